@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A client set up by hand, or on a server the importers don't know, is
+// adopted by posting its config file to POST /users/import/config?name=.
+// The client's public key is derived from its private key; a config without
+// one, like a template kept without the device's key, can name the key in a
+// PublicKey line of its [Interface] section instead, and the stored config
+// then has an empty PrivateKey for the device to fill in. The peer gets the
+// config's addresses, and its preshared key and kill switch are kept, so
+// the device keeps working; the stored config is rendered for this server.
+
+// Largest config file accepted; real ones are a few hundred bytes
+const maxAdoptedConfigSize = 64 << 10
+
+var (
+	errAdoptedKeyManaged  = errors.New("a client with this public key is managed already")
+	errAdoptedAddressUsed = errors.New("address is used by another client")
+)
+
+// What an uploaded client config holds
+type adoptedConfig struct {
+	keys       clientKeys
+	ipv4       string
+	ipv6       string
+	killSwitch string
+	// Public key of the server the config was made for
+	serverKey string
+}
+
+// Read a client config file
+func parseAdoptedConfig(config []byte) (adoptedConfig, error) {
+	var adopted adoptedConfig
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(line)
+			continue
+		}
+		// A commented public key is as good as one wg-quick would reject
+		if section == "[interface]" && strings.HasPrefix(line, "#") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			if !strings.HasPrefix(strings.ToLower(line), "publickey") {
+				continue
+			}
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		switch section + key {
+		case "[interface]privatekey":
+			adopted.keys.privateKey = value
+		case "[interface]publickey":
+			adopted.keys.publicKey = value
+		case "[interface]address":
+			for _, entry := range splitList(value) {
+				addr, err := netip.ParseAddr(strings.SplitN(entry, "/", 2)[0])
+				if err != nil {
+					return adopted, fmt.Errorf("Address %q is not an IP address", entry)
+				}
+				if addr.Is4() && adopted.ipv4 == "" {
+					adopted.ipv4 = addr.String()
+				} else if addr.Is6() && adopted.ipv6 == "" {
+					adopted.ipv6 = addr.String()
+				}
+			}
+		case "[peer]publickey":
+			adopted.serverKey = value
+		case "[peer]presharedkey":
+			adopted.keys.preSharedKey = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return adopted, fmt.Errorf("Invalid config: %v", err)
+	}
+
+	if adopted.keys.privateKey == "" && adopted.keys.publicKey == "" {
+		return adopted, errors.New("The config has no PrivateKey, nor a PublicKey in its [Interface] section")
+	}
+	if adopted.keys.privateKey == "" && !wgKeyRegex.MatchString(adopted.keys.publicKey) {
+		return adopted, errors.New("PublicKey is not a WireGuard key")
+	}
+	if errs := validateClientAddresses(adopted.ipv4, adopted.ipv6); len(errs) > 0 {
+		return adopted, errs.err()
+	}
+	adopted.killSwitch = configKillSwitch(string(config))
+	return adopted, nil
+}
+
+// Register the client of an uploaded config under name. Addresses missing
+// from the config are allocated. Returns the stored client.
+func adoptClient(name string, adopted adoptedConfig) (Client, error) {
+	// Deriving the key shells out, so it happens before taking the lock
+	if adopted.keys.privateKey != "" {
+		publicKey, err := derivePublicKey(adopted.keys.privateKey)
+		if err != nil {
+			return Client{}, fmt.Errorf("failed to derive public key: %v", err)
+		}
+		adopted.keys.publicKey = publicKey
+	}
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	exists, err := clientExists(name)
+	if err != nil {
+		return Client{}, err
+	}
+	if exists {
+		return Client{}, errClientExists
+	}
+	if owner, ok := clientNamesByPublicKey()[adopted.keys.publicKey]; ok {
+		return Client{}, fmt.Errorf("%w as %s", errAdoptedKeyManaged, owner)
+	}
+	inv, err := currentInventory()
+	if err != nil {
+		return Client{}, err
+	}
+	for _, address := range []string{adopted.ipv4, adopted.ipv6} {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			continue
+		}
+		if owner, ok := inv.byAddr[addr]; ok {
+			return Client{}, fmt.Errorf("%w: %s has %s", errAdoptedAddressUsed, owner, address)
+		}
+	}
+
+	ipv4, ipv6, err := allocateClientIPsLocked(adopted.ipv4, adopted.ipv6)
+	if err != nil {
+		return Client{}, err
+	}
+	config, err := createWireGuardClientLocked(name, ipv4, ipv6, adopted.keys, nil, adopted.killSwitch)
+	if err != nil {
+		return Client{}, err
+	}
+	if err := syncWireGuardConf(); err != nil {
+		return Client{}, fmt.Errorf("failed to sync WireGuard config: %w", err)
+	}
+
+	return Client{
+		Name:      name,
+		IPV4:      ipv4,
+		IPV6:      ipv6,
+		PublicKey: adopted.keys.publicKey,
+		Config:    config,
+	}, nil
+}
+
+// Handler for POST /users/import/config, adopting the client of the config
+// file in the body
+func adoptClientHandlerGin(c *gin.Context) {
+	name := c.Query("name")
+	if !validClientName(name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Client name " + clientNameMessage(),
+			Code:    codeInvalidName,
+		})
+		return
+	}
+	config, err := io.ReadAll(io.LimitReader(c.Request.Body, maxAdoptedConfigSize+1))
+	if err != nil || len(config) > maxAdoptedConfigSize {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "The body must be a client config file",
+		})
+		return
+	}
+	adopted, err := parseAdoptedConfig(config)
+	if err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	if !reserveCreates(c, 1) {
+		return
+	}
+	client, err := adoptClient(name, adopted)
+	if err != nil {
+		releaseCreates(c, 1)
+	}
+	switch {
+	case errors.Is(err, errClientExists):
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: clientExistsMessage,
+			Code:    codeNameTaken,
+		})
+	case errors.Is(err, errAdoptedKeyManaged), errors.Is(err, errAdoptedAddressUsed):
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "Can't adopt the client: " + err.Error(),
+		})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+	default:
+		message := "Client adopted successfully"
+		if adopted.serverKey != "" && adopted.serverKey != wgParams.ServerPubKey {
+			message = "Client adopted; its config was made for another server, so hand out the new one"
+		}
+		respondCreated(c, "/users/"+url.PathEscape(name), message, client)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func (e *testEnv) adoptConfig(t *testing.T, name, config string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/users/import/config?name="+name, strings.NewReader(config))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("key", "test-token")
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdoptClientConfig(t *testing.T) {
+	env := setupTestEnv(t)
+
+	config := `[Interface]
+PrivateKey = alice-private-key
+Address = 10.66.0.50/24
+DNS = 9.9.9.9
+
+[Peer]
+PublicKey = old-server-key
+PresharedKey = alice-psk
+Endpoint = old.example.com:51820
+AllowedIPs = 0.0.0.0/0
+`
+	rec := env.adoptConfig(t, "alice", config)
+	var resp struct {
+		Message string `json:"message"`
+		Data    Client `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("adopt: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if resp.Data.PublicKey != "pub-alice-private-key" || resp.Data.IPV4 != "10.66.0.50" || !strings.Contains(resp.Message, "another server") {
+		t.Errorf("got %+v, %q", resp.Data, resp.Message)
+	}
+	server := env.configContent(t)
+	for _, want := range []string{"### Client alice\n", "PublicKey = pub-alice-private-key", "PresharedKey = alice-psk", "AllowedIPs = 10.66.0.50/32"} {
+		if !strings.Contains(server, want) {
+			t.Errorf("server config lacks %q:\n%s", want, server)
+		}
+	}
+	stored := readFile(t, clientConfigFile("alice"))
+	if !strings.Contains(stored, "PrivateKey = alice-private-key") || !strings.Contains(stored, "Endpoint = 203.0.113.10:51820") {
+		t.Errorf("stored config:\n%s", stored)
+	}
+
+	if rec := env.adoptConfig(t, "alice2", config); rec.Code != http.StatusConflict {
+		t.Errorf("same key again: got status %d, want 409", rec.Code)
+	}
+	if rec := env.adoptConfig(t, "bob", "[Interface]\nPrivateKey = bob-private-key\nAddress = 10.66.0.50/32\n"); rec.Code != http.StatusConflict {
+		t.Errorf("address in use: got status %d, want 409", rec.Code)
+	}
+	if rec := env.adoptConfig(t, "bob", "[Interface]\nAddress = 10.66.0.51/32\n"); rec.Code != http.StatusBadRequest {
+		t.Errorf("no key: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestAdoptClientConfigWithoutPrivateKey(t *testing.T) {
+	env := setupTestEnv(t)
+	publicKey := "a2tra2tra2tra2tra2tra2tra2tra2tra2tra2tra2s="
+
+	rec := env.adoptConfig(t, "phone", "[Interface]\n# PublicKey = "+publicKey+"\n\n[Peer]\nPublicKey = server-public-key\n")
+	var resp struct {
+		Message string `json:"message"`
+		Data    Client `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("adopt: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if resp.Data.PublicKey != publicKey || resp.Data.IPV4 == "" || resp.Message != "Client adopted successfully" {
+		t.Errorf("got %+v, %q", resp.Data, resp.Message)
+	}
+	if stored := readFile(t, clientConfigFile("phone")); !strings.Contains(stored, "PrivateKey = \n") {
+		t.Errorf("stored config:\n%s", stored)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Failed requests carry a machine-readable code next to the message, so
+// API consumers can branch on it without parsing English. Handlers set the
+// specific codes below where they know the cause, errors from deeper down
+// carry theirs through errorCode, and every other failure gets the code of
+// its HTTP status from errorCodeMiddleware. The codes are part of the API:
+// add new ones, never rename them.
+
+const (
+	codeInvalidRequest       = "INVALID_REQUEST"
+	codeInvalidFields        = "INVALID_FIELDS"
+	codeInvalidName          = "INVALID_NAME"
+	codeUnauthorized         = "UNAUTHORIZED"
+	codeForbidden            = "FORBIDDEN"
+	codeNotFound             = "NOT_FOUND"
+	codeClientNotFound       = "CLIENT_NOT_FOUND"
+	codeConflict             = "CONFLICT"
+	codeNameTaken            = "NAME_TAKEN"
+	codePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	codeConfirmationRequired = "CONFIRMATION_REQUIRED"
+	codeRateLimited          = "RATE_LIMITED"
+	codeQuotaExceeded        = "QUOTA_EXCEEDED"
+	codeTenantLimit          = "TENANT_LIMIT"
+	codeOutsideTenantPool    = "OUTSIDE_TENANT_POOL"
+	codeSubnetExhausted      = "SUBNET_EXHAUSTED"
+	codeSyncFailed           = "SYNC_FAILED"
+	codeNotLeader            = "NOT_LEADER"
+	codeMaintenance          = "MAINTENANCE"
+	codeReadOnly             = "READ_ONLY"
+	codeChangesExpired       = "CHANGES_EXPIRED"
+	codeAuditTampered        = "AUDIT_TAMPERED"
+	codeHookRejected         = "HOOK_REJECTED"
+	codeOutsideWindow        = "OUTSIDE_MAINTENANCE_WINDOW"
+	codeInternal             = "INTERNAL_ERROR"
+	codeUpstreamFailed       = "UPSTREAM_FAILED"
+	codeUnavailable          = "UNAVAILABLE"
+	codeTimeout              = "TIMEOUT"
+)
+
+// The code of failures nothing more specific is known about
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            codeInvalidRequest,
+	http.StatusUnauthorized:          codeUnauthorized,
+	http.StatusForbidden:             codeForbidden,
+	http.StatusNotFound:              codeNotFound,
+	http.StatusConflict:              codeConflict,
+	http.StatusRequestEntityTooLarge: codePayloadTooLarge,
+	http.StatusUnprocessableEntity:   codeInvalidFields,
+	http.StatusPreconditionRequired:  codeConfirmationRequired,
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusInternalServerError:   codeInternal,
+	http.StatusBadGateway:            codeUpstreamFailed,
+	http.StatusServiceUnavailable:    codeUnavailable,
+	http.StatusGatewayTimeout:        codeTimeout,
+}
+
+func statusErrorCode(status int) string {
+	if code, ok := statusErrorCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return codeInternal
+	}
+	return codeInvalidRequest
+}
+
+// An error whose code is known where it happens, with the message of the
+// error it wraps
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+func withCode(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// The code of err, "" when it has none and the status' code applies
+func errorCode(err error) string {
+	var coded *codedError
+	var fields fieldErrors
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &coded):
+		return coded.code
+	case errors.As(err, &fields):
+		return codeInvalidFields
+	case errors.Is(err, errClientExists):
+		return codeNameTaken
+	case errors.Is(err, errClientNotFound):
+		return codeClientNotFound
+	case errors.Is(err, errTenantLimit):
+		return codeTenantLimit
+	case errors.Is(err, errOutsideTenantIP):
+		return codeOutsideTenantPool
+	}
+	return ""
+}
+
+// The status of a client or service change that failed with err: 409 when
+// a pre hook refused it, 500 otherwise
+func changeErrorStatus(err error) int {
+	if errorCode(err) == codeHookRejected {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// Holds back error responses until their code is filled in
+type errorCodeWriter struct {
+	gin.ResponseWriter
+	failed bool
+	body   bytes.Buffer
+}
+
+func (w *errorCodeWriter) WriteHeader(status int) {
+	w.failed = status >= http.StatusBadRequest
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorCodeWriter) Write(b []byte) (int, error) {
+	if w.failed {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorCodeWriter) WriteString(s string) (int, error) {
+	if w.failed {
+		return w.body.WriteString(s)
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Give failed API responses without a code the one of their status
+func errorCodeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		writer := &errorCodeWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		if !writer.failed {
+			return
+		}
+		body := writer.body.Bytes()
+		mediaType, _, _ := mime.ParseMediaType(c.Writer.Header().Get("Content-Type"))
+		if mediaType == gin.MIMEJSON {
+			if coded, ok := addErrorCode(body, c.Writer.Status()); ok {
+				body = coded
+			}
+		}
+		c.Writer.Write(body)
+	}
+}
+
+// The APIResponse in body with the status' code if it had none; false for
+// other bodies, which are left alone
+func addErrorCode(body []byte, status int) ([]byte, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || string(fields["success"]) != "false" || fields["code"] != nil {
+		return nil, false
+	}
+	var resp struct {
+		APIResponse
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, false
+	}
+	resp.APIResponse.Code = statusErrorCode(status)
+	if resp.Data != nil {
+		resp.APIResponse.Data = resp.Data
+	}
+	coded, err := json.Marshal(resp.APIResponse)
+	if err != nil {
+		return nil, false
+	}
+	if bytes.HasSuffix(body, []byte("\n")) {
+		coded = append(coded, '\n')
+	}
+	return coded, true
+}
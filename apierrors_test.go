@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func responseCode(t *testing.T, body []byte) APIResponse {
+	t.Helper()
+	var resp APIResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decoding response: %v: %s", err, body)
+	}
+	return resp
+}
+
+func TestErrorCodes(t *testing.T) {
+	env := setupTestEnv(t)
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}); rec.Code != http.StatusOK {
+		t.Fatalf("seeding alice: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		body         any
+		token        string
+		status       int
+		code         string
+	}{
+		{http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}, "test-token", http.StatusConflict, codeNameTaken},
+		{http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "not a name"}, "test-token", http.StatusBadRequest, codeInvalidName},
+		{http.MethodGet, "/api/v1/users/bob", nil, "test-token", http.StatusNotFound, codeClientNotFound},
+		// Unknown tokens get a bare 404, coded by the middleware
+		{http.MethodGet, "/api/v1/users", nil, "wrong-token", http.StatusNotFound, codeNotFound},
+	} {
+		rec := env.request(t, tc.method, tc.path, tc.body, tc.token)
+		resp := responseCode(t, rec.Body.Bytes())
+		if rec.Code != tc.status || resp.Code != tc.code || resp.Success {
+			t.Errorf("%s %s: got status %d, code %q, want %d, %q: %s", tc.method, tc.path, rec.Code, resp.Code, tc.status, tc.code, rec.Body.String())
+		}
+	}
+
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/users", nil); strings.Contains(rec.Body.String(), `"code"`) {
+		t.Errorf("successful responses carry no code: %s", rec.Body.String())
+	}
+}
+
+func TestSyncFailureErrorCode(t *testing.T) {
+	env := setupTestEnv(t)
+	if err := os.WriteFile(filepath.Join(env.dir, "sync_fail"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	if resp := responseCode(t, rec.Body.Bytes()); rec.Code != http.StatusInternalServerError || resp.Code != codeSyncFailed {
+		t.Errorf("got status %d, code %q, want 500, %s: %s", rec.Code, resp.Code, codeSyncFailed, rec.Body.String())
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code string
+	}{
+		{nil, ""},
+		{errors.New("boom"), ""},
+		{fmt.Errorf("adding alice: %w", withCode(codeSubnetExhausted, errors.New("no free IPv4 address"))), codeSubnetExhausted},
+		{fmt.Errorf("adding alice: %w", errClientExists), codeNameTaken},
+		{fieldErrors{{Field: "ipv4", Message: "bad"}}, codeInvalidFields},
+	} {
+		if got := errorCode(tc.err); got != tc.code {
+			t.Errorf("errorCode(%v) = %q, want %q", tc.err, got, tc.code)
+		}
+	}
+}
+
+func TestAddErrorCode(t *testing.T) {
+	coded, ok := addErrorCode([]byte(`{"success":false,"message":"nope","data":{"id":7}}`+"\n"), http.StatusNotFound)
+	if !ok || string(coded) != `{"success":false,"message":"nope","code":"NOT_FOUND","data":{"id":7}}`+"\n" {
+		t.Errorf("got %v, %s", ok, coded)
+	}
+
+	for _, body := range []string{
+		`{"success":false,"message":"nope","code":"NAME_TAKEN"}`,
+		`{"success":true}`,
+		`{"schemas":["urn:ietf:params:scim:api:messages:2.0:Error"],"status":"404"}`,
+		`not json`,
+	} {
+		if _, ok := addErrorCode([]byte(body), http.StatusNotFound); ok {
+			t.Errorf("%s: must be left alone", body)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API_TOKEN can be rotated without downtime: while API_TOKEN_SECONDARY is
+// set both tokens have full access. A new token is added as the secondary,
+// clients move over to it, and then the old one is revoked, which makes the
+// secondary the primary. This works through /tokens, which keeps the tokens
+// in API_TOKENS_FILE so they survive a restart, or by editing the settings.
+// Tokens read from a secret manager are rotated there; /tokens only reports
+// on them.
+
+// Shortest token /tokens/secondary accepts
+const minAPITokenLength = 16
+
+// Both slots as stored in API_TOKENS_FILE
+type apiTokensFile struct {
+	Primary   string `json:"primary"`
+	Secondary string `json:"secondary,omitempty"`
+}
+
+// A token as listed by the API, never the token itself
+type APITokenStatus struct {
+	Fingerprint string     `json:"fingerprint"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+}
+
+type AddAPITokenRequest struct {
+	Token string `json:"token"` // Generated when empty
+}
+
+type RevokeAPITokenRequest struct {
+	Token string `json:"token" binding:"required"` // "primary" or "secondary"
+}
+
+var (
+	// Serializes changes to the tokens and their file
+	apiTokensMutex sync.Mutex
+
+	// When each admin token was last used, by fingerprint, so it shows
+	// whether clients still use the old one
+	apiTokenUse = struct {
+		mu       sync.Mutex
+		lastUsed map[string]time.Time
+	}{lastUsed: map[string]time.Time{}}
+)
+
+// API_TOKENS_FILE, or api-tokens.json next to the server config
+func apiTokensFilePath() string {
+	if API_TOKENS_FILE != "" {
+		return API_TOKENS_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "api-tokens.json")
+}
+
+// Whether the tokens come from a secret manager rather than the API
+func apiTokensFromSecretManager() bool {
+	_, primary := secretSources["API_TOKEN"]
+	_, secondary := secretSources["API_TOKEN_SECONDARY"]
+	return primary || secondary
+}
+
+// Take the tokens last set through the API over those in the environment
+func loadAPITokens() error {
+	if apiTokensFromSecretManager() {
+		return nil
+	}
+	content, err := os.ReadFile(apiTokensFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read API tokens file: %v", err)
+	}
+	var tokens apiTokensFile
+	if err := json.Unmarshal(content, &tokens); err != nil {
+		return fmt.Errorf("failed to parse API tokens file: %v", err)
+	}
+	if tokens.Primary == "" {
+		return fmt.Errorf("API tokens file has no primary token")
+	}
+	API_TOKEN, API_TOKEN_SECONDARY = tokens.Primary, tokens.Secondary
+	return nil
+}
+
+// Caller holds apiTokensMutex
+func saveAPITokensLocked(primary, secondary string) error {
+	content, err := json.MarshalIndent(apiTokensFile{Primary: primary, Secondary: secondary}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(apiTokensFilePath(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write API tokens file: %v", err)
+	}
+
+	secretsMutex.Lock()
+	API_TOKEN, API_TOKEN_SECONDARY = primary, secondary
+	secretsMutex.Unlock()
+	return nil
+}
+
+// Whether the token is the primary or the secondary API token
+func isAPIToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	return token == API_TOKEN || token == API_TOKEN_SECONDARY
+}
+
+// callerKey of either API token
+const apiTokenCallerKey = "API_TOKEN"
+
+// The admin behind the request, whichever API token it used, so quotas
+// and rate limits don't double during a rotation
+func callerKey(c *gin.Context) string {
+	token := c.GetHeader("key")
+	if isAPIToken(token) {
+		return apiTokenCallerKey
+	}
+	return token
+}
+
+func apiTokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+func markAPITokenUsed(token string, now time.Time) {
+	apiTokenUse.mu.Lock()
+	apiTokenUse.lastUsed[apiTokenFingerprint(token)] = now.UTC()
+	apiTokenUse.mu.Unlock()
+}
+
+func apiTokenStatus(token string) *APITokenStatus {
+	if token == "" {
+		return nil
+	}
+	status := &APITokenStatus{Fingerprint: apiTokenFingerprint(token)}
+	apiTokenUse.mu.Lock()
+	if at, ok := apiTokenUse.lastUsed[status.Fingerprint]; ok {
+		status.LastUsedAt = &at
+	}
+	apiTokenUse.mu.Unlock()
+	return status
+}
+
+// Whether the token is already taken by another kind of caller
+func tokenInUse(token string) bool {
+	if isAPIToken(token) || approverTokens()[token] || readOnlyTokens()[token] || tenantsByToken[token] != nil {
+		return true
+	}
+	return token == secretValue(&SCIM_TOKEN)
+}
+
+func generateAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Handler listing the API tokens by fingerprint and when they were last used
+func listAPITokensHandlerGin(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"primary":             apiTokenStatus(secretValue(&API_TOKEN)),
+			"secondary":           apiTokenStatus(secretValue(&API_TOKEN_SECONDARY)),
+			"managed_by_secrets":  apiTokensFromSecretManager(),
+			"current_fingerprint": apiTokenFingerprint(c.GetHeader("key")),
+		},
+	})
+}
+
+// Refuse changes to tokens a secret manager owns
+func checkAPITokensManaged(c *gin.Context) bool {
+	if apiTokensFromSecretManager() {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "The API tokens are read from a secret manager; rotate them there",
+		})
+		return false
+	}
+	return true
+}
+
+// Handler adding a secondary token, generated unless given. It is only
+// returned this once.
+func addAPITokenHandlerGin(c *gin.Context) {
+	var req AddAPITokenRequest
+	if c.Request.ContentLength > 0 {
+		if !bindJSON(c, &req) {
+			return
+		}
+	}
+	if !checkAPITokensManaged(c) {
+		return
+	}
+
+	if req.Token == "" {
+		token, err := generateAPIToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+		req.Token = token
+	} else if len(req.Token) < minAPITokenLength {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Tokens must be at least %d characters", minAPITokenLength),
+		})
+		return
+	} else if tokenInUse(req.Token) {
+		c.JSON(conflictStatus(c), APIResponse{
+			Success: false,
+			Message: "Token is already in use",
+		})
+		return
+	}
+
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	if secretValue(&API_TOKEN_SECONDARY) != "" {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "A secondary token is already set; revoke one of the tokens first",
+		})
+		return
+	}
+	if err := saveAPITokensLocked(secretValue(&API_TOKEN), req.Token); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Secondary token added; both tokens are valid until one is revoked",
+		Data: map[string]interface{}{
+			"token":       req.Token,
+			"fingerprint": apiTokenFingerprint(req.Token),
+		},
+	})
+}
+
+// Handler revoking the primary or the secondary token. Revoking the
+// primary makes the secondary the primary. The request has to be made with
+// the token that stays, which proves the caller has moved over.
+func revokeAPITokenHandlerGin(c *gin.Context) {
+	var req RevokeAPITokenRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Token != "primary" && req.Token != "secondary" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "token must be primary or secondary",
+		})
+		return
+	}
+	if !checkAPITokensManaged(c) {
+		return
+	}
+
+	apiTokensMutex.Lock()
+	defer apiTokensMutex.Unlock()
+	primary, secondary := secretValue(&API_TOKEN), secretValue(&API_TOKEN_SECONDARY)
+	if secondary == "" {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "There is no secondary token; add one before revoking",
+		})
+		return
+	}
+
+	revoked, kept := secondary, primary
+	if req.Token == "primary" {
+		revoked, kept = primary, secondary
+	}
+	if c.GetHeader("key") != kept {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "Revoke a token using the other one",
+		})
+		return
+	}
+	if err := saveAPITokensLocked(kept, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Revoked the %s token", req.Token),
+		Data: map[string]interface{}{
+			"revoked": apiTokenFingerprint(revoked),
+			"primary": apiTokenStatus(kept),
+		},
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPITokenRotation(t *testing.T) {
+	env := setupTestEnv(t)
+
+	// Without a secondary there is nothing to revoke
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/tokens/revoke", RevokeAPITokenRequest{Token: "primary"}).Code; code != http.StatusConflict {
+		t.Errorf("revoke without secondary: got status %d, want 409", code)
+	}
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/tokens/secondary", nil)
+	var added struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &added); rec.Code != http.StatusOK || err != nil || len(added.Data.Token) < minAPITokenLength {
+		t.Fatalf("add secondary: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	newToken := added.Data.Token
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/tokens/secondary", AddAPITokenRequest{Token: "another-long-token"}).Code; code != http.StatusConflict {
+		t.Errorf("second secondary: got status %d, want 409", code)
+	}
+
+	// Both tokens work during the rotation
+	for _, token := range []string{"test-token", newToken} {
+		if code := env.request(t, http.MethodGet, "/api/v1/users", nil, token).Code; code != http.StatusOK {
+			t.Errorf("token %s: got status %d", token, code)
+		}
+	}
+
+	var tokens apiTokensFile
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(env.dir, "api-tokens.json"))), &tokens); err != nil ||
+		tokens.Primary != "test-token" || tokens.Secondary != newToken {
+		t.Errorf("unexpected tokens file: %+v, %v", tokens, err)
+	}
+
+	// The old token can't revoke itself; the new one proves the move
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/tokens/revoke", RevokeAPITokenRequest{Token: "primary"}).Code; code != http.StatusConflict {
+		t.Errorf("revoke with the old token: got status %d, want 409", code)
+	}
+	if rec := env.request(t, http.MethodPost, "/api/v1/tokens/revoke", RevokeAPITokenRequest{Token: "primary"}, newToken); rec.Code != http.StatusOK {
+		t.Fatalf("revoke primary: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if code := env.authedRequest(t, http.MethodGet, "/api/v1/users", nil).Code; code != http.StatusNotFound {
+		t.Errorf("revoked token: got status %d, want 404", code)
+	}
+	if API_TOKEN != newToken || API_TOKEN_SECONDARY != "" {
+		t.Errorf("the secondary must become the primary, got %q and %q", API_TOKEN, API_TOKEN_SECONDARY)
+	}
+
+	// The tokens survive a restart
+	API_TOKEN = "from-env"
+	if err := loadAPITokens(); err != nil || API_TOKEN != newToken {
+		t.Errorf("reloading: got %q, %v", API_TOKEN, err)
+	}
+}
+
+func TestAPITokenSecondaryValidation(t *testing.T) {
+	env := setupTestEnv(t)
+	setReadOnlyTokens(t, "reader-token-0123456789")
+	for _, token := range []string{"short", "test-token", "reader-token-0123456789"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/tokens/secondary", AddAPITokenRequest{Token: token}).Code; code != http.StatusBadRequest {
+			t.Errorf("token %q: got status %d, want 400", token, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(env.dir, "api-tokens.json")); !os.IsNotExist(err) {
+		t.Errorf("nothing may be written for rejected tokens: %v", err)
+	}
+
+	// Tokens a secret manager owns are rotated there
+	secretSources = map[string]secretRef{"API_TOKEN": {provider: "aws-sm", name: "api"}}
+	t.Cleanup(func() { secretSources = map[string]secretRef{} })
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/tokens/secondary", nil).Code; code != http.StatusConflict {
+		t.Errorf("secret manager tokens: got status %d, want 409", code)
+	}
+}
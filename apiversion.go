@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /api/v2 serves the same routes as /api/v1 with standard HTTP semantics
+// for mutations: adding a client, project or group answers 201 Created with
+// the new resource and a Location header, deleting one answers 204 No
+// Content, and conflicts answer 409. Clients can also be added with POST
+// /users and deleted with DELETE /users/{name}. /api/v1 keeps answering 200
+// so existing integrations don't break.
+
+// Whether the request uses the /api/v2 semantics. Known from routing, so
+// the global middlewares can tell too.
+func apiV2(c *gin.Context) bool {
+	return strings.HasPrefix(c.FullPath(), "/api/v2/")
+}
+
+// The routes only /api/v2 has, on top of registerAPIRoutes
+func registerAPIV2Routes(api *gin.RouterGroup) {
+	api.POST("/users", addUserHandlerGin)
+	api.DELETE("/users/:name", deleteUserByNameHandlerGin)
+}
+
+// Answer a created resource: 201 with its Location, a path relative to the
+// version's base, under /api/v2 and 200 under /api/v1
+func respondCreated(c *gin.Context, location, message string, data interface{}) {
+	status := http.StatusOK
+	if apiV2(c) {
+		status = http.StatusCreated
+		c.Header("Location", "/api/v2"+location)
+	}
+	c.JSON(status, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    data,
+	})
+}
+
+// Answer a deleted resource: 204 without a body under /api/v2 and 200 with
+// the message under /api/v1
+func respondDeleted(c *gin.Context, message string) {
+	if apiV2(c) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+	})
+}
+
+// Status of a request that conflicts with the current state, which /api/v1
+// answered with 400 in places
+func conflictStatus(c *gin.Context) int {
+	if apiV2(c) {
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
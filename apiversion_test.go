@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIV2CreatedAndDeleted(t *testing.T) {
+	env := setupTestEnv(t)
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v2/users", AddUserRequest{Name: "alice"})
+	var created struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/api/v2/users/alice" {
+		t.Fatalf("add: got status %d, Location %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body.String())
+	}
+	if created.Data.Name != "alice" || !strings.HasPrefix(created.Data.PublicKey, "pub-") || created.Data.Config == "" {
+		t.Errorf("add must return the client with its public key: %+v", created.Data)
+	}
+
+	rec = env.authedRequest(t, http.MethodGet, "/api/v2/users/alice", nil)
+	var got struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if rec.Code != http.StatusOK || got.Data.PublicKey != created.Data.PublicKey {
+		t.Errorf("get: got status %d, public key %q, want %q", rec.Code, got.Data.PublicKey, created.Data.PublicKey)
+	}
+
+	rec = env.authedRequest(t, http.MethodPost, "/api/v2/users/add", AddUserRequest{Name: "alice"})
+	if rec.Code != http.StatusConflict {
+		t.Errorf("duplicate: got status %d, want 409", rec.Code)
+	}
+
+	rec = env.authedRequest(t, http.MethodDelete, "/api/v2/users/alice", nil)
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Errorf("delete: got status %d: %q", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodDelete, "/api/v2/users/alice", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("delete twice: got status %d, want 404", rec.Code)
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v2/users", AddUserRequest{Name: "bob"})
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v2/users/delete", DeleteUserRequest{Name: "bob"}); rec.Code != http.StatusNoContent {
+		t.Errorf("delete by body: got status %d, want 204", rec.Code)
+	}
+
+	rec = env.authedRequest(t, http.MethodPost, "/api/v2/projects/add", ProjectRequest{Name: "cust-a"})
+	if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/api/v2/projects/cust-a" {
+		t.Errorf("project add: got status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v2/projects/delete", ProjectRequest{Name: "cust-a"}); rec.Code != http.StatusNoContent {
+		t.Errorf("project delete: got status %d, want 204", rec.Code)
+	}
+}
+
+func TestAPIV1KeepsStatusCodes(t *testing.T) {
+	env := setupTestEnv(t)
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	if rec.Code != http.StatusOK || rec.Header().Get("Location") != "" || !strings.Contains(rec.Body.String(), `"public_key":"pub-`) {
+		t.Errorf("add: got status %d, Location %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body.String())
+	}
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Client deleted successfully") {
+		t.Errorf("delete: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodDelete, "/api/v1/users/alice", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE is /api/v2 only: got status %d", rec.Code)
+	}
+}
+
+func TestAPIV2IdempotentReplayKeepsLocation(t *testing.T) {
+	env := setupTestEnv(t)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/v2/users", strings.NewReader(`{"name": "alice"}`))
+		req.Header.Set("key", "test-token")
+		req.Header.Set("Idempotency-Key", "add-alice")
+		rec := httptest.NewRecorder()
+		env.router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/api/v2/users/alice" {
+			t.Errorf("attempt %d: got status %d, Location %q", i+1, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestAPIV2RouteChecks(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+
+	rec := env.request(t, http.MethodPost, "/api/v2/users", AddUserRequest{Name: "alice"}, "acme-token")
+	if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/api/v2/users/alice" {
+		t.Fatalf("tenant add: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.request(t, http.MethodDelete, "/api/v2/users/alice", nil, "acme-token"); rec.Code != http.StatusNoContent {
+		t.Errorf("tenant delete: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.request(t, http.MethodGet, "/api/v2/stats", nil, "acme-token"); rec.Code != http.StatusForbidden {
+		t.Errorf("tenant outside the client routes: got status %d, want 403", rec.Code)
+	}
+
+	CONFIRM_DESTRUCTIVE = confirmToken
+	t.Cleanup(func() { CONFIRM_DESTRUCTIVE = confirmOff })
+	env.authedRequest(t, http.MethodPost, "/api/v2/users", AddUserRequest{Name: "bob"})
+	if rec := env.authedRequest(t, http.MethodDelete, "/api/v2/users/bob", nil); rec.Code != http.StatusPreconditionRequired {
+		t.Errorf("unconfirmed delete: got status %d, want 428", rec.Code)
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every request that may change something is recorded in AUDIT_LOG_FILE
+// with who made it, so "who deleted client X" has an answer even with
+// several automations sharing the API. Refused requests are recorded too.
+// Each entry is also POSTed to AUDIT_WEBHOOK when set, and every
+// authenticated response names the caller in X-Acted-By.
+//
+// The log is append-only and hash-chained: each entry carries the
+// previous entry's hash and its own, over everything else in it, so an
+// entry changed, removed or inserted afterwards breaks the chain, which
+// GET /audit/verify finds. Rewriting the whole chain from the change on
+// isn't caught by the file alone; the hashes sent to AUDIT_WEBHOOK, or
+// noted elsewhere, can be checked against it with ?seq=&hash=.
+//
+// Who made a request is the identity of its token. TOKEN_NAMES names
+// tokens by fingerprint, the first 8 hex digits of their SHA-256, so the
+// setting holds no secrets; an unnamed token goes by its kind and
+// fingerprint, e.g. "tenant:acme:1a2b3c4d".
+
+// Entries waiting for the webhook; the newest are dropped beyond this
+const auditQueueSize = 256
+
+// Most of a JSON body read for the client names in it
+const maxAuditedBodySize = 1 << 20
+
+// Default and most entries one GET /audit returns
+const (
+	defaultAuditPage = 100
+	maxAuditPage     = 1000
+)
+
+// A recorded request
+type AuditEntry struct {
+	Seq     int64     `json:"seq"`
+	At      time.Time `json:"at"`
+	ActedBy string    `json:"acted_by"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	// Relative to the API version prefix; the method name for gRPC
+	Route   string   `json:"route,omitempty"`
+	Clients []string `json:"clients,omitempty"`
+	// The HTTP status, or the gRPC status code for gRPC calls
+	Status int `json:"status"`
+	// Hash of the entry before, empty for the first
+	PrevHash string `json:"prev_hash"`
+	// SHA-256 of the entry with Hash empty, in hex
+	Hash string `json:"hash"`
+}
+
+// The end of the chain in a log file
+type auditChain struct {
+	// File the end was read from and its size then
+	path string
+	size int64
+	seq  int64
+	hash string
+}
+
+var (
+	// Serializes appends to the audit log
+	auditMutex sync.Mutex
+	// End of the chain as last written. Guarded by auditMutex.
+	auditTail auditChain
+
+	// Names from TOKEN_NAMES by token fingerprint
+	tokenNamesByFingerprint = map[string]string{}
+
+	auditQueue chan AuditEntry
+)
+
+// AUDIT_LOG_FILE, or audit.jsonl next to the server config
+func auditLogFile() string {
+	if AUDIT_LOG_FILE != "" {
+		return AUDIT_LOG_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "audit.jsonl")
+}
+
+// Parse TOKEN_NAMES, comma-separated fingerprint=name pairs
+func loadTokenNames() error {
+	names := map[string]string{}
+	for _, item := range splitList(TOKEN_NAMES) {
+		fingerprint, name, ok := strings.Cut(item, "=")
+		fingerprint, name = strings.ToLower(strings.TrimSpace(fingerprint)), strings.TrimSpace(name)
+		if !ok || name == "" || len(fingerprint) != 8 {
+			return fmt.Errorf("%q must be an 8 digit token fingerprint=name", item)
+		}
+		if _, err := strconv.ParseUint(fingerprint, 16, 32); err != nil {
+			return fmt.Errorf("%q must be an 8 digit token fingerprint=name", item)
+		}
+		names[fingerprint] = name
+	}
+	tokenNamesByFingerprint = names
+	return nil
+}
+
+// Who a token acts as: its name from TOKEN_NAMES, else its kind and
+// fingerprint
+func tokenIdentity(token string) string {
+	fingerprint := apiTokenFingerprint(token)
+	if name := tokenNamesByFingerprint[fingerprint]; name != "" {
+		return name
+	}
+	kind := "token"
+	switch {
+	case isAPIToken(token):
+		kind = "api-token"
+	case approverTokens()[token]:
+		kind = "approver"
+	case readOnlyTokens()[token]:
+		kind = "read-only"
+	case tenantsByToken[token] != nil:
+		kind = "tenant:" + tenantsByToken[token].Name
+	case token == secretValue(&SCIM_TOKEN):
+		kind = "scim"
+	}
+	return kind + ":" + fingerprint
+}
+
+// Record who the request acts as and tell the caller
+func setActedBy(c *gin.Context, identity string) {
+	c.Set("actedBy", identity)
+	c.Header("X-Acted-By", identity)
+}
+
+func actedBy(c *gin.Context) string {
+	return c.GetString("actedBy")
+}
+
+// Hash of the entry as its Hash field should hold
+func (e AuditEntry) chainHash() string {
+	e.Hash = ""
+	line, _ := json.Marshal(e)
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// Read the end of the chain when the file is new to us or another
+// instance sharing it wrote to it. A last line cut short by a crash is
+// ended, so the next entry starts on a line of its own; verification
+// reports it. Caller holds auditMutex.
+func (t *auditChain) loadLocked() error {
+	path := auditLogFile()
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read audit log: %v", err)
+	}
+	if info != nil && t.path == path && t.size == info.Size() {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read audit log: %v", err)
+	}
+	tail := auditChain{path: path, size: int64(len(content))}
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		var entry AuditEntry
+		if json.Unmarshal(line, &entry) == nil && entry.Seq > 0 {
+			tail.seq, tail.hash = entry.Seq, entry.Hash
+		}
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		if err := appendAuditLine(path, nil); err != nil {
+			return err
+		}
+		tail.size++
+	}
+	// Entries this process wrote are gone: chaining on from them leaves the
+	// gap in the file for verification to find
+	if t.path == path && t.seq > tail.seq {
+		log.Printf("Audit log %s lost entries %d to %d", path, tail.seq+1, t.seq)
+		tail.seq, tail.hash = t.seq, t.hash
+	}
+	*t = tail
+	return nil
+}
+
+func appendAuditLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+// Chain the entry onto the log
+func appendAudit(entry *AuditEntry) error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	if err := auditTail.loadLocked(); err != nil {
+		return err
+	}
+	entry.Seq, entry.PrevHash = auditTail.seq+1, auditTail.hash
+	entry.Hash = entry.chainHash()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := appendAuditLine(auditTail.path, line); err != nil {
+		return err
+	}
+	auditTail.seq, auditTail.hash = entry.Seq, entry.Hash
+	auditTail.size += int64(len(line)) + 1
+	return nil
+}
+
+// Append an entry to the audit log and queue it for the webhook. The
+// request was already handled, so a log that can't be written is only
+// logged.
+func recordAudit(entry AuditEntry) {
+	if err := appendAudit(&entry); err != nil {
+		log.Printf("Failed to record %s %s by %s in the audit log: %v", entry.Method, entry.Path, entry.ActedBy, err)
+	}
+
+	if auditQueue != nil {
+		select {
+		case auditQueue <- entry:
+		default:
+			log.Printf("Audit webhook: queue full, dropped %s %s by %s", entry.Method, entry.Path, entry.ActedBy)
+		}
+	}
+}
+
+// Send the entries to AUDIT_WEBHOOK when it is set, in order
+func startAuditWebhook() {
+	if AUDIT_WEBHOOK == "" {
+		return
+	}
+	queue := make(chan AuditEntry, auditQueueSize)
+	auditQueue = queue
+	go func() {
+		for entry := range queue {
+			if err := postWebhook(AUDIT_WEBHOOK, entry); err != nil {
+				log.Printf("Audit webhook: %s %s by %s: %v", entry.Method, entry.Path, entry.ActedBy, err)
+			}
+		}
+	}()
+}
+
+// A body read ahead, followed by the rest of the original
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// The clients a request names: the :name in its path, and "name" or
+// "names" in its JSON body, as stored
+func auditedClients(c *gin.Context) []string {
+	var names []string
+	if name := c.Param("name"); name != "" {
+		names = append(names, name)
+	}
+	if c.Request.Body != nil && c.ContentType() == "application/json" {
+		peeked, _ := io.ReadAll(io.LimitReader(c.Request.Body, maxAuditedBodySize))
+		c.Request.Body = peekedBody{io.MultiReader(bytes.NewReader(peeked), c.Request.Body), c.Request.Body}
+		var body struct {
+			Name  string   `json:"name"`
+			Names []string `json:"names"`
+		}
+		if json.Unmarshal(peeked, &body) == nil {
+			if body.Name != "" {
+				names = append(names, body.Name)
+			}
+			names = append(names, body.Names...)
+		}
+	}
+
+	tenant := tenantFrom(c)
+	for i, name := range names {
+		names[i] = tenant.storedName(name)
+	}
+	return names
+}
+
+// Record the requests that may change something, after the caller's
+// identity is known. Reads, POSTs that only read included, aren't
+// recorded; GraphQL is, as it may carry mutations.
+func auditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		route := apiRoute(c)
+		if c.FullPath() == "" || (postOnlyReads(c) && route != "POST /graphql") {
+			c.Next()
+			return
+		}
+
+		clients := auditedClients(c)
+		c.Next()
+		recordAudit(AuditEntry{
+			At:      time.Now().UTC(),
+			ActedBy: actedBy(c),
+			Method:  c.Request.Method,
+			Path:    c.Request.URL.Path,
+			Route:   route,
+			Clients: clients,
+			Status:  c.Writer.Status(),
+		})
+	}
+}
+
+// Whether the request named the client
+func (e AuditEntry) names(client string) bool {
+	for _, name := range e.Clients {
+		if name == client {
+			return true
+		}
+	}
+	return false
+}
+
+// The entries in the audit log, oldest first. Lines that can't be parsed,
+// as one cut short by a crash, are skipped.
+func readAuditLog() ([]AuditEntry, error) {
+	content, err := os.ReadFile(auditLogFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Handler for GET /audit?client=&acted_by=&limit=, newest first
+func auditHandlerGin(c *gin.Context) {
+	limit := defaultAuditPage
+	if value := c.Query("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditPage {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("limit must be between 1 and %d", maxAuditPage),
+			})
+			return
+		}
+	}
+	client, by := c.Query("client"), c.Query("acted_by")
+
+	auditMutex.Lock()
+	entries, err := readAuditLog()
+	auditMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	page := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0 && len(page) < limit; i-- {
+		entry := entries[i]
+		if by != "" && entry.ActedBy != by {
+			continue
+		}
+		if client != "" && !entry.names(client) {
+			continue
+		}
+		page = append(page, entry)
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    page,
+	})
+}
+
+// Where the chain first breaks
+type AuditBreak struct {
+	// Line of the log file, from 1
+	Line   int    `json:"line,omitempty"`
+	Seq    int64  `json:"seq,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Outcome of checking the chain
+type AuditVerification struct {
+	Valid    bool        `json:"valid"`
+	Entries  int         `json:"entries"`
+	LastSeq  int64       `json:"last_seq"`
+	LastHash string      `json:"last_hash,omitempty"`
+	Broken   *AuditBreak `json:"broken,omitempty"`
+}
+
+// Check the chain in content: every line an entry, numbered on from the
+// one before and linked to its hash, and every hash over its entry. With
+// anchorSeq set, that entry must also have anchorHash. A chain shorter
+// than written is only noticed while this process knows its end.
+func verifyAuditChain(content []byte, tail auditChain, anchorSeq int64, anchorHash string) AuditVerification {
+	var result AuditVerification
+	broken := func(line int, seq int64, format string, args ...interface{}) AuditVerification {
+		result.Broken = &AuditBreak{Line: line, Seq: seq, Reason: fmt.Sprintf(format, args...)}
+		return result
+	}
+
+	anchorFound := false
+	lines := bytes.Split(content, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return broken(i+1, 0, "not an audit entry")
+		}
+		if entry.Seq != result.LastSeq+1 {
+			return broken(i+1, entry.Seq, "entry %d follows entry %d", entry.Seq, result.LastSeq)
+		}
+		if entry.PrevHash != result.LastHash {
+			return broken(i+1, entry.Seq, "prev_hash isn't the hash of entry %d", result.LastSeq)
+		}
+		if entry.Hash != entry.chainHash() {
+			return broken(i+1, entry.Seq, "hash doesn't match the entry")
+		}
+		if anchorSeq == entry.Seq {
+			if entry.Hash != anchorHash {
+				return broken(i+1, entry.Seq, "hash isn't the one given for entry %d", anchorSeq)
+			}
+			anchorFound = true
+		}
+		result.Entries++
+		result.LastSeq, result.LastHash = entry.Seq, entry.Hash
+	}
+
+	if tail.seq > result.LastSeq {
+		return broken(0, result.LastSeq+1, "entries %d to %d were written but are gone", result.LastSeq+1, tail.seq)
+	}
+	if anchorSeq > 0 && !anchorFound {
+		return broken(0, anchorSeq, "entry %d isn't in the log", anchorSeq)
+	}
+	result.Valid = true
+	return result
+}
+
+// Handler for GET /audit/verify, optionally with ?seq=&hash= of an entry
+// whose hash was kept elsewhere
+func verifyAuditHandlerGin(c *gin.Context) {
+	var anchorSeq int64
+	anchorHash := c.Query("hash")
+	if value := c.Query("seq"); value != "" || anchorHash != "" {
+		var err error
+		anchorSeq, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || anchorSeq < 1 || anchorHash == "" {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "seq and hash must be given together, seq as an entry number",
+			})
+			return
+		}
+	}
+
+	auditMutex.Lock()
+	content, err := os.ReadFile(auditLogFile())
+	var tail auditChain
+	if auditTail.path == auditLogFile() {
+		tail = auditTail
+	}
+	auditMutex.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("failed to read audit log: %v", err),
+		})
+		return
+	}
+
+	result := verifyAuditChain(content, tail, anchorSeq, anchorHash)
+	if !result.Valid {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "The audit log was tampered with: " + result.Broken.Reason,
+			Code:    codeAuditTampered,
+			Data:    result,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("The audit log's %d entries are intact", result.Entries),
+		Data:    result,
+	})
+}
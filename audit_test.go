@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setTokenNames(t *testing.T, names string) {
+	t.Helper()
+	old := TOKEN_NAMES
+	t.Cleanup(func() {
+		TOKEN_NAMES = old
+		tokenNamesByFingerprint = map[string]string{}
+	})
+	TOKEN_NAMES = names
+	if err := loadTokenNames(); err != nil {
+		t.Fatalf("loadTokenNames: %v", err)
+	}
+}
+
+func auditEntries(t *testing.T, env *testEnv, query string) []AuditEntry {
+	t.Helper()
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/audit"+query, nil)
+	var resp struct {
+		Data []AuditEntry `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("audit: status %d, %s", rec.Code, rec.Body.String())
+	}
+	return resp.Data
+}
+
+func TestAuditRecordsWhoActed(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+	setTokenNames(t, apiTokenFingerprint("test-token")+"=ci-pipeline")
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Acted-By") != "ci-pipeline" {
+		t.Fatalf("add: status %d, acted by %q", rec.Code, rec.Header().Get("X-Acted-By"))
+	}
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodGet, "/api/v1/users", nil)
+	tenant := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}, "globex-token")
+	globex := "tenant:globex:" + apiTokenFingerprint("globex-token")
+	if tenant.Header().Get("X-Acted-By") != globex {
+		t.Errorf("tenant acted by %q, want %q", tenant.Header().Get("X-Acted-By"), globex)
+	}
+
+	// Newest first, the refused add included, the read left out
+	entries := auditEntries(t, env, "?client=alice")
+	want := []struct {
+		route  string
+		status int
+	}{{"POST /users/delete", http.StatusOK}, {"POST /users/add", http.StatusConflict}, {"POST /users/add", http.StatusOK}}
+	if len(entries) != len(want) {
+		t.Fatalf("got %+v", entries)
+	}
+	for i, entry := range entries {
+		if entry.Route != want[i].route || entry.Status != want[i].status || entry.ActedBy != "ci-pipeline" || entry.At.IsZero() {
+			t.Errorf("entry %d: got %+v", i, entry)
+		}
+	}
+	if entries := auditEntries(t, env, "?client=globex.alice"); len(entries) != 1 || entries[0].ActedBy != globex {
+		t.Errorf("tenant entries: got %+v", entries)
+	}
+	if entries := auditEntries(t, env, "?acted_by="+globex); len(entries) != 1 {
+		t.Errorf("by identity: got %+v", entries)
+	}
+}
+
+func TestAuditCoversGRPCAndWebhook(t *testing.T) {
+	env := setupTestEnv(t)
+	received := make(chan AuditEntry, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var entry AuditEntry
+		json.NewDecoder(r.Body).Decode(&entry)
+		received <- entry
+	}))
+	defer webhook.Close()
+	oldURL, oldQueue := AUDIT_WEBHOOK, auditQueue
+	t.Cleanup(func() { AUDIT_WEBHOOK, auditQueue = oldURL, oldQueue })
+	AUDIT_WEBHOOK = webhook.URL
+	startAuditWebhook()
+	defer close(auditQueue)
+
+	server := newGRPCTestServer(t)
+	if _, status := grpcCall(t, server, "AddClient", "test-token", appendProtoString(nil, 1, "bob")); status != "0" {
+		t.Fatalf("grpc add: got grpc-status %q", status)
+	}
+	select {
+	case entry := <-received:
+		if entry.Method != "gRPC" || entry.Route != "AddClient" || len(entry.Clients) != 1 || entry.Clients[0] != "bob" ||
+			entry.ActedBy != "api-token:"+apiTokenFingerprint("test-token") {
+			t.Errorf("webhook got %+v", entry)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook got no entry")
+	}
+	if entries := auditEntries(t, env, "?client=bob"); len(entries) != 1 {
+		t.Errorf("got %+v", entries)
+	}
+}
+
+func TestTokenNamesMustBeFingerprints(t *testing.T) {
+	old := TOKEN_NAMES
+	t.Cleanup(func() { TOKEN_NAMES = old })
+	for _, names := range []string{"ci", "abc=ci", "zzzzzzzz=ci", "1a2b3c4d="} {
+		TOKEN_NAMES = names
+		if err := loadTokenNames(); err == nil {
+			t.Errorf("%q: want an error", names)
+		}
+	}
+}
+
+func verifyAudit(t *testing.T, env *testEnv, query string) (int, string, AuditVerification) {
+	t.Helper()
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/audit/verify"+query, nil)
+	var resp struct {
+		Code string            `json:"code"`
+		Data AuditVerification `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding verification: %v, %s", err, rec.Body.String())
+	}
+	return rec.Code, resp.Code, resp.Data
+}
+
+func TestAuditChainDetectsTampering(t *testing.T) {
+	env := setupTestEnv(t)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		addedClient(t, env, name)
+	}
+	code, _, result := verifyAudit(t, env, "")
+	if code != http.StatusOK || !result.Valid || result.Entries != 3 || result.LastSeq != 3 {
+		t.Fatalf("intact log: status %d, %+v", code, result)
+	}
+	entries := auditEntries(t, env, "")
+	if entries[0].PrevHash != entries[1].Hash || entries[2].PrevHash != "" {
+		t.Errorf("entries aren't chained: %+v", entries)
+	}
+	if code, _, _ := verifyAudit(t, env, fmt.Sprintf("?seq=2&hash=%s", entries[1].Hash)); code != http.StatusOK {
+		t.Errorf("kept hash: status %d", code)
+	}
+
+	path := auditLogFile()
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(original), "\n")
+
+	// An edited entry
+	edited := strings.Replace(lines[1], `"clients":["bob"]`, `"clients":["mallory"]`, 1)
+	writeAuditLog(t, lines[0], edited, lines[2])
+	code, errCode, result := verifyAudit(t, env, "")
+	if code != http.StatusConflict || errCode != codeAuditTampered || result.Broken == nil || result.Broken.Line != 2 {
+		t.Errorf("edited entry: status %d, %+v", code, result)
+	}
+
+	// A removed entry
+	writeAuditLog(t, lines[0], lines[2])
+	if _, _, result := verifyAudit(t, env, ""); result.Valid || result.Broken.Seq != 3 {
+		t.Errorf("removed entry: %+v", result)
+	}
+
+	// A cut tail is found while the process knows the end, and stays in the
+	// file once the chain goes on
+	writeAuditLog(t, lines[0])
+	if _, _, result := verifyAudit(t, env, ""); result.Valid || result.Broken.Seq != 2 {
+		t.Errorf("cut tail: %+v", result)
+	}
+	addedClient(t, env, "dave")
+	auditTail = auditChain{}
+	if _, _, result := verifyAudit(t, env, ""); result.Valid || result.Broken.Seq != 4 {
+		t.Errorf("cut tail after restart: %+v", result)
+	}
+
+	// A chain rewritten after a restart only fails against a hash kept
+	// elsewhere
+	forged := entries[2]
+	forged.Clients = []string{"mallory"}
+	forged.Hash = forged.chainHash()
+	line, _ := json.Marshal(forged)
+	writeAuditLog(t, string(line)+"\n")
+	if _, _, result := verifyAudit(t, env, ""); !result.Valid {
+		t.Errorf("forged chain: %+v", result)
+	}
+	if _, _, result := verifyAudit(t, env, fmt.Sprintf("?seq=1&hash=%s", entries[2].Hash)); result.Valid {
+		t.Errorf("forged chain against the kept hash: %+v", result)
+	}
+}
+
+func writeAuditLog(t *testing.T, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(auditLogFile(), []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
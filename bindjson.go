@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// Request bodies are decoded strictly: a field the request type doesn't
+// have, or a value of the wrong type, is refused rather than dropped. A
+// typo like "nmae" would otherwise leave the name empty and fail later with
+// a message about the name's characters. GraphQL and SCIM keep gin's
+// lenient binding, as their clients send members of their own.
+
+// Decode the JSON body into obj and validate it; on failure answer with
+// the problem and return false
+func bindJSON(c *gin.Context, obj interface{}) bool {
+	if err := decodeStrictJSON(c.Request, obj); err != nil {
+		respondValidationError(c, err)
+		return false
+	}
+	return true
+}
+
+func decodeStrictJSON(req *http.Request, obj interface{}) error {
+	if req == nil || req.Body == nil {
+		return errors.New("Request body is required")
+	}
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(obj); err != nil {
+		return jsonDecodeError(err, obj)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("Invalid JSON: unexpected data after the request object")
+	}
+
+	if binding.Validator == nil {
+		return nil
+	}
+	if err := binding.Validator.ValidateStruct(obj); err != nil {
+		var invalid validator.ValidationErrors
+		if !errors.As(err, &invalid) {
+			return err
+		}
+		var errs fieldErrors
+		for _, fe := range invalid {
+			field := jsonFieldPath(reflect.TypeOf(obj), fe.StructNamespace())
+			if fe.Tag() == "required" {
+				errs.add(field, "is required")
+			} else {
+				errs.add(field, "fails the %s check", fe.Tag())
+			}
+		}
+		return errs
+	}
+	return nil
+}
+
+// The decoder's error as the fields it concerns, where it names them
+func jsonDecodeError(err error, obj interface{}) error {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var errs fieldErrors
+	switch {
+	case errors.Is(err, io.EOF):
+		return errors.New("Request body is required")
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		errs.add(field, "must be %s, not %s", jsonTypeName(typeErr.Type), typeErr.Value)
+		return errs
+	case errors.As(err, &syntaxErr):
+		return fmt.Errorf("Invalid JSON at offset %d: %v", syntaxErr.Offset, err)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for these
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		if suggestion := closestJSONField(reflect.TypeOf(obj), field); suggestion != "" {
+			errs.add(field, "unknown field; did you mean %s?", suggestion)
+		} else {
+			errs.add(field, "unknown field")
+		}
+		return errs
+	}
+	return fmt.Errorf("Invalid JSON: %v", err)
+}
+
+// How a value of type t is spelled in JSON, for messages
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// The JSON name of a struct field, "" when it isn't decoded
+func jsonFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch {
+	case name == "-" || !f.IsExported():
+		return ""
+	case name == "":
+		return f.Name
+	}
+	return name
+}
+
+// The JSON path of a validator namespace like AddUserRequest.DNS.Servers[1]
+func jsonFieldPath(t reflect.Type, namespace string) string {
+	parts := strings.Split(namespace, ".")
+	path := make([]string, 0, len(parts))
+	for _, part := range parts[1:] {
+		name, index := part, ""
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name, index = part[:i], part[i:]
+		}
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			path = append(path, name+index)
+			continue
+		}
+		if f, ok := t.FieldByName(name); ok {
+			if jsonName := jsonFieldName(f); jsonName != "" {
+				name = jsonName
+			}
+			t = f.Type
+		}
+		path = append(path, name+index)
+	}
+	return strings.Join(path, ".")
+}
+
+// The field of the request type, or of the objects nested in it, a
+// misspelled name most likely meant; "" when none is close
+func closestJSONField(t reflect.Type, field string) string {
+	best, bestDistance := "", 3
+	for _, name := range jsonFieldNames(t, map[reflect.Type]bool{}) {
+		distance := editDistance(strings.ToLower(field), strings.ToLower(name))
+		if distance < bestDistance && distance*2 < len(field) {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+func jsonFieldNames(t reflect.Type, seen map[reflect.Type]bool) []string {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if name := jsonFieldName(t.Field(i)); name != "" {
+			names = append(names, name)
+			names = append(names, jsonFieldNames(t.Field(i).Type, seen)...)
+		}
+	}
+	return names
+}
+
+// Levenshtein distance, with a swap of neighbours counting as one edit
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := rows[i-1][j] + 1
+			if rows[i][j-1]+1 < d {
+				d = rows[i][j-1] + 1
+			}
+			if rows[i-1][j-1]+cost < d {
+				d = rows[i-1][j-1] + cost
+			}
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && rows[i-2][j-2]+1 < d {
+				d = rows[i-2][j-2] + 1
+			}
+			rows[i][j] = d
+		}
+	}
+	return rows[len(ra)][len(rb)]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStrictJSONBinding(t *testing.T) {
+	env := setupTestEnv(t)
+	before := env.configContent(t)
+
+	for _, tc := range []struct {
+		body   string
+		fields []string
+		hint   string
+	}{
+		{`{"nmae": "alice"}`, []string{"nmae"}, "did you mean name?"},
+		{`{"name": "alice", "ipv4": 5}`, []string{"ipv4"}, "must be a string, not number"},
+		{`{"name": "alice", "dns": {"servers": "1.1.1.1"}}`, []string{"dns.servers"}, "must be an array"},
+		{`{"name": "alice", "dns": {"server": ["1.1.1.1"]}}`, []string{"server"}, "did you mean servers?"},
+		{`{"name": "alice", "bogus": true}`, []string{"bogus"}, "unknown field"},
+	} {
+		rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", json.RawMessage(tc.body))
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		var fields []string
+		for _, fe := range resp.Errors {
+			fields = append(fields, fe.Field)
+		}
+		if rec.Code != http.StatusUnprocessableEntity || !reflect.DeepEqual(fields, tc.fields) || !strings.Contains(resp.Message, tc.hint) {
+			t.Errorf("%s: got status %d: %s", tc.body, rec.Code, rec.Body.String())
+		}
+	}
+
+	for _, body := range []string{``, `{"name": "alice"`, `{"name": "alice"} {"name": "bob"}`} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/users/add", strings.NewReader(body))
+		req.Header.Set("key", "test-token")
+		rec := httptest.NewRecorder()
+		env.router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), codeInvalidRequest) {
+			t.Errorf("%q: got status %d: %s", body, rec.Code, rec.Body.String())
+		}
+	}
+
+	if after := env.configContent(t); after != before {
+		t.Errorf("nothing may be written for rejected bodies:\n%s", after)
+	}
+}
+
+func TestStrictJSONBindingRequiredFields(t *testing.T) {
+	env := setupTestEnv(t)
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/tokens/revoke", map[string]string{})
+	var resp APIResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusUnprocessableEntity || len(resp.Errors) != 1 || resp.Errors[0] != (FieldError{Field: "token", Message: "is required"}) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"name", "name", 0},
+		{"nmae", "name", 1},
+		{"ipv", "ipv4", 1},
+		{"dns", "ipv6", 4},
+	} {
+		if got := editDistance(tc.a, tc.b); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// --bootstrap sets up a fresh host the way wireguard-installer.sh does, so
+// the API can be installed on its own: it generates the server keys,
+// writes the params file and the server config, turns on IP forwarding,
+// enables the wg-quick unit and then serves the API as usual. A host that
+// already has a params file is left alone, so the flag can stay in the
+// service's command line. Only the WireGuard backend is set up; AmneziaWG
+// hosts still come from amneziawg-install.sh.
+
+// Commands and files touched on the host; vars so tests can stub them
+var (
+	sysctlCmd      = "sysctl"
+	sysctlConfFile = "/etc/sysctl.d/wg.conf"
+	// Where the server config of an interface goes
+	bootstrapConfigPath = func(nic string) string { return serverConfigPath("wireguard", nic) }
+)
+
+var (
+	interfaceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]{1,15}$`)
+	// VLAN and bridge names have dots and dashes
+	egressNICRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+)
+
+// What --bootstrap sets the server up with
+type BootstrapSettings struct {
+	// SERVER_PUB_IP; asked from PUBLIC_IP_URL when empty
+	Endpoint string
+	// The IPv4 /16 clients get addresses from, the server takes its first
+	Subnet string
+	// Optional IPv6 network, the server takes its first address
+	Subnet6 string
+	Port    int
+	NIC     string
+	// Interface client traffic leaves through; the default route's when empty
+	EgressNIC  string
+	DNS        string
+	AllowedIPs string
+}
+
+// Register --bootstrap and its settings on fs
+func registerBootstrapFlags(fs *flag.FlagSet) (*bool, *BootstrapSettings) {
+	s := &BootstrapSettings{}
+	enabled := fs.Bool("bootstrap", false, "Set up WireGuard on a fresh host before serving the API")
+	fs.StringVar(&s.Endpoint, "endpoint", "", "Public IP or hostname clients connect to; detected from PUBLIC_IP_URL when empty")
+	fs.StringVar(&s.Subnet, "subnet", "10.66.0.0/16", "IPv4 /16 of the clients")
+	fs.StringVar(&s.Subnet6, "subnet6", "", "IPv6 network of the clients, e.g. fd42:42:42::/64; none when empty")
+	fs.IntVar(&s.Port, "port", 51820, "WireGuard UDP port")
+	fs.StringVar(&s.NIC, "nic", "wg0", "WireGuard interface")
+	fs.StringVar(&s.EgressNIC, "egress-nic", "", "Interface client traffic leaves through; the default route's when empty")
+	fs.StringVar(&s.DNS, "dns", "1.1.1.1,1.0.0.1", "One or two DNS resolvers for the clients")
+	fs.StringVar(&s.AllowedIPs, "allowed-ips", "0.0.0.0/0,::/0", "AllowedIPs of the client configs")
+	return enabled, s
+}
+
+// The server's address in a network: the one given, or the first host
+// when the network address is given
+func serverAddress(value string, bits int) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil || prefix.Addr().BitLen() != bits {
+		return netip.Prefix{}, fmt.Errorf("%q isn't an IPv%d network", value, map[int]int{32: 4, 128: 6}[bits])
+	}
+	addr := prefix.Addr()
+	if addr == prefix.Masked().Addr() {
+		addr = addr.Next()
+	}
+	return netip.PrefixFrom(addr, prefix.Bits()), nil
+}
+
+// The params file content, like the installer writes it
+func renderBootstrapParams(p WGParams) string {
+	return fmt.Sprintf(`SERVER_PUB_IP=%s
+SERVER_PUB_NIC=%s
+SERVER_WG_NIC=%s
+SERVER_WG_IPV4=%s
+SERVER_WG_IPV6=%s
+SERVER_PORT=%s
+SERVER_PRIV_KEY=%s
+SERVER_PUB_KEY=%s
+CLIENT_DNS_1=%s
+CLIENT_DNS_2=%s
+ALLOWED_IPS=%s
+`, p.ServerPubIP, p.ServerPubNIC, p.ServerWGNIC, p.ServerWGIPv4, p.ServerWGIPv6, p.ServerPort,
+		p.ServerPrivKey, p.ServerPubKey, p.ClientDNS1, p.ClientDNS2, p.AllowedIPs)
+}
+
+// The server config, with the installer's iptables rules letting clients
+// out through the egress interface
+func renderBootstrapConfig(p WGParams, address string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Interface]\nAddress = %s\nListenPort = %s\nPrivateKey = %s\n", address, p.ServerPort, p.ServerPrivKey)
+	// OP is -I, or -A for NAT, to add and -D to delete
+	rules := []string{
+		"iptables OP INPUT -p udp --dport " + p.ServerPort + " -j ACCEPT",
+		"iptables OP FORWARD -i " + p.ServerPubNIC + " -o " + p.ServerWGNIC + " -j ACCEPT",
+		"iptables OP FORWARD -i " + p.ServerWGNIC + " -j ACCEPT",
+		"iptables -t nat OP POSTROUTING -o " + p.ServerPubNIC + " -j MASQUERADE",
+	}
+	if p.ServerWGIPv6 != "" {
+		rules = append(rules,
+			"ip6tables OP FORWARD -i "+p.ServerWGNIC+" -j ACCEPT",
+			"ip6tables -t nat OP POSTROUTING -o "+p.ServerPubNIC+" -j MASQUERADE")
+	}
+	for _, rule := range rules {
+		add := "-I"
+		if strings.Contains(rule, "POSTROUTING") {
+			add = "-A"
+		}
+		b.WriteString("PostUp = " + strings.Replace(rule, "OP", add, 1) + "\n")
+	}
+	for _, rule := range rules {
+		b.WriteString("PostDown = " + strings.Replace(rule, "OP", "-D", 1) + "\n")
+	}
+	return b.String()
+}
+
+// Set up the server from s. Returns false when the host already has a
+// params file and was left alone.
+func bootstrapServer(s BootstrapSettings) (bool, error) {
+	if _, err := os.Stat(WG_PARAMS_FILE); err == nil {
+		return false, nil
+	}
+	if backendType != "wireguard" {
+		return false, errors.New("only the WireGuard backend can be bootstrapped")
+	}
+
+	if !interfaceNameRegex.MatchString(s.NIC) {
+		return false, fmt.Errorf("invalid interface name %q", s.NIC)
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		return false, fmt.Errorf("invalid port %d", s.Port)
+	}
+	ipv4, err := serverAddress(s.Subnet, 32)
+	if err != nil {
+		return false, err
+	}
+	// Clients get addresses from the server's /16
+	if ipv4.Bits() != 16 {
+		return false, fmt.Errorf("the IPv4 subnet must be a /16, got /%d", ipv4.Bits())
+	}
+	address := ipv4.String()
+	p := WGParams{
+		ServerPubIP:  s.Endpoint,
+		ServerPubNIC: s.EgressNIC,
+		ServerWGNIC:  s.NIC,
+		ServerWGIPv4: ipv4.Addr().String(),
+		ServerPort:   strconv.Itoa(s.Port),
+		AllowedIPs:   s.AllowedIPs,
+	}
+	if s.Subnet6 != "" {
+		ipv6, err := serverAddress(s.Subnet6, 128)
+		if err != nil {
+			return false, err
+		}
+		p.ServerWGIPv6 = ipv6.Addr().String()
+		address += "," + ipv6.String()
+	}
+	dns := splitList(s.DNS)
+	if len(dns) < 1 || len(dns) > 2 {
+		return false, errors.New("give one or two DNS resolvers")
+	}
+	for _, resolver := range dns {
+		if _, err := netip.ParseAddr(resolver); err != nil {
+			return false, fmt.Errorf("invalid DNS resolver %q", resolver)
+		}
+	}
+	p.ClientDNS1, p.ClientDNS2 = dns[0], dns[len(dns)-1]
+
+	if p.ServerPubIP == "" {
+		detected, err := detectPublicIP()
+		if err != nil {
+			return false, fmt.Errorf("failed to detect the public IP, pass --endpoint: %v", err)
+		}
+		p.ServerPubIP = detected.String()
+	}
+	if p.ServerPubNIC == "" {
+		if p.ServerPubNIC, err = detectEgressNIC(); err != nil {
+			return false, err
+		}
+	}
+	if !egressNICRegex.MatchString(p.ServerPubNIC) {
+		return false, fmt.Errorf("invalid egress interface %q", p.ServerPubNIC)
+	}
+
+	configFile := bootstrapConfigPath(p.ServerWGNIC)
+	if _, err := os.Stat(configFile); err == nil {
+		return false, fmt.Errorf("%s exists without a params file; move it away or write %s by hand", configFile, WG_PARAMS_FILE)
+	}
+	if p.ServerPrivKey, err = generatePrivateKey(); err != nil {
+		return false, fmt.Errorf("failed to generate the server key: %v", err)
+	}
+	if p.ServerPubKey, err = derivePublicKey(p.ServerPrivKey); err != nil {
+		return false, fmt.Errorf("failed to derive the server public key: %v", err)
+	}
+
+	for _, dir := range []string{filepath.Dir(WG_PARAMS_FILE), filepath.Dir(configFile), WIREGUARD_CLIENTS} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return false, fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+	}
+	// The config first: without the params file a failed bootstrap is retried
+	if err := os.WriteFile(configFile, []byte(renderBootstrapConfig(p, address)), 0600); err != nil {
+		return false, fmt.Errorf("failed to write the server config: %v", err)
+	}
+	if err := os.WriteFile(WG_PARAMS_FILE, []byte(renderBootstrapParams(p)), 0600); err != nil {
+		os.Remove(configFile)
+		return false, fmt.Errorf("failed to write the params file: %v", err)
+	}
+
+	forwarding := "net.ipv4.ip_forward = 1\n"
+	if p.ServerWGIPv6 != "" {
+		forwarding += "net.ipv6.conf.all.forwarding = 1\n"
+	}
+	if err := os.WriteFile(sysctlConfFile, []byte(forwarding), 0644); err != nil {
+		return true, fmt.Errorf("failed to write %s: %v", sysctlConfFile, err)
+	}
+	if status, output := executeCommand(sysctlCmd, "-p", sysctlConfFile); status != "success" {
+		return true, fmt.Errorf("failed to enable IP forwarding: %s", output)
+	}
+
+	unit := "wg-quick@" + p.ServerWGNIC
+	if status, output := executeCommand(systemctlCmd, "enable", "--now", unit); status != "success" {
+		return true, fmt.Errorf("failed to enable %s: %s", unit, output)
+	}
+	log.Printf("Bootstrap: %s is up on %s:%s with clients in %s", p.ServerWGNIC, p.ServerPubIP, p.ServerPort, ipv4.Masked())
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBootstrapServer(t *testing.T) {
+	setupTestEnv(t)
+	dir := t.TempDir()
+
+	// Both commands log what they were run with
+	logFile := filepath.Join(dir, "commands.log")
+	script := "#!/bin/bash\necho \"$0 $*\" >> " + logFile + "\n"
+	sysctl, systemctl := filepath.Join(dir, "sysctl"), filepath.Join(dir, "systemctl")
+	os.WriteFile(sysctl, []byte(script), 0755)
+	os.WriteFile(systemctl, []byte(script), 0755)
+
+	paramsFile := filepath.Join(dir, "etc", "params")
+	configFile := filepath.Join(dir, "etc", "wg0.conf")
+	oldParamsFile, oldConfigPath, oldSysctlConf := WG_PARAMS_FILE, bootstrapConfigPath, sysctlConfFile
+	oldSysctl, oldSystemctl := sysctlCmd, systemctlCmd
+	WG_PARAMS_FILE, sysctlConfFile = paramsFile, filepath.Join(dir, "sysctl.conf")
+	bootstrapConfigPath = func(nic string) string { return filepath.Join(dir, "etc", nic+".conf") }
+	sysctlCmd, systemctlCmd = sysctl, systemctl
+	t.Cleanup(func() {
+		WG_PARAMS_FILE, bootstrapConfigPath, sysctlConfFile = oldParamsFile, oldConfigPath, oldSysctlConf
+		sysctlCmd, systemctlCmd = oldSysctl, oldSystemctl
+	})
+
+	settings := BootstrapSettings{
+		Endpoint:   "198.51.100.7",
+		Subnet:     "10.66.0.0/16",
+		Subnet6:    "fd42:42:42::/64",
+		Port:       51821,
+		NIC:        "wg0",
+		EgressNIC:  "eth0",
+		DNS:        "9.9.9.9",
+		AllowedIPs: "0.0.0.0/0",
+	}
+	if _, err := bootstrapServer(BootstrapSettings{Subnet: "10.66.0.0/24", Port: 51820, NIC: "wg0", DNS: "1.1.1.1"}); err == nil {
+		t.Error("a /24 subnet was accepted")
+	}
+
+	done, err := bootstrapServer(settings)
+	if err != nil || !done {
+		t.Fatalf("bootstrap: done %v, err %v", done, err)
+	}
+
+	params := parseWGParams([]byte(readFile(t, paramsFile)))
+	if err := validateWGParams(params); err != nil {
+		t.Errorf("params: %v", err)
+	}
+	if params.ServerPubIP != "198.51.100.7" || params.ServerWGIPv4 != "10.66.0.1" || params.ServerWGIPv6 != "fd42:42:42::1" ||
+		params.ServerPort != "51821" || params.ClientDNS1 != "9.9.9.9" || params.ClientDNS2 != "9.9.9.9" ||
+		!strings.HasPrefix(params.ServerPubKey, "pub-") {
+		t.Errorf("params: got %+v", params)
+	}
+
+	config := readFile(t, configFile)
+	for _, want := range []string{
+		"Address = 10.66.0.1/16,fd42:42:42::1/64\n",
+		"ListenPort = 51821\n",
+		"PrivateKey = " + params.ServerPrivKey + "\n",
+		"PostUp = iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE\n",
+		"PostDown = ip6tables -D FORWARD -i wg0 -j ACCEPT\n",
+	} {
+		if !strings.Contains(config, want) {
+			t.Errorf("config lacks %q:\n%s", want, config)
+		}
+	}
+	if !strings.Contains(readFile(t, sysctlConfFile), "net.ipv6.conf.all.forwarding = 1") {
+		t.Error("IPv6 forwarding isn't enabled")
+	}
+	commands := readFile(t, logFile)
+	if !strings.Contains(commands, sysctl+" -p "+sysctlConfFile) || !strings.Contains(commands, systemctl+" enable --now wg-quick@wg0") {
+		t.Errorf("commands: %s", commands)
+	}
+
+	// A host that is set up is left alone
+	os.Remove(logFile)
+	if done, err := bootstrapServer(settings); done || err != nil {
+		t.Errorf("second bootstrap: done %v, err %v", done, err)
+	}
+	if _, err := os.Stat(logFile); err == nil {
+		t.Error("the second bootstrap ran commands")
+	}
+}
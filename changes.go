@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every change to the clients and the server gets the next sequence number
+// and is appended to CHANGES_FILE, so external systems can follow
+// GET /changes?since=<seq> instead of re-reading every client. Clients
+// created, deleted, enabled, disabled or given new keys are recorded where
+// that happens, whichever API, sync or policy did it; other successful
+// changes through the API are recorded by route. Only the newest
+// CHANGES_KEEP changes are kept: a consumer asking for older ones is told
+// to resync with 410 CHANGES_EXPIRED.
+
+const (
+	changeClientCreated = "client.created"
+	changeClientUpdated = "client.updated"
+	changeClientDeleted = "client.deleted"
+	changeServer        = "server.changed"
+)
+
+// Most changes one GET /changes returns
+const maxChangesPerPage = 1000
+
+// A numbered change
+type Change struct {
+	Seq    int64  `json:"seq"`
+	Type   string `json:"type"`
+	Client string `json:"client,omitempty"`
+	// What changed, e.g. "disabled" or the API route
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// Routes whose changes are recorded where the clients change, or that
+// change nothing, relative to the API version prefix
+var unrecordedRoutes = map[string]bool{
+	"POST /users/add":                   true,
+	"POST /users":                       true,
+	"POST /users/add-bulk":              true,
+	"POST /users/delete":                true,
+	"DELETE /users/:name":               true,
+	"POST /users/delete-all":            true,
+	"POST /users/import":                true,
+	"POST /users/import/config":         true,
+	"POST /users/preview":               true,
+	"POST /users/status":                true,
+	"POST /lint":                        true,
+	"POST /users/:name/restore":         true,
+	"POST /users/:name/rotate-psk":      true,
+	"POST /users/:name/diagnose":        true,
+	"POST /users/:name/mtu-probe":       true,
+	"POST /server/port-check":           true,
+	"POST /escrow/export":               true,
+	"POST /graphql":                     true,
+	"POST /ldap-sync":                   true,
+	"POST /schedules/:job/run":          true,
+	"POST /pending-changes/:id/approve": true,
+	"POST /pending-changes/:id/reject":  true,
+	"POST /requests/:id/approve":        true,
+	"POST /requests/:id/reject":         true,
+	"POST /nodes/users/add":             true,
+	"POST /nodes/:node/users/add":       true,
+	"POST /nodes/:node/users/delete":    true,
+	"POST /nodes/:node/users/migrate":   true,
+}
+
+type changeLog struct {
+	mu sync.Mutex
+	// File the counters below were read from
+	path  string
+	last  int64
+	count int
+}
+
+var changeFeed = &changeLog{}
+
+// CHANGES_FILE, or changes.jsonl next to the server config
+func changesFile() string {
+	if CHANGES_FILE != "" {
+		return CHANGES_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "changes.jsonl")
+}
+
+// The changes in the file, oldest first. Lines that can't be parsed, as
+// one cut short by a crash, are skipped.
+func readChangesFile(path string) ([]Change, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read changes file: %v", err)
+	}
+	var list []Change
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err == nil && change.Seq > 0 {
+			list = append(list, change)
+		}
+	}
+	return list, nil
+}
+
+// Read the counters when the file is new to us. Caller holds mu.
+func (l *changeLog) loadLocked() error {
+	path := changesFile()
+	if l.path == path {
+		return nil
+	}
+	list, err := readChangesFile(path)
+	if err != nil {
+		return err
+	}
+	l.path, l.last, l.count = path, 0, len(list)
+	if len(list) > 0 {
+		l.last = list[len(list)-1].Seq
+	}
+	return nil
+}
+
+// Rewrite the file with only the newest CHANGES_KEEP changes. Caller holds mu.
+func (l *changeLog) trimLocked() error {
+	list, err := readChangesFile(l.path)
+	if err != nil {
+		return err
+	}
+	if len(list) > CHANGES_KEEP {
+		list = list[len(list)-CHANGES_KEEP:]
+	}
+	var buf bytes.Buffer
+	for _, change := range list {
+		line, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := os.WriteFile(l.path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write changes file: %v", err)
+	}
+	l.count = len(list)
+	return nil
+}
+
+// Append a change with the next sequence number
+func (l *changeLog) record(change Change) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.loadLocked(); err != nil {
+		return err
+	}
+	change.Seq = l.last + 1
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open changes file: %v", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write changes file: %v", err)
+	}
+	l.last = change.Seq
+	l.count++
+
+	// Trimmed in batches rather than on every change
+	if CHANGES_KEEP > 0 && l.count > 2*CHANGES_KEEP {
+		return l.trimLocked()
+	}
+	return nil
+}
+
+// Record a change. The change itself already happened, so a feed that
+// can't be written is only logged.
+func recordChange(changeType, client, detail string) {
+	err := changeFeed.record(Change{Type: changeType, Client: client, Detail: detail, At: time.Now().UTC()})
+	if err != nil {
+		log.Printf("Failed to record %s of %q: %v", changeType, client, err)
+	}
+}
+
+// Record the successful changes through the API that aren't recorded
+// where they happen. Comes after the jobs middleware, so a job is recorded
+// when it runs rather than when it is accepted.
+func changeFeedMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		if c.FullPath() == "" || c.Writer.Status() >= http.StatusMultipleChoices {
+			return
+		}
+		route := apiRoute(c)
+		if unrecordedRoutes[route] || serviceDryRun(c) {
+			return
+		}
+		if name := c.Param("name"); name != "" && strings.HasPrefix(route, "POST /users/:name/") {
+			recordChange(changeClientUpdated, tenantFrom(c).storedName(name), route)
+			return
+		}
+		recordChange(changeServer, "", route)
+	}
+}
+
+// Handler for GET /changes?since=<seq>&limit=<n>
+func changesHandlerGin(c *gin.Context) {
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "since must be a sequence number",
+		})
+		return
+	}
+	limit := maxChangesPerPage
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxChangesPerPage {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("limit must be between 1 and %d", maxChangesPerPage),
+			})
+			return
+		}
+	}
+
+	changeFeed.mu.Lock()
+	list, err := readChangesFile(changesFile())
+	changeFeed.mu.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	var last int64
+	if len(list) > 0 {
+		last = list[len(list)-1].Seq
+	}
+	// Changes after since were trimmed, or the feed started over
+	if since > last || (len(list) > 0 && since < list[0].Seq-1) {
+		c.JSON(http.StatusGone, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("changes after %d are no longer kept; read the clients again and follow the feed from %d", since, last),
+			Code:    codeChangesExpired,
+			Data:    gin.H{"last_seq": last},
+		})
+		return
+	}
+
+	page := []Change{}
+	for _, change := range list {
+		if change.Seq > since {
+			page = append(page, change)
+		}
+	}
+	more := len(page) > limit
+	if more {
+		page = page[:limit]
+	}
+	next := since
+	if len(page) > 0 {
+		next = page[len(page)-1].Seq
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: gin.H{
+			"changes":  page,
+			"next":     next,
+			"last_seq": last,
+			"more":     more,
+		},
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+type changesResponse struct {
+	Code string `json:"code"`
+	Data struct {
+		Changes []Change `json:"changes"`
+		Next    int64    `json:"next"`
+		LastSeq int64    `json:"last_seq"`
+		More    bool     `json:"more"`
+	} `json:"data"`
+}
+
+func changesSince(t *testing.T, env *testEnv, query string) (int, changesResponse) {
+	t.Helper()
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/changes"+query, nil)
+	var resp changesResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding changes: %v, %s", err, rec.Body.String())
+	}
+	return rec.Code, resp
+}
+
+func TestChangesFeed(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+	addedClient(t, env, "bob")
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/metadata", map[string]string{"notes": "desk"}); rec.Code != http.StatusOK {
+		t.Fatalf("metadata: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "bob"}); rec.Code != http.StatusOK {
+		t.Fatalf("delete: status %d, %s", rec.Code, rec.Body.String())
+	}
+	// Refused changes aren't recorded
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/maintenance/enable", nil)
+
+	code, resp := changesSince(t, env, "?since=0")
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	want := []Change{
+		{Seq: 1, Type: changeClientCreated, Client: "alice"},
+		{Seq: 2, Type: changeClientCreated, Client: "bob"},
+		{Seq: 3, Type: changeClientUpdated, Client: "alice", Detail: "POST /users/:name/metadata"},
+		{Seq: 4, Type: changeClientDeleted, Client: "bob"},
+		{Seq: 5, Type: changeServer, Detail: "POST /maintenance/enable"},
+	}
+	if len(resp.Data.Changes) != len(want) {
+		t.Fatalf("got %+v, want %d changes", resp.Data.Changes, len(want))
+	}
+	for i, change := range resp.Data.Changes {
+		if change.Seq != want[i].Seq || change.Type != want[i].Type || change.Client != want[i].Client || change.Detail != want[i].Detail || change.At.IsZero() {
+			t.Errorf("change %d: got %+v, want %+v", i, change, want[i])
+		}
+	}
+	if resp.Data.Next != 5 || resp.Data.LastSeq != 5 || resp.Data.More {
+		t.Errorf("got next %d, last %d, more %v", resp.Data.Next, resp.Data.LastSeq, resp.Data.More)
+	}
+
+	// Pages follow on from next
+	_, resp = changesSince(t, env, "?since=1&limit=2")
+	if len(resp.Data.Changes) != 2 || resp.Data.Changes[0].Seq != 2 || resp.Data.Next != 3 || !resp.Data.More {
+		t.Errorf("page: got %+v", resp.Data)
+	}
+	_, resp = changesSince(t, env, "?since=5")
+	if len(resp.Data.Changes) != 0 || resp.Data.Next != 5 {
+		t.Errorf("caught up: got %+v", resp.Data)
+	}
+
+	if code, resp := changesSince(t, env, "?since=9"); code != http.StatusGone || resp.Code != codeChangesExpired || resp.Data.LastSeq != 5 {
+		t.Errorf("since beyond the feed: status %d, %+v", code, resp)
+	}
+	if code, _ := changesSince(t, env, "?since=-1"); code != http.StatusBadRequest {
+		t.Errorf("negative since: status %d", code)
+	}
+}
+
+func TestChangesFeedTrimmed(t *testing.T) {
+	oldKeep := CHANGES_KEEP
+	CHANGES_KEEP = 2
+	t.Cleanup(func() { CHANGES_KEEP = oldKeep })
+	env := setupTestEnv(t)
+
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		addedClient(t, env, name)
+	}
+
+	// Five changes exceed twice CHANGES_KEEP, leaving the newest two
+	code, resp := changesSince(t, env, "?since=3")
+	if code != http.StatusOK || len(resp.Data.Changes) != 2 || resp.Data.Changes[0].Client != "d" {
+		t.Errorf("kept changes: status %d, %+v", code, resp.Data)
+	}
+	if code, resp := changesSince(t, env, "?since=1"); code != http.StatusGone || resp.Code != codeChangesExpired {
+		t.Errorf("trimmed changes: status %d, %+v", code, resp)
+	}
+
+	// Numbering goes on after the trim
+	addedClient(t, env, "f")
+	if _, resp := changesSince(t, env, "?since=5"); len(resp.Data.Changes) != 1 || resp.Data.Changes[0].Seq != 6 {
+		t.Errorf("after trim: got %+v", resp.Data)
+	}
+}
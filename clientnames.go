@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Client names are letters, digits, underscores and dashes, at most
+// CLIENT_NAME_MAX_LENGTH characters. The default of 15 keeps the name of a
+// downloaded config usable as a Linux interface name, but naming schemes
+// like <user>-<device> need more. CLIENT_NAME_CHARSET=extended also allows
+// letters and digits outside ASCII, such as "José" or "Алишер"; the client's
+// files then get a transliterated name, as not every filesystem, archiver
+// and client app copes with those. CLIENT_NAME_PATTERN narrows names further
+// but can't let in other characters, so a name can never break the server
+// config.
+
+const (
+	clientNameCharsetASCII    = "ascii"
+	clientNameCharsetExtended = "extended"
+)
+
+// Longest CLIENT_NAME_MAX_LENGTH accepted
+const maxClientNameLength = 64
+
+// CLIENT_NAME_PATTERN compiled, nil when unset
+var clientNamePattern *regexp.Regexp
+
+func checkClientNameConfig() error {
+	if CLIENT_NAME_CHARSET != clientNameCharsetASCII && CLIENT_NAME_CHARSET != clientNameCharsetExtended {
+		return fmt.Errorf("CLIENT_NAME_CHARSET must be %s or %s", clientNameCharsetASCII, clientNameCharsetExtended)
+	}
+	if CLIENT_NAME_MAX_LENGTH < 1 || CLIENT_NAME_MAX_LENGTH > maxClientNameLength {
+		return fmt.Errorf("CLIENT_NAME_MAX_LENGTH must be between 1 and %d", maxClientNameLength)
+	}
+	clientNamePattern = nil
+	if CLIENT_NAME_PATTERN != "" {
+		pattern, err := regexp.Compile(CLIENT_NAME_PATTERN)
+		if err != nil {
+			return fmt.Errorf("CLIENT_NAME_PATTERN: %v", err)
+		}
+		clientNamePattern = pattern
+	}
+	return nil
+}
+
+// Whether name is allowed as a client name under the configured policy
+func validClientName(name string) bool {
+	length := utf8.RuneCountInString(name)
+	if length == 0 || length > CLIENT_NAME_MAX_LENGTH || !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r < utf8.RuneSelf:
+			if !asciiNameChar(r) {
+				return false
+			}
+		case CLIENT_NAME_CHARSET != clientNameCharsetExtended:
+			return false
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			return false
+		}
+	}
+	return clientNamePattern == nil || clientNamePattern.MatchString(name)
+}
+
+func asciiNameChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-'
+}
+
+// Why a client name was refused, completing "Client name ..."
+func clientNameMessage() string {
+	characters := "alphanumeric characters"
+	if CLIENT_NAME_CHARSET == clientNameCharsetExtended {
+		characters = "letters, digits"
+	}
+	message := fmt.Sprintf("must contain only %s, underscores, or dashes and be at most %d characters", characters, CLIENT_NAME_MAX_LENGTH)
+	if clientNamePattern != nil {
+		message += " matching " + CLIENT_NAME_PATTERN
+	}
+	return message
+}
+
+// ASCII spellings of the letters clientFileName knows
+var transliterations = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "Ae", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ð': "D", 'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "Oe", 'Ø': "O",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "Ue", 'Ý': "Y", 'Þ': "Th", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "ae", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ð': "d", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "oe", 'ø': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "ue", 'ý': "y", 'þ': "th", 'ÿ': "y",
+	'Ą': "A", 'ą': "a", 'Ć': "C", 'ć': "c", 'Č': "C", 'č': "c", 'Ď': "D", 'ď': "d",
+	'Ę': "E", 'ę': "e", 'Ě': "E", 'ě': "e", 'Ğ': "G", 'ğ': "g", 'İ': "I", 'ı': "i",
+	'Ł': "L", 'ł': "l", 'Ń': "N", 'ń': "n", 'Ň': "N", 'ň': "n", 'Ő': "O", 'ő': "o",
+	'Œ': "OE", 'œ': "oe", 'Ř': "R", 'ř': "r", 'Ś': "S", 'ś': "s", 'Ş': "S", 'ş': "s",
+	'Š': "S", 'š': "s", 'Ť': "T", 'ť': "t", 'Ů': "U", 'ů': "u", 'Ű': "U", 'ű': "u",
+	'Ź': "Z", 'ź': "z", 'Ż': "Z", 'ż': "z", 'Ž': "Z", 'ž': "z",
+	'А': "A", 'Б': "B", 'В': "V", 'Г': "G", 'Д': "D", 'Е': "E", 'Ё': "Yo", 'Ж': "Zh",
+	'З': "Z", 'И': "I", 'Й': "Y", 'К': "K", 'Л': "L", 'М': "M", 'Н': "N", 'О': "O",
+	'П': "P", 'Р': "R", 'С': "S", 'Т': "T", 'У': "U", 'Ф': "F", 'Х': "Kh", 'Ц': "Ts",
+	'Ч': "Ch", 'Ш': "Sh", 'Щ': "Shch", 'Ъ': "", 'Ы': "Y", 'Ь': "", 'Э': "E", 'Ю': "Yu",
+	'Я': "Ya", 'Ў': "O", 'Қ': "Q", 'Ғ': "G", 'Ҳ': "H", 'Є': "Ye", 'І': "I", 'Ї': "Yi",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'ў': "o", 'қ': "q", 'ғ': "g", 'ҳ': "h", 'є': "ye", 'і': "i", 'ї': "yi",
+}
+
+// The name as used in the client's file names: ASCII names as they are,
+// other letters transliterated, or as u<hex code point> when there is no
+// transliteration, so names in other scripts don't all collapse into one
+func clientFileName(name string) string {
+	ascii := true
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return name
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+		} else if spelled, ok := transliterations[r]; ok {
+			b.WriteString(spelled)
+		} else {
+			fmt.Fprintf(&b, "u%x", r)
+		}
+	}
+	return b.String()
+}
+
+// The clients of the server config whose file name differs from their
+// name, by file name
+func clientNamesByFileName(serverConfig []byte) map[string]string {
+	names := make(map[string]string)
+	for _, section := range scanClientSections(serverConfig) {
+		if fileName := clientFileName(section.name); fileName != section.name {
+			names[fileName] = section.name
+		}
+	}
+	return names
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setClientNamePolicy(t *testing.T, maxLength int, charset, pattern string) {
+	t.Helper()
+	oldLength, oldCharset, oldPattern := CLIENT_NAME_MAX_LENGTH, CLIENT_NAME_CHARSET, CLIENT_NAME_PATTERN
+	t.Cleanup(func() {
+		CLIENT_NAME_MAX_LENGTH, CLIENT_NAME_CHARSET, CLIENT_NAME_PATTERN = oldLength, oldCharset, oldPattern
+		checkClientNameConfig()
+	})
+	CLIENT_NAME_MAX_LENGTH, CLIENT_NAME_CHARSET, CLIENT_NAME_PATTERN = maxLength, charset, pattern
+	if err := checkClientNameConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientNamePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name, charset, pattern string
+		want                   bool
+	}{
+		{"alice", clientNameCharsetASCII, "", true},
+		{"alice-laptop-2024", clientNameCharsetASCII, "", true},
+		{strings.Repeat("a", 33), clientNameCharsetASCII, "", false},
+		{"josé", clientNameCharsetASCII, "", false},
+		{"josé", clientNameCharsetExtended, "", true},
+		{"алишер-ноутбук", clientNameCharsetExtended, "", true},
+		{"a.b", clientNameCharsetExtended, "", false},
+		{"a b", clientNameCharsetExtended, "", false},
+		{"a/b", clientNameCharsetExtended, "", false},
+		{"a b", clientNameCharsetExtended, "", false},
+		{"alice-laptop", clientNameCharsetASCII, `^[a-z]+-[a-z0-9]+$`, true},
+		{"alice", clientNameCharsetASCII, `^[a-z]+-[a-z0-9]+$`, false},
+		{"alice\nb-c", clientNameCharsetASCII, `(?m)^[a-z]+-[a-z0-9]+$`, false},
+	} {
+		setClientNamePolicy(t, 32, tc.charset, tc.pattern)
+		if got := validClientName(tc.name); got != tc.want {
+			t.Errorf("%q (%s, %q): got %v, want %v", tc.name, tc.charset, tc.pattern, got, tc.want)
+		}
+	}
+
+	for _, bad := range []struct {
+		maxLength        int
+		charset, pattern string
+	}{{0, clientNameCharsetASCII, ""}, {65, clientNameCharsetASCII, ""}, {15, "unicode", ""}, {15, clientNameCharsetASCII, "("}} {
+		CLIENT_NAME_MAX_LENGTH, CLIENT_NAME_CHARSET, CLIENT_NAME_PATTERN = bad.maxLength, bad.charset, bad.pattern
+		if checkClientNameConfig() == nil {
+			t.Errorf("%+v must be refused", bad)
+		}
+	}
+}
+
+func TestClientFileName(t *testing.T) {
+	for name, want := range map[string]string{
+		"alice":       "alice",
+		"acme.bob":    "acme.bob",
+		"José-Müller": "Jose-Mueller",
+		"Алишер":      "Alisher",
+		"Ўзбек":       "Ozbek",
+		"李-phone":     "u674e-phone",
+	} {
+		if got := clientFileName(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestAddClientWithExtendedName(t *testing.T) {
+	env := setupTestEnv(t)
+	setClientNamePolicy(t, 32, clientNameCharsetExtended, "")
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "josé-laptop"}); rec.Code != http.StatusOK {
+		t.Fatalf("add: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(env.configContent(t), "### Client josé-laptop\n") {
+		t.Errorf("the server config keeps the name:\n%s", env.configContent(t))
+	}
+	file := filepath.Join(env.clientsDir, "wg0-client-jose-laptop.conf")
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("the config file must have the transliterated name: %v", err)
+	}
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/users/"+url.PathEscape("josé-laptop"), nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "PrivateKey") {
+		t.Errorf("get: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Names sharing a file name can't both exist
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "jose-laptop"}).Code; code != http.StatusConflict {
+		t.Errorf("colliding name: got status %d, want 409", code)
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "josé-laptop"}).Code; code != http.StatusOK {
+		t.Fatalf("delete: got status %d", code)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("the config file must be removed: %v", err)
+	}
+}
+
+func TestAddClientNameLongerThanDefault(t *testing.T) {
+	env := setupTestEnv(t)
+	req := AddUserRequest{Name: "alice-work-laptop"}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", req).Code; code != http.StatusBadRequest {
+		t.Errorf("default policy: got status %d, want 400", code)
+	}
+	setClientNamePolicy(t, 32, clientNameCharsetASCII, `^[a-z]+-[a-z0-9-]+$`)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", req).Code; code != http.StatusOK {
+		t.Errorf("longer names: got status %d, want 200", code)
+	}
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "laptop"})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "matching") {
+		t.Errorf("pattern: got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
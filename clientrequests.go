@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tenants with require_approval don't create clients themselves: their
+// adds become client requests, and nothing is allocated or written to the
+// server config until the admin approves one. Approving replays the add as
+// the tenant, so it goes through the same checks, limits and quotas as if
+// the tenant had made it then. Requests are kept in a JSON file next to
+// the server config, so they survive restarts and serve as an audit trail.
+
+// A client add waiting for the admin
+type ClientRequest struct {
+	ID          string          `json:"id"`
+	Tenant      string          `json:"tenant"`
+	Name        string          `json:"name"`
+	Request     json.RawMessage `json:"request"`
+	Status      string          `json:"status"` // pending, approved, rejected or failed
+	RequestedAt time.Time       `json:"requested_at"`
+	DecidedAt   *time.Time      `json:"decided_at,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+	// HTTP status of the replayed add
+	ResultStatus int `json:"result_status,omitempty"`
+}
+
+type RejectClientRequest struct {
+	Reason string `json:"reason"`
+}
+
+var (
+	clientRequestsMutex sync.Mutex
+
+	errClientRequestNotFound = errors.New("Client request not found")
+	errClientRequestDecided  = errors.New("Client request was already")
+)
+
+// Set on the context of adds replayed by an approval
+type approvedClientRequestKey struct{}
+
+// CLIENT_REQUESTS_FILE, or client-requests.json next to the server config
+func clientRequestsFile() string {
+	if CLIENT_REQUESTS_FILE != "" {
+		return CLIENT_REQUESTS_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "client-requests.json")
+}
+
+// Caller holds clientRequestsMutex
+func loadClientRequestsLocked() (map[string]*ClientRequest, error) {
+	requests := make(map[string]*ClientRequest)
+	content, err := os.ReadFile(clientRequestsFile())
+	if os.IsNotExist(err) {
+		return requests, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client requests file: %v", err)
+	}
+	if err := json.Unmarshal(content, &requests); err != nil {
+		return nil, fmt.Errorf("failed to parse client requests file: %v", err)
+	}
+	return requests, nil
+}
+
+// Caller holds clientRequestsMutex
+func saveClientRequestsLocked(requests map[string]*ClientRequest) error {
+	content, err := json.MarshalIndent(requests, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(clientRequestsFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write client requests file: %v", err)
+	}
+	return nil
+}
+
+// Whether the request's adds must wait for the admin
+func needsApproval(c *gin.Context) bool {
+	tenant := tenantFrom(c)
+	return tenant != nil && tenant.RequireApproval && c.Request.Context().Value(approvedClientRequestKey{}) == nil
+}
+
+// The token of a tenant, for replaying its adds
+func tenantToken(name string) string {
+	for token, tenant := range tenantsByToken {
+		if tenant.Name == name {
+			return token
+		}
+	}
+	return ""
+}
+
+// File a validated add as a client request and answer 202
+func requestClientApproval(c *gin.Context, req AddUserRequest) {
+	tenant := tenantFrom(c)
+	exists, err := clientExists(tenant.storedName(req.Name))
+	if err == nil && exists {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: clientExistsMessage,
+			Code:    codeNameTaken,
+		})
+		return
+	}
+	body, _ := json.Marshal(req)
+	request := &ClientRequest{
+		Tenant:      tenant.Name,
+		Name:        req.Name,
+		Request:     body,
+		Status:      "pending",
+		RequestedAt: time.Now().UTC(),
+	}
+	if err == nil {
+		request.ID, err = randomHex(8)
+	}
+	if err == nil {
+		err = func() error {
+			clientRequestsMutex.Lock()
+			defer clientRequestsMutex.Unlock()
+
+			requests, err := loadClientRequestsLocked()
+			if err != nil {
+				return err
+			}
+			for _, other := range requests {
+				if other.Status == "pending" && other.Tenant == tenant.Name && other.Name == req.Name {
+					return errClientExists
+				}
+			}
+			requests[request.ID] = request
+			return saveClientRequestsLocked(requests)
+		}()
+	}
+	if errors.Is(err, errClientExists) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "A request for this client is already pending",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, APIResponse{
+		Success: true,
+		Message: "Client request is pending approval",
+		Data:    request,
+	})
+}
+
+func registerClientRequestRoutes(api *gin.RouterGroup, router *gin.Engine) {
+	api.GET("/requests", listClientRequestsHandlerGin)
+	api.POST("/requests/:id/approve", approveClientRequestHandler(router))
+	api.POST("/requests/:id/reject", rejectClientRequestHandlerGin)
+}
+
+// Handler listing client requests, newest first, optionally only those
+// with ?status=. Tenants see their own.
+func listClientRequestsHandlerGin(c *gin.Context) {
+	clientRequestsMutex.Lock()
+	requests, err := loadClientRequestsLocked()
+	clientRequestsMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	tenant, status := tenantFrom(c), c.Query("status")
+	list := []*ClientRequest{}
+	for _, request := range requests {
+		if (tenant == nil || request.Tenant == tenant.Name) && (status == "" || request.Status == status) {
+			list = append(list, request)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RequestedAt.After(list[j].RequestedAt) })
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// Decide a pending request, answering 404/409 itself. Returns a copy of
+// the decided request, nil when the handler should stop.
+func decideClientRequest(c *gin.Context, status, reason string) *ClientRequest {
+	var decided ClientRequest
+	err := func() error {
+		clientRequestsMutex.Lock()
+		defer clientRequestsMutex.Unlock()
+
+		requests, err := loadClientRequestsLocked()
+		if err != nil {
+			return err
+		}
+		request := requests[c.Param("id")]
+		if request == nil {
+			return errClientRequestNotFound
+		}
+		if request.Status != "pending" {
+			return fmt.Errorf("%w %s", errClientRequestDecided, request.Status)
+		}
+		now := time.Now().UTC()
+		request.Status, request.Reason, request.DecidedAt = status, reason, &now
+		decided = *request
+		return saveClientRequestsLocked(requests)
+	}()
+	switch {
+	case errors.Is(err, errClientRequestNotFound):
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+	case errors.Is(err, errClientRequestDecided):
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+	default:
+		return &decided
+	}
+	return nil
+}
+
+// Record the outcome of an approved request's add
+func recordClientRequestResult(id string, resultStatus int) (*ClientRequest, error) {
+	clientRequestsMutex.Lock()
+	defer clientRequestsMutex.Unlock()
+
+	requests, err := loadClientRequestsLocked()
+	if err != nil {
+		return nil, err
+	}
+	request := requests[id]
+	if request == nil {
+		return nil, errClientRequestNotFound
+	}
+	request.ResultStatus = resultStatus
+	if resultStatus != http.StatusOK {
+		request.Status = "failed"
+	}
+	snapshot := *request
+	return &snapshot, saveClientRequestsLocked(requests)
+}
+
+// Handler approving a request by replaying its add as the tenant. A
+// replay that fails, e.g. because the tenant reached max_clients since,
+// leaves the request failed with the add's response.
+func approveClientRequestHandler(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		request := decideClientRequest(c, "approved", "")
+		if request == nil {
+			return
+		}
+
+		resp := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+		if token := tenantToken(request.Tenant); token == "" {
+			resp.status = http.StatusGone
+			resp.body.WriteString(`{"success":false,"message":"Tenant no longer exists"}`)
+		} else {
+			ctx := context.WithValue(c.Request.Context(), approvedClientRequestKey{}, true)
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/v1/users/add", strings.NewReader(string(request.Request)))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, APIResponse{
+					Success: false,
+					Message: err.Error(),
+					Code:    errorCode(err),
+				})
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("key", token)
+			router.ServeHTTP(resp, req)
+		}
+
+		request, err := recordClientRequestResult(request.ID, resp.status)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+
+		var result json.RawMessage
+		if json.Valid(resp.body.Bytes()) {
+			result = resp.body.Bytes()
+		}
+		message := "Client request approved"
+		if request.Status == "failed" {
+			message = "Client request approved, but adding the client failed"
+		}
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: message,
+			Data: gin.H{
+				"request": request,
+				"result":  result,
+			},
+		})
+	}
+}
+
+// Handler rejecting a request with an optional reason for the tenant
+func rejectClientRequestHandlerGin(c *gin.Context) {
+	var req RejectClientRequest
+	if c.Request.ContentLength > 0 {
+		if !bindJSON(c, &req) {
+			return
+		}
+	}
+
+	request := decideClientRequest(c, "rejected", req.Reason)
+	if request == nil {
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Client request rejected",
+		Data:    request,
+	})
+}
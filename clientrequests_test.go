@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientRequestApproval(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+	tenantsByToken["globex-token"].RequireApproval = true
+
+	// The add is filed without touching the server config
+	rec := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice", Notes: "New hire"}, "globex-token")
+	var resp struct {
+		Data ClientRequest `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusAccepted || resp.Data.Status != "pending" || resp.Data.Tenant != "globex" {
+		t.Fatalf("add must be pending: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(env.configContent(t), "### Client") {
+		t.Fatalf("nothing may be allocated before approval:\n%s", env.configContent(t))
+	}
+	if code := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}, "globex-token-2").Code; code != http.StatusConflict {
+		t.Errorf("second request for alice: got status %d, want 409", code)
+	}
+	if code := env.request(t, http.MethodPost, "/api/v1/users/add-bulk", AddUsersBulkRequest{Names: []string{"bob"}}, "globex-token").Code; code != http.StatusForbidden {
+		t.Errorf("bulk add: got status %d, want 403", code)
+	}
+
+	// Tenants see their own requests and can't decide them
+	if body := env.request(t, http.MethodGet, "/api/v1/requests", nil, "acme-token").Body.String(); strings.Contains(body, "alice") {
+		t.Errorf("acme must not see globex's requests: %s", body)
+	}
+	approve := "/api/v1/requests/" + resp.Data.ID + "/approve"
+	if code := env.request(t, http.MethodPost, approve, nil, "globex-token").Code; code != http.StatusForbidden {
+		t.Errorf("tenant approving: got status %d, want 403", code)
+	}
+
+	rec = env.authedRequest(t, http.MethodPost, approve, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"approved"`) || !strings.Contains(rec.Body.String(), `"result":{"success":true`) {
+		t.Fatalf("approve: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(env.configContent(t), "### Client globex.alice") {
+		t.Errorf("alice must be added once approved:\n%s", env.configContent(t))
+	}
+	if alice := listedClients(t, env, "?search=globex.alice"); len(alice) != 1 || alice[0].Notes != "New hire" {
+		t.Errorf("the request must be added as made: %+v", alice)
+	}
+	if code := env.authedRequest(t, http.MethodPost, approve, nil).Code; code != http.StatusConflict {
+		t.Errorf("approving twice: got status %d, want 409", code)
+	}
+
+	// A rejection keeps its reason for the tenant
+	json.Unmarshal(env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"}, "globex-token").Body.Bytes(), &resp)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/requests/"+resp.Data.ID+"/reject", RejectClientRequest{Reason: "No ticket"}).Code; code != http.StatusOK {
+		t.Fatalf("reject: got status %d", code)
+	}
+	body := env.request(t, http.MethodGet, "/api/v1/requests?status=rejected", nil, "globex-token").Body.String()
+	if !strings.Contains(body, `"reason":"No ticket"`) || strings.Contains(body, `"name":"alice"`) {
+		t.Errorf("unexpected rejected requests: %s", body)
+	}
+	if strings.Contains(env.configContent(t), "globex.bob") {
+		t.Error("bob must not be added")
+	}
+
+	// Other tenants add right away
+	if code := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "carol"}, "acme-token").Code; code != http.StatusOK {
+		t.Errorf("acme add: got status %d, want 200", code)
+	}
+}
+
+func TestClientRequestFailedReplay(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+	tenantsByToken["acme-token"].RequireApproval = true
+
+	// The name is taken between the request and the approval
+	var resp struct {
+		Data ClientRequest `json:"data"`
+	}
+	json.Unmarshal(env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}, "acme-token").Body.Bytes(), &resp)
+	if _, _, _, err := addTenantClient(tenantsByToken["acme-token"], "alice", "", "", nil, "", true); err != nil {
+		t.Fatalf("adding acme.alice: %v", err)
+	}
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/requests/"+resp.Data.ID+"/approve", nil)
+	if !strings.Contains(rec.Body.String(), `"status":"failed"`) || !strings.Contains(rec.Body.String(), `"result_status":409`) {
+		t.Errorf("approve must record the failure: %s", rec.Body.String())
+	}
+}
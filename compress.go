@@ -0,0 +1,152 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Client lists with configs, status dumps and the OpenAPI spec compress
+// well, so responses are gzipped for clients that accept it. The decision
+// is made once the first gzipMinSize bytes are written, which keeps small
+// responses plain, and streamed responses are compressed as they are
+// written rather than buffered. Only text formats are compressed; QR codes
+// and anything already encoded pass through.
+
+// Responses shorter than this are sent plain
+const gzipMinSize = 1024
+
+// Media types worth compressing, besides text/* and +json/+xml types
+var gzipMediaTypes = map[string]bool{
+	"application/json":       true,
+	"application/yaml":       true,
+	"application/x-yaml":     true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return gzipMediaTypes[mediaType] || strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// Whether the Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, coding := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			q, _ = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+		}
+		return q > 0
+	}
+	return false
+}
+
+// Holds back the start of the body until it is known whether to compress
+type gzipWriter struct {
+	gin.ResponseWriter
+	pending []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.pending = append(w.pending, b...)
+		if len(w.pending) < gzipMinSize {
+			return len(b), nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Start compressing if the response allows it, and write what was held back
+func (w *gzipWriter) decide() error {
+	w.decided = true
+	header := w.Header()
+	status := w.Status()
+	if len(w.pending) >= gzipMinSize && header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" &&
+		status != http.StatusPartialContent && compressible(header.Get("Content-Type")) {
+		header.Set("Content-Encoding", "gzip")
+		header.Add("Vary", "Accept-Encoding")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	pending := w.pending
+	w.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(pending)
+	} else {
+		_, err = w.ResponseWriter.Write(pending)
+	}
+	return err
+}
+
+// A handler flushing wants the client to see what it wrote so far
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) close() {
+	if !w.decided {
+		w.decide()
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// Gzip the responses of clients sending Accept-Encoding: gzip
+func gzipMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Replays record the response for a job or approval, not a client
+		if !GZIP_RESPONSES || c.Request.Method == http.MethodHead || replayedRequest(c) ||
+			!acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		writer := &gzipWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		defer func() {
+			writer.close()
+			c.Writer = writer.ResponseWriter
+		}()
+		c.Next()
+	}
+}
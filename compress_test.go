@@ -0,0 +1,84 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func (e *testEnv) gzipRequest(t *testing.T, path, acceptEncoding string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("key", "test-token")
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	recorder := httptest.NewRecorder()
+	e.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestGzipResponses(t *testing.T) {
+	env := setupTestEnv(t)
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("seeding %s failed with status %d", name, code)
+		}
+	}
+	plain := env.gzipRequest(t, "/api/v1/users?include=config", "")
+	if plain.Header().Get("Content-Encoding") != "" || plain.Body.Len() < gzipMinSize {
+		t.Fatalf("expected a plain response of at least %d bytes, got %d bytes encoded %q", gzipMinSize, plain.Body.Len(), plain.Header().Get("Content-Encoding"))
+	}
+
+	rec := env.gzipRequest(t, "/api/v1/users?include=config", "br, gzip;q=0.8")
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("unexpected headers: %v", rec.Header())
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("reading gzip: %v", err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("decompressing: %v", err)
+	}
+	// The list is in no particular order, so compare sizes
+	if !json.Valid(body) || len(body) != plain.Body.Len() || rec.Body.Len() >= plain.Body.Len() {
+		t.Errorf("got %d bytes compressed to %d, want %d bytes:\n%s", len(body), rec.Body.Len(), plain.Body.Len(), body)
+	}
+
+	// Small responses, refused gzip and GZIP_RESPONSES=false stay plain
+	if rec := env.gzipRequest(t, "/api/v1/users?search=alice", "gzip"); rec.Header().Get("Content-Encoding") != "" || rec.Code != http.StatusOK {
+		t.Errorf("small response: status %d, encoded %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	if rec := env.gzipRequest(t, "/api/v1/users?include=config", "gzip;q=0, identity"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("gzip;q=0 must not be compressed")
+	}
+	GZIP_RESPONSES = false
+	t.Cleanup(func() { GZIP_RESPONSES = true })
+	if rec := env.gzipRequest(t, "/api/v1/users?include=config", "gzip"); rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("GZIP_RESPONSES=false must not compress")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"GZIP":              true,
+		"deflate, gzip":     true,
+		"gzip;q=0.5":        true,
+		"gzip; q=0":         false,
+		"*":                 true,
+		"identity":          false,
+		"x-gzip, identity":  false,
+		"br;q=1, *;q=0.001": true,
+	} {
+		if got := acceptsGzip(header); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
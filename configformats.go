@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /users/:name/config downloads a client's config. format=conf, the
+// default, is the wg-quick file as stored; the other formats are built
+// from it for peers that can't import .conf files, such as MikroTik
+// routers and the BSD firewalls of firewallformats.go, so per-client DNS,
+// endpoint profiles and MTUs carry over. Like the export, the download
+// holds the client's private key, so tokens that don't get secrets get
+// 403.
+
+// A way of rendering a client config for download
+type configFormat struct {
+	extension   string
+	contentType string
+	render      func(name string, peer clientPeerConfig) (string, error)
+}
+
+var configFormats = map[string]configFormat{
+	"mikrotik": {extension: "rsc", contentType: "text/plain; charset=utf-8", render: renderMikrotik},
+	"opnsense": {extension: "json", contentType: "application/json", render: renderOPNsense},
+	"pfsense":  {extension: "xml", contentType: "application/xml; charset=utf-8", render: renderPfSense},
+}
+
+// The values of a client config the formats use
+type clientPeerConfig struct {
+	PrivateKey   string
+	Addresses    []string
+	DNS          []string
+	MTU          string
+	PostUp       bool
+	Obfuscated   bool // AmneziaWG junk and header parameters
+	PublicKey    string
+	PresharedKey string
+	Endpoint     string
+	AllowedIPs   []string
+	Keepalive    string
+	// The client's public key, not in the config; see clientConfigHandlerGin
+	InterfacePublicKey string
+}
+
+// Pull the values out of a stored client config
+func parseClientPeerConfig(config string) (clientPeerConfig, error) {
+	var peer clientPeerConfig
+	sections := (&linter{}).parse([]byte(config))
+	values := func(section *lintSection, key string) []string {
+		var list []string
+		for _, value := range section.values[key] {
+			list = append(list, splitList(value.value)...)
+		}
+		return list
+	}
+	value := func(section *lintSection, key string) string {
+		first, _ := section.first(key)
+		return first.value
+	}
+
+	peers := 0
+	for _, section := range sections {
+		if section.kind == "interface" {
+			peer.PrivateKey = value(section, "privatekey")
+			peer.Addresses = values(section, "address")
+			peer.DNS = values(section, "dns")
+			peer.MTU = value(section, "mtu")
+			peer.PostUp = len(section.values["postup"]) > 0 || len(section.values["postdown"]) > 0
+			for _, key := range []string{"jc", "jmin", "jmax", "s1", "s2", "h1", "h2", "h3", "h4"} {
+				if len(section.values[key]) > 0 {
+					peer.Obfuscated = true
+				}
+			}
+			continue
+		}
+		peers++
+		peer.PublicKey = value(section, "publickey")
+		peer.PresharedKey = value(section, "presharedkey")
+		peer.Endpoint = value(section, "endpoint")
+		peer.AllowedIPs = values(section, "allowedips")
+		peer.Keepalive = value(section, "persistentkeepalive")
+	}
+	if peers != 1 || peer.PublicKey == "" {
+		return peer, fmt.Errorf("the client config doesn't have exactly one server peer")
+	}
+	return peer, nil
+}
+
+// The server's address and port, empty without an Endpoint. IPv6 addresses
+// lose their brackets.
+func (p clientPeerConfig) endpoint() (string, string, error) {
+	if p.Endpoint == "" {
+		return "", "", nil
+	}
+	host, port, err := net.SplitHostPort(p.Endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid Endpoint %q: %v", p.Endpoint, err)
+	}
+	return host, port, nil
+}
+
+// The default routes among AllowedIPs, which would also catch the tunnel's
+// packets to the server
+func (p clientPeerConfig) defaultRoutes() []string {
+	var defaults []string
+	for _, entry := range p.AllowedIPs {
+		if prefix, err := netip.ParsePrefix(entry); err == nil && prefix.Bits() == 0 {
+			defaults = append(defaults, entry)
+		}
+	}
+	return defaults
+}
+
+// Quote a value for the RouterOS CLI
+func routerOSQuote(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// RouterOS 7 commands adding the client as a WireGuard interface with the
+// server as its peer. AllowedIPs other than default routes become routes
+// through the interface; a default route would also catch the tunnel's own
+// packets to the endpoint, so it is left to the router's admin.
+func renderMikrotik(name string, peer clientPeerConfig) (string, error) {
+	if peer.Obfuscated {
+		return "", fmt.Errorf("RouterOS doesn't support AmneziaWG's obfuscation parameters")
+	}
+	iface := routerOSQuote("wg-" + name)
+	var b strings.Builder
+	fmt.Fprintf(&b, "# WireGuard client %s for RouterOS 7; paste into a terminal or upload and /import\n", name)
+
+	b.WriteString("/interface wireguard\n")
+	fmt.Fprintf(&b, "add name=%s", iface)
+	if peer.PrivateKey != "" {
+		fmt.Fprintf(&b, " private-key=%s", routerOSQuote(peer.PrivateKey))
+	}
+	if peer.MTU != "" {
+		fmt.Fprintf(&b, " mtu=%s", peer.MTU)
+	}
+	b.WriteString("\n")
+
+	b.WriteString("/interface wireguard peers\n")
+	fmt.Fprintf(&b, "add interface=%s public-key=%s", iface, routerOSQuote(peer.PublicKey))
+	if peer.PresharedKey != "" {
+		fmt.Fprintf(&b, " preshared-key=%s", routerOSQuote(peer.PresharedKey))
+	}
+	host, port, err := peer.endpoint()
+	if err != nil {
+		return "", err
+	}
+	if host != "" {
+		fmt.Fprintf(&b, " endpoint-address=%s endpoint-port=%s", host, port)
+	}
+	fmt.Fprintf(&b, " allowed-address=%s", strings.Join(peer.AllowedIPs, ","))
+	if peer.Keepalive != "" && peer.Keepalive != "off" {
+		fmt.Fprintf(&b, " persistent-keepalive=%ss", peer.Keepalive)
+	}
+	fmt.Fprintf(&b, " comment=%s\n", routerOSQuote("VPN server"))
+
+	var ipv4, ipv6 []string
+	for _, address := range peer.Addresses {
+		if strings.Contains(address, ":") {
+			ipv6 = append(ipv6, address)
+		} else {
+			ipv4 = append(ipv4, address)
+		}
+	}
+	if len(ipv4) > 0 {
+		b.WriteString("/ip address\n")
+		for _, address := range ipv4 {
+			fmt.Fprintf(&b, "add address=%s interface=%s\n", address, iface)
+		}
+	}
+	if len(ipv6) > 0 {
+		b.WriteString("/ipv6 address\n")
+		for _, address := range ipv6 {
+			fmt.Fprintf(&b, "add address=%s interface=%s advertise=no\n", address, iface)
+		}
+	}
+
+	var routes4, routes6 []string
+	for _, entry := range peer.AllowedIPs {
+		prefix, err := netip.ParsePrefix(entry)
+		switch {
+		case err != nil:
+			return "", fmt.Errorf("invalid AllowedIPs entry %q", entry)
+		case prefix.Bits() == 0:
+		case prefix.Addr().Is4():
+			routes4 = append(routes4, prefix.Masked().String())
+		default:
+			routes6 = append(routes6, prefix.Masked().String())
+		}
+	}
+	if len(routes4) > 0 {
+		b.WriteString("/ip route\n")
+		for _, route := range routes4 {
+			fmt.Fprintf(&b, "add dst-address=%s gateway=%s\n", route, iface)
+		}
+	}
+	if len(routes6) > 0 {
+		b.WriteString("/ipv6 route\n")
+		for _, route := range routes6 {
+			fmt.Fprintf(&b, "add dst-address=%s gateway=%s\n", route, iface)
+		}
+	}
+
+	if defaults := peer.defaultRoutes(); len(defaults) > 0 {
+		fmt.Fprintf(&b, "# Not routed: %s would also take the tunnel's packets to the server; send the\n", strings.Join(defaults, ", "))
+		b.WriteString("# traffic meant for the VPN through a routing table or mangle rules instead\n")
+	}
+	if len(peer.DNS) > 0 {
+		b.WriteString("# The config's DNS servers; this replaces the router's own:\n")
+		fmt.Fprintf(&b, "# /ip dns set servers=%s\n", strings.Join(peer.DNS, ","))
+	}
+	if peer.PostUp {
+		b.WriteString("# The config's PostUp and PostDown commands, such as a kill switch, have no RouterOS equivalent\n")
+	}
+	return b.String(), nil
+}
+
+// Handler for GET /users/:name/config?format=
+func clientConfigHandlerGin(c *gin.Context) {
+	format := c.DefaultQuery("format", "conf")
+	renderer, known := configFormats[format]
+	if !known && format != "conf" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "format must be conf, mikrotik, opnsense or pfsense",
+		})
+		return
+	}
+	if !includeSecrets(c) {
+		c.JSON(http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: "The config holds the client's private key; this token doesn't get it, or needs ?include=secrets",
+		})
+		return
+	}
+
+	name := c.Param("name")
+	storedName := tenantFrom(c).storedName(name)
+	wgConfigMutex.Lock()
+	_, config, err := readClientConfigLocked(storedName)
+	wgConfigMutex.Unlock()
+	if err != nil {
+		respondEndpointProfileError(c, err)
+		return
+	}
+
+	extension, contentType := "conf", "text/plain; charset=utf-8"
+	if known {
+		peer, err := parseClientPeerConfig(config)
+		if err == nil {
+			// Disabled clients aren't in the server config's index
+			peer.InterfacePublicKey = findPublicKeyByClientName(storedName)
+			if peer.InterfacePublicKey == "" && peer.PrivateKey != "" {
+				peer.InterfacePublicKey, err = derivePublicKey(peer.PrivateKey)
+			}
+		}
+		if err == nil {
+			config, err = renderer.render(name, peer)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Can't render %s as %s: %v", name, format, err),
+			})
+			return
+		}
+		extension, contentType = renderer.extension, renderer.contentType
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, clientFileName(name), extension))
+	c.Data(http.StatusOK, contentType, []byte(config))
+}
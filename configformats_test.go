@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientConfigDownload(t *testing.T) {
+	env := setupTestEnv(t)
+	setReadOnlyTokens(t, "reader-token")
+	alice := addedClient(t, env, "alice")
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/users/alice/config", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != alice.Config || rec.Header().Get("Content-Disposition") != `attachment; filename="alice.conf"` {
+		t.Errorf("conf: status %d, %v, %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	// The unversioned routes serve it too
+	rec = env.authedRequest(t, http.MethodGet, "/api/users/alice/config?format=mikrotik", nil)
+	script := rec.Body.String()
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Disposition") != `attachment; filename="alice.rsc"` {
+		t.Fatalf("mikrotik: status %d, %s", rec.Code, script)
+	}
+	for _, want := range []string{
+		"\n/interface wireguard\nadd name=\"wg-alice\" private-key=\"",
+		"\n/interface wireguard peers\nadd interface=\"wg-alice\" public-key=\"server-public-key\" preshared-key=\"psk",
+		" endpoint-address=203.0.113.10 endpoint-port=51820 allowed-address=0.0.0.0/0 persistent-keepalive=25s ",
+		"\n/ip address\nadd address=" + alice.IPV4 + "/32 interface=\"wg-alice\"\n",
+		"# Not routed: 0.0.0.0/0",
+		"# /ip dns set servers=1.1.1.1,1.0.0.1\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("missing %q in:\n%s", want, script)
+		}
+	}
+
+	for _, tt := range []struct {
+		path, token string
+		status      int
+	}{
+		{"/api/v1/users/alice/config?format=ovpn", "test-token", http.StatusBadRequest},
+		{"/api/v1/users/nobody/config", "test-token", http.StatusNotFound},
+		{"/api/v1/users/alice/config", "reader-token", http.StatusForbidden},
+	} {
+		if rec := env.request(t, http.MethodGet, tt.path, nil, tt.token); rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestRenderMikrotik(t *testing.T) {
+	peer, err := parseClientPeerConfig(`[Interface]
+PrivateKey = client-private-key
+Address = 10.66.0.7/32, fd42:42:42::7/128
+MTU = 1380
+PostUp = iptables -I OUTPUT ! -o %i -j REJECT
+
+[Peer]
+PublicKey = server-public-key
+Endpoint = [2001:db8::1]:51820
+AllowedIPs = 10.66.0.0/24, 192.168.10.1/24, fd42:42:42::/64
+PersistentKeepalive = 25
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := renderMikrotik(`lab "$1"`, peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# WireGuard client lab "$1" for RouterOS 7; paste into a terminal or upload and /import
+/interface wireguard
+add name="wg-lab \"\$1\"" private-key="client-private-key" mtu=1380
+/interface wireguard peers
+add interface="wg-lab \"\$1\"" public-key="server-public-key" endpoint-address=2001:db8::1 endpoint-port=51820 allowed-address=10.66.0.0/24,192.168.10.1/24,fd42:42:42::/64 persistent-keepalive=25s comment="VPN server"
+/ip address
+add address=10.66.0.7/32 interface="wg-lab \"\$1\""
+/ipv6 address
+add address=fd42:42:42::7/128 interface="wg-lab \"\$1\"" advertise=no
+/ip route
+add dst-address=10.66.0.0/24 gateway="wg-lab \"\$1\""
+add dst-address=192.168.10.0/24 gateway="wg-lab \"\$1\""
+/ipv6 route
+add dst-address=fd42:42:42::/64 gateway="wg-lab \"\$1\""
+# The config's PostUp and PostDown commands, such as a kill switch, have no RouterOS equivalent
+`
+	if script != want {
+		t.Errorf("got:\n%s\nwant:\n%s", script, want)
+	}
+
+	peer.Obfuscated = true
+	if _, err := renderMikrotik("lab", peer); err == nil {
+		t.Error("rendered an AmneziaWG config")
+	}
+}
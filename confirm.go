@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Destructive calls can be made to need a second step, so one fat-fingered
+// request can't delete every client or take the VPN down. With
+// CONFIRM_DESTRUCTIVE=token the first call is answered with 428 and a
+// single-use token bound to that exact request, which the caller sends back
+// in X-Confirm-Token to run it. With CONFIRM_DESTRUCTIVE=approval the call
+// is parked as a pending change until someone holding one of
+// APPROVER_TOKENS approves it. Approver tokens can't do anything else and
+// the API token can't approve, so two people are always involved. Tokens
+// and pending changes live in memory for CONFIRM_TTL.
+
+const (
+	confirmOff      = "off"
+	confirmToken    = "token"
+	confirmApproval = "approval"
+)
+
+// Routes that need confirmation, relative to the API version prefix
+var destructiveRoutes = map[string]bool{
+	"POST /users/delete":                 true,
+	"DELETE /users/:name":                true,
+	"POST /users/delete-all":             true,
+	"DELETE /trash/:name":                true,
+	"POST /projects/delete":              true,
+	"POST /projects/:project/delete-all": true,
+	"POST /tags/:tag/delete-all":         true,
+	"POST /nodes/:node/users/delete":     true,
+	"POST /stop":                         true,
+	"POST /restart":                      true,
+	"POST /server/teardown":              true,
+}
+
+// A destructive request waiting for an approver
+type PendingChange struct {
+	ID          string    `json:"id"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Body        string    `json:"body,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Status      string    `json:"status"` // pending, approved or rejected
+	RequestedAt time.Time `json:"requested_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// HTTP status of the approved request
+	ResultStatus int `json:"result_status,omitempty"`
+
+	token string // API key of the requester, used when replaying
+}
+
+type confirmStore struct {
+	mu sync.Mutex
+	// Request fingerprint by confirmation token
+	tokens  map[string]confirmTokenEntry
+	changes map[string]*PendingChange
+}
+
+type confirmTokenEntry struct {
+	fingerprint [32]byte
+	expires     time.Time
+}
+
+var confirmations = &confirmStore{tokens: map[string]confirmTokenEntry{}, changes: map[string]*PendingChange{}}
+
+// GraphQL and gRPC have no second step, so their destructive calls are
+// refused while confirmation is on
+var errConfirmViaREST = errors.New("confirmation is required; use the REST endpoint")
+
+// Set on the context of requests replayed by an approval
+type confirmedRequestKey struct{}
+
+// Check CONFIRM_DESTRUCTIVE and that approval mode has someone to approve
+func checkConfirmConfig() error {
+	switch CONFIRM_DESTRUCTIVE {
+	case "", confirmOff, confirmToken:
+		return nil
+	case confirmApproval:
+		if len(approverTokens()) == 0 {
+			return fmt.Errorf("approval mode needs APPROVER_TOKENS")
+		}
+		return nil
+	}
+	return fmt.Errorf("CONFIRM_DESTRUCTIVE must be %s, %s or %s", confirmToken, confirmApproval, confirmOff)
+}
+
+// Whether destructive calls need a second step
+func confirmationRequired() bool {
+	return CONFIRM_DESTRUCTIVE == confirmToken || CONFIRM_DESTRUCTIVE == confirmApproval
+}
+
+// APPROVER_TOKENS as a set
+func approverTokens() map[string]bool {
+	tokens := map[string]bool{}
+	for _, token := range splitList(secretValue(&APPROVER_TOKENS)) {
+		if !isAPIToken(token) {
+			tokens[token] = true
+		}
+	}
+	return tokens
+}
+
+// Route of the request relative to the API version prefix
+func apiRoute(c *gin.Context) string {
+	route := strings.TrimPrefix(c.FullPath(), "/api")
+	if strings.HasPrefix(route, "/v1/") || strings.HasPrefix(route, "/v2/") {
+		route = route[len("/v1"):]
+	}
+	return c.Request.Method + " " + route
+}
+
+// Keep approver tokens to the pending changes
+func approverAllowed(c *gin.Context) bool {
+	return strings.HasPrefix(c.FullPath(), "/api/v1/pending-changes") || strings.HasPrefix(c.FullPath(), "/api/v2/pending-changes")
+}
+
+func isApprover(c *gin.Context) bool {
+	return c.GetBool("approver")
+}
+
+func confirmFingerprint(c *gin.Context, body []byte) [32]byte {
+	return sha256.Sum256([]byte(c.Request.Method + " " + c.Request.URL.Path + " " + c.GetHeader("key") + " " + string(body)))
+}
+
+// Drop expired tokens and changes. Caller holds mu.
+func (s *confirmStore) pruneLocked(now time.Time) {
+	for token, entry := range s.tokens {
+		if now.After(entry.expires) {
+			delete(s.tokens, token)
+		}
+	}
+	for id, change := range s.changes {
+		if now.After(change.ExpiresAt) {
+			delete(s.changes, id)
+		}
+	}
+}
+
+// Hold back destructive requests until they are confirmed or approved
+func confirmationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mode := CONFIRM_DESTRUCTIVE
+		if !confirmationRequired() || !destructiveRoutes[apiRoute(c)] || serviceDryRun(c) || c.Request.Context().Value(confirmedRequestKey{}) != nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "Failed to read request body",
+			})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now()
+		if mode == confirmApproval {
+			id, err := randomHex(8)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, APIResponse{
+					Success: false,
+					Message: err.Error(),
+					Code:    errorCode(err),
+				})
+				return
+			}
+			change := &PendingChange{
+				ID:          id,
+				Method:      c.Request.Method,
+				Path:        c.Request.URL.Path,
+				Body:        string(body),
+				Status:      "pending",
+				RequestedAt: now.UTC(),
+				ExpiresAt:   now.Add(CONFIRM_TTL).UTC(),
+				token:       c.GetHeader("key"),
+			}
+			if tenant := tenantFrom(c); tenant != nil {
+				change.Tenant = tenant.Name
+			}
+			snapshot := *change
+
+			confirmations.mu.Lock()
+			confirmations.pruneLocked(now)
+			confirmations.changes[id] = change
+			confirmations.mu.Unlock()
+
+			c.AbortWithStatusJSON(http.StatusAccepted, APIResponse{
+				Success: true,
+				Message: "Change is pending approval",
+				Data:    snapshot,
+			})
+			return
+		}
+
+		// A token is used up whether or not it matches, so it can't be probed
+		fingerprint := confirmFingerprint(c, body)
+		confirmations.mu.Lock()
+		confirmations.pruneLocked(now)
+		token := c.GetHeader("X-Confirm-Token")
+		entry, confirmed := confirmations.tokens[token]
+		delete(confirmations.tokens, token)
+		confirmations.mu.Unlock()
+		if confirmed && entry.fingerprint == fingerprint {
+			c.Next()
+			return
+		}
+
+		token, err = randomHex(16)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+		expires := now.Add(CONFIRM_TTL)
+		confirmations.mu.Lock()
+		confirmations.tokens[token] = confirmTokenEntry{fingerprint: fingerprint, expires: expires}
+		confirmations.mu.Unlock()
+
+		c.AbortWithStatusJSON(http.StatusPreconditionRequired, APIResponse{
+			Success: false,
+			Message: "Repeat the request with this X-Confirm-Token to confirm it",
+			Data: gin.H{
+				"confirm_token": token,
+				"expires_at":    expires.UTC(),
+			},
+		})
+	}
+}
+
+// The response of a replayed request
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bufferedResponse) Header() http.Header         { return r.header }
+func (r *bufferedResponse) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *bufferedResponse) WriteHeader(status int)      { r.status = status }
+
+func registerPendingChangeRoutes(api *gin.RouterGroup, router *gin.Engine) {
+	api.GET("/pending-changes", listPendingChangesHandlerGin)
+	api.POST("/pending-changes/:id/approve", approvePendingChangeHandler(router))
+	api.POST("/pending-changes/:id/reject", rejectPendingChangeHandlerGin)
+}
+
+// Handler listing the pending and recently decided changes, oldest first
+func listPendingChangesHandlerGin(c *gin.Context) {
+	confirmations.mu.Lock()
+	confirmations.pruneLocked(time.Now())
+	changes := make([]PendingChange, 0, len(confirmations.changes))
+	for _, change := range confirmations.changes {
+		changes = append(changes, *change)
+	}
+	confirmations.mu.Unlock()
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].RequestedAt.Before(changes[j].RequestedAt) })
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    changes,
+	})
+}
+
+// Take a pending change for a decision; responds and returns nil when
+// there is none or the caller may not decide it. Approvers may decide any
+// change, and with byRequester the token that requested it too.
+func takePendingChange(c *gin.Context, status string, byRequester bool) *PendingChange {
+	confirmations.mu.Lock()
+	defer confirmations.mu.Unlock()
+	confirmations.pruneLocked(time.Now())
+
+	change := confirmations.changes[c.Param("id")]
+	if change == nil {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Pending change not found",
+		})
+		return nil
+	}
+	if !isApprover(c) && (!byRequester || c.GetHeader("key") != change.token) {
+		c.JSON(http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: "Only approvers and the requester can decide this change",
+		})
+		return nil
+	}
+	if change.Status != "pending" {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "Change was already " + change.Status,
+		})
+		return nil
+	}
+	change.Status = status
+	return change
+}
+
+// Handler running a pending change as its requester. Only approver tokens
+// may approve.
+func approvePendingChangeHandler(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		change := takePendingChange(c, "approved", false)
+		if change == nil {
+			return
+		}
+
+		ctx := context.WithValue(c.Request.Context(), confirmedRequestKey{}, true)
+		req, err := http.NewRequestWithContext(ctx, change.Method, change.Path, strings.NewReader(change.Body))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("key", change.token)
+		resp := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+		router.ServeHTTP(resp, req)
+
+		confirmations.mu.Lock()
+		change.ResultStatus = resp.status
+		snapshot := *change
+		confirmations.mu.Unlock()
+
+		var result json.RawMessage
+		if json.Valid(resp.body.Bytes()) {
+			result = resp.body.Bytes()
+		}
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: "Change approved",
+			Data: gin.H{
+				"change": snapshot,
+				"result": result,
+			},
+		})
+	}
+}
+
+// Handler rejecting a pending change; the requester may withdraw it
+func rejectPendingChangeHandlerGin(c *gin.Context) {
+	change := takePendingChange(c, "rejected", true)
+	if change == nil {
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Change rejected",
+		Data:    change,
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func confirmedRequest(t *testing.T, env *testEnv, path string, body any, confirmToken string) *httptest.ResponseRecorder {
+	t.Helper()
+	encoded, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(encoded))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("key", "test-token")
+	req.Header.Set("X-Confirm-Token", confirmToken)
+	recorder := httptest.NewRecorder()
+	env.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestConfirmTokenMode(t *testing.T) {
+	env := setupTestEnv(t)
+	CONFIRM_DESTRUCTIVE = confirmToken
+	t.Cleanup(func() { CONFIRM_DESTRUCTIVE = confirmOff })
+
+	// Only destructive routes need confirming
+	for _, name := range []string{"alice", "bob"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("adding %s: got status %d", name, code)
+		}
+	}
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	var resp struct {
+		Data struct {
+			ConfirmToken string `json:"confirm_token"`
+		} `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusPreconditionRequired || resp.Data.ConfirmToken == "" {
+		t.Fatalf("unconfirmed delete: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(env.configContent(t), "### Client alice") {
+		t.Fatal("alice must not be deleted before confirming")
+	}
+
+	// The token is bound to the request it was issued for
+	if code := confirmedRequest(t, env, "/api/v1/users/delete", DeleteUserRequest{Name: "bob"}, resp.Data.ConfirmToken).Code; code != http.StatusPreconditionRequired {
+		t.Errorf("token for another body: got status %d, want 428", code)
+	}
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if code := confirmedRequest(t, env, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"}, resp.Data.ConfirmToken).Code; code != http.StatusOK {
+		t.Errorf("confirmed delete: got status %d, want 200", code)
+	}
+	if strings.Contains(env.configContent(t), "### Client alice") || !strings.Contains(env.configContent(t), "### Client bob") {
+		t.Errorf("only alice must be deleted:\n%s", env.configContent(t))
+	}
+	if code := confirmedRequest(t, env, "/api/v1/users/delete-all", nil, resp.Data.ConfirmToken).Code; code != http.StatusPreconditionRequired {
+		t.Errorf("reused token: got status %d, want 428", code)
+	}
+
+	// GraphQL has no second step
+	if _, err := gqlDeleteClient(map[string]interface{}{"name": "bob"}); err != errConfirmViaREST {
+		t.Errorf("GraphQL delete: got %v, want errConfirmViaREST", err)
+	}
+}
+
+func TestConfirmApprovalMode(t *testing.T) {
+	env := setupTestEnv(t)
+	CONFIRM_DESTRUCTIVE, APPROVER_TOKENS = confirmApproval, "approver-token"
+	t.Cleanup(func() { CONFIRM_DESTRUCTIVE, APPROVER_TOKENS = confirmOff, "" })
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	var resp struct {
+		Data PendingChange `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusAccepted || resp.Data.Status != "pending" || !strings.Contains(env.configContent(t), "### Client alice") {
+		t.Fatalf("delete must be parked: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	approve := "/api/v1/pending-changes/" + resp.Data.ID + "/approve"
+
+	// Approvers can do nothing else, and the requester can't approve
+	if code := env.request(t, http.MethodGet, "/api/v1/users", nil, "approver-token").Code; code != http.StatusForbidden {
+		t.Errorf("approver listing users: got status %d, want 403", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, approve, nil).Code; code != http.StatusForbidden {
+		t.Errorf("API token approving: got status %d, want 403", code)
+	}
+
+	rec = env.request(t, http.MethodPost, approve, nil, "approver-token")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"result_status":200`) || !strings.Contains(rec.Body.String(), `"result":{"success":true`) {
+		t.Fatalf("approve: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(env.configContent(t), "### Client alice") {
+		t.Error("alice must be deleted once approved")
+	}
+	if code := env.request(t, http.MethodPost, approve, nil, "approver-token").Code; code != http.StatusConflict {
+		t.Errorf("approving twice: got status %d, want 409", code)
+	}
+
+	// The requester may withdraw a change
+	json.Unmarshal(env.authedRequest(t, http.MethodPost, "/api/v1/restart", nil).Body.Bytes(), &resp)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/pending-changes/"+resp.Data.ID+"/reject", nil).Code; code != http.StatusOK {
+		t.Errorf("withdrawing: got status %d, want 200", code)
+	}
+	body := env.request(t, http.MethodGet, "/api/v1/pending-changes", nil, "approver-token").Body.String()
+	if !strings.Contains(body, `"status":"approved"`) || !strings.Contains(body, `"status":"rejected"`) {
+		t.Errorf("unexpected pending changes: %s", body)
+	}
+}
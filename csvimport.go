@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deployments managed from a spreadsheet move over by posting it as CSV to
+// POST /users/import with Content-Type: text/csv. The header row names the
+// columns: name is required, ipv4 and ipv6 pick addresses (allocated when
+// empty), tags are separated by commas or semicolons, email and notes are
+// stored with the client, and any other column becomes a metadata key.
+// Each row gets new keys. Rows that can't be imported are reported and
+// skipped, the rest are created under one lock hold with one config apply.
+// GET /users/export?format=csv writes the same columns back.
+
+const importSourceCSV = "csv"
+
+// Columns with a meaning of their own; the others are metadata
+var csvClientColumns = map[string]bool{
+	"name":  true,
+	"ipv4":  true,
+	"ipv6":  true,
+	"tags":  true,
+	"email": true,
+	"notes": true,
+}
+
+// A client row of an import
+type csvClientRow struct {
+	line     int
+	req      AddUserRequest
+	metadata ClientMetadataRequest
+}
+
+// The client rows of a CSV import. Rows that can't be used become skipped
+// results; an unusable file is an error.
+func parseClientCSV(r io.Reader) ([]csvClientRow, []ImportResult, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("The CSV has no header row")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid CSV: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		// Spreadsheets like to start the file with a byte order mark
+		column = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		if _, ok := columns[column]; ok {
+			return nil, nil, fmt.Errorf("The CSV has two %s columns", column)
+		}
+		if !csvClientColumns[column] && !metadataKeyRegex.MatchString(column) {
+			return nil, nil, fmt.Errorf("Column %q is not a metadata key: use 1-64 letters, digits, '.', '_' or '-'", column)
+		}
+		columns[column] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, nil, errors.New("The CSV needs a name column")
+	}
+
+	var rows []csvClientRow
+	var skipped []ImportResult
+	seen := make(map[string]bool)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid CSV: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		row := csvClientRow{line: line, metadata: ClientMetadataRequest{Metadata: map[string]string{}}}
+		for column, i := range columns {
+			value := ""
+			if i < len(record) {
+				value = strings.TrimSpace(record[i])
+			}
+			switch column {
+			case "name":
+				row.req.Name = value
+			case "ipv4":
+				row.req.IPV4 = value
+			case "ipv6":
+				row.req.IPV6 = value
+			case "tags":
+				row.req.Tags = strings.FieldsFunc(value, func(r rune) bool {
+					return r == ',' || r == ';' || unicode.IsSpace(r)
+				})
+			case "notes":
+				row.req.Notes = value
+			default:
+				if value != "" {
+					row.metadata.Metadata[column] = value
+				}
+			}
+		}
+		row.metadata.Notes, row.metadata.Tags = &row.req.Notes, row.req.Tags
+
+		reason := ""
+		switch {
+		case row.req.Name == "":
+			reason = "name is empty"
+		case !validClientName(row.req.Name):
+			reason = "Client name " + clientNameMessage()
+		case seen[row.req.Name]:
+			reason = "name appears on an earlier line"
+		}
+		if reason == "" {
+			if err := row.req.validateFields(); err != nil {
+				reason = err.Error()
+			} else if err := row.metadata.validate(); err != nil {
+				reason = err.Error()
+			}
+		}
+		if reason != "" {
+			skipped = append(skipped, ImportResult{Name: row.req.Name, Line: line, Status: "skipped", Message: reason})
+			continue
+		}
+		seen[row.req.Name] = true
+		rows = append(rows, row)
+	}
+	return rows, skipped, nil
+}
+
+// Create the clients of the rows, like a bulk add with addresses and
+// metadata. Returns a result per row.
+func importCSVClients(rows []csvClientRow, dryRun bool) ([]ImportResult, error) {
+	// Keys are generated before taking the lock, as for bulk adds
+	keys := make([]clientKeys, len(rows))
+	if !dryRun {
+		for i := range rows {
+			k, err := generateClientKeys()
+			if err != nil {
+				return nil, err
+			}
+			if !CLIENT_PRESHARED_KEYS {
+				k.preSharedKey = ""
+			}
+			keys[i] = k
+		}
+	}
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	inv, err := currentInventory()
+	if err != nil {
+		return nil, err
+	}
+	// Addresses given on earlier rows
+	claimed := make(map[netip.Addr]string)
+
+	results := make([]ImportResult, 0, len(rows))
+	created := 0
+	var importErr error
+	for i, row := range rows {
+		result := ImportResult{Name: row.req.Name, Line: row.line}
+		exists, err := clientExists(row.req.Name)
+		if err != nil {
+			return results, err
+		}
+		if exists {
+			result.Status = "exists"
+			results = append(results, result)
+			continue
+		}
+
+		taken := ""
+		for _, address := range []string{row.req.IPV4, row.req.IPV6} {
+			addr, err := netip.ParseAddr(address)
+			if err != nil {
+				continue
+			}
+			if owner, ok := inv.byAddr[addr]; ok {
+				taken = fmt.Sprintf("%s is used by %s", address, owner)
+			} else if owner, ok := claimed[addr]; ok {
+				taken = fmt.Sprintf("%s is given to %s on an earlier line", address, owner)
+			}
+		}
+		if taken != "" {
+			result.Status, result.Message = "skipped", taken
+			results = append(results, result)
+			continue
+		}
+		for _, address := range []string{row.req.IPV4, row.req.IPV6} {
+			if addr, err := netip.ParseAddr(address); err == nil {
+				claimed[addr] = row.req.Name
+			}
+		}
+
+		// Allocated addresses only become known once the earlier rows are
+		// written, so a dry run reports the ones given
+		result.Status = "imported"
+		result.IPV4, result.IPV6 = row.req.IPV4, row.req.IPV6
+		if dryRun {
+			results = append(results, result)
+			continue
+		}
+
+		ipv4, ipv6, err := allocateClientIPsLocked(row.req.IPV4, row.req.IPV6)
+		if err != nil {
+			// The rows created so far are still synced
+			importErr = fmt.Errorf("failed to import %s: %w", row.req.Name, err)
+			break
+		}
+		if _, err := createWireGuardClientLocked(row.req.Name, ipv4, ipv6, keys[i], nil, ""); err != nil {
+			result.Status, result.Message = "skipped", err.Error()
+			results = append(results, result)
+			continue
+		}
+		created++
+		result.IPV4, result.IPV6 = ipv4, ipv6
+		if len(row.metadata.Metadata) > 0 || row.req.Notes != "" || len(row.metadata.Tags) > 0 {
+			if err := setClientMetadata(row.req.Name, row.metadata); err != nil {
+				log.Printf("Warning: Failed to store metadata of %s: %v", row.req.Name, err)
+			}
+		}
+		results = append(results, result)
+	}
+
+	if created > 0 {
+		if err := syncWireGuardConf(); err != nil {
+			return results, fmt.Errorf("failed to sync WireGuard config: %w", err)
+		}
+	}
+	return results, importErr
+}
+
+// Handler for POST /users/import with a CSV body
+func importCSVHandlerGin(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+	rows, results, err := parseClientCSV(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if !dryRun && !reserveCreates(c, len(rows)) {
+		return
+	}
+	imported, err := importCSVClients(rows, dryRun)
+	if !dryRun {
+		releaseCreates(c, len(rows)-importedCount(imported))
+	}
+	results = append(results, imported...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Line < results[j].Line })
+	respondImport(c, importSourceCSV, dryRun, results, err)
+}
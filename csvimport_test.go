@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func (e *testEnv) importCSV(t *testing.T, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	req.Header.Set("key", "test-token")
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestImportCSV(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+
+	body := "\ufeffName,ipv4,tags,email,site\n" +
+		"bob,10.66.66.20,\"ops, vip\",bob@example.com,berlin\n" +
+		"alice,,,,\n" +
+		"bad name,,,,\n" +
+		"carol,10.66.66.20,,,\n" +
+		"dave,,,,\n"
+
+	rec := env.importCSV(t, "/api/v1/users/import?dry_run=true", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dry run: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if clientConfigFile("bob") != "" {
+		t.Fatal("dry run created bob")
+	}
+
+	rec = env.importCSV(t, "/api/v1/users/import", body)
+	var resp struct {
+		Data struct {
+			Source   string         `json:"source"`
+			Imported int            `json:"imported"`
+			Results  []ImportResult `json:"results"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("import: status %d, %s", rec.Code, rec.Body.String())
+	}
+	var statuses []string
+	for _, result := range resp.Data.Results {
+		statuses = append(statuses, result.Name+":"+result.Status)
+	}
+	want := []string{"bob:imported", "alice:exists", "bad name:skipped", "carol:skipped", "dave:imported"}
+	if resp.Data.Source != importSourceCSV || resp.Data.Imported != 2 || !reflect.DeepEqual(statuses, want) {
+		t.Errorf("got %+v, want %v", resp.Data, want)
+	}
+	if resp.Data.Results[2].Line != 4 {
+		t.Errorf("bad name: got line %d, want 4", resp.Data.Results[2].Line)
+	}
+
+	config := env.configContent(t)
+	if !strings.Contains(config, "### Client bob\n") || !strings.Contains(config, "AllowedIPs = 10.66.66.20/32") || !strings.Contains(config, "### Client dave\n") {
+		t.Errorf("server config:\n%s", config)
+	}
+	entry, err := clientMetadataOf("bob")
+	if err != nil || entry == nil {
+		t.Fatalf("bob's metadata: %v, %v", entry, err)
+	}
+	if !reflect.DeepEqual(entry.Tags, []string{"ops", "vip"}) || entry.Metadata["email"] != "bob@example.com" || entry.Metadata["site"] != "berlin" {
+		t.Errorf("bob's metadata: %+v", entry)
+	}
+
+	if rec := env.importCSV(t, "/api/v1/users/import", "ipv4\n10.66.66.30\n"); rec.Code != http.StatusBadRequest {
+		t.Errorf("no name column: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	env := setupTestEnv(t)
+	env.importCSV(t, "/api/v1/users/import", "name,ipv4,tags,email,notes,site\nbob,10.66.66.20,ops;vip,bob@example.com,\"desk, 2nd floor\",berlin\n")
+	alice := addedClient(t, env, "alice")
+
+	setReadOnlyTokens(t, "reader-token")
+	rec := env.request(t, http.MethodGet, "/api/v1/users/export?format=csv", nil, "reader-token")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("export: status %d, %s", rec.Code, rec.Body.String())
+	}
+	want := "name,ipv4,ipv6,tags,email,notes,site\n" +
+		"alice," + alice.IPV4 + ",,,,laptop,\n" +
+		"bob,10.66.66.20,,ops;vip,bob@example.com,\"desk, 2nd floor\",berlin\n"
+	if rec.Body.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", rec.Body.String(), want)
+	}
+}
+
+func TestImportCSVKeepsRowsBeforeAFailure(t *testing.T) {
+	env := setupTestEnv(t)
+	wgParams.ServerWGIPv6 = "fd42::1"
+
+	// A skipped row doesn't claim its other address
+	body := "name,ipv4,ipv6\n" +
+		"bob,10.66.66.20,fd42::20\n" +
+		"carol,10.66.66.20,fd42::30\n" +
+		"dave,10.66.66.30,fd42::30\n"
+	if rec := env.importCSV(t, "/api/v1/users/import", body); rec.Code != http.StatusOK || clientConfigFile("dave") == "" {
+		t.Fatalf("import: status %d, %s", rec.Code, rec.Body.String())
+	}
+
+	// Addresses can't be allocated for frank, but erin is still synced
+	wgParams.ServerWGIPv6 = "fd42:bad"
+	syncs := env.syncconfCalls(t)
+	body = "name,ipv4,ipv6\n" +
+		"erin,10.66.66.40,fd42::40\n" +
+		"frank,,\n" +
+		"grace,10.66.66.50,fd42::50\n"
+	rec := env.importCSV(t, "/api/v1/users/import", body)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("failed import: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(env.configContent(t), "### Client erin\n") || env.syncconfCalls(t) != syncs+1 {
+		t.Errorf("erin wasn't synced")
+	}
+	if clientConfigFile("grace") != "" {
+		t.Error("rows after the failure were imported")
+	}
+}
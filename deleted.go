@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deleting a client doesn't destroy it right away. Its peer block, config
+// file and metadata move to DELETED_CLIENTS_FILE for
+// DELETED_CLIENT_RETENTION, and POST /users/:name/restore brings it back
+// with the same keys and addresses, which stay reserved in the meantime.
+// Its firewall policy and group membership are not kept. With a retention
+// of 0 clients are deleted for good right away. GET /trash lists what is
+// kept, DELETE /trash/:name drops a client early, and the leader purges
+// expired ones every hour.
+
+// How often expired clients are purged
+const deletedClientsPurgeInterval = time.Hour
+
+// A deleted client as kept in DELETED_CLIENTS_FILE, keys included
+type deletedClient struct {
+	Name       string          `json:"name"`
+	Peer       string          `json:"peer"`                  // Its blocks of the server config
+	ConfigFile string          `json:"config_file,omitempty"` // Base name in WIREGUARD_CLIENTS
+	Config     string          `json:"config,omitempty"`
+	Metadata   *clientMetadata `json:"metadata,omitempty"`
+	DeletedAt  time.Time       `json:"deleted_at"`
+	ExpiresAt  time.Time       `json:"expires_at"`
+}
+
+// A deleted client as listed by the API, without its private keys
+type DeletedClient struct {
+	Name      string `json:"name"`
+	IPV4      string `json:"ipv4,omitempty"`
+	IPV6      string `json:"ipv6,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	// Deleted while disabled, and restored disabled
+	Disabled  bool              `json:"disabled,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Notes     string            `json:"notes,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	DeletedAt time.Time         `json:"deleted_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
+
+var (
+	// Taken after wgConfigMutex where both are held
+	deletedClientsMutex sync.Mutex
+
+	errNotDeleted   = errors.New("No deleted client with this name")
+	errAddressTaken = errors.New("address is now used by another client")
+)
+
+// DELETED_CLIENTS_FILE, or deleted-clients.json next to the server config
+func deletedClientsFile() string {
+	if DELETED_CLIENTS_FILE != "" {
+		return DELETED_CLIENTS_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "deleted-clients.json")
+}
+
+// Caller holds deletedClientsMutex. Clients expired by now are left out.
+func loadDeletedClientsLocked(now time.Time) (map[string]*deletedClient, error) {
+	deleted := make(map[string]*deletedClient)
+	content, err := os.ReadFile(deletedClientsFile())
+	if os.IsNotExist(err) {
+		return deleted, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deleted clients file: %v", err)
+	}
+	if err := json.Unmarshal(content, &deleted); err != nil {
+		return nil, fmt.Errorf("failed to parse deleted clients file: %v", err)
+	}
+	for name, client := range deleted {
+		if !now.Before(client.ExpiresAt) {
+			delete(deleted, name)
+		}
+	}
+	return deleted, nil
+}
+
+// Caller holds deletedClientsMutex
+func saveDeletedClientsLocked(deleted map[string]*deletedClient) error {
+	content, err := json.MarshalIndent(deleted, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(deletedClientsFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write deleted clients file: %v", err)
+	}
+	return nil
+}
+
+// The files a client's config may be in, depending on how it was added
+func clientConfigPaths(name string) []string {
+	return []string{
+		filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+clientFileName(name)+".conf"),
+		filepath.Join(WIREGUARD_CLIENTS, "wg0-client-"+clientFileName(name)+".conf"),
+		filepath.Join(WIREGUARD_CLIENTS, "awg0-client-"+clientFileName(name)+".conf"),
+		filepath.Join(WIREGUARD_CLIENTS, clientFileName(name)+".conf"),
+	}
+}
+
+// Keep the named clients of the server config content so they can be
+// restored until DELETED_CLIENT_RETENTION has passed. Caller holds
+// wgConfigMutex.
+func archiveClientsLocked(content []byte, names []string, now time.Time) error {
+	if DELETED_CLIENT_RETENTION <= 0 || len(names) == 0 {
+		return nil
+	}
+	sections := scanClientSections(content)
+
+	archived := make([]*deletedClient, 0, len(names))
+	for _, name := range names {
+		// The blocks of the first name form found, as removeClientFromConfig
+		// removes them
+		var blocks []string
+		for _, form := range clientSectionNames(name) {
+			for _, section := range sections {
+				if section.name == form {
+					blocks = append(blocks, strings.TrimRight(string(content[section.start:section.end]), "\n"))
+				}
+			}
+			if len(blocks) > 0 {
+				break
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		client := &deletedClient{
+			Name:      name,
+			Peer:      strings.Join(blocks, "\n\n"),
+			DeletedAt: now.UTC(),
+			ExpiresAt: now.Add(DELETED_CLIENT_RETENTION).UTC(),
+		}
+		for _, path := range clientConfigPaths(name) {
+			if config, err := os.ReadFile(path); err == nil {
+				client.ConfigFile, client.Config = filepath.Base(path), string(config)
+				break
+			}
+		}
+		metadata, err := clientMetadataOf(name)
+		if err != nil {
+			return err
+		}
+		client.Metadata = metadata
+		archived = append(archived, client)
+	}
+
+	deletedClientsMutex.Lock()
+	defer deletedClientsMutex.Unlock()
+	deleted, err := loadDeletedClientsLocked(now)
+	if err != nil {
+		return err
+	}
+	// A name deleted again replaces its older copy
+	for _, client := range archived {
+		deleted[client.Name] = client
+	}
+	return saveDeletedClientsLocked(deleted)
+}
+
+// The peer blocks of the deleted clients, whose addresses stay reserved
+// until they expire
+func reservedPeers() []byte {
+	deletedClientsMutex.Lock()
+	defer deletedClientsMutex.Unlock()
+
+	deleted, err := loadDeletedClientsLocked(time.Now())
+	if err != nil {
+		log.Printf("Warning: addresses of deleted clients are not reserved: %v", err)
+		return nil
+	}
+	var peers []byte
+	for _, client := range deleted {
+		peers = append(peers, '\n')
+		peers = append(peers, client.Peer...)
+		peers = append(peers, '\n')
+	}
+	return peers
+}
+
+// The server config plus the peers of deleted clients, for finding free
+// addresses
+func readAllocationContent() ([]byte, error) {
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	return append(content, reservedPeers()...), nil
+}
+
+// The tunnel addresses of a deleted client
+func (d *deletedClient) addresses() (string, string) {
+	var ipv4, ipv6 string
+	for _, section := range scanClientSections([]byte(d.Peer)) {
+		tunnel, _ := splitAllowedIPs(section.allowedIPs)
+		for _, entry := range tunnel {
+			if strings.HasSuffix(entry, "/128") {
+				ipv6 = strings.TrimSuffix(entry, "/128")
+			} else {
+				ipv4 = strings.TrimSuffix(entry, "/32")
+			}
+		}
+		if ipv4 != "" || ipv6 != "" {
+			break
+		}
+	}
+	return ipv4, ipv6
+}
+
+func (d *deletedClient) listed(name string) DeletedClient {
+	listed := DeletedClient{Name: name, DeletedAt: d.DeletedAt, ExpiresAt: d.ExpiresAt}
+	listed.IPV4, listed.IPV6 = d.addresses()
+	for _, section := range scanClientSections([]byte(d.Peer)) {
+		listed.PublicKey, listed.Disabled = section.publicKey, section.disabled
+		break
+	}
+	if d.Metadata != nil {
+		listed.Metadata, listed.Notes, listed.Tags = d.Metadata.Metadata, d.Metadata.Notes, d.Metadata.Tags
+	}
+	return listed
+}
+
+// Put a deleted client of the tenant back as it was
+func restoreDeletedClient(tenant *Tenant, name string) (Client, error) {
+	stored := tenant.storedName(name)
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+	deletedClientsMutex.Lock()
+	defer deletedClientsMutex.Unlock()
+
+	deleted, err := loadDeletedClientsLocked(time.Now())
+	if err != nil {
+		return Client{}, err
+	}
+	client := deleted[stored]
+	if client == nil {
+		return Client{}, errNotDeleted
+	}
+
+	exists, err := clientExists(stored)
+	if err != nil {
+		return Client{}, err
+	}
+	if exists {
+		return Client{}, errClientExists
+	}
+	if err := tenant.checkLimitLocked(); err != nil {
+		return Client{}, err
+	}
+
+	// Addresses given explicitly to new clients aren't checked against the
+	// reserved ones
+	inv, err := currentInventory()
+	if err != nil {
+		return Client{}, err
+	}
+	ipv4, ipv6 := client.addresses()
+	for _, address := range []string{ipv4, ipv6} {
+		if addr, err := netip.ParseAddr(address); err == nil {
+			if owner, ok := inv.byAddr[addr]; ok {
+				return Client{}, fmt.Errorf("%w: %s has %s", errAddressTaken, owner, address)
+			}
+		}
+	}
+
+	// To hooks a restore is an add
+	hookClient := hookClientFrom([]byte(client.Peer), stored)
+	if err := runPreHooks(hookAdd, hookClient); err != nil {
+		return Client{}, err
+	}
+
+	if client.ConfigFile != "" {
+		if err := os.MkdirAll(WIREGUARD_CLIENTS, 0700); err != nil {
+			return Client{}, fmt.Errorf("failed to create clients directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(WIREGUARD_CLIENTS, client.ConfigFile), []byte(client.Config), 0600); err != nil {
+			return Client{}, fmt.Errorf("failed to write client config: %v", err)
+		}
+	}
+	f, err := os.OpenFile(WG_CONFIG_FILE, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to open server config: %v", err)
+	}
+	_, err = f.WriteString("\n" + client.Peer + "\n")
+	f.Close()
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to update server config: %v", err)
+	}
+	if client.Metadata != nil {
+		if err := restoreClientMetadata(stored, client.Metadata); err != nil {
+			log.Printf("Warning: Failed to restore metadata of %s: %v", stored, err)
+		}
+	}
+
+	delete(deleted, stored)
+	if err := saveDeletedClientsLocked(deleted); err != nil {
+		return Client{}, err
+	}
+	announceAfterSyncLocked(changeClientCreated, "restored", hookAdd, hookClient)
+	if err := syncWireGuardConf(); err != nil {
+		return Client{}, fmt.Errorf("failed to sync WireGuard config: %w", err)
+	}
+
+	restored := Client{Name: name, IPV4: ipv4, IPV6: ipv6, Config: client.Config}
+	for _, section := range scanClientSections([]byte(client.Peer)) {
+		restored.PublicKey = section.publicKey
+		restored.Disabled = section.disabled
+		break
+	}
+	if client.Metadata != nil {
+		restored.Metadata, restored.Notes, restored.Tags = client.Metadata.Metadata, client.Metadata.Notes, client.Metadata.Tags
+	}
+	return restored, nil
+}
+
+// Drop the deleted clients whose retention has passed, keys and all
+func purgeExpiredDeletedClients(now time.Time) error {
+	deletedClientsMutex.Lock()
+	defer deletedClientsMutex.Unlock()
+
+	if _, err := os.Stat(deletedClientsFile()); os.IsNotExist(err) {
+		return nil
+	}
+	deleted, err := loadDeletedClientsLocked(now)
+	if err != nil {
+		return err
+	}
+	return saveDeletedClientsLocked(deleted)
+}
+
+// Purge expired deleted clients every deletedClientsPurgeInterval, or on
+// the job's schedule. Only the leader writes the file.
+func startDeletedClientsPurge() {
+	if DELETED_CLIENT_RETENTION <= 0 {
+		return
+	}
+
+	scheduleJob(jobPurgeDeletedClients, deletedClientsPurgeInterval, true, func() error {
+		err := purgeExpiredDeletedClients(time.Now())
+		if err != nil {
+			log.Printf("Purging deleted clients: %v", err)
+		}
+		return err
+	})
+}
+
+// Handler listing the deleted clients that can still be restored, most
+// recently deleted first
+func listDeletedClientsHandlerGin(c *gin.Context) {
+	deletedClientsMutex.Lock()
+	deleted, err := loadDeletedClientsLocked(time.Now())
+	deletedClientsMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	clients := make([]DeletedClient, 0, len(deleted))
+	for name, client := range deleted {
+		clients = append(clients, client.listed(name))
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if !clients[i].DeletedAt.Equal(clients[j].DeletedAt) {
+			return clients[i].DeletedAt.After(clients[j].DeletedAt)
+		}
+		return clients[i].Name < clients[j].Name
+	})
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    clients,
+	})
+}
+
+// Handler restoring a deleted client with its keys and addresses
+func restoreUserHandlerGin(c *gin.Context) {
+	name := c.Param("name")
+	if !validClientName(name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Client name " + clientNameMessage(),
+			Code:    codeInvalidName,
+		})
+		return
+	}
+
+	client, err := restoreDeletedClient(tenantFrom(c), name)
+	switch {
+	case errors.Is(err, errNotDeleted):
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    codeClientNotFound,
+		})
+	case errors.Is(err, errClientExists):
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: clientExistsMessage,
+			Code:    codeNameTaken,
+		})
+	case errors.Is(err, errAddressTaken):
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "Can't restore the client: " + err.Error(),
+		})
+	case respondTenantError(c, err):
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+	default:
+		respondCreated(c, "/users/"+url.PathEscape(name), "Client restored successfully", client)
+	}
+}
+
+// Handler dropping a deleted client for good before its retention passes,
+// e.g. when its keys were compromised
+func purgeDeletedClientHandlerGin(c *gin.Context) {
+	name := c.Param("name")
+
+	deletedClientsMutex.Lock()
+	defer deletedClientsMutex.Unlock()
+	deleted, err := loadDeletedClientsLocked(time.Now())
+	if err == nil && deleted[name] == nil {
+		err = errNotDeleted
+	}
+	if err == nil {
+		delete(deleted, name)
+		err = saveDeletedClientsLocked(deleted)
+	}
+	switch {
+	case errors.Is(err, errNotDeleted):
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    codeClientNotFound,
+		})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+	default:
+		respondDeleted(c, "Deleted client purged")
+	}
+}
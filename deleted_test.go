@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addedClient(t *testing.T, env *testEnv, name string) Client {
+	t.Helper()
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name, Notes: "laptop"})
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("adding %s: status %d, %s", name, rec.Code, rec.Body.String())
+	}
+	return resp.Data
+}
+
+func TestRestoreDeletedClient(t *testing.T) {
+	env := setupTestEnv(t)
+	alice := addedClient(t, env, "alice")
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"}); rec.Code != http.StatusOK {
+		t.Fatalf("delete: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(env.configContent(t), "### Client alice") {
+		t.Fatal("deleted client is still in the server config")
+	}
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/trash", nil)
+	var list struct {
+		Data []DeletedClient `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].Name != "alice" || list.Data[0].IPV4 != alice.IPV4 || list.Data[0].IPV6 != alice.IPV6 {
+		t.Fatalf("deleted clients: got %+v, want alice at %s", list.Data, alice.IPV4)
+	}
+	if list.Data[0].PublicKey != alice.PublicKey || list.Data[0].Notes != "laptop" || list.Data[0].ExpiresAt.Sub(list.Data[0].DeletedAt) != DELETED_CLIENT_RETENTION {
+		t.Errorf("deleted client: got %+v", list.Data[0])
+	}
+	if strings.Contains(rec.Body.String(), "PrivateKey") {
+		t.Error("deleted clients list shows keys")
+	}
+
+	// The address stays reserved for the restore
+	if bob := addedClient(t, env, "bob"); bob.IPV4 == alice.IPV4 {
+		t.Errorf("bob got alice's reserved address %s", bob.IPV4)
+	}
+
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/restore", nil)
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore: status %d, %s", rec.Code, rec.Body.String())
+	}
+	restored := resp.Data
+	if restored.IPV4 != alice.IPV4 || restored.IPV6 != alice.IPV6 || restored.Config != alice.Config || restored.Notes != "laptop" {
+		t.Errorf("restored %+v, want %+v", restored, alice)
+	}
+	if !strings.Contains(env.configContent(t), "### Client alice") {
+		t.Error("restored client is missing from the server config")
+	}
+	rec = env.authedRequest(t, http.MethodGet, "/api/v1/users/alice", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"notes":"laptop"`) {
+		t.Errorf("restored client: status %d, %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/restore", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("second restore: got status %d, want 404", rec.Code)
+	}
+}
+
+func TestRestoreConflicts(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+
+	// The name was reused
+	addedClient(t, env, "alice")
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/restore", nil); rec.Code != http.StatusConflict {
+		t.Errorf("reused name: got status %d, want 409", rec.Code)
+	}
+
+	// The address was given out explicitly
+	carol := addedClient(t, env, "carol")
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "carol"})
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob", IPV4: carol.IPV4}); rec.Code != http.StatusOK {
+		t.Fatalf("adding bob: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/carol/restore", nil); rec.Code != http.StatusConflict {
+		t.Errorf("reused address: got status %d, want 409", rec.Code)
+	}
+}
+
+func TestDeletedClientsExpire(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+
+	if err := purgeExpiredDeletedClients(time.Now().Add(DELETED_CLIENT_RETENTION + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(env.dir, "deleted-clients.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "alice") {
+		t.Error("expired client was not purged")
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/restore", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("restoring an expired client: got status %d, want 404", rec.Code)
+	}
+}
+
+func TestDeleteWithoutRetention(t *testing.T) {
+	env := setupTestEnv(t)
+	DELETED_CLIENT_RETENTION = 0
+	t.Cleanup(func() { DELETED_CLIENT_RETENTION = 168 * time.Hour })
+
+	alice := addedClient(t, env, "alice")
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/restore", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("restore: got status %d, want 404", rec.Code)
+	}
+	if bob := addedClient(t, env, "bob"); bob.IPV4 != alice.IPV4 {
+		t.Errorf("bob got %s, want alice's freed address %s", bob.IPV4, alice.IPV4)
+	}
+}
+
+func TestPurgeDeletedClient(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+
+	if rec := env.authedRequest(t, http.MethodDelete, "/api/v1/trash/alice", nil); rec.Code != http.StatusOK {
+		t.Fatalf("purge: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/restore", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("restoring a purged client: got status %d, want 404", rec.Code)
+	}
+	if rec := env.authedRequest(t, http.MethodDelete, "/api/v1/trash/alice", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("second purge: got status %d, want 404", rec.Code)
+	}
+
+	addedClient(t, env, "bob")
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "bob"})
+	if rec := env.authedRequest(t, http.MethodDelete, "/api/v2/trash/bob", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("purge under /api/v2: got status %d, want 204", rec.Code)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// "The VPN doesn't work" tickets start with the same questions: is the
+// client enabled, does the kernel know its peer and route its addresses to
+// it, has it ever completed a handshake, and does it answer through the
+// tunnel. POST /users/:name/diagnose answers them in one call, with a check
+// per question and a hint for each that fails. Clients often drop ICMP, so
+// an unanswered ping with a recent handshake is only a warning; ?ping=false
+// skips it.
+
+// A var so tests can stub it
+var pingCmd = "ping"
+
+const (
+	diagnosePingCount   = 3
+	diagnosePingTimeout = 10 * time.Second
+)
+
+// Check outcomes, and the diagnosis' status: the worst of its checks
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+var (
+	pingReceivedRegex = regexp.MustCompile(`(\d+) packets transmitted, (\d+) (?:packets )?received`)
+	pingRTTRegex      = regexp.MustCompile(`= [\d.]+/([\d.]+)/`)
+)
+
+// One question about the client
+type DiagnosticCheck struct {
+	Name string `json:"name"`
+	// "pass", "warn", "fail" or "skip"
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// What pinging the client's tunnel address got
+type PingResult struct {
+	Address  string  `json:"address"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	AvgRTTMs float64 `json:"avg_rtt_ms,omitempty"`
+}
+
+// Why a client can or can't connect
+type ClientDiagnosis struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key,omitempty"`
+	// "pass" when every check passed, else "warn" or "fail"
+	Status          string     `json:"status"`
+	Endpoint        string     `json:"endpoint,omitempty"`
+	LatestHandshake *time.Time `json:"latest_handshake,omitempty"`
+	// As in the server config, and as the kernel has them
+	AllowedIPs       []string          `json:"allowed_ips"`
+	KernelAllowedIPs []string          `json:"kernel_allowed_ips"`
+	Ping             *PingResult       `json:"ping,omitempty"`
+	Checks           []DiagnosticCheck `json:"checks"`
+}
+
+func (d *ClientDiagnosis) check(name, status, format string, args ...interface{}) {
+	d.Checks = append(d.Checks, DiagnosticCheck{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+	if status == checkFail || (status == checkWarn && d.Status != checkFail) {
+		d.Status = status
+	}
+}
+
+// The AllowedIPs entries of a raw value, with host bits cleared
+func maskedAllowedIPs(value string) []string {
+	entries := []string{}
+	for _, entry := range splitList(value) {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			entries = append(entries, prefix.Masked().String())
+		}
+	}
+	return entries
+}
+
+// The server config section of the client with the stored name. Returns
+// errClientNotFound for unknown clients.
+func findClientSection(name string) (*clientSection, error) {
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	sections := scanClientSections(content)
+	for _, candidate := range clientSectionNames(name) {
+		for i := range sections {
+			if sections[i].name == candidate {
+				return &sections[i], nil
+			}
+		}
+	}
+	return nil, errClientNotFound
+}
+
+// The client's first tunnel address, empty when it has none
+func sectionTunnelAddress(section *clientSection) string {
+	if tunnel, _ := splitAllowedIPs(section.allowedIPs); len(tunnel) > 0 {
+		return strings.SplitN(tunnel[0], "/", 2)[0]
+	}
+	return ""
+}
+
+// Ping address through the tunnel interface
+func pingClient(address string) *PingResult {
+	args := []string{"-c", strconv.Itoa(diagnosePingCount), "-W", "1", "-i", "0.5", "-I", wgParams.ServerWGNIC}
+	if strings.Contains(address, ":") {
+		args = append([]string{"-6"}, args...)
+	}
+	// ping exits non-zero when nothing answers, so the output is read either way
+	_, output := executeCommandTimeout(diagnosePingTimeout, pingCmd, append(args, address)...)
+	result := &PingResult{Address: address, Sent: diagnosePingCount}
+	if match := pingReceivedRegex.FindStringSubmatch(output); match != nil {
+		result.Sent, _ = strconv.Atoi(match[1])
+		result.Received, _ = strconv.Atoi(match[2])
+	}
+	if match := pingRTTRegex.FindStringSubmatch(output); match != nil {
+		result.AvgRTTMs, _ = strconv.ParseFloat(match[1], 64)
+	}
+	return result
+}
+
+// Diagnose the client with the stored name. Returns errClientNotFound for
+// unknown clients.
+func diagnoseClient(name string, ping bool, now time.Time) (*ClientDiagnosis, error) {
+	section, err := findClientSection(name)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &ClientDiagnosis{
+		Name:             name,
+		PublicKey:        section.publicKey,
+		Status:           checkPass,
+		AllowedIPs:       maskedAllowedIPs(section.allowedIPs),
+		KernelAllowedIPs: []string{},
+	}
+	if section.disabled {
+		d.check("enabled", checkFail, "The client is disabled; enable it to let it connect")
+		return d, nil
+	}
+	d.check("enabled", checkPass, "The client is enabled")
+
+	success, output := wireGuardDump()
+	if success != "success" {
+		d.check("interface", checkFail, "%s is down or unreadable; start it with POST /start", wgParams.ServerWGNIC)
+		return d, nil
+	}
+	d.check("interface", checkPass, "%s is up", wgParams.ServerWGNIC)
+
+	var peer *peerDump
+	owners := make(map[string]string) // kernel AllowedIPs entry to public key
+	for _, p := range parseWGDump(output) {
+		p := p
+		if p.PublicKey == section.publicKey {
+			peer = &p
+		}
+		for _, entry := range maskedAllowedIPs(p.AllowedIPs) {
+			owners[entry] = p.PublicKey
+		}
+	}
+	if peer == nil {
+		d.check("peer", checkFail, "The kernel has no peer with the client's key; the config wasn't applied, restart with POST /restart")
+		return d, nil
+	}
+	d.check("peer", checkPass, "The kernel has the client's peer")
+
+	d.KernelAllowedIPs = maskedAllowedIPs(peer.AllowedIPs)
+	kernel := make(map[string]bool, len(d.KernelAllowedIPs))
+	for _, entry := range d.KernelAllowedIPs {
+		kernel[entry] = true
+	}
+	var missing []string
+	for _, entry := range d.AllowedIPs {
+		if kernel[entry] {
+			continue
+		}
+		// The kernel routes an address to one peer only
+		if owner, ok := owners[entry]; ok {
+			if other := clientNamesByPublicKey()[owner]; other != "" {
+				entry += " (routed to " + other + ")"
+			} else {
+				entry += " (routed to another peer)"
+			}
+		}
+		missing = append(missing, entry)
+	}
+	if len(missing) > 0 {
+		d.check("allowed_ips", checkFail, "The kernel doesn't route %s to the client", strings.Join(missing, ", "))
+	} else {
+		d.check("allowed_ips", checkPass, "The kernel routes the client's AllowedIPs to it")
+	}
+
+	recent := false
+	if peer.LatestHandshake == 0 {
+		d.check("handshake", checkFail, "The client never completed a handshake; check its keys, its Endpoint and that UDP port %s reaches the server", wgParams.ServerPort)
+	} else {
+		at := time.Unix(peer.LatestHandshake, 0).UTC()
+		d.LatestHandshake = &at
+		age := now.Sub(at).Round(time.Second)
+		if recent = peer.online(now); recent {
+			d.check("handshake", checkPass, "Last handshake %s ago", age)
+		} else {
+			d.check("handshake", checkWarn, "Last handshake %s ago; the client is offline or idle", age)
+		}
+	}
+
+	if peer.Endpoint == "" || peer.Endpoint == "(none)" {
+		d.check("endpoint", checkWarn, "The server doesn't know where the client connects from")
+	} else {
+		d.Endpoint = peer.Endpoint
+		d.check("endpoint", checkPass, "The client connects from %s", peer.Endpoint)
+	}
+
+	address := sectionTunnelAddress(section)
+	switch {
+	case !ping:
+		d.check("ping", checkSkip, "Not pinged")
+	case address == "":
+		d.check("ping", checkSkip, "The client has no tunnel address")
+	default:
+		d.Ping = pingClient(address)
+		switch {
+		case d.Ping.Received > 0:
+			d.check("ping", checkPass, "%s answered %d of %d pings", address, d.Ping.Received, d.Ping.Sent)
+		case recent:
+			d.check("ping", checkWarn, "%s didn't answer pings; the tunnel is up, so the device likely drops ICMP", address)
+		default:
+			d.check("ping", checkFail, "%s didn't answer pings", address)
+		}
+	}
+	return d, nil
+}
+
+// Handler for POST /users/:name/diagnose
+func diagnoseUserHandlerGin(c *gin.Context) {
+	name := c.Param("name")
+	if !validClientName(name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Client name " + clientNameMessage(),
+			Code:    codeInvalidName,
+		})
+		return
+	}
+
+	diagnosis, err := diagnoseClient(tenantFrom(c).storedName(name), c.Query("ping") != "false", time.Now())
+	if err == errClientNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client not found",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	diagnosis.Name = name
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Diagnosis: " + diagnosis.Status,
+		Data:    diagnosis,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiagnoseClient(t *testing.T) {
+	env := setupTestEnv(t)
+	alice := addedClient(t, env, "alice")
+	bob := addedClient(t, env, "bob")
+
+	script := filepath.Join(env.dir, "ping")
+	os.WriteFile(script, []byte("#!/bin/bash\necho '3 packets transmitted, 0 received, 100% packet loss, time 2003ms'\nexit 1\n"), 0755)
+	oldCmd := pingCmd
+	pingCmd = script
+	t.Cleanup(func() { pingCmd = oldCmd })
+
+	diagnose := func(path string) ClientDiagnosis {
+		t.Helper()
+		rec := env.authedRequest(t, http.MethodPost, path, nil)
+		var resp struct {
+			Data ClientDiagnosis `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("diagnose: status %d, %s", rec.Code, rec.Body.String())
+		}
+		return resp.Data
+	}
+	statuses := func(d ClientDiagnosis) map[string]string {
+		checks := map[string]string{}
+		for _, check := range d.Checks {
+			checks[check.Name] = check.Status
+		}
+		return checks
+	}
+
+	// Alice is up and drops pings; bob's address went to alice, and he
+	// never connected
+	now := time.Now().Unix()
+	env.writeDump(t,
+		fmt.Sprintf("%s\t(none)\t198.51.100.7:4000\t%s/32,%s/32\t%d\t10\t20\toff", alice.PublicKey, alice.IPV4, bob.IPV4, now-30),
+		fmt.Sprintf("%s\t(none)\t(none)\t(none)\t0\t0\t0\toff", bob.PublicKey),
+	)
+
+	d := diagnose("/api/v1/users/alice/diagnose")
+	checks := statuses(d)
+	if d.Status != checkWarn || checks["handshake"] != checkPass || checks["ping"] != checkWarn || d.Endpoint != "198.51.100.7:4000" {
+		t.Errorf("alice: got %+v", d)
+	}
+	if d.Ping == nil || d.Ping.Address != alice.IPV4 || d.Ping.Sent != 3 || d.Ping.Received != 0 {
+		t.Errorf("alice's ping: got %+v", d.Ping)
+	}
+
+	d = diagnose("/api/v1/users/bob/diagnose?ping=false")
+	checks = statuses(d)
+	if d.Status != checkFail || checks["allowed_ips"] != checkFail || checks["handshake"] != checkFail || checks["ping"] != checkSkip {
+		t.Errorf("bob: got %+v", d)
+	}
+	for _, check := range d.Checks {
+		if check.Name == "allowed_ips" && check.Message != "The kernel doesn't route "+bob.IPV4+"/32 (routed to alice) to the client" {
+			t.Errorf("bob's allowed_ips: %q", check.Message)
+		}
+	}
+
+	env.writeDump(t)
+	if d := diagnose("/api/v1/users/alice/diagnose"); statuses(d)["peer"] != checkFail {
+		t.Errorf("peer not loaded: got %+v", d)
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/carol/diagnose", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown client: got status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// A disabled client keeps its peer block in the server config with every
+// line after the "### Client" marker commented out. wg drops the peer, but
+// its keys and addresses stay in the file, so the allocators never hand the
+// addresses out again and enabling it restores the same peer.
+
+var disabledPeerRegex = regexp.MustCompile(`(?m)^### Client (.+)\n#\[Peer\]`)
+
+// Names of the disabled clients in the server config content
+func disabledClientNames(content []byte) map[string]bool {
+	names := make(map[string]bool)
+	for _, match := range disabledPeerRegex.FindAllSubmatch(content, -1) {
+		names[string(match[1])] = true
+	}
+	return names
+}
+
+// Comment out or restore a client's peer block. Returns errClientNotFound
+// when the config has no such client and false when it is already in the
+// requested state. Caller holds wgConfigMutex and syncs afterwards.
+func setClientEnabledLocked(name string, enabled bool) (bool, error) {
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return false, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+
+	blockRegex := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(name) + `\n.*?^$`)
+	loc := blockRegex.FindIndex(content)
+	if loc == nil {
+		return false, errClientNotFound
+	}
+
+	block := string(content[loc[0]:loc[1]])
+	lines := strings.Split(block, "\n")
+	if strings.HasPrefix(lines[1], "#") != enabled {
+		return false, nil
+	}
+	hook := hookDisable
+	if enabled {
+		hook = hookEnable
+	}
+	hookClient := hookClientFrom(content, name)
+	if err := runPreHooks(hook, hookClient); err != nil {
+		return false, err
+	}
+	for i := 1; i < len(lines); i++ {
+		switch {
+		case lines[i] == "":
+		case enabled:
+			lines[i] = strings.TrimPrefix(lines[i], "#")
+		default:
+			lines[i] = "#" + lines[i]
+		}
+	}
+
+	updated := append([]byte{}, content[:loc[0]]...)
+	updated = append(updated, strings.Join(lines, "\n")...)
+	updated = append(updated, content[loc[1]:]...)
+	if err := os.WriteFile(WG_CONFIG_FILE, updated, 0600); err != nil {
+		return false, fmt.Errorf("failed to update server config: %v", err)
+	}
+	if enabled {
+		announceAfterSyncLocked(changeClientUpdated, "enabled", hook, hookClient)
+	} else {
+		announceAfterSyncLocked(changeClientUpdated, "disabled", hook, hookClient)
+	}
+	return true, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// DNS settings of a generated client config. Search domains are appended
+// to the DNS line, which wg-quick hands to resolvconf. Split domains
+// switch to split DNS: the tunnel's servers then only resolve those
+// domains, set per interface with resolvectl in PostUp, and everything
+// else keeps using the client's own resolver. PostUp needs wg-quick with
+// systemd-resolved; the Windows, Android and iOS apps ignore it.
+type ClientDNS struct {
+	Servers       []string `json:"servers,omitempty"`
+	SearchDomains []string `json:"search_domains,omitempty"`
+	SplitDomains  []string `json:"split_domains,omitempty"`
+}
+
+var dnsDomainRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// Comma-separated list from the environment, without empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (d *ClientDNS) validate() error {
+	if d == nil {
+		return nil
+	}
+	return d.fieldErrors("dns").err()
+}
+
+// The invalid servers and domains, named under field
+func (d *ClientDNS) fieldErrors(field string) fieldErrors {
+	var errs fieldErrors
+	for i, server := range d.Servers {
+		if addr, err := netip.ParseAddr(server); err != nil || addr.Zone() != "" || addr.IsUnspecified() || addr.IsMulticast() {
+			errs.add(fmt.Sprintf("%s.servers[%d]", field, i), "DNS server %q is not an IP address", server)
+		}
+	}
+	for i, domain := range d.SearchDomains {
+		if !dnsDomainRegex.MatchString(domain) {
+			errs.add(fmt.Sprintf("%s.search_domains[%d]", field, i), "%q is not a valid domain", domain)
+		}
+	}
+	for i, domain := range d.SplitDomains {
+		if !dnsDomainRegex.MatchString(domain) {
+			errs.add(fmt.Sprintf("%s.split_domains[%d]", field, i), "%q is not a valid domain", domain)
+		}
+	}
+	return errs
+}
+
+// The server defaults from params, CLIENT_DNS_SEARCH and CLIENT_DNS_SPLIT,
+// with each list the override sets replacing its default
+func clientDNSFor(params WGParams, override *ClientDNS) ClientDNS {
+	dns := ClientDNS{
+		SearchDomains: splitList(CLIENT_DNS_SEARCH),
+		SplitDomains:  splitList(CLIENT_DNS_SPLIT),
+	}
+	for _, server := range []string{params.ClientDNS1, params.ClientDNS2} {
+		if server != "" {
+			dns.Servers = append(dns.Servers, server)
+		}
+	}
+
+	if override != nil {
+		if override.Servers != nil {
+			dns.Servers = override.Servers
+		}
+		if override.SearchDomains != nil {
+			dns.SearchDomains = override.SearchDomains
+		}
+		if override.SplitDomains != nil {
+			dns.SplitDomains = override.SplitDomains
+		}
+	}
+	return dns
+}
+
+// [Interface] lines for the DNS settings
+func renderClientDNS(dns ClientDNS) []string {
+	if len(dns.Servers) == 0 {
+		return nil
+	}
+	if len(dns.SplitDomains) == 0 {
+		return []string{"DNS = " + strings.Join(append(append([]string{}, dns.Servers...), dns.SearchDomains...), ",")}
+	}
+
+	// "~" makes a domain routing-only: queries go to this link's servers
+	// without it becoming a search domain
+	domains := make([]string, 0, len(dns.SplitDomains)+len(dns.SearchDomains))
+	for _, domain := range dns.SplitDomains {
+		domains = append(domains, "~"+domain)
+	}
+	domains = append(domains, dns.SearchDomains...)
+	return []string{fmt.Sprintf("PostUp = resolvectl dns %%i %s; resolvectl domain %%i %s",
+		strings.Join(dns.Servers, " "), strings.Join(domains, " "))}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientDNSRendering(t *testing.T) {
+	params := WGParams{ClientDNS1: "10.66.0.1", ClientDNS2: ""}
+	for _, tc := range []struct {
+		search, split string
+		override      *ClientDNS
+		want          string
+	}{
+		{"", "", nil, "DNS = 10.66.0.1"},
+		{"corp.example.com", "", nil, "DNS = 10.66.0.1,corp.example.com"},
+		{"", "corp.example.com", nil, "PostUp = resolvectl dns %i 10.66.0.1; resolvectl domain %i ~corp.example.com"},
+		// Overrides replace the lists they set, an empty list clears one
+		{"", "corp.example.com", &ClientDNS{SplitDomains: []string{}, Servers: []string{"9.9.9.9"}}, "DNS = 9.9.9.9"},
+		{"lan", "", &ClientDNS{SplitDomains: []string{"corp.example.com", "svc.example.com"}},
+			"PostUp = resolvectl dns %i 10.66.0.1; resolvectl domain %i ~corp.example.com ~svc.example.com lan"},
+	} {
+		CLIENT_DNS_SEARCH, CLIENT_DNS_SPLIT = tc.search, tc.split
+		got := strings.Join(renderClientDNS(clientDNSFor(params, tc.override)), "\n")
+		if got != tc.want {
+			t.Errorf("search %q, split %q, override %+v: got %q, want %q", tc.search, tc.split, tc.override, got, tc.want)
+		}
+	}
+	CLIENT_DNS_SEARCH, CLIENT_DNS_SPLIT = "", ""
+}
+
+func TestAddUserWithDNSOverride(t *testing.T) {
+	env := setupTestEnv(t)
+
+	bad := map[string]any{"name": "alice", "dns": map[string]any{"split_domains": []string{"bad domain"}}}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", bad).Code; code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid domain: got status %d, want 422", code)
+	}
+
+	req := AddUserRequest{Name: "alice", DNS: &ClientDNS{Servers: []string{"10.0.0.53"}, SplitDomains: []string{"corp.example.com"}}}
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodPost, "/api/v1/users/add", req).Body.Bytes(), &resp)
+	want := "PostUp = resolvectl dns %i 10.0.0.53; resolvectl domain %i ~corp.example.com"
+	if !strings.Contains(resp.Data.Config, want) || strings.Contains(resp.Data.Config, "DNS =") {
+		t.Errorf("config must use split DNS:\n%s", resp.Data.Config)
+	}
+
+	json.Unmarshal(env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"}).Body.Bytes(), &resp)
+	if !strings.Contains(resp.Data.Config, "DNS = 1.1.1.1,1.0.0.1\n") {
+		t.Errorf("clients without an override keep the server DNS:\n%s", resp.Data.Config)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Clients get <name>.<DNS_RECORDS_DOMAIN> A/AAAA records pointing at their
+// tunnel IPs. Like the firewall table, the records are rebuilt from the
+// client list whenever the peers are applied, so every way of adding or
+// deleting clients keeps them in step. Backends:
+//
+//   - hosts: a hosts-format file, e.g. Pi-hole's custom.list or a file
+//     served by the CoreDNS hosts plugin
+//   - zone: a zone file for the CoreDNS file plugin; the serial changes on
+//     every write so CoreDNS reloads it
+//   - nsupdate: RFC 2136 dynamic updates sent with nsupdate; the published
+//     records are remembered in DNS_RECORDS_FILE to send only changes
+//
+// A failed update is logged and reported by GET /dns-records; it never
+// fails the client operation that triggered it.
+
+const (
+	dnsRecordsHosts    = "hosts"
+	dnsRecordsZone     = "zone"
+	dnsRecordsNsupdate = "nsupdate"
+
+	dnsRecordTTL = 300
+)
+
+// nsupdate binary, overridden in tests
+var nsupdateCmd = "nsupdate"
+
+type DNSRecord struct {
+	Name string `json:"name"`
+	IPV4 string `json:"ipv4,omitempty"`
+	IPV6 string `json:"ipv6,omitempty"`
+}
+
+var dnsRecordsState struct {
+	sync.Mutex
+	lastSync  time.Time
+	lastError string
+}
+
+// DNS_RECORDS_FILE, or a file next to the server config named after the
+// backend
+func dnsRecordsFile() string {
+	if DNS_RECORDS_FILE != "" {
+		return DNS_RECORDS_FILE
+	}
+	name := map[string]string{
+		dnsRecordsHosts:    "vpn.hosts",
+		dnsRecordsZone:     "db." + DNS_RECORDS_DOMAIN,
+		dnsRecordsNsupdate: "dns-records.json",
+	}[DNS_RECORDS_BACKEND]
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), name)
+}
+
+// Fully qualified name of a client's record, without the trailing dot
+func dnsRecordName(client string) string {
+	return strings.ToLower(client) + "." + DNS_RECORDS_DOMAIN
+}
+
+// The records for the given clients, by name
+func dnsRecordsFor(clients []Client) []DNSRecord {
+	records := make([]DNSRecord, 0, len(clients))
+	for _, client := range clients {
+		if client.IPV4 == "" && client.IPV6 == "" {
+			continue
+		}
+		records = append(records, DNSRecord{Name: dnsRecordName(client.Name), IPV4: client.IPV4, IPV6: client.IPV6})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
+
+func renderHostsRecords(records []DNSRecord) string {
+	var b strings.Builder
+	b.WriteString("# Managed by wireguard-api; changes are overwritten\n")
+	for _, record := range records {
+		if record.IPV4 != "" {
+			fmt.Fprintf(&b, "%s %s\n", record.IPV4, record.Name)
+		}
+		if record.IPV6 != "" {
+			fmt.Fprintf(&b, "%s %s\n", record.IPV6, record.Name)
+		}
+	}
+	return b.String()
+}
+
+// A zone for DNS_RECORDS_DOMAIN whose name server is this server's tunnel
+// address
+func renderZoneRecords(records []DNSRecord, serial int64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "; Managed by wireguard-api; changes are overwritten\n$ORIGIN %s.\n$TTL %d\n", DNS_RECORDS_DOMAIN, dnsRecordTTL)
+	fmt.Fprintf(&b, "@ IN SOA ns hostmaster %d 7200 3600 1209600 %d\n@ IN NS ns\n", serial, dnsRecordTTL)
+	if wgParams.ServerWGIPv4 != "" {
+		fmt.Fprintf(&b, "ns IN A %s\n", wgParams.ServerWGIPv4)
+	}
+	for _, record := range records {
+		label := strings.TrimSuffix(record.Name, "."+DNS_RECORDS_DOMAIN)
+		if record.IPV4 != "" {
+			fmt.Fprintf(&b, "%s IN A %s\n", label, record.IPV4)
+		}
+		if record.IPV6 != "" {
+			fmt.Fprintf(&b, "%s IN AAAA %s\n", label, record.IPV6)
+		}
+	}
+	return b.String()
+}
+
+// An nsupdate script replacing changed records and deleting removed ones;
+// empty when nothing changed
+func renderNsupdate(published, records []DNSRecord) string {
+	old := make(map[string]DNSRecord, len(published))
+	for _, record := range published {
+		old[record.Name] = record
+	}
+
+	var updates strings.Builder
+	for _, record := range records {
+		if previous, ok := old[record.Name]; ok && previous == record {
+			delete(old, record.Name)
+			continue
+		}
+		delete(old, record.Name)
+		fmt.Fprintf(&updates, "update delete %s.\n", record.Name)
+		if record.IPV4 != "" {
+			fmt.Fprintf(&updates, "update add %s. %d A %s\n", record.Name, dnsRecordTTL, record.IPV4)
+		}
+		if record.IPV6 != "" {
+			fmt.Fprintf(&updates, "update add %s. %d AAAA %s\n", record.Name, dnsRecordTTL, record.IPV6)
+		}
+	}
+	removed := make([]string, 0, len(old))
+	for name := range old {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		fmt.Fprintf(&updates, "update delete %s.\n", name)
+	}
+	if updates.Len() == 0 {
+		return ""
+	}
+
+	var script strings.Builder
+	if DNS_RECORDS_SERVER != "" {
+		fmt.Fprintf(&script, "server %s\n", DNS_RECORDS_SERVER)
+	}
+	fmt.Fprintf(&script, "zone %s.\n%ssend\n", DNS_RECORDS_DOMAIN, updates.String())
+	return script.String()
+}
+
+var zoneSerialRegex = regexp.MustCompile(`(?m)^@ IN SOA \S+ \S+ (\d+) `)
+
+// The current time, or one more than the zone's serial when that is ahead,
+// so two writes within a second still change it
+func nextZoneSerial() int64 {
+	serial := time.Now().Unix()
+	content, err := os.ReadFile(dnsRecordsFile())
+	if err != nil {
+		return serial
+	}
+	if match := zoneSerialRegex.FindSubmatch(content); match != nil {
+		if previous, err := strconv.ParseInt(string(match[1]), 10, 64); err == nil && previous >= serial {
+			serial = previous + 1
+		}
+	}
+	return serial
+}
+
+func loadPublishedRecords() ([]DNSRecord, error) {
+	var records []DNSRecord
+	content, err := os.ReadFile(dnsRecordsFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return records, json.Unmarshal(content, &records)
+}
+
+// Fail startup on a backend typo rather than on the first client change
+func checkDNSRecordsBackend() error {
+	switch DNS_RECORDS_BACKEND {
+	case "", dnsRecordsHosts, dnsRecordsZone, dnsRecordsNsupdate:
+		return nil
+	}
+	return fmt.Errorf("DNS_RECORDS_BACKEND must be %s, %s or %s", dnsRecordsHosts, dnsRecordsZone, dnsRecordsNsupdate)
+}
+
+// Bring the backend in line with the clients. With force, nsupdate sends
+// every record instead of only the changes. Caller holds wgConfigMutex.
+func updateDNSRecordsLocked(force bool) error {
+	clients, err := listWireGuardClients()
+	if err != nil {
+		return err
+	}
+	records := dnsRecordsFor(clients)
+
+	switch DNS_RECORDS_BACKEND {
+	case dnsRecordsHosts:
+		err = os.WriteFile(dnsRecordsFile(), []byte(renderHostsRecords(records)), 0644)
+	case dnsRecordsZone:
+		err = os.WriteFile(dnsRecordsFile(), []byte(renderZoneRecords(records, nextZoneSerial())), 0644)
+	case dnsRecordsNsupdate:
+		var published []DNSRecord
+		if !force {
+			if published, err = loadPublishedRecords(); err != nil {
+				return fmt.Errorf("failed to read published records: %v", err)
+			}
+		}
+		script := renderNsupdate(published, records)
+		if script == "" {
+			return nil
+		}
+		args := []string{}
+		if DNS_RECORDS_KEY_FILE != "" {
+			args = append(args, "-k", DNS_RECORDS_KEY_FILE)
+		}
+		cmd := exec.Command(nsupdateCmd, args...)
+		cmd.Stdin = strings.NewReader(script)
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("nsupdate failed: %v, output: %s", err, output.String())
+		}
+		content, _ := json.MarshalIndent(records, "", "  ")
+		err = os.WriteFile(dnsRecordsFile(), content, 0600)
+	default:
+		return fmt.Errorf("unknown DNS_RECORDS_BACKEND %q", DNS_RECORDS_BACKEND)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write DNS records: %v", err)
+	}
+
+	if DNS_RECORDS_RELOAD != "" && DNS_RECORDS_BACKEND != dnsRecordsNsupdate {
+		if success, output := executeCommand("sh", "-c", DNS_RECORDS_RELOAD); success != "success" {
+			return fmt.Errorf("reload command failed: %s", output)
+		}
+	}
+	return nil
+}
+
+// updateDNSRecordsLocked when a backend is configured. Caller holds
+// wgConfigMutex.
+func syncDNSRecordsLocked() {
+	if DNS_RECORDS_BACKEND == "" {
+		return
+	}
+	recordDNSSync(updateDNSRecordsLocked(false))
+}
+
+// Remember the outcome of an update for the status endpoint
+func recordDNSSync(err error) {
+	dnsRecordsState.Lock()
+	defer dnsRecordsState.Unlock()
+	dnsRecordsState.lastSync = time.Now()
+	dnsRecordsState.lastError = ""
+	if err != nil {
+		log.Printf("Failed to update DNS records: %v", err)
+		dnsRecordsState.lastError = err.Error()
+	}
+}
+
+// Handler listing the client records and how the last update went
+func dnsRecordsHandlerGin(c *gin.Context) {
+	data := map[string]interface{}{
+		"backend": DNS_RECORDS_BACKEND,
+	}
+	if DNS_RECORDS_BACKEND != "" {
+		clients, err := listWireGuardClients()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+
+		dnsRecordsState.Lock()
+		lastSync, lastError := dnsRecordsState.lastSync, dnsRecordsState.lastError
+		dnsRecordsState.Unlock()
+
+		data["domain"] = DNS_RECORDS_DOMAIN
+		data["records"] = dnsRecordsFor(clients)
+		if !lastSync.IsZero() {
+			data["last_sync"] = lastSync.UTC()
+		}
+		if lastError != "" {
+			data["last_error"] = lastError
+		}
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
+
+// Handler pushing every record again, e.g. after fixing the DNS server
+func syncDNSRecordsHandlerGin(c *gin.Context) {
+	if DNS_RECORDS_BACKEND == "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "DNS_RECORDS_BACKEND is not set",
+		})
+		return
+	}
+
+	wgConfigMutex.Lock()
+	err := updateDNSRecordsLocked(true)
+	wgConfigMutex.Unlock()
+	recordDNSSync(err)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "DNS records updated",
+	})
+}
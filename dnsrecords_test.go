@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Point the DNS records at backend, writing to a file in the test dir
+func setupDNSRecords(t *testing.T, env *testEnv, backend string) string {
+	t.Helper()
+	oldBackend, oldFile, oldDomain := DNS_RECORDS_BACKEND, DNS_RECORDS_FILE, DNS_RECORDS_DOMAIN
+	DNS_RECORDS_BACKEND = backend
+	DNS_RECORDS_FILE = filepath.Join(env.dir, "records")
+	DNS_RECORDS_DOMAIN = "vpn.internal"
+	t.Cleanup(func() { DNS_RECORDS_BACKEND, DNS_RECORDS_FILE, DNS_RECORDS_DOMAIN = oldBackend, oldFile, oldDomain })
+	return DNS_RECORDS_FILE
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return string(content)
+}
+
+func TestDNSRecordsHostsFile(t *testing.T) {
+	env := setupTestEnv(t)
+	file := setupDNSRecords(t, env, dnsRecordsHosts)
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "Alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+	hosts := readFile(t, file)
+	if !strings.Contains(hosts, "10.66.0.2 alice.vpn.internal\n") || !strings.Contains(hosts, "10.66.0.3 bob.vpn.internal\n") {
+		t.Errorf("unexpected hosts file:\n%s", hosts)
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "bob"})
+	if hosts := readFile(t, file); strings.Contains(hosts, "bob") {
+		t.Errorf("deleted client must lose its record:\n%s", hosts)
+	}
+}
+
+func TestDNSRecordsZoneFile(t *testing.T) {
+	env := setupTestEnv(t)
+	file := setupDNSRecords(t, env, dnsRecordsZone)
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	first := readFile(t, file)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+	second := readFile(t, file)
+
+	if !strings.Contains(second, "$ORIGIN vpn.internal.") || !strings.Contains(second, "alice IN A 10.66.0.2\n") || !strings.Contains(second, "bob IN A 10.66.0.3\n") {
+		t.Errorf("unexpected zone:\n%s", second)
+	}
+	serial := func(zone string) string { return string(zoneSerialRegex.FindStringSubmatch(zone)[1]) }
+	if serial(first) >= serial(second) {
+		t.Errorf("serial must increase on every write: %s then %s", serial(first), serial(second))
+	}
+}
+
+func TestDNSRecordsNsupdate(t *testing.T) {
+	env := setupTestEnv(t)
+	state := setupDNSRecords(t, env, dnsRecordsNsupdate)
+
+	script := filepath.Join(env.dir, "nsupdate")
+	updates := filepath.Join(env.dir, "updates")
+	os.WriteFile(script, []byte("#!/bin/bash\ncat >> \""+updates+"\"\n[ ! -f \""+env.dir+"/nsupdate_fail\" ]\n"), 0755)
+	oldCmd := nsupdateCmd
+	nsupdateCmd = script
+	t.Cleanup(func() { nsupdateCmd = oldCmd })
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	want := "zone vpn.internal.\nupdate delete alice.vpn.internal.\nupdate add alice.vpn.internal. 300 A 10.66.0.2\nsend\n" +
+		"zone vpn.internal.\nupdate delete alice.vpn.internal.\nsend\n"
+	if got := readFile(t, updates); got != want {
+		t.Errorf("got updates:\n%s\nwant:\n%s", got, want)
+	}
+	if got := readFile(t, state); strings.TrimSpace(got) != "[]" {
+		t.Errorf("published state must be empty, got %s", got)
+	}
+
+	// A failing DNS server doesn't fail the client change but is reported
+	os.WriteFile(filepath.Join(env.dir, "nsupdate_fail"), nil, 0600)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"}).Code; code != http.StatusOK {
+		t.Fatalf("add with DNS down: got status %d", code)
+	}
+	var status struct {
+		Data struct {
+			Records   []DNSRecord `json:"records"`
+			LastError string      `json:"last_error"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/dns-records", nil).Body.Bytes(), &status)
+	if len(status.Data.Records) != 1 || !strings.Contains(status.Data.LastError, "nsupdate failed") {
+		t.Errorf("unexpected status %+v", status.Data)
+	}
+
+	os.Remove(filepath.Join(env.dir, "nsupdate_fail"))
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/dns-records/sync", nil).Code; code != http.StatusOK {
+		t.Fatalf("sync: got status %d", code)
+	}
+	status.Data.LastError = ""
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/dns-records", nil).Body.Bytes(), &status)
+	if status.Data.LastError != "" {
+		t.Errorf("a successful sync must clear the error, got %q", status.Data.LastError)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// openapi.yml is the maintained API description; it is compiled into the
+// binary and served as JSON so clients can be generated from a running node.
+//
+//go:embed openapi.yml
+var openAPIYAML []byte
+
+// Swagger UI page pointing at /api/openapi.json. The UI assets come from the
+// swagger-ui-dist CDN so the binary doesn't carry them.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>WireGuard API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/api/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// Convert the embedded YAML spec to JSON
+func openAPIJSON() ([]byte, error) {
+	var spec interface{}
+	if err := yaml.Unmarshal(openAPIYAML, &spec); err != nil {
+		return nil, fmt.Errorf("failed to parse embedded OpenAPI spec: %v", err)
+	}
+	return json.Marshal(spec)
+}
+
+// Register /api/openapi.json and /api/docs. They are public (a browser
+// can't send the key header) so they must be registered BEFORE the auth
+// middleware is added, and only when API_DOCS is enabled — otherwise they
+// would reveal the API that the auth middleware hides behind 404s.
+func registerDocsRoutes(router *gin.Engine) {
+	spec, err := openAPIJSON()
+
+	router.GET("/api/openapi.json", func(c *gin.Context) {
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+		c.Data(http.StatusOK, "application/json", spec)
+	})
+
+	router.GET("/api/docs", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(swaggerUIPage))
+	})
+}
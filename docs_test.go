@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDocsRoutesDisabledByDefault(t *testing.T) {
+	env := setupTestEnv(t)
+
+	if code := env.request(t, http.MethodGet, "/api/openapi.json", nil, "").Code; code != http.StatusNotFound {
+		t.Errorf("docs must not be served when API_DOCS is off, got status %d", code)
+	}
+}
+
+func TestDocsRoutesServeSpecWithoutAuth(t *testing.T) {
+	oldDocs := API_DOCS
+	API_DOCS = true
+	t.Cleanup(func() { API_DOCS = oldDocs })
+
+	env := setupTestEnv(t)
+
+	recorder := env.request(t, http.MethodGet, "/api/openapi.json", nil, "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200 without a token", recorder.Code)
+	}
+
+	var spec struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("spec is not valid JSON: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("got openapi version %q, want 3.x", spec.OpenAPI)
+	}
+
+	// Every documented path must exist on the router, so the spec can't
+	// drift from the routes it describes
+	routes := make(map[string]bool)
+	for _, route := range env.router.Routes() {
+		routes[route.Path] = true
+	}
+	for path := range spec.Paths {
+		ginPath := strings.NewReplacer("{", ":", "}", "").Replace(path)
+		// A last parameter that may contain slashes is a catch-all
+		catchAll := ginPath
+		if i := strings.LastIndex(ginPath, "/:"); i >= 0 {
+			catchAll = ginPath[:i] + "/*" + ginPath[i+2:]
+		}
+		if !routes[ginPath] && !routes[catchAll] {
+			t.Errorf("documented path %s is not routed", path)
+		}
+	}
+
+	if code := env.request(t, http.MethodGet, "/api/docs", nil, "").Code; code != http.StatusOK {
+		t.Errorf("swagger UI: got status %d, want 200", code)
+	}
+
+	// The rest of the API stays behind auth
+	if code := env.request(t, http.MethodGet, "/api/users", nil, "").Code; code != http.StatusNotFound {
+		t.Errorf("docs must not open other routes, got status %d", code)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The endpoint filter restricts where peers may connect from by dropping
+// packets to the WireGuard UDP port from source addresses outside (allow
+// mode) or inside (deny mode) a list of networks. Networks come from IP
+// set files in IP_SETS_DIR, one CIDR per line, such as the ipdeny.com
+// country zones ("de" reads de.zone) or an ASN's prefix list, and from
+// CIDRs given directly. The filter is part of the firewall table (see
+// firewall.go) and is read from the set files every time the table is
+// applied.
+
+const (
+	endpointFilterAllow = "allow"
+	endpointFilterDeny  = "deny"
+)
+
+type EndpointFilter struct {
+	// "allow": only these networks may connect; "deny": they may not
+	Mode string `json:"mode"`
+	// Names of IP set files in IP_SETS_DIR, without the .zone extension
+	Sets  []string `json:"sets,omitempty"`
+	CIDRs []string `json:"cidrs,omitempty"`
+}
+
+// The filter's networks split by family, ready to render
+type resolvedEndpointFilter struct {
+	mode string
+	ipv4 []string
+	ipv6 []string
+}
+
+var (
+	ipSetNameRegex         = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+	errEndpointFilterEmpty = errors.New("the filter must list at least one set or CIDR")
+)
+
+// ENDPOINT_FILTER_FILE, or endpoint-filter.json next to the server config
+func endpointFilterFile() string {
+	if ENDPOINT_FILTER_FILE != "" {
+		return ENDPOINT_FILTER_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "endpoint-filter.json")
+}
+
+// The stored filter, nil when none is set. Caller holds firewallMutex.
+func loadEndpointFilterLocked() (*EndpointFilter, error) {
+	content, err := os.ReadFile(endpointFilterFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read endpoint filter file: %v", err)
+	}
+	var filter EndpointFilter
+	if err := json.Unmarshal(content, &filter); err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint filter file: %v", err)
+	}
+	return &filter, nil
+}
+
+// Store the filter, or remove it when nil. Caller holds firewallMutex.
+func saveEndpointFilterLocked(filter *EndpointFilter) error {
+	if filter == nil {
+		if err := os.Remove(endpointFilterFile()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove endpoint filter file: %v", err)
+		}
+		return nil
+	}
+	content, err := json.MarshalIndent(filter, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(endpointFilterFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write endpoint filter file: %v", err)
+	}
+	return nil
+}
+
+// Read the networks of an IP set file; comments and blank lines are skipped
+func readIPSet(name string) ([]string, error) {
+	if !ipSetNameRegex.MatchString(name) {
+		return nil, fmt.Errorf("invalid IP set name %q", name)
+	}
+	content, err := os.ReadFile(filepath.Join(IP_SETS_DIR, name+".zone"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IP set %s: %v", name, err)
+	}
+
+	var networks []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		networks = append(networks, line)
+	}
+	return networks, nil
+}
+
+// Load the filter's set files and check every network
+func resolveEndpointFilter(filter *EndpointFilter) (*resolvedEndpointFilter, error) {
+	if filter.Mode != endpointFilterAllow && filter.Mode != endpointFilterDeny {
+		return nil, fmt.Errorf("mode must be %s or %s", endpointFilterAllow, endpointFilterDeny)
+	}
+	if len(filter.Sets) == 0 && len(filter.CIDRs) == 0 {
+		return nil, errEndpointFilterEmpty
+	}
+
+	networks := append([]string{}, filter.CIDRs...)
+	for _, name := range filter.Sets {
+		set, err := readIPSet(name)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, set...)
+	}
+
+	resolved := &resolvedEndpointFilter{mode: filter.Mode}
+	for _, network := range networks {
+		// A single address is a /32 or /128
+		if ip := net.ParseIP(network); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			network = fmt.Sprintf("%s/%d", network, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", network)
+		}
+		if ipNet.IP.To4() != nil {
+			resolved.ipv4 = append(resolved.ipv4, ipNet.String())
+		} else {
+			resolved.ipv6 = append(resolved.ipv6, ipNet.String())
+		}
+	}
+	return resolved, nil
+}
+
+// Sets and input chain rules dropping filtered handshakes to the UDP port.
+// In allow mode a family without networks is dropped entirely.
+func renderEndpointFilter(port string, filter *resolvedEndpointFilter) (string, []string) {
+	var sets strings.Builder
+	var rules []string
+	for _, family := range []struct {
+		name, nfproto, setName, setType string
+		networks                        []string
+	}{
+		{"ip", "ipv4", "endpoint_filter_v4", "ipv4_addr", filter.ipv4},
+		{"ip6", "ipv6", "endpoint_filter_v6", "ipv6_addr", filter.ipv6},
+	} {
+		if len(family.networks) == 0 {
+			if filter.mode == endpointFilterAllow {
+				rules = append(rules, fmt.Sprintf("meta nfproto %s udp dport %s drop", family.nfproto, port))
+			}
+			continue
+		}
+		fmt.Fprintf(&sets, "\tset %s {\n\t\ttype %s; flags interval; auto-merge;\n\t\telements = { %s }\n\t}\n",
+			family.setName, family.setType, strings.Join(family.networks, ", "))
+		match := "@"
+		if filter.mode == endpointFilterAllow {
+			match = "!= @"
+		}
+		rules = append(rules, fmt.Sprintf("udp dport %s %s saddr %s%s drop", port, family.name, match, family.setName))
+	}
+	return sets.String(), rules
+}
+
+func respondEndpointFilterError(c *gin.Context, status int, err error) {
+	c.JSON(status, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    errorCode(err),
+	})
+}
+
+// Handler showing the active filter with how many networks it covers, and
+// whether its rules are loaded
+func endpointFilterHandlerGin(c *gin.Context) {
+	firewallMutex.Lock()
+	filter, err := loadEndpointFilterLocked()
+	firewallMutex.Unlock()
+	if err != nil {
+		respondEndpointFilterError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"active": filter != nil,
+		"port":   wgParams.ServerPort,
+	}
+	if filter != nil {
+		data["filter"] = filter
+		resolved, err := resolveEndpointFilter(filter)
+		if err != nil {
+			data["error"] = err.Error()
+		} else {
+			data["ipv4_networks"] = len(resolved.ipv4)
+			data["ipv6_networks"] = len(resolved.ipv6)
+		}
+		success, output := executeCommand(nftCmd, "list", "table", "inet", firewallTable)
+		data["installed"] = success == "success" && strings.Contains(output, "endpoint_filter")
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
+
+// Set or, with a nil filter, remove the filter and apply the table
+func setEndpointFilter(filter *EndpointFilter) error {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	firewallMutex.Lock()
+	err := saveEndpointFilterLocked(filter)
+	firewallMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return applyFirewallLocked()
+}
+
+// Handler replacing the endpoint filter
+func setEndpointFilterHandlerGin(c *gin.Context) {
+	var filter EndpointFilter
+	if !bindJSON(c, &filter) {
+		return
+	}
+	resolved, err := resolveEndpointFilter(&filter)
+	if err != nil {
+		respondEndpointFilterError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := setEndpointFilter(&filter); err != nil {
+		respondEndpointFilterError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Endpoint filter applied",
+		Data: map[string]interface{}{
+			"filter":        filter,
+			"ipv4_networks": len(resolved.ipv4),
+			"ipv6_networks": len(resolved.ipv6),
+		},
+	})
+}
+
+func deleteEndpointFilterHandlerGin(c *gin.Context) {
+	if err := setEndpointFilter(nil); err != nil {
+		respondEndpointFilterError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Endpoint filter removed",
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEndpointFilter(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+
+	oldSetsDir := IP_SETS_DIR
+	IP_SETS_DIR = env.dir
+	t.Cleanup(func() { IP_SETS_DIR = oldSetsDir })
+	zone := "# ipdeny zone\n192.0.2.0/24\n198.51.100.0/24\n2001:db8::/32\n"
+	if err := os.WriteFile(filepath.Join(env.dir, "de.zone"), []byte(zone), 0600); err != nil {
+		t.Fatalf("writing zone: %v", err)
+	}
+
+	for _, filter := range []EndpointFilter{
+		{Mode: "block", CIDRs: []string{"192.0.2.1"}},
+		{Mode: "allow"},
+		{Mode: "allow", Sets: []string{"fr"}},
+		{Mode: "allow", Sets: []string{"../etc/passwd"}},
+		{Mode: "deny", CIDRs: []string{"not-a-network"}},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/endpoint-filter", filter).Code; code != http.StatusBadRequest {
+			t.Errorf("%+v: got status %d, want 400", filter, code)
+		}
+	}
+
+	filter := EndpointFilter{Mode: "allow", Sets: []string{"de"}, CIDRs: []string{"203.0.113.7"}}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/endpoint-filter", filter).Code; code != http.StatusOK {
+		t.Fatalf("set filter: got status %d", code)
+	}
+	rules := readRules(t, rulesFile)
+	for _, want := range []string{
+		"elements = { 203.0.113.7/32, 192.0.2.0/24, 198.51.100.0/24 }",
+		"elements = { 2001:db8::/32 }",
+		"udp dport 51820 ip saddr != @endpoint_filter_v4 drop",
+		"udp dport 51820 ip6 saddr != @endpoint_filter_v6 drop",
+		"hook input",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules missing %q:\n%s", want, rules)
+		}
+	}
+
+	var status struct {
+		Data struct {
+			Active       bool `json:"active"`
+			Installed    bool `json:"installed"`
+			IPv4Networks int  `json:"ipv4_networks"`
+			IPv6Networks int  `json:"ipv6_networks"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/endpoint-filter", nil).Body.Bytes(), &status)
+	if !status.Data.Active || !status.Data.Installed || status.Data.IPv4Networks != 3 || status.Data.IPv6Networks != 1 {
+		t.Errorf("unexpected status %+v", status.Data)
+	}
+
+	// Allow mode without IPv6 networks keeps IPv6 peers out entirely
+	env.authedRequest(t, http.MethodPost, "/api/v1/endpoint-filter", EndpointFilter{Mode: "allow", CIDRs: []string{"192.0.2.0/24"}})
+	if rules := readRules(t, rulesFile); !strings.Contains(rules, "meta nfproto ipv6 udp dport 51820 drop") {
+		t.Errorf("allow mode must drop the family without networks:\n%s", rules)
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/endpoint-filter", EndpointFilter{Mode: "deny", CIDRs: []string{"192.0.2.0/24"}})
+	rules = readRules(t, rulesFile)
+	if !strings.Contains(rules, "udp dport 51820 ip saddr @endpoint_filter_v4 drop") || strings.Contains(rules, "ipv6") {
+		t.Errorf("deny mode must only drop the listed networks:\n%s", rules)
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/endpoint-filter/delete", nil).Code; code != http.StatusOK {
+		t.Fatalf("delete filter: got status %d", code)
+	}
+	if rules := readRules(t, rulesFile); strings.Contains(rules, "endpoint_filter") {
+		t.Errorf("removed filter must be gone:\n%s", rules)
+	}
+}
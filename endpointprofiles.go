@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Networks that block WireGuard's port, or the server's address, leave
+// clients with nothing to fall back to. ENDPOINT_PROFILES names alternate
+// endpoints the server is also reachable on, e.g.
+// "tls=vpn.example.com:443,alt=alt.example.net:51820" with 443/udp
+// forwarded to the WireGuard port. Client configs list them in a comment
+// block under Endpoint, so a user can swap the line by hand, and
+// POST /users/:name/endpoint-profile switches the stored config over.
+// "default" is always SERVER_PUB_IP:SERVER_PORT. Regenerating a config
+// keeps the profile its Endpoint line points at.
+
+const defaultEndpointProfile = "default"
+
+// An endpoint clients can be pointed at
+type EndpointProfile struct {
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+}
+
+// Profiles from ENDPOINT_PROFILES, in the order given
+var endpointProfiles []EndpointProfile
+
+var (
+	endpointProfileNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	clientEndpointRegex      = regexp.MustCompile(`(?m)^Endpoint = (.*)\n`)
+	// The comment block withEndpointProfile writes under Endpoint
+	fallbackEndpointsRegex = regexp.MustCompile(`(?m)^# Fallback endpoints.*\n(?:#   .*\n)*`)
+)
+
+// Parse ENDPOINT_PROFILES
+func loadEndpointProfiles() error {
+	endpointProfiles = nil
+	seen := map[string]bool{defaultEndpointProfile: true}
+	for _, profile := range listenPortProfiles() {
+		seen[profile.Name] = true
+	}
+	for _, entry := range splitList(ENDPOINT_PROFILES) {
+		name, endpoint, ok := strings.Cut(entry, "=")
+		name, endpoint = strings.TrimSpace(name), strings.TrimSpace(endpoint)
+		if !ok || !endpointProfileNameRegex.MatchString(name) {
+			return fmt.Errorf("%q isn't name=host:port with a lowercase name", entry)
+		}
+		if seen[name] {
+			return fmt.Errorf("profile %s is given twice, or is %s or an extra listen port's", name, defaultEndpointProfile)
+		}
+		host, port, err := net.SplitHostPort(endpoint)
+		if n, portErr := strconv.Atoi(port); err != nil || host == "" || portErr != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("profile %s: %q isn't host:port", name, endpoint)
+		}
+		seen[name] = true
+		endpointProfiles = append(endpointProfiles, EndpointProfile{Name: name, Endpoint: endpoint})
+	}
+	return nil
+}
+
+// The default profile followed by ENDPOINT_PROFILES and the extra listen
+// ports
+func allEndpointProfiles() []EndpointProfile {
+	profiles := append([]EndpointProfile{{Name: defaultEndpointProfile, Endpoint: serverEndpoint(wgParams)}}, endpointProfiles...)
+	return append(profiles, listenPortProfiles()...)
+}
+
+// The profile called name, false when there is none
+func findEndpointProfile(name string) (EndpointProfile, bool) {
+	for _, profile := range allEndpointProfiles() {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return EndpointProfile{}, false
+}
+
+// The profile a client config's Endpoint points at; empty for an endpoint
+// set by hand
+func configEndpointProfile(config string) string {
+	match := clientEndpointRegex.FindStringSubmatch(config)
+	if match == nil {
+		return ""
+	}
+	for _, profile := range allEndpointProfiles() {
+		if profile.Endpoint == strings.TrimSpace(match[1]) {
+			return profile.Name
+		}
+	}
+	return ""
+}
+
+// Point a client config at the profile called name and list the other
+// profiles below it. Without ENDPOINT_PROFILES or EXTRA_LISTEN_PORTS the
+// config is only given the default endpoint.
+func withEndpointProfile(config, name string) (string, error) {
+	active, ok := findEndpointProfile(name)
+	if !ok {
+		return "", fmt.Errorf("no endpoint profile %s", name)
+	}
+	lines := "Endpoint = " + active.Endpoint + "\n"
+	if len(endpointProfiles) > 0 || len(extraListenPorts) > 0 {
+		lines += "# Fallback endpoints, for when this one is blocked:\n"
+		for _, profile := range allEndpointProfiles() {
+			if profile.Name != active.Name {
+				lines += fmt.Sprintf("#   Endpoint = %s (%s)\n", profile.Endpoint, profile.Name)
+			}
+		}
+	}
+	config = fallbackEndpointsRegex.ReplaceAllLiteralString(config, "")
+	return clientEndpointRegex.ReplaceAllLiteralString(config, lines), nil
+}
+
+// Handler for GET /server/endpoint-profiles
+func endpointProfilesHandlerGin(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    allEndpointProfiles(),
+	})
+}
+
+// Read a client's stored config. Caller holds wgConfigMutex.
+func readClientConfigLocked(name string) (string, string, error) {
+	path := clientConfigFile(name)
+	if path == "" {
+		return "", "", errClientNotFound
+	}
+	config, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read client config: %v", err)
+	}
+	return path, string(config), nil
+}
+
+func respondEndpointProfileError(c *gin.Context, err error) {
+	if err == errClientNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client not found",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    errorCode(err),
+	})
+}
+
+// Handler for GET /users/:name/endpoint-profile: the active profile and the
+// client's config for each profile
+func clientEndpointProfileHandlerGin(c *gin.Context) {
+	name := tenantFrom(c).storedName(c.Param("name"))
+
+	wgConfigMutex.Lock()
+	_, config, err := readClientConfigLocked(name)
+	wgConfigMutex.Unlock()
+	if err != nil {
+		respondEndpointProfileError(c, err)
+		return
+	}
+
+	configs := make(map[string]string)
+	for _, profile := range allEndpointProfiles() {
+		configs[profile.Name], _ = withEndpointProfile(config, profile.Name)
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"active":   configEndpointProfile(config),
+			"profiles": allEndpointProfiles(),
+			"configs":  configs,
+		},
+	})
+}
+
+// Endpoint profile switch request
+type EndpointProfileRequest struct {
+	Profile string `json:"profile" binding:"required"`
+}
+
+// Handler for POST /users/:name/endpoint-profile. Only the client's config
+// changes; it has to reach the device again.
+func setClientEndpointProfileHandlerGin(c *gin.Context) {
+	var req EndpointProfileRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if _, ok := findEndpointProfile(req.Profile); !ok {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("No endpoint profile %s; see /server/endpoint-profiles", req.Profile),
+		})
+		return
+	}
+	name := tenantFrom(c).storedName(c.Param("name"))
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	path, config, err := readClientConfigLocked(name)
+	if err != nil {
+		respondEndpointProfileError(c, err)
+		return
+	}
+	updated, err := withEndpointProfile(config, req.Profile)
+	if err == nil {
+		err = os.WriteFile(path, []byte(updated), 0600)
+	}
+	if err != nil {
+		respondEndpointProfileError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("%s now connects to %s; import the new config", c.Param("name"), req.Profile),
+		Data:    Client{Name: c.Param("name"), Config: updated},
+	})
+}
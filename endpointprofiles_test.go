@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEndpointProfiles(t *testing.T) {
+	env := setupTestEnv(t)
+	oldProfiles := ENDPOINT_PROFILES
+	ENDPOINT_PROFILES = "tls=vpn.example.com:443"
+	t.Cleanup(func() {
+		ENDPOINT_PROFILES = oldProfiles
+		loadEndpointProfiles()
+	})
+	if err := loadEndpointProfiles(); err != nil {
+		t.Fatalf("loading profiles: %v", err)
+	}
+
+	// New configs list the fallbacks under the default endpoint
+	config := addedClient(t, env, "alice").Config
+	if !strings.Contains(config, "Endpoint = 203.0.113.10:51820\n# Fallback endpoints") ||
+		!strings.Contains(config, "#   Endpoint = vpn.example.com:443 (tls)\n") {
+		t.Errorf("new config:\n%s", config)
+	}
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/endpoint-profile", EndpointProfileRequest{Profile: "cdn"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown profile: status %d", rec.Code)
+	}
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/endpoint-profile", EndpointProfileRequest{Profile: "tls"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("switch: status %d, %s", rec.Code, rec.Body.String())
+	}
+	stored := readFile(t, clientConfigFile("alice"))
+	if !strings.Contains(stored, "Endpoint = vpn.example.com:443\n") || !strings.Contains(stored, "#   Endpoint = 203.0.113.10:51820 (default)\n") ||
+		strings.Count(stored, "# Fallback endpoints") != 1 {
+		t.Errorf("switched config:\n%s", stored)
+	}
+
+	var resp struct {
+		Data struct {
+			Active  string            `json:"active"`
+			Configs map[string]string `json:"configs"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/users/alice/endpoint-profile", nil).Body.Bytes(), &resp)
+	if resp.Data.Active != "tls" || !strings.Contains(resp.Data.Configs["default"], "Endpoint = 203.0.113.10:51820\n") {
+		t.Errorf("profile: got %+v", resp.Data)
+	}
+
+	// A regenerated config stays on its profile
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/server/regenerate-clients", RegenerateClientsRequest{}); rec.Code != http.StatusOK {
+		t.Fatalf("regenerate: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if config := readFile(t, clientConfigFile("alice")); configEndpointProfile(config) != "tls" {
+		t.Errorf("regenerated config:\n%s", config)
+	}
+
+	for _, invalid := range []string{"tls=vpn.example.com", "default=vpn.example.com:443", "TLS=vpn.example.com:443", "a=h:1,a=h:2"} {
+		ENDPOINT_PROFILES = invalid
+		if err := loadEndpointProfiles(); err == nil {
+			t.Errorf("%q was accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Key escrow for disaster recovery: the server's and every client's keys,
+// addresses and config files, encrypted to a public key the operator
+// brings, so backups can hold them without holding plaintext keys. The
+// private half never reaches the server. age recipients (age1...) are
+// encrypted to natively in the age v1 format; OpenPGP keys go through gpg
+// with a throwaway keyring.
+
+// gpg binary for OpenPGP recipients; a var so tests can substitute it
+var gpgCmd = "gpg"
+
+// The decrypted content of an escrow export
+type EscrowExport struct {
+	Version    int            `json:"version"`
+	ExportedAt time.Time      `json:"exported_at"`
+	Backend    string         `json:"backend"`
+	Server     EscrowServer   `json:"server"`
+	Clients    []EscrowClient `json:"clients"`
+}
+
+type EscrowServer struct {
+	Interface  string `json:"interface"`
+	Endpoint   string `json:"endpoint"`
+	Port       string `json:"port"`
+	IPV4       string `json:"ipv4,omitempty"`
+	IPV6       string `json:"ipv6,omitempty"`
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+	// The server config file as is, to restore the whole topology from
+	Config string `json:"config"`
+}
+
+type EscrowClient struct {
+	Name         string `json:"name"`
+	IPV4         string `json:"ipv4,omitempty"`
+	IPV6         string `json:"ipv6,omitempty"`
+	Disabled     bool   `json:"disabled,omitempty"`
+	PublicKey    string `json:"public_key,omitempty"`
+	PrivateKey   string `json:"private_key,omitempty"`
+	PresharedKey string `json:"preshared_key,omitempty"`
+	Config       string `json:"config"`
+}
+
+type EscrowExportRequest struct {
+	// An age recipient or an ASCII-armored OpenPGP public key
+	Recipient string `json:"recipient"`
+}
+
+// Snapshot the key material under the config lock, so the server config
+// and the client configs agree
+func buildEscrowExport(now time.Time) (EscrowExport, error) {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	serverConfig, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return EscrowExport{}, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	clients, err := listClients(true)
+	if err != nil {
+		return EscrowExport{}, err
+	}
+
+	export := EscrowExport{
+		Version:    1,
+		ExportedAt: now.UTC(),
+		Backend:    backendType,
+		Server: EscrowServer{
+			Interface:  wgParams.ServerWGNIC,
+			Endpoint:   wgParams.ServerPubIP,
+			Port:       wgParams.ServerPort,
+			IPV4:       wgParams.ServerWGIPv4,
+			IPV6:       wgParams.ServerWGIPv6,
+			PublicKey:  wgParams.ServerPubKey,
+			PrivateKey: wgParams.ServerPrivKey,
+			Config:     string(serverConfig),
+		},
+		Clients: make([]EscrowClient, 0, len(clients)),
+	}
+	for _, client := range clients {
+		// A client missing some keys is still exported with its config
+		parsed, _ := parseMigratedClient(client.Name, serverConfig, []byte(client.Config))
+		export.Clients = append(export.Clients, EscrowClient{
+			Name:         client.Name,
+			IPV4:         client.IPV4,
+			IPV6:         client.IPV6,
+			Disabled:     client.Disabled,
+			PublicKey:    parsed.keys.publicKey,
+			PrivateKey:   parsed.keys.privateKey,
+			PresharedKey: parsed.keys.preSharedKey,
+			Config:       client.Config,
+		})
+	}
+	return export, nil
+}
+
+var errInvalidRecipient = errors.New("recipient must be an age public key (age1...) or an ASCII-armored OpenPGP public key")
+
+// Encrypt plaintext to the recipient; returns the ASCII-armored ciphertext
+// and the file extension it goes by
+func encryptForEscrow(recipient string, plaintext []byte) ([]byte, string, error) {
+	recipient = strings.TrimSpace(recipient)
+	switch {
+	case strings.HasPrefix(recipient, "age1"):
+		encrypted, err := ageEncrypt(recipient, plaintext)
+		return encrypted, "age", err
+	case strings.HasPrefix(recipient, "-----BEGIN PGP PUBLIC KEY BLOCK-----"):
+		encrypted, err := gpgEncrypt(recipient, plaintext)
+		return encrypted, "asc", err
+	}
+	return nil, "", errInvalidRecipient
+}
+
+// Decode an age X25519 recipient, the bech32 encoding of a Curve25519
+// public key with the "age" prefix
+func parseAgeRecipient(recipient string) ([]byte, error) {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	if strings.ToLower(recipient) != recipient {
+		return nil, errInvalidRecipient
+	}
+	sep := strings.LastIndexByte(recipient, '1')
+	if sep < 0 || recipient[:sep] != "age" || len(recipient)-sep-1 < 6 {
+		return nil, errInvalidRecipient
+	}
+	values := make([]byte, 0, len(recipient)-sep-1)
+	for _, char := range recipient[sep+1:] {
+		value := strings.IndexRune(charset, char)
+		if value < 0 {
+			return nil, errInvalidRecipient
+		}
+		values = append(values, byte(value))
+	}
+
+	// The BIP 173 checksum over the expanded prefix and the data
+	checked := []byte{}
+	for _, char := range []byte("age") {
+		checked = append(checked, char>>5)
+	}
+	checked = append(checked, 0)
+	for _, char := range []byte("age") {
+		checked = append(checked, char&31)
+	}
+	checked = append(checked, values...)
+	generator := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	checksum := uint32(1)
+	for _, value := range checked {
+		top := checksum >> 25
+		checksum = (checksum&0x1ffffff)<<5 ^ uint32(value)
+		for i, g := range generator {
+			if (top>>uint(i))&1 == 1 {
+				checksum ^= g
+			}
+		}
+	}
+	if checksum != 1 {
+		return nil, errInvalidRecipient
+	}
+
+	// Regroup the 5-bit values without the checksum into bytes
+	key := []byte{}
+	acc, bits := 0, 0
+	for _, value := range values[:len(values)-6] {
+		acc = acc<<5 | int(value)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			key = append(key, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || acc&(1<<bits-1) != 0 || len(key) != curve25519.PointSize {
+		return nil, errInvalidRecipient
+	}
+	return key, nil
+}
+
+func hkdfKey(secret, salt []byte, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	return key
+}
+
+// Encrypt to an age X25519 recipient in the age v1 format, ASCII-armored
+func ageEncrypt(recipient string, plaintext []byte) ([]byte, error) {
+	publicKey, err := parseAgeRecipient(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey := make([]byte, 16)
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	nonce := make([]byte, 16)
+	for _, b := range [][]byte{fileKey, ephemeral, nonce} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+	}
+
+	// The X25519 stanza wraps the file key for the recipient
+	share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, publicKey)
+	if err != nil {
+		return nil, errInvalidRecipient
+	}
+	salt := append(append([]byte{}, share...), publicKey...)
+	aead, err := chacha20poly1305.New(hkdfKey(shared, salt, "age-encryption.org/v1/X25519"))
+	if err != nil {
+		return nil, err
+	}
+	wrapped := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+
+	b64 := base64.RawStdEncoding
+	var out bytes.Buffer
+	header := "age-encryption.org/v1\n-> X25519 " + b64.EncodeToString(share) + "\n" + b64.EncodeToString(wrapped) + "\n---"
+	mac := hmac.New(sha256.New, hkdfKey(fileKey, nil, "header"))
+	mac.Write([]byte(header))
+	out.WriteString(header + " " + b64.EncodeToString(mac.Sum(nil)) + "\n")
+
+	// The payload is STREAM-encrypted in 64 KiB chunks
+	out.Write(nonce)
+	if aead, err = chacha20poly1305.New(hkdfKey(fileKey, nonce, "payload")); err != nil {
+		return nil, err
+	}
+	const chunkSize = 64 * 1024
+	chunkNonce := make([]byte, chacha20poly1305.NonceSize)
+	for counter := uint64(0); ; counter++ {
+		chunk := plaintext
+		last := len(plaintext) <= chunkSize
+		if !last {
+			chunk = plaintext[:chunkSize]
+		}
+		binary.BigEndian.PutUint64(chunkNonce[3:11], counter)
+		if last {
+			chunkNonce[11] = 1
+		}
+		out.Write(aead.Seal(nil, chunkNonce, chunk, nil))
+		if last {
+			break
+		}
+		plaintext = plaintext[chunkSize:]
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(out.Bytes())
+	var armored bytes.Buffer
+	armored.WriteString("-----BEGIN AGE ENCRYPTED FILE-----\n")
+	for len(encoded) > 64 {
+		armored.WriteString(encoded[:64] + "\n")
+		encoded = encoded[64:]
+	}
+	armored.WriteString(encoded + "\n-----END AGE ENCRYPTED FILE-----\n")
+	return armored.Bytes(), nil
+}
+
+// Encrypt to an OpenPGP public key with gpg, in a keyring that only lives
+// for this call
+func gpgEncrypt(publicKey string, plaintext []byte) ([]byte, error) {
+	home, err := os.MkdirTemp("", "wireguard-api-gpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(home)
+	keyFile := filepath.Join(home, "recipient.asc")
+	if err := os.WriteFile(keyFile, []byte(publicKey), 0600); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(gpgCmd, "--batch", "--no-tty", "--homedir", home, "--trust-model", "always",
+		"--armor", "--encrypt", "--recipient-file", keyFile, "--output", "-")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(plaintext)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("gpg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Handler downloading the encrypted key escrow
+func escrowExportHandlerGin(c *gin.Context) {
+	var req EscrowExportRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	now := time.Now()
+	export, err := buildEscrowExport(now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	plaintext, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	encrypted, extension, err := encryptForEscrow(req.Recipient, plaintext)
+	if errors.Is(err, errInvalidRecipient) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Encrypting to the recipient failed: " + err.Error(),
+		})
+		return
+	}
+
+	log.Printf("Key escrow exported for %d clients", len(export.Clients))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="wireguard-escrow-%s.json.%s"`, now.UTC().Format("20060102T150405Z"), extension))
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", encrypted)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// bech32-encode a key with the "age" prefix, the way age-keygen prints
+// recipients
+func encodeAgeRecipient(key []byte) string {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	values := []byte{}
+	acc, bits := 0, 0
+	for _, b := range key {
+		acc = acc<<8 | int(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits&31))
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits)&31))
+	}
+
+	checked := []byte{3, 3, 3, 0, 1, 7, 5}
+	checked = append(append(checked, values...), 0, 0, 0, 0, 0, 0)
+	generator := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	checksum := uint32(1)
+	for _, value := range checked {
+		top := checksum >> 25
+		checksum = (checksum&0x1ffffff)<<5 ^ uint32(value)
+		for i, g := range generator {
+			if (top>>uint(i))&1 == 1 {
+				checksum ^= g
+			}
+		}
+	}
+	checksum ^= 1
+
+	recipient := "age1"
+	for _, value := range values {
+		recipient += string(charset[value])
+	}
+	for i := 0; i < 6; i++ {
+		recipient += string(charset[checksum>>uint(5*(5-i))&31])
+	}
+	return recipient
+}
+
+// Decrypt an armored age file with an X25519 identity, checking the
+// header MAC and every chunk
+func ageDecrypt(t *testing.T, identity, armored []byte) []byte {
+	t.Helper()
+	text := strings.TrimSpace(string(armored))
+	if !strings.HasPrefix(text, "-----BEGIN AGE ENCRYPTED FILE-----\n") || !strings.HasSuffix(text, "\n-----END AGE ENCRYPTED FILE-----") {
+		t.Fatalf("not armored:\n%s", armored)
+	}
+	lines := strings.Split(text, "\n")
+	for _, line := range lines[1 : len(lines)-2] {
+		if len(line) != 64 {
+			t.Fatalf("armor lines must be 64 columns: %q", line)
+		}
+	}
+	file, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	if err != nil {
+		t.Fatalf("armor: %v", err)
+	}
+
+	headerEnd := bytes.Index(file, []byte("\n---"))
+	macLineEnd := headerEnd + 4 + bytes.IndexByte(file[headerEnd+4:], '\n')
+	header := strings.Split(string(file[:headerEnd]), "\n")
+	if len(header) != 3 || header[0] != "age-encryption.org/v1" || !strings.HasPrefix(header[1], "-> X25519 ") {
+		t.Fatalf("unexpected header: %q", header)
+	}
+	b64 := base64.RawStdEncoding
+	share, _ := b64.DecodeString(strings.TrimPrefix(header[1], "-> X25519 "))
+	wrapped, _ := b64.DecodeString(header[2])
+
+	publicKey, _ := curve25519.X25519(identity, curve25519.Basepoint)
+	shared, _ := curve25519.X25519(identity, share)
+	aead, _ := chacha20poly1305.New(hkdfKey(shared, append(share, publicKey...), "age-encryption.org/v1/X25519"))
+	fileKey, err := aead.Open(nil, make([]byte, 12), wrapped, nil)
+	if err != nil {
+		t.Fatalf("unwrapping the file key: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, hkdfKey(fileKey, nil, "header"))
+	mac.Write(file[:headerEnd+4])
+	if got, _ := b64.DecodeString(string(file[headerEnd+5 : macLineEnd])); !hmac.Equal(got, mac.Sum(nil)) {
+		t.Fatal("header MAC mismatch")
+	}
+
+	payload := file[macLineEnd+1:]
+	aead, _ = chacha20poly1305.New(hkdfKey(fileKey, payload[:16], "payload"))
+	payload = payload[16:]
+	var plaintext []byte
+	nonce := make([]byte, 12)
+	for counter := uint64(0); ; counter++ {
+		chunk := payload
+		if len(chunk) > 64*1024+16 {
+			chunk = chunk[:64*1024+16]
+		}
+		payload = payload[len(chunk):]
+		binary.BigEndian.PutUint64(nonce[3:11], counter)
+		if len(payload) == 0 {
+			nonce[11] = 1
+		}
+		opened, err := aead.Open(nil, nonce, chunk, nil)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", counter, err)
+		}
+		plaintext = append(plaintext, opened...)
+		if len(payload) == 0 {
+			return plaintext
+		}
+	}
+}
+
+func newAgeIdentity(t *testing.T) ([]byte, string) {
+	t.Helper()
+	identity := make([]byte, 32)
+	rand.Read(identity)
+	publicKey, _ := curve25519.X25519(identity, curve25519.Basepoint)
+	return identity, encodeAgeRecipient(publicKey)
+}
+
+func TestEscrowExportToAge(t *testing.T) {
+	env := setupTestEnv(t)
+	noPSK := false
+	for _, req := range []AddUserRequest{{Name: "alice"}, {Name: "bob", PresharedKey: &noPSK}} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", req).Code; code != http.StatusOK {
+			t.Fatalf("seeding %s failed with status %d", req.Name, code)
+		}
+	}
+	identity, recipient := newAgeIdentity(t)
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/escrow/export", EscrowExportRequest{Recipient: recipient})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), ".json.age") {
+		t.Errorf("unexpected Content-Disposition %q", rec.Header().Get("Content-Disposition"))
+	}
+	if strings.Contains(rec.Body.String(), "server-private-key") {
+		t.Fatal("the export must not contain plaintext keys")
+	}
+
+	var export EscrowExport
+	if err := json.Unmarshal(ageDecrypt(t, identity, rec.Body.Bytes()), &export); err != nil {
+		t.Fatalf("parsing the export: %v", err)
+	}
+	if export.Server.PrivateKey != "server-private-key" || export.Server.Config != env.configContent(t) || len(export.Clients) != 2 {
+		t.Fatalf("unexpected export: %+v", export)
+	}
+	for _, client := range export.Clients {
+		if client.PrivateKey == "" || client.PublicKey == "" || client.Config != readFile(t, clientConfigFile(client.Name)) {
+			t.Errorf("%s is missing key material: %+v", client.Name, client)
+		}
+		if (client.PresharedKey == "") != (client.Name == "bob") {
+			t.Errorf("%s: unexpected preshared key %q", client.Name, client.PresharedKey)
+		}
+	}
+}
+
+func TestEscrowExportLargePayload(t *testing.T) {
+	identity, recipient := newAgeIdentity(t)
+	for _, size := range []int{0, 64 * 1024, 64*1024 + 1, 200 * 1024} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		encrypted, err := ageEncrypt(recipient, plaintext)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if got := ageDecrypt(t, identity, encrypted); !bytes.Equal(got, plaintext) {
+			t.Errorf("%d bytes: the round trip changed the payload", size)
+		}
+	}
+}
+
+func TestEscrowExportRejectsBadRecipients(t *testing.T) {
+	env := setupTestEnv(t)
+	_, recipient := newAgeIdentity(t)
+	corrupted := recipient[:len(recipient)-1] + "q"
+	if corrupted == recipient {
+		corrupted = recipient[:len(recipient)-1] + "p"
+	}
+	for _, bad := range []string{"", "ssh-ed25519 AAAA", corrupted, strings.ToUpper(recipient), "age1qqqq",
+		"-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nnot a key\n-----END PGP PUBLIC KEY BLOCK-----"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/escrow/export", EscrowExportRequest{Recipient: bad}).Code; code != http.StatusBadRequest {
+			t.Errorf("recipient %q: got status %d, want 400", bad, code)
+		}
+	}
+}
+
+func TestEscrowExportToGPG(t *testing.T) {
+	if _, err := exec.LookPath(gpgCmd); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	env := setupTestEnv(t)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding failed with status %d", code)
+	}
+
+	home := t.TempDir()
+	gpg := func(stdin []byte, args ...string) []byte {
+		t.Helper()
+		cmd := exec.Command(gpgCmd, append([]string{"--batch", "--no-tty", "--homedir", home}, args...)...)
+		cmd.Stdin = bytes.NewReader(stdin)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("gpg %v: %v: %s", args, err, stderr.String())
+		}
+		return out
+	}
+	gpg(nil, "--passphrase", "", "--quick-gen-key", "Escrow <escrow@example.com>", "default", "default", "never")
+	publicKey := gpg(nil, "--armor", "--export", "escrow@example.com")
+	t.Cleanup(func() { exec.Command("gpgconf", "--homedir", home, "--kill", "all").Run() })
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/escrow/export", EscrowExportRequest{Recipient: string(publicKey)})
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "-----BEGIN PGP MESSAGE-----") {
+		t.Fatalf("export: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var export EscrowExport
+	if err := json.Unmarshal(gpg(rec.Body.Bytes(), "--pinentry-mode", "loopback", "--passphrase", "", "--decrypt"), &export); err != nil {
+		t.Fatalf("parsing the export: %v", err)
+	}
+	if len(export.Clients) != 1 || export.Clients[0].Name != "alice" || export.Clients[0].PrivateKey == "" {
+		t.Errorf("unexpected export: %+v", export)
+	}
+
+	// The throwaway keyring is gone
+	if matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "wireguard-api-gpg*")); len(matches) != 0 {
+		t.Errorf("left behind %v", matches)
+	}
+}
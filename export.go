@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /users/export?format=zip streams a zip of the clients' config files,
+// and with qr=true a QR code PNG of each, for handing out many configs at
+// once or archiving them. It takes the filters of GET /users. Entries are
+// written as the configs are read, so thousands of clients aren't held in
+// memory. The configs hold private keys, so callers that may not see them
+// get 403 rather than an archive of empty files. format=csv writes the
+// inventory instead, in the columns POST /users/import takes, see
+// csvimport.go.
+
+// Handler streaming the clients' configs as a zip archive
+func exportUsersHandlerGin(c *gin.Context) {
+	format := c.DefaultQuery("format", "zip")
+	if format != "zip" && format != "csv" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "format must be zip or csv",
+		})
+		return
+	}
+	if format == "zip" && !includeSecrets(c) {
+		c.JSON(http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: "The export holds client configs and keys; this token doesn't get them, or needs ?include=secrets",
+		})
+		return
+	}
+	withQR := c.Query("qr") == "true"
+	if withQR {
+		if _, err := exec.LookPath(qrencodeCmd); err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: "QR codes need qrencode: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	clients, err := listClients(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	clients = tenantFrom(c).ownClients(clients)
+	clients, err = filterClients(c, clients)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	if format == "csv" {
+		c.Header("Content-Disposition", `attachment; filename="wireguard-clients.csv"`)
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		if err := writeClientsCSV(c.Writer, clients); err != nil {
+			log.Printf("Export: %v", err)
+		}
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="wireguard-clients.zip"`)
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	// Past this point the status is sent, so failures can only be logged
+	archive := zip.NewWriter(c.Writer)
+	for _, client := range clients {
+		info, err := os.Stat(client.configPath)
+		if err != nil {
+			// Deleted since it was listed
+			continue
+		}
+		config, err := os.ReadFile(client.configPath)
+		if err != nil {
+			log.Printf("Warning: Failed to read file %s: %v", client.configPath, err)
+			continue
+		}
+		if err := writeZipEntry(archive, clientFileName(client.Name)+".conf", info, config); err != nil {
+			log.Printf("Export: %v", err)
+			return
+		}
+		if !withQR {
+			continue
+		}
+		png, err := renderQRCode(config)
+		if err != nil {
+			log.Printf("Export: QR code of %s: %v", client.Name, err)
+			continue
+		}
+		if err := writeZipEntry(archive, clientFileName(client.Name)+".png", info, png); err != nil {
+			log.Printf("Export: %v", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Export: %v", err)
+	}
+}
+
+// Add a file readable only by its owner, like the configs themselves
+func writeZipEntry(archive *zip.Writer, name string, info os.FileInfo, content []byte) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime()}
+	header.SetMode(0600)
+	w, err := archive.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %v", name, err)
+	}
+	if _, err := w.Write(content); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// Write the clients as CSV, sorted by name: the columns an import takes,
+// then a column per other metadata key
+func writeClientsCSV(w io.Writer, clients []Client) error {
+	keySet := make(map[string]bool)
+	for _, client := range clients {
+		for key := range client.Metadata {
+			if !csvClientColumns[key] {
+				keySet[key] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+
+	out := csv.NewWriter(w)
+	header := append([]string{"name", "ipv4", "ipv6", "tags", "email", "notes"}, keys...)
+	if err := out.Write(header); err != nil {
+		return err
+	}
+	for _, client := range clients {
+		record := []string{client.Name, client.IPV4, client.IPV6, strings.Join(client.Tags, ";"), client.Metadata["email"], client.Notes}
+		for _, key := range keys {
+			record = append(record, client.Metadata[key])
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
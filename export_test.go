@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func zipEntries(t *testing.T, body []byte) map[string]string {
+	t.Helper()
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("not a zip archive: %v", err)
+	}
+	entries := map[string]string{}
+	for _, file := range archive.File {
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(r)
+		r.Close()
+		entries[file.Name] = string(content)
+	}
+	return entries
+}
+
+func TestExportUsers(t *testing.T) {
+	env := setupTestEnv(t)
+	alice := addedClient(t, env, "alice")
+	addedClient(t, env, "bob")
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/users/export?format=zip", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("export: status %d, %s", rec.Code, rec.Body.String())
+	}
+	entries := zipEntries(t, rec.Body.Bytes())
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "alice.conf,bob.conf" || entries["alice.conf"] != alice.Config {
+		t.Errorf("got entries %v, alice.conf:\n%s", names, entries["alice.conf"])
+	}
+
+	script := filepath.Join(env.dir, "qrencode")
+	os.WriteFile(script, []byte("#!/bin/bash\nprintf 'PNG:'\ncat\n"), 0755)
+	oldCmd := qrencodeCmd
+	qrencodeCmd = script
+	t.Cleanup(func() { qrencodeCmd = oldCmd })
+
+	rec = env.authedRequest(t, http.MethodGet, "/api/v1/users/export?qr=true&search=ali", nil)
+	entries = zipEntries(t, rec.Body.Bytes())
+	if len(entries) != 2 || entries["alice.png"] != "PNG:"+alice.Config {
+		t.Errorf("with QR codes: got %v", entries)
+	}
+
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/users/export?format=tar", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: got status %d, want 400", rec.Code)
+	}
+	setReadOnlyTokens(t, "reader-token")
+	if rec := env.request(t, http.MethodGet, "/api/v1/users/export", nil, "reader-token"); rec.Code != http.StatusForbidden {
+		t.Errorf("read-only token: got status %d, want 403", rec.Code)
+	}
+}
+
+func TestExportUsersInTenant(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+	env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "a"}, "acme-token")
+	env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "b"}, "globex-token")
+
+	rec := env.request(t, http.MethodGet, "/api/v1/users/export", nil, "acme-token")
+	entries := zipEntries(t, rec.Body.Bytes())
+	if _, ok := entries["a.conf"]; !ok || len(entries) != 1 {
+		t.Errorf("got status %d, entries %v, want acme's client only", rec.Code, entries)
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A client with a firewall policy may only reach the destinations it
+// allows; everything else it sends through the tunnel is dropped. Policies
+// live in a JSON file next to the server config and are rendered into one
+// nftables table, rebuilt whenever the peers are applied, so adding,
+// deleting, disabling or enabling a client installs or removes its chain.
+// Only forwarded traffic is filtered; the server's own services are not.
+//
+// The same table isolates clients from each other: with CLIENT_ISOLATION
+// no peer can reach another peer's tunnel IP, and clients of an isolated
+// project can't reach or be reached by any other peer. The server and the
+// networks behind it stay reachable.
+
+// nftables table owned by the API; nothing else should write to it
+const firewallTable = "wireguard_api"
+
+// nft binary, overridden in tests
+var nftCmd = "nft"
+
+type FirewallRule struct {
+	// IP or CIDR, IPv4 or IPv6
+	Destination string `json:"destination"`
+	// "tcp", "udp" or empty for any protocol
+	Protocol string `json:"protocol,omitempty"`
+	// Destination ports, all ports when empty
+	Ports []int `json:"ports,omitempty"`
+}
+
+type FirewallPolicy struct {
+	// An empty list blocks all forwarded traffic of the client
+	Allow []FirewallRule `json:"allow"`
+}
+
+// Which peers may not talk to other peers
+type firewallIsolation struct {
+	all     bool
+	clients map[string]bool
+}
+
+// Everything rendered into the table
+type firewallState struct {
+	policies  map[string]*FirewallPolicy
+	isolation firewallIsolation
+	forwards  map[string][]PortForward
+	// Interface to masquerade client traffic out of, see nat.go
+	egressNIC string
+	// Where peers may connect from, see endpointfilter.go
+	endpointFilter *resolvedEndpointFilter
+	// Marks selecting the uplink of routing profiles, see routing.go
+	routing []routingMark
+	// UDP ports redirected to the WireGuard port, see listenports.go
+	extraPorts []int
+}
+
+func (s firewallState) empty() bool {
+	return len(s.policies) == 0 && !s.isolation.all && len(s.isolation.clients) == 0 && len(s.forwards) == 0 &&
+		s.egressNIC == "" && s.endpointFilter == nil && len(s.routing) == 0 && len(s.extraPorts) == 0
+}
+
+var (
+	firewallMutex sync.Mutex
+	// Whether this process loaded the table, so peers can be applied on
+	// hosts without nft as long as no rule was ever needed
+	firewallInstalled bool
+)
+
+// FIREWALL_FILE, or firewall.json next to the server config
+func firewallFile() string {
+	if FIREWALL_FILE != "" {
+		return FIREWALL_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "firewall.json")
+}
+
+// Caller holds firewallMutex
+func loadFirewallPoliciesLocked() (map[string]*FirewallPolicy, error) {
+	policies := make(map[string]*FirewallPolicy)
+	content, err := os.ReadFile(firewallFile())
+	if os.IsNotExist(err) {
+		return policies, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read firewall file: %v", err)
+	}
+	if err := json.Unmarshal(content, &policies); err != nil {
+		return nil, fmt.Errorf("failed to parse firewall file: %v", err)
+	}
+	return policies, nil
+}
+
+// Caller holds firewallMutex
+func saveFirewallPoliciesLocked(policies map[string]*FirewallPolicy) error {
+	content, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(firewallFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write firewall file: %v", err)
+	}
+	return nil
+}
+
+func validateFirewallRule(rule FirewallRule) error {
+	if _, _, err := net.ParseCIDR(rule.Destination); err != nil && net.ParseIP(rule.Destination) == nil {
+		return fmt.Errorf("destination %q is not an IP or CIDR", rule.Destination)
+	}
+	switch rule.Protocol {
+	case "", "tcp", "udp":
+	default:
+		return fmt.Errorf("protocol must be tcp, udp or empty, got %q", rule.Protocol)
+	}
+	for _, port := range rule.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("port %d is out of range", port)
+		}
+	}
+	return nil
+}
+
+// One nft rule statement for an allow rule
+func renderFirewallRule(rule FirewallRule) string {
+	family := "ip"
+	if strings.Contains(rule.Destination, ":") {
+		family = "ip6"
+	}
+	statement := family + " daddr " + rule.Destination
+
+	if len(rule.Ports) > 0 {
+		ports := make([]string, len(rule.Ports))
+		for i, port := range rule.Ports {
+			ports[i] = strconv.Itoa(port)
+		}
+		if rule.Protocol == "" {
+			statement += " meta l4proto { tcp, udp } th"
+		} else {
+			statement += " " + rule.Protocol
+		}
+		statement += " dport { " + strings.Join(ports, ", ") + " }"
+	} else if rule.Protocol != "" {
+		statement += " meta l4proto " + rule.Protocol
+	}
+	return statement + " accept"
+}
+
+// The whole table for the given clients, as an nft script that replaces any
+// previous version atomically. Disabled clients and the state of deleted
+// clients are left out.
+func renderFirewall(nic string, clients []Client, state firewallState) string {
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	isolation := state.isolation
+
+	// Isolation comes first so no client chain can accept peer traffic
+	var jumps, chains, dnat strings.Builder
+	if isolation.all {
+		fmt.Fprintf(&jumps, "\t\tiifname %q oifname %q drop\n", nic, nic)
+	} else {
+		var ipv4, ipv6 []string
+		for _, client := range clients {
+			if !isolation.clients[client.Name] || client.Disabled {
+				continue
+			}
+			if client.IPV4 != "" {
+				ipv4 = append(ipv4, client.IPV4)
+			}
+			if client.IPV6 != "" {
+				ipv6 = append(ipv6, client.IPV6)
+			}
+		}
+		for _, family := range []struct {
+			name      string
+			addresses []string
+		}{{"ip", ipv4}, {"ip6", ipv6}} {
+			if len(family.addresses) == 0 {
+				continue
+			}
+			set := "{ " + strings.Join(family.addresses, ", ") + " }"
+			fmt.Fprintf(&jumps, "\t\tiifname %q oifname %q %s saddr %s drop\n", nic, nic, family.name, set)
+			fmt.Fprintf(&jumps, "\t\tiifname %q oifname %q %s daddr %s drop\n", nic, nic, family.name, set)
+		}
+	}
+
+	for _, rule := range renderListenPortRedirects(nic, wgParams.ServerPort, state.extraPorts) {
+		fmt.Fprintf(&dnat, "\t\t%s\n", rule)
+	}
+	for _, client := range clients {
+		if client.Disabled {
+			continue
+		}
+		if client.IPV4 != "" {
+			for _, forward := range state.forwards[client.Name] {
+				fmt.Fprintf(&dnat, "\t\t%s\n", renderPortForward(nic, client.IPV4, forward))
+			}
+		}
+
+		policy := state.policies[client.Name]
+		if policy == nil {
+			continue
+		}
+		chain := strconv.Quote("client-" + client.Name)
+		if client.IPV4 != "" {
+			fmt.Fprintf(&jumps, "\t\tiifname %q ip saddr %s jump %s\n", nic, client.IPV4, chain)
+		}
+		if client.IPV6 != "" {
+			fmt.Fprintf(&jumps, "\t\tiifname %q ip6 saddr %s jump %s\n", nic, client.IPV6, chain)
+		}
+		// Replies, e.g. to forwarded ports, are never restricted
+		fmt.Fprintf(&chains, "\tchain %s {\n\t\tct state established,related accept\n", chain)
+		for _, rule := range policy.Allow {
+			fmt.Fprintf(&chains, "\t\t%s\n", renderFirewallRule(rule))
+		}
+		chains.WriteString("\t\tdrop\n\t}\n")
+	}
+
+	// After the client chains, so these accepts can't bypass them
+	var snat strings.Builder
+	egress := []string{}
+	seen := map[string]bool{"": true}
+	for _, device := range append([]string{state.egressNIC}, routingDevices(state.routing)...) {
+		if !seen[device] {
+			seen[device] = true
+			egress = append(egress, device)
+		}
+	}
+	for _, device := range egress {
+		forward, postrouting := renderNAT(nic, device)
+		for _, rule := range forward {
+			fmt.Fprintf(&jumps, "\t\t%s\n", rule)
+		}
+		for _, rule := range postrouting {
+			fmt.Fprintf(&snat, "\t\t%s\n", rule)
+		}
+	}
+
+	var mangle string
+	for _, rule := range renderRoutingMarks(nic, clients, state.routing) {
+		mangle += "\t\t" + rule + "\n"
+	}
+
+	var sets, input string
+	if state.endpointFilter != nil {
+		var rules []string
+		sets, rules = renderEndpointFilter(wgParams.ServerPort, state.endpointFilter)
+		for _, rule := range rules {
+			input += "\t\t" + rule + "\n"
+		}
+	}
+
+	// Declaring the table first lets the delete succeed when it's missing
+	script := fmt.Sprintf("table inet %s\ndelete table inet %s\n", firewallTable, firewallTable)
+	if jumps.Len() == 0 && dnat.Len() == 0 && input == "" && mangle == "" {
+		return script
+	}
+	script += fmt.Sprintf("table inet %s {\n%s", firewallTable, sets)
+	if input != "" {
+		script += fmt.Sprintf("\tchain input {\n\t\ttype filter hook input priority -1; policy accept;\n%s\t}\n", input)
+	}
+	if jumps.Len() > 0 {
+		script += fmt.Sprintf("\tchain forward {\n\t\ttype filter hook forward priority -1; policy accept;\n%s\t}\n%s", jumps.String(), chains.String())
+	}
+	if mangle != "" {
+		script += fmt.Sprintf("\tchain mark {\n\t\ttype filter hook prerouting priority mangle; policy accept;\n%s\t}\n", mangle)
+	}
+	if dnat.Len() > 0 {
+		script += fmt.Sprintf("\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n%s\t}\n", dnat.String())
+	}
+	if snat.Len() > 0 {
+		script += fmt.Sprintf("\tchain postrouting {\n\t\ttype nat hook postrouting priority srcnat; policy accept;\n%s\t}\n", snat.String())
+	}
+	return script + "}\n"
+}
+
+// Rebuild the table from the stored state and the current clients. With
+// nothing to render and no table loaded by this process, nft isn't needed
+// and nothing runs. Caller holds wgConfigMutex.
+func applyFirewallLocked() error {
+	firewallMutex.Lock()
+	defer firewallMutex.Unlock()
+
+	state := firewallState{egressNIC: natEgressNIC, extraPorts: extraListenPorts}
+	var err error
+	if state.policies, err = loadFirewallPoliciesLocked(); err != nil {
+		return err
+	}
+	if state.forwards, err = loadPortForwardsLocked(); err != nil {
+		return err
+	}
+	if state.isolation, err = loadFirewallIsolation(); err != nil {
+		return err
+	}
+	filter, err := loadEndpointFilterLocked()
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		if state.endpointFilter, err = resolveEndpointFilter(filter); err != nil {
+			return err
+		}
+	}
+	profiles, err := loadRoutingProfilesLocked()
+	if err != nil {
+		return err
+	}
+	if state.routing, err = loadRoutingMarksLocked(profiles); err != nil {
+		return err
+	}
+	if err := applyPolicyRoutingLocked(profiles); err != nil {
+		return err
+	}
+	needed := !state.empty()
+	if !needed && !firewallInstalled {
+		return nil
+	}
+
+	clients, err := listWireGuardClients()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(nftCmd, "-f", "-")
+	cmd.Stdin = strings.NewReader(renderFirewall(wgParams.ServerWGNIC, clients, state))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft failed: %v, stderr: %s", err, stderr.String())
+	}
+	firewallInstalled = needed
+	return nil
+}
+
+// CLIENT_ISOLATION and the members of isolated projects
+func loadFirewallIsolation() (firewallIsolation, error) {
+	isolation := firewallIsolation{all: CLIENT_ISOLATION, clients: map[string]bool{}}
+
+	projectsMutex.Lock()
+	projects, err := loadProjectsLocked()
+	projectsMutex.Unlock()
+	if err != nil {
+		return isolation, err
+	}
+	for _, project := range projects {
+		if !project.Isolated {
+			continue
+		}
+		for _, name := range project.Clients {
+			isolation.clients[name] = true
+		}
+	}
+	return isolation, nil
+}
+
+// Install the rules at startup; nftables doesn't keep them across reboots
+func applyFirewall() error {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+	return applyFirewallLocked()
+}
+
+// Drop a deleted client's policy and port forwards so a new client with the
+// same name doesn't inherit them. Caller holds wgConfigMutex and syncs
+// afterwards.
+func removeClientFirewallLocked(name string) error {
+	firewallMutex.Lock()
+	defer firewallMutex.Unlock()
+
+	policies, err := loadFirewallPoliciesLocked()
+	if err != nil {
+		return err
+	}
+	if policies[name] != nil {
+		delete(policies, name)
+		if err := saveFirewallPoliciesLocked(policies); err != nil {
+			return err
+		}
+	}
+
+	forwards, err := loadPortForwardsLocked()
+	if err != nil {
+		return err
+	}
+	if forwards[name] != nil {
+		delete(forwards, name)
+		return savePortForwardsLocked(forwards)
+	}
+	return nil
+}
+
+// Set or, with a nil policy, remove a client's policy and apply the rules
+func setFirewallPolicy(name string, policy *FirewallPolicy) error {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	exists, err := clientExists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errClientNotFound
+	}
+
+	err = func() error {
+		firewallMutex.Lock()
+		defer firewallMutex.Unlock()
+
+		policies, err := loadFirewallPoliciesLocked()
+		if err != nil {
+			return err
+		}
+		if policy == nil {
+			delete(policies, name)
+		} else {
+			policies[name] = policy
+		}
+		return saveFirewallPoliciesLocked(policies)
+	}()
+	if err != nil {
+		return err
+	}
+	return applyFirewallLocked()
+}
+
+func respondFirewallError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, errClientNotFound) {
+		status = http.StatusNotFound
+	}
+	c.JSON(status, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    errorCode(err),
+	})
+}
+
+// Handler for a client's firewall policy; a client without one has
+// unrestricted access
+func firewallHandlerGin(c *gin.Context) {
+	name := c.Param("name")
+	exists, err := clientExists(name)
+	if err == nil && !exists {
+		err = errClientNotFound
+	}
+	if err != nil {
+		respondFirewallError(c, err)
+		return
+	}
+
+	firewallMutex.Lock()
+	policies, err := loadFirewallPoliciesLocked()
+	firewallMutex.Unlock()
+	if err != nil {
+		respondFirewallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"name":       name,
+			"restricted": policies[name] != nil,
+			"policy":     policies[name],
+		},
+	})
+}
+
+// Handler replacing a client's firewall policy
+func setFirewallHandlerGin(c *gin.Context) {
+	var policy FirewallPolicy
+	if !bindJSON(c, &policy) {
+		return
+	}
+	if policy.Allow == nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "allow must be a list of rules",
+		})
+		return
+	}
+	for _, rule := range policy.Allow {
+		if err := validateFirewallRule(rule); err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+	}
+
+	if err := setFirewallPolicy(c.Param("name"), &policy); err != nil {
+		respondFirewallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Firewall policy applied",
+		Data:    policy,
+	})
+}
+
+// Handler lifting a client's restrictions
+func deleteFirewallHandlerGin(c *gin.Context) {
+	if err := setFirewallPolicy(c.Param("name"), nil); err != nil {
+		respondFirewallError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Firewall policy removed",
+	})
+}
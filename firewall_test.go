@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeNftScript saves the loaded ruleset to nft.rules next to the script
+// and lists it back, failing like nft when nothing was loaded
+const fakeNftScript = `#!/bin/bash
+rules="$(dirname "$0")/nft.rules"
+if [ "$1" = "list" ]; then
+  if [ ! -f "$rules" ]; then
+    echo "Error: No such file or directory" >&2
+    exit 1
+  fi
+  cat "$rules"
+  exit 0
+fi
+cat > "$rules"
+`
+
+// Point nftCmd at fakeNftScript; returns the path of the loaded rules
+func setupFakeNft(t *testing.T, env *testEnv) string {
+	t.Helper()
+	script := filepath.Join(env.dir, "nft")
+	if err := os.WriteFile(script, []byte(fakeNftScript), 0755); err != nil {
+		t.Fatalf("writing fake nft script: %v", err)
+	}
+	oldNftCmd := nftCmd
+	nftCmd = script
+	t.Cleanup(func() { nftCmd = oldNftCmd })
+	return filepath.Join(env.dir, "nft.rules")
+}
+
+func readRules(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading loaded rules: %v", err)
+	}
+	return string(content)
+}
+
+func TestFirewallPolicyFollowsClient(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+
+	// Without any policy nft is never needed
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	if _, err := os.Stat(rulesFile); err == nil {
+		t.Fatal("nft must not run before a policy is set")
+	}
+
+	policy := FirewallPolicy{Allow: []FirewallRule{{Destination: "10.0.5.0/24", Protocol: "tcp", Ports: []int{443}}}}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/ghost/firewall", policy).Code; code != http.StatusNotFound {
+		t.Errorf("unknown client: got status %d, want 404", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/firewall", policy).Code; code != http.StatusOK {
+		t.Fatalf("set policy: got status %d", code)
+	}
+	rules := readRules(t, rulesFile)
+	for _, want := range []string{
+		`iifname "wg0" ip saddr 10.66.0.2 jump "client-alice"`,
+		"ip daddr 10.0.5.0/24 tcp dport { 443 } accept",
+		"drop",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules missing %q:\n%s", want, rules)
+		}
+	}
+
+	// Applying peers rebuilds the table, so a disabled client loses its chain
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/add", ProjectRequest{Name: "team"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/team/clients/add", ProjectClientsRequest{Names: []string{"alice"}})
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/team/disable", nil)
+	if rules := readRules(t, rulesFile); strings.Contains(rules, "client-alice") {
+		t.Errorf("disabled client must have no chain:\n%s", rules)
+	}
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/team/enable", nil)
+	if rules := readRules(t, rulesFile); !strings.Contains(rules, "client-alice") {
+		t.Errorf("enabled client must get its chain back:\n%s", rules)
+	}
+
+	// Deleting the client removes the chain and the stored policy
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	if rules := readRules(t, rulesFile); strings.Contains(rules, "client-alice") {
+		t.Errorf("deleted client must have no chain:\n%s", rules)
+	}
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	body := env.authedRequest(t, http.MethodGet, "/api/v1/users/alice/firewall", nil).Body.String()
+	if !strings.Contains(body, `"restricted":false`) {
+		t.Errorf("a new client must not inherit the old policy: %s", body)
+	}
+}
+
+func TestFirewallPolicyValidation(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeNft(t, env)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+
+	for _, body := range []any{
+		map[string]any{},
+		FirewallPolicy{Allow: []FirewallRule{{Destination: "not-an-ip"}}},
+		FirewallPolicy{Allow: []FirewallRule{{Destination: "10.0.0.1", Protocol: "icmp"}}},
+		FirewallPolicy{Allow: []FirewallRule{{Destination: "10.0.0.1", Ports: []int{70000}}}},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/firewall", body).Code; code != http.StatusBadRequest {
+			t.Errorf("%+v: got status %d, want 400", body, code)
+		}
+	}
+}
+
+func TestRenderFirewallRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule FirewallRule
+		want string
+	}{
+		{FirewallRule{Destination: "10.0.5.0/24"}, "ip daddr 10.0.5.0/24 accept"},
+		{FirewallRule{Destination: "fd00::/64", Protocol: "udp"}, "ip6 daddr fd00::/64 meta l4proto udp accept"},
+		{FirewallRule{Destination: "10.0.0.1", Ports: []int{53, 853}}, "ip daddr 10.0.0.1 meta l4proto { tcp, udp } th dport { 53, 853 } accept"},
+	} {
+		if got := renderFirewallRule(tc.rule); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestClientIsolation(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name})
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/add", ProjectRequest{Name: "cust-a"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/cust-a/clients/add", ProjectClientsRequest{Names: []string{"alice", "bob"}})
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/cust-a/isolation", map[string]any{}).Code; code != http.StatusUnprocessableEntity {
+		t.Errorf("missing flag: got status %d, want 422", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/cust-a/isolation", map[string]bool{"isolated": true}).Code; code != http.StatusOK {
+		t.Fatalf("isolate: got status %d", code)
+	}
+	rules := readRules(t, rulesFile)
+	for _, want := range []string{
+		`iifname "wg0" oifname "wg0" ip saddr { 10.66.0.2, 10.66.0.3 } drop`,
+		`iifname "wg0" oifname "wg0" ip daddr { 10.66.0.2, 10.66.0.3 } drop`,
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules missing %q:\n%s", want, rules)
+		}
+	}
+
+	// Membership changes update the isolated set
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/cust-a/clients/remove", ProjectClientsRequest{Names: []string{"bob"}})
+	if rules := readRules(t, rulesFile); !strings.Contains(rules, "saddr { 10.66.0.2 } drop") {
+		t.Errorf("removed member must no longer be isolated:\n%s", rules)
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/cust-a/isolation", map[string]bool{"isolated": false})
+	if rules := readRules(t, rulesFile); strings.Contains(rules, "drop") {
+		t.Errorf("lifting isolation must remove the rules:\n%s", rules)
+	}
+
+	oldIsolation := CLIENT_ISOLATION
+	CLIENT_ISOLATION = true
+	t.Cleanup(func() { CLIENT_ISOLATION = oldIsolation })
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "dave"})
+	if rules := readRules(t, rulesFile); !strings.Contains(rules, `iifname "wg0" oifname "wg0" drop`) {
+		t.Errorf("server-level isolation must drop all peer traffic:\n%s", rules)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Client config formats for the BSD firewalls run as site-to-site peers.
+// OPNsense is set up through its API, so format=opnsense describes the
+// calls to make; pfSense keeps its WireGuard package settings in
+// config.xml, so format=pfsense is the section to merge there. Neither
+// routes a default route through the tunnel without cutting itself off
+// from the server, so such configs get routing turned off and a note.
+
+// One call to the OPNsense API
+type opnsenseCall struct {
+	Purpose string      `json:"purpose"`
+	Method  string      `json:"method"`
+	Path    string      `json:"path"`
+	Body    interface{} `json:"body,omitempty"`
+}
+
+// The OPNsense API calls setting up a client
+type opnsenseSetup struct {
+	Comment string         `json:"comment"`
+	Calls   []opnsenseCall `json:"calls"`
+	Notes   []string       `json:"notes,omitempty"`
+}
+
+// Where the peer's UUID, returned by the addClient call, goes
+const opnsensePeerUUID = "<uuid returned by addClient>"
+
+// The OPNsense API calls adding the server as a peer and the client as an
+// instance using it, for OPNsense 24.1 and later
+func renderOPNsense(name string, peer clientPeerConfig) (string, error) {
+	if peer.Obfuscated {
+		return "", fmt.Errorf("OPNsense doesn't support AmneziaWG's obfuscation parameters")
+	}
+	host, port, err := peer.endpoint()
+	if err != nil {
+		return "", err
+	}
+
+	client := map[string]string{
+		"enabled":       "1",
+		"name":          name + "-server",
+		"pubkey":        peer.PublicKey,
+		"tunneladdress": strings.Join(peer.AllowedIPs, ","),
+		"serveraddress": host,
+		"serverport":    port,
+	}
+	if peer.PresharedKey != "" {
+		client["psk"] = peer.PresharedKey
+	}
+	if peer.Keepalive != "" && peer.Keepalive != "off" {
+		client["keepalive"] = peer.Keepalive
+	}
+
+	server := map[string]string{
+		"enabled":       "1",
+		"name":          name,
+		"privkey":       peer.PrivateKey,
+		"pubkey":        peer.InterfacePublicKey,
+		"tunneladdress": strings.Join(peer.Addresses, ","),
+		"peers":         opnsensePeerUUID,
+		"disableroutes": "0",
+	}
+	if peer.MTU != "" {
+		server["mtu"] = peer.MTU
+	}
+	if len(peer.DNS) > 0 {
+		server["dns"] = strings.Join(peer.DNS, ",")
+	}
+
+	setup := opnsenseSetup{
+		Comment: fmt.Sprintf("WireGuard client %s for OPNsense; make the calls in order with an API key, under VPN > WireGuard in the UI", name),
+	}
+	if defaults := peer.defaultRoutes(); len(defaults) > 0 {
+		server["disableroutes"] = "1"
+		setup.Notes = append(setup.Notes, fmt.Sprintf("Routes are off: %s would also take the tunnel's packets to the server. Assign the instance an interface and gateway, and policy-route the traffic meant for the VPN.", strings.Join(defaults, ", ")))
+	}
+	if peer.PostUp {
+		setup.Notes = append(setup.Notes, "The config's PostUp and PostDown commands, such as a kill switch, have no OPNsense equivalent.")
+	}
+	setup.Calls = []opnsenseCall{
+		{Purpose: "Add the VPN server as a peer", Method: "POST", Path: "/api/wireguard/client/addClient", Body: map[string]interface{}{"client": client}},
+		{Purpose: "Add the client's instance with that peer", Method: "POST", Path: "/api/wireguard/server/addServer", Body: map[string]interface{}{"server": server}},
+		{Purpose: "Enable WireGuard", Method: "POST", Path: "/api/wireguard/general/set", Body: map[string]interface{}{"general": map[string]string{"enabled": "1"}}},
+		{Purpose: "Apply the changes", Method: "POST", Path: "/api/wireguard/service/reconfigure"},
+	}
+
+	// The placeholder stays readable without HTML escaping
+	var b strings.Builder
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(setup); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// An address or network of the pfSense WireGuard package
+type pfsenseAddress struct {
+	Address string `xml:"address"`
+	Mask    int    `xml:"mask"`
+	Descr   string `xml:"descr"`
+}
+
+type pfsenseTunnel struct {
+	Name       string           `xml:"name"`
+	Enabled    string           `xml:"enabled"`
+	Descr      string           `xml:"descr"`
+	PrivateKey string           `xml:"privatekey"`
+	PublicKey  string           `xml:"publickey"`
+	MTU        string           `xml:"mtu,omitempty"`
+	Addresses  []pfsenseAddress `xml:"addresses>row"`
+}
+
+type pfsensePeer struct {
+	Enabled      string           `xml:"enabled"`
+	Tun          string           `xml:"tun"`
+	Descr        string           `xml:"descr"`
+	Dynamic      string           `xml:"dynamic,omitempty"`
+	Endpoint     string           `xml:"endpoint,omitempty"`
+	Port         string           `xml:"port,omitempty"`
+	Keepalive    string           `xml:"persistentkeepalive,omitempty"`
+	PublicKey    string           `xml:"publickey"`
+	PresharedKey string           `xml:"presharedkey,omitempty"`
+	AllowedIPs   []pfsenseAddress `xml:"allowedips>row"`
+}
+
+// The <wireguard> section of the package's config.xml settings
+type pfsenseWireGuard struct {
+	XMLName xml.Name        `xml:"wireguard"`
+	Notes   xml.Comment     `xml:",comment"`
+	Tunnels []pfsenseTunnel `xml:"tunnels>item"`
+	Peers   []pfsensePeer   `xml:"peers>item"`
+}
+
+// The tunnel the section adds, renamed when the firewall has one already
+const pfsenseTunnelName = "tun_wg0"
+
+// Text safe inside an XML comment, which can't hold "--" as client names
+// like my--router do
+func xmlCommentText(text string) string {
+	for strings.Contains(text, "--") {
+		text = strings.ReplaceAll(text, "--", "- -")
+	}
+	return text
+}
+
+func pfsenseAddresses(entries []string) ([]pfsenseAddress, error) {
+	addresses := []pfsenseAddress{}
+	for _, entry := range entries {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", entry)
+		}
+		addresses = append(addresses, pfsenseAddress{Address: prefix.Addr().String(), Mask: prefix.Bits()})
+	}
+	return addresses, nil
+}
+
+// The config.xml section of the pfSense WireGuard package adding the client
+// as a tunnel with the server as its peer
+func renderPfSense(name string, peer clientPeerConfig) (string, error) {
+	if peer.Obfuscated {
+		return "", fmt.Errorf("pfSense doesn't support AmneziaWG's obfuscation parameters")
+	}
+	host, port, err := peer.endpoint()
+	if err != nil {
+		return "", err
+	}
+	addresses, err := pfsenseAddresses(peer.Addresses)
+	if err != nil {
+		return "", err
+	}
+	allowedIPs, err := pfsenseAddresses(peer.AllowedIPs)
+	if err != nil {
+		return "", err
+	}
+
+	notes := []string{fmt.Sprintf("WireGuard client %s for the pfSense WireGuard package. Merge into <installedpackages><wireguard> of config.xml, renaming %s if it is taken, then assign the tunnel an interface.", name, pfsenseTunnelName)}
+	section := pfsenseWireGuard{
+		Tunnels: []pfsenseTunnel{{
+			Name:       pfsenseTunnelName,
+			Enabled:    "yes",
+			Descr:      name,
+			PrivateKey: peer.PrivateKey,
+			PublicKey:  peer.InterfacePublicKey,
+			MTU:        peer.MTU,
+			Addresses:  addresses,
+		}},
+		Peers: []pfsensePeer{{
+			Enabled:      "yes",
+			Tun:          pfsenseTunnelName,
+			Descr:        "VPN server",
+			Endpoint:     host,
+			Port:         port,
+			PublicKey:    peer.PublicKey,
+			PresharedKey: peer.PresharedKey,
+			AllowedIPs:   allowedIPs,
+		}},
+	}
+	if host == "" {
+		section.Peers[0].Dynamic = "yes"
+	}
+	if peer.Keepalive != "off" {
+		section.Peers[0].Keepalive = peer.Keepalive
+	}
+	if defaults := peer.defaultRoutes(); len(defaults) > 0 {
+		notes = append(notes, fmt.Sprintf("%s would also take the tunnel's packets to the server; add a gateway on the tunnel's interface and policy-route the traffic meant for the VPN.", strings.Join(defaults, ", ")))
+	}
+	if len(peer.DNS) > 0 {
+		notes = append(notes, fmt.Sprintf("The config's DNS servers, for the DNS resolver if wanted: %s", strings.Join(peer.DNS, ", ")))
+	}
+	if peer.PostUp {
+		notes = append(notes, "The config's PostUp and PostDown commands, such as a kill switch, have no pfSense equivalent.")
+	}
+	section.Notes = xml.Comment("\n    " + xmlCommentText(strings.Join(notes, "\n    ")) + "\n  ")
+
+	content, err := xml.MarshalIndent(section, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(content) + "\n", nil
+}
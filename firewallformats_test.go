@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFirewallConfigDownload(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/users/alice/config?format=opnsense", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Disposition") != `attachment; filename="alice.json"` {
+		t.Fatalf("opnsense: status %d, %s", rec.Code, rec.Body.String())
+	}
+	var setup struct {
+		Calls []struct {
+			Path string                       `json:"path"`
+			Body map[string]map[string]string `json:"body"`
+		} `json:"calls"`
+		Notes []string `json:"notes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &setup); err != nil || len(setup.Calls) != 4 {
+		t.Fatalf("opnsense: %v, %s", err, rec.Body.String())
+	}
+	client, server := setup.Calls[0].Body["client"], setup.Calls[1].Body["server"]
+	if client["pubkey"] != "server-public-key" || client["serveraddress"] != "203.0.113.10" || client["serverport"] != "51820" || client["keepalive"] != "25" {
+		t.Errorf("client: %v", client)
+	}
+	// The fake wg derives pub-<private key>
+	if server["pubkey"] != "pub-"+server["privkey"] || server["peers"] != opnsensePeerUUID || server["dns"] != "1.1.1.1,1.0.0.1" {
+		t.Errorf("server: %v", server)
+	}
+	if server["disableroutes"] != "1" || len(setup.Notes) != 1 || !strings.Contains(setup.Notes[0], "0.0.0.0/0") {
+		t.Errorf("the default route was routed: %v, %v", server, setup.Notes)
+	}
+
+	rec = env.authedRequest(t, http.MethodGet, "/api/v1/users/alice/config?format=pfsense", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Disposition") != `attachment; filename="alice.xml"` {
+		t.Fatalf("pfsense: status %d, %s", rec.Code, rec.Body.String())
+	}
+	var section pfsenseWireGuard
+	if err := xml.Unmarshal(rec.Body.Bytes(), &section); err != nil || len(section.Tunnels) != 1 || len(section.Peers) != 1 {
+		t.Fatalf("pfsense: %v, %s", err, rec.Body.String())
+	}
+	tunnel, peer := section.Tunnels[0], section.Peers[0]
+	if tunnel.PublicKey != "pub-"+tunnel.PrivateKey || len(tunnel.Addresses) != 1 || tunnel.Addresses[0].Mask != 32 {
+		t.Errorf("tunnel: %+v", tunnel)
+	}
+	if peer.Endpoint != "203.0.113.10" || peer.Port != "51820" || peer.PublicKey != "server-public-key" || peer.Tun != tunnel.Name {
+		t.Errorf("peer: %+v", peer)
+	}
+	if !strings.Contains(string(section.Notes), "0.0.0.0/0 would also take") || !strings.Contains(string(section.Notes), "1.1.1.1, 1.0.0.1") {
+		t.Errorf("notes: %s", section.Notes)
+	}
+
+	// Valid names can hold "--", which XML comments can't
+	addedClient(t, env, "my--router")
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/users/my--router/config?format=pfsense", nil); rec.Code != http.StatusOK {
+		t.Errorf("my--router: status %d, %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRenderPfSense(t *testing.T) {
+	peer, err := parseClientPeerConfig(`[Interface]
+PrivateKey = client-private-key
+Address = 10.66.0.7/32, fd42:42:42::7/128
+MTU = 1380
+
+[Peer]
+PublicKey = server-public-key
+AllowedIPs = 10.66.0.0/24, fd42:42:42::/64
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.InterfacePublicKey = "client-public-key"
+	content, err := renderPfSense("lab", peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<wireguard>
+  <!--
+    WireGuard client lab for the pfSense WireGuard package. Merge into <installedpackages><wireguard> of config.xml, renaming tun_wg0 if it is taken, then assign the tunnel an interface.
+  -->
+  <tunnels>
+    <item>
+      <name>tun_wg0</name>
+      <enabled>yes</enabled>
+      <descr>lab</descr>
+      <privatekey>client-private-key</privatekey>
+      <publickey>client-public-key</publickey>
+      <mtu>1380</mtu>
+      <addresses>
+        <row>
+          <address>10.66.0.7</address>
+          <mask>32</mask>
+          <descr></descr>
+        </row>
+        <row>
+          <address>fd42:42:42::7</address>
+          <mask>128</mask>
+          <descr></descr>
+        </row>
+      </addresses>
+    </item>
+  </tunnels>
+  <peers>
+    <item>
+      <enabled>yes</enabled>
+      <tun>tun_wg0</tun>
+      <descr>VPN server</descr>
+      <dynamic>yes</dynamic>
+      <publickey>server-public-key</publickey>
+      <allowedips>
+        <row>
+          <address>10.66.0.0</address>
+          <mask>24</mask>
+          <descr></descr>
+        </row>
+        <row>
+          <address>fd42:42:42::</address>
+          <mask>64</mask>
+          <descr></descr>
+        </row>
+      </allowedips>
+    </item>
+  </peers>
+</wireguard>
+`
+	if content != want {
+		t.Errorf("got:\n%s\nwant:\n%s", content, want)
+	}
+
+	// XML comments can't hold "--"
+	peer.AllowedIPs = []string{"0.0.0.0/0"}
+	content, err = renderPfSense("my---router", peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var section pfsenseWireGuard
+	if err := xml.Unmarshal([]byte(content), &section); err != nil || section.Tunnels[0].Descr != "my---router" {
+		t.Fatalf("%v, %s", err, content)
+	}
+	if !strings.Contains(string(section.Notes), "WireGuard client my- - -router for") {
+		t.Errorf("notes: %s", section.Notes)
+	}
+
+	peer.Obfuscated = true
+	if _, err := renderOPNsense("lab", peer); err == nil {
+		t.Error("rendered an AmneziaWG config for OPNsense")
+	}
+	if _, err := renderPfSense("lab", peer); err == nil {
+		t.Error("rendered an AmneziaWG config for pfSense")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Port forwards expose a service running on a client: connections to a
+// public port of this server are DNATed to the client's tunnel IPv4. They
+// are rendered into the firewall table (see firewall.go), so they follow
+// the peer: a disabled client's forwards are inactive and deleting the
+// client removes them.
+
+type PortForward struct {
+	// "tcp" or "udp"
+	Protocol   string `json:"protocol"`
+	PublicPort int    `json:"public_port"`
+	// Port on the client
+	Port int `json:"port"`
+}
+
+// A forward with the client it belongs to, for the fleet-wide list
+type ClientPortForward struct {
+	Name string `json:"name"`
+	PortForward
+}
+
+var (
+	errForwardExists   = errors.New("This public port is already forwarded")
+	errForwardNotFound = errors.New("Port forward not found")
+	errNoClientIPv4    = errors.New("Client has no IPv4 address to forward to")
+)
+
+// FORWARDS_FILE, or forwards.json next to the server config
+func portForwardsFile() string {
+	if FORWARDS_FILE != "" {
+		return FORWARDS_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "forwards.json")
+}
+
+// Caller holds firewallMutex
+func loadPortForwardsLocked() (map[string][]PortForward, error) {
+	forwards := make(map[string][]PortForward)
+	content, err := os.ReadFile(portForwardsFile())
+	if os.IsNotExist(err) {
+		return forwards, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forwards file: %v", err)
+	}
+	if err := json.Unmarshal(content, &forwards); err != nil {
+		return nil, fmt.Errorf("failed to parse forwards file: %v", err)
+	}
+	return forwards, nil
+}
+
+// Caller holds firewallMutex
+func savePortForwardsLocked(forwards map[string][]PortForward) error {
+	content, err := json.MarshalIndent(forwards, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(portForwardsFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write forwards file: %v", err)
+	}
+	return nil
+}
+
+// Ports this server listens on itself can't be forwarded
+func validatePortForward(forward PortForward) error {
+	if forward.Protocol != "tcp" && forward.Protocol != "udp" {
+		return fmt.Errorf("protocol must be tcp or udp")
+	}
+	if forward.PublicPort < 1 || forward.PublicPort > 65535 || forward.Port < 1 || forward.Port > 65535 {
+		return fmt.Errorf("ports must be between 1 and 65535")
+	}
+
+	reserved := map[string]string{
+		"udp/" + wgParams.ServerPort: "the VPN",
+		"tcp/" + API_PORT:            "the API",
+	}
+	if GRPC_PORT != "" {
+		reserved["tcp/"+GRPC_PORT] = "the gRPC API"
+	}
+	if service, ok := reserved[forward.Protocol+"/"+strconv.Itoa(forward.PublicPort)]; ok {
+		return fmt.Errorf("%s/%d is used by %s", forward.Protocol, forward.PublicPort, service)
+	}
+	return nil
+}
+
+// The DNAT rule of one forward. Traffic arriving through the tunnel isn't
+// translated, so clients reaching the public IP hit the server itself.
+func renderPortForward(nic, ipv4 string, forward PortForward) string {
+	return fmt.Sprintf("iifname != %q meta nfproto ipv4 %s dport %d dnat ip to %s:%d",
+		nic, forward.Protocol, forward.PublicPort, ipv4, forward.Port)
+}
+
+// Change a client's forwards with fn and apply the table
+func updatePortForwards(name string, fn func(forwards map[string][]PortForward) error) error {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	exists, err := clientExists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errClientNotFound
+	}
+
+	err = func() error {
+		firewallMutex.Lock()
+		defer firewallMutex.Unlock()
+
+		forwards, err := loadPortForwardsLocked()
+		if err != nil {
+			return err
+		}
+		if err := fn(forwards); err != nil {
+			return err
+		}
+		if len(forwards[name]) == 0 {
+			delete(forwards, name)
+		}
+		return savePortForwardsLocked(forwards)
+	}()
+	if err != nil {
+		return err
+	}
+	return applyFirewallLocked()
+}
+
+func respondPortForwardError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errClientNotFound), errors.Is(err, errForwardNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errForwardExists):
+		status = http.StatusConflict
+	case errors.Is(err, errNoClientIPv4):
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    errorCode(err),
+	})
+}
+
+// Handler listing the forwards of every client
+func listPortForwardsHandlerGin(c *gin.Context) {
+	firewallMutex.Lock()
+	forwards, err := loadPortForwardsLocked()
+	firewallMutex.Unlock()
+	if err != nil {
+		respondPortForwardError(c, err)
+		return
+	}
+
+	list := []ClientPortForward{}
+	for name, clientForwards := range forwards {
+		for _, forward := range clientForwards {
+			list = append(list, ClientPortForward{Name: name, PortForward: forward})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].PublicPort != list[j].PublicPort {
+			return list[i].PublicPort < list[j].PublicPort
+		}
+		return list[i].Protocol < list[j].Protocol
+	})
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+func portForwardsHandlerGin(c *gin.Context) {
+	name := c.Param("name")
+	exists, err := clientExists(name)
+	if err == nil && !exists {
+		err = errClientNotFound
+	}
+	if err != nil {
+		respondPortForwardError(c, err)
+		return
+	}
+
+	firewallMutex.Lock()
+	forwards, err := loadPortForwardsLocked()
+	firewallMutex.Unlock()
+	if err != nil {
+		respondPortForwardError(c, err)
+		return
+	}
+
+	list := forwards[name]
+	if list == nil {
+		list = []PortForward{}
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// Handler forwarding a public port to a client
+func addPortForwardHandlerGin(c *gin.Context) {
+	var forward PortForward
+	if !bindJSON(c, &forward) {
+		return
+	}
+	if err := validatePortForward(forward); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	name := c.Param("name")
+	err := updatePortForwards(name, func(forwards map[string][]PortForward) error {
+		for _, clientForwards := range forwards {
+			for _, existing := range clientForwards {
+				if existing.Protocol == forward.Protocol && existing.PublicPort == forward.PublicPort {
+					return errForwardExists
+				}
+			}
+		}
+		clients, err := listWireGuardClients()
+		if err != nil {
+			return err
+		}
+		for _, client := range clients {
+			if client.Name == name && client.IPV4 == "" {
+				return errNoClientIPv4
+			}
+		}
+		forwards[name] = append(forwards[name], forward)
+		return nil
+	})
+	if err != nil {
+		respondPortForwardError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("%s/%d forwarded to %s", forward.Protocol, forward.PublicPort, name),
+		Data:    forward,
+	})
+}
+
+// Handler removing a forward by protocol and public port
+func deletePortForwardHandlerGin(c *gin.Context) {
+	var forward PortForward
+	if !bindJSON(c, &forward) {
+		return
+	}
+
+	name := c.Param("name")
+	err := updatePortForwards(name, func(forwards map[string][]PortForward) error {
+		for i, existing := range forwards[name] {
+			if existing.Protocol == forward.Protocol && existing.PublicPort == forward.PublicPort {
+				forwards[name] = append(forwards[name][:i], forwards[name][i+1:]...)
+				return nil
+			}
+		}
+		return errForwardNotFound
+	})
+	if err != nil {
+		respondPortForwardError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Port forward removed",
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPortForwardLifecycle(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+
+	forward := PortForward{Protocol: "tcp", PublicPort: 8443, Port: 443}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/ghost/forwards/add", forward).Code; code != http.StatusNotFound {
+		t.Errorf("unknown client: got status %d, want 404", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/forwards/add", forward).Code; code != http.StatusOK {
+		t.Fatalf("add forward: got status %d", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/bob/forwards/add", forward).Code; code != http.StatusConflict {
+		t.Errorf("taken public port: got status %d, want 409", code)
+	}
+	want := `iifname != "wg0" meta nfproto ipv4 tcp dport 8443 dnat ip to 10.66.0.2:443`
+	if rules := readRules(t, rulesFile); !strings.Contains(rules, want) || !strings.Contains(rules, "hook prerouting") {
+		t.Errorf("rules missing %q:\n%s", want, rules)
+	}
+	if body := env.authedRequest(t, http.MethodGet, "/api/v1/forwards", nil).Body.String(); !strings.Contains(body, `"name":"alice","protocol":"tcp","public_port":8443,"port":443`) {
+		t.Errorf("unexpected forward list: %s", body)
+	}
+
+	// Deleting the client removes its forwards, freeing the public port
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	if rules := readRules(t, rulesFile); strings.Contains(rules, "dnat") {
+		t.Errorf("deleted client must have no forwards:\n%s", rules)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/bob/forwards/add", forward).Code; code != http.StatusOK {
+		t.Errorf("freed public port: got status %d", code)
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/bob/forwards/delete", forward).Code; code != http.StatusOK {
+		t.Fatalf("delete forward: got status %d", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/bob/forwards/delete", forward).Code; code != http.StatusNotFound {
+		t.Errorf("deleting again: got status %d, want 404", code)
+	}
+	if rules := readRules(t, rulesFile); strings.Contains(rules, "dnat") {
+		t.Errorf("removed forward must be gone:\n%s", rules)
+	}
+}
+
+func TestPortForwardValidation(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+
+	for _, forward := range []PortForward{
+		{Protocol: "icmp", PublicPort: 80, Port: 80},
+		{Protocol: "tcp", PublicPort: 0, Port: 80},
+		{Protocol: "udp", PublicPort: 51820, Port: 51820},
+		{Protocol: "tcp", PublicPort: 8080, Port: 80},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/forwards/add", forward).Code; code != http.StatusBadRequest {
+			t.Errorf("%+v: got status %d, want 400", forward, code)
+		}
+	}
+	if _, err := os.Stat(rulesFile); err == nil {
+		t.Error("rejected forwards must not load any rules")
+	}
+}
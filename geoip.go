@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+)
+
+// Minimal reader for MaxMind DB (.mmdb) files such as GeoLite2-City, used to
+// annotate peer endpoints with a country and city. Only lookups are
+// supported; see https://maxmind.github.io/MaxMind-DB/ for the format.
+
+var (
+	// Loaded from GEOIP_DB at startup; nil disables enrichment
+	geoIPDB *mmdbReader
+
+	mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+)
+
+// Location data attached to a peer endpoint in status responses
+type GeoInfo struct {
+	CountryCode string `json:"country_code,omitempty"`
+	Country     string `json:"country,omitempty"`
+	City        string `json:"city,omitempty"`
+}
+
+type mmdbReader struct {
+	buf        []byte
+	data       []byte // data section, pointers are relative to its start
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // node reached after the 96 leading zero bits of ::a.b.c.d
+}
+
+// Load the database named by GEOIP_DB, if any. A broken database only
+// disables enrichment; it must not keep the API from starting.
+func loadGeoIPDB() {
+	if GEOIP_DB == "" {
+		return
+	}
+
+	reader, err := openMMDB(GEOIP_DB)
+	if err != nil {
+		log.Printf("GeoIP disabled: %v", err)
+		return
+	}
+	geoIPDB = reader
+	log.Printf("GeoIP database loaded from %s", GEOIP_DB)
+}
+
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GeoIP database: %v", err)
+	}
+
+	markerIndex := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if markerIndex == -1 {
+		return nil, errors.New("invalid GeoIP database: metadata marker not found")
+	}
+
+	metaSection := buf[markerIndex+len(mmdbMetadataMarker):]
+	meta, _, err := decodeMMDBValue(metaSection, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP database metadata: %v", err)
+	}
+	metaMap, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid GeoIP database metadata: not a map")
+	}
+
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  uint(mmdbUint(metaMap["node_count"])),
+		recordSize: uint(mmdbUint(metaMap["record_size"])),
+		ipVersion:  uint(mmdbUint(metaMap["ip_version"])),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported GeoIP record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(markerIndex) {
+		return nil, errors.New("invalid GeoIP database: search tree exceeds file")
+	}
+	r.data = buf[treeSize+16 : markerIndex]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Read the left (bit 0) or right (bit 1) record of a search tree node
+func (r *mmdbReader) readRecord(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		b := r.buf[offset : offset+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.buf[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buf[offset : offset+4]))
+	}
+}
+
+// Look up the record for ip. Returns nil when the address isn't covered.
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	bits := ip.To16()
+	bitCount := 128
+
+	if v4 := ip.To4(); v4 != nil {
+		bits = v4
+		bitCount = 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = r.readRecord(node, bit)
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("invalid GeoIP database: search tree too deep")
+	}
+
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil, errors.New("invalid GeoIP database: data pointer out of range")
+	}
+
+	value, _, err := decodeMMDBValue(r.data, offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]interface{})
+	return record, nil
+}
+
+// Resolve a peer endpoint ("ip:port" or "[ip]:port" as printed by wg) to a
+// location. Returns nil when GeoIP is disabled or nothing is known.
+func lookupEndpointGeo(endpoint string) *GeoInfo {
+	if geoIPDB == nil {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	record, err := geoIPDB.lookup(ip)
+	if err != nil {
+		if DEBUG_MODE {
+			log.Printf("GeoIP lookup for %s failed: %v", host, err)
+		}
+		return nil
+	}
+	if record == nil {
+		return nil
+	}
+
+	info := &GeoInfo{
+		CountryCode: mmdbString(record, "country", "iso_code"),
+		Country:     mmdbString(record, "country", "names", "en"),
+		City:        mmdbString(record, "city", "names", "en"),
+	}
+	if *info == (GeoInfo{}) {
+		return nil
+	}
+	return info
+}
+
+// Walk nested maps and return the string at path, or "" if absent
+func mmdbString(record map[string]interface{}, path ...string) string {
+	var current interface{} = record
+	for _, key := range path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		current = m[key]
+	}
+	s, _ := current.(string)
+	return s
+}
+
+func mmdbUint(value interface{}) uint64 {
+	n, _ := value.(uint64)
+	return n
+}
+
+// Decode one value of the MMDB data section format starting at offset.
+// Returns the value and the offset just past it.
+func decodeMMDBValue(data []byte, offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(data)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+
+	ctrl := data[offset]
+	offset++
+	typeNum := uint(ctrl >> 5)
+
+	// Pointers use the size bits differently, handle them first
+	if typeNum == 1 {
+		sizeBits := uint(ctrl>>3) & 0x3
+		pointer := uint(ctrl & 0x7)
+		n := sizeBits + 1
+		if offset+n > uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data in pointer")
+		}
+		switch sizeBits {
+		case 0:
+			pointer = pointer<<8 | uint(data[offset])
+		case 1:
+			pointer = (pointer<<16 | uint(data[offset])<<8 | uint(data[offset+1])) + 2048
+		case 2:
+			pointer = (pointer<<24 | uint(data[offset])<<16 | uint(data[offset+1])<<8 | uint(data[offset+2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(data[offset : offset+4]))
+		}
+		value, _, err := decodeMMDBValue(data, pointer)
+		return value, offset + n, err
+	}
+
+	if typeNum == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data in extended type")
+		}
+		typeNum = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data in size")
+		}
+		extra := uint(0)
+		for i := uint(0); i < n; i++ {
+			extra = extra<<8 | uint(data[offset+i])
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + extra
+		case 2:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	// Maps and arrays hold entry counts, booleans carry the value in size;
+	// every other type's size is a byte length
+	switch typeNum {
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := decodeMMDBValue(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			value, next, err := decodeMMDBValue(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyString] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := decodeMMDBValue(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errors.New("unexpected end of data in value")
+	}
+	raw := data[offset : offset+size]
+	offset += size
+
+	switch typeNum {
+	case 2:
+		return string(raw), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case 4:
+		return append([]byte(nil), raw...), offset, nil
+	case 5, 6, 9, 10:
+		// uint128 values don't fit; they aren't used by location fields
+		n := uint64(0)
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		return n, offset, nil
+	case 8:
+		n := int32(0)
+		for _, b := range raw {
+			n = n<<8 | int32(b)
+		}
+		return int64(n), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type %d", typeNum)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Encode a value in the MMDB data section format. Only what the test
+// databases need: strings, small uints and maps, all shorter than 29.
+func encodeMMDB(t *testing.T, value interface{}) []byte {
+	t.Helper()
+
+	switch v := value.(type) {
+	case string:
+		return append([]byte{2<<5 | byte(len(v))}, v...)
+	case uint32:
+		return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		out := []byte{7<<5 | byte(len(v))}
+		for _, k := range keys {
+			out = append(out, encodeMMDB(t, k)...)
+			out = append(out, encodeMMDB(t, v[k])...)
+		}
+		return out
+	}
+
+	t.Fatalf("encodeMMDB: unsupported type %T", value)
+	return nil
+}
+
+// Write an IPv4 database with one node: 0.0.0.0/1 maps to record, the upper
+// half of the address space is unknown.
+func writeTestMMDB(t *testing.T, record map[string]interface{}) string {
+	t.Helper()
+
+	const nodeCount = 1
+	left := uint32(nodeCount + 16) // data section offset 0
+	right := uint32(nodeCount)     // "not found"
+	tree := []byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)}
+
+	var buf bytes.Buffer
+	buf.Write(tree)
+	buf.Write(make([]byte, 16))
+	buf.Write(encodeMMDB(t, record))
+	buf.Write(mmdbMetadataMarker)
+	buf.Write(encodeMMDB(t, map[string]interface{}{
+		"node_count":  uint32(nodeCount),
+		"record_size": uint32(24),
+		"ip_version":  uint32(4),
+	}))
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("writing test mmdb: %v", err)
+	}
+	return path
+}
+
+func TestLookupEndpointGeo(t *testing.T) {
+	path := writeTestMMDB(t, map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": "NL",
+			"names":    map[string]interface{}{"en": "Netherlands"},
+		},
+		"city": map[string]interface{}{
+			"names": map[string]interface{}{"en": "Amsterdam"},
+		},
+	})
+
+	reader, err := openMMDB(path)
+	if err != nil {
+		t.Fatalf("openMMDB: %v", err)
+	}
+	oldDB := geoIPDB
+	geoIPDB = reader
+	t.Cleanup(func() { geoIPDB = oldDB })
+
+	geo := lookupEndpointGeo("93.184.216.34:51820")
+	if geo == nil {
+		t.Fatal("expected a location for an address in the covered range")
+	}
+	if *geo != (GeoInfo{CountryCode: "NL", Country: "Netherlands", City: "Amsterdam"}) {
+		t.Errorf("got %+v", *geo)
+	}
+
+	if geo := lookupEndpointGeo("203.0.113.5:51820"); geo != nil {
+		t.Errorf("address outside the database must have no location, got %+v", *geo)
+	}
+	if geo := lookupEndpointGeo("(none)"); geo != nil {
+		t.Errorf("peer without endpoint must have no location, got %+v", *geo)
+	}
+}
+
+func TestOpenMMDBRejectsGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0600); err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+
+	if _, err := openMMDB(path); err == nil {
+		t.Error("expected an error for a file without MMDB metadata")
+	}
+}
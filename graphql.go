@@ -0,0 +1,861 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A deliberately small GraphQL implementation for /api/graphql: queries and
+// mutations with nested selections, aliases, arguments and variables.
+// Fragments, directives and introspection are not supported. Resolvers
+// return plain maps and the executor prunes them down to the selection, so
+// the response carries only the fields the caller asked for.
+//
+// Schema:
+//
+//	type Query {
+//	  clients(name: String): [Client!]!
+//	  client(name: String!): Client
+//	  peers(online: Boolean, client: String): [Peer!]!
+//	  stats: Stats!
+//	}
+//	type Mutation {
+//	  addClient(name: String!, ipv4: String, ipv6: String): Client!
+//	  deleteClient(name: String!): Boolean!
+//	}
+//	type Client { name ipv4 ipv6 config }
+//	type Peer { publicKey clientName endpoint allowedIps latestHandshake
+//	            transferRx transferTx online }
+//	type Stats { totalClients onlineClients transferRx transferTx
+//	             ipPoolUsed ipPoolSize }
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+type graphQLError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+type graphQLResponse struct {
+	Data   interface{}    `json:"data"`
+	Errors []graphQLError `json:"errors,omitempty"`
+}
+
+// Answers in the standard GraphQL shape rather than the APIResponse
+// envelope, so off-the-shelf GraphQL clients work unchanged
+func graphQLHandlerGin(c *gin.Context) {
+	var req graphQLRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Query) == "" {
+		c.JSON(http.StatusBadRequest, graphQLResponse{
+			Errors: []graphQLError{{Message: "Request body must be JSON with a non-empty query"}},
+		})
+		return
+	}
+
+	op, err := parseGraphQL(req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		c.JSON(http.StatusOK, graphQLResponse{Errors: []graphQLError{{Message: err.Error()}}})
+		return
+	}
+
+	if op.kind == "mutation" && c.GetBool("readonly") {
+		c.JSON(http.StatusOK, graphQLResponse{Errors: []graphQLError{{Message: "Read-only tokens can only run queries"}}})
+		return
+	}
+
+	c.JSON(http.StatusOK, executeGraphQL(op))
+}
+
+type gqlOperation struct {
+	kind       string // "query" or "mutation"
+	selections []*gqlField
+}
+
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []*gqlField
+}
+
+func (f *gqlField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type gqlResolver func(args map[string]interface{}) (interface{}, error)
+
+var gqlRoots = map[string]map[string]gqlResolver{
+	"query": {
+		"clients": gqlClients,
+		"client":  gqlClient,
+		"peers":   gqlPeers,
+		"stats":   gqlStats,
+	},
+	"mutation": {
+		"addClient":    gqlAddClient,
+		"deleteClient": gqlDeleteClient,
+	},
+}
+
+var gqlRootTypeNames = map[string]string{"query": "Query", "mutation": "Mutation"}
+
+// Field types per object type; "" marks a scalar. Selections are checked
+// against this before resolving, so a bad field errors even when the
+// result would be empty.
+var gqlTypes = map[string]map[string]string{
+	"Query":    {"clients": "Client", "client": "Client", "peers": "Peer", "stats": "Stats"},
+	"Mutation": {"addClient": "Client", "deleteClient": ""},
+	"Client":   {"name": "", "ipv4": "", "ipv6": "", "config": ""},
+	"Peer": {
+		"publicKey": "", "clientName": "", "endpoint": "", "allowedIps": "",
+		"latestHandshake": "", "transferRx": "", "transferTx": "", "online": "",
+	},
+	"Stats": {
+		"totalClients": "", "onlineClients": "", "transferRx": "", "transferTx": "",
+		"ipPoolUsed": "", "ipPoolSize": "",
+	},
+}
+
+func validateGQLSelection(typeName string, field *gqlField) error {
+	fieldType, ok := gqlTypes[typeName][field.name]
+	if !ok {
+		return fmt.Errorf("Cannot query field %q on type %q", field.name, typeName)
+	}
+	if fieldType == "" {
+		if len(field.selections) > 0 {
+			return fmt.Errorf("Field %q is a scalar and cannot have a selection", field.name)
+		}
+		return nil
+	}
+	if len(field.selections) == 0 {
+		return fmt.Errorf("Field %q of type %q must have a selection of subfields", field.name, fieldType)
+	}
+	for _, sub := range field.selections {
+		if err := validateGQLSelection(fieldType, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run the root fields in order. A failing field becomes null with an entry
+// in errors; the other fields are still returned.
+func executeGraphQL(op *gqlOperation) graphQLResponse {
+	var resp graphQLResponse
+	if op.kind == "mutation" {
+		if message := changesRefusedMessage(); message != "" {
+			resp.Errors = []graphQLError{{Message: message}}
+			return resp
+		}
+	}
+
+	data := gqlObject{}
+
+	for _, field := range op.selections {
+		if err := validateGQLSelection(gqlRootTypeNames[op.kind], field); err != nil {
+			resp.Errors = append(resp.Errors, graphQLError{Message: err.Error(), Path: []interface{}{field.key()}})
+			data = append(data, gqlEntry{field.key(), nil})
+			continue
+		}
+
+		value, err := gqlRoots[op.kind][field.name](field.args)
+		if err != nil {
+			resp.Errors = append(resp.Errors, graphQLError{Message: err.Error(), Path: []interface{}{field.key()}})
+			data = append(data, gqlEntry{field.key(), nil})
+			continue
+		}
+		data = append(data, gqlEntry{field.key(), gqlProject(value, field)})
+	}
+
+	resp.Data = data
+	return resp
+}
+
+// Ordered JSON object, since GraphQL responses follow selection order
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, entry := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(entry.key)
+		value, err := json.Marshal(entry.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Prune a resolved value down to the field's selection set, which
+// validateGQLSelection has already checked
+func gqlProject(value interface{}, field *gqlField) interface{} {
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			out = append(out, gqlProject(item, field))
+		}
+		return out
+	case map[string]interface{}:
+		out := make(gqlObject, 0, len(field.selections))
+		for _, sub := range field.selections {
+			out = append(out, gqlEntry{sub.key(), gqlProject(v[sub.name], sub)})
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// Argument helpers. Missing and null arguments both read as absent.
+
+func gqlStringArg(args map[string]interface{}, name string, required bool) (string, bool, error) {
+	raw, ok := args[name]
+	if !ok || raw == nil {
+		if required {
+			return "", false, fmt.Errorf("Argument %q is required", name)
+		}
+		return "", false, nil
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return "", false, fmt.Errorf("Argument %q must be a String", name)
+	}
+	return s, true, nil
+}
+
+func gqlBoolArg(args map[string]interface{}, name string) (bool, bool, error) {
+	raw, ok := args[name]
+	if !ok || raw == nil {
+		return false, false, nil
+	}
+	b, ok := raw.(bool)
+	if !ok {
+		return false, false, fmt.Errorf("Argument %q must be a Boolean", name)
+	}
+	return b, true, nil
+}
+
+// Resolvers
+
+func gqlClientObject(client Client) map[string]interface{} {
+	return map[string]interface{}{
+		"name":   client.Name,
+		"ipv4":   client.IPV4,
+		"ipv6":   client.IPV6,
+		"config": client.Config,
+	}
+}
+
+func gqlClients(args map[string]interface{}) (interface{}, error) {
+	name, filtered, err := gqlStringArg(args, "name", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Same self-healing sync as the REST list handler
+	if err := syncDeletedClientsWithConfig(); err != nil {
+		log.Printf("Error syncing deleted clients: %v", err)
+	}
+
+	clients, err := listWireGuardClients()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []map[string]interface{}{}
+	for _, client := range clients {
+		if filtered && client.Name != name {
+			continue
+		}
+		out = append(out, gqlClientObject(client))
+	}
+	return out, nil
+}
+
+func gqlClient(args map[string]interface{}) (interface{}, error) {
+	if _, _, err := gqlStringArg(args, "name", true); err != nil {
+		return nil, err
+	}
+	clients, err := gqlClients(args)
+	if err != nil {
+		return nil, err
+	}
+	if list := clients.([]map[string]interface{}); len(list) > 0 {
+		return list[0], nil
+	}
+	return nil, nil
+}
+
+func gqlPeers(args map[string]interface{}) (interface{}, error) {
+	online, filterOnline, err := gqlBoolArg(args, "online")
+	if err != nil {
+		return nil, err
+	}
+	clientName, filterClient, err := gqlStringArg(args, "client", false)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []map[string]interface{}{}
+	success, output := wireGuardDump()
+	if success != "success" {
+		return out, nil // interface down, no peers
+	}
+
+	names := clientNamesByPublicKey()
+	now := time.Now()
+	for _, peer := range parseWGDump(output) {
+		if filterOnline && peer.online(now) != online {
+			continue
+		}
+		if filterClient && names[peer.PublicKey] != clientName {
+			continue
+		}
+
+		out = append(out, map[string]interface{}{
+			"publicKey":       peer.PublicKey,
+			"clientName":      names[peer.PublicKey],
+			"endpoint":        peer.Endpoint,
+			"allowedIps":      peer.AllowedIPs,
+			"latestHandshake": peer.LatestHandshake,
+			"transferRx":      peer.TransferRx,
+			"transferTx":      peer.TransferTx,
+			"online":          peer.online(now),
+		})
+	}
+	return out, nil
+}
+
+func gqlStats(args map[string]interface{}) (interface{}, error) {
+	stats, err := collectSummaryStats()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"totalClients":  stats.TotalClients,
+		"onlineClients": stats.OnlineClients,
+		"transferRx":    stats.TransferRx,
+		"transferTx":    stats.TransferTx,
+		"ipPoolUsed":    stats.UsedIPv4,
+		"ipPoolSize":    ipv4PoolSize,
+	}, nil
+}
+
+func gqlAddClient(args map[string]interface{}) (interface{}, error) {
+	name, _, err := gqlStringArg(args, "name", true)
+	if err != nil {
+		return nil, err
+	}
+	ipv4, _, err := gqlStringArg(args, "ipv4", false)
+	if err != nil {
+		return nil, err
+	}
+	ipv6, _, err := gqlStringArg(args, "ipv6", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if !validClientName(name) {
+		return nil, fmt.Errorf("Client name %s", clientNameMessage())
+	}
+	if err := validateClientAddresses(ipv4, ipv6).err(); err != nil {
+		return nil, err
+	}
+
+	// Mutations only come with API_TOKEN
+	if err := reserveCreatesFor(apiTokenCallerKey, 1); err != nil {
+		return nil, err
+	}
+	config, ipv4, ipv6, err := addWireGuardClient(name, ipv4, ipv6)
+	if err != nil {
+		releaseCreatesFor(apiTokenCallerKey, 1)
+	}
+	if errors.Is(err, errClientExists) {
+		return nil, errors.New(clientExistsMessage)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return gqlClientObject(Client{Name: name, IPV4: ipv4, IPV6: ipv6, Config: config}), nil
+}
+
+func gqlDeleteClient(args map[string]interface{}) (interface{}, error) {
+	if confirmationRequired() {
+		return nil, errConfirmViaREST
+	}
+	name, _, err := gqlStringArg(args, "name", true)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := clientExists(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("Client not found")
+	}
+
+	if err := deleteWireGuardClient(name); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// Parser
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlString
+	gqlNumber
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+}
+
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(src); {
+		ch := src[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',':
+			i++
+		case ch == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{gqlPunct, "..."})
+			i += 3
+		case strings.IndexByte("!$()[]{}:=@|&", ch) >= 0:
+			tokens = append(tokens, gqlToken{gqlPunct, string(ch)})
+			i++
+		case ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, gqlToken{gqlName, src[start:i]})
+		case ch == '-' || ch >= '0' && ch <= '9':
+			start := i
+			i++
+			for i < len(src) && strings.IndexByte("0123456789.eE+-", src[i]) >= 0 {
+				i++
+			}
+			tokens = append(tokens, gqlToken{gqlNumber, src[start:i]})
+		case ch == '"':
+			if strings.HasPrefix(src[i:], `"""`) {
+				return nil, errors.New("Syntax error: block strings are not supported")
+			}
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				if end < len(src) && src[end] == '\n' {
+					break
+				}
+				end++
+			}
+			if end >= len(src) || src[end] != '"' {
+				return nil, errors.New("Syntax error: unterminated string")
+			}
+			// GraphQL string escapes are a subset of Go's, bar \/
+			value, err := strconv.Unquote(strings.ReplaceAll(src[i:end+1], `\/`, "/"))
+			if err != nil {
+				return nil, fmt.Errorf("Syntax error: invalid string %s", src[i:end+1])
+			}
+			tokens = append(tokens, gqlToken{gqlString, value})
+			i = end + 1
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("Syntax error: unexpected character %q", r)
+		}
+	}
+	return append(tokens, gqlToken{kind: gqlEOF}), nil
+}
+
+type gqlParser struct {
+	tokens    []gqlToken
+	pos       int
+	variables map[string]interface{}
+}
+
+func (p *gqlParser) peek() gqlToken { return p.tokens[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != gqlEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *gqlParser) isPunct(value string) bool {
+	tok := p.peek()
+	return tok.kind == gqlPunct && tok.value == value
+}
+
+func (p *gqlParser) expectPunct(value string) error {
+	if tok := p.next(); tok.kind != gqlPunct || tok.value != value {
+		return fmt.Errorf("Syntax error: expected %q, found %s", value, describeGQLToken(tok))
+	}
+	return nil
+}
+
+func (p *gqlParser) expectName() (string, error) {
+	tok := p.next()
+	if tok.kind != gqlName {
+		return "", fmt.Errorf("Syntax error: expected a name, found %s", describeGQLToken(tok))
+	}
+	return tok.value, nil
+}
+
+func describeGQLToken(tok gqlToken) string {
+	if tok.kind == gqlEOF {
+		return "end of query"
+	}
+	return strconv.Quote(tok.value)
+}
+
+// Parse the document and return the operation to run. With several
+// operations in the document operationName picks one, as the spec requires.
+func parseGraphQL(query, operationName string, variables map[string]interface{}) (*gqlOperation, error) {
+	tokens, err := lexGraphQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	type namedOp struct {
+		name  string
+		start int
+	}
+	// First pass: find operation boundaries, so variables are only bound
+	// for the operation that actually runs
+	p := &gqlParser{tokens: tokens}
+	var ops []namedOp
+	for p.peek().kind != gqlEOF {
+		start := p.pos
+		name := ""
+		if tok := p.peek(); tok.kind == gqlName {
+			switch tok.value {
+			case "query", "mutation":
+				p.next()
+				if p.peek().kind == gqlName {
+					name = p.next().value
+				}
+			case "subscription":
+				return nil, errors.New("Subscriptions are not supported")
+			case "fragment":
+				return nil, errors.New("Fragments are not supported")
+			default:
+				return nil, fmt.Errorf("Syntax error: unexpected %s", describeGQLToken(tok))
+			}
+		}
+		if err := p.skipUntilSelectionSetEnd(); err != nil {
+			return nil, err
+		}
+		ops = append(ops, namedOp{name, start})
+	}
+
+	var chosen *namedOp
+	for i := range ops {
+		if operationName == "" || ops[i].name == operationName {
+			if chosen != nil {
+				return nil, errors.New("Must provide operationName when the query contains multiple operations")
+			}
+			chosen = &ops[i]
+		}
+	}
+	if chosen == nil {
+		return nil, fmt.Errorf("Unknown operation named %q", operationName)
+	}
+
+	p = &gqlParser{tokens: tokens, pos: chosen.start, variables: map[string]interface{}{}}
+	return p.parseOperation(variables)
+}
+
+// Skip an operation header and its balanced top-level selection set
+func (p *gqlParser) skipUntilSelectionSetEnd() error {
+	for !p.isPunct("{") {
+		if p.peek().kind == gqlEOF {
+			return errors.New("Syntax error: expected a selection set")
+		}
+		p.next()
+	}
+	depth := 0
+	for {
+		tok := p.next()
+		switch {
+		case tok.kind == gqlEOF:
+			return errors.New("Syntax error: unbalanced braces")
+		case tok.kind == gqlPunct && tok.value == "{":
+			depth++
+		case tok.kind == gqlPunct && tok.value == "}":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *gqlParser) parseOperation(variables map[string]interface{}) (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query"}
+
+	if tok := p.peek(); tok.kind == gqlName {
+		op.kind = p.next().value
+		if p.peek().kind == gqlName {
+			p.next() // operation name
+		}
+		if p.isPunct("(") {
+			if err := p.parseVariableDefinitions(variables); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.isPunct("@") {
+		return nil, errors.New("Directives are not supported")
+	}
+
+	selections, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+// Bind ($name: Type = default, ...) against the request's variables
+func (p *gqlParser) parseVariableDefinitions(provided map[string]interface{}) error {
+	p.next() // (
+	for !p.isPunct(")") {
+		if err := p.expectPunct("$"); err != nil {
+			return err
+		}
+		name, err := p.expectName()
+		if err != nil {
+			return err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return err
+		}
+		nonNull, err := p.parseType()
+		if err != nil {
+			return err
+		}
+
+		var value interface{}
+		if p.isPunct("=") {
+			p.next()
+			if value, err = p.parseValue(true); err != nil {
+				return err
+			}
+		}
+		if v, ok := provided[name]; ok {
+			value = v
+		}
+		if value == nil && nonNull {
+			return fmt.Errorf("Variable \"$%s\" of non-null type must be provided", name)
+		}
+		p.variables[name] = value
+	}
+	p.next() // )
+	return nil
+}
+
+// Parse a type reference and report whether it is non-null. Types are not
+// checked beyond that; resolvers validate their own arguments.
+func (p *gqlParser) parseType() (bool, error) {
+	if p.isPunct("[") {
+		p.next()
+		if _, err := p.parseType(); err != nil {
+			return false, err
+		}
+		if err := p.expectPunct("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.expectName(); err != nil {
+		return false, err
+	}
+
+	if p.isPunct("!") {
+		p.next()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *gqlParser) parseSelectionSet() ([]*gqlField, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+
+	var fields []*gqlField
+	for !p.isPunct("}") {
+		if p.isPunct("...") {
+			return nil, errors.New("Fragments are not supported")
+		}
+
+		field := &gqlField{}
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if p.isPunct(":") {
+			p.next()
+			field.alias = name
+			if name, err = p.expectName(); err != nil {
+				return nil, err
+			}
+		}
+		field.name = name
+
+		if p.isPunct("(") {
+			if field.args, err = p.parseArguments(); err != nil {
+				return nil, err
+			}
+		}
+		if p.isPunct("@") {
+			return nil, errors.New("Directives are not supported")
+		}
+		if p.isPunct("{") {
+			if field.selections, err = p.parseSelectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, field)
+	}
+	p.next() // }
+
+	if len(fields) == 0 {
+		return nil, errors.New("Syntax error: empty selection set")
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) parseArguments() (map[string]interface{}, error) {
+	p.next() // (
+	args := map[string]interface{}{}
+	for !p.isPunct(")") {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.parseValue(false); err != nil {
+			return nil, err
+		}
+	}
+	p.next() // )
+	return args, nil
+}
+
+// Parse a literal or variable into the same types encoding/json produces
+func (p *gqlParser) parseValue(constant bool) (interface{}, error) {
+	tok := p.next()
+	switch tok.kind {
+	case gqlString:
+		return tok.value, nil
+	case gqlNumber:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Syntax error: invalid number %s", tok.value)
+		}
+		return f, nil
+	case gqlName:
+		switch tok.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return tok.value, nil // enum value
+	case gqlPunct:
+		switch tok.value {
+		case "$":
+			if constant {
+				return nil, errors.New("Syntax error: variables are not allowed here")
+			}
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			value, ok := p.variables[name]
+			if !ok {
+				return nil, fmt.Errorf("Variable \"$%s\" is not defined", name)
+			}
+			return value, nil
+		case "[":
+			list := []interface{}{}
+			for !p.isPunct("]") {
+				item, err := p.parseValue(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			p.next()
+			return list, nil
+		case "{":
+			obj := map[string]interface{}{}
+			for !p.isPunct("}") {
+				name, err := p.expectName()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expectPunct(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.parseValue(constant); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+			return obj, nil
+		}
+	}
+	return nil, fmt.Errorf("Syntax error: unexpected %s", describeGQLToken(tok))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type graphQLTestResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []graphQLError             `json:"errors"`
+}
+
+func (e *testEnv) graphQL(t *testing.T, query string, variables map[string]interface{}) graphQLTestResponse {
+	t.Helper()
+
+	recorder := e.authedRequest(t, http.MethodPost, "/api/graphql", graphQLRequest{Query: query, Variables: variables})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+
+	var resp graphQLTestResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return resp
+}
+
+func TestGraphQLAddClientAndSelectFields(t *testing.T) {
+	env := setupTestEnv(t)
+
+	resp := env.graphQL(t, `mutation Add($name: String!) { created: addClient(name: $name) { name ipv4 } }`,
+		map[string]interface{}{"name": "alice"})
+	if len(resp.Errors) > 0 {
+		t.Fatalf("unexpected errors %+v", resp.Errors)
+	}
+	if got := string(resp.Data["created"]); got != `{"name":"alice","ipv4":"10.66.0.2"}` {
+		t.Errorf("mutation must return only the selected fields in order, got %s", got)
+	}
+
+	resp = env.graphQL(t, `{ clients { name } }`, nil)
+	if got := string(resp.Data["clients"]); got != `[{"name":"alice"}]` {
+		t.Errorf("config must not be returned unless selected, got %s", got)
+	}
+
+	resp = env.graphQL(t, `mutation { deleteClient(name: "alice") }`, nil)
+	if got := string(resp.Data["deleteClient"]); got != "true" {
+		t.Errorf("deleteClient returned %s, errors %+v", got, resp.Errors)
+	}
+}
+
+func TestGraphQLPeerFilters(t *testing.T) {
+	env := setupTestEnv(t)
+
+	for _, name := range []string{"alice", "bob"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("seeding %s failed with status %d", name, code)
+		}
+	}
+
+	now := time.Now().Unix()
+	env.writeDump(t,
+		fmt.Sprintf("%s\tpsk\t198.51.100.1:4000\t10.66.0.2/32\t%d\t10\t20\t25", findPublicKeyByClientName("alice"), now-30),
+		fmt.Sprintf("%s\tpsk\t198.51.100.2:4000\t10.66.0.3/32\t%d\t30\t40\t25", findPublicKeyByClientName("bob"), now-3600),
+	)
+
+	resp := env.graphQL(t, `{ online: peers(online: true) { clientName } offline: peers(online: false) { clientName online } }`, nil)
+	if got := string(resp.Data["online"]); got != `[{"clientName":"alice"}]` {
+		t.Errorf("online peers: got %s", got)
+	}
+	if got := string(resp.Data["offline"]); got != `[{"clientName":"bob","online":false}]` {
+		t.Errorf("offline peers: got %s", got)
+	}
+
+	resp = env.graphQL(t, `{ peers(client: "bob") { transferRx } stats { totalClients onlineClients } }`, nil)
+	if got := string(resp.Data["peers"]); got != `[{"transferRx":30}]` {
+		t.Errorf("client filter: got %s", got)
+	}
+	if got := string(resp.Data["stats"]); got != `{"totalClients":2,"onlineClients":1}` {
+		t.Errorf("stats: got %s", got)
+	}
+}
+
+func TestGraphQLErrors(t *testing.T) {
+	env := setupTestEnv(t)
+
+	cases := map[string]string{
+		`{ clients { secret } }`:                   `Cannot query field "secret"`,
+		`{ stats }`:                                "must have a selection",
+		`{ nope }`:                                 `Cannot query field "nope" on type "Query"`,
+		`mutation { addClient { name } }`:          `Argument "name" is required`,
+		`{ clients { ...Fields } }`:                "Fragments are not supported",
+		`{ clients(name: $missing) { name } }`:     "is not defined",
+		`query ($n: String!) { client(name: $n) }`: "must be provided",
+		`{ clients { name }`:                       "Syntax error",
+	}
+	for query, want := range cases {
+		resp := env.graphQL(t, query, nil)
+		if len(resp.Errors) == 0 || !strings.Contains(resp.Errors[0].Message, want) {
+			t.Errorf("%s: expected error containing %q, got %+v", query, want, resp.Errors)
+		}
+	}
+}
+
+func TestGraphQLOperationName(t *testing.T) {
+	_, err := parseGraphQL(`query A { stats { totalClients } } query B { clients { name } }`, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "operationName") {
+		t.Errorf("ambiguous document must require operationName, got %v", err)
+	}
+
+	op, err := parseGraphQL(`query A { stats { totalClients } } query B { clients { name } }`, "B", nil)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(op.selections) != 1 || op.selections[0].name != "clients" {
+		t.Errorf("operation B not selected: %+v", op.selections[0])
+	}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Groups carry defaults for the configs of their members: DNS, AllowedIPs
+// and keepalive, plus a transfer quota and an expiration policy. Clients
+// created in a group inherit them; existing configs only change when the
+// group is applied, which re-renders those lines of every member's config
+// and keeps its keys and addresses. A client is in at most one group.
+//
+// Quotas and expirations are enforced by a poller that disables members
+// over their quota or past their expiry. It does so once: a member an
+// admin enables again stays enabled until the group is applied. Usage is
+// summed across interface restarts, which reset the wg counters.
+
+// Defaults a group's members inherit
+type GroupDefaults struct {
+	// Overrides the server's DNS settings, like a client's dns
+	DNS *ClientDNS `json:"dns,omitempty"`
+	// Comma-separated; the server's AllowedIPs when empty
+	AllowedIPs string `json:"allowed_ips,omitempty"`
+	// PersistentKeepalive in seconds, 0 leaves it out; 25 when nil
+	Keepalive *int `json:"keepalive,omitempty"`
+	// Transfer (rx+tx) a member may use before it is disabled, 0 = no quota
+	QuotaBytes int64 `json:"quota_bytes,omitempty"`
+	// Members are disabled this long after joining, e.g. "720h"; never when empty
+	ExpiresAfter string `json:"expires_after,omitempty"`
+}
+
+type ClientGroup struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	GroupDefaults
+	Members   map[string]*GroupMember `json:"members"`
+	CreatedAt time.Time               `json:"created_at"`
+}
+
+type GroupMember struct {
+	JoinedAt  time.Time  `json:"joined_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Transfer counted against the quota
+	UsedBytes int64 `json:"used_bytes"`
+	// Why the poller disabled the member: "quota" or "expired"
+	Enforced string `json:"enforced,omitempty"`
+	// rx+tx counter at the previous poll
+	LastCounter int64 `json:"last_counter"`
+}
+
+type GroupRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+	GroupDefaults
+}
+
+var (
+	groupsMutex      sync.Mutex
+	errGroupNotFound = errors.New("Group not found")
+	errGroupExists   = errors.New("A group with this name already exists")
+
+	clientDNSLineRegex   = regexp.MustCompile(`(?m)^(DNS = |PostUp = resolvectl ).*\n`)
+	clientAddressRegex   = regexp.MustCompile(`(?m)^Address = .*\n`)
+	clientAllowedIPRegex = regexp.MustCompile(`(?m)^AllowedIPs = .*\n`)
+	clientKeepaliveRegex = regexp.MustCompile(`(?m)^PersistentKeepalive = .*\n`)
+	killSwitchLineRegex  = regexp.MustCompile(`(?m)^(PostUp|PreDown) = .*(fwmark\)|killswitch_).*\n`)
+)
+
+// GROUPS_FILE, or groups.json next to the server config
+func groupsFile() string {
+	if GROUPS_FILE != "" {
+		return GROUPS_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "groups.json")
+}
+
+// Caller holds groupsMutex
+func loadGroupsLocked() (map[string]*ClientGroup, error) {
+	groups := make(map[string]*ClientGroup)
+	content, err := os.ReadFile(groupsFile())
+	if os.IsNotExist(err) {
+		return groups, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups file: %v", err)
+	}
+	if err := json.Unmarshal(content, &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse groups file: %v", err)
+	}
+	return groups, nil
+}
+
+// Caller holds groupsMutex
+func saveGroupsLocked(groups map[string]*ClientGroup) error {
+	content, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(groupsFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write groups file: %v", err)
+	}
+	return nil
+}
+
+// Run fn on the loaded groups and save them if it succeeds
+func updateGroups(fn func(groups map[string]*ClientGroup) error) error {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+
+	groups, err := loadGroupsLocked()
+	if err != nil {
+		return err
+	}
+	if err := fn(groups); err != nil {
+		return err
+	}
+	return saveGroupsLocked(groups)
+}
+
+func getGroup(name string) (*ClientGroup, error) {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+
+	groups, err := loadGroupsLocked()
+	if err != nil {
+		return nil, err
+	}
+	if groups[name] == nil {
+		return nil, errGroupNotFound
+	}
+	return groups[name], nil
+}
+
+func (d GroupDefaults) validate() error {
+	var errs fieldErrors
+	if d.DNS != nil {
+		errs = d.DNS.fieldErrors("dns")
+	}
+	if d.AllowedIPs != "" {
+		errs = append(errs, validateAllowedIPs("allowed_ips", d.AllowedIPs)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if d.Keepalive != nil && (*d.Keepalive < 0 || *d.Keepalive > 65535) {
+		return fmt.Errorf("keepalive must be between 0 and 65535 seconds")
+	}
+	if d.QuotaBytes < 0 {
+		return fmt.Errorf("quota_bytes must not be negative")
+	}
+	if d.ExpiresAfter != "" {
+		if after, err := time.ParseDuration(d.ExpiresAfter); err != nil || after <= 0 {
+			return fmt.Errorf("expires_after must be a positive duration such as 720h")
+		}
+	}
+	return nil
+}
+
+// AllowedIPs of the group's configs; the server's for the nil group
+func (g *ClientGroup) allowedIPs() string {
+	if g == nil || g.AllowedIPs == "" {
+		return wgParams.AllowedIPs
+	}
+	return g.AllowedIPs
+}
+
+// When a member joining at joined expires; nil when the group has no
+// expiration policy
+func (g *ClientGroup) expiresAt(joined time.Time) *time.Time {
+	after, err := time.ParseDuration(g.ExpiresAfter)
+	if g.ExpiresAfter == "" || err != nil {
+		return nil
+	}
+	expires := joined.Add(after)
+	return &expires
+}
+
+// Why a member must be disabled, "" when it may stay enabled
+func (g *ClientGroup) violation(member *GroupMember, now time.Time) string {
+	if g.QuotaBytes > 0 && member.UsedBytes >= g.QuotaBytes {
+		return "quota"
+	}
+	if member.ExpiresAt != nil && now.After(*member.ExpiresAt) {
+		return "expired"
+	}
+	return ""
+}
+
+// A client config with the group's AllowedIPs and keepalive, and its DNS
+// settings when withDNS is set. Kill switch lines are dropped when the
+// AllowedIPs are no longer full-tunnel, as they would block all traffic.
+func (g *ClientGroup) renderInto(config string, withDNS bool) string {
+	allowedIPs := g.allowedIPs()
+	config = clientAllowedIPRegex.ReplaceAllLiteralString(config, "AllowedIPs = "+allowedIPs+"\n")
+	if !fullTunnel(allowedIPs) {
+		config = killSwitchLineRegex.ReplaceAllLiteralString(config, "")
+	}
+
+	keepalive := 25
+	if g.Keepalive != nil {
+		keepalive = *g.Keepalive
+	}
+	config = clientKeepaliveRegex.ReplaceAllLiteralString(config, "")
+	if keepalive > 0 {
+		if loc := clientAllowedIPRegex.FindStringIndex(config); loc != nil {
+			config = config[:loc[1]] + fmt.Sprintf("PersistentKeepalive = %d\n", keepalive) + config[loc[1]:]
+		}
+	}
+
+	if withDNS {
+		config = clientDNSLineRegex.ReplaceAllLiteralString(config, "")
+		lines := ""
+		for _, line := range renderClientDNS(clientDNSFor(wgParams, g.DNS)) {
+			lines += line + "\n"
+		}
+		if loc := clientAddressRegex.FindStringIndex(config); loc != nil {
+			config = config[:loc[1]] + lines + config[loc[1]:]
+		}
+	}
+	return config
+}
+
+// Render a group's defaults into a member's config file. Returns the new
+// config and whether it changed; "" when the client has no config file.
+// Caller holds wgConfigMutex.
+func renderGroupMemberLocked(group *ClientGroup, name string, withDNS bool) (string, bool, error) {
+	path := clientConfigFile(name)
+	if path == "" {
+		return "", false, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read client config: %v", err)
+	}
+	config := group.renderInto(string(content), withDNS)
+	if config == string(content) {
+		return config, false, nil
+	}
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		return "", false, fmt.Errorf("failed to write client config: %v", err)
+	}
+	return config, true, nil
+}
+
+// Make clients members of a group, leaving any other group. Caller holds
+// groupsMutex.
+func joinGroupLocked(groups map[string]*ClientGroup, group *ClientGroup, names []string, now time.Time) {
+	for _, name := range names {
+		for _, other := range groups {
+			if other != group {
+				delete(other.Members, name)
+			}
+		}
+		if group.Members[name] == nil {
+			group.Members[name] = &GroupMember{JoinedAt: now.UTC(), ExpiresAt: group.expiresAt(now.UTC())}
+		}
+	}
+}
+
+// Put a newly created client in a group, with the group's AllowedIPs and
+// keepalive in its config; its DNS was set when creating it. Returns the
+// rendered config.
+func joinNewClientToGroup(groupName, name string) (string, error) {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	var config string
+	err := updateGroups(func(groups map[string]*ClientGroup) error {
+		group := groups[groupName]
+		if group == nil {
+			return errGroupNotFound
+		}
+		var err error
+		if config, _, err = renderGroupMemberLocked(group, name, false); err != nil {
+			return err
+		}
+		joinGroupLocked(groups, group, []string{name}, time.Now())
+		return nil
+	})
+	return config, err
+}
+
+// Drop a deleted client from its group so a new client with the same name
+// doesn't inherit its usage and expiry
+func removeGroupMember(name string) error {
+	groupsMutex.Lock()
+	defer groupsMutex.Unlock()
+
+	groups, err := loadGroupsLocked()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, group := range groups {
+		if group.Members[name] != nil {
+			delete(group.Members, name)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return saveGroupsLocked(groups)
+}
+
+// Start enforcing quotas and expirations every GROUP_POLICY_INTERVAL, or on
+// the job's schedule. Without either, enforcement is off.
+func startGroupEnforcer() {
+	scheduleJob(jobGroupPolicies, GROUP_POLICY_INTERVAL, true, func() error {
+		success, output := wireGuardDump()
+		if success != "success" {
+			return fmt.Errorf("failed to read peers: %s", output)
+		}
+		err := enforceGroupPolicies(parseWGDump(output), time.Now())
+		if err != nil {
+			log.Printf("Group policies: %v", err)
+		}
+		return err
+	})
+}
+
+// Count the members' transfer in one dump and disable those over their
+// quota or past their expiry
+func enforceGroupPolicies(peers []peerDump, now time.Time) error {
+	counters := make(map[string]int64, len(peers))
+	for _, peer := range peers {
+		counters[peer.PublicKey] = peer.TransferRx + peer.TransferTx
+	}
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	disabled := []string{}
+	err := updateGroups(func(groups map[string]*ClientGroup) error {
+		for _, group := range groups {
+			for _, name := range group.memberNames() {
+				member := group.Members[name]
+				if counter, ok := counters[findPublicKeyByClientName(name)]; ok {
+					// A counter below the last one means the interface restarted
+					if counter >= member.LastCounter {
+						member.UsedBytes += counter - member.LastCounter
+					} else {
+						member.UsedBytes += counter
+					}
+					member.LastCounter = counter
+				}
+
+				reason := group.violation(member, now)
+				if reason == "" || member.Enforced != "" {
+					continue
+				}
+				changed, err := setClientEnabledLocked(name, false)
+				if errors.Is(err, errClientNotFound) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				member.Enforced = reason
+				if changed {
+					log.Printf("Group %s: disabled %s (%s)", group.Name, name, reason)
+					disabled = append(disabled, name)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil || len(disabled) == 0 {
+		return err
+	}
+	return syncWireGuardConf()
+}
+
+// Sorted names of the group's members
+func (g *ClientGroup) memberNames() []string {
+	names := make([]string, 0, len(g.Members))
+	for name := range g.Members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Respond to a getGroup/updateGroups error
+func respondGroupError(c *gin.Context, err error) {
+	if errors.Is(err, errGroupNotFound) {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    errorCode(err),
+	})
+}
+
+// Handler listing groups with their members
+func listGroupsHandlerGin(c *gin.Context) {
+	groupsMutex.Lock()
+	groups, err := loadGroupsLocked()
+	groupsMutex.Unlock()
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	list := make([]*ClientGroup, 0, len(groups))
+	for _, group := range groups {
+		list = append(list, group)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+func addGroupHandlerGin(c *gin.Context) {
+	var req GroupRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !clientNameRegex.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Group name " + invalidClientNameMessage,
+		})
+		return
+	}
+	if err := req.GroupDefaults.validate(); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	group := &ClientGroup{
+		Name:          req.Name,
+		Description:   req.Description,
+		GroupDefaults: req.GroupDefaults,
+		Members:       map[string]*GroupMember{},
+		CreatedAt:     time.Now().UTC(),
+	}
+	err := updateGroups(func(groups map[string]*ClientGroup) error {
+		if groups[req.Name] != nil {
+			return errGroupExists
+		}
+		groups[req.Name] = group
+		return nil
+	})
+	if errors.Is(err, errGroupExists) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	respondCreated(c, "/groups/"+url.PathEscape(req.Name), "Group added successfully", group)
+}
+
+// Remove the group only; its members and their configs stay
+func deleteGroupHandlerGin(c *gin.Context) {
+	var req ProjectRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	err := updateGroups(func(groups map[string]*ClientGroup) error {
+		if groups[req.Name] == nil {
+			return errGroupNotFound
+		}
+		delete(groups, req.Name)
+		return nil
+	})
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	respondDeleted(c, "Group deleted successfully")
+}
+
+func groupHandlerGin(c *gin.Context) {
+	group, err := getGroup(c.Param("group"))
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    group,
+	})
+}
+
+// Handler replacing a group's defaults. Member configs keep the old ones
+// until the group is applied; new members get the new ones right away.
+func setGroupDefaultsHandlerGin(c *gin.Context) {
+	var req GroupDefaults
+	if !bindJSON(c, &req) {
+		return
+	}
+	if err := req.validate(); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	var group *ClientGroup
+	err := updateGroups(func(groups map[string]*ClientGroup) error {
+		if group = groups[c.Param("group")]; group == nil {
+			return errGroupNotFound
+		}
+		group.GroupDefaults = req
+		return nil
+	})
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Group defaults updated; apply the group to re-render member configs",
+		Data:    group,
+	})
+}
+
+// Handler adding existing clients to a group. Their configs change when
+// the group is applied; expiry counts from now.
+func addGroupClientsHandlerGin(c *gin.Context) {
+	var req ProjectClientsRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	clients, err := listWireGuardClients()
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+	existing := make(map[string]bool, len(clients))
+	for _, client := range clients {
+		existing[client.Name] = true
+	}
+	for _, name := range req.Names {
+		if !existing[name] {
+			c.JSON(http.StatusNotFound, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Client %s not found", name),
+				Code:    codeClientNotFound,
+			})
+			return
+		}
+	}
+
+	err = updateGroups(func(groups map[string]*ClientGroup) error {
+		group := groups[c.Param("group")]
+		if group == nil {
+			return errGroupNotFound
+		}
+		joinGroupLocked(groups, group, req.Names, time.Now())
+		return nil
+	})
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Added %d clients", len(req.Names)),
+	})
+}
+
+// Handler removing clients from a group; their configs stay as they are
+func removeGroupClientsHandlerGin(c *gin.Context) {
+	var req ProjectClientsRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	err := updateGroups(func(groups map[string]*ClientGroup) error {
+		group := groups[c.Param("group")]
+		if group == nil {
+			return errGroupNotFound
+		}
+		for _, name := range req.Names {
+			delete(group.Members, name)
+		}
+		return nil
+	})
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Removed %d clients", len(req.Names)),
+	})
+}
+
+// Handler applying a group to its members: their configs get the group's
+// DNS, AllowedIPs and keepalive, expiries are recomputed from when they
+// joined, and members the poller disabled that no longer violate the
+// policy are enabled again
+func applyGroupHandlerGin(c *gin.Context) {
+	rendered, enabled := []string{}, []string{}
+	err := func() error {
+		wgConfigMutex.Lock()
+		defer wgConfigMutex.Unlock()
+
+		err := updateGroups(func(groups map[string]*ClientGroup) error {
+			group := groups[c.Param("group")]
+			if group == nil {
+				return errGroupNotFound
+			}
+			now := time.Now()
+			names := group.memberNames()
+			for i, name := range names {
+				reportJobProgress(c, i, len(names))
+				member := group.Members[name]
+				_, changed, err := renderGroupMemberLocked(group, name, true)
+				if err != nil {
+					return err
+				}
+				if changed {
+					rendered = append(rendered, name)
+				}
+
+				member.ExpiresAt = group.expiresAt(member.JoinedAt)
+				if member.Enforced == "" || group.violation(member, now) != "" {
+					continue
+				}
+				member.Enforced = ""
+				ok, err := setClientEnabledLocked(name, true)
+				if err != nil && !errors.Is(err, errClientNotFound) {
+					return err
+				}
+				if ok {
+					enabled = append(enabled, name)
+				}
+			}
+			reportJobProgress(c, len(names), len(names))
+			return nil
+		})
+		if err != nil || len(enabled) == 0 {
+			return err
+		}
+		return syncWireGuardConf()
+	}()
+	if err != nil {
+		respondGroupError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Re-rendered %d client configs", len(rendered)),
+		Data:    map[string]interface{}{"rendered": rendered, "enabled": enabled},
+	})
+}
+
+// The group a client is created in, answering 400/404 itself when the
+// request names one that can't be used. Returns false when the handler
+// should stop.
+func groupForNewClient(c *gin.Context, name, killSwitch string) (*ClientGroup, bool) {
+	if name == "" {
+		return nil, true
+	}
+	group, err := getGroup(name)
+	if err != nil {
+		respondGroupError(c, err)
+		return nil, false
+	}
+	if killSwitch != "" && killSwitch != killSwitchOff && !fullTunnel(group.allowedIPs()) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("A kill switch needs clients to route 0.0.0.0/0 or ::/0 through the tunnel, which group %s doesn't", group.Name),
+		})
+		return nil, false
+	}
+	return group, true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupDefaults(t *testing.T) {
+	env := setupTestEnv(t)
+	keepalive := 0
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/groups/add", GroupRequest{
+		Name: "contractors",
+		GroupDefaults: GroupDefaults{
+			DNS:        &ClientDNS{Servers: []string{"10.0.0.53"}},
+			AllowedIPs: "10.0.0.0/8",
+			Keepalive:  &keepalive,
+		},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("adding group: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A client created in the group inherits its defaults
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice", Group: "contractors"})
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	config := resp.Data.Config
+	if rec.Code != http.StatusOK || !strings.Contains(config, "DNS = 10.0.0.53\n") || !strings.Contains(config, "AllowedIPs = 10.0.0.0/8\n") || strings.Contains(config, "PersistentKeepalive") {
+		t.Fatalf("alice must inherit the defaults: got status %d:\n%s", rec.Code, config)
+	}
+	if file := readFile(t, filepath.Join(env.clientsDir, "wg0-client-alice.conf")); file != config {
+		t.Errorf("the config file must match the response:\n%s", file)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob", Group: "contractors", KillSwitch: killSwitchNft}).Code; code != http.StatusBadRequest {
+		t.Errorf("kill switch in a split-tunnel group: got status %d, want 400", code)
+	}
+
+	// Existing clients only change when the group is applied
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/groups/contractors/clients/add", ProjectClientsRequest{Names: []string{"bob"}})
+	keepalive = 15
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/groups/contractors/defaults", GroupDefaults{AllowedIPs: "10.0.0.0/8,192.168.0.0/16", Keepalive: &keepalive}).Code; code != http.StatusOK {
+		t.Fatalf("updating defaults: got status %d", code)
+	}
+	bob := readFile(t, filepath.Join(env.clientsDir, "wg0-client-bob.conf"))
+	if !strings.Contains(bob, "AllowedIPs = 0.0.0.0/0\n") {
+		t.Fatalf("bob must keep his config until applied:\n%s", bob)
+	}
+
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/groups/contractors/apply", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"rendered":["alice","bob"]`) {
+		t.Fatalf("applying: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, name := range []string{"alice", "bob"} {
+		config := readFile(t, filepath.Join(env.clientsDir, "wg0-client-"+name+".conf"))
+		if !strings.Contains(config, "DNS = 1.1.1.1,1.0.0.1\n") || !strings.Contains(config, "AllowedIPs = 10.0.0.0/8,192.168.0.0/16\nPersistentKeepalive = 15\n") || !strings.Contains(config, "PrivateKey = priv") {
+			t.Errorf("%s must get the new defaults:\n%s", name, config)
+		}
+	}
+}
+
+func TestGroupPolicies(t *testing.T) {
+	env := setupTestEnv(t)
+	env.authedRequest(t, http.MethodPost, "/api/v1/groups/add", GroupRequest{
+		Name:          "trial",
+		GroupDefaults: GroupDefaults{QuotaBytes: 1000, ExpiresAfter: "24h"},
+	})
+	for _, name := range []string{"alice", "bob"} {
+		env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name, Group: "trial"})
+	}
+	alice, bob := findPublicKeyByClientName("alice"), findPublicKeyByClientName("bob")
+
+	// Usage adds up across a counter reset
+	now := time.Now()
+	enforceGroupPolicies([]peerDump{{PublicKey: alice, TransferRx: 400, TransferTx: 200}, {PublicKey: bob, TransferRx: 100}}, now)
+	enforceGroupPolicies([]peerDump{{PublicKey: alice, TransferRx: 300}, {PublicKey: bob, TransferRx: 150}}, now)
+	group, _ := getGroup("trial")
+	if group.Members["alice"].UsedBytes != 900 || group.Members["bob"].UsedBytes != 150 {
+		t.Fatalf("unexpected usage: alice %d, bob %d", group.Members["alice"].UsedBytes, group.Members["bob"].UsedBytes)
+	}
+	if disabled := disabledClientNames([]byte(env.configContent(t))); len(disabled) != 0 {
+		t.Fatalf("nobody is over quota yet: %v", disabled)
+	}
+
+	enforceGroupPolicies([]peerDump{{PublicKey: alice, TransferRx: 400}, {PublicKey: bob, TransferRx: 150}}, now)
+	if disabled := disabledClientNames([]byte(env.configContent(t))); !disabled["alice"] || disabled["bob"] {
+		t.Fatalf("alice must be disabled for her quota: %v", disabled)
+	}
+	enforceGroupPolicies(nil, now.Add(25*time.Hour))
+	group, _ = getGroup("trial")
+	if disabled := disabledClientNames([]byte(env.configContent(t))); !disabled["bob"] || group.Members["bob"].Enforced != "expired" || group.Members["alice"].Enforced != "quota" {
+		t.Errorf("bob must be disabled as expired: %v %+v", disabled, group.Members["bob"])
+	}
+
+	// Lifting the policy and applying enables them again
+	env.authedRequest(t, http.MethodPost, "/api/v1/groups/trial/defaults", GroupDefaults{})
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/groups/trial/apply", nil)
+	if !strings.Contains(rec.Body.String(), `"enabled":["alice","bob"]`) {
+		t.Errorf("applying must enable both: %s", rec.Body.String())
+	}
+	if disabled := disabledClientNames([]byte(env.configContent(t))); len(disabled) != 0 {
+		t.Errorf("nobody must stay disabled: %v", disabled)
+	}
+
+	// A deleted member leaves the group
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	if group, _ := getGroup("trial"); group.Members["alice"] != nil {
+		t.Error("alice must leave the group when deleted")
+	}
+}
+
+func TestGroupValidation(t *testing.T) {
+	env := setupTestEnv(t)
+	keepalive := -1
+	for _, defaults := range []GroupDefaults{
+		{Keepalive: &keepalive},
+		{QuotaBytes: -1},
+		{ExpiresAfter: "30d"},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/groups/add", GroupRequest{Name: "g", GroupDefaults: defaults}).Code; code != http.StatusBadRequest {
+			t.Errorf("defaults %+v: got status %d, want 400", defaults, code)
+		}
+	}
+	// Addresses and networks are answered field by field
+	for _, defaults := range []GroupDefaults{
+		{AllowedIPs: "10.0.0.0"},
+		{AllowedIPs: "10.0.0.1/8"},
+		{DNS: &ClientDNS{Servers: []string{"dns.example.com"}}},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/groups/add", GroupRequest{Name: "g", GroupDefaults: defaults}).Code; code != http.StatusUnprocessableEntity {
+			t.Errorf("defaults %+v: got status %d, want 422", defaults, code)
+		}
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice", Group: "missing"}).Code; code != http.StatusNotFound {
+		t.Errorf("unknown group: got status %d, want 404", code)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// gRPC service described by proto/wireguard.proto, served on GRPC_PORT over
+// cleartext HTTP/2 (h2c). The wire protocol is implemented directly on top
+// of net/http and protowire rather than generated grpc-go stubs: every call
+// is a POST to /wireguard.v1.WireGuard/<Method> whose body and response are
+// length-prefixed protobuf messages, with the outcome in the grpc-status
+// trailer. Terminate TLS in front of it like the REST API.
+
+const grpcServicePrefix = "/wireguard.v1.WireGuard/"
+
+// Largest request message accepted; requests here are tiny
+const maxGRPCMessageSize = 1 << 20
+
+// gRPC status codes used by this service
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// WatchPeerStatus interval when the request doesn't set one
+const grpcDefaultWatchSecs = 10
+
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string { return e.message }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// A method gets the decoded request fields and a send function; unary
+// methods call send exactly once, streaming methods as often as they like.
+type grpcMethod func(r *http.Request, req protoFields, send func([]byte) error) error
+
+var grpcMethods = map[string]grpcMethod{
+	"ListClients":     grpcListClients,
+	"AddClient":       grpcAddClient,
+	"DeleteClient":    grpcDeleteClient,
+	"GetPeerStatus":   grpcGetPeerStatus,
+	"WatchPeerStatus": grpcWatchPeerStatus,
+	"ControlService":  grpcControlService,
+}
+
+// Methods recorded in the audit log
+var grpcMutations = map[string]bool{
+	"AddClient":      true,
+	"DeleteClient":   true,
+	"ControlService": true,
+}
+
+// Start the gRPC listener when GRPC_PORT is set
+func startGRPCServer() {
+	if GRPC_PORT == "" {
+		return
+	}
+
+	server := &http.Server{
+		Addr:    ":" + GRPC_PORT,
+		Handler: h2c.NewHandler(http.HandlerFunc(grpcHandler), &http2.Server{}),
+	}
+
+	go func() {
+		log.Printf("gRPC server running on port %s", GRPC_PORT)
+		if err := server.ListenAndServe(); err != nil {
+			log.Printf("gRPC server stopped: %v", err)
+		}
+	}()
+}
+
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+
+	// Same token as the REST API, sent as "key" metadata
+	token := r.Header.Get("key")
+	if !isAPIToken(token) {
+		writeGRPCStatus(w, grpcErrorf(grpcUnauthenticated, "invalid or missing API token"))
+		return
+	}
+	identity := tokenIdentity(token)
+	w.Header().Set("X-Acted-By", identity)
+
+	name := strings.TrimPrefix(r.URL.Path, grpcServicePrefix)
+	method, ok := grpcMethods[name]
+	if !ok || !strings.HasPrefix(r.URL.Path, grpcServicePrefix) {
+		writeGRPCStatus(w, grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path))
+		return
+	}
+
+	payload, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcErrorf(grpcInvalidArgument, "%v", err))
+		return
+	}
+	req, err := decodeProtoFields(payload)
+	if err != nil {
+		writeGRPCStatus(w, grpcErrorf(grpcInvalidArgument, "malformed request message: %v", err))
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	send := func(msg []byte) error {
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		if _, err := w.Write(append(frame, msg...)); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	err = method(r, req, send)
+	writeGRPCStatus(w, err)
+
+	if grpcMutations[name] {
+		var clients []string
+		if name != "ControlService" {
+			clients = []string{req.str(1)}
+		}
+		code, _ := grpcStatus(err)
+		recordAudit(AuditEntry{
+			At:      time.Now().UTC(),
+			ActedBy: identity,
+			Method:  "gRPC",
+			Path:    r.URL.Path,
+			Route:   name,
+			Clients: clients,
+			Status:  code,
+		})
+	}
+}
+
+// Set the grpc-status/grpc-message trailers for err (nil = OK). Written
+// as trailers even when no message was sent, which gRPC clients accept.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, message := grpcStatus(err)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeGRPCMessage(message))
+	}
+}
+
+// Status code and message of err (nil = OK)
+func grpcStatus(err error) (int, string) {
+	if err == nil {
+		return grpcOK, ""
+	}
+	var gErr *grpcError
+	if errors.As(err, &gErr) {
+		return gErr.code, gErr.message
+	}
+	return grpcInternal, err.Error()
+}
+
+// Percent-encode a status message as the gRPC spec requires
+func encodeGRPCMessage(message string) string {
+	var sb strings.Builder
+	for i := 0; i < len(message); i++ {
+		ch := message[i]
+		if ch < 0x20 || ch > 0x7e || ch == '%' {
+			fmt.Fprintf(&sb, "%%%02X", ch)
+		} else {
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
+// Read the single length-prefixed message of a unary or server-streaming
+// call. Compressed messages are rejected since no grpc-encoding is
+// advertised.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, fmt.Errorf("reading message header: %v", err)
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxGRPCMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the %d byte limit", size, maxGRPCMessageSize)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, fmt.Errorf("reading message: %v", err)
+	}
+	return msg, nil
+}
+
+// Decoded fields of a request message; the last occurrence of a field wins,
+// as proto3 specifies for scalars
+type protoFields map[protowire.Number]protoValue
+
+type protoValue struct {
+	varint uint64
+	bytes  []byte
+}
+
+func (f protoFields) str(num protowire.Number) string { return string(f[num].bytes) }
+
+func decodeProtoFields(b []byte) (protoFields, error) {
+	fields := make(protoFields)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			fields[num] = protoValue{varint: v}
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			fields[num] = protoValue{bytes: v}
+			b = b[n:]
+		default:
+			// Unknown fields of other wire types are skipped
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return fields, nil
+}
+
+// proto3 omits default values, so empty strings, zeros and false aren't
+// written
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendProtoInt64(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendProtoBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendProtoMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// Client message
+func encodeClient(client Client) []byte {
+	var b []byte
+	b = appendProtoString(b, 1, client.Name)
+	b = appendProtoString(b, 2, client.IPV4)
+	b = appendProtoString(b, 3, client.IPV6)
+	b = appendProtoString(b, 4, client.Config)
+	return b
+}
+
+func grpcListClients(r *http.Request, req protoFields, send func([]byte) error) error {
+	// Same self-healing sync as the REST list handler
+	if err := syncDeletedClientsWithConfig(); err != nil {
+		log.Printf("Error syncing deleted clients: %v", err)
+	}
+
+	clients, err := listWireGuardClients()
+	if err != nil {
+		return grpcErrorf(grpcInternal, "%v", err)
+	}
+
+	var b []byte
+	for _, client := range clients {
+		b = appendProtoMessage(b, 1, encodeClient(client))
+	}
+	return send(b)
+}
+
+func grpcAddClient(r *http.Request, req protoFields, send func([]byte) error) error {
+	if message := changesRefusedMessage(); message != "" {
+		return grpcErrorf(grpcUnavailable, "%s", message)
+	}
+	name := req.str(1)
+	if !validClientName(name) {
+		return grpcErrorf(grpcInvalidArgument, "Client name %s", clientNameMessage())
+	}
+	if err := validateClientAddresses(req.str(2), req.str(3)).err(); err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+
+	if err := reserveCreatesFor(apiTokenCallerKey, 1); err != nil {
+		return grpcErrorf(grpcResourceExhausted, "%v", err)
+	}
+	config, ipv4, ipv6, err := addWireGuardClient(name, req.str(2), req.str(3))
+	if err != nil {
+		releaseCreatesFor(apiTokenCallerKey, 1)
+	}
+	if errors.Is(err, errClientExists) {
+		return grpcErrorf(grpcAlreadyExists, clientExistsMessage)
+	}
+	if err != nil {
+		return grpcErrorf(grpcInternal, "%v", err)
+	}
+
+	return send(encodeClient(Client{Name: name, IPV4: ipv4, IPV6: ipv6, Config: config}))
+}
+
+func grpcDeleteClient(r *http.Request, req protoFields, send func([]byte) error) error {
+	if message := changesRefusedMessage(); message != "" {
+		return grpcErrorf(grpcUnavailable, "%s", message)
+	}
+	if confirmationRequired() {
+		return grpcErrorf(grpcFailedPrecondition, "%v", errConfirmViaREST)
+	}
+	name := req.str(1)
+	exists, err := clientExists(name)
+	if err != nil {
+		return grpcErrorf(grpcInternal, "%v", err)
+	}
+	if !exists {
+		return grpcErrorf(grpcNotFound, "Client not found")
+	}
+
+	if err := deleteWireGuardClient(name); err != nil {
+		return grpcErrorf(grpcInternal, "%v", err)
+	}
+	return send(nil)
+}
+
+// Encode the current PeerStatusResponse
+func peerStatusMessage() []byte {
+	success, output := wireGuardDump()
+	if success != "success" {
+		return nil // running=false, no peers
+	}
+
+	names := clientNamesByPublicKey()
+	now := time.Now()
+
+	b := appendProtoBool(nil, 1, true)
+	for _, peer := range parseWGDump(output) {
+		var p []byte
+		p = appendProtoString(p, 1, peer.PublicKey)
+		p = appendProtoString(p, 2, names[peer.PublicKey])
+		p = appendProtoString(p, 3, peer.Endpoint)
+		p = appendProtoString(p, 4, peer.AllowedIPs)
+		p = appendProtoInt64(p, 5, peer.LatestHandshake)
+		p = appendProtoInt64(p, 6, peer.TransferRx)
+		p = appendProtoInt64(p, 7, peer.TransferTx)
+		p = appendProtoBool(p, 8, peer.online(now))
+		b = appendProtoMessage(b, 2, p)
+	}
+	return b
+}
+
+// Map every peer public key in the server config to its client name, in one
+// read instead of findClientNameByPublicKey's read per peer
+func clientNamesByPublicKey() map[string]string {
+	names := make(map[string]string)
+
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		if DEBUG_MODE {
+			log.Printf("Failed to read WireGuard config: %v", err)
+		}
+		return names
+	}
+
+	clientSectionRegex := regexp.MustCompile(`(?m)^### Client (.+)$\s*\[Peer\]\s*PublicKey = (.+)$`)
+	for _, match := range clientSectionRegex.FindAllSubmatch(content, -1) {
+		names[string(match[2])] = string(match[1])
+	}
+	return names
+}
+
+func grpcGetPeerStatus(r *http.Request, req protoFields, send func([]byte) error) error {
+	return send(peerStatusMessage())
+}
+
+func grpcWatchPeerStatus(r *http.Request, req protoFields, send func([]byte) error) error {
+	interval := time.Duration(req[1].varint) * time.Second
+	if interval <= 0 {
+		interval = grpcDefaultWatchSecs * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := send(peerStatusMessage()); err != nil {
+			return err
+		}
+
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func grpcControlService(r *http.Request, req protoFields, send func([]byte) error) error {
+	if message := changesRefusedMessage(); message != "" {
+		return grpcErrorf(grpcUnavailable, "%s", message)
+	}
+	action := req.str(1)
+	pastTense := map[string]string{"start": "started", "stop": "stopped", "restart": "restarted"}[action]
+	if pastTense == "" {
+		return grpcErrorf(grpcInvalidArgument, "action must be start, stop or restart")
+	}
+	if action != "start" && confirmationRequired() {
+		return grpcErrorf(grpcFailedPrecondition, "%v", errConfirmViaREST)
+	}
+	// Forcing or queueing needs REST
+	if open, _ := windowOpen(time.Now()); action != "start" && !open {
+		return grpcErrorf(grpcFailedPrecondition, "%s is only allowed during a maintenance window", action)
+	}
+
+	if _, err := controlWireGuardService(action); err != nil {
+		return grpcErrorf(grpcInternal, "%v", err)
+	}
+
+	return send(appendProtoString(nil, 1, fmt.Sprintf("%s service %s successfully", backendType, pastTense)))
+}
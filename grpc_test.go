@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Call a unary method over real h2c and return the response messages and
+// the grpc-status trailer
+func grpcCall(t *testing.T, server *httptest.Server, method, token string, msg []byte) ([][]byte, string) {
+	t.Helper()
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	req, err := http.NewRequest(http.MethodPost, server.URL+grpcServicePrefix+method, bytes.NewReader(append(frame, msg...)))
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if token != "" {
+		req.Header.Set("key", token)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+
+	var messages [][]byte
+	for len(body) >= 5 {
+		size := binary.BigEndian.Uint32(body[1:5])
+		messages = append(messages, body[5:5+size])
+		body = body[5+size:]
+	}
+
+	return messages, resp.Trailer.Get("Grpc-Status")
+}
+
+func newGRPCTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(grpcHandler), &http2.Server{}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGRPCRejectsMissingToken(t *testing.T) {
+	setupTestEnv(t)
+	server := newGRPCTestServer(t)
+
+	_, status := grpcCall(t, server, "ListClients", "", nil)
+	if status != "16" {
+		t.Errorf("got grpc-status %q, want 16 (UNAUTHENTICATED)", status)
+	}
+}
+
+func TestGRPCAddAndListClients(t *testing.T) {
+	env := setupTestEnv(t)
+	server := newGRPCTestServer(t)
+
+	req := appendProtoString(nil, 1, "alice")
+	messages, status := grpcCall(t, server, "AddClient", "test-token", req)
+	if status != "0" || len(messages) != 1 {
+		t.Fatalf("AddClient: got status %q and %d messages", status, len(messages))
+	}
+	client, err := decodeProtoFields(messages[0])
+	if err != nil {
+		t.Fatalf("decoding Client: %v", err)
+	}
+	if client.str(1) != "alice" || client.str(2) != "10.66.0.2" || !strings.Contains(client.str(4), "[Interface]") {
+		t.Errorf("unexpected Client name=%q ipv4=%q", client.str(1), client.str(2))
+	}
+	if !strings.Contains(env.configContent(t), "### Client alice") {
+		t.Error("AddClient did not write the peer")
+	}
+
+	if _, status := grpcCall(t, server, "AddClient", "test-token", req); status != "6" {
+		t.Errorf("duplicate AddClient: got grpc-status %q, want 6 (ALREADY_EXISTS)", status)
+	}
+
+	messages, status = grpcCall(t, server, "ListClients", "test-token", nil)
+	if status != "0" || len(messages) != 1 {
+		t.Fatalf("ListClients: got status %q and %d messages", status, len(messages))
+	}
+	num, typ, n := protowire.ConsumeTag(messages[0])
+	if n < 0 || num != 1 || typ != protowire.BytesType {
+		t.Errorf("ListClientsResponse must hold repeated Client in field 1")
+	}
+}
+
+func TestGRPCDeleteUnknownClient(t *testing.T) {
+	setupTestEnv(t)
+	server := newGRPCTestServer(t)
+
+	if _, status := grpcCall(t, server, "DeleteClient", "test-token", appendProtoString(nil, 1, "ghost")); status != "5" {
+		t.Errorf("got grpc-status %q, want 5 (NOT_FOUND)", status)
+	}
+	if _, status := grpcCall(t, server, "NoSuchMethod", "test-token", nil); status != "12" {
+		t.Errorf("got grpc-status %q, want 12 (UNIMPLEMENTED)", status)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// High availability: several API instances can front the same server. The
+// one holding an exclusive flock on HA_LOCK_FILE is the leader and the only
+// one allowed to change the config; the others serve reads and keep trying
+// to take the lock. The kernel drops the lock when the leader's process
+// exits, so a follower takes over within one HA_POLL_INTERVAL.
+
+var (
+	leader       atomic.Bool
+	haLockHandle *os.File // kept open for as long as we lead
+)
+
+func isLeader() bool {
+	return HA_LOCK_FILE == "" || leader.Load()
+}
+
+// Start competing for the lock. Without HA_LOCK_FILE this instance is the
+// only one and always leads.
+func startLeaderElection() error {
+	if HA_LOCK_FILE == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(HA_LOCK_FILE, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open HA lock file: %v", err)
+	}
+
+	switch err := lockFile(file); err {
+	case nil:
+		becomeLeader(file)
+		return nil
+	case errNoFileLocks:
+		file.Close()
+		return err
+	}
+	log.Printf("HA: another instance holds %s, running as follower", HA_LOCK_FILE)
+
+	go func() {
+		ticker := time.NewTicker(HA_POLL_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			if tryLeadership(file) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Returned by lockFile where the platform has no flock
+var errNoFileLocks = errors.New("HA_LOCK_FILE needs flock, which this platform doesn't have")
+
+// Lead when the lock on file can be taken
+func tryLeadership(file *os.File) bool {
+	if lockFile(file) != nil {
+		return false
+	}
+	becomeLeader(file)
+	return true
+}
+
+// Lead with the lock on file taken
+func becomeLeader(file *os.File) {
+	// The PID is only informational, for operators looking at the file
+	file.Truncate(0)
+	file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+
+	haLockHandle = file
+	leader.Store(true)
+	log.Printf("HA: acquired %s, this instance is now the leader", HA_LOCK_FILE)
+}
+
+func haRole() string {
+	if isLeader() {
+		return "leader"
+	}
+	return "follower"
+}
+
+const followerMessage = "This instance is a follower; changes must go to the leader"
+
+// Handler reporting this instance's HA role, for load balancer checks
+func haStatusHandlerGin(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"enabled": HA_LOCK_FILE != "",
+			"role":    haRole(),
+		},
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFollowerRejectsChanges(t *testing.T) {
+	env := setupTestEnv(t)
+
+	oldLockFile := HA_LOCK_FILE
+	HA_LOCK_FILE = filepath.Join(env.dir, "ha.lock")
+	t.Cleanup(func() {
+		HA_LOCK_FILE = oldLockFile
+		leader.Store(false)
+	})
+
+	// Another instance holds the lock
+	holder, err := os.OpenFile(HA_LOCK_FILE, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("opening lock file: %v", err)
+	}
+	defer holder.Close()
+	if !tryLeadership(holder) {
+		t.Fatal("first instance must become leader")
+	}
+	leader.Store(false)
+
+	follower, err := os.OpenFile(HA_LOCK_FILE, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatalf("opening lock file: %v", err)
+	}
+	defer follower.Close()
+	if tryLeadership(follower) {
+		t.Fatal("second instance must not take a held lock")
+	}
+
+	recorder := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d, want 503 with Retry-After", recorder.Code)
+	}
+	if clientConfigExists("alice") {
+		t.Error("follower must not create clients")
+	}
+
+	status := env.authedRequest(t, http.MethodGet, "/api/v1/ha", nil)
+	if status.Code != http.StatusOK || status.Header().Get("X-HA-Role") != "follower" {
+		t.Errorf("got status %d, role %q", status.Code, status.Header().Get("X-HA-Role"))
+	}
+
+	// The leader exits and the follower takes over
+	holder.Close()
+	if !tryLeadership(follower) {
+		t.Fatal("follower must take over a released lock")
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Errorf("new leader got status %d, want 200", code)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows has no flock, so an instance there can't take part in leader
+// election and refuses to start with HA_LOCK_FILE set
+func lockFile(file *os.File) error {
+	return errNoFileLocks
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Hooks attach site-specific steps to client and service changes without
+// forking: HOOKS_CONFIG lists scripts to run before or after a client is
+// added, deleted, enabled or disabled and before or after the VPN service
+// restarts, e.g.
+//
+//	hooks:
+//	  - event: pre-add
+//	    command: /etc/wireguard-api/hooks/open-ticket
+//	    timeout: 30s
+//	    on_failure: abort
+//	  - event: post-delete
+//	    command: /usr/local/sbin/fw-close
+//	    args: ["--quiet"]
+//
+// Scripts get the event in environment variables (see hookEnv) and run
+// with their timeout, 10s by default. A pre hook that fails or times out
+// refuses the change when its on_failure is abort and is only logged when
+// it is warn, the default. Pre hooks run while the server config is
+// locked, so keep them quick. Post hooks run in the background once the
+// change reaches the interface and can only warn. Every path that changes clients runs
+// them: the API, bulk imports, groups, projects, tags and LDAP and SCIM
+// syncs alike.
+
+const (
+	hookAdd     = "add"
+	hookDelete  = "delete"
+	hookEnable  = "enable"
+	hookDisable = "disable"
+	hookRestart = "restart"
+
+	hookAbort = "abort"
+	hookWarn  = "warn"
+)
+
+const defaultHookTimeout = 10 * time.Second
+
+// Output of a failed hook kept in its error
+const maxHookOutput = 2048
+
+// A script run on an event
+type Hook struct {
+	// pre- or post- and one of the hook events, e.g. pre-add
+	Event   string        `yaml:"event"`
+	Command string        `yaml:"command"`
+	Args    []string      `yaml:"args"`
+	Timeout time.Duration `yaml:"timeout"`
+	// abort or warn
+	OnFailure string `yaml:"on_failure"`
+}
+
+// The client a hook runs for; empty for service events
+type HookClient struct {
+	Name      string
+	IPV4      string
+	IPV6      string
+	PublicKey string
+}
+
+// Loaded from HOOKS_CONFIG, by event in the order listed
+var hooksByEvent = map[string][]Hook{}
+
+// Post hooks still running, for tests and shutdown
+var postHooks sync.WaitGroup
+
+func loadHooks() error {
+	hooksByEvent = map[string][]Hook{}
+	if HOOKS_CONFIG == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(HOOKS_CONFIG)
+	if err != nil {
+		return fmt.Errorf("failed to read hooks config: %v", err)
+	}
+	var file struct {
+		Hooks []Hook `yaml:"hooks"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("failed to parse hooks config: %v", err)
+	}
+
+	events := map[string]bool{hookAdd: true, hookDelete: true, hookEnable: true, hookDisable: true, hookRestart: true}
+	for i, hook := range file.Hooks {
+		stage, event, _ := strings.Cut(hook.Event, "-")
+		if (stage != "pre" && stage != "post") || !events[event] {
+			return fmt.Errorf("hook %d: unknown event %q, want pre- or post- and add, delete, enable, disable or restart", i+1, hook.Event)
+		}
+		if hook.Command == "" {
+			return fmt.Errorf("hook %d (%s): no command", i+1, hook.Event)
+		}
+		if hook.Timeout < 0 {
+			return fmt.Errorf("hook %d (%s): timeout must not be negative", i+1, hook.Event)
+		}
+		if hook.Timeout == 0 {
+			hook.Timeout = defaultHookTimeout
+		}
+		switch hook.OnFailure {
+		case "":
+			hook.OnFailure = hookWarn
+		case hookWarn:
+		case hookAbort:
+			if stage == "post" {
+				return fmt.Errorf("hook %d (%s): post hooks run after the change and can only warn", i+1, hook.Event)
+			}
+		default:
+			return fmt.Errorf("hook %d (%s): on_failure must be abort or warn", i+1, hook.Event)
+		}
+		hooksByEvent[hook.Event] = append(hooksByEvent[hook.Event], hook)
+	}
+	return nil
+}
+
+var hookPublicKeyRegex = regexp.MustCompile(`(?m)^#?PublicKey\s*=\s*(\S+)`)
+
+// The client named name in server config content, with its addresses and
+// key when it has a block there
+func hookClientFrom(content []byte, name string) HookClient {
+	client := HookClient{Name: name}
+	names := make(map[string]bool)
+	for _, sectionName := range clientSectionNames(name) {
+		names[sectionName] = true
+	}
+	for _, section := range scanClientSections(content) {
+		if !names[section.name] {
+			continue
+		}
+		client.PublicKey = section.publicKey
+		// Sections leave out the commented-out key of disabled clients
+		if match := hookPublicKeyRegex.FindSubmatch(content[section.start:section.end]); section.disabled && match != nil {
+			client.PublicKey = string(match[1])
+		}
+		tunnel, _ := splitAllowedIPs(section.allowedIPs)
+		for _, entry := range tunnel {
+			if strings.HasSuffix(entry, "/128") {
+				client.IPV6 = strings.TrimSuffix(entry, "/128")
+			} else {
+				client.IPV4 = strings.TrimSuffix(entry, "/32")
+			}
+		}
+		break
+	}
+	return client
+}
+
+// The variables of the API's environment hooks get. The rest, API_TOKEN and
+// the other settings from .env among them, stay with the API.
+var hookInheritedEnv = []string{"PATH", "HOME", "LANG"}
+
+// The environment hooks run with
+func hookEnv(event string, client HookClient) []string {
+	var env []string
+	for _, name := range hookInheritedEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return append(env,
+		"WG_HOOK_EVENT="+event,
+		"WG_INTERFACE="+wgParams.ServerWGNIC,
+		"WG_BACKEND="+backendType,
+		"WG_CLIENT_NAME="+client.Name,
+		"WG_CLIENT_IPV4="+client.IPV4,
+		"WG_CLIENT_IPV6="+client.IPV6,
+		"WG_CLIENT_PUBLIC_KEY="+client.PublicKey,
+	)
+}
+
+func (h Hook) run(event string, client HookClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command, h.Args...)
+	cmd.Env = hookEnv(event, client)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", h.Timeout)
+	}
+	if err == nil {
+		return nil
+	}
+	out := strings.TrimSpace(output.String())
+	if len(out) > maxHookOutput {
+		out = out[:maxHookOutput] + "..."
+	}
+	if out != "" {
+		return fmt.Errorf("%s hook %s: %v: %s", event, h.Command, err, redactSecrets(out))
+	}
+	return fmt.Errorf("%s hook %s: %v", event, h.Command, err)
+}
+
+// Run the pre hooks of event in order. The first failing hook with the
+// abort policy stops them and refuses the change with HOOK_REJECTED.
+func runPreHooks(event string, client HookClient) error {
+	event = "pre-" + event
+	for _, hook := range hooksByEvent[event] {
+		if err := hook.run(event, client); err != nil {
+			if hook.OnFailure == hookAbort {
+				return withCode(codeHookRejected, err)
+			}
+			log.Printf("Warning: %v", err)
+		}
+	}
+	return nil
+}
+
+// A client change written to the server config but not applied yet
+type pendingChange struct {
+	changeType, detail string
+	hook               string
+	client             HookClient
+}
+
+// Changes since the last successful syncWireGuardConf, guarded by
+// wgConfigMutex. The change feed and post hooks only hear of a change once
+// the interface has it: a failed sync leaves them queued for the sync that
+// applies them.
+var pendingChanges []pendingChange
+
+// Queue a client change for the change feed and the post hooks of event.
+// Caller holds wgConfigMutex and syncs afterwards.
+func announceAfterSyncLocked(changeType, detail, event string, client HookClient) {
+	pendingChanges = append(pendingChanges, pendingChange{changeType: changeType, detail: detail, hook: event, client: client})
+}
+
+// Record and start the post hooks of the queued changes, once a sync
+// applied them. Caller holds wgConfigMutex.
+func announcePendingChangesLocked() {
+	for _, change := range pendingChanges {
+		recordChange(change.changeType, change.client.Name, change.detail)
+		runPostHooks(change.hook, change.client)
+	}
+	pendingChanges = nil
+}
+
+// Start the post hooks of event in the background
+func runPostHooks(event string, client HookClient) {
+	event = "post-" + event
+	hooks := hooksByEvent[event]
+	if len(hooks) == 0 {
+		return
+	}
+	postHooks.Add(1)
+	go func() {
+		defer postHooks.Done()
+		for _, hook := range hooks {
+			if err := hook.run(event, client); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func setHooks(t *testing.T, env *testEnv, config string) {
+	t.Helper()
+	path := filepath.Join(env.dir, "hooks.yml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := HOOKS_CONFIG
+	t.Cleanup(func() {
+		postHooks.Wait()
+		HOOKS_CONFIG = old
+		hooksByEvent = map[string][]Hook{}
+	})
+	HOOKS_CONFIG = path
+	if err := loadHooks(); err != nil {
+		t.Fatalf("loadHooks: %v", err)
+	}
+}
+
+// A hook script running body
+func hookScript(t *testing.T, env *testEnv, name, body string) string {
+	t.Helper()
+	path := filepath.Join(env.dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHooksGetEventData(t *testing.T) {
+	env := setupTestEnv(t)
+	logFile := filepath.Join(env.dir, "hooks.log")
+	// The API's secrets stay out of the hooks' environment
+	t.Setenv("API_TOKEN", "env-secret")
+	script := hookScript(t, env, "log-event", `echo "$WG_HOOK_EVENT $WG_CLIENT_NAME $WG_CLIENT_IPV4 $WG_CLIENT_PUBLIC_KEY $WG_INTERFACE$API_TOKEN" >> `+logFile)
+	setHooks(t, env, `hooks:
+  - {event: pre-add, command: `+script+`}
+  - {event: post-add, command: `+script+`}
+  - {event: pre-disable, command: `+script+`}
+  - {event: post-delete, command: `+script+`}
+`)
+
+	alice := addedClient(t, env, "alice")
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/metadata", map[string][]string{"tags": {"lab"}})
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/tags/lab/disable", nil); rec.Code != http.StatusOK {
+		t.Fatalf("disable: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"}); rec.Code != http.StatusOK {
+		t.Fatalf("delete: status %d, %s", rec.Code, rec.Body.String())
+	}
+	postHooks.Wait()
+
+	logged := readFile(t, logFile)
+	for _, event := range []string{"pre-add", "post-add", "pre-disable", "post-delete"} {
+		want := event + " alice " + alice.IPV4 + " " + alice.PublicKey + " wg0\n"
+		if !strings.Contains(logged, want) {
+			t.Errorf("missing %q in:\n%s", want, logged)
+		}
+	}
+	if strings.Index(logged, "pre-add") > strings.Index(logged, "pre-disable") {
+		t.Errorf("hooks ran out of order:\n%s", logged)
+	}
+}
+
+func TestPreHooksAbortOrWarn(t *testing.T) {
+	env := setupTestEnv(t)
+	refuse := hookScript(t, env, "refuse", "echo no ticket for $WG_CLIENT_NAME\nexit 1")
+	hang := hookScript(t, env, "hang", "exec sleep 5")
+	setHooks(t, env, `hooks:
+  - {event: pre-add, command: `+refuse+`, on_failure: warn}
+  - {event: pre-delete, command: `+hang+`, timeout: 100ms, on_failure: abort}
+  - {event: pre-restart, command: `+refuse+`, on_failure: abort}
+`)
+
+	// A warning hook lets the add through, a hanging abort hook stops the
+	// delete
+	addedClient(t, env, "alice")
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	var resp APIResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusConflict || resp.Code != codeHookRejected || !strings.Contains(resp.Message, "timed out") {
+		t.Errorf("delete: status %d, %s", rec.Code, rec.Body.String())
+	}
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/users/delete-all", nil)
+	resp = APIResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusConflict || resp.Code != codeHookRejected {
+		t.Errorf("delete-all: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(env.configContent(t), "### Client alice") {
+		t.Error("a refused delete removed alice")
+	}
+
+	// Refused restarts never reach systemctl
+	logFile := filepath.Join(env.dir, "systemctl.log")
+	oldSystemctl := systemctlCmd
+	systemctlCmd = hookScript(t, env, "systemctl", `echo "$*" >> `+logFile)
+	t.Cleanup(func() { systemctlCmd = oldSystemctl })
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/restart", nil)
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusConflict || resp.Code != codeHookRejected || !strings.Contains(resp.Message, "no ticket for") {
+		t.Errorf("restart: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(logFile); err == nil {
+		t.Error("a refused restart ran systemctl")
+	}
+
+	// Aborting adds leave nothing behind
+	setHooks(t, env, "hooks:\n  - {event: pre-add, command: "+refuse+", on_failure: abort}\n")
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusConflict || resp.Code != codeHookRejected || !strings.Contains(resp.Message, "no ticket for bob") {
+		t.Errorf("add: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(env.configContent(t), "### Client bob") {
+		t.Error("a refused add appended bob")
+	}
+	setHooks(t, env, "hooks: []\n")
+	addedClient(t, env, "bob")
+}
+
+func TestPostHooksWaitForSync(t *testing.T) {
+	env := setupTestEnv(t)
+	logFile := filepath.Join(env.dir, "hooks.log")
+	script := hookScript(t, env, "log-event", `echo "$WG_HOOK_EVENT $WG_CLIENT_NAME" >> `+logFile)
+	setHooks(t, env, "hooks:\n  - {event: post-add, command: "+script+"}\n  - {event: post-delete, command: "+script+"}\n")
+	addedClient(t, env, "alice")
+
+	// A change the interface never got isn't announced
+	syncFail := filepath.Join(env.dir, "sync_fail")
+	if err := os.WriteFile(syncFail, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"}); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("add: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"}); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("delete: status %d, %s", rec.Code, rec.Body.String())
+	}
+	postHooks.Wait()
+	if logged := readFile(t, logFile); logged != "post-add alice\n" {
+		t.Errorf("hooks ran for unapplied changes:\n%s", logged)
+	}
+	if _, resp := changesSince(t, env, "?since=0"); len(resp.Data.Changes) != 1 {
+		t.Errorf("unapplied changes were recorded: %+v", resp.Data.Changes)
+	}
+
+	// The sync applying them announces them
+	if err := os.Remove(syncFail); err != nil {
+		t.Fatal(err)
+	}
+	addedClient(t, env, "carol")
+	postHooks.Wait()
+	// Post hooks of different changes run side by side
+	logged := strings.Split(strings.TrimSpace(readFile(t, logFile)), "\n")
+	sort.Strings(logged)
+	if got := strings.Join(logged, ","); got != "post-add alice,post-add bob,post-add carol,post-delete alice" {
+		t.Errorf("got hooks %s", got)
+	}
+	if _, resp := changesSince(t, env, "?since=0"); len(resp.Data.Changes) != 4 {
+		t.Errorf("got changes %+v", resp.Data.Changes)
+	}
+}
+
+func TestHooksConfigValidated(t *testing.T) {
+	env := setupTestEnv(t)
+	old := HOOKS_CONFIG
+	t.Cleanup(func() {
+		HOOKS_CONFIG = old
+		hooksByEvent = map[string][]Hook{}
+	})
+	HOOKS_CONFIG = filepath.Join(env.dir, "hooks.yml")
+	for _, config := range []string{
+		"hooks:\n  - {event: add, command: /bin/true}\n",
+		"hooks:\n  - {event: pre-rename, command: /bin/true}\n",
+		"hooks:\n  - {event: pre-add}\n",
+		"hooks:\n  - {event: post-add, command: /bin/true, on_failure: abort}\n",
+		"hooks:\n  - {event: pre-add, command: /bin/true, on_failure: retry}\n",
+		"hooks:\n  - {event: pre-add, command: /bin/true, timeout: -1s}\n",
+	} {
+		os.WriteFile(HOOKS_CONFIG, []byte(config), 0600)
+		if err := loadHooks(); err == nil {
+			t.Errorf("%q: want an error", config)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Longest Idempotency-Key accepted; keys are meant to be UUIDs
+const maxIdempotencyKeyLength = 255
+
+type idempotentResponse struct {
+	fingerprint [32]byte
+	done        bool
+	status      int
+	contentType string
+	location    string // Of a 201 under /api/v2
+	body        []byte
+	expires     time.Time
+}
+
+type idempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+}
+
+var idempotency = &idempotencyStore{entries: make(map[string]*idempotentResponse)}
+
+// Captures the handler's response so it can be replayed
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Replay the stored response for a repeated Idempotency-Key on mutating
+// requests, so automation can retry after a network failure without
+// creating duplicates or hitting "already exists". Keys are scoped to
+// method, path and tenant and kept for IDEMPOTENCY_TTL in memory. Reusing a key
+// with a different body is rejected, as is a retry while the first request
+// is still running. 5xx results are not stored, so those can be retried.
+func idempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" || c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || IDEMPOTENCY_TTL <= 0 {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "Idempotency-Key must be at most 255 characters",
+			})
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "Failed to read request body",
+			})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256(body)
+		scope := c.Request.Method + " " + c.Request.URL.Path + " " + key
+		// Tenants may pick the same keys
+		if tenant := tenantFrom(c); tenant != nil {
+			scope = tenant.Name + " " + scope
+		}
+
+		now := time.Now()
+		idempotency.mu.Lock()
+		idempotency.pruneLocked(now)
+		entry, exists := idempotency.entries[scope]
+		if !exists {
+			entry = &idempotentResponse{fingerprint: fingerprint}
+			idempotency.entries[scope] = entry
+		}
+		idempotency.mu.Unlock()
+
+		if exists {
+			switch {
+			case entry.fingerprint != fingerprint:
+				c.JSON(http.StatusUnprocessableEntity, APIResponse{
+					Success: false,
+					Message: "Idempotency-Key was already used with a different request body",
+				})
+			case !entry.done:
+				c.JSON(http.StatusConflict, APIResponse{
+					Success: false,
+					Message: "A request with this Idempotency-Key is still in progress",
+				})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				if entry.location != "" {
+					c.Header("Location", entry.location)
+				}
+				c.Data(entry.status, entry.contentType, entry.body)
+			}
+			c.Abort()
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		idempotency.mu.Lock()
+		defer idempotency.mu.Unlock()
+		if status := recorder.Status(); status >= http.StatusInternalServerError {
+			delete(idempotency.entries, scope)
+		} else {
+			entry.done = true
+			entry.status = status
+			entry.contentType = recorder.Header().Get("Content-Type")
+			entry.location = recorder.Header().Get("Location")
+			entry.body = recorder.body.Bytes()
+			entry.expires = time.Now().Add(IDEMPOTENCY_TTL)
+		}
+	}
+}
+
+// Drop expired responses. In-progress entries have no expiry yet.
+func (s *idempotencyStore) pruneLocked(now time.Time) {
+	for scope, entry := range s.entries {
+		if entry.done && now.After(entry.expires) {
+			delete(s.entries, scope)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func (e *testEnv) idempotentRequest(t *testing.T, path, key string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("encoding request body: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(encoded))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("key", "test-token")
+	req.Header.Set("Idempotency-Key", key)
+
+	recorder := httptest.NewRecorder()
+	e.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestIdempotentAddReplaysOriginalResponse(t *testing.T) {
+	env := setupTestEnv(t)
+
+	first := env.idempotentRequest(t, "/api/v1/users/add", "key-1", AddUserRequest{Name: "alice"})
+	if first.Code != http.StatusOK {
+		t.Fatalf("first request: got status %d, body %s", first.Code, first.Body.String())
+	}
+	syncs := env.syncconfCalls(t)
+
+	retry := env.idempotentRequest(t, "/api/v1/users/add", "key-1", AddUserRequest{Name: "alice"})
+	if retry.Code != http.StatusOK {
+		t.Fatalf("retry must replay 200 instead of conflicting, got %d", retry.Code)
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("replayed body differs:\n%s\n%s", first.Body.String(), retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay must be marked with Idempotent-Replayed")
+	}
+	if env.syncconfCalls(t) != syncs {
+		t.Error("replay must not run the handler again")
+	}
+
+	// Without a key a repeat is a real second request
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusConflict {
+		t.Errorf("request without key: got status %d, want 409", code)
+	}
+}
+
+func TestIdempotencyKeyReusedWithDifferentBody(t *testing.T) {
+	env := setupTestEnv(t)
+
+	if code := env.idempotentRequest(t, "/api/v1/users/add", "key-1", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("first request: got status %d", code)
+	}
+	if code := env.idempotentRequest(t, "/api/v1/users/add", "key-1", AddUserRequest{Name: "bob"}).Code; code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key with another body: got status %d, want 422", code)
+	}
+	// Keys are scoped per route
+	if code := env.idempotentRequest(t, "/api/v1/users/delete", "key-1", DeleteUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Errorf("same key on another route: got status %d, want 200", code)
+	}
+}
+
+func TestIdempotencyDoesNotStoreServerErrors(t *testing.T) {
+	env := setupTestEnv(t)
+	syncFail := filepath.Join(env.dir, "sync_fail")
+	if err := os.WriteFile(syncFail, nil, 0600); err != nil {
+		t.Fatalf("creating sync_fail flag: %v", err)
+	}
+
+	if code := env.idempotentRequest(t, "/api/v1/users/add-bulk", "key-1", AddUsersBulkRequest{Names: []string{"a"}}).Code; code != http.StatusInternalServerError {
+		t.Fatalf("expected the sync failure to surface as 500, got %d", code)
+	}
+
+	if err := os.Remove(syncFail); err != nil {
+		t.Fatalf("removing sync_fail flag: %v", err)
+	}
+	recorder := env.idempotentRequest(t, "/api/v1/users/add-bulk", "key-1", AddUsersBulkRequest{Names: []string{"a"}})
+	if recorder.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("a 5xx result must not be replayed")
+	}
+}
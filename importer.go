@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Import sources
+const (
+	importSourceWGEasy           = "wg-easy"
+	importSourceWireGuardInstall = "wireguard-install"
+)
+
+// Where angristan/wireguard-install leaves client configs: the home of the
+// user named like the client, the sudo user's home, or /root. Globs are
+// expanded. A var so tests can point it at a temp dir.
+var wireGuardInstallHomeDirs = []string{"/root", "/home/*"}
+
+type ImportRequest struct {
+	Source string `json:"source" binding:"required"`
+	DryRun bool   `json:"dry_run"`
+}
+
+type ImportResult struct {
+	Name         string `json:"name"`
+	OriginalName string `json:"original_name,omitempty"`
+	// Line of the CSV the client is on
+	Line int `json:"line,omitempty"`
+	// "imported", "exists" or "skipped"
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	IPV4    string `json:"ipv4,omitempty"`
+	IPV6    string `json:"ipv6,omitempty"`
+}
+
+// wg-easy (before v14) state file, /etc/wireguard/wg0.json
+type wgEasyState struct {
+	Clients map[string]wgEasyClient `json:"clients"`
+}
+
+type wgEasyClient struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Address      string `json:"address"`
+	PrivateKey   string `json:"privateKey"`
+	PublicKey    string `json:"publicKey"`
+	PreSharedKey string `json:"preSharedKey"`
+	Enabled      bool   `json:"enabled"`
+}
+
+// Handler that adopts clients created by wg-easy or wireguard-install,
+// keeping their keys and addresses so issued configs keep working, or
+// creates the clients of a CSV, see csvimport.go
+func importClientsHandlerGin(c *gin.Context) {
+	if c.ContentType() == "text/csv" {
+		importCSVHandlerGin(c)
+		return
+	}
+
+	var req ImportRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	var importClients func(dryRun bool) ([]ImportResult, error)
+	switch req.Source {
+	case importSourceWGEasy:
+		importClients = importWGEasy
+	case importSourceWireGuardInstall:
+		importClients = importWireGuardInstall
+	default:
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("source must be %s or %s", importSourceWGEasy, importSourceWireGuardInstall),
+		})
+		return
+	}
+	if req.DryRun {
+		results, err := importClients(true)
+		respondImport(c, req.Source, true, results, err)
+		return
+	}
+
+	// The clients to import are only known once the source is read, so a
+	// dry run finds how many creations to reserve
+	planned, err := importClients(true)
+	if err != nil {
+		respondImport(c, req.Source, false, planned, err)
+		return
+	}
+	reserved := importedCount(planned)
+	if !reserveCreates(c, reserved) {
+		return
+	}
+	results, err := importClients(false)
+	releaseCreates(c, reserved-importedCount(results))
+	respondImport(c, req.Source, false, results, err)
+}
+
+// How many of results were, or in a dry run would be, imported
+func importedCount(results []ImportResult) int {
+	imported := 0
+	for _, result := range results {
+		if result.Status == "imported" {
+			imported++
+		}
+	}
+	return imported
+}
+
+// Answer an import with its results, and the error that stopped it
+func respondImport(c *gin.Context, source string, dryRun bool, results []ImportResult, err error) {
+	imported := importedCount(results)
+	data := map[string]interface{}{
+		"source":   source,
+		"dry_run":  dryRun,
+		"imported": imported,
+		"results":  results,
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+			Data:    data,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Imported %d clients", imported),
+		Data:    data,
+	})
+}
+
+// wg-easy marks peers with "# Client: <name> (<id>)" and keeps the client
+// keys in wg0.json. Each enabled client gets a "### Client" peer block and a
+// client config file built from the stored keys.
+func importWGEasy(dryRun bool) ([]ImportResult, error) {
+	raw, err := os.ReadFile(WG_EASY_CONFIG)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wg-easy config: %v", err)
+	}
+	var state wgEasyState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse wg-easy config %s: %v", WG_EASY_CONFIG, err)
+	}
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+
+	// Stable order, so renamed duplicates get predictable suffixes
+	clients := make([]wgEasyClient, 0, len(state.Clients))
+	for id, client := range state.Clients {
+		if client.ID == "" {
+			client.ID = id
+		}
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+
+	var results []ImportResult
+	taken := make(map[string]bool)
+	managed := clientNamesByPublicKey()
+	changed := false
+
+	for _, client := range clients {
+		// Imported by an earlier run
+		if name, ok := managed[client.PublicKey]; ok {
+			results = append(results, ImportResult{Name: name, OriginalName: client.Name, Status: "exists"})
+			continue
+		}
+
+		name, err := uniqueImportName(client.Name, taken)
+		if err != nil {
+			return results, err
+		}
+		result := ImportResult{Name: name}
+		if name != client.Name {
+			result.OriginalName = client.Name
+		}
+
+		peerRegex := regexp.MustCompile(`(?ms)^# Client: .* \(` + regexp.QuoteMeta(client.ID) + `\)$.*?^$`)
+		switch {
+		case !client.Enabled:
+			result.Status, result.Message = "skipped", "disabled in wg-easy"
+		case client.PrivateKey == "" || client.PublicKey == "" || client.Address == "":
+			result.Status, result.Message = "skipped", "incomplete client record"
+		case !peerRegex.Match(content):
+			result.Status, result.Message = "skipped", "peer not found in server config"
+		default:
+			result.Status = "imported"
+		}
+		if result.Status != "imported" || dryRun {
+			results = append(results, result)
+			continue
+		}
+
+		// Swap the wg-easy peer block for one in this API's format
+		updated := peerRegex.ReplaceAll(content, nil)
+		if err := os.WriteFile(WG_CONFIG_FILE, updated, 0600); err != nil {
+			return results, fmt.Errorf("failed to update WireGuard config: %v", err)
+		}
+		// Clients without a preshared key keep having none
+		keys := clientKeys{privateKey: client.PrivateKey, publicKey: client.PublicKey, preSharedKey: client.PreSharedKey}
+		if _, err := createWireGuardClientLocked(name, client.Address, "", keys, nil, ""); err != nil {
+			// Put the original peer back so the client keeps working
+			os.WriteFile(WG_CONFIG_FILE, content, 0600)
+			return results, fmt.Errorf("failed to import %s: %v", client.Name, err)
+		}
+		changed = true
+
+		if content, err = os.ReadFile(WG_CONFIG_FILE); err != nil {
+			return results, fmt.Errorf("failed to read WireGuard config: %v", err)
+		}
+		results = append(results, result)
+	}
+
+	if changed {
+		if err := syncWireGuardConf(); err != nil {
+			return results, fmt.Errorf("failed to sync WireGuard config: %w", err)
+		}
+	}
+	return results, nil
+}
+
+// wireguard-install already uses "### Client <name>" peer blocks; only the
+// client configs live elsewhere. They are copied into WIREGUARD_CLIENTS,
+// which also stops the self-healing sync from dropping those peers.
+func importWireGuardInstall(dryRun bool) ([]ImportResult, error) {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+
+	if !dryRun {
+		if err := os.MkdirAll(WIREGUARD_CLIENTS, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create clients directory: %v", err)
+		}
+	}
+
+	var results []ImportResult
+	for _, match := range regexp.MustCompile(`(?m)^### Client (.+)$`).FindAllSubmatch(content, -1) {
+		name := string(match[1])
+		result := ImportResult{Name: name}
+
+		if clientConfigExists(name) {
+			result.Status = "exists"
+			results = append(results, result)
+			continue
+		}
+
+		source := findWireGuardInstallConfig(name)
+		if source == "" {
+			result.Status = "skipped"
+			result.Message = "client config not found; the peer will be removed on the next client sync unless its config is added"
+			results = append(results, result)
+			continue
+		}
+
+		result.Status = "imported"
+		result.Message = "from " + source
+		if !dryRun {
+			config, err := os.ReadFile(source)
+			if err != nil {
+				return results, fmt.Errorf("failed to read %s: %v", source, err)
+			}
+			target := filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+clientFileName(name)+".conf")
+			if err := os.WriteFile(target, config, 0600); err != nil {
+				return results, fmt.Errorf("failed to write %s: %v", target, err)
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func findWireGuardInstallConfig(name string) string {
+	fileName := wgParams.ServerWGNIC + "-client-" + name + ".conf"
+	for _, pattern := range wireGuardInstallHomeDirs {
+		dirs, _ := filepath.Glob(pattern)
+		for _, dir := range dirs {
+			path := filepath.Join(dir, fileName)
+			if fileExists(path) {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// Turn a foreign client name into a valid, unused one: invalid characters
+// become dashes, long names are cut, and clashes get a numeric suffix.
+// Caller holds wgConfigMutex.
+func uniqueImportName(original string, taken map[string]bool) (string, error) {
+	base := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, strings.TrimSpace(original))
+	if base == "" {
+		base = "client"
+	}
+	if len(base) > 15 {
+		base = base[:15]
+	}
+
+	for i := 1; ; i++ {
+		name := base
+		if i > 1 {
+			suffix := fmt.Sprintf("-%d", i)
+			if len(base)+len(suffix) > 15 {
+				name = base[:15-len(suffix)]
+			}
+			name += suffix
+		}
+
+		if taken[name] {
+			continue
+		}
+		exists, err := clientExists(name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			taken[name] = true
+			return name, nil
+		}
+	}
+}
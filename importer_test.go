@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type importResponse struct {
+	Success bool `json:"success"`
+	Data    struct {
+		Imported int            `json:"imported"`
+		Results  []ImportResult `json:"results"`
+	} `json:"data"`
+}
+
+func (e *testEnv) importClients(t *testing.T, req ImportRequest) importResponse {
+	t.Helper()
+
+	recorder := e.authedRequest(t, http.MethodPost, "/api/v1/users/import", req)
+	var resp importResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response %q: %v", recorder.Body.String(), err)
+	}
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+	return resp
+}
+
+func TestImportWGEasy(t *testing.T) {
+	env := setupTestEnv(t)
+
+	state := `{
+  "server": {"privateKey": "srv", "publicKey": "srv-pub", "address": "10.8.0.1"},
+  "clients": {
+    "id-1": {"id": "id-1", "name": "alice", "address": "10.8.0.2", "privateKey": "alice-priv", "publicKey": "alice-pub", "preSharedKey": "alice-psk", "enabled": true},
+    "id-2": {"id": "id-2", "name": "Bob's Phone", "address": "10.8.0.3", "privateKey": "bob-priv", "publicKey": "bob-pub", "preSharedKey": "bob-psk", "enabled": true},
+    "id-3": {"id": "id-3", "name": "old", "address": "10.8.0.4", "privateKey": "old-priv", "publicKey": "old-pub", "preSharedKey": "old-psk", "enabled": false}
+  }
+}`
+	stateFile := filepath.Join(env.dir, "wg0.json")
+	if err := os.WriteFile(stateFile, []byte(state), 0600); err != nil {
+		t.Fatalf("writing wg-easy state: %v", err)
+	}
+	oldStateFile := WG_EASY_CONFIG
+	WG_EASY_CONFIG = stateFile
+	t.Cleanup(func() { WG_EASY_CONFIG = oldStateFile })
+
+	appendToFile(t, env.configFile, `
+# Client: alice (id-1)
+[Peer]
+PublicKey = alice-pub
+PresharedKey = alice-psk
+AllowedIPs = 10.8.0.2/32
+
+# Client: Bob's Phone (id-2)
+[Peer]
+PublicKey = bob-pub
+PresharedKey = bob-psk
+AllowedIPs = 10.8.0.3/32
+`)
+
+	dryRun := env.importClients(t, ImportRequest{Source: "wg-easy", DryRun: true})
+	if dryRun.Data.Imported != 2 || !strings.Contains(env.configContent(t), "# Client: alice") {
+		t.Fatalf("dry run must report without changing anything: %+v", dryRun.Data)
+	}
+
+	resp := env.importClients(t, ImportRequest{Source: "wg-easy"})
+	if resp.Data.Imported != 2 {
+		t.Fatalf("got %+v, want 2 imported", resp.Data.Results)
+	}
+	byName := map[string]ImportResult{}
+	for _, result := range resp.Data.Results {
+		byName[result.Name] = result
+	}
+	if byName["Bob-s-Phone"].OriginalName != "Bob's Phone" {
+		t.Errorf("invalid name must be sanitized, got %+v", resp.Data.Results)
+	}
+	if byName["old"].Status != "skipped" {
+		t.Errorf("disabled client must be skipped, got %+v", byName["old"])
+	}
+
+	config := env.configContent(t)
+	if strings.Contains(config, "# Client:") {
+		t.Errorf("wg-easy peer markers left behind:\n%s", config)
+	}
+	if !strings.Contains(config, "### Client alice\n[Peer]\nPublicKey = alice-pub\nPresharedKey = alice-psk\nAllowedIPs = 10.8.0.2/32") {
+		t.Errorf("alice's peer must keep its keys and address:\n%s", config)
+	}
+
+	clientConfig, err := os.ReadFile(filepath.Join(env.clientsDir, "wg0-client-alice.conf"))
+	if err != nil {
+		t.Fatalf("client config not written: %v", err)
+	}
+	if !strings.Contains(string(clientConfig), "PrivateKey = alice-priv") {
+		t.Errorf("client config must reuse the wg-easy private key:\n%s", clientConfig)
+	}
+
+	// Running again is harmless
+	again := env.importClients(t, ImportRequest{Source: "wg-easy"})
+	if again.Data.Imported != 0 {
+		t.Errorf("second run imported %d clients", again.Data.Imported)
+	}
+}
+
+func TestImportWireGuardInstall(t *testing.T) {
+	env := setupTestEnv(t)
+
+	home := filepath.Join(env.dir, "home", "admin")
+	if err := os.MkdirAll(home, 0700); err != nil {
+		t.Fatalf("creating home dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(home, "wg0-client-carol.conf"), []byte("[Interface]\nPrivateKey = carol-priv\nAddress = 10.66.0.5/32\n"), 0600); err != nil {
+		t.Fatalf("writing client config: %v", err)
+	}
+	oldDirs := wireGuardInstallHomeDirs
+	wireGuardInstallHomeDirs = []string{filepath.Join(env.dir, "home", "*")}
+	t.Cleanup(func() { wireGuardInstallHomeDirs = oldDirs })
+
+	appendToFile(t, env.configFile, "\n### Client carol\n[Peer]\nPublicKey = carol-pub\nAllowedIPs = 10.66.0.5/32\n\n### Client lost\n[Peer]\nPublicKey = lost-pub\nAllowedIPs = 10.66.0.6/32\n")
+
+	env.importClients(t, ImportRequest{Source: "wireguard-install", DryRun: true})
+	if clientConfigExists("carol") {
+		t.Fatal("dry run must not copy configs")
+	}
+
+	resp := env.importClients(t, ImportRequest{Source: "wireguard-install"})
+	if resp.Data.Imported != 1 || resp.Data.Results[1].Status != "skipped" {
+		t.Errorf("unexpected results %+v", resp.Data.Results)
+	}
+
+	users := env.authedRequest(t, http.MethodGet, "/api/v1/users", nil)
+	if !strings.Contains(users.Body.String(), `"name":"carol","ipv4":"10.66.0.5"`) {
+		t.Errorf("imported client not listed: %s", users.Body.String())
+	}
+}
+
+func TestImportRejectsUnknownSource(t *testing.T) {
+	env := setupTestEnv(t)
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/import", ImportRequest{Source: "pivpn"}).Code; code != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", code)
+	}
+}
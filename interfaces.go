@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /status only covers the interface the API manages, but a host often runs
+// others: a site-to-site link, a second VPN set up by hand. GET
+// /status/interfaces lists every interface `wg show interfaces` knows,
+// with its peers and health, and flags the ones this API didn't create as
+// unmanaged. Peers are only matched to client names on the managed one. The
+// managed interface is listed even when it is down.
+
+// Whether an interface is the one the API manages
+const (
+	interfaceManaged   = "managed"
+	interfaceUnmanaged = "unmanaged"
+)
+
+// Interface health
+const (
+	interfaceDown   = "down"   // the dump couldn't be read
+	interfaceIdle   = "idle"   // up, no peer handshaked within onlineHandshakeWindow
+	interfaceActive = "active" // up, with peers online
+)
+
+// A WireGuard interface on the host
+type InterfaceStatus struct {
+	Name string `json:"name"`
+	// "managed" or "unmanaged"
+	Ownership string `json:"ownership"`
+	// "active", "idle" or "down"
+	Health      string                   `json:"health"`
+	PublicKey   string                   `json:"public_key,omitempty"`
+	ListenPort  int                      `json:"listen_port,omitempty"`
+	PeerCount   int                      `json:"peer_count"`
+	OnlinePeers int                      `json:"online_peers"`
+	Peers       []map[string]interface{} `json:"peers"`
+	// Why the interface is down
+	Error string `json:"error,omitempty"`
+}
+
+// Interface names from `wg show interfaces`, with the managed one first
+func listWireGuardInterfaces() ([]string, error) {
+	success, output := executeCommandTimeout(STATUS_COMMAND_TIMEOUT, wgCmd, "show", "interfaces")
+	if success != "success" {
+		return nil, fmt.Errorf("%s show interfaces failed: %s", wgCmd, strings.TrimSpace(output))
+	}
+	names := []string{wgParams.ServerWGNIC}
+	others := strings.Fields(output)
+	sort.Strings(others)
+	for _, name := range others {
+		if name != wgParams.ServerWGNIC {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Read one interface's dump into its status
+func collectInterfaceStatus(name string, now time.Time) InterfaceStatus {
+	status := InterfaceStatus{Name: name, Ownership: interfaceUnmanaged, Health: interfaceDown, Peers: []map[string]interface{}{}}
+	managed := name == wgParams.ServerWGNIC
+	if managed {
+		status.Ownership = interfaceManaged
+	}
+
+	success, output := interfaceDump(name)
+	if success != "success" {
+		status.Error = strings.TrimSpace(output)
+		return status
+	}
+	if lines := strings.SplitN(output, "\n", 2); len(lines) > 0 {
+		// private key, public key, listen port, fwmark
+		if fields := strings.Fields(lines[0]); len(fields) == 4 {
+			status.PublicKey = fields[1]
+			status.ListenPort, _ = strconv.Atoi(fields[2])
+		}
+	}
+
+	status.Health = interfaceIdle
+	for _, peer := range parseWGDump(output) {
+		online := peer.online(now)
+		entry := map[string]interface{}{
+			"public_key":        peer.PublicKey,
+			"endpoint":          peer.Endpoint,
+			"allowed_ips":       peer.AllowedIPs,
+			"latest_handshake":  peer.LatestHandshake,
+			"transfer_rx_bytes": peer.TransferRx,
+			"transfer_tx_bytes": peer.TransferTx,
+			"online":            online,
+		}
+		if managed {
+			if clientName := findClientNameByPublicKey(peer.PublicKey); clientName != "" {
+				entry["client_name"] = clientName
+			}
+		}
+		if online {
+			status.OnlinePeers++
+			status.Health = interfaceActive
+		}
+		status.Peers = append(status.Peers, entry)
+	}
+	status.PeerCount = len(status.Peers)
+	return status
+}
+
+// Status of every WireGuard interface on the host, read side by side
+func collectInterfaceStatuses() ([]InterfaceStatus, error) {
+	names, err := listWireGuardInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	statuses := make([]InterfaceStatus, len(names))
+	tasks := make([]func(), len(names))
+	for i, name := range names {
+		i, name := i, name
+		tasks[i] = func() { statuses[i] = collectInterfaceStatus(name, now) }
+	}
+	runBounded(STATUS_CONCURRENCY, tasks...)
+	return statuses, nil
+}
+
+// Handler for GET /status/interfaces. Takes ?format= like /status; reads
+// the interfaces on every call rather than going through the status cache.
+func interfacesStatusHandlerGin(c *gin.Context) {
+	format, ok := parseTransferFormat(c)
+	if !ok {
+		return
+	}
+
+	statuses, err := collectInterfaceStatuses()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+	for i := range statuses {
+		for j, peer := range statuses[i].Peers {
+			statuses[i].Peers[j] = formatPeerTransfer(peer, format)
+		}
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    statuses,
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInterfacesStatus(t *testing.T) {
+	env := setupTestEnv(t)
+	alice := addedClient(t, env, "alice")
+	if alice.PublicKey == "" {
+		t.Fatal("added client has no public key")
+	}
+
+	// alice last handshaked an hour ago; wg1's peer is online
+	env.writeDump(t, fmt.Sprintf("%s\t(none)\t198.51.100.1:4000\t10.66.0.2/32\t%d\t100\t200\toff", alice.PublicKey, time.Now().Add(-time.Hour).Unix()))
+	site := fmt.Sprintf("site-private\tsite-public\t51821\toff\nremote-public\t(none)\t192.0.2.7:51821\t10.99.0.0/24\t%d\t5\t6\t25\n", time.Now().Unix())
+	if err := os.WriteFile(filepath.Join(env.dir, "dump-wg1"), []byte(site), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(env.dir, "interfaces"), []byte("wg1 wg0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/status/interfaces?format=raw", nil)
+	var resp struct {
+		Data []InterfaceStatus `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, %s", rec.Code, rec.Body.String())
+	}
+	if len(resp.Data) != 2 {
+		t.Fatalf("got %d interfaces, want 2: %s", len(resp.Data), rec.Body.String())
+	}
+
+	managed, site1 := resp.Data[0], resp.Data[1]
+	if managed.Name != "wg0" || managed.Ownership != interfaceManaged || managed.Health != interfaceIdle {
+		t.Errorf("managed interface: %+v", managed)
+	}
+	if managed.PeerCount != 1 || managed.Peers[0]["client_name"] != "alice" || managed.Peers[0]["online"] != false {
+		t.Errorf("managed peers: %+v", managed.Peers)
+	}
+	if site1.Name != "wg1" || site1.Ownership != interfaceUnmanaged || site1.Health != interfaceActive {
+		t.Errorf("unmanaged interface: %+v", site1)
+	}
+	if site1.PublicKey != "site-public" || site1.ListenPort != 51821 || site1.OnlinePeers != 1 {
+		t.Errorf("unmanaged interface details: %+v", site1)
+	}
+	if _, named := site1.Peers[0]["client_name"]; named || site1.Peers[0]["transfer_rx_bytes"] != float64(5) {
+		t.Errorf("unmanaged peer: %+v", site1.Peers[0])
+	}
+}
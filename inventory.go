@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lookups by client name or public key used to read and regex-scan the
+// server config on every call, and the status handler made one per peer,
+// which dominates requests on servers with thousands of clients. The
+// inventory indexes the config once and is rebuilt when the file changes.
+//
+// The config is written from many places, and by hand or an HA peer, so
+// instead of being told about changes the index compares the file's size
+// and modification time. Modification times are coarse, and a write in the
+// same tick as the last one keeps both, so like git's index an inventory
+// is only trusted once the file's mtime was well in the past when it was
+// built; until then every lookup rebuilds it.
+
+// How long after its last modification the config counts as settled
+const inventorySettleTime = 2 * time.Second
+
+var (
+	inventoryMutex sync.Mutex
+	inventoryData  *clientInventory
+)
+
+// The clients of one version of the server config. Names are as in the
+// "### Client" markers, prefixes included, and disabled clients have no
+// public key, as their peer is commented out.
+type clientInventory struct {
+	path    string
+	size    int64
+	modTime time.Time
+	builtAt time.Time
+
+	names map[string]bool
+	keys  map[string]string // name to public key
+	byKey map[string]string // public key to name
+
+	// AllowedIPs to name: the client addresses, and the routed subnets
+	// longest prefix first
+	byAddr   map[netip.Addr]string
+	networks []clientNetwork
+}
+
+type clientNetwork struct {
+	prefix netip.Prefix
+	name   string
+}
+
+// Whether the inventory still describes the file with info
+func (inv *clientInventory) current(path string, info os.FileInfo) bool {
+	return inv != nil && inv.path == path && inv.size == info.Size() && inv.modTime.Equal(info.ModTime()) &&
+		inv.builtAt.Sub(inv.modTime) > inventorySettleTime
+}
+
+// The inventory of the server config, rebuilt when the file has changed
+func currentInventory() (*clientInventory, error) {
+	inventoryMutex.Lock()
+	defer inventoryMutex.Unlock()
+
+	path := WG_CONFIG_FILE
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	if inventoryData.current(path, info) {
+		return inventoryData, nil
+	}
+
+	builtAt := time.Now()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	inv := &clientInventory{
+		path:    path,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		builtAt: builtAt,
+		names:   make(map[string]bool),
+		keys:    make(map[string]string),
+		byKey:   make(map[string]string),
+		byAddr:  make(map[netip.Addr]string),
+	}
+	// The first section with a name or key wins, as in the scans before
+	for _, section := range scanClientSections(content) {
+		inv.names[section.name] = true
+		inv.addAllowedIPs(section.name, section.allowedIPs)
+		if section.publicKey == "" {
+			continue
+		}
+		if _, ok := inv.keys[section.name]; !ok {
+			inv.keys[section.name] = section.publicKey
+		}
+		if _, ok := inv.byKey[section.publicKey]; !ok {
+			inv.byKey[section.publicKey] = section.name
+		}
+	}
+	sort.SliceStable(inv.networks, func(i, j int) bool {
+		return inv.networks[i].prefix.Bits() > inv.networks[j].prefix.Bits()
+	})
+	// Stat before reading, so a write in between only makes it rebuild again
+	inventoryData = inv
+	return inv, nil
+}
+
+func (inv *clientInventory) addAllowedIPs(name, allowedIPs string) {
+	for _, value := range strings.Split(allowedIPs, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(value))
+		if err != nil {
+			continue
+		}
+		prefix = prefix.Masked()
+		if prefix.IsSingleIP() {
+			if _, ok := inv.byAddr[prefix.Addr()]; !ok {
+				inv.byAddr[prefix.Addr()] = name
+			}
+			continue
+		}
+		inv.networks = append(inv.networks, clientNetwork{prefix: prefix, name: name})
+	}
+}
+
+// The client owning addr, as its address or within a routed subnet, and
+// the AllowedIPs entry it matched
+func (inv *clientInventory) ownerOf(addr netip.Addr) (string, netip.Prefix, bool) {
+	addr = addr.Unmap()
+	if name, ok := inv.byAddr[addr]; ok {
+		return name, netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	for _, network := range inv.networks {
+		if network.prefix.Contains(addr) {
+			return network.name, network.prefix, true
+		}
+	}
+	return "", netip.Prefix{}, false
+}
+
+// The "### Client" names a client can have in the server config
+func clientSectionNames(name string) []string {
+	return []string{
+		name,
+		"wg0-client-" + name,
+		"awg0-client-" + name,
+		wgParams.ServerWGNIC + "-client-" + name,
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInventoryLookups(t *testing.T) {
+	env := setupTestEnv(t)
+	for _, name := range []string{"alice", "bob"} {
+		env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name})
+	}
+
+	key := findPublicKeyByClientName("alice")
+	if key == "" || findClientNameByPublicKey(key) != "alice" {
+		t.Fatalf("alice must be found by name and key, got key %q", key)
+	}
+	if exists, err := clientExists("bob"); err != nil || !exists {
+		t.Errorf("bob must exist: %v", err)
+	}
+
+	// A disabled client still exists but has no peer
+	wgConfigMutex.Lock()
+	setClientEnabledLocked("bob", false)
+	wgConfigMutex.Unlock()
+	if exists, _ := clientExists("bob"); !exists || findPublicKeyByClientName("bob") != "" {
+		t.Error("disabled bob must exist without a key")
+	}
+}
+
+func TestInventoryFollowsConfigChanges(t *testing.T) {
+	env := setupTestEnv(t)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	key := findPublicKeyByClientName("alice")
+
+	// Once the config has settled the inventory is reused
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(WG_CONFIG_FILE, old, old)
+	first, _ := currentInventory()
+	if second, _ := currentInventory(); first != second {
+		t.Error("a settled config must not be indexed again")
+	}
+
+	// A same-size edit right after indexing is still seen
+	content := strings.Replace(env.configContent(t), "### Client alice", "### Client carol", 1)
+	os.WriteFile(WG_CONFIG_FILE, []byte(content), 0600)
+	currentInventory()
+	content = strings.Replace(content, "### Client carol", "### Client david", 1)
+	os.WriteFile(WG_CONFIG_FILE, []byte(content), 0600)
+	if name := findClientNameByPublicKey(key); name != "david" {
+		t.Errorf("got %q for alice's key, want david", name)
+	}
+	if exists, _ := clientExists("carol"); exists {
+		t.Error("carol must be gone")
+	}
+}
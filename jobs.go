@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Restarting the service, re-rendering a large group's configs or syncing a
+// directory can take minutes, longer than proxies and clients like to hold
+// a connection. With ?async=true such a request answers 202 with a job
+// right away and runs in the background, replayed through the router like
+// an approved change, and GET /jobs/:id reports its progress and result.
+// Without it they still answer when done, as v1 integrations expect. Jobs
+// live in memory and finished ones are dropped after JOB_TTL.
+
+// Routes that can run as jobs, relative to the API version prefix
+var asyncRoutes = map[string]bool{
+	"POST /start":                     true,
+	"POST /stop":                      true,
+	"POST /restart":                   true,
+	"POST /groups/:group/apply":       true,
+	"POST /ldap-sync":                 true,
+	"POST /schedules/:job/run":        true,
+	"POST /users/import":              true,
+	"POST /server/regenerate-clients": true,
+	"POST /server/teardown":           true,
+}
+
+// A request running in the background
+type Job struct {
+	ID         string       `json:"id"`
+	Method     string       `json:"method"`
+	Path       string       `json:"path"`
+	Status     string       `json:"status"` // queued, running, succeeded or failed
+	Progress   *JobProgress `json:"progress,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	FinishedAt *time.Time   `json:"finished_at,omitempty"`
+	// HTTP status and body of the request's response
+	ResultStatus int             `json:"result_status,omitempty"`
+	Result       json.RawMessage `json:"result,omitempty"`
+	// When a job queued for a maintenance window runs
+	RunAt *time.Time `json:"run_at,omitempty"`
+}
+
+// Items of a job done so far, for handlers that report them
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+type jobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+var jobs = &jobStore{jobs: map[string]*Job{}}
+
+// Set on the context of requests running as a job, holding its ID
+type jobKey struct{}
+
+// Wait for a queued job's time; a var so tests can skip the wait
+var waitUntil = func(at time.Time) { time.Sleep(time.Until(at)) }
+
+// Drop finished jobs older than JOB_TTL. Caller holds mu.
+func (s *jobStore) pruneLocked(now time.Time) {
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > JOB_TTL {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// A copy of a job, nil when there is none
+func (s *jobStore) get(id string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(time.Now())
+
+	job := s.jobs[id]
+	if job == nil {
+		return nil
+	}
+	snapshot := *job
+	if job.Progress != nil {
+		progress := *job.Progress
+		snapshot.Progress = &progress
+	}
+	return &snapshot
+}
+
+// Report how far the request's job is; does nothing outside jobs
+func reportJobProgress(c *gin.Context, done, total int) {
+	if c == nil {
+		return
+	}
+	id, ok := c.Request.Context().Value(jobKey{}).(string)
+	if !ok {
+		return
+	}
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	if job := jobs.jobs[id]; job != nil {
+		job.Progress = &JobProgress{Done: done, Total: total}
+	}
+}
+
+// Run ?async=true requests to async routes in the background, and those
+// queued for the next maintenance window. Comes after confirmation, so only
+// confirmed requests become jobs, and after idempotency, so a retry gets
+// the same job instead of starting another.
+func jobsMiddleware(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		runAt, queued := windowQueuedUntil(c)
+		if (c.Query("async") != "true" && !queued) || !asyncRoutes[apiRoute(c)] || serviceDryRun(c) || c.Request.Context().Value(jobKey{}) != nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "Failed to read request body",
+			})
+			return
+		}
+		id, err := randomHex(8)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+
+		now := time.Now()
+		job := &Job{
+			ID:        id,
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Status:    "running",
+			CreatedAt: now.UTC(),
+		}
+		message := "Job started"
+		if queued {
+			job.Status = "queued"
+			job.RunAt = &runAt
+			message = "Job queued until the next maintenance window"
+		}
+		snapshot := *job
+		jobs.mu.Lock()
+		jobs.pruneLocked(now)
+		jobs.jobs[id] = job
+		jobs.mu.Unlock()
+
+		// The job outlives this request, so it can't use its context. It
+		// was confirmed already, and must not replay this one's key.
+		ctx := context.WithValue(context.Background(), jobKey{}, id)
+		ctx = context.WithValue(ctx, confirmedRequestKey{}, true)
+		if queued {
+			ctx = context.WithValue(ctx, windowQueuedKey{}, true)
+		}
+		req, err := http.NewRequestWithContext(ctx, c.Request.Method, c.Request.URL.String(), bytes.NewReader(body))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+		req.Header = c.Request.Header.Clone()
+		req.Header.Del("Idempotency-Key")
+		req.Header.Del("X-Confirm-Token")
+		go runJob(router, job, req)
+
+		version := "v1"
+		if apiV2(c) {
+			version = "v2"
+		}
+		c.Header("Location", "/api/"+version+"/jobs/"+id)
+		c.AbortWithStatusJSON(http.StatusAccepted, APIResponse{
+			Success: true,
+			Message: message,
+			Data:    snapshot,
+		})
+	}
+}
+
+// Run a job's request and record its response
+func runJob(router *gin.Engine, job *Job, req *http.Request) {
+	if job.RunAt != nil {
+		waitUntil(*job.RunAt)
+		jobs.mu.Lock()
+		job.Status = "running"
+		jobs.mu.Unlock()
+	}
+
+	resp := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	router.ServeHTTP(resp, req)
+
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	job.ResultStatus = resp.status
+	job.Status = "succeeded"
+	if resp.status >= http.StatusBadRequest {
+		job.Status = "failed"
+	}
+	if json.Valid(resp.body.Bytes()) {
+		job.Result = resp.body.Bytes()
+	}
+}
+
+// Handler returning a job's progress, and its result once finished
+func jobHandlerGin(c *gin.Context) {
+	job := jobs.get(c.Param("id"))
+	if job == nil {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Job not found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    job,
+	})
+}
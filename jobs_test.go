@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Poll a job until it has finished
+func waitForJob(t *testing.T, env *testEnv, id string) Job {
+	t.Helper()
+	var resp struct {
+		Data Job `json:"data"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rec := env.authedRequest(t, http.MethodGet, "/api/v1/jobs/"+id, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("polling job: got status %d: %s", rec.Code, rec.Body.String())
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if resp.Data.Status != "running" && resp.Data.Status != "queued" {
+			return resp.Data
+		}
+	}
+	t.Fatalf("job %s didn't finish", id)
+	return resp.Data
+}
+
+func TestAsyncJobs(t *testing.T) {
+	env := setupTestEnv(t)
+	env.authedRequest(t, http.MethodPost, "/api/v1/groups/add", GroupRequest{Name: "staff"})
+	for _, name := range []string{"alice", "bob"} {
+		env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name, Group: "staff"})
+	}
+
+	// Applying answers with a job right away and the result comes later
+	apply := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/groups/staff/apply?async=true", bytes.NewReader(nil))
+		req.Header.Set("key", "test-token")
+		req.Header.Set("Idempotency-Key", "apply-1")
+		rec := httptest.NewRecorder()
+		env.router.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := apply()
+	var resp struct {
+		Data Job `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusAccepted || resp.Data.ID == "" || rec.Header().Get("Location") != "/api/v1/jobs/"+resp.Data.ID {
+		t.Fatalf("async apply: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	job := waitForJob(t, env, resp.Data.ID)
+	if job.Status != "succeeded" || job.ResultStatus != http.StatusOK || !strings.Contains(string(job.Result), `"success":true`) {
+		t.Errorf("unexpected job: %+v, result %s", job, job.Result)
+	}
+	if job.Progress == nil || job.Progress.Done != 2 || job.Progress.Total != 2 {
+		t.Errorf("unexpected progress: %+v", job.Progress)
+	}
+
+	// A retry gets the same job
+	json.Unmarshal(apply().Body.Bytes(), &resp)
+	if resp.Data.ID != job.ID {
+		t.Errorf("retry started job %s, want %s", resp.Data.ID, job.ID)
+	}
+
+	// A failed request fails its job
+	json.Unmarshal(env.authedRequest(t, http.MethodPost, "/api/v1/groups/missing/apply?async=true", nil).Body.Bytes(), &resp)
+	if job := waitForJob(t, env, resp.Data.ID); job.Status != "failed" || job.ResultStatus != http.StatusNotFound {
+		t.Errorf("unexpected job: %+v", job)
+	}
+
+	// Without async, or on other routes, requests answer when done
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/groups/staff/apply", nil).Code; code != http.StatusOK {
+		t.Errorf("sync apply: got status %d, want 200", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add?async=true", AddUserRequest{Name: "carol"}).Code; code != http.StatusOK {
+		t.Errorf("add with async: got status %d, want 200", code)
+	}
+	if code := env.authedRequest(t, http.MethodGet, "/api/v1/jobs/missing", nil).Code; code != http.StatusNotFound {
+		t.Errorf("unknown job: got status %d, want 404", code)
+	}
+}
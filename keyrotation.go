@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Periodic key rotation for compliance: every client whose keys are older
+// than KEY_ROTATION_INTERVAL gets a new preshared key, and with
+// KEY_ROTATION_KEYPAIRS a new key pair too. Its old config stops working,
+// so it is marked as needing redistribution until an admin confirms the
+// new config was delivered or its portal user downloads it, and
+// KEY_ROTATION_WEBHOOK is told which clients were rotated. The configs
+// themselves are never sent anywhere.
+//
+// The age of a client's keys counts from its last rotation, scheduled or
+// through the API or portal. Clients that predate the policy count from
+// when it first saw them, so turning it on doesn't rotate everything at
+// once.
+
+// How often the policy looks for clients due for rotation
+const keyRotationCheckInterval = time.Hour
+
+type KeyRotation struct {
+	RotatedAt time.Time `json:"rotated_at"`
+	// Set by a scheduled rotation, cleared once the config was delivered
+	NeedsRedistribution bool `json:"needs_redistribution,omitempty"`
+}
+
+// A client's rotation state as listed by the API
+type KeyRotationStatus struct {
+	Name string `json:"name"`
+	KeyRotation
+	DueAt *time.Time `json:"due_at,omitempty"`
+}
+
+var keyRotationMutex sync.Mutex
+
+// KEY_ROTATION_FILE, or key-rotation.json next to the server config
+func keyRotationFile() string {
+	if KEY_ROTATION_FILE != "" {
+		return KEY_ROTATION_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "key-rotation.json")
+}
+
+// Caller holds keyRotationMutex
+func loadKeyRotationsLocked() (map[string]*KeyRotation, error) {
+	rotations := make(map[string]*KeyRotation)
+	content, err := os.ReadFile(keyRotationFile())
+	if os.IsNotExist(err) {
+		return rotations, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key rotation file: %v", err)
+	}
+	if err := json.Unmarshal(content, &rotations); err != nil {
+		return nil, fmt.Errorf("failed to parse key rotation file: %v", err)
+	}
+	return rotations, nil
+}
+
+// Caller holds keyRotationMutex
+func saveKeyRotationsLocked(rotations map[string]*KeyRotation) error {
+	content, err := json.MarshalIndent(rotations, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyRotationFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write key rotation file: %v", err)
+	}
+	return nil
+}
+
+// Record that the clients got new keys now. Rotations through the API or
+// portal hand the new config over right away, scheduled ones don't.
+func markKeysRotated(names []string, now time.Time, needsRedistribution bool) error {
+	keyRotationMutex.Lock()
+	defer keyRotationMutex.Unlock()
+
+	rotations, err := loadKeyRotationsLocked()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		rotations[name] = &KeyRotation{RotatedAt: now.UTC(), NeedsRedistribution: needsRedistribution}
+	}
+	return saveKeyRotationsLocked(rotations)
+}
+
+// Clear the client's redistribution mark; errClientNotFound when it had none
+func markKeysRedistributed(name string) error {
+	keyRotationMutex.Lock()
+	defer keyRotationMutex.Unlock()
+
+	rotations, err := loadKeyRotationsLocked()
+	if err != nil {
+		return err
+	}
+	rotation := rotations[name]
+	if rotation == nil || !rotation.NeedsRedistribution {
+		return errClientNotFound
+	}
+	rotation.NeedsRedistribution = false
+	return saveKeyRotationsLocked(rotations)
+}
+
+// Rotate the keys of the clients due at now, sync once, and return their
+// names. Clients seen for the first time start their schedule, and those
+// deleted are forgotten.
+func rotateDueKeys(now time.Time) ([]string, error) {
+	clients, err := listClients(false)
+	if err != nil {
+		return nil, err
+	}
+
+	keyRotationMutex.Lock()
+	defer keyRotationMutex.Unlock()
+
+	rotations, err := loadKeyRotationsLocked()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(clients))
+	due := []string{}
+	for _, client := range clients {
+		present[client.Name] = true
+		rotation := rotations[client.Name]
+		if rotation == nil {
+			rotations[client.Name] = &KeyRotation{RotatedAt: now.UTC()}
+		} else if now.Sub(rotation.RotatedAt) >= KEY_ROTATION_INTERVAL {
+			due = append(due, client.Name)
+		}
+	}
+	for name := range rotations {
+		if !present[name] {
+			delete(rotations, name)
+		}
+	}
+	sort.Strings(due)
+
+	rotated, syncErr := rotateKeys(due)
+	for _, name := range rotated {
+		rotations[name] = &KeyRotation{RotatedAt: now.UTC(), NeedsRedistribution: true}
+	}
+	if err := saveKeyRotationsLocked(rotations); err != nil {
+		return rotated, err
+	}
+	return rotated, syncErr
+}
+
+// Give the clients new keys under one lock and sync once. Clients that
+// fail are logged and left for the next check, and without
+// KEY_ROTATION_KEYPAIRS clients without a preshared key are skipped.
+func rotateKeys(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+
+	rotated := []string{}
+	for _, name := range names {
+		// Giving a client created without a preshared key one would break it
+		if !KEY_ROTATION_KEYPAIRS && !clientHasPresharedKey(content, name) {
+			continue
+		}
+		var keys clientKeys
+		var err error
+		if KEY_ROTATION_KEYPAIRS {
+			keys, err = generateClientKeys()
+		} else {
+			keys.preSharedKey, err = generatePSK()
+		}
+		if err == nil {
+			_, err = replaceClientKeysLocked(name, keys)
+		}
+		if err != nil {
+			log.Printf("Key rotation: %s: %v", name, err)
+			continue
+		}
+		rotated = append(rotated, name)
+	}
+	if len(rotated) == 0 {
+		return rotated, nil
+	}
+
+	// The files have the new keys either way, so the clients count as rotated
+	if err := syncWireGuardConf(); err != nil {
+		return rotated, fmt.Errorf("failed to sync WireGuard config: %w", err)
+	}
+	return rotated, nil
+}
+
+// POST the rotated client names to KEY_ROTATION_WEBHOOK
+func notifyKeyRotation(names []string, now time.Time) error {
+	if KEY_ROTATION_WEBHOOK == "" {
+		return nil
+	}
+
+	return postWebhook(KEY_ROTATION_WEBHOOK, map[string]interface{}{
+		"event":      "keys_rotated",
+		"rotated_at": now.UTC().Format(time.RFC3339),
+		"keypairs":   KEY_ROTATION_KEYPAIRS,
+		"clients":    names,
+	})
+}
+
+// Rotate due keys every keyRotationCheckInterval, or on the job's schedule,
+// when KEY_ROTATION_INTERVAL is set. Only the leader changes keys.
+func startKeyRotation() {
+	if KEY_ROTATION_INTERVAL <= 0 {
+		return
+	}
+
+	scheduleJob(jobKeyRotation, keyRotationCheckInterval, true, func() error {
+		return runKeyRotation(time.Now())
+	})
+}
+
+// Returns the rotation's error; the clients rotated before it are notified
+// all the same
+func runKeyRotation(now time.Time) error {
+	rotated, err := rotateDueKeys(now)
+	if err != nil {
+		log.Printf("Key rotation: %v", err)
+	}
+	if len(rotated) == 0 {
+		return err
+	}
+	log.Printf("Key rotation: rotated %d clients", len(rotated))
+	if err := notifyKeyRotation(rotated, now); err != nil {
+		log.Printf("Key rotation webhook: %v", err)
+	}
+	return err
+}
+
+// Handler listing the policy and each client's rotation state
+func keyRotationHandlerGin(c *gin.Context) {
+	keyRotationMutex.Lock()
+	rotations, err := loadKeyRotationsLocked()
+	keyRotationMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	clients := make([]KeyRotationStatus, 0, len(rotations))
+	for name, rotation := range rotations {
+		status := KeyRotationStatus{Name: name, KeyRotation: *rotation}
+		if KEY_ROTATION_INTERVAL > 0 {
+			due := rotation.RotatedAt.Add(KEY_ROTATION_INTERVAL)
+			status.DueAt = &due
+		}
+		clients = append(clients, status)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"enabled":  KEY_ROTATION_INTERVAL > 0,
+			"interval": KEY_ROTATION_INTERVAL.String(),
+			"keypairs": KEY_ROTATION_KEYPAIRS,
+			"clients":  clients,
+		},
+	})
+}
+
+// Handler confirming a rotated client's new config was delivered
+func keysRedistributedHandlerGin(c *gin.Context) {
+	err := markKeysRedistributed(c.Param("name"))
+	if err == errClientNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client has no config awaiting redistribution",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Marked as redistributed",
+	})
+}
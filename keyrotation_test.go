@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func setKeyRotation(t *testing.T, interval time.Duration, keypairs bool, webhook string) {
+	t.Helper()
+	oldInterval, oldKeypairs, oldWebhook := KEY_ROTATION_INTERVAL, KEY_ROTATION_KEYPAIRS, KEY_ROTATION_WEBHOOK
+	t.Cleanup(func() {
+		KEY_ROTATION_INTERVAL, KEY_ROTATION_KEYPAIRS, KEY_ROTATION_WEBHOOK = oldInterval, oldKeypairs, oldWebhook
+	})
+	KEY_ROTATION_INTERVAL, KEY_ROTATION_KEYPAIRS, KEY_ROTATION_WEBHOOK = interval, keypairs, webhook
+}
+
+// The key line of the client's server block
+func peerKey(t *testing.T, env *testEnv, name, key string) string {
+	t.Helper()
+	block := regexp.MustCompile(`(?ms)^### Client ` + name + `\n.*?^$`).FindString(env.configContent(t))
+	return regexp.MustCompile(`(?m)^` + key + ` = .*$`).FindString(block)
+}
+
+func keyRotationState(t *testing.T, env *testEnv) map[string]KeyRotationStatus {
+	t.Helper()
+	var resp struct {
+		Data struct {
+			Clients []KeyRotationStatus `json:"clients"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/key-rotation", nil).Body.Bytes(), &resp)
+	state := map[string]KeyRotationStatus{}
+	for _, client := range resp.Data.Clients {
+		state[client.Name] = client
+	}
+	return state
+}
+
+func TestScheduledKeyRotation(t *testing.T) {
+	env := setupTestEnv(t)
+	var notified []map[string]interface{}
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&event)
+		notified = append(notified, event)
+	}))
+	defer webhook.Close()
+	setKeyRotation(t, 24*time.Hour, false, webhook.URL)
+	for _, name := range []string{"alice", "bob"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("seeding %s failed with status %d", name, code)
+		}
+	}
+
+	// Existing clients start their schedule instead of rotating right away
+	start := time.Now().Add(-12 * time.Hour)
+	runKeyRotation(start)
+	if len(notified) != 0 || keyRotationState(t, env)["alice"].NeedsRedistribution {
+		t.Fatal("clients seen for the first time must not be rotated")
+	}
+
+	// bob was rotated by hand since, so only alice is due
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/bob/rotate-psk", nil).Code; code != http.StatusOK {
+		t.Fatalf("rotating bob failed with status %d", code)
+	}
+	publicKey, psk := peerKey(t, env, "alice", "PublicKey"), peerKey(t, env, "alice", "PresharedKey")
+	bobPSK := peerKey(t, env, "bob", "PresharedKey")
+	runKeyRotation(start.Add(25 * time.Hour))
+
+	if peerKey(t, env, "alice", "PresharedKey") == psk || peerKey(t, env, "alice", "PublicKey") != publicKey {
+		t.Error("alice must get a new preshared key and keep her key pair")
+	}
+	if peerKey(t, env, "bob", "PresharedKey") != bobPSK {
+		t.Error("bob isn't due yet")
+	}
+	if len(notified) != 1 || notified[0]["event"] != "keys_rotated" || len(notified[0]["clients"].([]interface{})) != 1 || notified[0]["clients"].([]interface{})[0] != "alice" {
+		t.Errorf("unexpected notifications: %v", notified)
+	}
+	state := keyRotationState(t, env)
+	if !state["alice"].NeedsRedistribution || state["bob"].NeedsRedistribution || state["alice"].DueAt == nil {
+		t.Errorf("unexpected state: %+v", state)
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/redistributed", nil).Code; code != http.StatusOK {
+		t.Errorf("redistributed: got status %d, want 200", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/redistributed", nil).Code; code != http.StatusNotFound {
+		t.Errorf("second redistributed: got status %d, want 404", code)
+	}
+
+	// Deleted clients are forgotten
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "bob"}).Code; code != http.StatusOK {
+		t.Fatalf("deleting bob failed with status %d", code)
+	}
+	runKeyRotation(start.Add(26 * time.Hour))
+	if _, ok := keyRotationState(t, env)["bob"]; ok {
+		t.Error("bob must be forgotten once deleted")
+	}
+}
+
+func TestScheduledKeyPairRotation(t *testing.T) {
+	env := setupTestEnv(t)
+	setKeyRotation(t, time.Hour, true, "")
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding failed with status %d", code)
+	}
+
+	now := time.Now()
+	runKeyRotation(now)
+	publicKey := peerKey(t, env, "alice", "PublicKey")
+	rotated, err := rotateDueKeys(now.Add(time.Hour))
+	if err != nil || len(rotated) != 1 {
+		t.Fatalf("rotated %v: %v", rotated, err)
+	}
+	if peerKey(t, env, "alice", "PublicKey") == publicKey {
+		t.Error("KEY_ROTATION_KEYPAIRS must replace the key pair")
+	}
+}
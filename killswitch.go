@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A kill switch in a client config rejects traffic that would leave the
+// client outside the tunnel, so nothing leaks while the tunnel is down or
+// reconnecting. These are the rules from the wg-quick man page: wg-quick
+// marks the tunnel's own packets with the interface's fwmark, and anything
+// else not going out of the interface or to a local address is rejected.
+// wg-quick only sets the fwmark for a full-tunnel AllowedIPs, so configs
+// routing only some networks through the tunnel get no kill switch. The
+// rules are PostUp/PreDown lines, which only wg-quick runs; the Windows app
+// blocks untunneled traffic on its own, and the mobile apps ignore them.
+
+const (
+	killSwitchOff      = "off"
+	killSwitchIPTables = "iptables"
+	killSwitchNft      = "nft"
+)
+
+// Check a kill switch setting: CLIENT_KILL_SWITCH or a client's override,
+// where empty means the default
+func validateKillSwitch(mode string) error {
+	switch mode {
+	case "", killSwitchOff, killSwitchIPTables, killSwitchNft:
+		return nil
+	}
+	return fmt.Errorf("kill switch must be %s, %s or %s", killSwitchIPTables, killSwitchNft, killSwitchOff)
+}
+
+// The override, or CLIENT_KILL_SWITCH when it is empty
+func killSwitchFor(override string) string {
+	if override != "" {
+		return override
+	}
+	if CLIENT_KILL_SWITCH == "" {
+		return killSwitchOff
+	}
+	return CLIENT_KILL_SWITCH
+}
+
+// Whether the client routes everything through the tunnel, so wg-quick
+// sets the fwmark the rules rely on
+func fullTunnel(allowedIPs string) bool {
+	for _, network := range splitList(allowedIPs) {
+		if network == "0.0.0.0/0" || network == "::/0" {
+			return true
+		}
+	}
+	return false
+}
+
+// [Interface] lines for the kill switch; none when it is off or the client
+// isn't full-tunnel
+func renderKillSwitch(params WGParams, backend, mode string) []string {
+	if mode == killSwitchOff || !fullTunnel(params.AllowedIPs) {
+		return nil
+	}
+	wg := "wg"
+	if backend == "amneziawg" {
+		wg = "awg"
+	}
+	fwmark := fmt.Sprintf("$(%s show %%i fwmark)", wg)
+
+	if mode == killSwitchNft {
+		table := "inet killswitch_%i"
+		return []string{
+			fmt.Sprintf("PostUp = nft add table %s && nft add chain %s output '{ type filter hook output priority 0; policy accept; }' && nft add rule %s output oifname != %%i meta mark != %s fib daddr type != local reject",
+				table, table, table, fwmark),
+			fmt.Sprintf("PreDown = nft delete table %s", table),
+		}
+	}
+
+	rule := func(action string) string {
+		rules := make([]string, 0, 2)
+		for _, cmd := range []string{"iptables", "ip6tables"} {
+			rules = append(rules, fmt.Sprintf("%s %s OUTPUT ! -o %%i -m mark ! --mark %s -m addrtype ! --dst-type LOCAL -j REJECT", cmd, action, fwmark))
+		}
+		return strings.Join(rules, " && ")
+	}
+	return []string{"PostUp = " + rule("-I"), "PreDown = " + rule("-D")}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestKillSwitchRendering(t *testing.T) {
+	full := WGParams{AllowedIPs: "0.0.0.0/0,::/0"}
+	iptables := renderKillSwitch(full, "wireguard", killSwitchIPTables)
+	if len(iptables) != 2 ||
+		iptables[0] != "PostUp = iptables -I OUTPUT ! -o %i -m mark ! --mark $(wg show %i fwmark) -m addrtype ! --dst-type LOCAL -j REJECT && ip6tables -I OUTPUT ! -o %i -m mark ! --mark $(wg show %i fwmark) -m addrtype ! --dst-type LOCAL -j REJECT" ||
+		!strings.HasPrefix(iptables[1], "PreDown = iptables -D OUTPUT") {
+		t.Errorf("iptables kill switch: %q", iptables)
+	}
+
+	nft := renderKillSwitch(full, "amneziawg", killSwitchNft)
+	if len(nft) != 2 || !strings.Contains(nft[0], "meta mark != $(awg show %i fwmark) fib daddr type != local reject") ||
+		nft[1] != "PreDown = nft delete table inet killswitch_%i" {
+		t.Errorf("nft kill switch: %q", nft)
+	}
+
+	// Without the fwmark of a full tunnel the rules would block everything
+	if lines := renderKillSwitch(WGParams{AllowedIPs: "10.0.0.0/8"}, "wireguard", killSwitchNft); lines != nil {
+		t.Errorf("split tunnel must get no kill switch: %q", lines)
+	}
+	if lines := renderKillSwitch(full, "wireguard", killSwitchOff); lines != nil {
+		t.Errorf("off must render nothing: %q", lines)
+	}
+}
+
+func TestAddUserWithKillSwitch(t *testing.T) {
+	env := setupTestEnv(t)
+	CLIENT_KILL_SWITCH = killSwitchNft
+	t.Cleanup(func() { CLIENT_KILL_SWITCH = "" })
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice", KillSwitch: "pf"}).Code; code != http.StatusBadRequest {
+		t.Errorf("unknown kill switch: got status %d, want 400", code)
+	}
+
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Body.Bytes(), &resp)
+	if !strings.Contains(resp.Data.Config, "PostUp = nft add table inet killswitch_%i") {
+		t.Errorf("default kill switch missing:\n%s", resp.Data.Config)
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob", KillSwitch: killSwitchOff}).Body.Bytes(), &resp)
+	if strings.Contains(resp.Data.Config, "PostUp") {
+		t.Errorf("kill switch must be off for bob:\n%s", resp.Data.Config)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Group mappings let directory groups decide what a synced client may do:
+// the project it is in (and with it isolation and the routing profile),
+// the destinations its firewall policy allows, and how many devices its
+// user gets. A user in several mapped groups gets the first mapping in
+// LDAP_GROUP_MAPPINGS they match, so list the most specific groups first.
+//
+// With mappings configured, the sync owns the project and the firewall
+// policy of the clients it created: a user who leaves a mapped group
+// loses its project and policy on the next sync, and changes an admin
+// makes to them by hand are overwritten. Groups come from memberOf, which
+// lists direct memberships only; nested groups don't count.
+
+// A directory group and what its members' clients get
+type LDAPGroupMapping struct {
+	// Group DN, compared case-insensitively with memberOf
+	Group string `yaml:"group" json:"group"`
+	// Project the clients are put in; created when missing
+	Project string `yaml:"project" json:"project,omitempty"`
+	// Firewall policy of the clients; unrestricted when nil
+	Firewall *FirewallPolicy `yaml:"firewall" json:"firewall,omitempty"`
+	// Clients per user; LDAP_DEVICES_PER_USER when 0
+	Devices int `yaml:"devices" json:"devices,omitempty"`
+}
+
+// Loaded from LDAP_GROUP_MAPPINGS, in priority order
+var ldapGroupMappings []LDAPGroupMapping
+
+func loadLDAPGroupMappings() error {
+	if LDAP_GROUP_MAPPINGS == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(LDAP_GROUP_MAPPINGS)
+	if err != nil {
+		return fmt.Errorf("failed to read LDAP group mappings: %v", err)
+	}
+	var file struct {
+		Mappings []LDAPGroupMapping `yaml:"mappings"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("failed to parse LDAP group mappings: %v", err)
+	}
+
+	for _, mapping := range file.Mappings {
+		if mapping.Group == "" {
+			return fmt.Errorf("LDAP group mappings: a mapping has no group")
+		}
+		if mapping.Project != "" && !clientNameRegex.MatchString(mapping.Project) {
+			return fmt.Errorf("LDAP group mappings: project name %q %s", mapping.Project, invalidClientNameMessage)
+		}
+		if mapping.Devices < 0 {
+			return fmt.Errorf("LDAP group mappings: devices of %s must not be negative", mapping.Group)
+		}
+		if mapping.Firewall != nil {
+			for _, rule := range mapping.Firewall.Allow {
+				if err := validateFirewallRule(rule); err != nil {
+					return fmt.Errorf("LDAP group mappings: firewall of %s: %v", mapping.Group, err)
+				}
+			}
+		}
+	}
+	ldapGroupMappings = file.Mappings
+	return nil
+}
+
+// The first mapping matching one of a user's groups, nil when none does
+func ldapMappingFor(groups []string) *LDAPGroupMapping {
+	for i := range ldapGroupMappings {
+		for _, group := range groups {
+			if strings.EqualFold(group, ldapGroupMappings[i].Group) {
+				return &ldapGroupMappings[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Clients per user under a mapping
+func (m *LDAPGroupMapping) devices() int {
+	if m != nil && m.Devices > 0 {
+		return m.Devices
+	}
+	return LDAP_DEVICES_PER_USER
+}
+
+// Put synced clients in the project and firewall policy of their mapping,
+// nil meaning none. Returns the clients that changed. Caller holds
+// wgConfigMutex and syncs afterwards, which applies the firewall.
+func applyLDAPMappingsLocked(clients map[string]*LDAPGroupMapping) ([]string, error) {
+	updated := make(map[string]bool)
+
+	err := func() error {
+		firewallMutex.Lock()
+		defer firewallMutex.Unlock()
+
+		policies, err := loadFirewallPoliciesLocked()
+		if err != nil {
+			return err
+		}
+		changed := false
+		for name, mapping := range clients {
+			var want *FirewallPolicy
+			if mapping != nil {
+				want = mapping.Firewall
+			}
+			have, _ := json.Marshal(policies[name])
+			wanted, _ := json.Marshal(want)
+			if string(have) == string(wanted) {
+				continue
+			}
+			if want == nil {
+				delete(policies, name)
+			} else {
+				policy := *want
+				policies[name] = &policy
+			}
+			updated[name] = true
+			changed = true
+		}
+		if !changed {
+			return nil
+		}
+		return saveFirewallPoliciesLocked(policies)
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateProjects(func(projects map[string]*Project) error {
+		current := make(map[string]string)
+		for _, project := range projects {
+			for _, name := range project.Clients {
+				current[name] = project.Name
+			}
+		}
+		for name, mapping := range clients {
+			want := ""
+			if mapping != nil {
+				want = mapping.Project
+			}
+			if current[name] == want {
+				continue
+			}
+			if project := projects[current[name]]; project != nil {
+				project.Clients = without(project.Clients, []string{name})
+			}
+			if want != "" {
+				project := projects[want]
+				if project == nil {
+					project = &Project{Name: want, Description: "Created by the LDAP sync", Clients: []string{}, CreatedAt: time.Now().UTC()}
+					projects[want] = project
+				}
+				project.Clients = append(project.Clients, name)
+				sort.Strings(project.Clients)
+			}
+			updated[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(updated), nil
+}
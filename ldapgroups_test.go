@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testLDAPGroupMappings = `mappings:
+  - group: CN=Engineering,OU=Groups,DC=test
+    project: engineering
+    devices: 2
+    firewall:
+      allow:
+        - destination: 10.10.0.0/16
+          protocol: tcp
+          ports: [22, 443]
+  - group: cn=sales,ou=groups,dc=test
+    project: sales
+`
+
+func writeLDIF(t *testing.T, env *testEnv, ldif string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(env.dir, "ldap.ldif"), []byte(ldif), 0644); err != nil {
+		t.Fatalf("writing ldif: %v", err)
+	}
+}
+
+func TestLDAPGroupMappings(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeLDAP(t, env)
+	rulesPath := setupFakeNft(t, env)
+	LDAP_GROUP_MAPPINGS = filepath.Join(env.dir, "mappings.yml")
+	os.WriteFile(LDAP_GROUP_MAPPINGS, []byte(testLDAPGroupMappings), 0644)
+	t.Cleanup(func() { LDAP_GROUP_MAPPINGS, ldapGroupMappings = "", nil })
+	if err := loadLDAPGroupMappings(); err != nil {
+		t.Fatalf("loading mappings: %v", err)
+	}
+
+	// alice is in both mapped groups and gets the first mapping
+	writeLDIF(t, env, `dn: uid=alice,dc=test
+uid: alice
+memberOf: cn=engineering,ou=groups,dc=test
+memberOf: cn=sales,ou=groups,dc=test
+
+dn: uid=bob,dc=test
+uid: bob
+memberOf: cn=sales,ou=groups,dc=test
+
+dn: uid=carol,dc=test
+uid: carol
+`)
+	result := runLDAPSync(t, env, http.StatusOK)
+	if strings.Join(result.Created, ",") != "alice,alice-2,bob,carol" || strings.Join(result.Updated, ",") != "alice,alice-2,bob" {
+		t.Fatalf("first sync: %+v", result)
+	}
+	if args := readFile(t, filepath.Join(env.dir, "ldapsearch.args")); !strings.HasSuffix(args, "uid\nmemberOf\n") {
+		t.Errorf("memberOf must be requested:\n%s", args)
+	}
+
+	projects, _ := loadProjectsLocked()
+	if strings.Join(projects["engineering"].Clients, ",") != "alice,alice-2" || strings.Join(projects["sales"].Clients, ",") != "bob" {
+		t.Errorf("unexpected projects: %+v %+v", projects["engineering"], projects["sales"])
+	}
+	policies, _ := loadFirewallPoliciesLocked()
+	if policies["alice"] == nil || policies["alice"].Allow[0].Destination != "10.10.0.0/16" || policies["bob"] != nil || policies["carol"] != nil {
+		t.Errorf("unexpected firewall policies: %+v", policies)
+	}
+	if rules := readRules(t, rulesPath); !strings.Contains(rules, "ip daddr 10.10.0.0/16 tcp dport { 22, 443 } accept") {
+		t.Errorf("alice's policy must be installed:\n%s", rules)
+	}
+
+	// Nothing changes while the groups stay the same
+	if result := runLDAPSync(t, env, http.StatusOK); len(result.Updated) != 0 {
+		t.Errorf("second sync must change nothing: %+v", result)
+	}
+
+	// Leaving engineering drops the second device, the project and the policy
+	writeLDIF(t, env, `dn: uid=alice,dc=test
+uid: alice
+memberOf: cn=sales,ou=groups,dc=test
+
+dn: uid=bob,dc=test
+uid: bob
+memberOf: cn=sales,ou=groups,dc=test
+
+dn: uid=carol,dc=test
+uid: carol
+`)
+	result = runLDAPSync(t, env, http.StatusOK)
+	if strings.Join(result.Disabled, ",") != "alice-2" || strings.Join(result.Updated, ",") != "alice" {
+		t.Errorf("alice must move to sales: %+v", result)
+	}
+	projects, _ = loadProjectsLocked()
+	policies, _ = loadFirewallPoliciesLocked()
+	if strings.Join(projects["sales"].Clients, ",") != "alice,bob" || policies["alice"] != nil {
+		t.Errorf("alice must be in sales without a policy: %+v %+v", projects["sales"], policies["alice"])
+	}
+}
+
+func TestLDAPGroupMappingsValidation(t *testing.T) {
+	env := setupTestEnv(t)
+	LDAP_GROUP_MAPPINGS = filepath.Join(env.dir, "mappings.yml")
+	t.Cleanup(func() { LDAP_GROUP_MAPPINGS, ldapGroupMappings = "", nil })
+
+	for _, mappings := range []string{
+		"mappings:\n  - project: eng\n",
+		"mappings:\n  - group: cn=eng\n    project: eng team\n",
+		"mappings:\n  - group: cn=eng\n    firewall:\n      allow:\n        - destination: nowhere\n",
+	} {
+		os.WriteFile(LDAP_GROUP_MAPPINGS, []byte(mappings), 0644)
+		if err := loadLDAPGroupMappings(); err == nil {
+			t.Errorf("mappings must be rejected:\n%s", mappings)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The LDAP sync gives every member of LDAP_GROUP_DN a client (or
+// LDAP_DEVICES_PER_USER of them) and disables the clients of users who left
+// the group, so offboarded employees lose access without anyone touching
+// the VPN. The directory is queried with ldapsearch from the OpenLDAP
+// client tools, which works against OpenLDAP and Active Directory alike.
+//
+// Only clients the sync created are ever enabled or disabled by it; they
+// are remembered in LDAP_SYNC_FILE. A client with a member's name that was
+// created by hand is left alone and reported. Users who come back get
+// their old clients, keys and addresses back. Clients are disabled rather
+// than deleted, so an admin decides when to delete them.
+
+// ldapsearch binary, overridden in tests
+var ldapsearchCmd = "ldapsearch"
+
+type LDAPSkippedClient struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type LDAPSyncResult struct {
+	Time     time.Time           `json:"time"`
+	Members  int                 `json:"members"`
+	Created  []string            `json:"created"`
+	Enabled  []string            `json:"enabled"`
+	Disabled []string            `json:"disabled"`
+	Skipped  []LDAPSkippedClient `json:"skipped"`
+	Error    string              `json:"error,omitempty"`
+	// Clients whose project or firewall policy followed a group mapping
+	Updated []string `json:"updated,omitempty"`
+}
+
+var (
+	// Serializes syncs, so the timer and the endpoint never run one twice
+	ldapSyncMutex sync.Mutex
+	lastLDAPSync  *LDAPSyncResult
+
+	errLDAPNoMembers = errors.New("LDAP returned no members; refusing to disable every synced client")
+)
+
+// LDAP_SYNC_FILE, or ldap-sync.json next to the server config
+func ldapSyncFile() string {
+	if LDAP_SYNC_FILE != "" {
+		return LDAP_SYNC_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "ldap-sync.json")
+}
+
+// The synced clients, mapped to the user they belong to. Caller holds
+// ldapSyncMutex.
+func loadLDAPClientsLocked() (map[string]string, error) {
+	clients := make(map[string]string)
+	content, err := os.ReadFile(ldapSyncFile())
+	if os.IsNotExist(err) {
+		return clients, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read LDAP sync file: %v", err)
+	}
+	if err := json.Unmarshal(content, &clients); err != nil {
+		return nil, fmt.Errorf("failed to parse LDAP sync file: %v", err)
+	}
+	return clients, nil
+}
+
+// Caller holds ldapSyncMutex
+func saveLDAPClientsLocked(clients map[string]string) error {
+	content, err := json.MarshalIndent(clients, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ldapSyncFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write LDAP sync file: %v", err)
+	}
+	return nil
+}
+
+// Escape a value for use in a search filter (RFC 4515)
+func ldapEscape(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// The group members' filter, narrowed by LDAP_USER_FILTER when set
+func ldapFilter() string {
+	filter := "(memberOf=" + ldapEscape(LDAP_GROUP_DN) + ")"
+	if LDAP_USER_FILTER != "" {
+		filter = "(&" + filter + LDAP_USER_FILTER + ")"
+	}
+	return filter
+}
+
+// The entries of ldapsearch's LDIF output, each mapping lowercased
+// attribute names to their values
+func parseLDIFEntries(output string) ([]map[string][]string, error) {
+	var entries []map[string][]string
+	var entry map[string][]string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			entry = nil
+			continue
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		// "attr:: value" holds base64, used for non-ASCII values
+		if strings.HasPrefix(value, ":") {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value of %s: %v", name, err)
+			}
+			value = string(decoded)
+		}
+		if entry == nil {
+			entry = make(map[string][]string)
+			entries = append(entries, entry)
+		}
+		name = strings.ToLower(name)
+		entry[name] = append(entry[name], strings.TrimSpace(value))
+	}
+	return entries, nil
+}
+
+// The names of the group members, and each member's groups when there are
+// group mappings
+func searchLDAPMembers() ([]string, map[string][]string, error) {
+	args := []string{"-LLL", "-x", "-o", "ldif-wrap=no", "-H", LDAP_URL}
+	if LDAP_BIND_DN != "" {
+		args = append(args, "-D", LDAP_BIND_DN, "-y", LDAP_BIND_PASSWORD_FILE)
+	}
+	args = append(args, "-b", LDAP_BASE_DN, ldapFilter(), LDAP_NAME_ATTRIBUTE)
+	if len(ldapGroupMappings) > 0 {
+		args = append(args, "memberOf")
+	}
+	success, output := executeCommand(ldapsearchCmd, args...)
+	if success != "success" {
+		return nil, nil, fmt.Errorf("ldapsearch failed: %s", output)
+	}
+
+	entries, err := parseLDIFEntries(output)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups := make(map[string][]string, len(entries))
+	members := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names := entry[strings.ToLower(LDAP_NAME_ATTRIBUTE)]
+		if len(names) == 0 {
+			continue
+		}
+		if _, seen := groups[names[0]]; !seen {
+			members = append(members, names[0])
+		}
+		groups[names[0]] = append(groups[names[0]], entry["memberof"]...)
+	}
+	sort.Strings(members)
+	return members, groups, nil
+}
+
+// Client names of a user: the user name, then name-2, name-3, ...
+func ldapDeviceNames(user string, devices int) []string {
+	names := []string{user}
+	for i := 2; i <= devices; i++ {
+		names = append(names, user+"-"+strconv.Itoa(i))
+	}
+	return names
+}
+
+// Run one sync and remember its result
+func syncLDAP() *LDAPSyncResult {
+	ldapSyncMutex.Lock()
+	defer ldapSyncMutex.Unlock()
+
+	result := &LDAPSyncResult{
+		Time:     time.Now().UTC(),
+		Created:  []string{},
+		Enabled:  []string{},
+		Disabled: []string{},
+		Skipped:  []LDAPSkippedClient{},
+	}
+	if err := syncLDAPLocked(result); err != nil {
+		log.Printf("LDAP sync failed: %v", err)
+		result.Error = err.Error()
+	} else if len(result.Created)+len(result.Enabled)+len(result.Disabled)+len(result.Updated) > 0 {
+		log.Printf("LDAP sync: %d created, %d enabled, %d disabled, %d updated",
+			len(result.Created), len(result.Enabled), len(result.Disabled), len(result.Updated))
+	}
+	lastLDAPSync = result
+	return result
+}
+
+// Caller holds ldapSyncMutex
+func syncLDAPLocked(result *LDAPSyncResult) error {
+	members, groups, err := searchLDAPMembers()
+	if err != nil {
+		return err
+	}
+	result.Members = len(members)
+	managed, err := loadLDAPClientsLocked()
+	if err != nil {
+		return err
+	}
+	if len(members) == 0 && len(managed) > 0 {
+		return errLDAPNoMembers
+	}
+
+	wanted := make(map[string]string)
+	mappings := make(map[string]*LDAPGroupMapping)
+	for _, user := range members {
+		mappings[user] = ldapMappingFor(groups[user])
+		for _, name := range ldapDeviceNames(user, mappings[user].devices()) {
+			if !validClientName(name) {
+				result.Skipped = append(result.Skipped, LDAPSkippedClient{Name: name, Reason: "Client name " + clientNameMessage()})
+				continue
+			}
+			wanted[name] = user
+		}
+	}
+
+	// Keys shell out to wg, so generate them before taking the lock
+	keys := make(map[string]clientKeys)
+	for name := range wanted {
+		if exists, err := clientExists(name); err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+		if keys[name], err = generateClientKeys(); err != nil {
+			return err
+		}
+	}
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	disabled := disabledClientNames(content)
+
+	// Clients created before a failure are still remembered and applied
+	changed := false
+	err = reconcileLDAPClientsLocked(wanted, managed, disabled, keys, result, &changed)
+	if err == nil && len(ldapGroupMappings) > 0 {
+		synced := make(map[string]*LDAPGroupMapping)
+		for name, user := range wanted {
+			if _, ok := managed[name]; ok {
+				synced[name] = mappings[user]
+			}
+		}
+		result.Updated, err = applyLDAPMappingsLocked(synced)
+		if len(result.Updated) > 0 {
+			changed = true
+		}
+	}
+	if saveErr := saveLDAPClientsLocked(managed); err == nil {
+		err = saveErr
+	}
+	if changed {
+		if syncErr := syncWireGuardConf(); err == nil {
+			err = syncErr
+		}
+	}
+	return err
+}
+
+// Create or enable the wanted clients and disable managed ones no longer
+// wanted, recording what changed. Caller holds wgConfigMutex and syncs
+// afterwards.
+func reconcileLDAPClientsLocked(wanted, managed map[string]string, disabled map[string]bool, keys map[string]clientKeys, result *LDAPSyncResult, changed *bool) error {
+	for _, name := range sortedStringKeys(wanted) {
+		exists, err := clientExists(name)
+		if err != nil {
+			return err
+		}
+		_, isManaged := managed[name]
+		switch {
+		case exists && !isManaged:
+			result.Skipped = append(result.Skipped, LDAPSkippedClient{Name: name, Reason: "a client with this name was not created by the LDAP sync"})
+		case exists && disabled[name]:
+			if _, err := setClientEnabledLocked(name, true); err != nil {
+				return err
+			}
+			result.Enabled = append(result.Enabled, name)
+			*changed = true
+		case !exists:
+			clientKeys, ok := keys[name]
+			if !ok {
+				// Deleted between the key generation and the lock
+				continue
+			}
+			ipv4, ipv6, err := allocateClientIPsLocked("", "")
+			if err != nil {
+				return err
+			}
+			if _, err := createWireGuardClientLocked(name, ipv4, ipv6, clientKeys, nil, ""); err != nil {
+				return err
+			}
+			managed[name] = wanted[name]
+			result.Created = append(result.Created, name)
+			*changed = true
+		}
+	}
+
+	for _, name := range sortedStringKeys(managed) {
+		if _, ok := wanted[name]; ok {
+			continue
+		}
+		exists, err := clientExists(name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			// Deleted by an admin; nothing left to manage
+			delete(managed, name)
+			continue
+		}
+		if !disabled[name] {
+			if _, err := setClientEnabledLocked(name, false); err != nil {
+				return err
+			}
+			result.Disabled = append(result.Disabled, name)
+			*changed = true
+		}
+	}
+	return nil
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Sync every LDAP_SYNC_INTERVAL, or on the job's schedule, while this
+// instance leads. Without either, syncing is left to POST /ldap-sync.
+func startLDAPSync() {
+	if LDAP_URL == "" {
+		return
+	}
+
+	scheduleJob(jobLDAPSync, LDAP_SYNC_INTERVAL, true, func() error {
+		if result := syncLDAP(); result.Error != "" {
+			return errors.New(result.Error)
+		}
+		return nil
+	})
+}
+
+// Fail startup on settings ldapsearch would reject on every sync
+func checkLDAPConfig() error {
+	if LDAP_URL == "" {
+		return nil
+	}
+	if LDAP_BASE_DN == "" || LDAP_GROUP_DN == "" {
+		return fmt.Errorf("LDAP_BASE_DN and LDAP_GROUP_DN are required with LDAP_URL")
+	}
+	if LDAP_BIND_DN != "" && LDAP_BIND_PASSWORD_FILE == "" {
+		return fmt.Errorf("LDAP_BIND_PASSWORD_FILE is required with LDAP_BIND_DN")
+	}
+	if LDAP_DEVICES_PER_USER < 1 {
+		return fmt.Errorf("LDAP_DEVICES_PER_USER must be at least 1")
+	}
+	return nil
+}
+
+// Handler showing the sync settings, the synced clients and the last result
+func ldapSyncHandlerGin(c *gin.Context) {
+	data := map[string]interface{}{
+		"enabled": LDAP_URL != "",
+	}
+	if LDAP_URL != "" {
+		ldapSyncMutex.Lock()
+		managed, err := loadLDAPClientsLocked()
+		last := lastLDAPSync
+		ldapSyncMutex.Unlock()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+
+		data["group"] = LDAP_GROUP_DN
+		data["interval"] = LDAP_SYNC_INTERVAL.String()
+		data["clients"] = managed
+		if len(ldapGroupMappings) > 0 {
+			data["group_mappings"] = ldapGroupMappings
+		}
+		if last != nil {
+			data["last_sync"] = last
+		}
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
+
+// Handler running a sync now, e.g. right after offboarding someone
+func runLDAPSyncHandlerGin(c *gin.Context) {
+	if LDAP_URL == "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "LDAP_URL is not set",
+		})
+		return
+	}
+
+	result := syncLDAP()
+	if result.Error != "" {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: result.Error,
+			Data:    result,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "LDAP sync complete",
+		Data:    result,
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeLdapsearchScript prints ldap.ldif next to the script and logs its
+// arguments to ldapsearch.args
+const fakeLdapsearchScript = `#!/bin/bash
+dir="$(dirname "$0")"
+printf '%s\n' "$@" > "$dir/ldapsearch.args"
+cat "$dir/ldap.ldif"
+`
+
+// Point ldapsearchCmd at fakeLdapsearchScript and configure the sync;
+// returns a function replacing the directory's members
+func setupFakeLDAP(t *testing.T, env *testEnv) func(members ...string) {
+	t.Helper()
+	script := filepath.Join(env.dir, "ldapsearch")
+	if err := os.WriteFile(script, []byte(fakeLdapsearchScript), 0755); err != nil {
+		t.Fatalf("writing fake ldapsearch script: %v", err)
+	}
+	oldCmd := ldapsearchCmd
+	ldapsearchCmd = script
+	LDAP_URL, LDAP_BASE_DN, LDAP_GROUP_DN = "ldap://dc.test", "dc=test", "cn=vpn,ou=groups,dc=test"
+	LDAP_NAME_ATTRIBUTE, LDAP_DEVICES_PER_USER = "uid", 1
+	t.Cleanup(func() {
+		ldapsearchCmd = oldCmd
+		LDAP_URL, LDAP_BASE_DN, LDAP_GROUP_DN = "", "", ""
+	})
+
+	return func(members ...string) {
+		var ldif strings.Builder
+		for _, member := range members {
+			ldif.WriteString("dn: uid=" + member + ",ou=people,dc=test\nuid: " + member + "\n\n")
+		}
+		if err := os.WriteFile(filepath.Join(env.dir, "ldap.ldif"), []byte(ldif.String()), 0644); err != nil {
+			t.Fatalf("writing ldif: %v", err)
+		}
+	}
+}
+
+func runLDAPSync(t *testing.T, env *testEnv, wantStatus int) LDAPSyncResult {
+	t.Helper()
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/ldap-sync", nil)
+	if rec.Code != wantStatus {
+		t.Fatalf("sync: got status %d, want %d: %s", rec.Code, wantStatus, rec.Body.String())
+	}
+	var resp struct {
+		Data LDAPSyncResult `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding sync result: %v", err)
+	}
+	return resp.Data
+}
+
+func TestLDAPSyncFollowsGroupMembership(t *testing.T) {
+	env := setupTestEnv(t)
+	setMembers := setupFakeLDAP(t, env)
+
+	setMembers("alice", "bob")
+	result := runLDAPSync(t, env, http.StatusOK)
+	if strings.Join(result.Created, ",") != "alice,bob" || result.Members != 2 {
+		t.Fatalf("first sync: %+v", result)
+	}
+	args := readFile(t, filepath.Join(env.dir, "ldapsearch.args"))
+	if !strings.Contains(args, "(memberOf=cn=vpn,ou=groups,dc=test)\nuid\n") {
+		t.Errorf("unexpected ldapsearch arguments:\n%s", args)
+	}
+
+	// Leaving the group disables the client; coming back enables it again
+	setMembers("alice")
+	if result := runLDAPSync(t, env, http.StatusOK); strings.Join(result.Disabled, ",") != "bob" {
+		t.Errorf("bob must be disabled: %+v", result)
+	}
+	if !strings.Contains(env.configContent(t), "### Client bob\n#[Peer]") {
+		t.Errorf("bob's peer must be commented out:\n%s", env.configContent(t))
+	}
+	setMembers("alice", "bob")
+	if result := runLDAPSync(t, env, http.StatusOK); strings.Join(result.Enabled, ",") != "bob" || len(result.Created) != 0 {
+		t.Errorf("bob must be enabled again: %+v", result)
+	}
+
+	// Clients made by hand are never touched
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "carol"})
+	setMembers("alice", "carol")
+	result = runLDAPSync(t, env, http.StatusOK)
+	if len(result.Skipped) != 1 || result.Skipped[0].Name != "carol" || strings.Join(result.Disabled, ",") != "bob" {
+		t.Errorf("carol must be skipped and bob disabled: %+v", result)
+	}
+}
+
+func TestLDAPSyncRefusesEmptyGroup(t *testing.T) {
+	env := setupTestEnv(t)
+	setMembers := setupFakeLDAP(t, env)
+
+	setMembers("alice")
+	runLDAPSync(t, env, http.StatusOK)
+
+	// A broken filter returning nobody must not lock everyone out
+	setMembers()
+	if result := runLDAPSync(t, env, http.StatusBadGateway); result.Error == "" || len(result.Disabled) != 0 {
+		t.Errorf("empty result must fail the sync: %+v", result)
+	}
+	if strings.Contains(env.configContent(t), "#[Peer]") {
+		t.Error("no client may be disabled")
+	}
+
+	body := env.authedRequest(t, http.MethodGet, "/api/v1/ldap-sync", nil).Body.String()
+	if !strings.Contains(body, `"clients":{"alice":"alice"}`) || !strings.Contains(body, `"error":"LDAP returned no members`) {
+		t.Errorf("unexpected status: %s", body)
+	}
+
+	LDAP_URL = ""
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/ldap-sync", nil).Code; code != http.StatusBadRequest {
+		t.Errorf("sync without LDAP_URL: got status %d, want 400", code)
+	}
+}
+
+func TestLDAPHelpers(t *testing.T) {
+	if got := ldapEscape(`cn=R&D (Berlin)*\`); got != `cn=R&D \28Berlin\29\2a\5c` {
+		t.Errorf("ldapEscape = %q", got)
+	}
+
+	entries, err := parseLDIFEntries("dn: uid=a,dc=test\nuid: alice\nmemberOf: cn=a\nmemberOf: cn=b\n\ndn: uid=j,dc=test\nUID:: asO2cmc=\n")
+	if err != nil || len(entries) != 2 || strings.Join(entries[0]["memberof"], ",") != "cn=a,cn=b" || entries[1]["uid"][0] != "jörg" {
+		t.Errorf("parseLDIFEntries = %q, %v", entries, err)
+	}
+
+	if got := strings.Join(ldapDeviceNames("alice", 3), ","); got != "alice,alice-2,alice-3" {
+		t.Errorf("ldapDeviceNames = %q", got)
+	}
+}
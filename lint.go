@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// wg setconf takes configs with mistakes that only show once traffic goes
+// missing: a peer whose AllowedIPs another peer also claims loses them to
+// it without a word, a client given 10.66.0.2/31 takes its neighbour's
+// address too, and a peer dialled without PersistentKeepalive becomes
+// unreachable once its NAT mapping times out. POST /lint reads a config,
+// the uploaded one or the server's, and reports such findings by line.
+
+// Largest config POST /lint accepts
+const maxLintConfigSize = 4 << 20
+
+// Severity of findings: errors break something, warnings likely do
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+)
+
+// NAT mappings commonly last 30 to 120 seconds
+const maxUsefulKeepalive = 120
+
+// Keys wg-quick and awg-quick accept, by section
+var lintKnownKeys = map[string]map[string]bool{
+	"interface": {
+		"privatekey": true, "listenport": true, "fwmark": true, "address": true, "dns": true, "mtu": true,
+		"table": true, "preup": true, "postup": true, "predown": true, "postdown": true, "saveconfig": true,
+		// AmneziaWG
+		"jc": true, "jmin": true, "jmax": true, "s1": true, "s2": true, "s3": true, "s4": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "i1": true, "i2": true, "i3": true, "i4": true, "i5": true,
+	},
+	"peer": {
+		"publickey": true, "presharedkey": true, "allowedips": true, "endpoint": true, "persistentkeepalive": true,
+	},
+}
+
+// A problem found in a config
+type LintFinding struct {
+	// e.g. overlapping-allowed-ips
+	Rule string `json:"rule"`
+	// "error" or "warning"
+	Severity string `json:"severity"`
+	// From 1
+	Line int `json:"line"`
+	// The peer's client name, or its public key when it has none
+	Peer    string `json:"peer,omitempty"`
+	Message string `json:"message"`
+}
+
+// What POST /lint found
+type LintResult struct {
+	// "body" or "server"
+	Source string `json:"source"`
+	// No errors; warnings may remain
+	Valid    bool          `json:"valid"`
+	Peers    int           `json:"peers"`
+	Errors   int           `json:"errors"`
+	Warnings int           `json:"warnings"`
+	Findings []LintFinding `json:"findings"`
+}
+
+type lintValue struct {
+	value string
+	line  int
+}
+
+// An [Interface] or [Peer] section
+type lintSection struct {
+	kind string
+	line int
+	// From the ### Client marker above a peer
+	name   string
+	values map[string][]lintValue
+}
+
+func (s *lintSection) first(key string) (lintValue, bool) {
+	values := s.values[key]
+	if len(values) == 0 {
+		return lintValue{}, false
+	}
+	return values[0], true
+}
+
+func (s *lintSection) label() string {
+	if s.name != "" {
+		return s.name
+	}
+	if key, ok := s.first("publickey"); ok {
+		return key.value
+	}
+	return fmt.Sprintf("peer at line %d", s.line)
+}
+
+type linter struct {
+	findings []LintFinding
+}
+
+func (l *linter) add(rule, severity string, line int, peer, format string, args ...interface{}) {
+	l.findings = append(l.findings, LintFinding{Rule: rule, Severity: severity, Line: line, Peer: peer, Message: fmt.Sprintf(format, args...)})
+}
+
+// Split a config into its sections. Commented lines are skipped, so
+// disabled clients don't count.
+func (l *linter) parse(config []byte) []*lintSection {
+	var sections []*lintSection
+	var current *lintSection
+	marker := ""
+	scanner := bufio.NewScanner(bytes.NewReader(config))
+	scanner.Buffer(make([]byte, 64<<10), maxLintConfigSize)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, clientMarker):
+			marker = strings.TrimPrefix(line, clientMarker)
+			continue
+		case line == "":
+			// The marker sits right above its [Peer]
+			marker = ""
+			continue
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			kind := strings.ToLower(strings.Trim(line, "[] "))
+			if kind != "interface" && kind != "peer" {
+				l.add("syntax", lintError, number, "", "Unknown section %s", line)
+				current = nil
+				continue
+			}
+			current = &lintSection{kind: kind, line: number, values: map[string][]lintValue{}}
+			if kind == "peer" {
+				current.name = marker
+			}
+			marker = ""
+			sections = append(sections, current)
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		// Values may end in a comment
+		if i := strings.Index(value, "#"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		switch {
+		case !ok:
+			l.add("syntax", lintError, number, "", "%q is not a key = value line", line)
+		case current == nil:
+			l.add("syntax", lintError, number, "", "%s is outside an [Interface] or [Peer] section", name)
+		case !lintKnownKeys[current.kind][strings.ToLower(name)]:
+			l.add("unknown-key", lintError, number, "", "%s is not a key of the %s section; wg rejects the config", name, current.kind)
+		default:
+			key := strings.ToLower(name)
+			current.values[key] = append(current.values[key], lintValue{value: value, line: number})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		l.add("syntax", lintError, 0, "", "Config can't be read: %v", err)
+	}
+	return sections
+}
+
+// A peer's AllowedIPs entry
+type lintPrefix struct {
+	prefix netip.Prefix
+	entry  string
+	line   int
+	peer   *lintSection
+}
+
+// Check a WireGuard config, a server's or a client's
+func lintConfig(config []byte) LintResult {
+	l := &linter{}
+	sections := l.parse(config)
+
+	var iface *lintSection
+	var peers []*lintSection
+	for _, section := range sections {
+		switch {
+		case section.kind == "peer":
+			peers = append(peers, section)
+		case iface != nil:
+			l.add("syntax", lintError, section.line, "", "A second [Interface] section; only one is allowed")
+		default:
+			iface = section
+		}
+	}
+
+	// The VPN subnets, from the interface's addresses
+	var subnets []netip.Prefix
+	if iface != nil {
+		for _, value := range iface.values["address"] {
+			for _, entry := range splitList(value.value) {
+				prefix, err := netip.ParsePrefix(entry)
+				if err != nil {
+					if addr, err := netip.ParseAddr(entry); err == nil {
+						prefix = netip.PrefixFrom(addr, addr.BitLen())
+					} else {
+						l.add("invalid-address", lintError, value.line, "", "Address %q is not an IP address with a prefix", entry)
+						continue
+					}
+				}
+				subnets = append(subnets, prefix.Masked())
+				l.checkInterfaceAddress(prefix, value.line)
+			}
+		}
+	}
+
+	keys := make(map[string]*lintSection)
+	var prefixes []lintPrefix
+	for _, peer := range peers {
+		key, ok := peer.first("publickey")
+		switch {
+		case !ok:
+			l.add("missing-public-key", lintError, peer.line, peer.label(), "The peer has no PublicKey")
+		case keys[key.value] != nil:
+			l.add("duplicate-public-key", lintError, key.line, peer.label(), "The PublicKey is also %s's, at line %d; wg merges the two peers into one", keys[key.value].label(), keys[key.value].line)
+		default:
+			keys[key.value] = peer
+		}
+
+		for _, value := range peer.values["allowedips"] {
+			for _, entry := range splitList(value.value) {
+				prefix, err := netip.ParsePrefix(entry)
+				if err != nil {
+					l.add("invalid-allowed-ips", lintError, value.line, peer.label(), "AllowedIPs %q is not a network", entry)
+					continue
+				}
+				if prefix != prefix.Masked() {
+					l.add("allowed-ips-host-bits", lintWarning, value.line, peer.label(), "AllowedIPs %s has host bits set and means %s", entry, prefix.Masked())
+				}
+				l.checkPeerPrefix(prefix, subnets, value.line, peer)
+				prefixes = append(prefixes, lintPrefix{prefix: prefix.Masked(), entry: entry, line: value.line, peer: peer})
+			}
+		}
+
+		l.checkKeepalive(peer)
+	}
+	l.checkOverlaps(prefixes)
+
+	sort.SliceStable(l.findings, func(i, j int) bool { return l.findings[i].Line < l.findings[j].Line })
+	result := LintResult{Peers: len(peers), Findings: l.findings}
+	if result.Findings == nil {
+		result.Findings = []LintFinding{}
+	}
+	for _, finding := range result.Findings {
+		if finding.Severity == lintError {
+			result.Errors++
+		} else {
+			result.Warnings++
+		}
+	}
+	result.Valid = result.Errors == 0
+	return result
+}
+
+// The interface's own address can't be its subnet's network or broadcast
+// address, which /31 and /32 don't have
+func (l *linter) checkInterfaceAddress(prefix netip.Prefix, line int) {
+	addr := prefix.Addr()
+	if addr.Is6() || prefix.Bits() >= 31 {
+		return
+	}
+	network := prefix.Masked().Addr()
+	broadcast := network.As4()
+	binary.BigEndian.PutUint32(broadcast[:], binary.BigEndian.Uint32(broadcast[:])|(1<<uint(32-prefix.Bits())-1))
+	switch addr {
+	case network:
+		l.add("interface-address", lintError, line, "", "Address %s is the network address of %s; use a host address such as %s/%d", prefix, prefix.Masked(), network.Next(), prefix.Bits())
+	case netip.AddrFrom4(broadcast):
+		l.add("interface-address", lintError, line, "", "Address %s is the broadcast address of %s", prefix, prefix.Masked())
+	}
+}
+
+// A peer's entry in the VPN subnet is its tunnel address and should be a
+// single one; a wider one, like a /31, takes its neighbours' addresses
+func (l *linter) checkPeerPrefix(prefix netip.Prefix, subnets []netip.Prefix, line int, peer *lintSection) {
+	if prefix.IsSingleIP() {
+		return
+	}
+	for _, subnet := range subnets {
+		if prefix.Bits() > subnet.Bits() && subnet.Contains(prefix.Addr()) {
+			host := 32
+			if prefix.Addr().Is6() {
+				host = 128
+			}
+			l.add("address-prefix", lintWarning, line, peer.label(),
+				"AllowedIPs %s covers %s addresses of the VPN subnet %s; a client's tunnel address is a /%d",
+				prefix, addressCount(prefix), subnet, host)
+			return
+		}
+	}
+}
+
+func addressCount(prefix netip.Prefix) string {
+	bits := prefix.Addr().BitLen() - prefix.Bits()
+	if bits >= 63 {
+		return "2^" + strconv.Itoa(bits)
+	}
+	return strconv.FormatUint(1<<uint(bits), 10)
+}
+
+// A peer this side dials keeps its NAT mapping open only with a keepalive
+// shorter than the mapping lasts
+func (l *linter) checkKeepalive(peer *lintSection) {
+	endpoint, ok := peer.first("endpoint")
+	if !ok {
+		return
+	}
+	keepalive, ok := peer.first("persistentkeepalive")
+	if !ok || keepalive.value == "off" || keepalive.value == "0" {
+		l.add("missing-persistent-keepalive", lintWarning, endpoint.line, peer.label(),
+			"The peer at %s has no PersistentKeepalive; behind NAT it becomes unreachable once idle (25 is usual)", endpoint.value)
+		return
+	}
+	seconds, err := strconv.Atoi(keepalive.value)
+	switch {
+	case err != nil || seconds < 0 || seconds > 65535:
+		l.add("invalid-keepalive", lintError, keepalive.line, peer.label(), "PersistentKeepalive %q must be off or 1 to 65535 seconds", keepalive.value)
+	case seconds > maxUsefulKeepalive:
+		l.add("missing-persistent-keepalive", lintWarning, keepalive.line, peer.label(),
+			"PersistentKeepalive of %ds is longer than most NAT mappings last (25 is usual)", seconds)
+	}
+}
+
+// The kernel routes each address to the peer with the most specific entry,
+// and an entry two peers share to the one configured last
+func (l *linter) checkOverlaps(prefixes []lintPrefix) {
+	sort.SliceStable(prefixes, func(i, j int) bool { return prefixes[i].line < prefixes[j].line })
+	for i, later := range prefixes {
+		for _, earlier := range prefixes[:i] {
+			if earlier.peer == later.peer || !earlier.prefix.Overlaps(later.prefix) {
+				continue
+			}
+			if earlier.prefix == later.prefix {
+				l.add("overlapping-allowed-ips", lintError, later.line, later.peer.label(),
+					"AllowedIPs %s is also %s's, at line %d; wg gives it to this peer and takes it from %s",
+					later.entry, earlier.peer.label(), earlier.line, earlier.peer.label())
+			} else {
+				l.add("overlapping-allowed-ips", lintWarning, later.line, later.peer.label(),
+					"AllowedIPs %s overlaps %s of %s, at line %d; the more specific one gets the addresses both cover",
+					later.entry, earlier.entry, earlier.peer.label(), earlier.line)
+			}
+		}
+	}
+}
+
+// Handler for POST /lint: lint the config file in the body, or the server
+// config when the body is empty
+func lintHandlerGin(c *gin.Context) {
+	config, err := io.ReadAll(io.LimitReader(c.Request.Body, maxLintConfigSize+1))
+	if err != nil || len(config) > maxLintConfigSize {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("The body must be a WireGuard config of at most %d bytes", maxLintConfigSize),
+		})
+		return
+	}
+
+	source := "body"
+	if len(bytes.TrimSpace(config)) == 0 {
+		source = "server"
+		if config, err = os.ReadFile(WG_CONFIG_FILE); err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Failed to read WireGuard config: %v", err),
+			})
+			return
+		}
+	}
+
+	result := lintConfig(config)
+	result.Source = source
+	message := "No problems found"
+	if len(result.Findings) > 0 {
+		message = fmt.Sprintf("Errors: %d, warnings: %d", result.Errors, result.Warnings)
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    result,
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func lintRequest(t *testing.T, env *testEnv, config, token string) (int, LintResult) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/lint", strings.NewReader(config))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("key", token)
+	rec := httptest.NewRecorder()
+	env.router.ServeHTTP(rec, req)
+	var resp struct {
+		Data LintResult `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding lint: %v, %s", err, rec.Body.String())
+	}
+	return rec.Code, resp.Data
+}
+
+func TestLintFindsProblems(t *testing.T) {
+	env := setupTestEnv(t)
+	keyA, keyB, keyC := strings.Repeat("A", 43)+"=", strings.Repeat("B", 43)+"=", strings.Repeat("C", 43)+"="
+	config := `[Interface]
+Address = 10.66.0.0/24
+ListenPort = 51820
+Tabel = off
+
+### Client alice
+[Peer]
+PublicKey = ` + keyA + `
+AllowedIPs = 10.66.0.2/31
+
+### Client bob
+[Peer]
+PublicKey = ` + keyB + `
+AllowedIPs = 10.66.0.3/32, 192.168.1.0/24
+
+[Peer]
+PublicKey = ` + keyC + `
+AllowedIPs = 192.168.1.0/24
+Endpoint = 198.51.100.7:51820
+
+### Client carol
+#[Peer]
+#PublicKey = ` + keyA + `
+#AllowedIPs = 10.66.0.2/32
+`
+	code, result := lintRequest(t, env, config, "test-token")
+	if code != http.StatusOK || result.Source != "body" || result.Valid || result.Peers != 3 || result.Errors != 3 || result.Warnings != 3 {
+		t.Fatalf("status %d, %+v", code, result)
+	}
+	want := []LintFinding{
+		{Rule: "interface-address", Severity: lintError, Line: 2},
+		{Rule: "unknown-key", Severity: lintError, Line: 4},
+		{Rule: "address-prefix", Severity: lintWarning, Line: 9, Peer: "alice"},
+		{Rule: "overlapping-allowed-ips", Severity: lintWarning, Line: 14, Peer: "bob"},
+		{Rule: "overlapping-allowed-ips", Severity: lintError, Line: 18, Peer: keyC},
+		{Rule: "missing-persistent-keepalive", Severity: lintWarning, Line: 19, Peer: keyC},
+	}
+	for i, finding := range result.Findings {
+		if finding.Rule != want[i].Rule || finding.Severity != want[i].Severity || finding.Line != want[i].Line || finding.Peer != want[i].Peer || finding.Message == "" {
+			t.Errorf("finding %d: got %+v, want %+v", i, finding, want[i])
+		}
+	}
+
+	if _, result := lintRequest(t, env, "[Peer]\nPublicKey = "+keyA+"\nEndpoint = vpn.example.com:51820\nPersistentKeepalive = 25\nAllowedIPs = 0.0.0.0/0\n", "test-token"); !result.Valid || len(result.Findings) != 0 {
+		t.Errorf("client config: %+v", result)
+	}
+}
+
+func TestLintServerConfig(t *testing.T) {
+	env := setupTestEnv(t)
+	setReadOnlyTokens(t, "reader-token")
+	addedClient(t, env, "alice")
+	addedClient(t, env, "bob")
+
+	// An empty body lints the server config, which only reads
+	code, result := lintRequest(t, env, "", "reader-token")
+	if code != http.StatusOK || result.Source != "server" || !result.Valid || result.Peers != 2 || len(result.Findings) != 0 {
+		t.Errorf("status %d, %+v", code, result)
+	}
+	if _, resp := changesSince(t, env, "?since=0"); len(resp.Data.Changes) != 2 {
+		t.Errorf("linting recorded a change: %+v", resp.Data.Changes)
+	}
+}
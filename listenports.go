@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Restrictive networks often let only a few UDP ports out, like 53 or 443.
+// EXTRA_LISTEN_PORTS exposes WireGuard on them too: the firewall table gets
+// a prerouting rule per port redirecting it to SERVER_PORT, so one
+// interface answers on all of them. Each port becomes an endpoint profile
+// called port-<port> (see endpointprofiles.go), listed as a fallback in
+// client configs and switchable per client. Traffic arriving over the
+// tunnel isn't redirected, so a DNS server for the clients keeps port 53.
+
+// Ports from EXTRA_LISTEN_PORTS, sorted
+var extraListenPorts []int
+
+// Parse EXTRA_LISTEN_PORTS. Needs the params for SERVER_PORT.
+func loadExtraListenPorts() error {
+	extraListenPorts = nil
+	seen := map[int]bool{}
+	for _, value := range splitList(EXTRA_LISTEN_PORTS) {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("%q isn't a port", value)
+		}
+		if strconv.Itoa(port) == wgParams.ServerPort {
+			return fmt.Errorf("%d is SERVER_PORT already", port)
+		}
+		if !seen[port] {
+			seen[port] = true
+			extraListenPorts = append(extraListenPorts, port)
+		}
+	}
+	sort.Ints(extraListenPorts)
+	return nil
+}
+
+// Name of the endpoint profile of an extra port
+func listenPortProfile(port int) string {
+	return fmt.Sprintf("port-%d", port)
+}
+
+// The endpoint profiles of the extra ports
+func listenPortProfiles() []EndpointProfile {
+	profiles := make([]EndpointProfile, 0, len(extraListenPorts))
+	for _, port := range extraListenPorts {
+		params := wgParams
+		params.ServerPort = strconv.Itoa(port)
+		profiles = append(profiles, EndpointProfile{Name: listenPortProfile(port), Endpoint: serverEndpoint(params)})
+	}
+	return profiles
+}
+
+// Prerouting rules sending the extra ports to the WireGuard port
+func renderListenPortRedirects(nic, serverPort string, ports []int) []string {
+	rules := make([]string, 0, len(ports))
+	for _, port := range ports {
+		rules = append(rules, fmt.Sprintf("iifname != %q udp dport %d redirect to :%s", nic, port, serverPort))
+	}
+	return rules
+}
+
+// Handler for GET /server/listen-ports: the ports, their rules and whether
+// those are loaded
+func listenPortsHandlerGin(c *gin.Context) {
+	rules := renderListenPortRedirects(wgParams.ServerWGNIC, wgParams.ServerPort, extraListenPorts)
+	data := map[string]interface{}{
+		"port":        wgParams.ServerPort,
+		"extra_ports": extraListenPorts,
+		"rules":       rules,
+	}
+	if len(extraListenPorts) > 0 {
+		success, output := executeCommand(nftCmd, "list", "table", "inet", firewallTable)
+		if success != "success" && !strings.Contains(output, "No such file or directory") {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("nft failed: %s", output),
+			})
+			return
+		}
+		installed := success == "success"
+		for _, port := range extraListenPorts {
+			installed = installed && strings.Contains(output, fmt.Sprintf("udp dport %d redirect", port))
+		}
+		data["installed"] = installed
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExtraListenPorts(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+	oldPorts := EXTRA_LISTEN_PORTS
+	EXTRA_LISTEN_PORTS = "443, 53"
+	t.Cleanup(func() {
+		EXTRA_LISTEN_PORTS = oldPorts
+		loadExtraListenPorts()
+	})
+	if err := loadExtraListenPorts(); err != nil {
+		t.Fatalf("loading ports: %v", err)
+	}
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/nat/apply", nil); rec.Code != http.StatusOK {
+		t.Fatalf("apply: status %d, %s", rec.Code, rec.Body.String())
+	}
+	rules := readRules(t, rulesFile)
+	for _, want := range []string{
+		`iifname != "wg0" udp dport 53 redirect to :51820`,
+		`iifname != "wg0" udp dport 443 redirect to :51820`,
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules lack %q:\n%s", want, rules)
+		}
+	}
+
+	var resp struct {
+		Data struct {
+			ExtraPorts []int `json:"extra_ports"`
+			Installed  bool  `json:"installed"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/server/listen-ports", nil).Body.Bytes(), &resp)
+	if len(resp.Data.ExtraPorts) != 2 || resp.Data.ExtraPorts[0] != 53 || !resp.Data.Installed {
+		t.Errorf("listen ports: got %+v", resp.Data)
+	}
+
+	// Each port is an endpoint profile clients can switch to
+	config := addedClient(t, env, "alice").Config
+	if !strings.Contains(config, "#   Endpoint = 203.0.113.10:443 (port-443)\n") {
+		t.Errorf("config lacks the port:\n%s", config)
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/endpoint-profile", EndpointProfileRequest{Profile: "port-53"}); rec.Code != http.StatusOK {
+		t.Errorf("switch: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if config := readFile(t, clientConfigFile("alice")); !strings.Contains(config, "Endpoint = 203.0.113.10:53\n") {
+		t.Errorf("switched config:\n%s", config)
+	}
+
+	for _, invalid := range []string{"51820", "0", "dns"} {
+		EXTRA_LISTEN_PORTS = invalid
+		if err := loadExtraListenPorts(); err == nil {
+			t.Errorf("%q was accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Firewall logs and IDS alerts only show tunnel addresses. GET
+// /lookup/ip/:address names the client behind one, either as its own
+// address or as part of a subnet routed to it, from the server config's
+// AllowedIPs. Monitoring that reads wg show sees public keys instead, which
+// GET /lookup/pubkey/:key maps to the client.
+
+// The owner of a tunnel address
+type IPLookup struct {
+	Address string `json:"address"`
+	Client  string `json:"client"`
+	// The AllowedIPs entry the address matched: the client's /32 or /128,
+	// or a subnet routed to it
+	Network   string `json:"network"`
+	PublicKey string `json:"public_key,omitempty"`
+	Disabled  bool   `json:"disabled,omitempty"`
+}
+
+// Handler for the client owning a tunnel address
+func lookupIPHandlerGin(c *gin.Context) {
+	addr, err := netip.ParseAddr(c.Param("address"))
+	if err != nil || addr.Zone() != "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: c.Param("address") + " is not an IP address",
+		})
+		return
+	}
+
+	inv, err := currentInventory()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	name, network, ok := inv.ownerOf(addr)
+	if !ok {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "No client has this address",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+
+	publicKey, enabled := inv.keys[name]
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: IPLookup{
+			Address:   addr.Unmap().String(),
+			Client:    name,
+			Network:   network.String(),
+			PublicKey: publicKey,
+			Disabled:  !enabled,
+		},
+	})
+}
+
+// Handler for the client with a public key, without its config. Keys
+// contain slashes, so the route ends in a catch-all; the URL-safe base64
+// alphabet works too.
+func lookupPublicKeyHandlerGin(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	key = strings.NewReplacer("-", "+", "_", "/").Replace(key)
+	if !wgKeyRegex.MatchString(key) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Not a WireGuard public key",
+		})
+		return
+	}
+
+	name := findClientNameByPublicKey(key)
+	if name == "" {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "No client has this public key",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+
+	clients, err := listClients(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	client := Client{Name: name}
+	for _, listed := range clients {
+		if listed.Name == name {
+			client = listed
+			break
+		}
+	}
+	client.PublicKey = key
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    client,
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestLookupIP(t *testing.T) {
+	env := setupTestEnv(t)
+	peers := `
+### Client alice
+[Peer]
+PublicKey = alice-key
+AllowedIPs = 10.66.0.2/32,fd42:42:42::2/128,192.168.50.0/24
+
+### Client bob
+#[Peer]
+#PublicKey = bob-key
+#AllowedIPs = 10.66.0.3/32
+
+### Client carol
+[Peer]
+PublicKey = carol-key
+AllowedIPs = 10.66.0.4/32,192.168.50.128/25
+`
+	f, err := os.OpenFile(env.configFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(peers)
+	f.Close()
+
+	for _, tc := range []struct {
+		address string
+		want    IPLookup
+	}{
+		{"10.66.0.2", IPLookup{Address: "10.66.0.2", Client: "alice", Network: "10.66.0.2/32", PublicKey: "alice-key"}},
+		{"fd42:42:42::2", IPLookup{Address: "fd42:42:42::2", Client: "alice", Network: "fd42:42:42::2/128", PublicKey: "alice-key"}},
+		{"::ffff:10.66.0.4", IPLookup{Address: "10.66.0.4", Client: "carol", Network: "10.66.0.4/32", PublicKey: "carol-key"}},
+		{"10.66.0.3", IPLookup{Address: "10.66.0.3", Client: "bob", Network: "10.66.0.3/32", Disabled: true}},
+		// The most specific routed subnet wins
+		{"192.168.50.7", IPLookup{Address: "192.168.50.7", Client: "alice", Network: "192.168.50.0/24", PublicKey: "alice-key"}},
+		{"192.168.50.200", IPLookup{Address: "192.168.50.200", Client: "carol", Network: "192.168.50.128/25", PublicKey: "carol-key"}},
+	} {
+		rec := env.authedRequest(t, http.MethodGet, "/api/v1/lookup/ip/"+tc.address, nil)
+		var resp struct {
+			Data IPLookup `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK || resp.Data != tc.want {
+			t.Errorf("%s: got status %d, %+v, want %+v", tc.address, rec.Code, resp.Data, tc.want)
+		}
+	}
+
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/lookup/ip/10.66.0.99", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unused address: got status %d, want 404", rec.Code)
+	}
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/lookup/ip/10.66.0", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed address: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestLookupPublicKey(t *testing.T) {
+	env := setupTestEnv(t)
+	const key = "kF3d/4+AbCdEfGhIjKlMnOpQrStUvWxYz0123456789="
+	// The fake wg's keys aren't base64, so give alice a real-looking one
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	config := regexp.MustCompile(`PublicKey = pub-\S+`).ReplaceAllString(env.configContent(t), "PublicKey = "+key)
+	if err := os.WriteFile(env.configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"/api/v1/lookup/pubkey/" + key,
+		"/api/v1/lookup/pubkey/kF3d%2F4%2BAbCdEfGhIjKlMnOpQrStUvWxYz0123456789%3D",
+		"/api/v1/lookup/pubkey/kF3d_4-AbCdEfGhIjKlMnOpQrStUvWxYz0123456789=",
+	} {
+		rec := env.authedRequest(t, http.MethodGet, path, nil)
+		var resp struct {
+			Data Client `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusOK || resp.Data.Name != "alice" || resp.Data.IPV4 != "10.66.0.2" || resp.Data.PublicKey != key || resp.Data.Config != "" {
+			t.Errorf("%s: got status %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/lookup/pubkey/AAAA/4+AbCdEfGhIjKlMnOpQrStUvWxYz0123456789=", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown key: got status %d, want 404", rec.Code)
+	}
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/lookup/pubkey/not-a-key", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("malformed key: got status %d, want 400", rec.Code)
+	}
+}
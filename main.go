@@ -3,16 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -22,16 +27,117 @@ var (
 	// Configuration
 	API_PORT          = getEnv("API_PORT", "8080")
 	API_TOKEN         = getEnv("API_TOKEN", "your-secure-api-token") // Default if not in .env
+	API_TOKEN_SECONDARY = getEnv("API_TOKEN_SECONDARY", "") // Also valid while rotating API_TOKEN
+	API_TOKENS_FILE   = getEnv("API_TOKENS_FILE", "") // Tokens set through /tokens, api-tokens.json next to the server config when empty
 	WG_CONFIG_FILE    = getEnv("WG_CONFIG_FILE", "/etc/wireguard/wg0.conf")
 	WG_PARAMS_FILE    = getEnv("WG_PARAMS_FILE", "/etc/wireguard/params")
 	WIREGUARD_CLIENTS = getEnv("WIREGUARD_CLIENTS", "/home/wireguard/users")
 	DEBUG_MODE        = getEnv("DEBUG_MODE", "false") == "true"
+	STATUS_CACHE_TTL  = getEnvDuration("STATUS_CACHE_TTL", 5*time.Second)
+	CLIENT_DNS_SEARCH = getEnv("CLIENT_DNS_SEARCH", "") // Comma-separated search domains for client configs
+	CLIENT_DNS_SPLIT  = getEnv("CLIENT_DNS_SPLIT", "") // Comma-separated domains resolved via the tunnel only (split DNS)
+	CLIENT_KILL_SWITCH = getEnv("CLIENT_KILL_SWITCH", "") // "iptables" or "nft" kill switch rules in client configs; none when empty
+	CLIENT_PRESHARED_KEYS = getEnv("CLIENT_PRESHARED_KEYS", "true") == "true" // Give new clients a PresharedKey; false for client software without PSK support
+	CLIENT_NAME_MAX_LENGTH = getEnvInt("CLIENT_NAME_MAX_LENGTH", 15) // Longest client name in characters, up to 64
+	CLIENT_NAME_CHARSET = getEnv("CLIENT_NAME_CHARSET", "ascii") // "ascii", or "extended" to allow non-ASCII letters and digits too
+	CLIENT_NAME_PATTERN = getEnv("CLIENT_NAME_PATTERN", "") // Regex client names must also match, e.g. "^[a-z]+-[a-z0-9]+$"
+	GEOIP_DB          = getEnv("GEOIP_DB", "") // Optional MaxMind .mmdb for peer endpoint locations
+	SESSION_POLL_INTERVAL = getEnvDuration("SESSION_POLL_INTERVAL", 30*time.Second)
+	API_DOCS          = getEnv("API_DOCS", "false") == "true" // Serve OpenAPI spec and Swagger UI without auth
+	GRPC_PORT         = getEnv("GRPC_PORT", "") // gRPC listener, disabled when empty
+	IDEMPOTENCY_TTL   = getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+	WG_EASY_CONFIG    = getEnv("WG_EASY_CONFIG", "/etc/wireguard/wg0.json") // Read by the wg-easy importer
+	NODES_CONFIG      = getEnv("NODES_CONFIG", "") // YAML list of remote nodes managed over SSH
+	TENANTS_CONFIG    = getEnv("TENANTS_CONFIG", "") // YAML list of tenants with their own tokens
+	PROJECTS_FILE     = getEnv("PROJECTS_FILE", "") // Project membership, projects.json next to the server config when empty
+	FIREWALL_FILE     = getEnv("FIREWALL_FILE", "") // Per-client firewall policies, firewall.json next to the server config when empty
+	FORWARDS_FILE     = getEnv("FORWARDS_FILE", "") // Port forwards to clients, forwards.json next to the server config when empty
+	CLIENT_ISOLATION  = getEnv("CLIENT_ISOLATION", "false") == "true" // Block peer-to-peer traffic between all clients
+	NAT_MANAGED       = getEnv("NAT_MANAGED", "false") == "true" // Own the masquerade/forwarding rules instead of the installer's PostUp
+	NAT_EGRESS_NIC    = getEnv("NAT_EGRESS_NIC", "") // Detected from params or the default route when empty
+	DNS_RECORDS_BACKEND = getEnv("DNS_RECORDS_BACKEND", "") // "hosts", "zone" or "nsupdate"; client DNS records disabled when empty
+	DNS_RECORDS_DOMAIN  = getEnv("DNS_RECORDS_DOMAIN", "vpn.internal")
+	DNS_RECORDS_FILE    = getEnv("DNS_RECORDS_FILE", "") // Hosts/zone file, or nsupdate state; next to the server config when empty
+	DNS_RECORDS_RELOAD  = getEnv("DNS_RECORDS_RELOAD", "") // Shell command run after the hosts/zone file changes
+	DNS_RECORDS_SERVER  = getEnv("DNS_RECORDS_SERVER", "") // nsupdate server, from the zone's SOA when empty
+	DNS_RECORDS_KEY_FILE = getEnv("DNS_RECORDS_KEY_FILE", "") // TSIG key file for nsupdate -k
+	ENDPOINT_FILTER_FILE = getEnv("ENDPOINT_FILTER_FILE", "") // Where peers may connect from, endpoint-filter.json next to the server config when empty
+	IP_SETS_DIR       = getEnv("IP_SETS_DIR", "/etc/wireguard/ipsets") // <name>.zone CIDR lists for the endpoint filter
+	ROUTING_PROFILES_FILE = getEnv("ROUTING_PROFILES_FILE", "") // Uplinks for projects, routing-profiles.json next to the server config when empty
+	PLACEMENT_POLICY  = getEnv("PLACEMENT_POLICY", "peers") // "peers" or "transfer"
+	HA_LOCK_FILE      = getEnv("HA_LOCK_FILE", "") // Leader election lock, HA disabled when empty
+	HA_POLL_INTERVAL  = getEnvDuration("HA_POLL_INTERVAL", 5*time.Second)
+	MAX_CREATES_PER_HOUR = getEnvInt("MAX_CREATES_PER_HOUR", 0) // Client creations per hour for API_TOKEN, 0 = unlimited
+	LDAP_URL          = getEnv("LDAP_URL", "") // e.g. ldaps://dc.corp.example.com; LDAP sync disabled when empty
+	LDAP_BIND_DN      = getEnv("LDAP_BIND_DN", "") // Anonymous bind when empty
+	LDAP_BIND_PASSWORD_FILE = getEnv("LDAP_BIND_PASSWORD_FILE", "")
+	LDAP_BASE_DN      = getEnv("LDAP_BASE_DN", "")
+	LDAP_GROUP_DN     = getEnv("LDAP_GROUP_DN", "") // Members of this group get clients
+	LDAP_USER_FILTER  = getEnv("LDAP_USER_FILTER", "") // Extra filter ANDed with the group membership
+	LDAP_NAME_ATTRIBUTE = getEnv("LDAP_NAME_ATTRIBUTE", "uid") // Client name; sAMAccountName on Active Directory
+	LDAP_DEVICES_PER_USER = getEnvInt("LDAP_DEVICES_PER_USER", 1)
+	LDAP_SYNC_INTERVAL = getEnvDuration("LDAP_SYNC_INTERVAL", 15*time.Minute)
+	LDAP_SYNC_FILE    = getEnv("LDAP_SYNC_FILE", "") // Synced clients, ldap-sync.json next to the server config when empty
+	LDAP_GROUP_MAPPINGS = getEnv("LDAP_GROUP_MAPPINGS", "") // YAML mapping directory groups to projects, firewall policies and device counts
+	SCIM_TOKEN        = getEnv("SCIM_TOKEN", "") // Bearer token of the identity provider; SCIM endpoint disabled when empty
+	SCIM_USERS_FILE   = getEnv("SCIM_USERS_FILE", "") // Provisioned users, scim-users.json next to the server config when empty
+	PORTAL_USERS_FILE = getEnv("PORTAL_USERS_FILE", "") // Self-service portal users, portal-users.json next to the server config when empty
+	CONFIRM_DESTRUCTIVE = getEnv("CONFIRM_DESTRUCTIVE", "off") // "token", "approval" or "off"
+	APPROVER_TOKENS   = getEnv("APPROVER_TOKENS", "") // Comma-separated tokens that approve pending changes
+	READONLY_TOKENS   = getEnv("READONLY_TOKENS", "") // Comma-separated tokens that can only read, never seeing configs or keys
+	RESPONSE_SECRETS  = getEnv("RESPONSE_SECRETS", "always") // "always" sends configs and keys to the API and tenant tokens; "opt-in" only with ?include=secrets
+	CONFIRM_TTL       = getEnvDuration("CONFIRM_TTL", 10*time.Minute) // Lifetime of confirmation tokens and pending changes
+	CLIENT_METADATA_FILE = getEnv("CLIENT_METADATA_FILE", "") // Client metadata and notes, client-metadata.json next to the server config when empty
+	GROUPS_FILE       = getEnv("GROUPS_FILE", "") // Client groups, groups.json next to the server config when empty
+	GROUP_POLICY_INTERVAL = getEnvDuration("GROUP_POLICY_INTERVAL", time.Minute) // How often group quotas and expirations are enforced, 0 disables
+	CLIENT_REQUESTS_FILE = getEnv("CLIENT_REQUESTS_FILE", "") // Client adds awaiting approval, client-requests.json next to the server config when empty
+	JOB_TTL           = getEnvDuration("JOB_TTL", time.Hour) // How long finished jobs can be polled
+	WG_NETLINK        = getEnv("WG_NETLINK", "true") == "true" // Read peers over netlink instead of running wg, kernel WireGuard only
+	RATE_LIMIT        = getEnv("RATE_LIMIT", "") // Requests per token, e.g. "20/s"; no limit when empty
+	RATE_LIMIT_ROUTES = getEnv("RATE_LIMIT_ROUTES", "") // Comma-separated per-route overrides, e.g. "GET /status=1/s,POST /users/add=30/m"
+	RATE_LIMIT_BY     = getEnv("RATE_LIMIT_BY", "token") // "token" or "ip"
+	GZIP_RESPONSES    = getEnv("GZIP_RESPONSES", "true") == "true" // Compress responses for clients sending Accept-Encoding: gzip
+	CACHE_REFRESH_INTERVAL = getEnvDuration("CACHE_REFRESH_INTERVAL", time.Minute) // How often the client index and status are rebuilt in the background, 0 only warms them at startup
+	STATUS_CONCURRENCY = getEnvInt("STATUS_CONCURRENCY", 4) // Status commands run at the same time
+	STATUS_COMMAND_TIMEOUT = getEnvDuration("STATUS_COMMAND_TIMEOUT", 5*time.Second) // Longest a status or wg dump command may run, 0 = no limit
+	SECRETS_REFRESH_INTERVAL = getEnvDuration("SECRETS_REFRESH_INTERVAL", 5*time.Minute) // How often secret manager references are read again, 0 disables
+	KEY_ROTATION_INTERVAL = getEnvDuration("KEY_ROTATION_INTERVAL", 0) // Rotate client keys older than this, e.g. "2160h"; never when 0
+	KEY_ROTATION_KEYPAIRS = getEnv("KEY_ROTATION_KEYPAIRS", "false") == "true" // Rotate key pairs too, not only preshared keys
+	KEY_ROTATION_WEBHOOK = getEnv("KEY_ROTATION_WEBHOOK", "") // URL told which clients were rotated
+	KEY_ROTATION_FILE = getEnv("KEY_ROTATION_FILE", "") // Rotation state, key-rotation.json next to the server config when empty
+	DELETED_CLIENT_RETENTION = getEnvDuration("DELETED_CLIENT_RETENTION", 168*time.Hour) // How long deleted clients can be restored, 0 deletes them for good right away
+	DELETED_CLIENTS_FILE = getEnv("DELETED_CLIENTS_FILE", "") // Deleted clients with their keys, deleted-clients.json next to the server config when empty
+	PORT_CHECK_URL = getEnv("PORT_CHECK_URL", "") // Service asked whether the WireGuard port is reachable from outside, see portcheck.go
+	PUBLIC_IP_CHECK_INTERVAL = getEnvDuration("PUBLIC_IP_CHECK_INTERVAL", 0) // How often the public IP is compared to SERVER_PUB_IP, 0 disables
+	PUBLIC_IP_URL = getEnv("PUBLIC_IP_URL", "https://api.ipify.org") // Answers the address it is asked from as plain text
+	PUBLIC_IP_AUTO_UPDATE = getEnv("PUBLIC_IP_AUTO_UPDATE", "false") == "true" // Follow a changed public IP and regenerate the client configs
+	MAINTENANCE_FILE = getEnv("MAINTENANCE_FILE", "") // Set while maintenance mode is on, maintenance.json next to the server config when empty
+	TEARDOWN_BACKUP_DIR = getEnv("TEARDOWN_BACKUP_DIR", "") // Where /server/teardown archives the server files, backups next to the server config when empty
+	EXTRA_LISTEN_PORTS = getEnv("EXTRA_LISTEN_PORTS", "") // UDP ports redirected to SERVER_PORT, e.g. 53,443
+	THROUGHPUT_SAMPLE_INTERVAL = getEnvDuration("THROUGHPUT_SAMPLE_INTERVAL", 10*time.Second) // How often the interface rx/tx counters are sampled, 0 disables
+	THROUGHPUT_RETENTION = getEnvDuration("THROUGHPUT_RETENTION", 24*time.Hour) // How much of the throughput series is kept in memory
+	PEER_EVENTS_WEBHOOK = getEnv("PEER_EVENTS_WEBHOOK", "") // URL POSTed peer.connected and peer.disconnected events
+	PEER_ONLINE_THRESHOLD = getEnvDuration("PEER_ONLINE_THRESHOLD", 3*time.Minute) // A peer is connected once it handshaked within this
+	PEER_EVENT_HYSTERESIS = getEnvDuration("PEER_EVENT_HYSTERESIS", time.Minute) // Extra time without a handshake before a peer counts as disconnected
+	ENDPOINT_PROFILES = getEnv("ENDPOINT_PROFILES", "") // Alternate endpoints for client configs, name=host:port comma-separated
+	WG_USERSPACE = getEnv("WG_USERSPACE", "auto") // auto runs wireguard-go or boringtun without the kernel module, off always uses the unit, else the command to run
+	SELFTEST_ON_START = getEnv("SELFTEST_ON_START", "fail") // "fail" exits when a self-test check fails, "warn" only logs, "off" skips it
+	READ_ONLY = getEnv("READ_ONLY", "false") == "true" // Refuse changes, for a reporting replica; see readonlymode.go
+	CHANGES_FILE = getEnv("CHANGES_FILE", "") // Numbered feed of changes, changes.jsonl next to the server config when empty
+	CHANGES_KEEP = getEnvInt("CHANGES_KEEP", 10000) // Newest changes kept for GET /changes
+	AUDIT_LOG_FILE = getEnv("AUDIT_LOG_FILE", "") // Requests that may change something and who made them, audit.jsonl next to the server config when empty
+	AUDIT_WEBHOOK = getEnv("AUDIT_WEBHOOK", "") // URL POSTed every audit entry
+	TOKEN_NAMES = getEnv("TOKEN_NAMES", "") // Names of tokens by fingerprint, fingerprint=name comma-separated
+	HOOKS_CONFIG = getEnv("HOOKS_CONFIG", "") // YAML list of scripts run before and after client and service changes, see hooks.go
+	SCHEDULES = getEnv("SCHEDULES", "") // Cron schedules of background jobs replacing their intervals, job=schedule semicolon-separated, see scheduler.go
+	MAINTENANCE_WINDOWS = getEnv("MAINTENANCE_WINDOWS", "") // When stop and restart may run, "<cron> <duration>" semicolon-separated; any time when empty, see maintenancewindows.go
 	
 	// Backend detection
 	backendType string // "wireguard" or "amneziawg"
 	wgCmd       string // "wg" or "awg"
 	wgQuickCmd  string // "wg-quick" or "awg-quick"
 	wgServicePrefix string // "wg-quick@" or "awg-quick@"
+	systemctlCmd = "systemctl" // A var so tests can stub it
 )
 
 // WireGuard/AmneziaWG parameters loaded from params file
@@ -63,6 +169,9 @@ type WGParams struct {
 type APIResponse struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message,omitempty"`
+	// Machine-readable reason of a failure, see apierrors.go
+	Code    string       `json:"code,omitempty"`
+	Errors  []FieldError `json:"errors,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 }
 
@@ -70,7 +179,17 @@ type Client struct {
 	Name   string `json:"name"`
 	IPV4   string `json:"ipv4,omitempty"`
 	IPV6   string `json:"ipv6,omitempty"`
+	// Set on the responses about one client
+	PublicKey string `json:"public_key,omitempty"`
 	Config string `json:"config,omitempty"`
+	// Peer commented out in the server config, see disable.go
+	Disabled bool `json:"disabled,omitempty"`
+	// Free-form inventory data, see metadata.go
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Notes    string            `json:"notes,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	// Config file the client was listed from, see streamClients
+	configPath string
 }
 
 // Add user request
@@ -78,6 +197,18 @@ type AddUserRequest struct {
 	Name   string `json:"name"`
 	IPV4   string `json:"ipv4,omitempty"`
 	IPV6   string `json:"ipv6,omitempty"`
+	// Overrides the server's DNS settings for this client
+	DNS    *ClientDNS `json:"dns,omitempty"`
+	// "iptables", "nft" or "off"; CLIENT_KILL_SWITCH when empty
+	KillSwitch string `json:"kill_switch,omitempty"`
+	// false leaves out the PresharedKey; the server's setting when omitted
+	PresharedKey *bool `json:"preshared_key,omitempty"`
+	// Group whose defaults the client inherits
+	Group  string `json:"group,omitempty"`
+	// Inventory data stored with the client
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Notes    string            `json:"notes,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
 }
 
 // Bulk add users request
@@ -90,6 +221,7 @@ type BulkUserResult struct {
 	Name    string `json:"name"`
 	Success bool   `json:"success"`
 	Message string `json:"message,omitempty"`
+	Code    string `json:"code,omitempty"`
 	IPV4    string `json:"ipv4,omitempty"`
 	IPV6    string `json:"ipv6,omitempty"`
 }
@@ -127,6 +259,7 @@ const maxBulkUsers = 500
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.GetHeader("key")
+		apiToken := isAPIToken(token)
 		if token == "" {
 			c.JSON(http.StatusNotFound, APIResponse{
 			})
@@ -134,13 +267,56 @@ func authMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if token != API_TOKEN {
-			c.JSON(http.StatusNotFound, APIResponse{
-			})
-			c.Abort()
-			return
+		if !apiToken && approverTokens()[token] {
+			if !approverAllowed(c) {
+				c.JSON(http.StatusForbidden, APIResponse{
+					Success: false,
+					Message: "Approver tokens can only decide pending changes",
+				})
+				c.Abort()
+				return
+			}
+			c.Set("approver", true)
+		} else if !apiToken && readOnlyTokens()[token] {
+			if !readOnlyAllowed(c) {
+				c.JSON(http.StatusForbidden, APIResponse{
+					Success: false,
+					Message: "Read-only tokens can only read",
+				})
+				c.Abort()
+				return
+			}
+			if includesSecrets(c) {
+				c.JSON(http.StatusForbidden, APIResponse{
+					Success: false,
+					Message: "Read-only tokens can't include secrets",
+				})
+				c.Abort()
+				return
+			}
+			c.Set("readonly", true)
+		} else if !apiToken {
+			tenant := tenantsByToken[token]
+			if tenant == nil {
+				c.JSON(http.StatusNotFound, APIResponse{
+				})
+				c.Abort()
+				return
+			}
+			if !tenantAllowed(c) {
+				c.JSON(http.StatusForbidden, APIResponse{
+					Success: false,
+					Message: "Tenant tokens can only manage their own clients",
+				})
+				c.Abort()
+				return
+			}
+			c.Set("tenant", tenant)
+		} else {
+			markAPITokenUsed(token, time.Now())
 		}
 
+		setActedBy(c, tokenIdentity(token))
 		c.Next()
 	}
 }
@@ -154,6 +330,36 @@ func getEnv(key, fallback string) string {
 	return value
 }
 
+// Helper function to get a duration environment variable (e.g. "10s") with
+// fallback. Invalid values are logged and ignored rather than fatal.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("Invalid %s %q, using %s", key, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// Helper function to get a non-negative integer environment variable with
+// fallback. Invalid values are logged and ignored rather than fatal.
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid %s %q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
 // Detect backend type (WireGuard or AmneziaWG)
 func detectBackend() {
 	// Check if AmneziaWG is installed
@@ -205,8 +411,109 @@ func loadEnv() {
 	// Reload configuration vars after reading .env
 	API_PORT = getEnv("API_PORT", "8080")
 	API_TOKEN = getEnv("API_TOKEN", "your-secure-api-token")
+	API_TOKEN_SECONDARY = getEnv("API_TOKEN_SECONDARY", "")
+	API_TOKENS_FILE = getEnv("API_TOKENS_FILE", "")
 	WIREGUARD_CLIENTS = getEnv("WIREGUARD_CLIENTS", "/home/wireguard/users")
 	DEBUG_MODE = getEnv("DEBUG_MODE", "false") == "true"
+	STATUS_CACHE_TTL = getEnvDuration("STATUS_CACHE_TTL", 5*time.Second)
+	CLIENT_DNS_SEARCH = getEnv("CLIENT_DNS_SEARCH", "")
+	CLIENT_DNS_SPLIT = getEnv("CLIENT_DNS_SPLIT", "")
+	CLIENT_KILL_SWITCH = getEnv("CLIENT_KILL_SWITCH", "")
+	CLIENT_PRESHARED_KEYS = getEnv("CLIENT_PRESHARED_KEYS", "true") == "true"
+	CLIENT_NAME_MAX_LENGTH = getEnvInt("CLIENT_NAME_MAX_LENGTH", 15)
+	CLIENT_NAME_CHARSET = getEnv("CLIENT_NAME_CHARSET", "ascii")
+	CLIENT_NAME_PATTERN = getEnv("CLIENT_NAME_PATTERN", "")
+	GEOIP_DB = getEnv("GEOIP_DB", "")
+	SESSION_POLL_INTERVAL = getEnvDuration("SESSION_POLL_INTERVAL", 30*time.Second)
+	API_DOCS = getEnv("API_DOCS", "false") == "true"
+	GRPC_PORT = getEnv("GRPC_PORT", "")
+	IDEMPOTENCY_TTL = getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+	WG_EASY_CONFIG = getEnv("WG_EASY_CONFIG", "/etc/wireguard/wg0.json")
+	NODES_CONFIG = getEnv("NODES_CONFIG", "")
+	TENANTS_CONFIG = getEnv("TENANTS_CONFIG", "")
+	PROJECTS_FILE = getEnv("PROJECTS_FILE", "")
+	FIREWALL_FILE = getEnv("FIREWALL_FILE", "")
+	FORWARDS_FILE = getEnv("FORWARDS_FILE", "")
+	CLIENT_ISOLATION = getEnv("CLIENT_ISOLATION", "false") == "true"
+	NAT_MANAGED = getEnv("NAT_MANAGED", "false") == "true"
+	NAT_EGRESS_NIC = getEnv("NAT_EGRESS_NIC", "")
+	DNS_RECORDS_BACKEND = getEnv("DNS_RECORDS_BACKEND", "")
+	DNS_RECORDS_DOMAIN = getEnv("DNS_RECORDS_DOMAIN", "vpn.internal")
+	DNS_RECORDS_FILE = getEnv("DNS_RECORDS_FILE", "")
+	DNS_RECORDS_RELOAD = getEnv("DNS_RECORDS_RELOAD", "")
+	DNS_RECORDS_SERVER = getEnv("DNS_RECORDS_SERVER", "")
+	DNS_RECORDS_KEY_FILE = getEnv("DNS_RECORDS_KEY_FILE", "")
+	ENDPOINT_FILTER_FILE = getEnv("ENDPOINT_FILTER_FILE", "")
+	IP_SETS_DIR = getEnv("IP_SETS_DIR", "/etc/wireguard/ipsets")
+	ROUTING_PROFILES_FILE = getEnv("ROUTING_PROFILES_FILE", "")
+	PLACEMENT_POLICY = getEnv("PLACEMENT_POLICY", "peers")
+	HA_LOCK_FILE = getEnv("HA_LOCK_FILE", "")
+	HA_POLL_INTERVAL = getEnvDuration("HA_POLL_INTERVAL", 5*time.Second)
+	MAX_CREATES_PER_HOUR = getEnvInt("MAX_CREATES_PER_HOUR", 0)
+	LDAP_URL = getEnv("LDAP_URL", "")
+	LDAP_BIND_DN = getEnv("LDAP_BIND_DN", "")
+	LDAP_BIND_PASSWORD_FILE = getEnv("LDAP_BIND_PASSWORD_FILE", "")
+	LDAP_BASE_DN = getEnv("LDAP_BASE_DN", "")
+	LDAP_GROUP_DN = getEnv("LDAP_GROUP_DN", "")
+	LDAP_USER_FILTER = getEnv("LDAP_USER_FILTER", "")
+	LDAP_NAME_ATTRIBUTE = getEnv("LDAP_NAME_ATTRIBUTE", "uid")
+	LDAP_DEVICES_PER_USER = getEnvInt("LDAP_DEVICES_PER_USER", 1)
+	LDAP_SYNC_INTERVAL = getEnvDuration("LDAP_SYNC_INTERVAL", 15*time.Minute)
+	LDAP_SYNC_FILE = getEnv("LDAP_SYNC_FILE", "")
+	LDAP_GROUP_MAPPINGS = getEnv("LDAP_GROUP_MAPPINGS", "")
+	SCIM_TOKEN = getEnv("SCIM_TOKEN", "")
+	SCIM_USERS_FILE = getEnv("SCIM_USERS_FILE", "")
+	PORTAL_USERS_FILE = getEnv("PORTAL_USERS_FILE", "")
+	CONFIRM_DESTRUCTIVE = getEnv("CONFIRM_DESTRUCTIVE", "off")
+	APPROVER_TOKENS = getEnv("APPROVER_TOKENS", "")
+	READONLY_TOKENS = getEnv("READONLY_TOKENS", "")
+	RESPONSE_SECRETS = getEnv("RESPONSE_SECRETS", "always")
+	CONFIRM_TTL = getEnvDuration("CONFIRM_TTL", 10*time.Minute)
+	CLIENT_METADATA_FILE = getEnv("CLIENT_METADATA_FILE", "")
+	GROUPS_FILE = getEnv("GROUPS_FILE", "")
+	GROUP_POLICY_INTERVAL = getEnvDuration("GROUP_POLICY_INTERVAL", time.Minute)
+	CLIENT_REQUESTS_FILE = getEnv("CLIENT_REQUESTS_FILE", "")
+	JOB_TTL = getEnvDuration("JOB_TTL", time.Hour)
+	WG_NETLINK = getEnv("WG_NETLINK", "true") == "true"
+	RATE_LIMIT = getEnv("RATE_LIMIT", "")
+	RATE_LIMIT_ROUTES = getEnv("RATE_LIMIT_ROUTES", "")
+	RATE_LIMIT_BY = getEnv("RATE_LIMIT_BY", "token")
+	GZIP_RESPONSES = getEnv("GZIP_RESPONSES", "true") == "true"
+	CACHE_REFRESH_INTERVAL = getEnvDuration("CACHE_REFRESH_INTERVAL", time.Minute)
+	STATUS_CONCURRENCY = getEnvInt("STATUS_CONCURRENCY", 4)
+	STATUS_COMMAND_TIMEOUT = getEnvDuration("STATUS_COMMAND_TIMEOUT", 5*time.Second)
+	SECRETS_REFRESH_INTERVAL = getEnvDuration("SECRETS_REFRESH_INTERVAL", 5*time.Minute)
+	KEY_ROTATION_INTERVAL = getEnvDuration("KEY_ROTATION_INTERVAL", 0)
+	KEY_ROTATION_KEYPAIRS = getEnv("KEY_ROTATION_KEYPAIRS", "false") == "true"
+	KEY_ROTATION_WEBHOOK = getEnv("KEY_ROTATION_WEBHOOK", "")
+	KEY_ROTATION_FILE = getEnv("KEY_ROTATION_FILE", "")
+	DELETED_CLIENT_RETENTION = getEnvDuration("DELETED_CLIENT_RETENTION", 168*time.Hour)
+	DELETED_CLIENTS_FILE = getEnv("DELETED_CLIENTS_FILE", "")
+	PORT_CHECK_URL = getEnv("PORT_CHECK_URL", "")
+	PUBLIC_IP_CHECK_INTERVAL = getEnvDuration("PUBLIC_IP_CHECK_INTERVAL", 0)
+	PUBLIC_IP_URL = getEnv("PUBLIC_IP_URL", "https://api.ipify.org")
+	PUBLIC_IP_AUTO_UPDATE = getEnv("PUBLIC_IP_AUTO_UPDATE", "false") == "true"
+	MAINTENANCE_FILE = getEnv("MAINTENANCE_FILE", "")
+	TEARDOWN_BACKUP_DIR = getEnv("TEARDOWN_BACKUP_DIR", "")
+	EXTRA_LISTEN_PORTS = getEnv("EXTRA_LISTEN_PORTS", "")
+	THROUGHPUT_SAMPLE_INTERVAL = getEnvDuration("THROUGHPUT_SAMPLE_INTERVAL", 10*time.Second)
+	THROUGHPUT_RETENTION = getEnvDuration("THROUGHPUT_RETENTION", 24*time.Hour)
+	PEER_EVENTS_WEBHOOK = getEnv("PEER_EVENTS_WEBHOOK", "")
+	PEER_ONLINE_THRESHOLD = getEnvDuration("PEER_ONLINE_THRESHOLD", 3*time.Minute)
+	PEER_EVENT_HYSTERESIS = getEnvDuration("PEER_EVENT_HYSTERESIS", time.Minute)
+	ENDPOINT_PROFILES = getEnv("ENDPOINT_PROFILES", "")
+	WG_USERSPACE = getEnv("WG_USERSPACE", "auto")
+	SELFTEST_ON_START = getEnv("SELFTEST_ON_START", "fail")
+	READ_ONLY = getEnv("READ_ONLY", "false") == "true"
+	readOnlyMode.Store(READ_ONLY)
+	CHANGES_FILE = getEnv("CHANGES_FILE", "")
+	CHANGES_KEEP = getEnvInt("CHANGES_KEEP", 10000)
+	AUDIT_LOG_FILE = getEnv("AUDIT_LOG_FILE", "")
+	AUDIT_WEBHOOK = getEnv("AUDIT_WEBHOOK", "")
+	TOKEN_NAMES = getEnv("TOKEN_NAMES", "")
+	HOOKS_CONFIG = getEnv("HOOKS_CONFIG", "")
+	SCHEDULES = getEnv("SCHEDULES", "")
+	MAINTENANCE_WINDOWS = getEnv("MAINTENANCE_WINDOWS", "")
 	
 	// Detect backend type (this will set WG_CONFIG_FILE and WG_PARAMS_FILE)
 	detectBackend()
@@ -225,6 +532,12 @@ func loadEnv() {
 
 // Main function
 func main() {
+	// Nothing logged may show a key or token
+	redactLogs()
+
+	bootstrap, bootstrapSettings := registerBootstrapFlags(flag.CommandLine)
+	flag.Parse()
+
 	// Load environment variables
 	loadEnv()
 	
@@ -236,18 +549,164 @@ func main() {
 	log.Printf("VPN params file: %s", WG_PARAMS_FILE)
 	log.Printf("Clients directory: %s", WIREGUARD_CLIENTS)
 	log.Printf("Debug mode: %v", DEBUG_MODE)
+	log.Printf("Status cache TTL: %s", STATUS_CACHE_TTL)
+
+	// A fresh host gets its server config before anything reads it
+	if *bootstrap {
+		done, err := bootstrapServer(*bootstrapSettings)
+		if err != nil {
+			log.Fatalf("Bootstrap failed: %v", err)
+		}
+		if !done {
+			log.Printf("Bootstrap: %s exists, the host is already set up", WG_PARAMS_FILE)
+		}
+	}
+
+	// Misconfigured hosts fail here rather than on the first request
+	startupSelfTest()
 	
+	// Tokens given as secret manager references, before anything uses them
+	if err := loadSecrets(); err != nil {
+		log.Fatalf("Failed to read secrets: %v", err)
+	}
+	startSecretsRefresher()
+	if err := loadAPITokens(); err != nil {
+		log.Fatalf("Failed to load API tokens: %v", err)
+	}
+
 	// Load VPN params
 	err := loadWGParams()
 	if err != nil {
 		log.Fatalf("Failed to load VPN parameters: %v", err)
 	}
 
+	// Only the leader changes the config when several instances share it.
+	// A read-only replica must not take the lock from it.
+	if READ_ONLY {
+		log.Printf("Read-only mode: changes are refused")
+	} else if err := startLeaderElection(); err != nil {
+		log.Fatalf("Failed to start leader election: %v", err)
+	}
+
+	if err := checkDNSRecordsBackend(); err != nil {
+		log.Fatalf("Invalid DNS records config: %v", err)
+	}
+	if err := loadExtraListenPorts(); err != nil {
+		log.Fatalf("Invalid EXTRA_LISTEN_PORTS: %v", err)
+	}
+	if err := loadEndpointProfiles(); err != nil {
+		log.Fatalf("Invalid ENDPOINT_PROFILES: %v", err)
+	}
+	if err := validateKillSwitch(CLIENT_KILL_SWITCH); err != nil {
+		log.Fatalf("Invalid CLIENT_KILL_SWITCH: %v", err)
+	}
+	if err := checkClientNameConfig(); err != nil {
+		log.Fatalf("Invalid client name policy: %v", err)
+	}
+	if err := checkLDAPConfig(); err != nil {
+		log.Fatalf("Invalid LDAP sync config: %v", err)
+	}
+	if err := loadLDAPGroupMappings(); err != nil {
+		log.Fatalf("Invalid LDAP group mappings: %v", err)
+	}
+	if err := checkConfirmConfig(); err != nil {
+		log.Fatalf("Invalid confirmation config: %v", err)
+	}
+	if err := checkResponseSecretsConfig(); err != nil {
+		log.Fatalf("Invalid response filtering config: %v", err)
+	}
+	if err := loadRateLimits(); err != nil {
+		log.Fatalf("Invalid rate limits: %v", err)
+	}
+	if err := loadTokenNames(); err != nil {
+		log.Fatalf("Invalid TOKEN_NAMES: %v", err)
+	}
+	if err := loadHooks(); err != nil {
+		log.Fatalf("Invalid HOOKS_CONFIG: %v", err)
+	}
+	if err := loadSchedules(); err != nil {
+		log.Fatalf("Invalid SCHEDULES: %v", err)
+	}
+	if err := loadMaintenanceWindows(); err != nil {
+		log.Fatalf("Invalid MAINTENANCE_WINDOWS: %v", err)
+	}
+
+	// wireguard-go or boringtun when the kernel module is missing
+	if err := setupUserspace(); err != nil {
+		log.Fatalf("Invalid WG_USERSPACE: %v", err)
+	}
+
+	// Rules belong to the instance that manages the config
+	if !READ_ONLY {
+		// Nothing brings a userspace interface up at boot but the API
+		if userspaceImpl != "" {
+			if err := startUserspaceInterface(); err != nil {
+				log.Printf("Failed to start %s: %v", wgParams.ServerWGNIC, err)
+			}
+		}
+
+		// Masquerading out of the egress interface, when the service owns it
+		if err := setupNAT(); err != nil {
+			log.Fatalf("Failed to set up NAT: %v", err)
+		}
+
+		// nftables rules don't survive a reboot, so install them again
+		if err := applyFirewall(); err != nil {
+			log.Printf("Failed to apply firewall rules: %v", err)
+		}
+	}
+
+	// Optional GeoIP enrichment of peer endpoints
+	loadGeoIPDB()
+
+	// Remote WireGuard servers managed over SSH
+	if err := loadNodes(); err != nil {
+		log.Fatalf("Failed to load nodes: %v", err)
+	}
+
+	// Customers with their own tokens, client namespace and IP pool
+	if err := loadTenants(); err != nil {
+		log.Fatalf("Failed to load tenants: %v", err)
+	}
+
+	// Connection events ride on the session tracker's polls
+	startPeerEvents()
+
+	// Audit entries for a SIEM or chat
+	startAuditWebhook()
+
+	// Approximate per-peer session history from handshakes
+	startSessionTracker()
+
+	// Interface bandwidth series for dashboards
+	startThroughputSampler()
+
+	// Clients for the members of an LDAP group
+	startLDAPSync()
+
+	// Disable group members over their quota or past their expiry
+	startGroupEnforcer()
+
+	// New keys for clients whose keys are older than KEY_ROTATION_INTERVAL
+	startKeyRotation()
+
+	// Drop deleted clients once they can no longer be restored
+	startDeletedClientsPurge()
+
+	// Warn when SERVER_PUB_IP no longer points at this server
+	startPublicIPCheck()
+
+	// Build the client index and status before the first request asks
+	startCacheWarmer()
+
 	// Set Gin to release mode in production
 	if !DEBUG_MODE {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	
+	// Optional gRPC service on its own port
+	startGRPCServer()
+
 	// Start server
 	router := newRouter()
 	log.Printf("WireGuard API server running on port %s", API_PORT)
@@ -258,35 +717,240 @@ func main() {
 // tests so they exercise the exact production routing.
 func newRouter() *gin.Engine {
 	router := gin.Default()
+	router.Use(gzipMiddleware())
+	// Before everything that can fail a request, so each failure gets a code
+	router.Use(errorCodeMiddleware())
+
+	// Public API docs; must come before the auth middleware
+	if API_DOCS {
+		registerDocsRoutes(router)
+	}
+
+	// SCIM provisioning authenticates with its own bearer token
+	registerSCIMRoutes(router)
+
+	// The self-service portal authenticates end users with portal tokens
+	registerPortalRoutes(router)
 
 	// Apply authentication middleware
 	router.Use(authMiddleware())
+	// After auth, which tells read-only tokens apart
+	router.Use(responseFilterMiddleware())
+	// After auth, so buckets belong to valid tokens
+	router.Use(rateLimitMiddleware())
+	// Before anything refuses a change, so refusals are recorded too
+	router.Use(auditMiddleware())
+	router.Use(changesAllowedMiddleware())
+	// Before idempotency, so a 428 or 202 isn't stored for the key
+	router.Use(confirmationMiddleware())
+	router.Use(idempotencyMiddleware())
+	// Before jobs, which run the requests it queues
+	router.Use(maintenanceWindowMiddleware())
+	// After idempotency, so a retry gets the same job
+	router.Use(jobsMiddleware(router))
+	// After jobs, so a job's change is recorded when it runs
+	router.Use(changeFeedMiddleware())
+
+	// Versioned API. Breaking response changes go into a new version group
+	// (e.g. /api/v2) so existing integrations keep working on /api/v1.
+	registerAPIRoutes(router.Group("/api/v1"))
+	// Approving replays requests through the router
+	registerPendingChangeRoutes(router.Group("/api/v1"), router)
+	registerClientRequestRoutes(router.Group("/api/v1"), router)
+
+	// Same routes with 201/204 semantics for mutations, see apiversion.go
+	v2 := router.Group("/api/v2")
+	registerAPIRoutes(v2)
+	registerAPIV2Routes(v2)
+	registerPendingChangeRoutes(v2, router)
+	registerClientRequestRoutes(v2, router)
+
+	// Unversioned routes predate versioning and serve the v1 shape
+	registerAPIRoutes(router.Group("/api", deprecatedAPIMiddleware("/api", "/api/v1")))
 
-	// API routes
-	router.GET("/api/users", listUsersHandlerGin)
-	router.POST("/api/users/add", addUserHandlerGin)
-	router.POST("/api/users/add-bulk", addUsersBulkHandlerGin)
-	router.POST("/api/users/delete", deleteUserHandlerGin)
-	router.POST("/api/users/delete-all", deleteAllUsersHandlerGin)
+	return router
+}
+
+// Register the API routes on a version group
+func registerAPIRoutes(api *gin.RouterGroup) {
+	api.GET("/users", listUsersHandlerGin)
+	api.GET("/users/export", exportUsersHandlerGin)
+	api.GET("/users/roaming", roamingReportHandlerGin)
+	api.POST("/users/add", addUserHandlerGin)
+	api.POST("/users/add-bulk", addUsersBulkHandlerGin)
+	api.POST("/users/delete", deleteUserHandlerGin)
+	api.POST("/users/delete-all", deleteAllUsersHandlerGin)
+	api.POST("/users/preview", previewUserHandlerGin)
+	api.POST("/users/status", usersStatusHandlerGin)
+	api.POST("/lint", lintHandlerGin)
+	api.GET("/trash", listDeletedClientsHandlerGin)
+	api.DELETE("/trash/:name", purgeDeletedClientHandlerGin)
+	api.POST("/users/import", importClientsHandlerGin)
+	api.POST("/users/import/config", adoptClientHandlerGin)
+	api.GET("/users/:name", getUserHandlerGin)
+	api.GET("/users/:name/config", clientConfigHandlerGin)
+	api.POST("/users/:name/metadata", setUserMetadataHandlerGin)
+	api.POST("/users/:name/restore", restoreUserHandlerGin)
+	api.POST("/users/:name/rotate-psk", rotatePSKHandlerGin)
+	api.POST("/users/:name/redistributed", keysRedistributedHandlerGin)
+	api.GET("/users/:name/sessions", userSessionsHandlerGin)
+	api.GET("/users/:name/endpoints", userEndpointsHandlerGin)
+	api.POST("/users/:name/diagnose", diagnoseUserHandlerGin)
+	api.POST("/users/:name/mtu-probe", mtuProbeHandlerGin)
+	api.GET("/users/:name/endpoint-profile", clientEndpointProfileHandlerGin)
+	api.POST("/users/:name/endpoint-profile", setClientEndpointProfileHandlerGin)
+	api.GET("/users/:name/firewall", firewallHandlerGin)
+	api.POST("/users/:name/firewall", setFirewallHandlerGin)
+	api.POST("/users/:name/firewall/delete", deleteFirewallHandlerGin)
+	api.GET("/users/:name/routes", clientRoutesHandlerGin)
+	api.POST("/users/:name/routes", setClientRoutesHandlerGin)
+	api.GET("/users/:name/forwards", portForwardsHandlerGin)
+	api.POST("/users/:name/forwards/add", addPortForwardHandlerGin)
+	api.POST("/users/:name/forwards/delete", deletePortForwardHandlerGin)
+	api.GET("/forwards", listPortForwardsHandlerGin)
 
 	// WireGuard status route
-	router.GET("/api/status", wireGuardStatusHandlerGin)
-	router.POST("/api/start", wireGuardStartHandlerGin)
-	router.POST("/api/stop", wireGuardStopHandlerGin)
-	router.POST("/api/restart", wireGuardRestartHandlerGin)
+	api.GET("/status", wireGuardStatusHandlerGin)
+	api.GET("/status/interfaces", interfacesStatusHandlerGin)
+	api.GET("/stats", statsHandlerGin)
+	api.POST("/start", wireGuardStartHandlerGin)
+	api.POST("/stop", wireGuardStopHandlerGin)
+	api.POST("/restart", wireGuardRestartHandlerGin)
+	api.POST("/server/regenerate-clients", regenerateClientsHandlerGin)
+	api.POST("/server/port-check", portCheckHandlerGin)
+	api.GET("/server/throughput", throughputHandlerGin)
+	api.POST("/server/teardown", teardownHandlerGin)
+	api.GET("/server/endpoint-profiles", endpointProfilesHandlerGin)
+	api.GET("/server/listen-ports", listenPortsHandlerGin)
+	api.GET("/jobs/:id", jobHandlerGin)
+	api.GET("/changes", changesHandlerGin)
+	api.GET("/audit", auditHandlerGin)
+	api.GET("/audit/verify", verifyAuditHandlerGin)
+
+	api.POST("/graphql", graphQLHandlerGin)
+
+	api.GET("/ha", haStatusHandlerGin)
+	api.GET("/selftest", selfTestHandlerGin)
+	api.GET("/maintenance", maintenanceHandlerGin)
+	api.POST("/maintenance/enable", enableMaintenanceHandlerGin)
+	api.POST("/maintenance/disable", disableMaintenanceHandlerGin)
+	api.GET("/maintenance/windows", maintenanceWindowsHandlerGin)
+	api.GET("/read-only", readOnlyModeHandlerGin)
+	api.POST("/read-only/enable", setReadOnlyModeHandler(true))
+	api.POST("/read-only/disable", setReadOnlyModeHandler(false))
+
+	api.GET("/overview", overviewHandlerGin)
+	api.GET("/lookup/ip/:address", lookupIPHandlerGin)
+	api.GET("/lookup/pubkey/*key", lookupPublicKeyHandlerGin)
+
+	api.GET("/nat", natHandlerGin)
+	api.POST("/nat/apply", applyNATHandlerGin)
+	api.GET("/endpoint-filter", endpointFilterHandlerGin)
+	api.POST("/endpoint-filter", setEndpointFilterHandlerGin)
+	api.POST("/endpoint-filter/delete", deleteEndpointFilterHandlerGin)
+	api.GET("/routing-profiles", listRoutingProfilesHandlerGin)
+	api.POST("/routing-profiles", setRoutingProfileHandlerGin)
+	api.POST("/routing-profiles/delete", deleteRoutingProfileHandlerGin)
+	api.GET("/key-rotation", keyRotationHandlerGin)
+	api.POST("/escrow/export", escrowExportHandlerGin)
+	api.GET("/tokens", listAPITokensHandlerGin)
+	api.POST("/tokens/secondary", addAPITokenHandlerGin)
+	api.POST("/tokens/revoke", revokeAPITokenHandlerGin)
+	api.GET("/ldap-sync", ldapSyncHandlerGin)
+	api.POST("/ldap-sync", runLDAPSyncHandlerGin)
+	api.GET("/schedules", schedulesHandlerGin)
+	api.POST("/schedules/:job/run", runScheduledJobHandlerGin)
+	api.GET("/portal-users", listPortalUsersHandlerGin)
+	api.POST("/portal-users", setPortalUserHandlerGin)
+	api.POST("/portal-users/delete", deletePortalUserHandlerGin)
+	api.GET("/dns-records", dnsRecordsHandlerGin)
+	api.POST("/dns-records/sync", syncDNSRecordsHandlerGin)
+
+	// Projects
+	api.GET("/projects", listProjectsHandlerGin)
+	api.POST("/projects/add", addProjectHandlerGin)
+	api.POST("/projects/delete", deleteProjectHandlerGin)
+	api.GET("/projects/:project", projectHandlerGin)
+	api.POST("/projects/:project/clients/add", addProjectClientsHandlerGin)
+	api.POST("/projects/:project/clients/remove", removeProjectClientsHandlerGin)
+	api.POST("/projects/:project/disable", setProjectEnabledHandler(false))
+	api.POST("/projects/:project/enable", setProjectEnabledHandler(true))
+	api.POST("/projects/:project/isolation", setProjectIsolationHandlerGin)
+	api.POST("/projects/:project/routing", setProjectRoutingHandlerGin)
+	api.POST("/projects/:project/delete-all", deleteProjectClientsHandlerGin)
+
+	// Groups with inherited defaults
+	api.GET("/groups", listGroupsHandlerGin)
+	api.POST("/groups/add", addGroupHandlerGin)
+	api.POST("/groups/delete", deleteGroupHandlerGin)
+	api.GET("/groups/:group", groupHandlerGin)
+	api.POST("/groups/:group/defaults", setGroupDefaultsHandlerGin)
+	api.POST("/groups/:group/clients/add", addGroupClientsHandlerGin)
+	api.POST("/groups/:group/clients/remove", removeGroupClientsHandlerGin)
+	api.POST("/groups/:group/apply", applyGroupHandlerGin)
+
+	api.GET("/tags", listTagsHandlerGin)
+	api.POST("/tags/:tag/disable", setTagEnabledHandler(false))
+	api.POST("/tags/:tag/enable", setTagEnabledHandler(true))
+	api.POST("/tags/:tag/delete-all", deleteTaggedClientsHandlerGin)
+
+	// Remote nodes
+	api.GET("/nodes", listNodesHandlerGin)
+	api.POST("/nodes/users/add", placeUserHandlerGin)
+	api.GET("/nodes/:node/users", nodeUsersHandlerGin)
+	api.POST("/nodes/:node/users/add", nodeAddUserHandlerGin)
+	api.POST("/nodes/:node/users/delete", nodeDeleteUserHandlerGin)
+	api.POST("/nodes/:node/users/migrate", migrateUserHandlerGin)
+}
 
-	return router
+// Mark responses of a deprecated route prefix and point clients at the
+// same path under its successor (draft-ietf-httpapi-deprecation-header)
+func deprecatedAPIMiddleware(prefix, successor string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", successor, strings.TrimPrefix(c.Request.URL.Path, prefix)))
+		c.Next()
+	}
 }
 
 // Load WireGuard/AmneziaWG parameters from params file
 func loadWGParams() error {
-	file, err := os.Open(WG_PARAMS_FILE)
+	content, err := os.ReadFile(WG_PARAMS_FILE)
 	if err != nil {
 		return fmt.Errorf("failed to open params file: %v", err)
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	wgParams = parseWGParams(content)
+
+	// Update config file path if interface name was detected
+	if wgParams.ServerWGNIC != "" {
+		WG_CONFIG_FILE = serverConfigPath(backendType, wgParams.ServerWGNIC)
+	}
+
+	return validateWGParams(wgParams)
+}
+
+// Config file of the interface for a backend
+func serverConfigPath(backend, nic string) string {
+	if backend == "amneziawg" {
+		return fmt.Sprintf("/etc/amnezia/amneziawg/%s.conf", nic)
+	}
+	return fmt.Sprintf("/etc/wireguard/%s.conf", nic)
+}
+
+// Ensure all required fields are present
+func validateWGParams(p WGParams) error {
+	if p.ServerPubIP == "" || p.ServerWGNIC == "" || 
+	   p.ServerPubKey == "" || p.ServerPort == "" || 
+	   p.ServerWGIPv4 == "" {
+		return fmt.Errorf("required VPN parameters missing")
+	}
+	return nil
+}
+
+// Parse a WireGuard/AmneziaWG params file
+func parseWGParams(content []byte) WGParams {
+	scanner := bufio.NewScanner(bytes.NewReader(content))
 	params := make(map[string]string)
 	
 	for scanner.Scan() {
@@ -317,7 +981,7 @@ func loadWGParams() error {
 		serverIPv6 = params["SERVER_AWG_IPV6"] // AmneziaWG uses SERVER_AWG_IPV6
 	}
 
-	wgParams = WGParams{
+	return WGParams{
 		ServerPubIP:   params["SERVER_PUB_IP"],
 		ServerPubNIC:  params["SERVER_PUB_NIC"],
 		ServerWGNIC:   serverNIC,
@@ -340,24 +1004,6 @@ func loadWGParams() error {
 		ServerAWGH3:   params["SERVER_AWG_H3"],
 		ServerAWGH4:   params["SERVER_AWG_H4"],
 	}
-
-	// Update config file path if interface name was detected
-	if wgParams.ServerWGNIC != "" {
-		if backendType == "amneziawg" {
-			WG_CONFIG_FILE = fmt.Sprintf("/etc/amnezia/amneziawg/%s.conf", wgParams.ServerWGNIC)
-		} else {
-			WG_CONFIG_FILE = fmt.Sprintf("/etc/wireguard/%s.conf", wgParams.ServerWGNIC)
-		}
-	}
-
-	// Ensure all required fields are present
-	if wgParams.ServerPubIP == "" || wgParams.ServerWGNIC == "" || 
-	   wgParams.ServerPubKey == "" || wgParams.ServerPort == "" || 
-	   wgParams.ServerWGIPv4 == "" {
-		return fmt.Errorf("required VPN parameters missing")
-	}
-
-	return nil
 }
 
 // Handler for listing all users
@@ -367,72 +1013,209 @@ func listUsersHandlerGin(c *gin.Context) {
 		log.Printf("Error syncing deleted clients: %v", err)
 	}
 	
-	clients, err := listWireGuardClients()
+	// Configs are only read with ?include=config, and only for callers
+	// that may see them (see includeSecrets)
+	withConfig := false
+	for _, include := range splitList(c.Query("include")) {
+		if include != "config" && include != "secrets" {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "include must be config or secrets",
+			})
+			return
+		}
+		withConfig = withConfig || include == "config"
+	}
+	withConfig = withConfig && includeSecrets(c)
+
+	// Configs are read one by one as they are written, see streamClients
+	clients, err := listClients(false)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Message: err.Error(),
+			Code:    errorCode(err),
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Data:    clients,
-	})
-}
-
-// Handler for adding a new user
-func addUserHandlerGin(c *gin.Context) {
-	var req AddUserRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+	clients = tenantFrom(c).ownClients(clients)
+	clients, err = filterClients(c, clients)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Message: "Invalid request payload",
+			Message: err.Error(),
+			Code:    errorCode(err),
 		})
 		return
 	}
 
+	streamClients(c, clients, withConfig)
+}
+
+// Stream the clients, with their configs when asked. Thousands of configs
+// would otherwise be held in memory several times over while encoding.
+func streamClients(c *gin.Context, clients []Client, withConfig bool) {
+	respondStreamed(c, http.StatusOK, len(clients), func(i int) (interface{}, bool) {
+		client := clients[i]
+		if withConfig {
+			configData, err := os.ReadFile(client.configPath)
+			if err != nil {
+				// Deleted since it was listed
+				log.Printf("Warning: Failed to read file %s: %v", client.configPath, err)
+				return nil, false
+			}
+			client.Config = string(configData)
+		}
+		return client, true
+	}, []string{"name", "ipv4", "ipv6"}, func(i int) []string {
+		// Inventory only; configs are multi-line and better fetched as YAML
+		return []string{clients[i].Name, clients[i].IPV4, clients[i].IPV6}
+	})
+}
+
+// Validate an add request, answering the problem when there is one.
+// Returns the group the client joins and its metadata with normalized tags.
+func checkAddUserRequest(c *gin.Context, req *AddUserRequest) (*ClientGroup, ClientMetadataRequest, bool) {
 	// Validate client name
-	if !clientNameRegex.MatchString(req.Name) {
+	if !validClientName(req.Name) {
 		c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Message: "Client name " + invalidClientNameMessage,
+			Message: "Client name " + clientNameMessage(),
+			Code:    codeInvalidName,
+		})
+		return nil, ClientMetadataRequest{}, false
+	}
+	if err := req.validateFields(); err != nil {
+		respondValidationError(c, err)
+		return nil, ClientMetadataRequest{}, false
+	}
+	if err := validateKillSwitch(req.KillSwitch); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return nil, ClientMetadataRequest{}, false
+	}
+	if req.KillSwitch != "" && req.KillSwitch != killSwitchOff && !fullTunnel(wgParams.AllowedIPs) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "A kill switch needs clients to route 0.0.0.0/0 or ::/0 through the tunnel",
+		})
+		return nil, ClientMetadataRequest{}, false
+	}
+	group, ok := groupForNewClient(c, req.Group, req.KillSwitch)
+	if !ok {
+		return nil, ClientMetadataRequest{}, false
+	}
+	metadata := ClientMetadataRequest{Metadata: req.Metadata, Notes: &req.Notes, Tags: req.Tags}
+	if err := metadata.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
 		})
+		return nil, ClientMetadataRequest{}, false
+	}
+	return group, metadata, true
+}
+
+// The DNS and kill switch a new client gets: a group's DNS applies unless
+// the request has its own
+func (req AddUserRequest) clientSettings(group *ClientGroup) (*ClientDNS, string) {
+	dns, killSwitch := req.DNS, req.KillSwitch
+	if group != nil {
+		if dns == nil {
+			dns = group.DNS
+		}
+		if !fullTunnel(group.allowedIPs()) {
+			killSwitch = killSwitchOff
+		}
+	}
+	return dns, killSwitch
+}
+
+// Handler for adding a new user
+func addUserHandlerGin(c *gin.Context) {
+	var req AddUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	group, metadata, ok := checkAddUserRequest(c, &req)
+	if !ok {
+		return
+	}
+
+	if needsApproval(c) {
+		requestClientApproval(c, req)
 		return
 	}
 
+	if !reserveCreates(c, 1) {
+		return
+	}
+
+	dns, killSwitch := req.clientSettings(group)
+
 	// Create the client; the existence check and IP allocation both happen
 	// under the config lock so concurrent same-name adds can't both pass
-	clientConfig, ipv4, ipv6, err := addWireGuardClient(req.Name, req.IPV4, req.IPV6)
+	clientConfig, ipv4, ipv6, err := addTenantClient(tenantFrom(c), req.Name, req.IPV4, req.IPV6, dns, killSwitch,
+		presharedKeyFor(req.PresharedKey, CLIENT_PRESHARED_KEYS))
+	if err != nil {
+		releaseCreates(c, 1)
+	}
 	if errors.Is(err, errClientExists) {
 		c.JSON(http.StatusConflict, APIResponse{
 			Success: false,
 			Message: clientExistsMessage,
+			Code:    codeNameTaken,
 		})
 		return
 	}
+	if respondTenantError(c, err) {
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, APIResponse{
+		c.JSON(changeErrorStatus(err), APIResponse{
 			Success: false,
 			Message: err.Error(),
+			Code:    errorCode(err),
 		})
 		return
 	}
 
+	if group != nil {
+		clientConfig, err = joinNewClientToGroup(group.Name, tenantFrom(c).storedName(req.Name))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Client added, but joining group %s failed: %v", group.Name, err),
+			})
+			return
+		}
+	}
+
+	// The client exists now; failing to store its metadata doesn't undo that
+	if len(req.Metadata) > 0 || req.Notes != "" || len(metadata.Tags) > 0 {
+		if err := setClientMetadata(tenantFrom(c).storedName(req.Name), metadata); err != nil {
+			log.Printf("Warning: Failed to store metadata of %s: %v", req.Name, err)
+		}
+	}
+
 	// Create response
 	client := Client{
 		Name:   req.Name,
 		IPV4:   ipv4,
 		IPV6:   ipv6,
+		PublicKey: findPublicKeyByClientName(tenantFrom(c).storedName(req.Name)),
 		Config: clientConfig,
+		Metadata: req.Metadata,
+		Notes:  req.Notes,
+		Tags:   metadata.Tags,
 	}
 
-	c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Message: "Client added successfully",
-		Data:    client,
-	})
+	respondCreated(c, "/users/"+url.PathEscape(req.Name), "Client added successfully", client)
 }
 
 // Handler for adding many users in one request. All clients are created under
@@ -441,11 +1224,7 @@ func addUserHandlerGin(c *gin.Context) {
 // response lists the outcome of every requested name.
 func addUsersBulkHandlerGin(c *gin.Context) {
 	var req AddUsersBulkRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: "Invalid request payload",
-		})
+	if !bindJSON(c, &req) {
 		return
 	}
 
@@ -456,6 +1235,13 @@ func addUsersBulkHandlerGin(c *gin.Context) {
 		})
 		return
 	}
+	if needsApproval(c) {
+		c.JSON(http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: "Adds need approval; request clients one at a time with /users/add",
+		})
+		return
+	}
 	if len(req.Names) > maxBulkUsers {
 		c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
@@ -468,10 +1254,10 @@ func addUsersBulkHandlerGin(c *gin.Context) {
 	// the config, so a validation bug can't half-apply a batch.
 	seen := make(map[string]bool, len(req.Names))
 	for _, name := range req.Names {
-		if !clientNameRegex.MatchString(name) {
+		if !validClientName(name) {
 			c.JSON(http.StatusBadRequest, APIResponse{
 				Success: false,
-				Message: fmt.Sprintf("invalid client name %q: must contain only alphanumeric characters, underscores, or dashes and be less than 16 characters", name),
+				Message: fmt.Sprintf("invalid client name %q: %s", name, clientNameMessage()),
 			})
 			return
 		}
@@ -485,6 +1271,10 @@ func addUsersBulkHandlerGin(c *gin.Context) {
 		seen[name] = true
 	}
 
+	if !reserveCreates(c, len(req.Names)) {
+		return
+	}
+
 	// Key generation shells out to wg but reads no shared state, so do all of
 	// it before taking the lock — this keeps the lock hold to file reads and
 	// appends instead of ~3 subprocess spawns per client. It also means a
@@ -493,15 +1283,18 @@ func addUsersBulkHandlerGin(c *gin.Context) {
 	for i := range req.Names {
 		k, err := generateClientKeys()
 		if err != nil {
+			releaseCreates(c, len(req.Names))
 			c.JSON(http.StatusInternalServerError, APIResponse{
 				Success: false,
 				Message: err.Error(),
+				Code:    errorCode(err),
 			})
 			return
 		}
 		keys[i] = k
 	}
 
+	tenant := tenantFrom(c)
 	results := make([]BulkUserResult, 0, len(req.Names))
 	created := 0
 
@@ -513,7 +1306,7 @@ func addUsersBulkHandlerGin(c *gin.Context) {
 		defer wgConfigMutex.Unlock()
 
 		for i, name := range req.Names {
-			exists, err := clientExists(name)
+			exists, err := clientExists(tenant.storedName(name))
 			if err != nil {
 				// Config unreadable — systemic, every remaining name would
 				// fail the same way, so stop here.
@@ -521,19 +1314,24 @@ func addUsersBulkHandlerGin(c *gin.Context) {
 				break
 			}
 			if exists {
-				results = append(results, BulkUserResult{Name: name, Success: false, Message: clientExistsMessage})
+				results = append(results, BulkUserResult{Name: name, Success: false, Message: clientExistsMessage, Code: codeNameTaken})
 				continue
 			}
 
-			ipv4, ipv6, err := allocateClientIPsLocked("", "")
+			if err := tenant.checkLimitLocked(); err != nil {
+				results = failRemaining(results, req.Names[i:], err)
+				break
+			}
+
+			ipv4, ipv6, err := tenant.allocateIPsLocked("", "")
 			if err != nil {
 				// Pool exhausted or config unreadable — also systemic.
 				results = failRemaining(results, req.Names[i:], err)
 				break
 			}
 
-			if _, err := createWireGuardClientLocked(name, ipv4, ipv6, keys[i]); err != nil {
-				results = append(results, BulkUserResult{Name: name, Success: false, Message: err.Error()})
+			if _, err := createWireGuardClientLocked(tenant.storedName(name), ipv4, ipv6, keys[i], nil, ""); err != nil {
+				results = append(results, BulkUserResult{Name: name, Success: false, Message: err.Error(), Code: errorCode(err)})
 				continue
 			}
 
@@ -547,6 +1345,8 @@ func addUsersBulkHandlerGin(c *gin.Context) {
 		return syncWireGuardConf()
 	}()
 
+	releaseCreates(c, len(req.Names)-created)
+
 	data := gin.H{
 		"created": created,
 		"failed":  len(req.Names) - created,
@@ -594,7 +1394,7 @@ func addUsersBulkHandlerGin(c *gin.Context) {
 // batch pointless.
 func failRemaining(results []BulkUserResult, names []string, err error) []BulkUserResult {
 	for _, name := range names {
-		results = append(results, BulkUserResult{Name: name, Success: false, Message: err.Error()})
+		results = append(results, BulkUserResult{Name: name, Success: false, Message: err.Error(), Code: errorCode(err)})
 	}
 	return results
 }
@@ -602,20 +1402,27 @@ func failRemaining(results []BulkUserResult, names []string, err error) []BulkUs
 // Handler for deleting a user
 func deleteUserHandlerGin(c *gin.Context) {
 	var req DeleteUserRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, APIResponse{
-			Success: false,
-			Message: "Invalid request payload",
-		})
+	if !bindJSON(c, &req) {
 		return
 	}
+	deleteUser(c, req.Name)
+}
+
+// Handler for DELETE /users/{name}
+func deleteUserByNameHandlerGin(c *gin.Context) {
+	deleteUser(c, c.Param("name"))
+}
+
+func deleteUser(c *gin.Context, name string) {
+	name = tenantFrom(c).storedName(name)
 
 	// Check if client exists
-	exists, err := clientExists(req.Name)
+	exists, err := clientExists(name)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Message: err.Error(),
+			Code:    errorCode(err),
 		})
 		return
 	}
@@ -623,23 +1430,22 @@ func deleteUserHandlerGin(c *gin.Context) {
 		c.JSON(http.StatusNotFound, APIResponse{
 			Success: false,
 			Message: "Client not found",
+			Code:    codeClientNotFound,
 		})
 		return
 	}
 
 	// Delete the client
-	if err := deleteWireGuardClient(req.Name); err != nil {
-		c.JSON(http.StatusInternalServerError, APIResponse{
+	if err := deleteWireGuardClient(name); err != nil {
+		c.JSON(changeErrorStatus(err), APIResponse{
 			Success: false,
 			Message: err.Error(),
+			Code:    errorCode(err),
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Message: "Client deleted successfully",
-	})
+	respondDeleted(c, "Client deleted successfully")
 }
 
 // Handler for deleting all users
@@ -671,6 +1477,42 @@ func deleteAllUsersHandlerGin(c *gin.Context) {
 	wgConfigMutex.Lock()
 	defer wgConfigMutex.Unlock()
 	
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to read WireGuard config: %v", err),
+		})
+		return
+	}
+
+	// A pre-delete hook refusing one client refuses them all
+	hookClients := make([]HookClient, len(clientsData))
+	for i, client := range clientsData {
+		hookClients[i] = hookClientFrom(content, client.Name)
+		if err := runPreHooks(hookDelete, hookClients[i]); err != nil {
+			c.JSON(changeErrorStatus(err), APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+	}
+	
+	// Keep them restorable like single deletions
+	names := make([]string, len(clientsData))
+	for i, client := range clientsData {
+		names[i] = client.Name
+	}
+	if err := archiveClientsLocked(content, names, time.Now()); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to keep deleted clients: %v", err),
+		})
+		return
+	}
+	
 	// Step 2: Delete all client config files from directory
 	deletedFiles, filesErr := removeAllClientFiles()
 	if filesErr != nil {
@@ -692,6 +1534,20 @@ func deleteAllUsersHandlerGin(c *gin.Context) {
 		return
 	}
 	
+	// Their firewall policies and port forwards go with them
+	for i, client := range clientsData {
+		if err := removeClientFirewallLocked(client.Name); err != nil {
+			log.Printf("Warning: Failed to remove firewall rules of %s: %v", client.Name, err)
+		}
+		if err := removeClientMetadata(client.Name); err != nil {
+			log.Printf("Warning: Failed to remove metadata of %s: %v", client.Name, err)
+		}
+		if err := removeGroupMember(client.Name); err != nil {
+			log.Printf("Warning: Failed to remove %s from its group: %v", client.Name, err)
+		}
+		announceAfterSyncLocked(changeClientDeleted, "", hookDelete, hookClients[i])
+	}
+	
 	// Step 4: Sync changes with WireGuard to disconnect clients
 	syncErr := syncWireGuardConf()
 	if syncErr != nil {
@@ -806,19 +1662,23 @@ func removeAllClientsFromConfig() error {
 // beyond the original /24 to route. Deploy this only on nodes whose interface
 // has been widened to /16.
 func getNextAvailableIPv4() (string, error) {
-	parts := strings.Split(wgParams.ServerWGIPv4, ".")
-	if len(parts) != 4 {
-		return "", fmt.Errorf("invalid server IPv4 address format")
-	}
+	content, err := readAllocationContent()
+	if err != nil {
+		return "", err
+	}
+	return nextAvailableIPv4(wgParams, content)
+}
+
+// Lowest free IPv4 in the server's /16 given the server config content
+func nextAvailableIPv4(params WGParams, content []byte) (string, error) {
+	parts := strings.Split(params.ServerWGIPv4, ".")
+	if len(parts) != 4 {
+		return "", fmt.Errorf("invalid server IPv4 address format")
+	}
 
 	// /16 base: first two octets.
 	base := fmt.Sprintf("%s.%s", parts[0], parts[1])
-	serverOwnIP := wgParams.ServerWGIPv4
-
-	content, err := os.ReadFile(WG_CONFIG_FILE)
-	if err != nil {
-		return "", fmt.Errorf("failed to read WireGuard config: %v", err)
-	}
+	serverOwnIP := params.ServerWGIPv4
 
 	// Collect every full IPv4 in this /16 already present in the config
 	// (Address and AllowedIPs lines, plus the server's own interface address).
@@ -840,7 +1700,7 @@ func getNextAvailableIPv4() (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("no available IPv4 addresses in the subnet")
+	return "", withCode(codeSubnetExhausted, fmt.Errorf("no available IPv4 addresses in the subnet"))
 }
 
 // Get the next available IPv6 address
@@ -849,20 +1709,24 @@ func getNextAvailableIPv6() (string, error) {
 		return "", nil // IPv6 not enabled
 	}
 
+	// Get existing IPs from the config file and the deleted clients
+	content, err := readAllocationContent()
+	if err != nil {
+		return "", err
+	}
+	return nextAvailableIPv6(wgParams, content)
+}
+
+// Lowest free IPv6 host given the server config content
+func nextAvailableIPv6(params WGParams, content []byte) (string, error) {
 	// Parse the server IP to get the base network
-	parts := strings.Split(wgParams.ServerWGIPv6, "::")
+	parts := strings.Split(params.ServerWGIPv6, "::")
 	if len(parts) != 2 {
 		return "", fmt.Errorf("invalid server IPv6 address format")
 	}
 	
 	baseIP := parts[0]
 	
-	// Get existing IPs from the config file
-	content, err := os.ReadFile(WG_CONFIG_FILE)
-	if err != nil {
-		return "", fmt.Errorf("failed to read WireGuard config: %v", err)
-	}
-	
 	// Find all IPv6 addresses in the config
 	ipv6Pattern := regexp.QuoteMeta(baseIP) + `::([\da-fA-F]+)`
 	ipv6Regex := regexp.MustCompile(ipv6Pattern)
@@ -896,65 +1760,39 @@ func getNextAvailableIPv6() (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("no available IPv6 addresses in the subnet")
+	return "", withCode(codeSubnetExhausted, fmt.Errorf("no available IPv6 addresses in the subnet"))
 }
 
 // Check if a client with the given name exists
 func clientExists(name string) (bool, error) {
-	// First check the config file for the client entry
-	content, err := os.ReadFile(WG_CONFIG_FILE)
+	// First check the server config for the client entry
+	inv, err := currentInventory()
 	if err != nil {
-		return false, fmt.Errorf("failed to read WireGuard config: %v", err)
-	}
-	
-	// (?m) makes ^/$ match per line; without it `$` only matches end-of-text,
-	// so these checks silently never fired and existence relied solely on the
-	// client config files below.
-
-	// Check for exact name match
-	exactClientRegex := regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(name) + `$`)
-	if exactClientRegex.Match(content) {
-		return true, nil
-	}
-
-	// Check for prefixed match with wg0-client- prefix
-	prefixedName := "wg0-client-" + name
-	prefixedClientRegex := regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(prefixedName) + `$`)
-	if prefixedClientRegex.Match(content) {
-		return true, nil
-	}
-
-	// Check for prefixed match with awg0-client- prefix
-	awgPrefixedName := "awg0-client-" + name
-	awgPrefixedClientRegex := regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(awgPrefixedName) + `$`)
-	if awgPrefixedClientRegex.Match(content) {
-		return true, nil
+		return false, err
 	}
-
-	// Check for dynamic prefixed match with interface-client- prefix
-	dynamicPrefixedName := wgParams.ServerWGNIC + "-client-" + name
-	dynamicPrefixedClientRegex := regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(dynamicPrefixedName) + `$`)
-	if dynamicPrefixedClientRegex.Match(content) {
-		return true, nil
+	for _, section := range clientSectionNames(name) {
+		if inv.names[section] {
+			return true, nil
+		}
 	}
 	
 	// Check all possible client config file patterns
-	standardConfigPath := filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+name+".conf")
+	standardConfigPath := filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+clientFileName(name)+".conf")
 	if fileExists(standardConfigPath) {
 		return true, nil
 	}
 	
-	alternativeConfigPath := filepath.Join(WIREGUARD_CLIENTS, "wg0-client-"+name+".conf")
+	alternativeConfigPath := filepath.Join(WIREGUARD_CLIENTS, "wg0-client-"+clientFileName(name)+".conf")
 	if fileExists(alternativeConfigPath) {
 		return true, nil
 	}
 	
-	awgConfigPath := filepath.Join(WIREGUARD_CLIENTS, "awg0-client-"+name+".conf")
+	awgConfigPath := filepath.Join(WIREGUARD_CLIENTS, "awg0-client-"+clientFileName(name)+".conf")
 	if fileExists(awgConfigPath) {
 		return true, nil
 	}
 	
-	simpleConfigPath := filepath.Join(WIREGUARD_CLIENTS, name+".conf")
+	simpleConfigPath := filepath.Join(WIREGUARD_CLIENTS, clientFileName(name)+".conf")
 	if fileExists(simpleConfigPath) {
 		return true, nil
 	}
@@ -962,11 +1800,27 @@ func clientExists(name string) (bool, error) {
 	return false, nil
 }
 
-// List all WireGuard clients
+// List all WireGuard clients with their configs
 func listWireGuardClients() ([]Client, error) {
+	return listClients(true)
+}
+
+// List all WireGuard clients. Without configs, addresses come from the
+// peers in the server config, so a client's file is only read when it has
+// no peer there; on large servers reading every file dominates the list.
+func listClients(withConfig bool) ([]Client, error) {
 	// Create map to hold all clients (using map to avoid duplicates)
 	clientMap := make(map[string]Client)
 	
+	// The server config marks disabled clients and has the peer addresses
+	serverConfig, _ := os.ReadFile(WG_CONFIG_FILE)
+	var peerAddresses map[string][2]string
+	if !withConfig {
+		peerAddresses = tunnelAddressesByClient(serverConfig)
+	}
+	// Names whose files have a transliterated name
+	namesByFile := clientNamesByFileName(serverConfig)
+	
 	// First, scan the client configuration directory
 	err := os.MkdirAll(WIREGUARD_CLIENTS, 0700)
 	if err != nil {
@@ -1013,9 +1867,17 @@ func listWireGuardClients() ([]Client, error) {
 			}
 			continue
 		}
+		if name, ok := namesByFile[clientName]; ok {
+			clientName = name
+		}
+		
+		configPath := filepath.Join(WIREGUARD_CLIENTS, fileName)
+		if addresses, ok := peerAddresses[clientName]; ok {
+			clientMap[clientName] = Client{Name: clientName, IPV4: addresses[0], IPV6: addresses[1], configPath: configPath}
+			continue
+		}
 		
 		// Read the client configuration
-		configPath := filepath.Join(WIREGUARD_CLIENTS, fileName)
 		configData, err := os.ReadFile(configPath)
 		if err != nil {
 			log.Printf("Warning: Failed to read file %s: %v", configPath, err)
@@ -1025,7 +1887,10 @@ func listWireGuardClients() ([]Client, error) {
 		// Create basic client info
 		client := Client{
 			Name:   clientName,
-			Config: string(configData),
+			configPath: configPath,
+		}
+		if withConfig {
+			client.Config = string(configData)
 		}
 		
 		// Try to extract IP addresses if this looks like a WireGuard config
@@ -1064,11 +1929,18 @@ func listWireGuardClients() ([]Client, error) {
 		clientMap[clientName] = client
 	}
 	
+	// Mark clients whose peer is commented out
+	disabled := disabledClientNames(serverConfig)
+
 	// Convert map to slice for return
 	clients := make([]Client, 0, len(clientMap))
 	for _, client := range clientMap {
+		client.Disabled = disabled[client.Name]
 		clients = append(clients, client)
 	}
+	if err := attachClientMetadata(clients); err != nil {
+		return nil, err
+	}
 	
 	return clients, nil
 }
@@ -1137,15 +2009,25 @@ func generateClientKeys() (clientKeys, error) {
 // allocation happen under the lock. Returns errClientExists for taken names,
 // otherwise the client config plus the IPs actually assigned.
 func addWireGuardClient(name, ipv4, ipv6 string) (string, string, string, error) {
+	return addTenantClient(nil, name, ipv4, ipv6, nil, "", CLIENT_PRESHARED_KEYS)
+}
+
+// addWireGuardClient within a tenant's namespace, pool and limit; the nil
+// tenant is the admin. A nil dns uses the server's DNS settings and an empty
+// killSwitch CLIENT_KILL_SWITCH. Without presharedKey the client gets none.
+func addTenantClient(tenant *Tenant, name, ipv4, ipv6 string, dns *ClientDNS, killSwitch string, presharedKey bool) (string, string, string, error) {
 	keys, err := generateClientKeys()
 	if err != nil {
 		return "", "", "", err
 	}
+	if !presharedKey {
+		keys.preSharedKey = ""
+	}
 
 	wgConfigMutex.Lock()
 	defer wgConfigMutex.Unlock()
 
-	exists, err := clientExists(name)
+	exists, err := clientExists(tenant.storedName(name))
 	if err != nil {
 		return "", "", "", err
 	}
@@ -1153,18 +2035,22 @@ func addWireGuardClient(name, ipv4, ipv6 string) (string, string, string, error)
 		return "", "", "", errClientExists
 	}
 
-	ipv4, ipv6, err = allocateClientIPsLocked(ipv4, ipv6)
+	if err := tenant.checkLimitLocked(); err != nil {
+		return "", "", "", err
+	}
+
+	ipv4, ipv6, err = tenant.allocateIPsLocked(ipv4, ipv6)
 	if err != nil {
 		return "", "", "", err
 	}
 
-	clientConfig, err := createWireGuardClientLocked(name, ipv4, ipv6, keys)
+	clientConfig, err := createWireGuardClientLocked(tenant.storedName(name), ipv4, ipv6, keys, dns, killSwitch)
 	if err != nil {
 		return "", "", "", err
 	}
 
 	if err := syncWireGuardConf(); err != nil {
-		return "", "", "", fmt.Errorf("failed to sync WireGuard config: %v", err)
+		return "", "", "", fmt.Errorf("failed to sync WireGuard config: %w", err)
 	}
 
 	return clientConfig, ipv4, ipv6, nil
@@ -1172,8 +2058,10 @@ func addWireGuardClient(name, ipv4, ipv6 string) (string, string, string, error)
 
 // Write the client config file and append the peer to the server config —
 // WITHOUT applying it. Caller must hold wgConfigMutex, supply pre-generated
-// keys (see generateClientKeys), and call syncWireGuardConf afterwards.
-func createWireGuardClientLocked(name, ipv4, ipv6 string, keys clientKeys) (string, error) {
+// keys (see generateClientKeys), and call syncWireGuardConf afterwards. A nil
+// dns uses the server's DNS settings and an empty killSwitch
+// CLIENT_KILL_SWITCH.
+func createWireGuardClientLocked(name, ipv4, ipv6 string, keys clientKeys, dns *ClientDNS, killSwitch string) (string, error) {
 	// Ensure the clients directory exists
 	err := os.MkdirAll(WIREGUARD_CLIENTS, 0700)
 	if err != nil {
@@ -1181,7 +2069,7 @@ func createWireGuardClientLocked(name, ipv4, ipv6 string, keys clientKeys) (stri
 	}
 
 	// Check if client config file already exists
-	configPath := filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+name+".conf")
+	configPath := filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+clientFileName(name)+".conf")
 	if fileExists(configPath) {
 		return "", fmt.Errorf("client configuration file already exists at %s", configPath)
 	}
@@ -1191,15 +2079,56 @@ func createWireGuardClientLocked(name, ipv4, ipv6 string, keys clientKeys) (stri
 		return "", fmt.Errorf("at least one IP address (IPv4 or IPv6) must be provided")
 	}
 
-	// Create client configuration
-	endpoint := wgParams.ServerPubIP
+	clientConfig := renderClientConfig(wgParams, backendType, ipv4, ipv6, keys, dns, killSwitch)
+	clientConfig, err = withEndpointProfile(clientConfig, defaultEndpointProfile)
+	if err != nil {
+		return "", err
+	}
+
+	hookClient := HookClient{Name: name, IPV4: ipv4, IPV6: ipv6, PublicKey: keys.publicKey}
+	if err := runPreHooks(hookAdd, hookClient); err != nil {
+		return "", err
+	}
+
+	// Write client config to file
+	err = os.WriteFile(configPath, []byte(clientConfig), 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write client config: %v", err)
+	}
+
+	// Add client to server config
+	serverConfigUpdate := renderServerPeer(name, ipv4, ipv6, keys)
+
+	// If the peer can't be appended to the server config, remove the client
+	// file written above — a leftover file makes clientExists treat the name
+	// as taken forever even though no peer exists.
+	f, err := os.OpenFile(WG_CONFIG_FILE, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		os.Remove(configPath)
+		return "", fmt.Errorf("failed to open server config: %v", err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(serverConfigUpdate); err != nil {
+		os.Remove(configPath)
+		return "", fmt.Errorf("failed to update server config: %v", err)
+	}
+	announceAfterSyncLocked(changeClientCreated, "", hookAdd, hookClient)
+
+	return clientConfig, nil
+}
+
+// Render a client's config file for the server described by params, with
+// dns overriding its DNS settings when not nil
+func renderClientConfig(params WGParams, backend, ipv4, ipv6 string, keys clientKeys, dns *ClientDNS, killSwitch string) string {
+	endpoint := params.ServerPubIP
 	
 	// If IPv6, add brackets if missing
 	if strings.Contains(endpoint, ":") && !strings.Contains(endpoint, "[") {
 		endpoint = "[" + endpoint + "]"
 	}
 	
-	endpoint = endpoint + ":" + wgParams.ServerPort
+	endpoint = endpoint + ":" + params.ServerPort
 
 	// Format Address line based on provided IP addresses
 	var addressParts []string
@@ -1215,60 +2144,56 @@ func createWireGuardClientLocked(name, ipv4, ipv6 string, keys clientKeys) (stri
 	var interfaceLines []string
 	interfaceLines = append(interfaceLines, fmt.Sprintf("PrivateKey = %s", keys.privateKey))
 	interfaceLines = append(interfaceLines, addressLine)
-	interfaceLines = append(interfaceLines, fmt.Sprintf("DNS = %s,%s", wgParams.ClientDNS1, wgParams.ClientDNS2))
+	interfaceLines = append(interfaceLines, renderClientDNS(clientDNSFor(params, dns))...)
+	interfaceLines = append(interfaceLines, renderKillSwitch(params, backend, killSwitchFor(killSwitch))...)
 	
 	// Add AmneziaWG specific parameters if backend is AmneziaWG
-	if backendType == "amneziawg" {
-		if wgParams.ServerAWGJC != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("Jc = %s", wgParams.ServerAWGJC))
+	if backend == "amneziawg" {
+		if params.ServerAWGJC != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("Jc = %s", params.ServerAWGJC))
 		}
-		if wgParams.ServerAWGJMin != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("Jmin = %s", wgParams.ServerAWGJMin))
+		if params.ServerAWGJMin != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("Jmin = %s", params.ServerAWGJMin))
 		}
-		if wgParams.ServerAWGJMax != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("Jmax = %s", wgParams.ServerAWGJMax))
+		if params.ServerAWGJMax != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("Jmax = %s", params.ServerAWGJMax))
 		}
-		if wgParams.ServerAWGS1 != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("S1 = %s", wgParams.ServerAWGS1))
+		if params.ServerAWGS1 != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("S1 = %s", params.ServerAWGS1))
 		}
-		if wgParams.ServerAWGS2 != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("S2 = %s", wgParams.ServerAWGS2))
+		if params.ServerAWGS2 != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("S2 = %s", params.ServerAWGS2))
 		}
-		if wgParams.ServerAWGH1 != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("H1 = %s", wgParams.ServerAWGH1))
+		if params.ServerAWGH1 != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("H1 = %s", params.ServerAWGH1))
 		}
-		if wgParams.ServerAWGH2 != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("H2 = %s", wgParams.ServerAWGH2))
+		if params.ServerAWGH2 != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("H2 = %s", params.ServerAWGH2))
 		}
-		if wgParams.ServerAWGH3 != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("H3 = %s", wgParams.ServerAWGH3))
+		if params.ServerAWGH3 != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("H3 = %s", params.ServerAWGH3))
 		}
-		if wgParams.ServerAWGH4 != "" {
-			interfaceLines = append(interfaceLines, fmt.Sprintf("H4 = %s", wgParams.ServerAWGH4))
+		if params.ServerAWGH4 != "" {
+			interfaceLines = append(interfaceLines, fmt.Sprintf("H4 = %s", params.ServerAWGH4))
 		}
 	}
 	
 	// PersistentKeepalive keeps the client's NAT mapping alive while the
 	// phone is locked and idle; without it recovery after unlock is slow.
-	clientConfig := fmt.Sprintf(`[Interface]
+	return fmt.Sprintf(`[Interface]
 %s
 
 [Peer]
 PublicKey = %s
-PresharedKey = %s
-Endpoint = %s
+%sEndpoint = %s
 AllowedIPs = %s
 PersistentKeepalive = 25
 `, strings.Join(interfaceLines, "\n"),
-	   wgParams.ServerPubKey, keys.preSharedKey, endpoint, wgParams.AllowedIPs)
-
-	// Write client config to file
-	err = os.WriteFile(configPath, []byte(clientConfig), 0600)
-	if err != nil {
-		return "", fmt.Errorf("failed to write client config: %v", err)
-	}
+	   params.ServerPubKey, presharedKeyLine(keys), endpoint, params.AllowedIPs)
+}
 
-	// Add client to server config
+// Render a client's peer block for the server config
+func renderServerPeer(name, ipv4, ipv6 string, keys clientKeys) string {
 	var allowedIPsParts []string
 	if ipv4 != "" {
 		allowedIPsParts = append(allowedIPsParts, ipv4+"/32")
@@ -1278,34 +2203,22 @@ PersistentKeepalive = 25
 	}
 	allowedIPs := strings.Join(allowedIPsParts, ",")
 
-	serverConfigUpdate := fmt.Sprintf(`
+	return fmt.Sprintf(`
 ### Client %s
 [Peer]
 PublicKey = %s
-PresharedKey = %s
-AllowedIPs = %s
-`, name, keys.publicKey, keys.preSharedKey, allowedIPs)
-
-	// If the peer can't be appended to the server config, remove the client
-	// file written above — a leftover file makes clientExists treat the name
-	// as taken forever even though no peer exists.
-	f, err := os.OpenFile(WG_CONFIG_FILE, os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		os.Remove(configPath)
-		return "", fmt.Errorf("failed to open server config: %v", err)
-	}
-	defer f.Close()
-
-	if _, err = f.WriteString(serverConfigUpdate); err != nil {
-		os.Remove(configPath)
-		return "", fmt.Errorf("failed to update server config: %v", err)
-	}
-
-	return clientConfig, nil
+%sAllowedIPs = %s
+`, name, keys.publicKey, presharedKeyLine(keys), allowedIPs)
 }
 
 // Delete a WireGuard client
 func deleteWireGuardClient(name string) error {
+	return removeWireGuardClient(name, true)
+}
+
+// Delete a client, keeping it restorable for DELETED_CLIENT_RETENTION when
+// archive is set, see deleted.go
+func removeWireGuardClient(name string, archive bool) error {
 	wgConfigMutex.Lock()
 	defer wgConfigMutex.Unlock()
 	
@@ -1315,68 +2228,32 @@ func deleteWireGuardClient(name string) error {
 		return fmt.Errorf("failed to read WireGuard config: %v", err)
 	}
 
-	// Look for patterns matching either:
-	// 1. "### Client {name}" (exact name match)
-	// 2. "### Client wg0-client-{name}" (prefixed name match)
-	// 3. "### Client {interface}-client-{name}" (dynamic interface prefixed match)
-	
-	// Check for exact name match first
-	exactClientRegex := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(name) + `$.*?^$`)
-	if exactClientRegex.Match(content) {
-		newContent := exactClientRegex.ReplaceAll(content, []byte(""))
-		
+	hookClient := hookClientFrom(content, name)
+	if err := runPreHooks(hookDelete, hookClient); err != nil {
+		return err
+	}
+
+	if archive {
+		if err := archiveClientsLocked(content, []string{name}, time.Now()); err != nil {
+			return fmt.Errorf("failed to keep deleted client: %v", err)
+		}
+	}
+
+	// Remove the block under whichever name form the client was added as
+	if newContent, removed := removeClientFromConfig(content, name); removed {
 		// Write back the updated config
 		err = os.WriteFile(WG_CONFIG_FILE, newContent, 0600)
 		if err != nil {
 			return fmt.Errorf("failed to update server config: %v", err)
 		}
-	} else {
-		// Check for prefixed name matches
-		prefixedName := "wg0-client-" + name
-		prefixedClientRegex := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(prefixedName) + `$.*?^$`)
-		
-		// Check for awg0 prefixed name matches
-		awgPrefixedName := "awg0-client-" + name
-		awgPrefixedClientRegex := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(awgPrefixedName) + `$.*?^$`)
-		
-		// Also try with dynamic interface name prefix
-		dynamicPrefixedName := wgParams.ServerWGNIC + "-client-" + name
-		dynamicPrefixedClientRegex := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(dynamicPrefixedName) + `$.*?^$`)
-		
-		if prefixedClientRegex.Match(content) {
-			newContent := prefixedClientRegex.ReplaceAll(content, []byte(""))
-			err = os.WriteFile(WG_CONFIG_FILE, newContent, 0600)
-			if err != nil {
-				return fmt.Errorf("failed to update server config: %v", err)
-			}
-		} else if awgPrefixedClientRegex.Match(content) {
-			newContent := awgPrefixedClientRegex.ReplaceAll(content, []byte(""))
-			err = os.WriteFile(WG_CONFIG_FILE, newContent, 0600)
-			if err != nil {
-				return fmt.Errorf("failed to update server config: %v", err)
-			}
-		} else if dynamicPrefixedClientRegex.Match(content) {
-			newContent := dynamicPrefixedClientRegex.ReplaceAll(content, []byte(""))
-			err = os.WriteFile(WG_CONFIG_FILE, newContent, 0600)
-			if err != nil {
-				return fmt.Errorf("failed to update server config: %v", err)
-			}
-		} else if DEBUG_MODE {
-			log.Printf("Warning: Could not find client %s in VPN config file", name)
-		}
+	} else if DEBUG_MODE {
+		log.Printf("Warning: Could not find client %s in VPN config file", name)
 	}
 
-	// Try to remove client config file with different possible patterns
-	standardConfigPath := filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+name+".conf")
-	alternativeConfigPath := filepath.Join(WIREGUARD_CLIENTS, "wg0-client-"+name+".conf")
-	awgConfigPath := filepath.Join(WIREGUARD_CLIENTS, "awg0-client-"+name+".conf")
-	simpleConfigPath := filepath.Join(WIREGUARD_CLIENTS, name+".conf")
-	
 	// Try removing all possible config file patterns
-	configPaths := []string{standardConfigPath, alternativeConfigPath, awgConfigPath, simpleConfigPath}
 	clientRemoved := false
 	
-	for _, configPath := range configPaths {
+	for _, configPath := range clientConfigPaths(name) {
 		if fileExists(configPath) {
 			if err := os.Remove(configPath); err != nil {
 				return fmt.Errorf("failed to delete client config at %s: %v", configPath, err)
@@ -1392,9 +2269,20 @@ func deleteWireGuardClient(name string) error {
 		log.Printf("Warning: Could not find any config files for client %s", name)
 	}
 
+	if err := removeClientFirewallLocked(name); err != nil {
+		return err
+	}
+	if err := removeClientMetadata(name); err != nil {
+		return err
+	}
+	if err := removeGroupMember(name); err != nil {
+		return err
+	}
+	announceAfterSyncLocked(changeClientDeleted, "", hookDelete, hookClient)
+
 	// Apply the configuration
 	if err := syncWireGuardConf(); err != nil {
-		return fmt.Errorf("failed to sync WireGuard config: %v", err)
+		return fmt.Errorf("failed to sync WireGuard config: %w", err)
 	}
 
 	return nil
@@ -1458,7 +2346,8 @@ func syncWireGuardConf() error {
 			log.Printf("%s strip command failed: %v", wgQuickCmd, err)
 			log.Printf("stderr: %s", stripError.String())
 		}
-		return fmt.Errorf("%s strip command failed: %v, stderr: %s", wgQuickCmd, err, stripError.String())
+		// wg-quick quotes the config lines it can't parse
+		return withCode(codeSyncFailed, fmt.Errorf("%s strip command failed: %v, stderr: %s", wgQuickCmd, err, redactSecrets(stripError.String())))
 	}
 	
 	syncCmd := exec.Command(wgCmd, "syncconf", wgParams.ServerWGNIC, "/dev/stdin")
@@ -1472,7 +2361,24 @@ func syncWireGuardConf() error {
 			log.Printf("%s syncconf command failed: %v", wgCmd, err)
 			log.Printf("stderr: %s", syncError.String())
 		}
-		return fmt.Errorf("%s syncconf command failed: %v, stderr: %s", wgCmd, err, syncError.String())
+		return withCode(codeSyncFailed, fmt.Errorf("%s syncconf command failed: %v, stderr: %s", wgCmd, err, redactSecrets(syncError.String())))
+	}
+	
+	// Peers changed, so a cached status would show stale peers
+	invalidateStatusCache()
+	announcePendingChangesLocked()
+
+	// Firewall chains follow the peers they are keyed by
+	if err := applyFirewallLocked(); err != nil {
+		return fmt.Errorf("failed to apply firewall rules: %v", err)
+	}
+
+	// DNS records too, but a DNS outage must not fail client changes
+	syncDNSRecordsLocked()
+
+	// wg-quick only adds routes for AllowedIPs when the interface comes up
+	if err := reconcileRoutesLocked(); err != nil {
+		log.Printf("Failed to update routes: %v", err)
 	}
 	
 	return nil
@@ -1480,6 +2386,11 @@ func syncWireGuardConf() error {
 
 // Check if any clients in WireGuard config don't have corresponding config files and remove them
 func syncDeletedClientsWithConfig() error {
+	// Followers and read-only replicas must not touch the config
+	if !writesAllowed() {
+		return nil
+	}
+
 	wgConfigMutex.Lock()
 	defer wgConfigMutex.Unlock()
 	
@@ -1489,19 +2400,11 @@ func syncDeletedClientsWithConfig() error {
 		return fmt.Errorf("failed to read WireGuard config: %v", err)
 	}
 	
-	// Extract client names from the config file
-	clientSectionRegex := regexp.MustCompile(`(?m)^### Client (.+)$`)
-	matches := clientSectionRegex.FindAllSubmatch(content, -1)
-	
 	configChanged := false
 	
 	// For each client in WireGuard config, check if its config file exists
-	for _, match := range matches {
-		if len(match) < 2 {
-			continue
-		}
-		
-		clientName := string(match[1])
+	for _, section := range scanClientSections(content) {
+		clientName := section.name
 		
 		// Check if config file exists for this client using all possible naming patterns
 		if !clientConfigExists(clientName) {
@@ -1517,6 +2420,8 @@ func syncDeletedClientsWithConfig() error {
 					log.Printf("Failed to update WireGuard config file: %v", err)
 					continue
 				}
+				// Later removals build on this one
+				content = newContent
 				configChanged = true
 			}
 		}
@@ -1525,7 +2430,7 @@ func syncDeletedClientsWithConfig() error {
 	// If we made changes to the config, apply them
 	if configChanged {
 		if err := syncWireGuardConf(); err != nil {
-			return fmt.Errorf("failed to sync WireGuard config: %v", err)
+			return fmt.Errorf("failed to sync WireGuard config: %w", err)
 		}
 	}
 	
@@ -1534,37 +2439,26 @@ func syncDeletedClientsWithConfig() error {
 
 // Remove client entry from WireGuard/AmneziaWG config directly without calling deleteWireGuardClient
 func removeClientFromConfig(content []byte, clientName string) ([]byte, bool) {
-	// Try all possible client name formats in the config
-	patterns := []string{
-		`(?ms)^### Client ` + regexp.QuoteMeta(clientName) + `$.*?^$`,
-		`(?ms)^### Client ` + regexp.QuoteMeta("wg0-client-" + clientName) + `$.*?^$`,
-		`(?ms)^### Client ` + regexp.QuoteMeta("awg0-client-" + clientName) + `$.*?^$`,
-		`(?ms)^### Client ` + regexp.QuoteMeta(wgParams.ServerWGNIC + "-client-" + clientName) + `$.*?^$`,
-	}
-	
-	originalSize := len(content)
-	var newContent []byte
-	removed := false
-	
-	for _, pattern := range patterns {
-		clientRegex := regexp.MustCompile(pattern)
-		if clientRegex.Match(content) {
-			newContent = clientRegex.ReplaceAll(content, []byte(""))
-			removed = true
-			break
+	sections := scanClientSections(content)
+	
+	// Try all possible client name formats in the config, removing every
+	// block of the first one found
+	for _, name := range clientSectionNames(clientName) {
+		var newContent []byte
+		last, removed := 0, false
+		for _, section := range sections {
+			if section.name != name {
+				continue
+			}
+			newContent = append(newContent, content[last:section.start]...)
+			last, removed = section.end, true
+		}
+		if removed {
+			return append(newContent, content[last:]...), true
 		}
 	}
 	
-	// If none of the patterns matched, return original content
-	if !removed {
-		return content, false
-	}
-	
-	// If the content changed, return the new content
-	if len(newContent) != originalSize {
-		return newContent, true
-	}
-	
+	// If none of the formats matched, return original content
 	return content, false
 }
 
@@ -1575,51 +2469,156 @@ func clientConfigExists(clientName string) bool {
 		return false
 	}
 	
-	standardConfigPath := filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+clientName+".conf")
-	alternativeConfigPath := filepath.Join(WIREGUARD_CLIENTS, "wg0-client-"+clientName+".conf")
-	simpleConfigPath := filepath.Join(WIREGUARD_CLIENTS, clientName+".conf")
+	standardConfigPath := filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+clientFileName(clientName)+".conf")
+	alternativeConfigPath := filepath.Join(WIREGUARD_CLIENTS, "wg0-client-"+clientFileName(clientName)+".conf")
+	simpleConfigPath := filepath.Join(WIREGUARD_CLIENTS, clientFileName(clientName)+".conf")
 	
 	return fileExists(standardConfigPath) || fileExists(alternativeConfigPath) || fileExists(simpleConfigPath)
 }
 
-// WireGuard status handler - shows current status of the WireGuard server
+// Cached result of collectWireGuardStatus. Collection spawns a dozen
+// processes, so monitoring that polls every few seconds is served from here
+// for STATUS_CACHE_TTL instead.
+var (
+	// Serializes collections so concurrent pollers wait for one collection
+	// instead of each spawning their own
+	statusCollectMutex sync.Mutex
+	// Guards the cached entry; never held while collecting, because
+	// collection can sync the config, which invalidates the cache
+	statusCacheMutex sync.Mutex
+	statusCacheData  map[string]interface{}
+	statusCacheTime  time.Time
+)
+
+// Drop the cached status so the next request collects fresh data. Called
+// after anything that changes peers or the service state.
+func invalidateStatusCache() {
+	statusCacheMutex.Lock()
+	defer statusCacheMutex.Unlock()
+
+	statusCacheData = nil
+}
+
+// Return the cached status, collecting it first when the cache is empty,
+// older than STATUS_CACHE_TTL, or refresh is set. The bool reports whether
+// the result came from the cache.
+func getWireGuardStatus(refresh bool) (map[string]interface{}, time.Time, bool) {
+	statusCollectMutex.Lock()
+	defer statusCollectMutex.Unlock()
+
+	if !refresh {
+		statusCacheMutex.Lock()
+		data, collectedAt := statusCacheData, statusCacheTime
+		statusCacheMutex.Unlock()
+
+		if data != nil && time.Since(collectedAt) < STATUS_CACHE_TTL {
+			return data, collectedAt, true
+		}
+	}
+
+	data := collectWireGuardStatus()
+	collectedAt := time.Now()
+
+	statusCacheMutex.Lock()
+	statusCacheData, statusCacheTime = data, collectedAt
+	statusCacheMutex.Unlock()
+
+	return data, collectedAt, false
+}
+
+// WireGuard status handler - shows current status of the WireGuard server.
+// Pass ?refresh=true to bypass the status cache and ?format= to choose the
+// transfer fields (see parseTransferFormat).
 func wireGuardStatusHandlerGin(c *gin.Context) {
+	format, ok := parseTransferFormat(c)
+	if !ok {
+		return
+	}
+
+	data, collectedAt, cached := getWireGuardStatus(c.Query("refresh") == "true")
+
+	// Copy so the per-response fields don't leak into the shared cache entry
+	statusData := make(map[string]interface{}, len(data)+2)
+	for k, v := range data {
+		statusData[k] = v
+	}
+	statusData["cached"] = cached
+	statusData["collected_at"] = collectedAt.UTC().Format(time.RFC3339)
+
+	if peers, ok := data["peers"].([]map[string]interface{}); ok {
+		formatted := make([]map[string]interface{}, 0, len(peers))
+		for _, peer := range peers {
+			formatted = append(formatted, formatPeerTransfer(peer, format))
+		}
+		statusData["peers"] = formatted
+	}
+
+	respondNegotiated(c, http.StatusOK, APIResponse{
+		Success: true,
+		Data:    statusData,
+	}, func() [][]string {
+		peers, _ := data["peers"].([]map[string]interface{})
+		return peerStatusTable(peers)
+	})
+}
+
+// Collect the full server status. Expensive: runs wg, ip, ss, systemctl and
+// friends, so callers should go through getWireGuardStatus.
+func collectWireGuardStatus() map[string]interface{} {
 	// Sync deleted clients first to ensure the server config is up to date
 	if err := syncDeletedClientsWithConfig(); err != nil && DEBUG_MODE {
 		log.Printf("Error syncing deleted clients: %v", err)
 	}
 	
-	// Check VPN backend installed
-	wgInstalled, _ := executeCommand("which", wgCmd)
-	wgQuickInstalled, _ := executeCommand("which", wgQuickCmd)
-	
-	// Get VPN status
-	statusSuccess, statusOutput := executeCommand(wgCmd, "show", wgParams.ServerWGNIC)
-	
-	// Get VPN statistics (transfer, handshakes, etc.)
-	statsSuccess, statsOutput := executeCommand(wgCmd, "show", wgParams.ServerWGNIC, "dump")
-	
-	// Check if WireGuard interface is up - try ip command first, fall back to ifconfig
-	var interfaceOutput string
-	_, interfaceOutput = executeCommand("ip", "addr", "show", wgParams.ServerWGNIC)
-	if interfaceOutput == "" || strings.Contains(interfaceOutput, "Error") {
-		// Try ifconfig as fallback
-		_, interfaceOutput = executeCommand("ifconfig", wgParams.ServerWGNIC)
-	}
-	
-	// Get listening port status - try ss command first, fall back to netstat
-	var portSuccess, portOutput string
-	portSuccess, portOutput = executeCommand("ss", "-lnp", fmt.Sprintf("sport = %s", wgParams.ServerPort))
-	if portSuccess != "success" {
-		// Try netstat as fallback
-		portSuccess, portOutput = executeCommand("netstat", "-lnp", fmt.Sprintf("| grep %s", wgParams.ServerPort))
+	// The commands don't depend on each other, so they run side by side and
+	// the collection takes as long as the slowest one rather than the sum
+	timeout := STATUS_COMMAND_TIMEOUT
+	var (
+		wgInstalled, wgQuickInstalled string
+		statusSuccess, statusOutput   string
+		statsSuccess, statsOutput     string
+		interfaceOutput               string
+		portSuccess, portOutput       string
+		loadOutput, hostInfo          string
+		moduleOutput, serviceOutput   string
+		routed                        []RoutedSubnet
+	)
+	modulePattern := "wireguard"
+	if backendType == "amneziawg" {
+		modulePattern = "amneziawg"
 	}
-	
-	// Get system load
-	_, loadOutput := executeCommand("uptime")
-	
-	// Get server information
-	hostInfo, _ := executeCommand("uname", "-a")
+	runBounded(STATUS_CONCURRENCY,
+		// Check VPN backend installed
+		func() { wgInstalled, _ = executeCommandTimeout(timeout, "which", wgCmd) },
+		func() { wgQuickInstalled, _ = executeCommandTimeout(timeout, "which", wgQuickCmd) },
+		// Get VPN status
+		func() { statusSuccess, statusOutput = executeCommandTimeout(timeout, wgCmd, "show", wgParams.ServerWGNIC) },
+		// Get VPN statistics (transfer, handshakes, etc.)
+		func() { statsSuccess, statsOutput = wireGuardDump() },
+		// Check if WireGuard interface is up - try ip command first, fall back to ifconfig
+		func() {
+			_, interfaceOutput = executeCommandTimeout(timeout, "ip", "addr", "show", wgParams.ServerWGNIC)
+			if interfaceOutput == "" || strings.Contains(interfaceOutput, "Error") {
+				_, interfaceOutput = executeCommandTimeout(timeout, "ifconfig", wgParams.ServerWGNIC)
+			}
+		},
+		// Get listening port status - try ss command first, fall back to netstat
+		func() {
+			portSuccess, portOutput = executeCommandTimeout(timeout, "ss", "-lnp", fmt.Sprintf("sport = %s", wgParams.ServerPort))
+			if portSuccess != "success" {
+				portSuccess, portOutput = executeCommandTimeout(timeout, "netstat", "-lnp", fmt.Sprintf("| grep %s", wgParams.ServerPort))
+			}
+		},
+		// Get system load and server information
+		func() { _, loadOutput = executeCommandTimeout(timeout, "uptime") },
+		func() { hostInfo, _ = executeCommandTimeout(timeout, "uname", "-a") },
+		// Get kernel module and service status
+		func() { _, moduleOutput = executeCommandTimeout(timeout, "lsmod", fmt.Sprintf("| grep %s", modulePattern)) },
+		func() {
+			_, serviceOutput = executeCommandTimeout(timeout, systemctlCmd, "status", wgServicePrefix+wgParams.ServerWGNIC)
+		},
+		func() { routed = routedSubnetStatus() },
+	)
 	
 	// Parse the statistics to get more structured data
 	var peers []map[string]interface{}
@@ -1640,9 +2639,17 @@ func wireGuardStatusHandlerGin(c *gin.Context) {
 					"latest_handshake": fields[4],
 				}
 				
+				// Stored as exact byte counts; formatPeerTransfer adds the
+				// human-readable strings per response
 				if len(fields) >= 7 {
-					peer["transfer_rx"] = fields[5]
-					peer["transfer_tx"] = fields[6]
+					rx, _ := strconv.ParseInt(fields[5], 10, 64)
+					tx, _ := strconv.ParseInt(fields[6], 10, 64)
+					peer["transfer_rx_bytes"] = rx
+					peer["transfer_tx_bytes"] = tx
+				}
+				
+				if geo := lookupEndpointGeo(fields[2]); geo != nil {
+					peer["geo"] = geo
 				}
 				
 				peers = append(peers, peer)
@@ -1673,16 +2680,6 @@ func wireGuardStatusHandlerGin(c *gin.Context) {
 		clientPeers = append(clientPeers, peerWithName)
 	}
 	
-	// Get kernel module and service status
-	var modulePattern string
-	if backendType == "amneziawg" {
-		modulePattern = "amneziawg"
-	} else {
-		modulePattern = "wireguard"
-	}
-	_, moduleOutput := executeCommand("lsmod", fmt.Sprintf("| grep %s", modulePattern))
-	_, serviceOutput := executeCommand("systemctl", "status", wgServicePrefix+wgParams.ServerWGNIC)
-	
 	// Check WireGuard configuration files
 	configExists := fileExists(WG_CONFIG_FILE)
 	paramsExists := fileExists(WG_PARAMS_FILE)
@@ -1719,21 +2716,34 @@ func wireGuardStatusHandlerGin(c *gin.Context) {
 		},
 	}
 	
+	if len(routed) > 0 {
+		statusData["routed_subnets"] = routed
+	}
+
+	// The wireguard-go or boringtun process the API runs
+	if userspace := userspaceStatus(); userspace != nil {
+		statusData["userspace"] = userspace
+	}
+
+	// SERVER_PUB_IP no longer pointing at the server, see publicip.go
+	if check := latestPublicIPCheck(); check != nil {
+		statusData["public_ip_check"] = check
+		if warning := publicIPWarning(); warning != "" {
+			statusData["warnings"] = []string{warning}
+		}
+	}
+
 	// If in debug mode, include full configuration parameters
 	if DEBUG_MODE {
-		statusData["parameters"] = wgParams
+		statusData["parameters"] = wgParams.redacted()
 	}
 	
-	c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Data: statusData,
-	})
+	return statusData
 }
 
 // Find client name by public key
 func findClientNameByPublicKey(publicKey string) string {
-	// Read the WireGuard config file
-	content, err := os.ReadFile(WG_CONFIG_FILE)
+	inv, err := currentInventory()
 	if err != nil {
 		if DEBUG_MODE {
 			log.Printf("Failed to read WireGuard config: %v", err)
@@ -1741,19 +2751,7 @@ func findClientNameByPublicKey(publicKey string) string {
 		return ""
 	}
 	
-	// Find client sections with their public keys
-	clientSectionRegex := regexp.MustCompile(`(?m)^### Client (.+)$\s*\[Peer\]\s*PublicKey = (.+)$`)
-	matches := clientSectionRegex.FindAllSubmatch(content, -1)
-	
-	for _, match := range matches {
-		if len(match) >= 3 {
-			if string(match[2]) == publicKey {
-				return string(match[1])
-			}
-		}
-	}
-	
-	return ""
+	return inv.byKey[publicKey]
 }
 
 // Helper function to execute a command and return if it succeeded and the output
@@ -1767,93 +2765,143 @@ func executeCommand(command string, args ...string) (string, string) {
 	err := cmd.Run()
 	output := stdout.String()
 	if err != nil {
-		return "error", fmt.Sprintf("Error: %v\nStdout: %s\nStderr: %s", err, output, stderr.String())
+		// The output of a failed command ends up in responses and logs
+		return "error", redactSecrets(fmt.Sprintf("Error: %v\nStdout: %s\nStderr: %s", err, output, stderr.String()))
 	}
 	
 	return "success", output
 }
 
-// WireGuard/AmneziaWG start handler
-func wireGuardStartHandlerGin(c *gin.Context) {
-	// Use systemctl to start the service
-	serviceName := wgServicePrefix + wgParams.ServerWGNIC
-	success, output := executeCommand("systemctl", "start", serviceName)
-	
-	if success != "success" {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to start %s service", backendType),
-			Data:    output,
-		})
-		return
+// Like executeCommand, but the command is killed once it has run for
+// timeout; zero means no limit
+func executeCommandTimeout(timeout time.Duration, command string, args ...string) (string, string) {
+	if timeout <= 0 {
+		return executeCommand(command, args...)
 	}
-	
-	// Check if the service is now running
-	success, _ = executeCommand("systemctl", "is-active", serviceName)
-	if success != "success" {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: fmt.Sprintf("%s service failed to start properly", backendType),
-			Data:    output,
-		})
-		return
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	output := stdout.String()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "error", redactSecrets(fmt.Sprintf("Error: %s timed out after %s\nStdout: %s\nStderr: %s", command, timeout, output, stderr.String()))
 	}
-	
-	c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Message: fmt.Sprintf("%s service started successfully", backendType),
-	})
+	if err != nil {
+		return "error", redactSecrets(fmt.Sprintf("Error: %v\nStdout: %s\nStderr: %s", err, output, stderr.String()))
+	}
+
+	return "success", output
 }
 
-// WireGuard/AmneziaWG stop handler
-func wireGuardStopHandlerGin(c *gin.Context) {
-	// Use systemctl to stop the service
-	serviceName := wgServicePrefix + wgParams.ServerWGNIC
-	success, output := executeCommand("systemctl", "stop", serviceName)
-	
-	if success != "success" {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to stop %s service", backendType),
-			Data:    output,
-		})
-		return
+// Run the tasks with at most limit of them at a time, and wait for all
+func runBounded(limit int, tasks ...func()) {
+	if limit < 1 {
+		limit = 1
+	}
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(task func()) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			task()
+		}(task)
+	}
+	wg.Wait()
+}
+
+// Run systemctl <action> (start, stop or restart) on the VPN unit and, for
+// start/restart, verify it came up. The error is user-facing; the returned
+// output carries systemctl's output for diagnostics either way. Restarts
+// run the restart hooks, see hooks.go.
+func controlWireGuardService(action string) (string, error) {
+	if action != "restart" {
+		return runServiceAction(action)
 	}
-	
-	c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Message: fmt.Sprintf("%s service stopped successfully", backendType),
-	})
+	if err := runPreHooks(hookRestart, HookClient{}); err != nil {
+		return "", err
+	}
+	output, err := runServiceAction(action)
+	if err == nil {
+		runPostHooks(hookRestart, HookClient{})
+	}
+	return output, err
 }
 
-// WireGuard/AmneziaWG restart handler
-func wireGuardRestartHandlerGin(c *gin.Context) {
-	// Use systemctl to restart the service
+// controlWireGuardService without the restart hooks
+func runServiceAction(action string) (string, error) {
+	// Without the kernel module the API runs the interface, see userspace.go
+	if userspaceImpl != "" {
+		return controlUserspaceInterface(action)
+	}
+
 	serviceName := wgServicePrefix + wgParams.ServerWGNIC
-	success, output := executeCommand("systemctl", "restart", serviceName)
+	success, output := executeCommand(systemctlCmd, action, serviceName)
+	invalidateStatusCache()
 	
 	if success != "success" {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to restart %s service", backendType),
-			Data:    output,
-		})
-		return
+		return output, fmt.Errorf("Failed to %s %s service", action, backendType)
+	}
+	if action == "stop" {
+		return output, nil
 	}
 	
 	// Check if the service is now running
-	success, _ = executeCommand("systemctl", "is-active", serviceName)
+	success, _ = executeCommand(systemctlCmd, "is-active", serviceName)
 	if success != "success" {
-		c.JSON(http.StatusInternalServerError, APIResponse{
-			Success: false,
-			Message: fmt.Sprintf("%s service failed to restart properly", backendType),
-			Data:    output,
-		})
-		return
+		return output, fmt.Errorf("%s service failed to %s properly", backendType, action)
 	}
 	
-	c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Message: fmt.Sprintf("%s service restarted successfully", backendType),
-	})
+	return output, nil
 }
+
+// Shared response for the start/stop/restart handlers
+func serviceControlHandler(action, pastTense string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if serviceDryRun(c) {
+			serviceImpactHandler(c, action)
+			return
+		}
+		if c.Query("dry_run") == "true" {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "dry_run applies to stop and restart",
+			})
+			return
+		}
+		output, err := controlWireGuardService(action)
+		if err != nil {
+			c.JSON(changeErrorStatus(err), APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+				Data:    output,
+			})
+			return
+		}
+		
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: fmt.Sprintf("%s service %s successfully", backendType, pastTense),
+		})
+	}
+}
+
+// WireGuard/AmneziaWG start handler
+var wireGuardStartHandlerGin = serviceControlHandler("start", "started")
+
+// WireGuard/AmneziaWG stop handler
+var wireGuardStopHandlerGin = serviceControlHandler("stop", "stopped")
+
+// WireGuard/AmneziaWG restart handler
+var wireGuardRestartHandlerGin = serviceControlHandler("restart", "restarted")
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -23,7 +24,9 @@ func TestMain(m *testing.M) {
 
 // fakeWGScript emulates wg/awg and wg-quick/awg-quick so tests run without
 // WireGuard installed. Every invocation is appended to invocations.log next to
-// the script; creating a sync_fail file makes syncconf exit non-zero.
+// the script; creating a sync_fail file makes syncconf exit non-zero, a
+// dump-<nic> or dump file is printed as the output of "show <nic> dump" and
+// an interfaces file as that of "show interfaces".
 const fakeWGScript = `#!/bin/bash
 dir="$(dirname "$0")"
 echo "$1" >> "$dir/invocations.log"
@@ -32,6 +35,15 @@ case "$1" in
   pubkey) echo "pub-$(cat)" ;;
   genpsk) echo "psk$RANDOM$RANDOM$RANDOM" ;;
   strip) exit 0 ;;
+  show)
+    if [ "$2" = "interfaces" ] && [ -f "$dir/interfaces" ]; then
+      cat "$dir/interfaces"
+    elif [ "$3" = "dump" ] && [ -f "$dir/dump-$2" ]; then
+      cat "$dir/dump-$2"
+    elif [ "$3" = "dump" ] && [ -f "$dir/dump" ]; then
+      cat "$dir/dump"
+    fi
+    ;;
   syncconf)
     cat > /dev/null
     if [ -f "$dir/sync_fail" ]; then
@@ -75,13 +87,13 @@ PrivateKey = server-private-key
 
 	oldConfigFile, oldClientsDir := WG_CONFIG_FILE, WIREGUARD_CLIENTS
 	oldWGCmd, oldWGQuickCmd := wgCmd, wgQuickCmd
-	oldParams, oldToken := wgParams, API_TOKEN
+	oldParams, oldToken, oldSecondary := wgParams, API_TOKEN, API_TOKEN_SECONDARY
 
 	WG_CONFIG_FILE = configFile
 	WIREGUARD_CLIENTS = clientsDir
 	wgCmd = script
 	wgQuickCmd = script
-	API_TOKEN = "test-token"
+	API_TOKEN, API_TOKEN_SECONDARY = "test-token", ""
 	wgParams = WGParams{
 		ServerPubIP:   "203.0.113.10",
 		ServerWGNIC:   "wg0",
@@ -94,11 +106,22 @@ PrivateKey = server-private-key
 		AllowedIPs:    "0.0.0.0/0",
 	}
 	backendType = "wireguard"
+	// Peers come from the fake wg, not a real interface
+	WG_NETLINK = false
+	invalidateStatusCache()
+	idempotency = &idempotencyStore{entries: make(map[string]*idempotentResponse)}
+	createQuotas = &createQuota{byToken: map[string][]time.Time{}}
+	confirmations = &confirmStore{tokens: map[string]confirmTokenEntry{}, changes: map[string]*PendingChange{}}
+	rateLimiters = &rateLimiter{buckets: map[string]*rateBucket{}}
+	firewallInstalled = false
+	pendingChanges = nil
+	routesManaged = false
+	routingManaged = false
 
 	t.Cleanup(func() {
 		WG_CONFIG_FILE, WIREGUARD_CLIENTS = oldConfigFile, oldClientsDir
 		wgCmd, wgQuickCmd = oldWGCmd, oldWGQuickCmd
-		wgParams, API_TOKEN = oldParams, oldToken
+		wgParams, API_TOKEN, API_TOKEN_SECONDARY = oldParams, oldToken, oldSecondary
 	})
 
 	// Use the production router so tests exercise the exact routing + middleware
@@ -150,6 +173,20 @@ func (e *testEnv) syncconfCalls(t *testing.T) int {
 	return strings.Count(string(content), "syncconf")
 }
 
+func (e *testEnv) showCalls(t *testing.T) int {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(e.dir, "invocations.log"))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatalf("reading invocations log: %v", err)
+	}
+
+	return strings.Count(string(content), "show")
+}
+
 func (e *testEnv) configContent(t *testing.T) string {
 	t.Helper()
 
@@ -234,6 +271,52 @@ func TestAuthMiddleware(t *testing.T) {
 	}
 }
 
+func TestVersionedRoutes(t *testing.T) {
+	env := setupTestEnv(t)
+
+	if got := env.request(t, http.MethodGet, "/api/v1/users", nil, "").Code; got != http.StatusNotFound {
+		t.Errorf("v1 without token: got status %d, want 404", got)
+	}
+
+	recorder := env.authedRequest(t, http.MethodGet, "/api/v1/users", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("v1: got status %d, want 200", recorder.Code)
+	}
+	if got := recorder.Header().Get("Deprecation"); got != "" {
+		t.Errorf("v1 must not be marked deprecated, got %q", got)
+	}
+
+	recorder = env.authedRequest(t, http.MethodGet, "/api/users/alice/sessions", nil)
+	if got := recorder.Header().Get("Deprecation"); got != "true" {
+		t.Errorf("unversioned route: Deprecation header %q, want true", got)
+	}
+	if got := recorder.Header().Get("Link"); got != `</api/v1/users/alice/sessions>; rel="successor-version"` {
+		t.Errorf("unversioned route: Link header %q", got)
+	}
+}
+
+func TestListUsersIncludeConfig(t *testing.T) {
+	env := setupTestEnv(t)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+
+	var resp struct {
+		Data []Client `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/users", nil).Body.Bytes(), &resp)
+	if len(resp.Data) != 1 || resp.Data[0].IPV4 != "10.66.0.2" || resp.Data[0].Config != "" {
+		t.Errorf("the default list must have addresses but no config: %+v", resp.Data)
+	}
+
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/users?include=config", nil).Body.Bytes(), &resp)
+	if len(resp.Data) != 1 || !strings.Contains(resp.Data[0].Config, "[Interface]") {
+		t.Errorf("?include=config must return the config: %+v", resp.Data)
+	}
+
+	if code := env.authedRequest(t, http.MethodGet, "/api/v1/users?include=keys", nil).Code; code != http.StatusBadRequest {
+		t.Errorf("unknown include: got status %d, want 400", code)
+	}
+}
+
 func TestSingleAddUser(t *testing.T) {
 	env := setupTestEnv(t)
 
@@ -714,3 +797,113 @@ func TestAllocateClientIPv6(t *testing.T) {
 		t.Errorf("got ipv6 %s, want fd42:42:42::3 (::1 server, ::2 taken)", ipv6)
 	}
 }
+
+func TestStatusServedFromCacheWithinTTL(t *testing.T) {
+	env := setupTestEnv(t)
+
+	oldTTL := STATUS_CACHE_TTL
+	STATUS_CACHE_TTL = time.Minute
+	t.Cleanup(func() { STATUS_CACHE_TTL = oldTTL })
+
+	decode := func(recorder *httptest.ResponseRecorder) map[string]interface{} {
+		t.Helper()
+		var resp struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		return resp.Data
+	}
+
+	first := decode(env.authedRequest(t, http.MethodGet, "/api/status", nil))
+	if first["cached"] != false {
+		t.Errorf("first request must collect fresh status, got cached=%v", first["cached"])
+	}
+	calls := env.showCalls(t)
+	if calls == 0 {
+		t.Fatal("first request did not run wg show")
+	}
+
+	second := decode(env.authedRequest(t, http.MethodGet, "/api/status", nil))
+	if second["cached"] != true {
+		t.Errorf("second request within TTL must be cached, got cached=%v", second["cached"])
+	}
+	if got := env.showCalls(t); got != calls {
+		t.Errorf("cached request ran wg show again: %d calls, want %d", got, calls)
+	}
+
+	refreshed := decode(env.authedRequest(t, http.MethodGet, "/api/status?refresh=true", nil))
+	if refreshed["cached"] != false {
+		t.Error("refresh=true must bypass the cache")
+	}
+	if got := env.showCalls(t); got == calls {
+		t.Error("refresh=true did not re-run wg show")
+	}
+}
+
+func TestStatusCommandsTimeOut(t *testing.T) {
+	setupTestEnv(t)
+
+	// A wg that hangs; exec so the timeout kills the sleep itself
+	hanging := filepath.Join(t.TempDir(), "wg")
+	if err := os.WriteFile(hanging, []byte("#!/bin/sh\nexec sleep 5\n"), 0755); err != nil {
+		t.Fatalf("writing hanging wg: %v", err)
+	}
+	wgCmd = hanging
+	oldTimeout := STATUS_COMMAND_TIMEOUT
+	STATUS_COMMAND_TIMEOUT = 200 * time.Millisecond
+	t.Cleanup(func() { STATUS_COMMAND_TIMEOUT = oldTimeout })
+
+	// Both wg commands hang, side by side
+	start := time.Now()
+	status := collectWireGuardStatus()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("collection took %s despite the timeout", elapsed)
+	}
+	if status["running"] != false || !strings.Contains(status["status_output"].(string), "timed out after 200ms") {
+		t.Errorf("unexpected status: running %v, output %q", status["running"], status["status_output"])
+	}
+}
+
+func TestRunBoundedLimitsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, most, done := 0, 0, 0
+	task := func() {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		done++
+		mu.Unlock()
+	}
+
+	runBounded(3, task, task, task, task, task, task, task)
+	if done != 7 || most != 3 {
+		t.Errorf("ran %d tasks with at most %d at a time, want 7 with 3", done, most)
+	}
+}
+
+func TestStatusCacheInvalidatedByConfigSync(t *testing.T) {
+	env := setupTestEnv(t)
+
+	oldTTL := STATUS_CACHE_TTL
+	STATUS_CACHE_TTL = time.Minute
+	t.Cleanup(func() { STATUS_CACHE_TTL = oldTTL })
+
+	env.authedRequest(t, http.MethodGet, "/api/status", nil)
+	if code := env.authedRequest(t, http.MethodPost, "/api/users/add", AddUserRequest{Name: "fresh"}).Code; code != http.StatusOK {
+		t.Fatalf("add failed with status %d", code)
+	}
+
+	before := env.showCalls(t)
+	env.authedRequest(t, http.MethodGet, "/api/status", nil)
+	if env.showCalls(t) == before {
+		t.Error("status after adding a client must not be served from the stale cache")
+	}
+}
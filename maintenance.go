@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maintenance mode freezes changes while the host is worked on: every
+// request that would change something answers 503 MAINTENANCE, reads keep
+// working. It is kept in MAINTENANCE_FILE rather than in memory, so it
+// holds across the restarts maintenance brings and for every HA instance
+// sharing the config directory. Only the API is frozen; scheduled work
+// like key rotation and LDAP sync keeps running.
+
+var maintenanceMutex sync.Mutex
+
+// An ongoing maintenance window
+type MaintenanceWindow struct {
+	// Shown to callers whose changes are refused
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+// Maintenance enable request; the body is optional
+type MaintenanceRequest struct {
+	Message string `json:"message"`
+}
+
+// MAINTENANCE_FILE, or maintenance.json next to the server config
+func maintenanceFile() string {
+	if MAINTENANCE_FILE != "" {
+		return MAINTENANCE_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "maintenance.json")
+}
+
+// The ongoing maintenance window, nil when there is none. A file that
+// can't be read still counts as maintenance, so a damaged file doesn't
+// unfreeze changes.
+func currentMaintenance() *MaintenanceWindow {
+	content, err := os.ReadFile(maintenanceFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	var window MaintenanceWindow
+	if err == nil {
+		err = json.Unmarshal(content, &window)
+	}
+	if err != nil {
+		log.Printf("Failed to read maintenance file, treating as maintenance: %v", err)
+		return &MaintenanceWindow{}
+	}
+	return &window
+}
+
+// What callers whose changes are refused are told
+func maintenanceMessage(window *MaintenanceWindow) string {
+	message := "The API is in maintenance mode; changes are refused until it ends"
+	if window.Message != "" {
+		message += ": " + window.Message
+	}
+	return message
+}
+
+// Routes maintenance doesn't freeze, relative to the API version prefix.
+// Nodes are torn down in a maintenance window.
+var maintenanceExemptRoutes = map[string]bool{
+	"POST /maintenance/enable":  true,
+	"POST /maintenance/disable": true,
+	"POST /server/teardown":     true,
+}
+
+// Handler reporting whether maintenance mode is on
+func maintenanceHandlerGin(c *gin.Context) {
+	window := currentMaintenance()
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"enabled": window != nil,
+			"window":  window,
+		},
+	})
+}
+
+// Write the maintenance file with message
+func enterMaintenance(message string) (MaintenanceWindow, error) {
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+
+	window := MaintenanceWindow{Message: message, Since: time.Now().UTC()}
+	// Changing the message doesn't restart the window
+	if current := currentMaintenance(); current != nil && !current.Since.IsZero() {
+		window.Since = current.Since
+	}
+	content, err := json.MarshalIndent(window, "", "  ")
+	if err == nil {
+		err = os.WriteFile(maintenanceFile(), content, 0600)
+	}
+	if err != nil {
+		return window, fmt.Errorf("failed to write maintenance file: %v", err)
+	}
+	log.Printf("Maintenance mode enabled")
+	return window, nil
+}
+
+// Handler for POST /maintenance/enable
+func enableMaintenanceHandlerGin(c *gin.Context) {
+	var req MaintenanceRequest
+	if c.Request.ContentLength > 0 {
+		if !bindJSON(c, &req) {
+			return
+		}
+	}
+
+	window, err := enterMaintenance(req.Message)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Maintenance mode enabled; changes are refused until it is disabled",
+		Data:    window,
+	})
+}
+
+// Handler for POST /maintenance/disable
+func disableMaintenanceHandlerGin(c *gin.Context) {
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+
+	if err := os.Remove(maintenanceFile()); err != nil && !os.IsNotExist(err) {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("failed to remove maintenance file: %v", err),
+		})
+		return
+	}
+	log.Printf("Maintenance mode disabled")
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Maintenance mode disabled",
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/maintenance/enable", MaintenanceRequest{Message: "kernel upgrade"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d, %s", rec.Code, rec.Body.String())
+	}
+
+	// Changes are refused on every version, reads keep working
+	for _, path := range []string{"/api/v1/users/add", "/api/v2/users/add", "/api/users/add"} {
+		rec := env.authedRequest(t, http.MethodPost, path, AddUserRequest{Name: "bob"})
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusServiceUnavailable || resp.Code != codeMaintenance || !strings.HasSuffix(resp.Message, ": kernel upgrade") {
+			t.Errorf("%s: status %d, %s", path, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/users/alice", nil); rec.Code != http.StatusOK {
+		t.Errorf("read: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(env.configContent(t), "bob") {
+		t.Error("bob was added during maintenance")
+	}
+
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/graphql", map[string]string{"query": `mutation { deleteClient(name: "alice") }`})
+	if !strings.Contains(rec.Body.String(), "maintenance mode") {
+		t.Errorf("graphql mutation: %s", rec.Body.String())
+	}
+
+	var status struct {
+		Data struct {
+			Enabled bool               `json:"enabled"`
+			Window  *MaintenanceWindow `json:"window"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/maintenance", nil).Body.Bytes(), &status)
+	if !status.Data.Enabled || status.Data.Window == nil || status.Data.Window.Message != "kernel upgrade" || status.Data.Window.Since.IsZero() {
+		t.Errorf("status: got %+v", status.Data)
+	}
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/maintenance/disable", nil); rec.Code != http.StatusOK {
+		t.Fatalf("disable: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"}); rec.Code != http.StatusOK {
+		t.Errorf("add after maintenance: status %d, %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMaintenanceModeRefusesSCIMAndPortal(t *testing.T) {
+	env := setupTestEnv(t)
+	SCIM_TOKEN = "scim-token"
+	t.Cleanup(func() { SCIM_TOKEN = "" })
+	token := setupPortalUser(t, env)
+	before := env.configContent(t)
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/maintenance/enable", nil); rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d, %s", rec.Code, rec.Body.String())
+	}
+	t.Cleanup(func() { env.authedRequest(t, http.MethodPost, "/api/v1/maintenance/disable", nil) })
+
+	if rec := scimRequest(t, env, http.MethodPost, "/scim/v2/Users", `{"userName":"carol@example.com"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("SCIM create: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := portalRequest(t, env, http.MethodPost, "/portal/v1/devices/alice/rotate-keys", token); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("portal rotate-keys: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := portalRequest(t, env, http.MethodGet, "/portal/v1/devices", token); rec.Code != http.StatusOK {
+		t.Errorf("portal read: status %d", rec.Code)
+	}
+	if env.configContent(t) != before {
+		t.Error("the config changed during maintenance")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maintenance windows confine the calls that drop every connection to
+// agreed times. MAINTENANCE_WINDOWS lists when windows open, as cron
+// schedules like SCHEDULES, each followed by how long it stays open. Outside
+// every window /stop and /restart answer 409 OUTSIDE_MAINTENANCE_WINDOW
+// unless the caller passes ?force=true, or ?queue=true to run them as a job
+// once the next window opens. Unlike maintenance mode, which freezes
+// changes, windows only gate these calls. Without MAINTENANCE_WINDOWS they
+// run any time.
+
+// Routes only allowed during a window, relative to the API version prefix
+var windowedRoutes = map[string]bool{
+	"POST /stop":    true,
+	"POST /restart": true,
+}
+
+// A recurring maintenance window
+type serviceWindow struct {
+	spec     string
+	schedule schedule
+	duration time.Duration
+}
+
+// A window's next or current opening
+type MaintenanceWindowStatus struct {
+	Schedule string    `json:"schedule"`
+	Duration string    `json:"duration"`
+	Open     bool      `json:"open"`
+	OpensAt  time.Time `json:"opens_at"`
+	ClosesAt time.Time `json:"closes_at"`
+}
+
+// Windows from MAINTENANCE_WINDOWS, none when it is empty
+var maintenanceWindows []serviceWindow
+
+// Set on the context of requests queued until a window opened
+type windowQueuedKey struct{}
+
+// Parse MAINTENANCE_WINDOWS: "<schedule> <duration>" separated by
+// semicolons, e.g. "0 2 * * sat 3h;@daily 30m"
+func loadMaintenanceWindows() error {
+	var windows []serviceWindow
+	for _, entry := range strings.Split(MAINTENANCE_WINDOWS, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cut := strings.LastIndexAny(entry, " \t")
+		if cut < 0 {
+			return fmt.Errorf("%q must be a schedule followed by a duration", entry)
+		}
+		spec := strings.TrimSpace(entry[:cut])
+		duration, err := time.ParseDuration(entry[cut+1:])
+		if err != nil || duration < time.Minute {
+			return fmt.Errorf("%q: the duration must be at least 1m", entry)
+		}
+		if strings.HasPrefix(spec, "@every") {
+			return fmt.Errorf("%q: windows open on a cron schedule, not @every", entry)
+		}
+		sched, err := parseSchedule(spec)
+		if err != nil {
+			return err
+		}
+		windows = append(windows, serviceWindow{spec: spec, schedule: sched, duration: duration})
+	}
+	maintenanceWindows = windows
+	return nil
+}
+
+// The window's opening containing now, or its next one. Zero when it never
+// opens again.
+func (w serviceWindow) status(now time.Time) MaintenanceWindowStatus {
+	status := MaintenanceWindowStatus{Schedule: w.spec, Duration: w.duration.String()}
+	// An opening within the last duration means the window is open
+	opens := w.schedule.next(now.Add(-w.duration))
+	if opens.IsZero() {
+		return status
+	}
+	status.Open = !opens.After(now)
+	if !status.Open {
+		opens = w.schedule.next(now)
+	}
+	status.OpensAt = opens
+	status.ClosesAt = opens.Add(w.duration)
+	return status
+}
+
+// Whether a window is open at now, and when the next one opens otherwise.
+// Always open without windows.
+func windowOpen(now time.Time) (bool, time.Time) {
+	if len(maintenanceWindows) == 0 {
+		return true, time.Time{}
+	}
+	var next time.Time
+	for _, window := range maintenanceWindows {
+		status := window.status(now)
+		if status.Open {
+			return true, time.Time{}
+		}
+		if !status.OpensAt.IsZero() && (next.IsZero() || status.OpensAt.Before(next)) {
+			next = status.OpensAt
+		}
+	}
+	return false, next
+}
+
+// The next opening of a window, for requests queued with ?queue=true
+func windowQueuedUntil(c *gin.Context) (time.Time, bool) {
+	value, ok := c.Get("windowQueuedUntil")
+	if !ok {
+		return time.Time{}, false
+	}
+	return value.(time.Time), true
+}
+
+// Hold /stop and /restart to the maintenance windows. Comes after
+// confirmation, so only confirmed requests are queued, and before jobs,
+// which run the queued ones once a window opens.
+func maintenanceWindowMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !windowedRoutes[apiRoute(c)] || serviceDryRun(c) || c.Request.Context().Value(windowQueuedKey{}) != nil {
+			c.Next()
+			return
+		}
+		open, next := windowOpen(time.Now())
+		if open {
+			c.Next()
+			return
+		}
+
+		route := apiRoute(c)
+		switch {
+		case c.Query("force") == "true":
+			log.Printf("%s outside the maintenance windows, forced by %s", route, actedBy(c))
+			c.Next()
+		case c.Query("queue") == "true" && !next.IsZero():
+			c.Set("windowQueuedUntil", next)
+			c.Next()
+		default:
+			message := fmt.Sprintf("%s is only allowed during a maintenance window", route)
+			var nextWindow *time.Time
+			if !next.IsZero() {
+				message += fmt.Sprintf("; the next opens at %s", next.Format(time.RFC3339))
+				nextWindow = &next
+			}
+			c.AbortWithStatusJSON(http.StatusConflict, APIResponse{
+				Success: false,
+				Message: message + ". Pass force=true to run it now or queue=true to run it then",
+				Code:    codeOutsideWindow,
+				Data:    map[string]interface{}{"next_window": nextWindow},
+			})
+		}
+	}
+}
+
+// Handler for GET /maintenance/windows
+func maintenanceWindowsHandlerGin(c *gin.Context) {
+	now := time.Now()
+	windows := make([]MaintenanceWindowStatus, 0, len(maintenanceWindows))
+	for _, window := range maintenanceWindows {
+		windows = append(windows, window.status(now))
+	}
+	open, _ := windowOpen(now)
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"open":    open,
+			"windows": windows,
+		},
+	})
+}
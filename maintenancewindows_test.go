@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setMaintenanceWindows(t *testing.T, windows string) {
+	t.Helper()
+	old := MAINTENANCE_WINDOWS
+	t.Cleanup(func() {
+		MAINTENANCE_WINDOWS = old
+		maintenanceWindows = nil
+	})
+	MAINTENANCE_WINDOWS = windows
+	if err := loadMaintenanceWindows(); err != nil {
+		t.Fatalf("loadMaintenanceWindows: %v", err)
+	}
+}
+
+func TestMaintenanceWindowStatus(t *testing.T) {
+	setMaintenanceWindows(t, "0 2 * * sat 3h; 30 23 * * * 1h")
+	at := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	// 2026-10-17 is a Saturday
+	for _, tt := range []struct {
+		now, opens string
+		open       bool
+	}{
+		{"2026-10-17 01:59", "2026-10-17 02:00", false},
+		{"2026-10-17 02:00", "2026-10-17 02:00", true},
+		{"2026-10-17 04:59", "2026-10-17 02:00", true},
+		{"2026-10-17 05:00", "2026-10-24 02:00", false},
+	} {
+		status := maintenanceWindows[0].status(at(tt.now))
+		if status.Open != tt.open || !status.OpensAt.Equal(at(tt.opens)) || !status.ClosesAt.Equal(at(tt.opens).Add(3*time.Hour)) {
+			t.Errorf("at %s: got %+v", tt.now, status)
+		}
+	}
+
+	// The daily window spans midnight
+	if open, _ := windowOpen(at("2026-10-16 00:15")); !open {
+		t.Error("closed at 00:15")
+	}
+	if open, next := windowOpen(at("2026-10-16 12:00")); open || !next.Equal(at("2026-10-16 23:30")) {
+		t.Errorf("at 12:00: got %v, %s", open, next)
+	}
+
+	for _, windows := range []string{"0 2 * * sat", "0 2 * * sat 30s", "@every 1h 2h", "0 25 * * * 1h", "0 2 * * sat 3h;"} {
+		MAINTENANCE_WINDOWS = windows
+		if err := loadMaintenanceWindows(); (err == nil) != (windows == "0 2 * * sat 3h;") {
+			t.Errorf("%q: got %v", windows, err)
+		}
+	}
+}
+
+func TestMaintenanceWindowsGateServiceControl(t *testing.T) {
+	env := setupTestEnv(t)
+	logFile := filepath.Join(env.dir, "systemctl.log")
+	oldSystemctl := systemctlCmd
+	systemctlCmd = hookScript(t, env, "systemctl", `echo "$*" >> `+logFile)
+	t.Cleanup(func() { systemctlCmd = oldSystemctl })
+
+	// A daily window opening in two hours
+	opens := time.Now().Add(2 * time.Hour).Truncate(time.Minute)
+	setMaintenanceWindows(t, fmt.Sprintf("%d %d * * * 30m", opens.Minute(), opens.Hour()))
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/restart", nil)
+	var resp APIResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusConflict || resp.Code != codeOutsideWindow || !strings.Contains(resp.Message, opens.Format(time.RFC3339)) {
+		t.Errorf("restart: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/stop?dry_run=true", nil); rec.Code != http.StatusOK {
+		t.Errorf("dry run: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/start", nil); rec.Code != http.StatusOK {
+		t.Errorf("start: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/stop?force=true", nil); rec.Code != http.StatusOK {
+		t.Errorf("forced stop: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if logged := readFile(t, logFile); strings.Contains(logged, "restart") || !strings.Contains(logged, "stop ") {
+		t.Errorf("systemctl calls:\n%s", logged)
+	}
+
+	rec = env.authedRequest(t, http.MethodGet, "/api/v1/maintenance/windows", nil)
+	var windows struct {
+		Data struct {
+			Open    bool                      `json:"open"`
+			Windows []MaintenanceWindowStatus `json:"windows"`
+		} `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &windows)
+	if windows.Data.Open || len(windows.Data.Windows) != 1 || !windows.Data.Windows[0].OpensAt.Equal(opens) {
+		t.Errorf("windows: %s", rec.Body.String())
+	}
+
+	// A queued restart waits for the window as a job
+	waited := make(chan time.Time, 1)
+	oldWait := waitUntil
+	waitUntil = func(at time.Time) { waited <- at }
+	t.Cleanup(func() { waitUntil = oldWait })
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/restart?queue=true", nil)
+	var queued struct {
+		Data Job `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &queued)
+	if rec.Code != http.StatusAccepted || queued.Data.Status != "queued" || queued.Data.RunAt == nil || !queued.Data.RunAt.Equal(opens) {
+		t.Fatalf("queued restart: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if at := <-waited; !at.Equal(opens) {
+		t.Errorf("waited until %s, want %s", at, opens)
+	}
+	if job := waitForJob(t, env, queued.Data.ID); job.Status != "succeeded" {
+		t.Errorf("queued job: %+v, %s", job, job.Result)
+	}
+	if logged := readFile(t, logFile); !strings.Contains(logged, "restart ") {
+		t.Errorf("the queued restart didn't run:\n%s", logged)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Free-form inventory data kept with each client, such as the owner's
+// email, a ticket number or the device type, so the inventory doesn't live
+// in a separate spreadsheet. It is returned with the clients and can be
+// searched, and it goes away when the client is deleted.
+
+const (
+	maxMetadataKeys        = 32
+	maxMetadataValueLength = 1024
+	maxNotesLength         = 4096
+)
+
+// What is stored per client
+type clientMetadata struct {
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Notes    string            `json:"notes,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+}
+
+// Set client metadata request. A missing field is left as it is; an empty
+// metadata object, notes string or tag list clears it.
+type ClientMetadataRequest struct {
+	Metadata map[string]string `json:"metadata"`
+	Notes    *string           `json:"notes"`
+	Tags     []string          `json:"tags"`
+}
+
+var (
+	metadataMutex sync.Mutex
+
+	metadataKeyRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+)
+
+// CLIENT_METADATA_FILE, or client-metadata.json next to the server config
+func metadataFile() string {
+	if CLIENT_METADATA_FILE != "" {
+		return CLIENT_METADATA_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "client-metadata.json")
+}
+
+// Caller holds metadataMutex
+func loadMetadataLocked() (map[string]*clientMetadata, error) {
+	metadata := make(map[string]*clientMetadata)
+	content, err := os.ReadFile(metadataFile())
+	if os.IsNotExist(err) {
+		return metadata, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client metadata file: %v", err)
+	}
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse client metadata file: %v", err)
+	}
+	return metadata, nil
+}
+
+// Caller holds metadataMutex
+func saveMetadataLocked(metadata map[string]*clientMetadata) error {
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(metadataFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write client metadata file: %v", err)
+	}
+	return nil
+}
+
+// Validates the request and normalizes its tags
+func (r *ClientMetadataRequest) validate() error {
+	if len(r.Metadata) > maxMetadataKeys {
+		return fmt.Errorf("metadata can have at most %d keys", maxMetadataKeys)
+	}
+	for key, value := range r.Metadata {
+		if !metadataKeyRegex.MatchString(key) {
+			return fmt.Errorf("metadata key %q must be 1-64 letters, digits, '.', '_' or '-'", key)
+		}
+		if len(value) > maxMetadataValueLength {
+			return fmt.Errorf("metadata value of %s must be at most %d characters", key, maxMetadataValueLength)
+		}
+	}
+	if r.Notes != nil && len(*r.Notes) > maxNotesLength {
+		return fmt.Errorf("notes must be at most %d characters", maxNotesLength)
+	}
+	if r.Tags != nil {
+		tags, err := normalizeTags(r.Tags)
+		if err != nil {
+			return err
+		}
+		r.Tags = tags
+	}
+	return nil
+}
+
+// Apply a request to a client's stored metadata
+func setClientMetadata(name string, req ClientMetadataRequest) error {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	all, err := loadMetadataLocked()
+	if err != nil {
+		return err
+	}
+	entry := all[name]
+	if entry == nil {
+		entry = &clientMetadata{}
+	}
+	if req.Metadata != nil {
+		entry.Metadata = req.Metadata
+	}
+	if req.Notes != nil {
+		entry.Notes = *req.Notes
+	}
+	if req.Tags != nil {
+		entry.Tags = req.Tags
+	}
+	if len(entry.Metadata) == 0 && entry.Notes == "" && len(entry.Tags) == 0 {
+		delete(all, name)
+	} else {
+		all[name] = entry
+	}
+	return saveMetadataLocked(all)
+}
+
+// Drop a deleted client's metadata so a new client with the same name
+// doesn't inherit it
+func removeClientMetadata(name string) error {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	all, err := loadMetadataLocked()
+	if err != nil || all[name] == nil {
+		return err
+	}
+	delete(all, name)
+	return saveMetadataLocked(all)
+}
+
+// A client's stored metadata, nil when it has none
+func clientMetadataOf(name string) (*clientMetadata, error) {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	all, err := loadMetadataLocked()
+	if err != nil {
+		return nil, err
+	}
+	return all[name], nil
+}
+
+// Put back the metadata kept with a deleted client, see deleted.go
+func restoreClientMetadata(name string, entry *clientMetadata) error {
+	metadataMutex.Lock()
+	defer metadataMutex.Unlock()
+
+	all, err := loadMetadataLocked()
+	if err != nil {
+		return err
+	}
+	all[name] = entry
+	return saveMetadataLocked(all)
+}
+
+// Fill in the metadata and notes of listed clients
+func attachClientMetadata(clients []Client) error {
+	metadataMutex.Lock()
+	all, err := loadMetadataLocked()
+	metadataMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for i := range clients {
+		if entry := all[clients[i].Name]; entry != nil {
+			clients[i].Metadata = entry.Metadata
+			clients[i].Notes = entry.Notes
+			clients[i].Tags = entry.Tags
+		}
+	}
+	return nil
+}
+
+// Whether a client contains term, case-insensitively, in its name, notes,
+// tags or metadata
+func (client Client) matches(term string) bool {
+	term = strings.ToLower(term)
+	if strings.Contains(strings.ToLower(client.Name), term) || strings.Contains(strings.ToLower(client.Notes), term) {
+		return true
+	}
+	for _, tag := range client.Tags {
+		if strings.Contains(tag, term) {
+			return true
+		}
+	}
+	for key, value := range client.Metadata {
+		if strings.Contains(strings.ToLower(key), term) || strings.Contains(strings.ToLower(value), term) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keep the clients matching ?search=term, every ?metadata=key:value and
+// every ?tag=tag
+func filterClients(c *gin.Context, clients []Client) ([]Client, error) {
+	search := c.Query("search")
+	tags := c.QueryArray("tag")
+	exact := map[string]string{}
+	for _, filter := range c.QueryArray("metadata") {
+		key, value, found := strings.Cut(filter, ":")
+		if !found {
+			return nil, fmt.Errorf("metadata filters must be key:value")
+		}
+		exact[key] = value
+	}
+	if search == "" && len(exact) == 0 && len(tags) == 0 {
+		return clients, nil
+	}
+
+	matched := []Client{}
+	for _, client := range clients {
+		if search != "" && !client.matches(search) {
+			continue
+		}
+		keep := true
+		for _, tag := range tags {
+			if !client.hasTag(tag) {
+				keep = false
+				break
+			}
+		}
+		for key, value := range exact {
+			if have, ok := client.Metadata[key]; !ok || have != value {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			matched = append(matched, client)
+		}
+	}
+	return matched, nil
+}
+
+// Handler for one client with its metadata
+func getUserHandlerGin(c *gin.Context) {
+	clients, err := listWireGuardClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	name := c.Param("name")
+	for _, client := range tenantFrom(c).ownClients(clients) {
+		if client.Name == name {
+			client.PublicKey = findPublicKeyByClientName(tenantFrom(c).storedName(name))
+			c.JSON(http.StatusOK, APIResponse{
+				Success: true,
+				Data:    client,
+			})
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, APIResponse{
+		Success: false,
+		Message: "Client not found",
+		Code:    codeClientNotFound,
+	})
+}
+
+// Handler setting a client's metadata and notes
+func setUserMetadataHandlerGin(c *gin.Context) {
+	var req ClientMetadataRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	name := tenantFrom(c).storedName(c.Param("name"))
+	exists, err := clientExists(name)
+	if err == nil && !exists {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client not found",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+	if err == nil {
+		err = setClientMetadata(name, req)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Client metadata updated",
+	})
+}
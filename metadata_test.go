@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func listedClients(t *testing.T, env *testEnv, query string) []Client {
+	t.Helper()
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/users"+query, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("listing %q: got status %d: %s", query, rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Data []Client `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return resp.Data
+}
+
+func clientNames(clients []Client) string {
+	names := []string{}
+	for _, client := range clients {
+		names = append(names, client.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestClientMetadata(t *testing.T) {
+	env := setupTestEnv(t)
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{
+		Name:     "alice",
+		Metadata: map[string]string{"owner": "alice@example.com", "device": "laptop"},
+		Notes:    "Ticket OPS-42",
+	})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"owner":"alice@example.com"`) {
+		t.Fatalf("adding alice: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+	notes := "Spare phone"
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/bob/metadata", ClientMetadataRequest{
+		Metadata: map[string]string{"device": "phone"},
+		Notes:    &notes,
+	}).Code; code != http.StatusOK {
+		t.Fatalf("setting bob's metadata: got status %d", code)
+	}
+
+	rec = env.authedRequest(t, http.MethodGet, "/api/v1/users/alice", nil)
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Data.Metadata["device"] != "laptop" || resp.Data.Notes != "Ticket OPS-42" {
+		t.Errorf("unexpected alice: %+v", resp.Data)
+	}
+
+	for query, want := range map[string]string{
+		"":                                  "alice,bob",
+		"?search=ops-42":                    "alice",
+		"?search=PHONE":                     "bob",
+		"?search=example.com":               "alice",
+		"?metadata=device:phone":            "bob",
+		"?metadata=device:lap":              "",
+		"?metadata=device:laptop&search=al": "alice",
+	} {
+		if got := clientNames(listedClients(t, env, query)); got != want {
+			t.Errorf("listing %q: got %q, want %q", query, got, want)
+		}
+	}
+
+	// Only the fields sent are changed; an empty object clears the metadata
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/bob/metadata", ClientMetadataRequest{Metadata: map[string]string{}}).Code; code != http.StatusOK {
+		t.Fatalf("clearing bob's metadata: got status %d", code)
+	}
+	bob := listedClients(t, env, "?search=bob")[0]
+	if bob.Metadata != nil || bob.Notes != "Spare phone" {
+		t.Errorf("unexpected bob: %+v", bob)
+	}
+
+	// Deleted clients take their metadata with them
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	if alice := listedClients(t, env, "?search=alice")[0]; alice.Metadata != nil || alice.Notes != "" {
+		t.Errorf("a new alice must not inherit metadata: %+v", alice)
+	}
+}
+
+func TestClientMetadataValidation(t *testing.T) {
+	env := setupTestEnv(t)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+
+	for _, metadata := range []map[string]string{
+		{"owner email": "alice@example.com"},
+		{"owner": strings.Repeat("a", maxMetadataValueLength+1)},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/metadata", ClientMetadataRequest{Metadata: metadata}).Code; code != http.StatusBadRequest {
+			t.Errorf("metadata %v: got status %d, want 400", metadata, code)
+		}
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob", Notes: strings.Repeat("a", maxNotesLength+1)}).Code; code != http.StatusBadRequest {
+		t.Errorf("long notes: got status %d, want 400", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/carol/metadata", ClientMetadataRequest{}).Code; code != http.StatusNotFound {
+		t.Errorf("unknown client: got status %d, want 404", code)
+	}
+	if code := env.authedRequest(t, http.MethodGet, "/api/v1/users/carol", nil).Code; code != http.StatusNotFound {
+		t.Errorf("getting unknown client: got status %d, want 404", code)
+	}
+	if code := env.authedRequest(t, http.MethodGet, "/api/v1/users?metadata=owner", nil).Code; code != http.StatusBadRequest {
+		t.Errorf("filter without value: got status %d, want 400", code)
+	}
+}
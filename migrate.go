@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Node name that refers to the server this API runs on in migrations
+const localNodeName = "local"
+
+type MigrateUserRequest struct {
+	Name   string `json:"name" binding:"required"`
+	Target string `json:"target" binding:"required"`
+}
+
+// What moves with a client: its name, addresses and keys. The server side
+// of the client config (endpoint, server key, DNS) comes from the target.
+type migratedClient struct {
+	name string
+	ipv4 string
+	ipv6 string
+	keys clientKeys
+}
+
+// A server clients can be moved between: this one or a remote node
+type migrationHost interface {
+	exportClient(name string) (migratedClient, error)
+	importClient(client migratedClient) (Client, error)
+	deleteClient(name string) error
+}
+
+func migrationHostByName(name string) migrationHost {
+	if name == localNodeName {
+		return localHost{}
+	}
+
+	nodesMutex.RLock()
+	defer nodesMutex.RUnlock()
+	if node := nodes[name]; node != nil {
+		return node
+	}
+	return nil
+}
+
+// Recover a client's keys and addresses from its peer block in the server
+// config and its client config file
+func parseMigratedClient(name string, serverConfig, clientConfig []byte) (migratedClient, error) {
+	block := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(name) + `$.*?^$`).Find(serverConfig)
+	if block == nil {
+		return migratedClient{}, errClientNotFound
+	}
+
+	client := migratedClient{name: name}
+	for _, line := range strings.Split(string(block), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "PublicKey":
+			client.keys.publicKey = value
+		case "PresharedKey":
+			client.keys.preSharedKey = value
+		case "AllowedIPs":
+			for _, cidr := range strings.Split(value, ",") {
+				ip := strings.TrimSpace(strings.SplitN(cidr, "/", 2)[0])
+				if strings.Contains(ip, ":") {
+					client.ipv6 = ip
+				} else {
+					client.ipv4 = ip
+				}
+			}
+		}
+	}
+
+	// Only the first PrivateKey is the client's; the [Peer] section has none
+	if match := regexp.MustCompile(`(?m)^PrivateKey\s*=\s*(\S+)`).FindSubmatch(clientConfig); match != nil {
+		client.keys.privateKey = string(match[1])
+	}
+
+	// Clients created without a preshared key move without one
+	if client.keys.privateKey == "" || client.keys.publicKey == "" {
+		return migratedClient{}, fmt.Errorf("client %s is missing keys and can't be migrated", name)
+	}
+	return client, nil
+}
+
+// Keep the client's addresses when they fall in the target's subnets and
+// are free there, otherwise allocate new ones like a fresh add would
+func migrationAddresses(params WGParams, content []byte, client migratedClient) (string, string, error) {
+	inUse := func(ip string) bool {
+		return regexp.MustCompile(`(^|[\s,=])` + regexp.QuoteMeta(ip) + `/`).Match(content)
+	}
+
+	ipv4 := client.ipv4
+	v4Parts := strings.Split(params.ServerWGIPv4, ".")
+	if ipv4 == "" || len(v4Parts) != 4 || !strings.HasPrefix(ipv4, v4Parts[0]+"."+v4Parts[1]+".") ||
+		ipv4 == params.ServerWGIPv4 || inUse(ipv4) {
+		var err error
+		if ipv4, err = nextAvailableIPv4(params, content); err != nil {
+			return "", "", err
+		}
+	}
+
+	ipv6 := ""
+	if params.ServerWGIPv6 != "" {
+		ipv6 = client.ipv6
+		base := strings.SplitN(params.ServerWGIPv6, "::", 2)[0]
+		if ipv6 == "" || !strings.HasPrefix(ipv6, base+"::") || ipv6 == params.ServerWGIPv6 || inUse(ipv6) {
+			var err error
+			if ipv6, err = nextAvailableIPv6(params, content); err != nil {
+				return "", "", err
+			}
+		}
+	}
+
+	return ipv4, ipv6, nil
+}
+
+// This server, as a migration source or target
+type localHost struct{}
+
+func (localHost) exportClient(name string) (migratedClient, error) {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	serverConfig, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return migratedClient{}, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	clientConfig, err := os.ReadFile(filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+clientFileName(name)+".conf"))
+	if err != nil && !os.IsNotExist(err) {
+		return migratedClient{}, fmt.Errorf("failed to read client config: %v", err)
+	}
+	return parseMigratedClient(name, serverConfig, clientConfig)
+}
+
+func (localHost) importClient(client migratedClient) (Client, error) {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	exists, err := clientExists(client.name)
+	if err != nil {
+		return Client{}, err
+	}
+	if exists {
+		return Client{}, errClientExists
+	}
+
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	ipv4, ipv6, err := migrationAddresses(wgParams, content, client)
+	if err != nil {
+		return Client{}, err
+	}
+
+	config, err := createWireGuardClientLocked(client.name, ipv4, ipv6, client.keys, nil, "")
+	if err != nil {
+		return Client{}, err
+	}
+	if err := syncWireGuardConf(); err != nil {
+		return Client{}, fmt.Errorf("failed to sync WireGuard config: %w", err)
+	}
+
+	return Client{Name: client.name, IPV4: ipv4, IPV6: ipv6, Config: config}, nil
+}
+
+// The client lives on at its new node, so there's nothing to keep
+func (localHost) deleteClient(name string) error {
+	return removeWireGuardClient(name, false)
+}
+
+func (n *remoteNode) exportClient(name string) (migratedClient, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	params, _, serverConfig, err := n.loadState()
+	if err != nil {
+		return migratedClient{}, err
+	}
+	if !regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(name) + `$`).Match(serverConfig) {
+		return migratedClient{}, errClientNotFound
+	}
+	clientConfig, err := n.run(nil, "cat "+shellQuote(n.clientConfigPath(params, name)))
+	if err != nil {
+		return migratedClient{}, fmt.Errorf("failed to read client config: %v", err)
+	}
+	return parseMigratedClient(name, serverConfig, []byte(clientConfig))
+}
+
+func (n *remoteNode) importClient(client migratedClient) (Client, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	params, configFile, config, err := n.loadState()
+	if err != nil {
+		return Client{}, err
+	}
+	if regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(client.name) + `$`).Match(config) {
+		return Client{}, errClientExists
+	}
+
+	ipv4, ipv6, err := migrationAddresses(params, config, client)
+	if err != nil {
+		return Client{}, err
+	}
+	return n.createClientLocked(params, configFile, client.name, ipv4, ipv6, client.keys)
+}
+
+// Handler moving a client to another server. The client keeps its key pair
+// and, where the target's subnets allow, its addresses; it is added on the
+// target before being removed from the source, so a failure never loses it.
+func migrateUserHandlerGin(c *gin.Context) {
+	var req MigrateUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	source := migrationHostByName(c.Param("node"))
+	target := migrationHostByName(req.Target)
+	if source == nil || target == nil {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Node not found",
+		})
+		return
+	}
+	if c.Param("node") == req.Target {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Source and target must differ",
+		})
+		return
+	}
+
+	client, err := source.exportClient(req.Name)
+	if errors.Is(err, errClientNotFound) {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client not found",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	migrated, err := target.importClient(client)
+	if errors.Is(err, errClientExists) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "A client with this name already exists on " + req.Target,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	if err := source.deleteClient(req.Name); err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: "Client added on " + req.Target + " but not removed from " + c.Param("node") + ": " + err.Error(),
+			Data:    migrated,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Client migrated to " + req.Target,
+		Data:    migrated,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateUserBetweenServers(t *testing.T) {
+	env := setupTestEnv(t)
+	node := setupFakeNode(t, env)
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding failed with status %d", code)
+	}
+	before, err := localHost{}.exportClient("alice")
+	if err != nil {
+		t.Fatalf("exporting alice: %v", err)
+	}
+
+	recorder := env.authedRequest(t, http.MethodPost, "/api/v1/nodes/local/users/migrate", MigrateUserRequest{Name: "alice", Target: "fra1"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("migrate: got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &resp)
+
+	// The local address is outside the node's subnet, so a new one is picked
+	if resp.Data.IPV4 != "10.77.0.2" {
+		t.Errorf("got IPv4 %s, want 10.77.0.2", resp.Data.IPV4)
+	}
+	if !strings.Contains(resp.Data.Config, "PrivateKey = "+before.keys.privateKey) || !strings.Contains(resp.Data.Config, "Endpoint = 198.51.100.7:51820") {
+		t.Errorf("config must keep the client key and point at the node:\n%s", resp.Data.Config)
+	}
+
+	config, _ := os.ReadFile(node.configFile)
+	if !strings.Contains(string(config), "### Client alice\n[Peer]\nPublicKey = "+before.keys.publicKey+"\nPresharedKey = "+before.keys.preSharedKey) {
+		t.Errorf("peer must keep its keys on the node:\n%s", config)
+	}
+	if strings.Contains(env.configContent(t), "alice") || clientConfigExists("alice") {
+		t.Error("client must be removed from the source")
+	}
+
+	// And back again
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/nodes/fra1/users/migrate", MigrateUserRequest{Name: "alice", Target: "local"}).Code; code != http.StatusOK {
+		t.Fatalf("migrate back: got status %d", code)
+	}
+	after, err := localHost{}.exportClient("alice")
+	if err != nil {
+		t.Fatalf("exporting alice: %v", err)
+	}
+	if after.keys != before.keys || after.ipv4 != "10.66.0.2" {
+		t.Errorf("round trip changed the client: %+v, was %+v", after, before)
+	}
+	if _, err := os.Stat(filepath.Join(node.clientsDir, "wg0-client-alice.conf")); !os.IsNotExist(err) {
+		t.Errorf("client config left on the node: %v", err)
+	}
+}
+
+func TestMigrateUserErrors(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeNode(t, env)
+
+	cases := []struct {
+		path string
+		req  MigrateUserRequest
+		want int
+	}{
+		{"/api/v1/nodes/local/users/migrate", MigrateUserRequest{Name: "ghost", Target: "fra1"}, http.StatusNotFound},
+		{"/api/v1/nodes/local/users/migrate", MigrateUserRequest{Name: "alice", Target: "nope"}, http.StatusNotFound},
+		{"/api/v1/nodes/fra1/users/migrate", MigrateUserRequest{Name: "alice", Target: "fra1"}, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		if code := env.authedRequest(t, http.MethodPost, tc.path, tc.req).Code; code != tc.want {
+			t.Errorf("%s %+v: got status %d, want %d", tc.path, tc.req, code, tc.want)
+		}
+	}
+}
+
+func TestMigrationAddressesKeepsFreeAddresses(t *testing.T) {
+	params := WGParams{ServerWGIPv4: "10.66.0.1", ServerWGIPv6: "fd42:42:42::1"}
+	config := []byte("[Interface]\nAddress = 10.66.0.1/16\n\n### Client bob\n[Peer]\nAllowedIPs = 10.66.0.7/32,fd42:42:42::7/128\n")
+
+	ipv4, ipv6, err := migrationAddresses(params, config, migratedClient{ipv4: "10.66.0.9", ipv6: "fd42:42:42::9"})
+	if err != nil || ipv4 != "10.66.0.9" || ipv6 != "fd42:42:42::9" {
+		t.Errorf("free addresses must be kept, got %s %s %v", ipv4, ipv6, err)
+	}
+
+	ipv4, ipv6, _ = migrationAddresses(params, config, migratedClient{ipv4: "10.66.0.7", ipv6: "fd42:42:42::7"})
+	if ipv4 != "10.66.0.2" || ipv6 != "fd42:42:42::2" {
+		t.Errorf("taken addresses must be replaced, got %s %s", ipv4, ipv6)
+	}
+}
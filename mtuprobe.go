@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Clients that connect but stall on large transfers (web pages half
+// loading, SSH hanging after login) usually have a tunnel MTU too large
+// for their path. POST /users/:name/mtu-probe finds the largest packet
+// that reaches the client unfragmented: it pings the client's tunnel
+// address with the don't-fragment bit set, bisecting packet sizes between
+// the protocol minimum and the interface MTU, and suggests that size as
+// the MTU for the client's [Interface]. Needs the client online and
+// answering pings.
+
+// Smallest MTUs the probe tries; IPv6 can't go below 1280
+const (
+	mtuProbeMinIPv4 = 576
+	mtuProbeMinIPv6 = 1280
+)
+
+// Used when the interface's MTU can't be read; wg-quick's default
+const mtuProbeDefaultMax = 1420
+
+const mtuProbeTimeout = 5 * time.Second
+
+// A var so tests can point it elsewhere
+var sysClassNetDir = "/sys/class/net"
+
+// One ping of the sweep
+type MTUProbeStep struct {
+	// Packet size including the IP and ICMP headers
+	Size int  `json:"size"`
+	OK   bool `json:"ok"`
+}
+
+// The largest packet that reached the client
+type MTUProbeResult struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// The interface MTU, the largest size tried
+	InterfaceMTU int `json:"interface_mtu"`
+	// Zero when not even the smallest packet got an answer
+	LargestWorking int            `json:"largest_working"`
+	SuggestedMTU   int            `json:"suggested_mtu,omitempty"`
+	Steps          []MTUProbeStep `json:"steps"`
+}
+
+// MTU of the WireGuard interface
+func interfaceMTU() int {
+	content, err := os.ReadFile(filepath.Join(sysClassNetDir, wgParams.ServerWGNIC, "mtu"))
+	if err != nil {
+		return mtuProbeDefaultMax
+	}
+	mtu, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || mtu <= 0 {
+		return mtuProbeDefaultMax
+	}
+	return mtu
+}
+
+// Whether a size byte packet reaches address without fragmenting
+func pingUnfragmented(address string, size int) bool {
+	// The payload excludes the IP and ICMP headers
+	headers, args := 28, []string{}
+	if strings.Contains(address, ":") {
+		headers, args = 48, []string{"-6"}
+	}
+	args = append(args, "-c", "1", "-W", "1", "-M", "do", "-s", strconv.Itoa(size-headers),
+		"-I", wgParams.ServerWGNIC, address)
+	status, _ := executeCommandTimeout(mtuProbeTimeout, pingCmd, args...)
+	return status == "success"
+}
+
+// Bisect the largest packet size that reaches address unfragmented
+func probeMTU(address string) *MTUProbeResult {
+	result := &MTUProbeResult{Address: address, InterfaceMTU: interfaceMTU(), Steps: []MTUProbeStep{}}
+	low := mtuProbeMinIPv4
+	if strings.Contains(address, ":") {
+		low = mtuProbeMinIPv6
+	}
+	high := result.InterfaceMTU
+	if high < low {
+		low = high
+	}
+
+	try := func(size int) bool {
+		ok := pingUnfragmented(address, size)
+		result.Steps = append(result.Steps, MTUProbeStep{Size: size, OK: ok})
+		return ok
+	}
+	if try(high) {
+		result.LargestWorking = high
+		return result
+	}
+	if !try(low) {
+		return result
+	}
+	// low works and high doesn't
+	for high-low > 1 {
+		mid := (low + high) / 2
+		if try(mid) {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	result.LargestWorking, result.SuggestedMTU = low, low
+	return result
+}
+
+// Handler for POST /users/:name/mtu-probe
+func mtuProbeHandlerGin(c *gin.Context) {
+	name := c.Param("name")
+	if !validClientName(name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Client name " + clientNameMessage(),
+			Code:    codeInvalidName,
+		})
+		return
+	}
+
+	section, err := findClientSection(tenantFrom(c).storedName(name))
+	if err == errClientNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client not found",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	address := sectionTunnelAddress(section)
+	if section.disabled || address == "" {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: "Only an enabled client with a tunnel address can be probed",
+			Code:    codeConflict,
+		})
+		return
+	}
+
+	result := probeMTU(address)
+	result.Name = name
+
+	var message string
+	switch {
+	case result.LargestWorking == 0:
+		message = fmt.Sprintf("%s didn't answer pings; check that the client is online with POST /users/%s/diagnose", address, name)
+	case result.SuggestedMTU == 0:
+		message = fmt.Sprintf("Packets of the interface MTU %d reach the client; no change needed", result.InterfaceMTU)
+	default:
+		message = fmt.Sprintf("Packets over %d bytes don't reach the client; set MTU = %d in its [Interface]", result.LargestWorking, result.SuggestedMTU)
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    result,
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMTUProbe(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+
+	// Answers payloads up to 1344 bytes, packets of 1372 with the headers
+	script := filepath.Join(env.dir, "ping")
+	os.WriteFile(script, []byte("#!/bin/bash\nwhile [ $# -gt 0 ]; do [ \"$1\" = -s ] && size=$2; shift; done\n[ \"$size\" -le 1344 ]\n"), 0755)
+	oldCmd, oldDir := pingCmd, sysClassNetDir
+	pingCmd, sysClassNetDir = script, t.TempDir()
+	t.Cleanup(func() { pingCmd, sysClassNetDir = oldCmd, oldDir })
+
+	probe := func() MTUProbeResult {
+		t.Helper()
+		rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/mtu-probe", nil)
+		var resp struct {
+			Data MTUProbeResult `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("mtu probe: status %d, %s", rec.Code, rec.Body.String())
+		}
+		return resp.Data
+	}
+
+	result := probe()
+	if result.Address != "10.66.0.2" || result.InterfaceMTU != mtuProbeDefaultMax || result.LargestWorking != 1372 || result.SuggestedMTU != 1372 {
+		t.Errorf("got %+v", result)
+	}
+	if len(result.Steps) > 12 {
+		t.Errorf("took %d pings", len(result.Steps))
+	}
+
+	// Everything up to the interface MTU gets through
+	os.MkdirAll(filepath.Join(sysClassNetDir, "wg0"), 0755)
+	os.WriteFile(filepath.Join(sysClassNetDir, "wg0", "mtu"), []byte("1300\n"), 0644)
+	if result := probe(); result.LargestWorking != 1300 || result.SuggestedMTU != 0 || len(result.Steps) != 1 {
+		t.Errorf("interface MTU: got %+v", result)
+	}
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/carol/mtu-probe", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown client: got status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With NAT_MANAGED the service owns the masquerade and forwarding rules
+// clients need to reach the internet, in the firewall table (see
+// firewall.go), instead of relying on the installer's PostUp iptables
+// rules. Those can stay; the rules just overlap. A firewall reload that
+// flushes the ruleset drops the table, so it can be checked and applied
+// again through /nat.
+
+// Egress interface the client traffic is masqueraded out of; empty when
+// NAT isn't managed
+var natEgressNIC string
+
+var defaultRouteDevRegex = regexp.MustCompile(`\bdev (\S+)`)
+
+// NAT_EGRESS_NIC, else the installer's SERVER_PUB_NIC, else the interface
+// of the default route
+func detectEgressNIC() (string, error) {
+	if NAT_EGRESS_NIC != "" {
+		return NAT_EGRESS_NIC, nil
+	}
+	if wgParams.ServerPubNIC != "" {
+		return wgParams.ServerPubNIC, nil
+	}
+	success, output := executeCommand("ip", "route", "show", "default")
+	if success != "success" {
+		return "", fmt.Errorf("failed to read the default route: %s", output)
+	}
+	match := defaultRouteDevRegex.FindStringSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("no default route; set NAT_EGRESS_NIC")
+	}
+	return match[1], nil
+}
+
+// Pick the egress interface when NAT is managed. The rules are installed by
+// the startup applyFirewall.
+func setupNAT() error {
+	if !NAT_MANAGED {
+		return nil
+	}
+	nic, err := detectEgressNIC()
+	if err != nil {
+		return err
+	}
+	natEgressNIC = nic
+	log.Printf("Managing NAT for %s out of %s", wgParams.ServerWGNIC, nic)
+	return nil
+}
+
+// Forward chain and postrouting rules letting clients out through egress
+// and forwarded ports in
+func renderNAT(nic, egress string) ([]string, []string) {
+	forward := []string{
+		fmt.Sprintf("iifname %q oifname %q accept", nic, egress),
+		fmt.Sprintf("iifname %q oifname %q ct state established,related accept", egress, nic),
+		fmt.Sprintf("iifname %q oifname %q ct status dnat accept", egress, nic),
+	}
+	postrouting := []string{
+		fmt.Sprintf("iifname %q oifname %q masquerade", nic, egress),
+	}
+	return forward, postrouting
+}
+
+// Whether the loaded table still has the masquerade rule
+func natInstalled() (bool, error) {
+	success, output := executeCommand(nftCmd, "list", "table", "inet", firewallTable)
+	if success != "success" {
+		// A missing table is the common case after a reload
+		if strings.Contains(output, "No such file or directory") {
+			return false, nil
+		}
+		return false, fmt.Errorf("nft failed: %s", output)
+	}
+	return strings.Contains(output, "masquerade"), nil
+}
+
+// Handler showing the managed NAT rules and whether they are loaded
+func natHandlerGin(c *gin.Context) {
+	data := map[string]interface{}{
+		"managed": natEgressNIC != "",
+	}
+	if natEgressNIC != "" {
+		installed, err := natInstalled()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+		forward, postrouting := renderNAT(wgParams.ServerWGNIC, natEgressNIC)
+		data["egress_nic"] = natEgressNIC
+		data["installed"] = installed
+		data["rules"] = map[string][]string{"forward": forward, "postrouting": postrouting}
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
+
+// Handler loading the whole firewall table again, e.g. after a firewall
+// reload flushed it
+func applyNATHandlerGin(c *gin.Context) {
+	if err := applyFirewall(); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Firewall rules applied",
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestManagedNAT(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+
+	if body := env.authedRequest(t, http.MethodGet, "/api/v1/nat", nil).Body.String(); !strings.Contains(body, `"managed":false`) {
+		t.Errorf("NAT must be unmanaged by default: %s", body)
+	}
+
+	oldNIC := natEgressNIC
+	natEgressNIC = "eth0"
+	t.Cleanup(func() { natEgressNIC = oldNIC })
+
+	var status struct {
+		Data struct {
+			Managed   bool   `json:"managed"`
+			EgressNIC string `json:"egress_nic"`
+			Installed bool   `json:"installed"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/nat", nil).Body.Bytes(), &status)
+	if !status.Data.Managed || status.Data.EgressNIC != "eth0" || status.Data.Installed {
+		t.Errorf("before applying: got %+v", status.Data)
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/nat/apply", nil).Code; code != http.StatusOK {
+		t.Fatalf("apply: got status %d", code)
+	}
+	rules := readRules(t, rulesFile)
+	for _, want := range []string{
+		`iifname "wg0" oifname "eth0" masquerade`,
+		`iifname "wg0" oifname "eth0" accept`,
+		"hook postrouting",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules missing %q:\n%s", want, rules)
+		}
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/nat", nil).Body.Bytes(), &status)
+	if !status.Data.Installed {
+		t.Error("applied rules must show as installed")
+	}
+
+	// A firewall reload flushing the ruleset is detected
+	os.Remove(rulesFile)
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/nat", nil).Body.Bytes(), &status)
+	if status.Data.Installed {
+		t.Error("flushed rules must show as missing")
+	}
+}
+
+func TestNATAcceptsFollowClientChains(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+	oldNIC := natEgressNIC
+	natEgressNIC = "eth0"
+	t.Cleanup(func() { natEgressNIC = oldNIC })
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/firewall", FirewallPolicy{Allow: []FirewallRule{}})
+	rules := readRules(t, rulesFile)
+	jump := strings.Index(rules, `jump "client-alice"`)
+	accept := strings.Index(rules, `iifname "wg0" oifname "eth0" accept`)
+	if jump < 0 || accept < jump {
+		t.Errorf("the egress accept must come after the client jumps:\n%s", rules)
+	}
+}
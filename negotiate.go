@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Media types offered by respondNegotiated, JSON first so a missing or
+// wildcard Accept header keeps the default
+var negotiatedFormats = []string{
+	gin.MIMEJSON,
+	"application/yaml",
+	"application/x-yaml",
+	"text/yaml",
+	"text/csv",
+}
+
+// Reply with resp in the format the Accept header asks for: JSON (default),
+// YAML with the same structure, or CSV rendered by table (header row
+// first). Endpoints without a tabular form pass a nil table and answer 406
+// to CSV requests. Unsupported types fall back to JSON rather than failing,
+// as the API always answered JSON before.
+func respondNegotiated(c *gin.Context, status int, resp APIResponse, table func() [][]string) {
+	switch c.NegotiateFormat(negotiatedFormats...) {
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		body, err := marshalYAML(resp)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: "Failed to encode YAML: " + err.Error(),
+			})
+			return
+		}
+		c.Data(status, "application/yaml; charset=utf-8", body)
+
+	case "text/csv":
+		if table == nil {
+			c.JSON(http.StatusNotAcceptable, APIResponse{
+				Success: false,
+				Message: "CSV is not available for this endpoint",
+			})
+			return
+		}
+
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.WriteAll(table())
+		c.Data(status, "text/csv; charset=utf-8", buf.Bytes())
+
+	default:
+		c.JSON(status, resp)
+	}
+}
+
+// Reply like respondNegotiated with a list of count elements that is too
+// large to hold in memory at once, such as every client with its config.
+// item returns the i-th element, or false to leave it out, and is called
+// only when the element is written, so each can be dropped before the next
+// is built. The CSV form has the header row, then row(i) per element.
+func respondStreamed(c *gin.Context, status int, count int, item func(i int) (interface{}, bool), header []string, row func(i int) []string) {
+	var err error
+	switch c.NegotiateFormat(negotiatedFormats...) {
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		c.Header("Content-Type", "application/yaml; charset=utf-8")
+		c.Status(status)
+		err = streamYAML(c.Writer, count, item)
+
+	case "text/csv":
+		if header == nil {
+			c.JSON(http.StatusNotAcceptable, APIResponse{
+				Success: false,
+				Message: "CSV is not available for this endpoint",
+			})
+			return
+		}
+
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(status)
+		w := csv.NewWriter(c.Writer)
+		w.Write(header)
+		for i := 0; i < count && w.Error() == nil; i++ {
+			w.Write(row(i))
+		}
+		w.Flush()
+		err = w.Error()
+
+	default:
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Status(status)
+		err = streamJSON(c.Writer, count, item)
+	}
+	if err != nil && DEBUG_MODE {
+		log.Printf("Streaming %s stopped: %v", c.Request.URL.Path, err)
+	}
+}
+
+// Write the elements as the data of a successful APIResponse, the same as
+// c.JSON would
+func streamJSON(w io.Writer, count int, item func(i int) (interface{}, bool)) error {
+	if _, err := io.WriteString(w, `{"success":true,"data":[`); err != nil {
+		return err
+	}
+	first := true
+	for i := 0; i < count; i++ {
+		v, ok := item(i)
+		if !ok {
+			continue
+		}
+		element, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if !first {
+			element = append([]byte{','}, element...)
+		}
+		first = false
+		if _, err := w.Write(element); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]}")
+	return err
+}
+
+// Write the elements as the data of a successful APIResponse, the same as
+// marshalYAML would: each element is encoded on its own and indented as an
+// item of the data sequence
+func streamYAML(w io.Writer, count int, item func(i int) (interface{}, bool)) error {
+	if _, err := io.WriteString(w, "success: true\n"); err != nil {
+		return err
+	}
+	empty := true
+	for i := 0; i < count; i++ {
+		v, ok := item(i)
+		if !ok {
+			continue
+		}
+		element, err := marshalYAML(v)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if empty {
+			buf.WriteString("data:\n")
+			empty = false
+		}
+		for j, line := range bytes.SplitAfter(element, []byte("\n")) {
+			switch {
+			case len(line) == 0:
+				continue
+			case j == 0:
+				buf.WriteString("  - ")
+			case len(bytes.TrimSpace(line)) > 0:
+				buf.WriteString("    ")
+			}
+			buf.Write(line)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if empty {
+		_, err := io.WriteString(w, "data: []\n")
+		return err
+	}
+	return nil
+}
+
+// Encode v as YAML with the keys and field names of its JSON form. JSON is
+// valid YAML, so it is parsed back as a node tree (keeping key order and
+// string/number distinctions) and re-emitted in block style.
+func marshalYAML(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	clearYAMLStyle(&doc)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func clearYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		clearYAMLStyle(child)
+	}
+}
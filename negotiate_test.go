@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func (e *testEnv) acceptRequest(t *testing.T, path, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("key", "test-token")
+	req.Header.Set("Accept", accept)
+
+	recorder := httptest.NewRecorder()
+	e.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestListUsersAsYAML(t *testing.T) {
+	env := setupTestEnv(t)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding failed with status %d", code)
+	}
+
+	recorder := env.acceptRequest(t, "/api/v1/users?include=config", "application/yaml")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+	if got := recorder.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/yaml") {
+		t.Errorf("Content-Type %q, want application/yaml", got)
+	}
+
+	var resp struct {
+		Success bool `yaml:"success"`
+		Data    []struct {
+			Name   string `yaml:"name"`
+			IPV4   string `yaml:"ipv4"`
+			Config string `yaml:"config"`
+		} `yaml:"data"`
+	}
+	if err := yaml.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding YAML: %v\n%s", err, recorder.Body.String())
+	}
+	if !resp.Success || len(resp.Data) != 1 || resp.Data[0].Name != "alice" || resp.Data[0].IPV4 != "10.66.0.2" {
+		t.Errorf("unexpected payload %+v", resp)
+	}
+	if !strings.Contains(resp.Data[0].Config, "[Interface]") {
+		t.Errorf("config not preserved: %q", resp.Data[0].Config)
+	}
+}
+
+func TestListUsersAsCSV(t *testing.T) {
+	env := setupTestEnv(t)
+	for _, name := range []string{"alice", "bob"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("seeding %s failed with status %d", name, code)
+		}
+	}
+
+	recorder := env.acceptRequest(t, "/api/v1/users", "text/csv")
+	if got := recorder.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/csv") {
+		t.Fatalf("Content-Type %q, want text/csv", got)
+	}
+
+	rows, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("decoding CSV: %v", err)
+	}
+	if len(rows) != 3 || strings.Join(rows[0], ",") != "name,ipv4,ipv6" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+	// Client order isn't guaranteed
+	if names := rows[1][0] + "," + rows[2][0]; names != "alice,bob" && names != "bob,alice" {
+		t.Errorf("unexpected client rows %v", rows[1:])
+	}
+}
+
+func TestStatsAsCSV(t *testing.T) {
+	env := setupTestEnv(t)
+	env.writeDump(t, "pub1\tpsk\t198.51.100.1:4000\t10.66.0.2/32\t0\t1536\t2048\t25")
+
+	recorder := env.acceptRequest(t, "/api/v1/stats?format=human", "text/csv")
+	rows, err := csv.NewReader(recorder.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("decoding CSV: %v", err)
+	}
+	if len(rows) != 2 || rows[0][2] != "rx_bytes" || rows[1][2] != "1536" {
+		t.Errorf("stats CSV must carry raw counts whatever the format, got %v", rows)
+	}
+}
+
+func TestUnsupportedAcceptFallsBackToJSON(t *testing.T) {
+	env := setupTestEnv(t)
+
+	for _, accept := range []string{"", "*/*", "application/xml"} {
+		recorder := env.acceptRequest(t, "/api/v1/users", accept)
+		if got := recorder.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+			t.Errorf("Accept %q: Content-Type %q, want JSON", accept, got)
+		}
+	}
+}
+
+func TestStreamedListMatchesBuffered(t *testing.T) {
+	clients := []Client{
+		{Name: "alice", IPV4: "10.66.0.2", Config: "[Interface]\nPrivateKey = a\n\n[Peer]\nEndpoint = <host>:51820\n"},
+		{Name: "skipped"},
+		{Name: "bob", Metadata: map[string]string{"team": "ops"}, Tags: []string{"laptop", "eu"}, Notes: "line one\nline two"},
+	}
+	for _, kept := range [][]Client{clients, nil} {
+		item := func(i int) (interface{}, bool) { return kept[i], kept[i].Name != "skipped" }
+		want := []Client{}
+		for _, client := range kept {
+			if client.Name != "skipped" {
+				want = append(want, client)
+			}
+		}
+
+		var streamed bytes.Buffer
+		if err := streamJSON(&streamed, len(kept), item); err != nil {
+			t.Fatalf("streaming JSON: %v", err)
+		}
+		buffered, _ := json.Marshal(APIResponse{Success: true, Data: want})
+		if streamed.String() != string(buffered) {
+			t.Errorf("streamed JSON:\n%s\nwant:\n%s", streamed.String(), buffered)
+		}
+
+		streamed.Reset()
+		if err := streamYAML(&streamed, len(kept), item); err != nil {
+			t.Fatalf("streaming YAML: %v", err)
+		}
+		buffered, _ = marshalYAML(APIResponse{Success: true, Data: want})
+		if streamed.String() != string(buffered) {
+			t.Errorf("streamed YAML:\n%s\nwant:\n%s", streamed.String(), buffered)
+		}
+	}
+}
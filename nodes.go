@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Timeout for one command on a remote node, connection included
+const remoteCommandTimeout = 30 * time.Second
+
+// ssh binary used to reach remote nodes; a var so tests can substitute it
+var sshCmd = "ssh"
+
+// A remote WireGuard server managed over SSH, as listed in NODES_CONFIG.
+// Host keys are checked against the API user's known_hosts, so add each
+// node there first (e.g. with ssh-keyscan).
+type NodeConfig struct {
+	Name         string `yaml:"name" json:"name"`
+	Host         string `yaml:"host" json:"host"`
+	Port         int    `yaml:"port" json:"port,omitempty"`
+	User         string `yaml:"user" json:"user,omitempty"`
+	IdentityFile string `yaml:"identity_file" json:"-"`
+	// "wireguard" (default) or "amneziawg"
+	Backend    string `yaml:"backend" json:"backend"`
+	ParamsFile string `yaml:"params_file" json:"-"`
+	// Derived from the params' interface name when empty
+	ConfigFile string `yaml:"config_file" json:"-"`
+	ClientsDir string `yaml:"clients_dir" json:"-"`
+	// false creates the node's clients without a preshared key
+	PresharedKeys *bool `yaml:"preshared_keys" json:"preshared_keys,omitempty"`
+}
+
+type remoteNode struct {
+	NodeConfig
+	// Serializes config changes on the node, like wgConfigMutex locally
+	mu sync.Mutex
+}
+
+var (
+	nodesMutex sync.RWMutex
+	nodes      = map[string]*remoteNode{}
+)
+
+// Load the remote node list. Without NODES_CONFIG only the local server is
+// managed.
+func loadNodes() error {
+	if NODES_CONFIG == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(NODES_CONFIG)
+	if err != nil {
+		return fmt.Errorf("failed to read nodes config: %v", err)
+	}
+
+	var file struct {
+		Nodes []NodeConfig `yaml:"nodes"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("failed to parse nodes config: %v", err)
+	}
+
+	loaded := make(map[string]*remoteNode, len(file.Nodes))
+	for _, cfg := range file.Nodes {
+		if !clientNameRegex.MatchString(cfg.Name) || cfg.Host == "" {
+			return fmt.Errorf("nodes config: every node needs a host and a name of letters, digits, _ or -")
+		}
+		if cfg.Name == localNodeName {
+			return fmt.Errorf("nodes config: %s is reserved for this server", localNodeName)
+		}
+		if loaded[cfg.Name] != nil {
+			return fmt.Errorf("nodes config: duplicate node %s", cfg.Name)
+		}
+		if cfg.Backend == "" {
+			cfg.Backend = "wireguard"
+		}
+		if cfg.Backend != "wireguard" && cfg.Backend != "amneziawg" {
+			return fmt.Errorf("nodes config: node %s has unknown backend %s", cfg.Name, cfg.Backend)
+		}
+		if cfg.ParamsFile == "" {
+			cfg.ParamsFile = "/etc/wireguard/params"
+			if cfg.Backend == "amneziawg" {
+				cfg.ParamsFile = "/etc/amnezia/amneziawg/params"
+			}
+		}
+		if cfg.ClientsDir == "" {
+			cfg.ClientsDir = "/home/wireguard/users"
+		}
+		loaded[cfg.Name] = &remoteNode{NodeConfig: cfg}
+	}
+
+	nodesMutex.Lock()
+	nodes = loaded
+	nodesMutex.Unlock()
+
+	log.Printf("Managing %d remote nodes from %s", len(loaded), NODES_CONFIG)
+	return nil
+}
+
+// Quote a string for the remote POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Run a shell command on the node, feeding stdin when non-nil
+func (n *remoteNode) run(stdin []byte, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteCommandTimeout)
+	defer cancel()
+
+	args := []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}
+	if n.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(n.Port))
+	}
+	if n.IdentityFile != "" {
+		args = append(args, "-i", n.IdentityFile)
+	}
+	target := n.Host
+	if n.User != "" {
+		target = n.User + "@" + n.Host
+	}
+	args = append(args, target, "--", command)
+
+	cmd := exec.CommandContext(ctx, sshCmd, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if DEBUG_MODE {
+			log.Printf("Node %s: %q failed: %v, stderr: %s", n.Name, command, err, stderr.String())
+		}
+		return "", fmt.Errorf("node %s: %v: %s", n.Name, err, redactSecrets(strings.TrimSpace(stderr.String())))
+	}
+	return stdout.String(), nil
+}
+
+func (n *remoteNode) wgCmd() string {
+	if n.Backend == "amneziawg" {
+		return "awg"
+	}
+	return "wg"
+}
+
+func (n *remoteNode) wgQuickCmd() string {
+	if n.Backend == "amneziawg" {
+		return "awg-quick"
+	}
+	return "wg-quick"
+}
+
+// Read the node's params and server config. Caller holds n.mu.
+func (n *remoteNode) loadState() (WGParams, string, []byte, error) {
+	raw, err := n.run(nil, "cat "+shellQuote(n.ParamsFile))
+	if err != nil {
+		return WGParams{}, "", nil, fmt.Errorf("failed to read params file: %v", err)
+	}
+	params := parseWGParams([]byte(raw))
+	if err := validateWGParams(params); err != nil {
+		return WGParams{}, "", nil, fmt.Errorf("node %s: %v", n.Name, err)
+	}
+
+	configFile := n.ConfigFile
+	if configFile == "" {
+		configFile = serverConfigPath(n.Backend, params.ServerWGNIC)
+	}
+	config, err := n.run(nil, "cat "+shellQuote(configFile))
+	if err != nil {
+		return WGParams{}, "", nil, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	return params, configFile, []byte(config), nil
+}
+
+func (n *remoteNode) clientConfigPath(params WGParams, name string) string {
+	return path.Join(n.ClientsDir, params.ServerWGNIC+"-client-"+clientFileName(name)+".conf")
+}
+
+// Apply the server config without dropping sessions, as syncWireGuardConf
+// does locally
+func (n *remoteNode) syncConf(params WGParams) error {
+	stripped, err := n.run(nil, n.wgQuickCmd()+" strip "+shellQuote(params.ServerWGNIC))
+	if err != nil {
+		return withCode(codeSyncFailed, fmt.Errorf("%s strip command failed: %v", n.wgQuickCmd(), err))
+	}
+	if _, err := n.run([]byte(stripped), n.wgCmd()+" syncconf "+shellQuote(params.ServerWGNIC)+" /dev/stdin"); err != nil {
+		return withCode(codeSyncFailed, fmt.Errorf("%s syncconf command failed: %v", n.wgCmd(), err))
+	}
+	return nil
+}
+
+func (n *remoteNode) listClients() ([]Client, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, _, config, err := n.loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	// Names and addresses come from the peer blocks; configs are returned
+	// when a client is added
+	clients := []Client{}
+	for _, line := range strings.Split(string(config), "\n") {
+		line = strings.TrimSpace(line)
+		if name := strings.TrimPrefix(line, "### Client "); name != line {
+			clients = append(clients, Client{Name: name})
+			continue
+		}
+		if len(clients) == 0 || !strings.HasPrefix(line, "AllowedIPs = ") {
+			continue
+		}
+
+		client := &clients[len(clients)-1]
+		for _, cidr := range strings.Split(strings.TrimPrefix(line, "AllowedIPs = "), ",") {
+			ip := strings.TrimSpace(strings.SplitN(cidr, "/", 2)[0])
+			if strings.Contains(ip, ":") {
+				client.IPV6 = ip
+			} else {
+				client.IPV4 = ip
+			}
+		}
+	}
+	return clients, nil
+}
+
+// A nil presharedKey follows the node's preshared_keys setting
+func (n *remoteNode) addClient(name, ipv4, ipv6 string, presharedKey *bool) (Client, error) {
+	// Keys are generated on the node, so the API host needs no wg tools
+	keys, err := n.generateKeys(presharedKeyFor(presharedKey, presharedKeyFor(n.PresharedKeys, true)))
+	if err != nil {
+		return Client{}, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	params, configFile, config, err := n.loadState()
+	if err != nil {
+		return Client{}, err
+	}
+	if regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(name) + `$`).Match(config) {
+		return Client{}, errClientExists
+	}
+
+	if ipv4 == "" {
+		if ipv4, err = nextAvailableIPv4(params, config); err != nil {
+			return Client{}, err
+		}
+	}
+	if ipv6 == "" && params.ServerWGIPv6 != "" {
+		if ipv6, err = nextAvailableIPv6(params, config); err != nil {
+			return Client{}, err
+		}
+	}
+
+	return n.createClientLocked(params, configFile, name, ipv4, ipv6, keys)
+}
+
+func (n *remoteNode) generateKeys(presharedKey bool) (clientKeys, error) {
+	var keys clientKeys
+	var err error
+	if keys.privateKey, err = n.run(nil, n.wgCmd()+" genkey"); err != nil {
+		return clientKeys{}, fmt.Errorf("failed to generate private key: %v", err)
+	}
+	keys.privateKey = strings.TrimSpace(keys.privateKey)
+	if keys.publicKey, err = n.run([]byte(keys.privateKey), n.wgCmd()+" pubkey"); err != nil {
+		return clientKeys{}, fmt.Errorf("failed to derive public key: %v", err)
+	}
+	keys.publicKey = strings.TrimSpace(keys.publicKey)
+	if !presharedKey {
+		return keys, nil
+	}
+	if keys.preSharedKey, err = n.run(nil, n.wgCmd()+" genpsk"); err != nil {
+		return clientKeys{}, fmt.Errorf("failed to generate pre-shared key: %v", err)
+	}
+	keys.preSharedKey = strings.TrimSpace(keys.preSharedKey)
+	return keys, nil
+}
+
+// Write the client config, append the peer and apply it. Caller holds n.mu.
+func (n *remoteNode) createClientLocked(params WGParams, configFile, name, ipv4, ipv6 string, keys clientKeys) (Client, error) {
+	clientConfig := renderClientConfig(params, n.Backend, ipv4, ipv6, keys, nil, "")
+	clientPath := n.clientConfigPath(params, name)
+	if _, err := n.run([]byte(clientConfig), fmt.Sprintf("mkdir -p -m 700 %s && umask 077 && cat > %s",
+		shellQuote(n.ClientsDir), shellQuote(clientPath))); err != nil {
+		return Client{}, fmt.Errorf("failed to write client config: %v", err)
+	}
+
+	if _, err := n.run([]byte(renderServerPeer(name, ipv4, ipv6, keys)), "cat >> "+shellQuote(configFile)); err != nil {
+		n.run(nil, "rm -f "+shellQuote(clientPath))
+		return Client{}, fmt.Errorf("failed to update server config: %v", err)
+	}
+
+	if err := n.syncConf(params); err != nil {
+		return Client{}, fmt.Errorf("failed to sync WireGuard config: %w", err)
+	}
+
+	return Client{Name: name, IPV4: ipv4, IPV6: ipv6, Config: clientConfig}, nil
+}
+
+var errClientNotFound = errors.New("Client not found")
+
+func (n *remoteNode) deleteClient(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	params, configFile, config, err := n.loadState()
+	if err != nil {
+		return err
+	}
+
+	updated, removed := removeClientFromConfig(config, name)
+	if !removed {
+		return errClientNotFound
+	}
+	if _, err := n.run(updated, "umask 077 && cat > "+shellQuote(configFile)); err != nil {
+		return fmt.Errorf("failed to update server config: %v", err)
+	}
+	if _, err := n.run(nil, "rm -f "+shellQuote(n.clientConfigPath(params, name))); err != nil {
+		log.Printf("Node %s: failed to remove client config of %s: %v", n.Name, name, err)
+	}
+
+	if err := n.syncConf(params); err != nil {
+		return fmt.Errorf("failed to sync WireGuard config: %w", err)
+	}
+	return nil
+}
+
+// Resolve the :node parameter, answering 404 for unknown nodes
+func nodeFromParam(c *gin.Context) (*remoteNode, bool) {
+	nodesMutex.RLock()
+	node := nodes[c.Param("node")]
+	nodesMutex.RUnlock()
+
+	if node == nil {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Node not found",
+		})
+		return nil, false
+	}
+	return node, true
+}
+
+// Handler listing the configured remote nodes
+func listNodesHandlerGin(c *gin.Context) {
+	nodesMutex.RLock()
+	list := make([]NodeConfig, 0, len(nodes))
+	for _, node := range nodes {
+		list = append(list, node.NodeConfig)
+	}
+	nodesMutex.RUnlock()
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+func nodeUsersHandlerGin(c *gin.Context) {
+	node, ok := nodeFromParam(c)
+	if !ok {
+		return
+	}
+
+	clients, err := node.listClients()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    clients,
+	})
+}
+
+func nodeAddUserHandlerGin(c *gin.Context) {
+	node, ok := nodeFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req AddUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !validClientName(req.Name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Client name " + clientNameMessage(),
+			Code:    codeInvalidName,
+		})
+		return
+	}
+	if err := req.validateFields(); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	if !reserveCreates(c, 1) {
+		return
+	}
+
+	client, err := node.addClient(req.Name, req.IPV4, req.IPV6, req.PresharedKey)
+	if err != nil {
+		releaseCreates(c, 1)
+	}
+	if errors.Is(err, errClientExists) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: clientExistsMessage,
+			Code:    codeNameTaken,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Client added successfully",
+		Data:    client,
+	})
+}
+
+func nodeDeleteUserHandlerGin(c *gin.Context) {
+	node, ok := nodeFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req DeleteUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid request payload",
+		})
+		return
+	}
+
+	err := node.deleteClient(req.Name)
+	if errors.Is(err, errClientNotFound) {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client not found",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Client deleted successfully",
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Stands in for ssh: drops the options and target and runs the command
+// locally, where PATH points at the fake wg
+const fakeSSHScript = `#!/bin/bash
+while [ "$1" != "--" ]; do shift; done
+exec bash -c "$2"
+`
+
+type fakeNode struct {
+	configFile string
+	clientsDir string
+}
+
+func setupFakeNode(t *testing.T, env *testEnv) fakeNode {
+	t.Helper()
+
+	remote := t.TempDir()
+	node := fakeNode{
+		configFile: filepath.Join(remote, "wg0.conf"),
+		clientsDir: filepath.Join(remote, "users"),
+	}
+	paramsFile := filepath.Join(remote, "params")
+
+	files := map[string]string{
+		paramsFile:                    "SERVER_PUB_IP=198.51.100.7\nSERVER_WG_NIC=wg0\nSERVER_WG_IPV4=10.77.0.1\nSERVER_PORT=51820\nSERVER_PUB_KEY=node-pub\nCLIENT_DNS_1=9.9.9.9\nCLIENT_DNS_2=1.1.1.1\nALLOWED_IPS=0.0.0.0/0\n",
+		node.configFile:               "[Interface]\nAddress = 10.77.0.1/16\n",
+		filepath.Join(env.dir, "ssh"): fakeSSHScript,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(env.dir, "wg"), filepath.Join(env.dir, "wg-quick")); err != nil {
+		t.Fatalf("linking wg-quick: %v", err)
+	}
+	t.Setenv("PATH", env.dir+":"+os.Getenv("PATH"))
+
+	nodesFile := filepath.Join(remote, "nodes.yml")
+	nodesYAML := fmt.Sprintf("nodes:\n  - name: fra1\n    host: fra1.example\n    user: root\n    params_file: %s\n    config_file: %s\n    clients_dir: %s\n",
+		paramsFile, node.configFile, node.clientsDir)
+	if err := os.WriteFile(nodesFile, []byte(nodesYAML), 0600); err != nil {
+		t.Fatalf("writing nodes config: %v", err)
+	}
+
+	oldSSH, oldNodesConfig := sshCmd, NODES_CONFIG
+	sshCmd, NODES_CONFIG = filepath.Join(env.dir, "ssh"), nodesFile
+	t.Cleanup(func() {
+		sshCmd, NODES_CONFIG = oldSSH, oldNodesConfig
+		nodes = map[string]*remoteNode{}
+	})
+	if err := loadNodes(); err != nil {
+		t.Fatalf("loadNodes: %v", err)
+	}
+	return node
+}
+
+func TestRemoteNodeUserLifecycle(t *testing.T) {
+	env := setupTestEnv(t)
+	node := setupFakeNode(t, env)
+
+	recorder := env.authedRequest(t, http.MethodPost, "/api/v1/nodes/fra1/users/add", AddUserRequest{Name: "alice"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("add: got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+	var added struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &added)
+	if added.Data.IPV4 != "10.77.0.2" || !strings.Contains(added.Data.Config, "Endpoint = 198.51.100.7:51820") {
+		t.Errorf("client must be allocated and rendered from the node's params, got %+v", added.Data)
+	}
+
+	config, _ := os.ReadFile(node.configFile)
+	if !strings.Contains(string(config), "### Client alice") {
+		t.Errorf("peer not appended on the node:\n%s", config)
+	}
+	if _, err := os.Stat(filepath.Join(node.clientsDir, "wg0-client-alice.conf")); err != nil {
+		t.Errorf("client config not written on the node: %v", err)
+	}
+	if env.syncconfCalls(t) != 1 {
+		t.Errorf("node config must be applied once, got %d syncconf calls", env.syncconfCalls(t))
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/nodes/fra1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusConflict {
+		t.Errorf("duplicate add: got status %d, want 409", code)
+	}
+
+	list := env.authedRequest(t, http.MethodGet, "/api/v1/nodes/fra1/users", nil)
+	if !strings.Contains(list.Body.String(), `{"name":"alice","ipv4":"10.77.0.2"}`) {
+		t.Errorf("unexpected list %s", list.Body.String())
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/nodes/fra1/users/delete", DeleteUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("delete: got status %d", code)
+	}
+	config, _ = os.ReadFile(node.configFile)
+	if strings.Contains(string(config), "alice") {
+		t.Errorf("peer not removed on the node:\n%s", config)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/nodes/fra1/users/delete", DeleteUserRequest{Name: "alice"}).Code; code != http.StatusNotFound {
+		t.Errorf("second delete: got status %d, want 404", code)
+	}
+
+	// The local server is untouched
+	if strings.Contains(env.configContent(t), "alice") {
+		t.Error("remote add leaked into the local config")
+	}
+}
+
+func TestUnknownNode(t *testing.T) {
+	env := setupTestEnv(t)
+
+	if code := env.authedRequest(t, http.MethodGet, "/api/v1/nodes/nope/users", nil).Code; code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", code)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got := shellQuote("it's"); got != `'it'\''s'` {
+		t.Errorf("got %s", got)
+	}
+}
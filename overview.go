@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// IPv4 pool utilization from which a server gets a warning in the overview
+const poolWarnUtilization = 90.0
+
+// One server in the fleet overview
+type NodeOverview struct {
+	Name          string  `json:"name"`
+	Reachable     bool    `json:"reachable"`
+	InterfaceUp   bool    `json:"interface_up"`
+	TotalClients  int     `json:"total_clients"`
+	OnlineClients int     `json:"online_clients"`
+	TransferRx    int64   `json:"transfer_rx_bytes"`
+	TransferTx    int64   `json:"transfer_tx_bytes"`
+	IPPoolUsed    int     `json:"ip_pool_used"`
+	IPPoolUtil    float64 `json:"ip_pool_utilization"`
+	Error         string  `json:"error,omitempty"`
+}
+
+type OverviewAlert struct {
+	Node string `json:"node"`
+	// "critical" or "warning"
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// Same numbers as collectSummaryStats, gathered over SSH
+func (n *remoteNode) summary() (summaryStats, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	params, _, config, err := n.loadState()
+	if err != nil {
+		return summaryStats{}, err
+	}
+
+	stats := summaryStats{
+		TotalClients: len(regexp.MustCompile(`(?m)^### Client (.+)$`).FindAll(config, -1)),
+		UsedIPv4:     countUsedIPv4(params, config),
+	}
+	dump, err := n.run(nil, n.wgCmd()+" show "+shellQuote(params.ServerWGNIC)+" dump")
+	if err != nil {
+		return stats, nil
+	}
+	stats.InterfaceUp = true
+	now := time.Now()
+	for _, peer := range parseWGDump(dump) {
+		if peer.online(now) {
+			stats.OnlineClients++
+		}
+		stats.TransferRx += peer.TransferRx
+		stats.TransferTx += peer.TransferTx
+	}
+	return stats, nil
+}
+
+// Summaries of this server and every remote node, gathered concurrently so
+// one slow node doesn't add up with the others
+func collectOverview() []NodeOverview {
+	nodesMutex.RLock()
+	remotes := make([]*remoteNode, 0, len(nodes))
+	for _, node := range nodes {
+		remotes = append(remotes, node)
+	}
+	nodesMutex.RUnlock()
+	sort.Slice(remotes, func(i, j int) bool { return remotes[i].Name < remotes[j].Name })
+
+	overview := make([]NodeOverview, len(remotes)+1)
+	var wg sync.WaitGroup
+	gather := func(i int, name string, summary func() (summaryStats, error)) {
+		defer wg.Done()
+		entry := NodeOverview{Name: name}
+		stats, err := summary()
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Reachable = true
+			entry.InterfaceUp = stats.InterfaceUp
+			entry.TotalClients = stats.TotalClients
+			entry.OnlineClients = stats.OnlineClients
+			entry.TransferRx = stats.TransferRx
+			entry.TransferTx = stats.TransferTx
+			entry.IPPoolUsed = stats.UsedIPv4
+			entry.IPPoolUtil = float64(stats.UsedIPv4) / float64(ipv4PoolSize) * 100
+		}
+		overview[i] = entry
+	}
+
+	wg.Add(len(overview))
+	go gather(0, localNodeName, collectSummaryStats)
+	for i, node := range remotes {
+		go gather(i+1, node.Name, node.summary)
+	}
+	wg.Wait()
+	return overview
+}
+
+func overviewAlerts(overview []NodeOverview) []OverviewAlert {
+	alerts := []OverviewAlert{}
+	for _, node := range overview {
+		switch {
+		case !node.Reachable:
+			alerts = append(alerts, OverviewAlert{Node: node.Name, Level: "critical", Message: "unreachable: " + node.Error})
+		case !node.InterfaceUp:
+			alerts = append(alerts, OverviewAlert{Node: node.Name, Level: "critical", Message: "interface is down"})
+		}
+		if node.IPPoolUtil >= poolWarnUtilization {
+			alerts = append(alerts, OverviewAlert{Node: node.Name, Level: "warning",
+				Message: fmt.Sprintf("IPv4 pool %.1f%% used", node.IPPoolUtil)})
+		}
+		if node.Name == localNodeName {
+			if warning := publicIPWarning(); warning != "" {
+				alerts = append(alerts, OverviewAlert{Node: node.Name, Level: "warning", Message: warning})
+			}
+		}
+	}
+	return alerts
+}
+
+// Handler for the fleet dashboard: totals, per-server numbers and alerts
+// for this server and every remote node in one response
+func overviewHandlerGin(c *gin.Context) {
+	overview := collectOverview()
+
+	var reachable, clients, online int
+	var rx, tx int64
+	for _, node := range overview {
+		if node.Reachable {
+			reachable++
+		}
+		clients += node.TotalClients
+		online += node.OnlineClients
+		rx += node.TransferRx
+		tx += node.TransferTx
+	}
+
+	respondNegotiated(c, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"totals": map[string]interface{}{
+				"nodes":             len(overview),
+				"reachable_nodes":   reachable,
+				"total_clients":     clients,
+				"online_clients":    online,
+				"transfer_rx_bytes": rx,
+				"transfer_tx_bytes": tx,
+			},
+			"nodes":  overview,
+			"alerts": overviewAlerts(overview),
+		},
+	}, func() [][]string {
+		rows := [][]string{{"node", "reachable", "interface_up", "total_clients", "online_clients",
+			"rx_bytes", "tx_bytes", "ip_pool_used", "ip_pool_utilization"}}
+		for _, node := range overview {
+			rows = append(rows, []string{node.Name, strconv.FormatBool(node.Reachable), strconv.FormatBool(node.InterfaceUp),
+				strconv.Itoa(node.TotalClients), strconv.Itoa(node.OnlineClients),
+				strconv.FormatInt(node.TransferRx, 10), strconv.FormatInt(node.TransferTx, 10),
+				strconv.Itoa(node.IPPoolUsed), strconv.FormatFloat(node.IPPoolUtil, 'f', 2, 64)})
+		}
+		return rows
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+type overviewResponse struct {
+	Data struct {
+		Totals struct {
+			Nodes          int   `json:"nodes"`
+			ReachableNodes int   `json:"reachable_nodes"`
+			TotalClients   int   `json:"total_clients"`
+			OnlineClients  int   `json:"online_clients"`
+			TransferRx     int64 `json:"transfer_rx_bytes"`
+		} `json:"totals"`
+		Nodes  []NodeOverview  `json:"nodes"`
+		Alerts []OverviewAlert `json:"alerts"`
+	} `json:"data"`
+}
+
+func TestOverviewAggregatesNodes(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeNode(t, env)
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/nodes/fra1/users/add", AddUserRequest{Name: "bob"})
+	// The fake wg serves the same dump to both servers
+	env.writeDump(t, fmt.Sprintf("pub1\tpsk\t198.51.100.1:4000\t10.66.0.2/32\t%d\t100\t200\t25", time.Now().Unix()))
+
+	var resp overviewResponse
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/overview", nil).Body.Bytes(), &resp)
+	totals := resp.Data.Totals
+	if totals.Nodes != 2 || totals.ReachableNodes != 2 || totals.TotalClients != 2 || totals.OnlineClients != 2 || totals.TransferRx != 200 {
+		t.Errorf("unexpected totals %+v", totals)
+	}
+	if len(resp.Data.Nodes) != 2 || resp.Data.Nodes[0].Name != localNodeName || resp.Data.Nodes[1].Name != "fra1" {
+		t.Errorf("unexpected nodes %+v", resp.Data.Nodes)
+	}
+	if len(resp.Data.Alerts) != 0 {
+		t.Errorf("unexpected alerts %+v", resp.Data.Alerts)
+	}
+
+	// Every ssh call fails
+	if err := os.WriteFile(sshCmd, []byte("#!/bin/bash\necho unreachable >&2\nexit 255\n"), 0755); err != nil {
+		t.Fatalf("writing ssh: %v", err)
+	}
+	resp = overviewResponse{}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/overview", nil).Body.Bytes(), &resp)
+	if resp.Data.Totals.ReachableNodes != 1 || resp.Data.Totals.TotalClients != 1 {
+		t.Errorf("unreachable node must be left out of the totals, got %+v", resp.Data.Totals)
+	}
+	if len(resp.Data.Alerts) != 1 || resp.Data.Alerts[0].Node != "fra1" || resp.Data.Alerts[0].Level != "critical" {
+		t.Errorf("unexpected alerts %+v", resp.Data.Alerts)
+	}
+}
+
+func TestOverviewAlerts(t *testing.T) {
+	alerts := overviewAlerts([]NodeOverview{
+		{Name: "local", Reachable: true, InterfaceUp: true, IPPoolUtil: 10},
+		{Name: "fra1", Reachable: true, InterfaceUp: false, IPPoolUtil: 95},
+	})
+	if len(alerts) != 2 || alerts[0].Message != "interface is down" || alerts[1].Level != "warning" {
+		t.Errorf("unexpected alerts %+v", alerts)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The session tracker's polls also drive connection events: when a peer
+// comes online or goes away, PEER_EVENTS_WEBHOOK is POSTed a
+// peer.connected or peer.disconnected event with the client's name, its
+// endpoint and how long it was offline or connected. A peer counts as
+// connected once it handshaked within PEER_ONLINE_THRESHOLD, and only as
+// disconnected after PEER_EVENT_HYSTERESIS more without a handshake, so a
+// peer hovering around the threshold doesn't flap. The first poll after
+// startup only learns the states, so a restart doesn't announce every
+// connected peer again. Events are sent in order from a queue; when the
+// webhook can't keep up, new events are dropped and logged.
+
+const (
+	peerConnectedEvent    = "peer.connected"
+	peerDisconnectedEvent = "peer.disconnected"
+)
+
+// Events waiting for the webhook; the newest are dropped beyond this
+const peerEventQueueSize = 256
+
+// A peer connection state change
+type PeerEvent struct {
+	Event     string    `json:"event"`
+	Client    string    `json:"client,omitempty"`
+	PublicKey string    `json:"public_key"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	At        time.Time `json:"at"`
+	// For peer.connected how long the peer was offline, for
+	// peer.disconnected how long it was connected, up to its last
+	// handshake. Omitted when not known.
+	DurationSeconds int64 `json:"duration_seconds,omitempty"`
+}
+
+type peerConnState struct {
+	connected bool
+	// When the current connection started or the last one ended
+	since time.Time
+}
+
+type peerStateTracker struct {
+	mu     sync.Mutex
+	peers  map[string]*peerConnState // keyed by public key
+	seeded bool
+}
+
+var peerStates = newPeerStateTracker()
+
+var peerEventQueue chan PeerEvent
+
+func newPeerStateTracker() *peerStateTracker {
+	return &peerStateTracker{peers: make(map[string]*peerConnState)}
+}
+
+// Fold one dump snapshot into the connection states, returning the changes
+func (t *peerStateTracker) observe(peers []peerDump, now time.Time) []PeerEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var events []PeerEvent
+	present := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		present[peer.PublicKey] = true
+
+		var handshake time.Time
+		age := time.Duration(1<<63 - 1)
+		if peer.LatestHandshake > 0 {
+			handshake = time.Unix(peer.LatestHandshake, 0)
+			age = now.Sub(handshake)
+		}
+		endpoint := peer.Endpoint
+		if endpoint == "(none)" {
+			endpoint = ""
+		}
+		event := PeerEvent{PublicKey: peer.PublicKey, Endpoint: endpoint, At: now.UTC()}
+
+		state := t.peers[peer.PublicKey]
+		switch {
+		case state == nil:
+			state = &peerConnState{connected: age < PEER_ONLINE_THRESHOLD, since: handshake}
+			t.peers[peer.PublicKey] = state
+			// A new peer is announced once it connects; at startup nothing is
+			if state.connected && t.seeded {
+				event.Event = peerConnectedEvent
+				events = append(events, event)
+			}
+		case !state.connected && age < PEER_ONLINE_THRESHOLD:
+			if !state.since.IsZero() {
+				event.DurationSeconds = int64(handshake.Sub(state.since).Seconds())
+			}
+			state.connected, state.since = true, handshake
+			event.Event = peerConnectedEvent
+			events = append(events, event)
+		case state.connected && age >= PEER_ONLINE_THRESHOLD+PEER_EVENT_HYSTERESIS:
+			if !state.since.IsZero() && !handshake.IsZero() {
+				event.DurationSeconds = int64(handshake.Sub(state.since).Seconds())
+			}
+			state.connected, state.since = false, handshake
+			event.Event = peerDisconnectedEvent
+			events = append(events, event)
+		}
+	}
+
+	// Removed clients go without an event
+	for key := range t.peers {
+		if !present[key] {
+			delete(t.peers, key)
+		}
+	}
+	t.seeded = true
+	return events
+}
+
+// Name the clients and queue the events for the webhook
+func emitPeerEvents(events []PeerEvent) {
+	if peerEventQueue == nil {
+		return
+	}
+	for _, event := range events {
+		event.Client = findClientNameByPublicKey(event.PublicKey)
+		select {
+		case peerEventQueue <- event:
+		default:
+			log.Printf("Peer events: queue full, dropped %s of %s", event.Event, event.PublicKey)
+		}
+	}
+}
+
+// POST one event to PEER_EVENTS_WEBHOOK
+func sendPeerEvent(event PeerEvent) error {
+	return postWebhook(PEER_EVENTS_WEBHOOK, event)
+}
+
+// POST payload as JSON to a webhook, failing unless it answers 2xx
+func postWebhook(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Start sending the events when PEER_EVENTS_WEBHOOK is set. They come from
+// the session tracker's polls, so SESSION_POLL_INTERVAL has to be on too.
+func startPeerEvents() {
+	if PEER_EVENTS_WEBHOOK == "" {
+		return
+	}
+	if SESSION_POLL_INTERVAL <= 0 {
+		log.Printf("PEER_EVENTS_WEBHOOK is set but SESSION_POLL_INTERVAL is 0; no peer events will be sent")
+		return
+	}
+
+	queue := make(chan PeerEvent, peerEventQueueSize)
+	peerEventQueue = queue
+	go func() {
+		for event := range queue {
+			if err := sendPeerEvent(event); err != nil {
+				log.Printf("Peer events webhook: %s of %s: %v", event.Event, event.PublicKey, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPeerStateTransitions(t *testing.T) {
+	oldThreshold, oldHysteresis := PEER_ONLINE_THRESHOLD, PEER_EVENT_HYSTERESIS
+	t.Cleanup(func() { PEER_ONLINE_THRESHOLD, PEER_EVENT_HYSTERESIS = oldThreshold, oldHysteresis })
+	PEER_ONLINE_THRESHOLD, PEER_EVENT_HYSTERESIS = 3*time.Minute, time.Minute
+
+	tracker := newPeerStateTracker()
+	start := time.Unix(1700000000, 0)
+	at := func(offset time.Duration) int64 { return start.Add(offset).Unix() }
+	poll := func(now time.Duration, handshake int64) []PeerEvent {
+		return tracker.observe([]peerDump{{PublicKey: "pubA", Endpoint: "198.51.100.1:4000", LatestHandshake: handshake}}, start.Add(now))
+	}
+
+	// Startup only learns the state
+	if events := poll(0, at(-time.Minute)); len(events) != 0 {
+		t.Fatalf("first poll sent %+v", events)
+	}
+	// Past the threshold but within the hysteresis: still connected
+	if events := poll(2*time.Minute+30*time.Second, at(-time.Minute)); len(events) != 0 {
+		t.Errorf("disconnected within the hysteresis: %+v", events)
+	}
+	events := poll(5*time.Minute, at(-time.Minute))
+	if len(events) != 1 || events[0].Event != peerDisconnectedEvent || events[0].Endpoint != "198.51.100.1:4000" {
+		t.Fatalf("want a disconnect, got %+v", events)
+	}
+
+	// Back after ten minutes offline
+	events = poll(10*time.Minute, at(9*time.Minute))
+	if len(events) != 1 || events[0].Event != peerConnectedEvent || events[0].DurationSeconds != 600 {
+		t.Fatalf("want a connect after 600s offline, got %+v", events)
+	}
+	// Handshakes keep it connected; a disconnect reports how long it was
+	poll(12*time.Minute, at(11*time.Minute))
+	events = poll(20*time.Minute, at(14*time.Minute))
+	if len(events) != 1 || events[0].Event != peerDisconnectedEvent || events[0].DurationSeconds != 300 {
+		t.Errorf("want a disconnect after 300s connected, got %+v", events)
+	}
+
+	// A peer added later is announced once it connects
+	events = tracker.observe([]peerDump{{PublicKey: "pubB", Endpoint: "(none)"}}, start.Add(21*time.Minute))
+	if len(events) != 0 {
+		t.Errorf("peer that never handshaked: %+v", events)
+	}
+	events = tracker.observe([]peerDump{{PublicKey: "pubB", Endpoint: "192.0.2.9:5000", LatestHandshake: at(21 * time.Minute)}}, start.Add(22*time.Minute))
+	if len(events) != 1 || events[0].Event != peerConnectedEvent || events[0].DurationSeconds != 0 {
+		t.Errorf("new peer: %+v", events)
+	}
+}
+
+func TestPeerEventsWebhook(t *testing.T) {
+	env := setupTestEnv(t)
+	alice := addedClient(t, env, "alice")
+
+	received := make(chan PeerEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event PeerEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer webhook.Close()
+
+	oldURL, oldQueue := PEER_EVENTS_WEBHOOK, peerEventQueue
+	t.Cleanup(func() { PEER_EVENTS_WEBHOOK, peerEventQueue = oldURL, oldQueue })
+	PEER_EVENTS_WEBHOOK = webhook.URL
+	startPeerEvents()
+	defer close(peerEventQueue)
+
+	emitPeerEvents([]PeerEvent{{Event: peerConnectedEvent, PublicKey: alice.PublicKey, Endpoint: "198.51.100.1:4000", At: time.Now().UTC()}})
+	select {
+	case event := <-received:
+		if event.Event != peerConnectedEvent || event.Client != "alice" || event.Endpoint != "198.51.100.1:4000" {
+			t.Errorf("webhook got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't called")
+	}
+}
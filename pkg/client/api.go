@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// User is a WireGuard client as returned by the API
+type User struct {
+	Name      string `json:"name"`
+	IPV4      string `json:"ipv4,omitempty"`
+	IPV6      string `json:"ipv6,omitempty"`
+	PublicKey string `json:"public_key,omitempty"` // Set by AddUser
+	Config    string `json:"config,omitempty"`
+}
+
+// AddUserRequest creates one client. IPs are allocated when left empty.
+type AddUserRequest struct {
+	Name string `json:"name"`
+	IPV4 string `json:"ipv4,omitempty"`
+	IPV6 string `json:"ipv6,omitempty"`
+}
+
+// BulkUserResult is the outcome of one name in a bulk add
+type BulkUserResult struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	Code    string `json:"code,omitempty"`
+	IPV4    string `json:"ipv4,omitempty"`
+	IPV6    string `json:"ipv6,omitempty"`
+}
+
+// BulkResult summarizes a bulk add
+type BulkResult struct {
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Results []BulkUserResult `json:"results"`
+}
+
+// Stats is the summary returned by /api/v1/stats
+type Stats struct {
+	TotalClients  int `json:"total_clients"`
+	OnlineClients int `json:"online_clients"`
+	Transfer      struct {
+		RxBytes    int64 `json:"rx_bytes"`
+		TxBytes    int64 `json:"tx_bytes"`
+		TotalBytes int64 `json:"total_bytes"`
+	} `json:"transfer"`
+	IPPool struct {
+		Used        int     `json:"used"`
+		Size        int     `json:"size"`
+		Utilization float64 `json:"utilization"`
+	} `json:"ip_pool"`
+	ServiceActiveSince string `json:"service_active_since"`
+	APIUptimeSeconds   int64  `json:"api_uptime_seconds"`
+}
+
+// Session is one approximated connection session of a client
+type Session struct {
+	Endpoint       string    `json:"endpoint"`
+	FirstHandshake time.Time `json:"first_handshake"`
+	LastHandshake  time.Time `json:"last_handshake"`
+	RxBytes        int64     `json:"rx_bytes"`
+	TxBytes        int64     `json:"tx_bytes"`
+	Active         bool      `json:"active"`
+}
+
+// GeoInfo is the location of an endpoint, when the server has GeoIP
+type GeoInfo struct {
+	CountryCode string `json:"country_code,omitempty"`
+	Country     string `json:"country,omitempty"`
+	City        string `json:"city,omitempty"`
+}
+
+// EndpointChange is one entry of a client's endpoint log
+type EndpointChange struct {
+	IP        string    `json:"ip"`
+	Endpoint  string    `json:"endpoint"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Geo       *GeoInfo  `json:"geo,omitempty"`
+}
+
+// ListUsers returns every configured client including its config
+func (c *Client) ListUsers(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.do(ctx, http.MethodGet, "/api/v1/users", url.Values{"include": {"config"}}, nil, &users)
+	return users, err
+}
+
+// AddUser creates a client. Use IsConflict to detect an existing name.
+func (c *Client) AddUser(ctx context.Context, req AddUserRequest) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodPost, "/api/v1/users/add", nil, req, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// AddUsersBulk creates up to 500 clients with one config apply. When the
+// server reports a failure the per-name results are still returned
+// alongside the error, so callers can see what was written.
+func (c *Client) AddUsersBulk(ctx context.Context, names []string) (*BulkResult, error) {
+	var result BulkResult
+	err := c.do(ctx, http.MethodPost, "/api/v1/users/add-bulk", nil, map[string][]string{"names": names}, &result)
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && len(apiErr.Data) > 0 {
+		if json.Unmarshal(apiErr.Data, &result) == nil {
+			return &result, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeleteUser removes a client
+func (c *Client) DeleteUser(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/users/delete", nil, map[string]string{"name": name}, nil)
+}
+
+// DeleteAllUsers removes every client
+func (c *Client) DeleteAllUsers(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/users/delete-all", nil, nil, nil)
+}
+
+// Status returns the full server status. The payload is large and loosely
+// structured, so it is returned as a map. refresh bypasses the server's
+// status cache.
+func (c *Client) Status(ctx context.Context, refresh bool) (map[string]interface{}, error) {
+	query := url.Values{}
+	if refresh {
+		query.Set("refresh", "true")
+	}
+
+	var status map[string]interface{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/status", query, nil, &status)
+	return status, err
+}
+
+// Stats returns the summary statistics
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	query := url.Values{"format": {"raw"}}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/stats", query, nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Sessions returns a client's connection sessions, newest first
+func (c *Client) Sessions(ctx context.Context, name string) ([]Session, error) {
+	var data struct {
+		Sessions []Session `json:"sessions"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/users/"+url.PathEscape(name)+"/sessions", nil, nil, &data)
+	return data.Sessions, err
+}
+
+// Endpoints returns the endpoint IPs a client connected from, newest first
+func (c *Client) Endpoints(ctx context.Context, name string) ([]EndpointChange, error) {
+	var data struct {
+		Endpoints []EndpointChange `json:"endpoints"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/users/"+url.PathEscape(name)+"/endpoints", nil, nil, &data)
+	return data.Endpoints, err
+}
+
+// Start starts the VPN service
+func (c *Client) Start(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/start", nil, nil, nil)
+}
+
+// Stop stops the VPN service
+func (c *Client) Stop(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/stop", nil, nil, nil)
+}
+
+// Restart restarts the VPN service
+func (c *Client) Restart(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/restart", nil, nil, nil)
+}
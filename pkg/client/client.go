@@ -0,0 +1,221 @@
+// Package client is a Go client for the WireGuard API.
+//
+//	c := client.New("http://10.0.0.1:8080", os.Getenv("WG_API_TOKEN"))
+//	user, err := c.AddUser(ctx, client.AddUserRequest{Name: "alice"})
+//
+// Every method returns an *APIError when the server answers with a
+// non-2xx status. Note that the server masks authentication failures as
+// 404, so a bad token looks like a missing route; see APIError.NotFound.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to one WireGuard API server. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http.Client (30s timeout)
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithRetries sets how many times a request is retried and the initial
+// backoff, which doubles per attempt. Only read-only requests are retried,
+// on network errors and 429/502/503/504 responses. Default: 2 retries,
+// 500ms backoff.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// New creates a client for the server at baseURL (e.g. "http://host:8080")
+// authenticating with the API token.
+func New(baseURL, token string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		retries:    2,
+		backoff:    500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// APIError is returned for any non-2xx response
+type APIError struct {
+	StatusCode int
+	Message    string
+	// Machine-readable cause such as NAME_TAKEN or SYNC_FAILED; stable
+	// across releases, unlike the message
+	Code string
+	// The invalid fields of a 422
+	Errors []FieldError
+	// Raw data of the response envelope, e.g. per-name results of a
+	// failed bulk add
+	Data json.RawMessage
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("wireguard api: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("wireguard api: status %d: %s", e.StatusCode, e.Message)
+}
+
+// NotFound reports a 404. With an empty message this usually means the
+// token was rejected, since the server hides auth failures behind 404.
+func (e *APIError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409, e.g. adding an existing client
+func IsConflict(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// FieldError names one invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Response envelope shared by every endpoint
+type envelope struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Code    string          `json:"code"`
+	Errors  []FieldError    `json:"errors"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Perform a request and decode the envelope's data into out (if non-nil)
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("wireguard api: encoding request: %v", err)
+		}
+	}
+
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	attempts := 1
+	if method == http.MethodGet {
+		attempts += c.retries
+	}
+
+	backoff := c.backoff
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		env, status, err := c.roundTrip(ctx, method, target, payload)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if status < 200 || status > 299 {
+			lastErr = &APIError{StatusCode: status, Message: env.Message, Code: env.Code, Errors: env.Errors, Data: env.Data}
+			if retryableStatus(status) {
+				continue
+			}
+			return lastErr
+		}
+
+		if out != nil && len(env.Data) > 0 {
+			if err := json.Unmarshal(env.Data, out); err != nil {
+				return fmt.Errorf("wireguard api: decoding response: %v", err)
+			}
+		}
+		return nil
+	}
+
+	return lastErr
+}
+
+func (c *Client) roundTrip(ctx context.Context, method, target string, payload []byte) (envelope, int, error) {
+	var env envelope
+
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return env, 0, fmt.Errorf("wireguard api: building request: %v", err)
+	}
+	req.Header.Set("key", c.token)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return env, 0, fmt.Errorf("wireguard api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return env, 0, fmt.Errorf("wireguard api: reading response: %v", err)
+	}
+	// Auth failures and some errors come back with an empty or non-JSON
+	// body; the status code alone still tells the caller what happened
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &env); err != nil && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return env, 0, fmt.Errorf("wireguard api: decoding response: %v", err)
+		}
+	}
+
+	return env, resp.StatusCode, nil
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
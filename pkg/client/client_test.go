@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeEnvelope(w http.ResponseWriter, status int, success bool, message string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": success, "message": message, "data": data})
+}
+
+func TestAddUserSendsTokenAndDecodesData(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("key") != "secret" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/users/add" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+
+		var req AddUserRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		writeEnvelope(w, http.StatusOK, true, "Client added successfully", User{Name: req.Name, IPV4: "10.66.0.2"})
+	}))
+	defer server.Close()
+
+	user, err := New(server.URL, "secret").AddUser(context.Background(), AddUserRequest{Name: "alice"})
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if user.Name != "alice" || user.IPV4 != "10.66.0.2" {
+		t.Errorf("got %+v", user)
+	}
+
+	_, err = New(server.URL, "wrong").AddUser(context.Background(), AddUserRequest{Name: "alice"})
+	apiErr, ok := err.(*APIError)
+	if !ok || !apiErr.NotFound() {
+		t.Errorf("bad token must surface as a 404 APIError, got %v", err)
+	}
+}
+
+func TestConflictIsDetectable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"success":false,"message":"A client with this name already exists","code":"NAME_TAKEN"}`))
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, "t").AddUser(context.Background(), AddUserRequest{Name: "alice"})
+	if !IsConflict(err) {
+		t.Errorf("expected a conflict error, got %v", err)
+	}
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Code != "NAME_TAKEN" {
+		t.Errorf("expected the error code, got %#v", err)
+	}
+}
+
+func TestGetRetriedOnUnavailable(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			writeEnvelope(w, http.StatusServiceUnavailable, false, "busy", nil)
+			return
+		}
+		writeEnvelope(w, http.StatusOK, true, "", []User{{Name: "alice"}})
+	}))
+	defer server.Close()
+
+	c := New(server.URL, "t", WithRetries(2, time.Millisecond))
+	users, err := c.ListUsers(context.Background())
+	if err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	if len(users) != 1 || atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("got %d users after %d calls, want 1 user after 3 calls", len(users), calls)
+	}
+}
+
+func TestMutationsAreNotRetried(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		writeEnvelope(w, http.StatusServiceUnavailable, false, "busy", nil)
+	}))
+	defer server.Close()
+
+	c := New(server.URL, "t", WithRetries(3, time.Millisecond))
+	if err := c.DeleteUser(context.Background(), "alice"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("non-idempotent request sent %d times, want 1", got)
+	}
+}
+
+func TestAddUsersBulkReturnsResultsOnFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeEnvelope(w, http.StatusInternalServerError, false, "created 2 clients but failed to apply config", BulkResult{
+			Created: 2,
+			Results: []BulkUserResult{{Name: "a", Success: true}, {Name: "b", Success: true}},
+		})
+	}))
+	defer server.Close()
+
+	result, err := New(server.URL, "t").AddUsersBulk(context.Background(), []string{"a", "b"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if result == nil || result.Created != 2 || len(result.Results) != 2 {
+		t.Errorf("per-name results must be returned with the error, got %+v", result)
+	}
+}
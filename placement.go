@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Placement policies for new clients
+const (
+	placementByPeers    = "peers"
+	placementByTransfer = "transfer"
+)
+
+type PlaceUserRequest struct {
+	AddUserRequest
+	// Overrides PLACEMENT_POLICY for this request
+	Policy string `json:"policy"`
+}
+
+// A client added through placement, with the server it landed on
+type PlacedClient struct {
+	Node string `json:"node"`
+	Client
+}
+
+// How busy a server is, and whether it already has the client
+type nodeLoad struct {
+	peers     int
+	transfer  int64
+	hasClient bool
+}
+
+// A server new clients can be placed on: this one or a remote node
+type placementHost interface {
+	load(clientName string) (nodeLoad, error)
+	// A nil presharedKey follows the server's setting
+	addClient(name, ipv4, ipv6 string, presharedKey *bool) (Client, error)
+}
+
+func (localHost) load(clientName string) (nodeLoad, error) {
+	stats, err := collectSummaryStats()
+	if err != nil {
+		return nodeLoad{}, err
+	}
+	exists, err := clientExists(clientName)
+	if err != nil {
+		return nodeLoad{}, err
+	}
+	return nodeLoad{peers: stats.TotalClients, transfer: stats.TransferRx + stats.TransferTx, hasClient: exists}, nil
+}
+
+func (localHost) addClient(name, ipv4, ipv6 string, presharedKey *bool) (Client, error) {
+	config, ipv4, ipv6, err := addTenantClient(nil, name, ipv4, ipv6, nil, "", presharedKeyFor(presharedKey, CLIENT_PRESHARED_KEYS))
+	if err != nil {
+		return Client{}, err
+	}
+	return Client{Name: name, IPV4: ipv4, IPV6: ipv6, Config: config}, nil
+}
+
+func (n *remoteNode) load(clientName string) (nodeLoad, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	params, _, config, err := n.loadState()
+	if err != nil {
+		return nodeLoad{}, err
+	}
+
+	var load nodeLoad
+	load.peers = len(regexp.MustCompile(`(?m)^### Client (.+)$`).FindAll(config, -1))
+	load.hasClient = regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(clientName) + `$`).Match(config)
+
+	// A stopped interface just has no traffic, as locally
+	if dump, err := n.run(nil, n.wgCmd()+" show "+shellQuote(params.ServerWGNIC)+" dump"); err == nil {
+		for _, peer := range parseWGDump(dump) {
+			load.transfer += peer.TransferRx + peer.TransferTx
+		}
+	}
+	return load, nil
+}
+
+// Pick the least loaded server for a new client. Unreachable nodes are left
+// out; ties go to this server, then to nodes in name order. Returns
+// errClientExists when any reachable server already has the name, so names
+// stay unique across the fleet.
+func placeClient(name, policy string) (string, placementHost, error) {
+	names := []string{localNodeName}
+	nodesMutex.RLock()
+	remote := make([]string, 0, len(nodes))
+	for nodeName := range nodes {
+		remote = append(remote, nodeName)
+	}
+	nodesMutex.RUnlock()
+	sort.Strings(remote)
+	names = append(names, remote...)
+
+	var bestName string
+	var best placementHost
+	var bestLoad int64
+	for _, nodeName := range names {
+		host, ok := migrationHostByName(nodeName).(placementHost)
+		if !ok {
+			continue
+		}
+		load, err := host.load(name)
+		if err != nil {
+			log.Printf("Placement: skipping node %s: %v", nodeName, err)
+			continue
+		}
+		if load.hasClient {
+			return "", nil, errClientExists
+		}
+
+		value := int64(load.peers)
+		if policy == placementByTransfer {
+			value = load.transfer
+		}
+		if best == nil || value < bestLoad {
+			bestName, best, bestLoad = nodeName, host, value
+		}
+	}
+
+	if best == nil {
+		return "", nil, fmt.Errorf("no node is reachable")
+	}
+	return bestName, best, nil
+}
+
+// Handler adding a client on whichever server is least loaded
+func placeUserHandlerGin(c *gin.Context) {
+	var req PlaceUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !validClientName(req.Name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Client name " + clientNameMessage(),
+			Code:    codeInvalidName,
+		})
+		return
+	}
+	if err := req.validateFields(); err != nil {
+		respondValidationError(c, err)
+		return
+	}
+
+	policy := req.Policy
+	if policy == "" {
+		policy = PLACEMENT_POLICY
+	}
+	if policy != placementByPeers && policy != placementByTransfer {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("policy must be %s or %s", placementByPeers, placementByTransfer),
+		})
+		return
+	}
+
+	if !reserveCreates(c, 1) {
+		return
+	}
+
+	nodeName, host, err := placeClient(req.Name, policy)
+	if err != nil {
+		releaseCreates(c, 1)
+	}
+	if errors.Is(err, errClientExists) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: clientExistsMessage,
+			Code:    codeNameTaken,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	client, err := host.addClient(req.Name, req.IPV4, req.IPV6, req.PresharedKey)
+	if err != nil {
+		releaseCreates(c, 1)
+	}
+	if errors.Is(err, errClientExists) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: clientExistsMessage,
+			Code:    codeNameTaken,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("failed to add client on %s: %v", nodeName, err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Client added on " + nodeName,
+		Data:    PlacedClient{Node: nodeName, Client: client},
+	})
+}
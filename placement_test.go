@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPlaceUserOnLeastLoadedNode(t *testing.T) {
+	env := setupTestEnv(t)
+	node := setupFakeNode(t, env)
+
+	place := func(req PlaceUserRequest) (int, PlacedClient) {
+		recorder := env.authedRequest(t, http.MethodPost, "/api/v1/nodes/users/add", req)
+		var resp struct {
+			Data PlacedClient `json:"data"`
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &resp)
+		return recorder.Code, resp.Data
+	}
+
+	// Both servers are empty, so the tie goes to this one
+	code, placed := place(PlaceUserRequest{AddUserRequest: AddUserRequest{Name: "alice"}})
+	if code != http.StatusOK || placed.Node != localNodeName || placed.IPV4 != "10.66.0.2" {
+		t.Fatalf("got status %d, %+v", code, placed)
+	}
+
+	code, placed = place(PlaceUserRequest{AddUserRequest: AddUserRequest{Name: "bob"}})
+	if code != http.StatusOK || placed.Node != "fra1" || placed.IPV4 != "10.77.0.2" {
+		t.Fatalf("got status %d, %+v", code, placed)
+	}
+	config, _ := os.ReadFile(node.configFile)
+	if !strings.Contains(string(config), "### Client bob") {
+		t.Errorf("bob not added on the node:\n%s", config)
+	}
+
+	// Names are unique across the fleet
+	if code, _ := place(PlaceUserRequest{AddUserRequest: AddUserRequest{Name: "bob"}}); code != http.StatusConflict {
+		t.Errorf("duplicate name: got status %d, want 409", code)
+	}
+
+	if code, _ := place(PlaceUserRequest{AddUserRequest: AddUserRequest{Name: "carol"}, Policy: "random"}); code != http.StatusBadRequest {
+		t.Errorf("unknown policy: got status %d, want 400", code)
+	}
+}
+
+func TestPlaceUserSkipsUnreachableNodes(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeNode(t, env)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+
+	// Every ssh call fails
+	if err := os.WriteFile(sshCmd, []byte("#!/bin/bash\necho unreachable >&2\nexit 255\n"), 0755); err != nil {
+		t.Fatalf("writing ssh: %v", err)
+	}
+
+	recorder := env.authedRequest(t, http.MethodPost, "/api/v1/nodes/users/add", PlaceUserRequest{AddUserRequest: AddUserRequest{Name: "bob"}})
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"node":"local"`) {
+		t.Errorf("got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The self-service portal lets end users manage their own devices without
+// the admin API_TOKEN. An admin creates a portal user owning some clients
+// and hands out the token issued for it; with it the user can list those
+// clients, download their configs and QR codes, and rotate their keys, and
+// nothing else. Clients the user doesn't own are reported as not found, so
+// the portal doesn't reveal which names exist. Only a SHA-256 of each token
+// is stored, so a lost token is replaced, not recovered.
+
+// Overridable in tests
+var qrencodeCmd = "qrencode"
+
+// A portal user and the clients they own
+type PortalUser struct {
+	Name    string   `json:"name"`
+	Clients []string `json:"clients"`
+}
+
+// A PortalUser as stored in PORTAL_USERS_FILE
+type portalUserRecord struct {
+	PortalUser
+	TokenHash string `json:"token_hash"`
+}
+
+// Create or update portal user request
+type PortalUserRequest struct {
+	Name    string   `json:"name"`
+	Clients []string `json:"clients"`
+	// Issue a new token, invalidating the old one; new users always get one
+	ResetToken bool `json:"reset_token,omitempty"`
+}
+
+var (
+	portalMutex sync.Mutex
+
+	portalUserNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.@-]{1,64}$`)
+)
+
+// PORTAL_USERS_FILE, or portal-users.json next to the server config
+func portalUsersFile() string {
+	if PORTAL_USERS_FILE != "" {
+		return PORTAL_USERS_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "portal-users.json")
+}
+
+// Portal users by name. Caller holds portalMutex.
+func loadPortalUsersLocked() (map[string]*portalUserRecord, error) {
+	users := make(map[string]*portalUserRecord)
+	content, err := os.ReadFile(portalUsersFile())
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read portal users file: %v", err)
+	}
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse portal users file: %v", err)
+	}
+	return users, nil
+}
+
+// Caller holds portalMutex
+func savePortalUsersLocked(users map[string]*portalUserRecord) error {
+	content, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(portalUsersFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write portal users file: %v", err)
+	}
+	return nil
+}
+
+func hashPortalToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether the user owns the client
+func (u *PortalUser) owns(name string) bool {
+	for _, client := range u.Clients {
+		if client == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the portal user by "Authorization: Bearer <token>"
+func portalAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, APIResponse{
+				Success: false,
+				Message: "Unauthorized",
+			})
+			return
+		}
+
+		portalMutex.Lock()
+		users, err := loadPortalUsersLocked()
+		portalMutex.Unlock()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+
+		// Comparing hashes, so the lookup leaks nothing about the tokens
+		hash := hashPortalToken(token)
+		for _, user := range users {
+			if user.TokenHash == hash {
+				c.Set("portalUser", &user.PortalUser)
+				setActedBy(c, "portal:"+user.Name)
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, APIResponse{
+			Success: false,
+			Message: "Unauthorized",
+		})
+	}
+}
+
+func portalUserFrom(c *gin.Context) *PortalUser {
+	return c.MustGet("portalUser").(*PortalUser)
+}
+
+func registerPortalRoutes(router *gin.Engine) {
+	portal := router.Group("/portal/v1", portalAuthMiddleware(), auditMiddleware(), changesAllowedMiddleware())
+	portal.GET("/devices", portalDevicesHandlerGin)
+	portal.GET("/devices/:name/config", portalDeviceConfigHandlerGin)
+	portal.GET("/devices/:name/qr", portalDeviceQRHandlerGin)
+	portal.POST("/devices/:name/rotate-keys", portalRotateKeysHandlerGin)
+}
+
+// Path of a client's config file, empty when it has none
+func clientConfigFile(name string) string {
+	for _, path := range []string{
+		filepath.Join(WIREGUARD_CLIENTS, wgParams.ServerWGNIC+"-client-"+clientFileName(name)+".conf"),
+		filepath.Join(WIREGUARD_CLIENTS, "wg0-client-"+clientFileName(name)+".conf"),
+		filepath.Join(WIREGUARD_CLIENTS, clientFileName(name)+".conf"),
+	} {
+		if fileExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// The config of a client the portal user owns
+func portalDeviceConfig(c *gin.Context) ([]byte, bool) {
+	name := c.Param("name")
+	path := ""
+	if portalUserFrom(c).owns(name) {
+		path = clientConfigFile(name)
+	}
+	if path == "" {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Device not found",
+		})
+		return nil, false
+	}
+
+	config, err := os.ReadFile(path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("failed to read client config: %v", err),
+		})
+		return nil, false
+	}
+	// The user now has the config a scheduled rotation replaced
+	if err := markKeysRedistributed(name); err != nil && err != errClientNotFound {
+		log.Printf("Key rotation: %s: %v", name, err)
+	}
+	return config, true
+}
+
+// Handler listing the portal user's devices, without their configs
+func portalDevicesHandlerGin(c *gin.Context) {
+	clients, err := listWireGuardClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	user := portalUserFrom(c)
+	devices := []Client{}
+	for _, client := range clients {
+		if user.owns(client.Name) {
+			client.Config = ""
+			devices = append(devices, client)
+		}
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    devices,
+	})
+}
+
+// Handler downloading a device's config file
+func portalDeviceConfigHandlerGin(c *gin.Context) {
+	config, ok := portalDeviceConfig(c)
+	if !ok {
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.conf"`, clientFileName(c.Param("name"))))
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", config)
+}
+
+// Handler rendering a device's config as a QR code PNG for the mobile apps
+func portalDeviceQRHandlerGin(c *gin.Context) {
+	config, ok := portalDeviceConfig(c)
+	if !ok {
+		return
+	}
+
+	png, err := renderQRCode(config)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// A config as a QR code PNG
+func renderQRCode(config []byte) ([]byte, error) {
+	// The config goes in on stdin; as an argument it would show up in ps
+	cmd := exec.Command(qrencodeCmd, "-t", "PNG", "-o", "-")
+	cmd.Stdin = bytes.NewReader(config)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("qrencode failed: %v, stderr: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// Handler replacing a device's keys; the old config stops working
+func portalRotateKeysHandlerGin(c *gin.Context) {
+	name := c.Param("name")
+	if !portalUserFrom(c).owns(name) {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Device not found",
+		})
+		return
+	}
+
+	config, err := rotateClientKeys(name)
+	if err == errClientNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Device not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	if err := markKeysRotated([]string{name}, time.Now(), false); err != nil {
+		log.Printf("Key rotation: %s: %v", name, err)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Keys rotated; import the new config",
+		Data:    Client{Name: name, Config: config},
+	})
+}
+
+// Replace a client's private, public and preshared keys in place. Its
+// addresses, routed subnets, DNS and kill switch stay, and a disabled
+// client stays disabled. Returns the new client config.
+func rotateClientKeys(name string) (string, error) {
+	keys, err := generateClientKeys()
+	if err != nil {
+		return "", err
+	}
+	return replaceClientKeys(name, keys)
+}
+
+// Write keys into the client's server block and config and sync. Without a
+// private key only the preshared key is replaced, and added where the
+// client had none; with one, a client without a preshared key keeps
+// having none.
+func replaceClientKeys(name string, keys clientKeys) (string, error) {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	config, err := replaceClientKeysLocked(name, keys)
+	if err != nil {
+		return "", err
+	}
+	if err := syncWireGuardConf(); err != nil {
+		return "", fmt.Errorf("failed to sync WireGuard config: %w", err)
+	}
+	return config, nil
+}
+
+// replaceClientKeys without the sync, for rotating many clients at once.
+// Caller holds wgConfigMutex.
+func replaceClientKeysLocked(name string, keys clientKeys) (string, error) {
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return "", fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	path := clientConfigFile(name)
+	blockRegex := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(name) + `\n.*?^$`)
+	loc := blockRegex.FindIndex(content)
+	if loc == nil || path == "" {
+		return "", errClientNotFound
+	}
+	config, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read client config: %v", err)
+	}
+
+	// The server's block may be commented out by disable.go
+	block := content[loc[0]:loc[1]]
+	publicKeyRegex := regexp.MustCompile(`(?m)^(#?)PublicKey = .*$`)
+	presharedKeyRegex := regexp.MustCompile(`(?m)^(#?)PresharedKey = .*$`)
+	if keys.privateKey != "" {
+		block = publicKeyRegex.ReplaceAll(block, []byte("${1}PublicKey = "+keys.publicKey))
+		config = regexp.MustCompile(`(?m)^PrivateKey = .*$`).ReplaceAll(config, []byte("PrivateKey = "+keys.privateKey))
+	}
+	// A new key pair keeps a client created without a preshared key without one
+	if presharedKeyRegex.Match(block) || keys.privateKey == "" {
+		if presharedKeyRegex.Match(block) {
+			block = presharedKeyRegex.ReplaceAll(block, []byte("${1}PresharedKey = "+keys.preSharedKey))
+		} else {
+			block = publicKeyRegex.ReplaceAll(block, []byte("${0}\n${1}PresharedKey = "+keys.preSharedKey))
+		}
+		if presharedKeyRegex.Match(config) {
+			config = presharedKeyRegex.ReplaceAll(config, []byte("PresharedKey = "+keys.preSharedKey))
+		} else {
+			config = publicKeyRegex.ReplaceAll(config, []byte("${0}\nPresharedKey = "+keys.preSharedKey))
+		}
+	}
+	updated := append([]byte{}, content[:loc[0]]...)
+	updated = append(updated, block...)
+	updated = append(updated, content[loc[1]:]...)
+
+	if err := os.WriteFile(WG_CONFIG_FILE, updated, 0600); err != nil {
+		return "", fmt.Errorf("failed to update server config: %v", err)
+	}
+	if err := os.WriteFile(path, config, 0600); err != nil {
+		// Keep the old keys working rather than leave the two files disagreeing
+		os.WriteFile(WG_CONFIG_FILE, content, 0600)
+		return "", fmt.Errorf("failed to write client config: %v", err)
+	}
+	recordChange(changeClientUpdated, name, "keys")
+	return string(config), nil
+}
+
+// Handler listing the portal users and their clients
+func listPortalUsersHandlerGin(c *gin.Context) {
+	portalMutex.Lock()
+	users, err := loadPortalUsersLocked()
+	portalMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	list := make([]PortalUser, 0, len(users))
+	for _, user := range users {
+		list = append(list, user.PortalUser)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// Handler creating a portal user or replacing their clients. The token is
+// only in the response when one was issued.
+func setPortalUserHandlerGin(c *gin.Context) {
+	var req PortalUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !portalUserNameRegex.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Portal user name must be 1-64 letters, digits, '.', '@', '_' or '-'",
+		})
+		return
+	}
+	if req.Clients == nil {
+		req.Clients = []string{}
+	}
+	for _, client := range req.Clients {
+		exists, err := clientExists(client)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Client %s not found", client),
+			})
+			return
+		}
+	}
+
+	portalMutex.Lock()
+	defer portalMutex.Unlock()
+
+	users, err := loadPortalUsersLocked()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	user := users[req.Name]
+	token := ""
+	if user == nil || req.ResetToken {
+		if token, err = randomHex(32); err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+	}
+	if user == nil {
+		user = &portalUserRecord{}
+		users[req.Name] = user
+	}
+	user.PortalUser = PortalUser{Name: req.Name, Clients: req.Clients}
+	if token != "" {
+		user.TokenHash = hashPortalToken(token)
+	}
+	if err := savePortalUsersLocked(users); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	data := gin.H{"name": user.Name, "clients": user.Clients}
+	if token != "" {
+		data["token"] = token
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    data,
+	})
+}
+
+// Handler deleting a portal user; their clients stay
+func deletePortalUserHandlerGin(c *gin.Context) {
+	var req PortalUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Name == "" {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Invalid request payload",
+		})
+		return
+	}
+
+	portalMutex.Lock()
+	defer portalMutex.Unlock()
+
+	users, err := loadPortalUsersLocked()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	if users[req.Name] == nil {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Portal user not found",
+		})
+		return
+	}
+	delete(users, req.Name)
+	if err := savePortalUsersLocked(users); err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Portal user deleted",
+	})
+}
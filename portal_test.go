@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func portalRequest(t *testing.T, env *testEnv, method, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	env.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// Create alice and bob and a portal user owning alice; returns its token
+func setupPortalUser(t *testing.T, env *testEnv) string {
+	t.Helper()
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/portal-users", PortalUserRequest{Name: "alice@example.com", Clients: []string{"alice"}})
+	var resp struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Data.Token == "" {
+		t.Fatalf("creating portal user: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	return resp.Data.Token
+}
+
+func TestPortalOnlyShowsOwnDevices(t *testing.T) {
+	env := setupTestEnv(t)
+	token := setupPortalUser(t, env)
+
+	body := portalRequest(t, env, http.MethodGet, "/portal/v1/devices", token).Body.String()
+	if !strings.Contains(body, `"name":"alice"`) || strings.Contains(body, "bob") || strings.Contains(body, "PrivateKey") {
+		t.Errorf("devices must list alice only, without configs: %s", body)
+	}
+
+	rec := portalRequest(t, env, http.MethodGet, "/portal/v1/devices/alice/config", token)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "[Interface]\nPrivateKey = ") {
+		t.Errorf("alice's config: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, path := range []string{"/portal/v1/devices/bob/config", "/portal/v1/devices/bob/qr", "/portal/v1/devices/nobody/config"} {
+		if code := portalRequest(t, env, http.MethodGet, path, token).Code; code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want 404", path, code)
+		}
+	}
+	if code := portalRequest(t, env, http.MethodPost, "/portal/v1/devices/bob/rotate-keys", token).Code; code != http.StatusNotFound {
+		t.Errorf("rotating bob's keys: got status %d, want 404", code)
+	}
+
+	// The portal token is no API token
+	if code := portalRequest(t, env, http.MethodGet, "/portal/v1/devices", "test-token").Code; code != http.StatusUnauthorized {
+		t.Errorf("API token on the portal: got status %d, want 401", code)
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/users", nil)
+	req.Header.Set("key", token)
+	env.router.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK {
+		t.Error("portal token must not open the API")
+	}
+
+	// Resetting the token locks out the old one
+	env.authedRequest(t, http.MethodPost, "/api/v1/portal-users", PortalUserRequest{Name: "alice@example.com", Clients: []string{"alice"}, ResetToken: true})
+	if code := portalRequest(t, env, http.MethodGet, "/portal/v1/devices", token).Code; code != http.StatusUnauthorized {
+		t.Errorf("old token after reset: got status %d, want 401", code)
+	}
+	if body := env.authedRequest(t, http.MethodGet, "/api/v1/portal-users", nil).Body.String(); strings.Contains(body, "token") {
+		t.Errorf("listing must not show token hashes: %s", body)
+	}
+}
+
+func TestPortalQRCode(t *testing.T) {
+	env := setupTestEnv(t)
+	token := setupPortalUser(t, env)
+
+	script := filepath.Join(env.dir, "qrencode")
+	os.WriteFile(script, []byte("#!/bin/bash\nprintf 'PNG:%s:' \"$*\"\ncat\n"), 0755)
+	oldCmd := qrencodeCmd
+	qrencodeCmd = script
+	t.Cleanup(func() { qrencodeCmd = oldCmd })
+
+	rec := portalRequest(t, env, http.MethodGet, "/portal/v1/devices/alice/qr", token)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" ||
+		!strings.HasPrefix(rec.Body.String(), "PNG:-t PNG -o -:[Interface]\nPrivateKey = ") {
+		t.Errorf("QR code: got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPortalRotateKeys(t *testing.T) {
+	env := setupTestEnv(t)
+	token := setupPortalUser(t, env)
+	if err := setClientActive("alice", false); err != nil {
+		t.Fatalf("disabling alice: %v", err)
+	}
+	before := env.configContent(t)
+
+	rec := portalRequest(t, env, http.MethodPost, "/portal/v1/devices/alice/rotate-keys", token)
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	privateKey := regexp.MustCompile(`(?m)^PrivateKey = (.*)$`).FindStringSubmatch(resp.Data.Config)
+	psk := regexp.MustCompile(`(?m)^PresharedKey = (.*)$`).FindStringSubmatch(resp.Data.Config)
+	after := env.configContent(t)
+	if privateKey == nil || psk == nil || !strings.Contains(after, "PublicKey = pub-"+privateKey[1]+"\n") || !strings.Contains(after, "PresharedKey = "+psk[1]+"\n") {
+		t.Fatalf("server config must have the new keys:\n%s\nclient:\n%s", after, resp.Data.Config)
+	}
+	if strings.Contains(before, privateKey[1]) {
+		t.Error("keys must change")
+	}
+	if !strings.Contains(resp.Data.Config, "Address = 10.66.0.2/32") {
+		t.Errorf("address must stay:\n%s", resp.Data.Config)
+	}
+
+	// bob is untouched, alice stays disabled
+	bobBlock := regexp.MustCompile(`(?ms)^### Client bob\n.*?^$`)
+	if bobBlock.FindString(before) != bobBlock.FindString(after) {
+		t.Error("bob's peer must not change")
+	}
+	if !strings.Contains(after, "### Client alice\n#[Peer]\n#PublicKey = pub-"+privateKey[1]) {
+		t.Errorf("alice must stay disabled:\n%s", after)
+	}
+	config := portalRequest(t, env, http.MethodGet, "/portal/v1/devices/alice/config", token).Body.String()
+	if config != resp.Data.Config {
+		t.Errorf("downloaded config must be the rotated one:\n%s", config)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// "It's up but nobody can connect" mostly means the WireGuard port is
+// blocked on the way in, which the server can't see from the inside: the
+// kernel drops unauthenticated packets silently, so a UDP probe gets no
+// answer either way. POST /server/port-check asks from the outside instead:
+//
+//   - with {"node": "fra1"}, a node of NODES_CONFIG does a real handshake.
+//     It brings up a throwaway interface with a fresh key, the server gets
+//     that key as a temporary peer without addresses, and the port is
+//     reachable when the handshake completes. Needs wg and ip on the node.
+//   - otherwise PORT_CHECK_URL is POSTed {"host", "port", "protocol": "udp"}
+//     and answers {"reachable": bool, "message": string}.
+
+// How long the node waits for a handshake
+const portCheckHandshakeWait = 10
+
+// Port check request; the body is optional
+type PortCheckRequest struct {
+	// Node of NODES_CONFIG to check from; PORT_CHECK_URL when empty
+	Node string `json:"node"`
+}
+
+// Whether the server's port answered from the outside
+type PortCheckResult struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+	// "node" or "service"
+	Via       string    `json:"via"`
+	Node      string    `json:"node,omitempty"`
+	Reachable bool      `json:"reachable"`
+	Message   string    `json:"message,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// The server's endpoint as clients dial it
+func serverEndpoint(params WGParams) string {
+	host := params.ServerPubIP
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	return host + ":" + params.ServerPort
+}
+
+// Handshake with the server from the node
+func checkPortFromNode(node *remoteNode, result *PortCheckResult) error {
+	if backendType != "wireguard" {
+		return errors.New("handshakes from a node need the wireguard backend")
+	}
+	privateKey, err := generatePrivateKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate private key: %v", err)
+	}
+	publicKey, err := derivePublicKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to derive public key: %v", err)
+	}
+	suffix, err := randomHex(3)
+	if err != nil {
+		return err
+	}
+
+	// A sync would drop the temporary peer mid-check
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	if status, output := executeCommand(wgCmd, "set", wgParams.ServerWGNIC, "peer", publicKey); status != "success" {
+		return fmt.Errorf("failed to add the probe peer: %s", output)
+	}
+	defer executeCommand(wgCmd, "set", wgParams.ServerWGNIC, "peer", publicKey, "remove")
+
+	iface := shellQuote("wgprobe" + suffix)
+	script := fmt.Sprintf(`ip link add %[1]s type wireguard || exit 1
+trap 'ip link del %[1]s' EXIT
+wg set %[1]s private-key /dev/stdin peer %[2]s endpoint %[3]s persistent-keepalive 1 || exit 1
+ip link set %[1]s up || exit 1
+for i in $(seq %[4]d); do
+  sleep 1
+  if wg show %[1]s latest-handshakes | awk '$2 != 0 {found = 1} END {exit !found}'; then echo reachable; exit 0; fi
+done
+echo unreachable`, iface, shellQuote(wgParams.ServerPubKey), shellQuote(serverEndpoint(wgParams)), portCheckHandshakeWait)
+
+	output, err := node.run([]byte(privateKey), script)
+	if err != nil {
+		return err
+	}
+	result.Reachable = strings.TrimSpace(output) == "reachable"
+	if result.Reachable {
+		result.Message = fmt.Sprintf("%s completed a handshake", node.Name)
+	} else {
+		result.Message = fmt.Sprintf("%s got no handshake within %ds", node.Name, portCheckHandshakeWait)
+	}
+	return nil
+}
+
+// Ask PORT_CHECK_URL whether the port is reachable
+func checkPortFromService(result *PortCheckResult) error {
+	body, err := json.Marshal(map[string]string{"host": result.Host, "port": result.Port, "protocol": "udp"})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(PORT_CHECK_URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("port check service: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("port check service answered %d", resp.StatusCode)
+	}
+	var answer struct {
+		Reachable *bool  `json:"reachable"`
+		Message   string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil || answer.Reachable == nil {
+		return errors.New("port check service answered without reachable")
+	}
+	result.Reachable, result.Message = *answer.Reachable, answer.Message
+	return nil
+}
+
+// Handler for POST /server/port-check
+func portCheckHandlerGin(c *gin.Context) {
+	var req PortCheckRequest
+	if c.Request.ContentLength > 0 {
+		if !bindJSON(c, &req) {
+			return
+		}
+	}
+
+	result := PortCheckResult{Host: wgParams.ServerPubIP, Port: wgParams.ServerPort}
+	var err error
+	switch {
+	case req.Node != "":
+		nodesMutex.RLock()
+		node := nodes[req.Node]
+		nodesMutex.RUnlock()
+		if node == nil {
+			c.JSON(http.StatusNotFound, APIResponse{
+				Success: false,
+				Message: "Node not found",
+			})
+			return
+		}
+		result.Via, result.Node = "node", node.Name
+		err = checkPortFromNode(node, &result)
+	case PORT_CHECK_URL != "":
+		result.Via = "service"
+		err = checkPortFromService(&result)
+	default:
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Set PORT_CHECK_URL, or name a node of NODES_CONFIG to check from",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	result.CheckedAt = time.Now().UTC()
+
+	message := fmt.Sprintf("UDP port %s is reachable", result.Port)
+	if !result.Reachable {
+		message = fmt.Sprintf("UDP port %s is NOT reachable from outside", result.Port)
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    result,
+	})
+}
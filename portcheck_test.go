@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func portCheck(t *testing.T, env *testEnv, body any, want int) PortCheckResult {
+	t.Helper()
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/server/port-check", body)
+	var resp struct {
+		Data PortCheckResult `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != want {
+		t.Fatalf("port check: status %d, want %d, %s", rec.Code, want, rec.Body.String())
+	}
+	return resp.Data
+}
+
+func TestPortCheckFromService(t *testing.T) {
+	env := setupTestEnv(t)
+	portCheck(t, env, nil, http.StatusBadRequest)
+
+	var asked map[string]string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&asked)
+		w.Write([]byte(`{"reachable": false, "message": "no reply from 203.0.113.10:51820"}`))
+	}))
+	defer service.Close()
+	oldURL := PORT_CHECK_URL
+	PORT_CHECK_URL = service.URL
+	t.Cleanup(func() { PORT_CHECK_URL = oldURL })
+
+	result := portCheck(t, env, nil, http.StatusOK)
+	if asked["host"] != "203.0.113.10" || asked["port"] != "51820" || asked["protocol"] != "udp" {
+		t.Errorf("service was asked %v", asked)
+	}
+	if result.Via != "service" || result.Reachable || result.Message != "no reply from 203.0.113.10:51820" {
+		t.Errorf("got %+v", result)
+	}
+}
+
+func TestPortCheckFromNode(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeNode(t, env)
+
+	// The node's wg reports a handshake when handshakes exists, and ip
+	// only records what it was asked
+	bin := t.TempDir()
+	files := map[string]string{
+		filepath.Join(bin, "wg"): "#!/bin/bash\nif [ \"$3\" = latest-handshakes ]; then\n  [ -f " + bin + "/handshakes ] && printf 'key\\t1700000000\\n' || printf 'key\\t0\\n'\n  exit 0\nfi\necho \"$@\" >> " + bin + "/node.log\n",
+		filepath.Join(bin, "ip"): "#!/bin/bash\necho ip \"$@\" >> " + bin + "/node.log\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	os.WriteFile(filepath.Join(bin, "handshakes"), nil, 0600)
+
+	result := portCheck(t, env, PortCheckRequest{Node: "fra1"}, http.StatusOK)
+	if result.Via != "node" || result.Node != "fra1" || !result.Reachable {
+		t.Errorf("got %+v", result)
+	}
+	log := readFile(t, filepath.Join(bin, "node.log"))
+	if !strings.Contains(log, "peer server-public-key endpoint 203.0.113.10:51820") || !strings.Contains(log, "ip link del wgprobe") {
+		t.Errorf("node ran:\n%s", log)
+	}
+	// The temporary peer was added and removed again
+	if calls := strings.Count(readFile(t, filepath.Join(env.dir, "invocations.log")), "set"); calls != 2 {
+		t.Errorf("got %d wg set calls on the server, want 2", calls)
+	}
+
+	portCheck(t, env, PortCheckRequest{Node: "nope"}, http.StatusNotFound)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /users/preview takes an add request and answers with the client
+// config and server peer block it would produce, so a UI can show them for
+// review before creating the client. The request is validated and the
+// addresses allocated like an add, but nothing is written and the addresses
+// aren't reserved: a later add may get different ones. Keys are generated on
+// create, so the preview shows placeholders.
+
+// Stand-ins for the keys in a preview
+var previewKeys = clientKeys{
+	privateKey:   "(generated on create)",
+	publicKey:    "(generated on create)",
+	preSharedKey: "(generated on create)",
+}
+
+// What adding a client would produce
+type ClientPreview struct {
+	Name       string `json:"name"`
+	IPV4       string `json:"ipv4,omitempty"`
+	IPV6       string `json:"ipv6,omitempty"`
+	Config     string `json:"config"`
+	ServerPeer string `json:"server_peer"`
+}
+
+// Handler rendering the client an add request would create
+func previewUserHandlerGin(c *gin.Context) {
+	var req AddUserRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	group, _, ok := checkAddUserRequest(c, &req)
+	if !ok {
+		return
+	}
+
+	preview, err := previewTenantClient(tenantFrom(c), req, group)
+	if errors.Is(err, errClientExists) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: clientExistsMessage,
+			Code:    codeNameTaken,
+		})
+		return
+	}
+	if respondTenantError(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    preview,
+	})
+}
+
+// addTenantClient without writing anything
+func previewTenantClient(tenant *Tenant, req AddUserRequest, group *ClientGroup) (ClientPreview, error) {
+	keys := previewKeys
+	if !presharedKeyFor(req.PresharedKey, CLIENT_PRESHARED_KEYS) {
+		keys.preSharedKey = ""
+	}
+	dns, killSwitch := req.clientSettings(group)
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	exists, err := clientExists(tenant.storedName(req.Name))
+	if err != nil {
+		return ClientPreview{}, err
+	}
+	if exists {
+		return ClientPreview{}, errClientExists
+	}
+	if err := tenant.checkLimitLocked(); err != nil {
+		return ClientPreview{}, err
+	}
+	ipv4, ipv6, err := tenant.allocateIPsLocked(req.IPV4, req.IPV6)
+	if err != nil {
+		return ClientPreview{}, err
+	}
+
+	config := renderClientConfig(wgParams, backendType, ipv4, ipv6, keys, dns, killSwitch)
+	if config, err = withEndpointProfile(config, defaultEndpointProfile); err != nil {
+		return ClientPreview{}, err
+	}
+	if group != nil {
+		config = group.renderInto(config, false)
+	}
+	return ClientPreview{
+		Name:       req.Name,
+		IPV4:       ipv4,
+		IPV6:       ipv6,
+		Config:     config,
+		ServerPeer: renderServerPeer(tenant.storedName(req.Name), ipv4, ipv6, keys),
+	}, nil
+}
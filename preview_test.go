@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPreviewUser(t *testing.T) {
+	env := setupTestEnv(t)
+	before := env.configContent(t)
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/preview", AddUserRequest{Name: "alice"})
+	var resp struct {
+		Data ClientPreview `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview: status %d, %s", rec.Code, rec.Body.String())
+	}
+	preview := resp.Data
+	if !strings.Contains(preview.Config, "PrivateKey = (generated on create)") || !strings.Contains(preview.Config, "Address = "+preview.IPV4+"/32") {
+		t.Errorf("config:\n%s", preview.Config)
+	}
+	if !strings.Contains(preview.ServerPeer, "### Client alice") || !strings.Contains(preview.ServerPeer, "AllowedIPs = "+preview.IPV4+"/32") {
+		t.Errorf("server peer:\n%s", preview.ServerPeer)
+	}
+
+	// Nothing was written
+	if env.configContent(t) != before {
+		t.Error("preview changed the server config")
+	}
+	if entries, _ := os.ReadDir(env.clientsDir); len(entries) != 0 {
+		t.Errorf("preview wrote %d client files", len(entries))
+	}
+
+	// The add gets what the preview showed
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	var added struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &added)
+	if added.Data.IPV4 != preview.IPV4 {
+		t.Errorf("added with %s, preview showed %s", added.Data.IPV4, preview.IPV4)
+	}
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/preview", AddUserRequest{Name: "alice"}); rec.Code != http.StatusConflict {
+		t.Errorf("existing name: got status %d, want 409", rec.Code)
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/preview", AddUserRequest{Name: "bad name!"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid name: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestPreviewUserInTenant(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+
+	rec := env.request(t, http.MethodPost, "/api/v1/users/preview", AddUserRequest{Name: "a"}, "acme-token")
+	var resp struct {
+		Data ClientPreview `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusOK || resp.Data.IPV4 != "10.66.10.1" || resp.Data.Name != "a" {
+		t.Errorf("got status %d, %+v, want a at the first pool address", rec.Code, resp.Data)
+	}
+	if !strings.Contains(resp.Data.ServerPeer, "### Client acme.a") {
+		t.Errorf("server peer:\n%s", resp.Data.ServerPeer)
+	}
+}
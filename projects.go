@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Projects group clients so a team's access can be managed as a unit. A
+// client belongs to at most one project. Membership lives in a JSON file
+// next to the server config; the WireGuard config itself is untouched.
+// Members of an isolated project can't reach other peers, nor other peers
+// them (see firewall.go). A project with a routing profile leaves through
+// the profile's uplink (see routing.go).
+type Project struct {
+	Name           string    `json:"name"`
+	Description    string    `json:"description,omitempty"`
+	Clients        []string  `json:"clients"`
+	Isolated       bool      `json:"isolated,omitempty"`
+	RoutingProfile string    `json:"routing_profile,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type ProjectRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+type ProjectClientsRequest struct {
+	Names []string `json:"names" binding:"required"`
+}
+
+type ProjectIsolationRequest struct {
+	Isolated *bool `json:"isolated" binding:"required"`
+}
+
+// Usage of a project's clients, from one `wg show dump`
+type ProjectUsage struct {
+	TotalClients    int   `json:"total_clients"`
+	DisabledClients int   `json:"disabled_clients"`
+	OnlineClients   int   `json:"online_clients"`
+	TransferRx      int64 `json:"transfer_rx_bytes"`
+	TransferTx      int64 `json:"transfer_tx_bytes"`
+}
+
+var (
+	projectsMutex      sync.Mutex
+	errProjectNotFound = errors.New("Project not found")
+	errProjectExists   = errors.New("A project with this name already exists")
+)
+
+// PROJECTS_FILE, or projects.json next to the server config
+func projectsFile() string {
+	if PROJECTS_FILE != "" {
+		return PROJECTS_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "projects.json")
+}
+
+// Caller holds projectsMutex
+func loadProjectsLocked() (map[string]*Project, error) {
+	projects := make(map[string]*Project)
+	content, err := os.ReadFile(projectsFile())
+	if os.IsNotExist(err) {
+		return projects, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read projects file: %v", err)
+	}
+	if err := json.Unmarshal(content, &projects); err != nil {
+		return nil, fmt.Errorf("failed to parse projects file: %v", err)
+	}
+	return projects, nil
+}
+
+// Caller holds projectsMutex
+func saveProjectsLocked(projects map[string]*Project) error {
+	content, err := json.MarshalIndent(projects, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(projectsFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write projects file: %v", err)
+	}
+	return nil
+}
+
+// Run fn on the loaded projects and save them if it succeeds
+func updateProjects(fn func(projects map[string]*Project) error) error {
+	projectsMutex.Lock()
+	defer projectsMutex.Unlock()
+
+	projects, err := loadProjectsLocked()
+	if err != nil {
+		return err
+	}
+	if err := fn(projects); err != nil {
+		return err
+	}
+	return saveProjectsLocked(projects)
+}
+
+// A project with members that no longer exist left out
+func getProject(name string) (*Project, []Client, error) {
+	projectsMutex.Lock()
+	projects, err := loadProjectsLocked()
+	projectsMutex.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	project := projects[name]
+	if project == nil {
+		return nil, nil, errProjectNotFound
+	}
+
+	clients, err := listWireGuardClients()
+	if err != nil {
+		return nil, nil, err
+	}
+	byName := make(map[string]Client, len(clients))
+	for _, client := range clients {
+		byName[client.Name] = client
+	}
+
+	members := []Client{}
+	for _, member := range project.Clients {
+		if client, ok := byName[member]; ok {
+			members = append(members, client)
+		}
+	}
+	return project, members, nil
+}
+
+// Respond to a getProject/updateProjects error
+func respondProjectError(c *gin.Context, err error) {
+	if errors.Is(err, errProjectNotFound) {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    errorCode(err),
+	})
+}
+
+// Handler listing projects with their member counts
+func listProjectsHandlerGin(c *gin.Context) {
+	projectsMutex.Lock()
+	projects, err := loadProjectsLocked()
+	projectsMutex.Unlock()
+	if err != nil {
+		respondProjectError(c, err)
+		return
+	}
+
+	list := make([]*Project, 0, len(projects))
+	for _, project := range projects {
+		list = append(list, project)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+func addProjectHandlerGin(c *gin.Context) {
+	var req ProjectRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if !clientNameRegex.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Project name " + invalidClientNameMessage,
+		})
+		return
+	}
+
+	project := &Project{Name: req.Name, Description: req.Description, Clients: []string{}, CreatedAt: time.Now().UTC()}
+	err := updateProjects(func(projects map[string]*Project) error {
+		if projects[req.Name] != nil {
+			return errProjectExists
+		}
+		projects[req.Name] = project
+		return nil
+	})
+	if errors.Is(err, errProjectExists) {
+		c.JSON(http.StatusConflict, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	if err != nil {
+		respondProjectError(c, err)
+		return
+	}
+
+	respondCreated(c, "/projects/"+url.PathEscape(req.Name), "Project added successfully", project)
+}
+
+// Remove the grouping only; the clients stay
+func deleteProjectHandlerGin(c *gin.Context) {
+	var req ProjectRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	err := updateProjects(func(projects map[string]*Project) error {
+		if projects[req.Name] == nil {
+			return errProjectNotFound
+		}
+		delete(projects, req.Name)
+		return nil
+	})
+	if err == nil {
+		err = applyFirewall()
+	}
+	if err != nil {
+		respondProjectError(c, err)
+		return
+	}
+
+	respondDeleted(c, "Project deleted successfully")
+}
+
+// Handler for one project: its clients and their aggregate usage
+func projectHandlerGin(c *gin.Context) {
+	project, members, err := getProject(c.Param("project"))
+	if err != nil {
+		respondProjectError(c, err)
+		return
+	}
+
+	usage := ProjectUsage{TotalClients: len(members)}
+	isMember := make(map[string]bool, len(members))
+	for _, member := range members {
+		isMember[member.Name] = true
+		if member.Disabled {
+			usage.DisabledClients++
+		}
+	}
+
+	// A stopped interface just means no usage
+	if success, output := wireGuardDump(); success == "success" {
+		names := clientNamesByPublicKey()
+		now := time.Now()
+		for _, peer := range parseWGDump(output) {
+			if !isMember[names[peer.PublicKey]] {
+				continue
+			}
+			if peer.online(now) {
+				usage.OnlineClients++
+			}
+			usage.TransferRx += peer.TransferRx
+			usage.TransferTx += peer.TransferTx
+		}
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"name":            project.Name,
+			"description":     project.Description,
+			"isolated":        project.Isolated,
+			"routing_profile": project.RoutingProfile,
+			"created_at":      project.CreatedAt,
+			"clients":         members,
+			"usage":           usage,
+		},
+	})
+}
+
+// Handler putting existing clients in a project, moving them out of any
+// other project
+func addProjectClientsHandlerGin(c *gin.Context) {
+	var req ProjectClientsRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if len(req.Names) == 0 {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "names must contain at least one client name",
+		})
+		return
+	}
+	// Only existing clients can be grouped
+	for _, name := range req.Names {
+		exists, err := clientExists(name)
+		if err != nil {
+			respondProjectError(c, err)
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("Client %s not found", name),
+			})
+			return
+		}
+	}
+
+	name := c.Param("project")
+	err := updateProjects(func(projects map[string]*Project) error {
+		project := projects[name]
+		if project == nil {
+			return errProjectNotFound
+		}
+		for _, other := range projects {
+			other.Clients = without(other.Clients, req.Names)
+		}
+		project.Clients = append(project.Clients, req.Names...)
+		sort.Strings(project.Clients)
+		return nil
+	})
+	if err == nil {
+		err = applyFirewall()
+	}
+	if err != nil {
+		respondProjectError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Added %d clients to %s", len(req.Names), name),
+	})
+}
+
+func removeProjectClientsHandlerGin(c *gin.Context) {
+	var req ProjectClientsRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	err := updateProjects(func(projects map[string]*Project) error {
+		project := projects[c.Param("project")]
+		if project == nil {
+			return errProjectNotFound
+		}
+		project.Clients = without(project.Clients, req.Names)
+		return nil
+	})
+	if err == nil {
+		err = applyFirewall()
+	}
+	if err != nil {
+		respondProjectError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Clients removed from project",
+	})
+}
+
+func without(names, remove []string) []string {
+	drop := make(map[string]bool, len(remove))
+	for _, name := range remove {
+		drop[name] = true
+	}
+	kept := []string{}
+	for _, name := range names {
+		if !drop[name] {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// Handler isolating a project's clients from the other peers, or lifting it
+func setProjectIsolationHandlerGin(c *gin.Context) {
+	var req ProjectIsolationRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	name := c.Param("project")
+	err := updateProjects(func(projects map[string]*Project) error {
+		project := projects[name]
+		if project == nil {
+			return errProjectNotFound
+		}
+		project.Isolated = *req.Isolated
+		return nil
+	})
+	if err == nil {
+		err = applyFirewall()
+	}
+	if err != nil {
+		respondProjectError(c, err)
+		return
+	}
+
+	message := "Project isolated"
+	if !*req.Isolated {
+		message = "Project isolation lifted"
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+	})
+}
+
+// Handler disabling or enabling every client of a project with one apply
+func setProjectEnabledHandler(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, members, err := getProject(c.Param("project"))
+		if err != nil {
+			respondProjectError(c, err)
+			return
+		}
+
+		changed := []string{}
+		err = func() error {
+			wgConfigMutex.Lock()
+			defer wgConfigMutex.Unlock()
+
+			for _, member := range members {
+				ok, err := setClientEnabledLocked(member.Name, enabled)
+				if errors.Is(err, errClientNotFound) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if ok {
+					changed = append(changed, member.Name)
+				}
+			}
+			if len(changed) == 0 {
+				return nil
+			}
+			return syncWireGuardConf()
+		}()
+		if err != nil {
+			respondProjectError(c, err)
+			return
+		}
+
+		verb := "Disabled"
+		if enabled {
+			verb = "Enabled"
+		}
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: fmt.Sprintf("%s %d clients", verb, len(changed)),
+			Data:    map[string]interface{}{"clients": changed},
+		})
+	}
+}
+
+// Handler deleting every client of a project; the project itself stays
+func deleteProjectClientsHandlerGin(c *gin.Context) {
+	project, members, err := getProject(c.Param("project"))
+	if err != nil {
+		respondProjectError(c, err)
+		return
+	}
+
+	deleted := []string{}
+	for _, member := range members {
+		if err := deleteWireGuardClient(member.Name); err != nil {
+			log.Printf("Project %s: failed to delete %s: %v", project.Name, member.Name, err)
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("deleted %d clients, then failed on %s: %v", len(deleted), member.Name, err),
+				Data:    map[string]interface{}{"clients": deleted},
+			})
+			return
+		}
+		deleted = append(deleted, member.Name)
+	}
+
+	if err := updateProjects(func(projects map[string]*Project) error {
+		if p := projects[project.Name]; p != nil {
+			p.Clients = without(p.Clients, deleted)
+		}
+		return nil
+	}); err != nil {
+		log.Printf("Project %s: failed to update members: %v", project.Name, err)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Deleted %d clients", len(deleted)),
+		Data:    map[string]interface{}{"clients": deleted},
+	})
+}
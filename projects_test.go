@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProjectLifecycle(t *testing.T) {
+	env := setupTestEnv(t)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("seeding %s failed with status %d", name, code)
+		}
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/add", ProjectRequest{Name: "team-a"}).Code; code != http.StatusOK {
+		t.Fatalf("add project: got status %d", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/add", ProjectRequest{Name: "team-a"}).Code; code != http.StatusConflict {
+		t.Errorf("duplicate project: got status %d, want 409", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/team-a/clients/add", ProjectClientsRequest{Names: []string{"ghost"}}).Code; code != http.StatusNotFound {
+		t.Errorf("unknown client: got status %d, want 404", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/team-a/clients/add", ProjectClientsRequest{Names: []string{"alice", "bob"}}).Code; code != http.StatusOK {
+		t.Fatalf("add clients: got status %d", code)
+	}
+
+	env.writeDump(t,
+		fmt.Sprintf("%s\tpsk\t198.51.100.1:4000\t10.66.0.2/32\t%d\t100\t200\t25", findPublicKeyByClientName("alice"), time.Now().Unix()),
+		fmt.Sprintf("%s\tpsk\t198.51.100.2:4000\t10.66.0.3/32\t0\t10\t20\t25", findPublicKeyByClientName("bob")),
+		fmt.Sprintf("%s\tpsk\t198.51.100.3:4000\t10.66.0.4/32\t0\t1000\t1000\t25", findPublicKeyByClientName("carol")),
+	)
+
+	var detail struct {
+		Data struct {
+			Clients []Client     `json:"clients"`
+			Usage   ProjectUsage `json:"usage"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/projects/team-a", nil).Body.Bytes(), &detail)
+	want := ProjectUsage{TotalClients: 2, OnlineClients: 1, TransferRx: 110, TransferTx: 220}
+	if len(detail.Data.Clients) != 2 || detail.Data.Usage != want {
+		t.Errorf("got %+v, want usage %+v", detail.Data, want)
+	}
+
+	syncBefore := env.syncconfCalls(t)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/team-a/disable", nil).Code; code != http.StatusOK {
+		t.Fatalf("disable: got status %d", code)
+	}
+	if env.syncconfCalls(t) != syncBefore+1 {
+		t.Error("disabling a project must apply the config once")
+	}
+	config := env.configContent(t)
+	if !strings.Contains(config, "### Client alice\n#[Peer]\n#PublicKey") || !strings.Contains(config, "### Client carol\n[Peer]") {
+		t.Errorf("only the project's peers must be commented out:\n%s", config)
+	}
+	users := env.authedRequest(t, http.MethodGet, "/api/v1/users", nil).Body.String()
+	if strings.Count(users, `"disabled":true`) != 2 {
+		t.Errorf("list must flag disabled clients: %s", users)
+	}
+
+	// Disabled peers keep their addresses reserved
+	var added struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "dave"}).Body.Bytes(), &added)
+	if added.Data.IPV4 != "10.66.0.5" {
+		t.Errorf("got IPv4 %s, want 10.66.0.5", added.Data.IPV4)
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/team-a/enable", nil)
+	if strings.Contains(env.configContent(t), "#[Peer]") {
+		t.Errorf("enable must restore the peers:\n%s", env.configContent(t))
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/team-a/delete-all", nil).Code; code != http.StatusOK {
+		t.Fatalf("delete-all: got status %d", code)
+	}
+	config = env.configContent(t)
+	if strings.Contains(config, "alice") || strings.Contains(config, "bob") || !strings.Contains(config, "carol") {
+		t.Errorf("delete-all must remove only the project's clients:\n%s", config)
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/delete", ProjectRequest{Name: "team-a"}).Code; code != http.StatusOK {
+		t.Errorf("delete project: got status %d", code)
+	}
+	if code := env.authedRequest(t, http.MethodGet, "/api/v1/projects/team-a", nil).Code; code != http.StatusNotFound {
+		t.Errorf("deleted project: got status %d, want 404", code)
+	}
+}
+
+func TestClientBelongsToOneProject(t *testing.T) {
+	env := setupTestEnv(t)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	for _, name := range []string{"team-a", "team-b"} {
+		env.authedRequest(t, http.MethodPost, "/api/v1/projects/add", ProjectRequest{Name: name})
+		env.authedRequest(t, http.MethodPost, "/api/v1/projects/"+name+"/clients/add", ProjectClientsRequest{Names: []string{"alice"}})
+	}
+
+	var list struct {
+		Data []Project `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/projects", nil).Body.Bytes(), &list)
+	if len(list.Data) != 2 || len(list.Data[0].Clients) != 0 || len(list.Data[1].Clients) != 1 {
+		t.Errorf("alice must have moved to team-b, got %+v", list.Data)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Some embedded and router WireGuard implementations can't use preshared
+// keys, so clients can be created without one: the PresharedKey line is
+// then left out of both the server peer and the client config.
+
+// The request's choice, or the server's when it made none
+func presharedKeyFor(override *bool, serverDefault bool) bool {
+	if override != nil {
+		return *override
+	}
+	return serverDefault
+}
+
+// The PresharedKey line of a peer section, empty for clients without one
+func presharedKeyLine(keys clientKeys) string {
+	if keys.preSharedKey == "" {
+		return ""
+	}
+	return "PresharedKey = " + keys.preSharedKey + "\n"
+}
+
+// Whether the client's block in the server config has a preshared key,
+// commented out or not
+func clientHasPresharedKey(serverConfig []byte, name string) bool {
+	block := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(name) + `\n.*?^$`).Find(serverConfig)
+	return regexp.MustCompile(`(?m)^#?PresharedKey = `).Match(block)
+}
+
+// Replace only a client's preshared key, keeping its key pair. Both sides
+// need the new config, as with a full rotation, but the public key other
+// systems know the client by stays the same. Returns the new client config.
+func rotateClientPSK(name string) (string, error) {
+	psk, err := generatePSK()
+	if err != nil {
+		return "", err
+	}
+	return replaceClientKeys(name, clientKeys{preSharedKey: psk})
+}
+
+// Handler for a new preshared key; the old config stops working
+func rotatePSKHandlerGin(c *gin.Context) {
+	name := c.Param("name")
+	config, err := rotateClientPSK(name)
+	if err == errClientNotFound {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client not found",
+			Code:    codeClientNotFound,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	if err := markKeysRotated([]string{name}, time.Now(), false); err != nil {
+		log.Printf("Key rotation: %s: %v", name, err)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Preshared key rotated; import the new config",
+		Data:    Client{Name: name, Config: config},
+	})
+}
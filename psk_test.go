@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRotatePSK(t *testing.T) {
+	env := setupTestEnv(t)
+	for _, name := range []string{"alice", "bob"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("seeding %s failed with status %d", name, code)
+		}
+	}
+	before := env.configContent(t)
+	oldConfig := readFile(t, clientConfigFile("alice"))
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/rotate-psk", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rotate: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+
+	pskRegex := regexp.MustCompile(`(?m)^PresharedKey = (.*)$`)
+	privateKeyRegex := regexp.MustCompile(`(?m)^PrivateKey = (.*)$`)
+	psk := pskRegex.FindStringSubmatch(resp.Data.Config)
+	after := env.configContent(t)
+	if psk == nil || psk[1] == pskRegex.FindStringSubmatch(oldConfig)[1] || !strings.Contains(after, "PresharedKey = "+psk[1]+"\n") {
+		t.Fatalf("server config must have a new preshared key:\n%s\nclient:\n%s", after, resp.Data.Config)
+	}
+	if privateKeyRegex.FindString(resp.Data.Config) != privateKeyRegex.FindString(oldConfig) {
+		t.Error("the private key must stay")
+	}
+	publicKey := regexp.MustCompile(`(?m)^PublicKey = .*$`)
+	aliceBlock := regexp.MustCompile(`(?ms)^### Client alice\n.*?^$`)
+	if publicKey.FindString(aliceBlock.FindString(before)) != publicKey.FindString(aliceBlock.FindString(after)) {
+		t.Error("alice's public key must stay")
+	}
+	bobBlock := regexp.MustCompile(`(?ms)^### Client bob\n.*?^$`)
+	if bobBlock.FindString(before) != bobBlock.FindString(after) {
+		t.Error("bob's peer must not change")
+	}
+	if readFile(t, clientConfigFile("alice")) != resp.Data.Config {
+		t.Error("the client config file must be the rotated one")
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/nobody/rotate-psk", nil).Code; code != http.StatusNotFound {
+		t.Errorf("unknown client: got status %d, want 404", code)
+	}
+}
+
+func TestRotatePSKAddsMissingKey(t *testing.T) {
+	env := setupTestEnv(t)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding failed with status %d", code)
+	}
+	// A client created without a preshared key
+	withoutPSK := regexp.MustCompile(`(?m)^PresharedKey = .*\n`)
+	path := clientConfigFile("alice")
+	os.WriteFile(env.configFile, withoutPSK.ReplaceAll([]byte(env.configContent(t)), nil), 0600)
+	os.WriteFile(path, withoutPSK.ReplaceAll([]byte(readFile(t, path)), nil), 0600)
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/rotate-psk", nil).Code; code != http.StatusOK {
+		t.Fatalf("rotate: got status %d", code)
+	}
+	psk := regexp.MustCompile(`(?m)^PresharedKey = (.*)$`).FindStringSubmatch(readFile(t, path))
+	if psk == nil || !regexp.MustCompile(`(?m)^PublicKey = .*\nPresharedKey = `+regexp.QuoteMeta(psk[1])+`$`).MatchString(env.configContent(t)) {
+		t.Errorf("both sides must get the key:\n%s\nclient:\n%s", env.configContent(t), readFile(t, path))
+	}
+}
+
+func TestAddClientWithoutPresharedKey(t *testing.T) {
+	env := setupTestEnv(t)
+	noPSK, withPSK := false, true
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice", PresharedKey: &noPSK})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("add: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "PresharedKey") || strings.Contains(readFile(t, clientConfigFile("alice")), "PresharedKey") {
+		t.Errorf("the client config must have no preshared key:\n%s", rec.Body.String())
+	}
+	if !strings.Contains(env.configContent(t), "### Client alice\n[Peer]\nPublicKey = ") ||
+		clientHasPresharedKey([]byte(env.configContent(t)), "alice") {
+		t.Errorf("the server peer must have no preshared key:\n%s", env.configContent(t))
+	}
+
+	// CLIENT_PRESHARED_KEYS=false is the default a request can override
+	CLIENT_PRESHARED_KEYS = false
+	t.Cleanup(func() { CLIENT_PRESHARED_KEYS = true })
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "carol", PresharedKey: &withPSK})
+	content := []byte(env.configContent(t))
+	if clientHasPresharedKey(content, "bob") || !clientHasPresharedKey(content, "carol") {
+		t.Errorf("bob must have no preshared key and carol one:\n%s", content)
+	}
+
+	// A new key pair doesn't add a preshared key, and neither does the
+	// scheduled preshared key rotation
+	if _, err := rotateClientKeys("alice"); err != nil {
+		t.Fatalf("rotating alice's keys: %v", err)
+	}
+	if clientHasPresharedKey([]byte(env.configContent(t)), "alice") || strings.Contains(readFile(t, clientConfigFile("alice")), "PresharedKey") {
+		t.Error("a new key pair must keep alice without a preshared key")
+	}
+	if rotated, err := rotateKeys([]string{"alice", "carol"}); err != nil || len(rotated) != 1 || rotated[0] != "carol" {
+		t.Errorf("rotated %v, %v; want only carol", rotated, err)
+	}
+}
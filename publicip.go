@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client configs dial SERVER_PUB_IP, so a VM that comes back from
+// re-provisioning with a new public IP leaves every client unable to
+// connect while the server looks healthy. Every PUBLIC_IP_CHECK_INTERVAL
+// the server asks PUBLIC_IP_URL for the address it is seen from, and a
+// difference shows as a warning in /status and an alert in /overview. A
+// SERVER_PUB_IP that is a hostname is resolved and compared, as its DNS
+// record is what needs updating. With PUBLIC_IP_AUTO_UPDATE the leader
+// writes the new address to the params file and regenerates the client
+// configs, which then still have to reach the devices.
+
+var serverPubIPRegex = regexp.MustCompile(`(?m)^SERVER_PUB_IP=.*$`)
+
+// The latest public IP check
+type PublicIPCheck struct {
+	Configured string    `json:"configured"`
+	Detected   string    `json:"detected,omitempty"`
+	Drift      bool      `json:"drift"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+	// When PUBLIC_IP_AUTO_UPDATE last rewrote SERVER_PUB_IP
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+var (
+	publicIPMutex sync.Mutex
+	publicIPState *PublicIPCheck
+)
+
+// The address PUBLIC_IP_URL sees this server from
+func detectPublicIP() (netip.Addr, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(PUBLIC_IP_URL)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return netip.Addr{}, fmt.Errorf("%s answered %d", PUBLIC_IP_URL, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(string(body)))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%s didn't answer an IP address", PUBLIC_IP_URL)
+	}
+	return addr.Unmap(), nil
+}
+
+// Whether configured, an address or a hostname, points at detected
+func endpointMatches(configured string, detected netip.Addr) bool {
+	if addr, err := netip.ParseAddr(strings.Trim(configured, "[]")); err == nil {
+		return addr.Unmap() == detected
+	}
+	addrs, err := net.LookupHost(configured)
+	if err != nil {
+		return false
+	}
+	for _, value := range addrs {
+		if addr, err := netip.ParseAddr(value); err == nil && addr.Unmap() == detected {
+			return true
+		}
+	}
+	return false
+}
+
+// Compare the detected public IP to SERVER_PUB_IP, and on the leader with
+// PUBLIC_IP_AUTO_UPDATE follow it
+func checkPublicIP(now time.Time) *PublicIPCheck {
+	check := &PublicIPCheck{Configured: wgParams.ServerPubIP, CheckedAt: now.UTC()}
+	publicIPMutex.Lock()
+	if publicIPState != nil {
+		check.UpdatedAt = publicIPState.UpdatedAt
+	}
+	publicIPMutex.Unlock()
+
+	detected, err := detectPublicIP()
+	if err != nil {
+		check.Error = err.Error()
+	} else {
+		check.Detected = detected.String()
+		check.Drift = !endpointMatches(check.Configured, detected)
+	}
+
+	// Hostnames are left to their DNS record
+	_, isAddr := netip.ParseAddr(strings.Trim(check.Configured, "[]"))
+	if check.Drift && PUBLIC_IP_AUTO_UPDATE && isAddr == nil && writesAllowed() {
+		if err := updateServerPubIP(detected.String()); err != nil {
+			log.Printf("Public IP: failed to update SERVER_PUB_IP to %s: %v", detected, err)
+			check.Error = err.Error()
+		} else {
+			log.Printf("Public IP: SERVER_PUB_IP changed from %s to %s, client configs regenerated", check.Configured, detected)
+			updatedAt := now.UTC()
+			check.Configured, check.Drift, check.UpdatedAt = detected.String(), false, &updatedAt
+		}
+	}
+
+	publicIPMutex.Lock()
+	publicIPState = check
+	publicIPMutex.Unlock()
+	invalidateStatusCache()
+	return check
+}
+
+// Write ip to the params file and regenerate the client configs from it
+func updateServerPubIP(ip string) error {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	content, err := os.ReadFile(WG_PARAMS_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to open params file: %v", err)
+	}
+	if !serverPubIPRegex.Match(content) {
+		return fmt.Errorf("params file has no SERVER_PUB_IP")
+	}
+	content = serverPubIPRegex.ReplaceAllLiteral(content, []byte("SERVER_PUB_IP="+ip))
+	if err := os.WriteFile(WG_PARAMS_FILE, content, 0600); err != nil {
+		return fmt.Errorf("failed to write params file: %v", err)
+	}
+	// Keeping each config's DNS, as only the endpoint changed
+	result, err := regenerateClientsLocked(nil, RegenerateClientsRequest{KeepDNS: true})
+	if err != nil {
+		return err
+	}
+	for _, skipped := range result.Skipped {
+		log.Printf("Public IP: %s keeps its config: %s", skipped.Name, skipped.Reason)
+	}
+	return nil
+}
+
+// The drift warning, empty when there is none
+func publicIPWarning() string {
+	publicIPMutex.Lock()
+	defer publicIPMutex.Unlock()
+
+	if publicIPState == nil || !publicIPState.Drift {
+		return ""
+	}
+	return fmt.Sprintf("SERVER_PUB_IP %s doesn't point at this server's public IP %s; clients can't connect",
+		publicIPState.Configured, publicIPState.Detected)
+}
+
+// The latest check, nil before the first
+func latestPublicIPCheck() *PublicIPCheck {
+	publicIPMutex.Lock()
+	defer publicIPMutex.Unlock()
+
+	return publicIPState
+}
+
+// Check the public IP every PUBLIC_IP_CHECK_INTERVAL, or on the job's
+// schedule. Followers check too; only the leader updates SERVER_PUB_IP.
+func startPublicIPCheck() {
+	if PUBLIC_IP_URL == "" {
+		return
+	}
+
+	scheduleJob(jobPublicIPCheck, PUBLIC_IP_CHECK_INTERVAL, false, func() error {
+		check := checkPublicIP(time.Now())
+		if check.Error == "" {
+			return nil
+		}
+		if DEBUG_MODE {
+			log.Printf("Public IP check: %s", check.Error)
+		}
+		return errors.New(check.Error)
+	})
+}
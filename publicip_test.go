@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve ip as this server's public IP
+func setupPublicIP(t *testing.T, ip string) {
+	t.Helper()
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(ip + "\n"))
+	}))
+	t.Cleanup(service.Close)
+	oldURL, oldAutoUpdate := PUBLIC_IP_URL, PUBLIC_IP_AUTO_UPDATE
+	PUBLIC_IP_URL = service.URL
+	t.Cleanup(func() {
+		PUBLIC_IP_URL, PUBLIC_IP_AUTO_UPDATE = oldURL, oldAutoUpdate
+		publicIPMutex.Lock()
+		publicIPState = nil
+		publicIPMutex.Unlock()
+	})
+}
+
+func TestPublicIPDriftWarns(t *testing.T) {
+	env := setupTestEnv(t)
+	setupPublicIP(t, "203.0.113.10")
+
+	if check := checkPublicIP(time.Now()); check.Drift || check.Error != "" || check.Detected != "203.0.113.10" {
+		t.Errorf("same IP: got %+v", check)
+	}
+
+	setupPublicIP(t, "198.51.100.20")
+	check := checkPublicIP(time.Now())
+	if !check.Drift || check.Configured != "203.0.113.10" || check.Detected != "198.51.100.20" {
+		t.Errorf("moved IP: got %+v", check)
+	}
+
+	var status struct {
+		Data struct {
+			PublicIPCheck *PublicIPCheck `json:"public_ip_check"`
+			Warnings      []string       `json:"warnings"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/status", nil).Body.Bytes(), &status)
+	if status.Data.PublicIPCheck == nil || !status.Data.PublicIPCheck.Drift || len(status.Data.Warnings) != 1 ||
+		!strings.Contains(status.Data.Warnings[0], "198.51.100.20") {
+		t.Errorf("status: got %+v", status.Data)
+	}
+
+	var overview overviewResponse
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/overview", nil).Body.Bytes(), &overview)
+	found := false
+	for _, alert := range overview.Data.Alerts {
+		found = found || (alert.Node == localNodeName && strings.Contains(alert.Message, "SERVER_PUB_IP"))
+	}
+	if !found {
+		t.Errorf("overview alerts: got %+v", overview.Data.Alerts)
+	}
+}
+
+func TestPublicIPAutoUpdate(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+
+	paramsFile := filepath.Join(env.dir, "params")
+	params := "SERVER_PUB_IP=203.0.113.10\nSERVER_WG_NIC=wg0\nSERVER_WG_IPV4=10.66.0.1\nSERVER_PORT=51820\nSERVER_PUB_KEY=server-public-key\nCLIENT_DNS_1=1.1.1.1\nCLIENT_DNS_2=1.0.0.1\n"
+	if err := os.WriteFile(paramsFile, []byte(params), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldParamsFile := WG_PARAMS_FILE
+	WG_PARAMS_FILE = paramsFile
+	t.Cleanup(func() { WG_PARAMS_FILE = oldParamsFile })
+
+	setupPublicIP(t, "198.51.100.20")
+	PUBLIC_IP_AUTO_UPDATE = true
+
+	check := checkPublicIP(time.Now())
+	if check.Drift || check.Configured != "198.51.100.20" || check.UpdatedAt == nil || check.Error != "" {
+		t.Errorf("got %+v", check)
+	}
+	if content := readFile(t, paramsFile); !strings.Contains(content, "SERVER_PUB_IP=198.51.100.20\n") {
+		t.Errorf("params file:\n%s", content)
+	}
+	if config := readFile(t, clientConfigFile("alice")); !strings.Contains(config, "Endpoint = 198.51.100.20:51820") {
+		t.Errorf("alice's config:\n%s", config)
+	}
+	if wgParams.ServerPubIP != "198.51.100.20" {
+		t.Errorf("params: got %q", wgParams.ServerPubIP)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Window of the client creation quota
+const createQuotaWindow = time.Hour
+
+// Client creations per token over the last createQuotaWindow, so runaway
+// automation can't fill the server. Kept in memory; a restart resets it.
+type createQuota struct {
+	mu      sync.Mutex
+	byToken map[string][]time.Time
+}
+
+var createQuotas = &createQuota{byToken: map[string][]time.Time{}}
+
+// Creations per hour allowed for the request's token; 0 means no limit
+func createLimit(c *gin.Context) int {
+	if tenant := tenantFrom(c); tenant != nil {
+		return tenant.MaxCreatesPerHour
+	}
+	return MAX_CREATES_PER_HOUR
+}
+
+// A reservation that would exceed the quota
+type createQuotaError struct {
+	limit, used, requested int
+	retryAfter             time.Duration
+}
+
+func (e *createQuotaError) Error() string {
+	return fmt.Sprintf("Create quota of %d clients per hour exceeded", e.limit)
+}
+
+// Reserve n creations for key under limit, 0 meaning no limit
+func reserveCreatesLimited(key string, limit, n int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	createQuotas.mu.Lock()
+	defer createQuotas.mu.Unlock()
+
+	recent := createQuotas.byToken[key][:0]
+	for _, at := range createQuotas.byToken[key] {
+		if now.Sub(at) < createQuotaWindow {
+			recent = append(recent, at)
+		}
+	}
+	used := len(recent)
+	if used+n > limit {
+		createQuotas.byToken[key] = recent
+
+		// The oldest creations in the window expire first
+		retryAfter := createQuotaWindow
+		if free := used + n - limit; free <= used {
+			retryAfter = createQuotaWindow - now.Sub(recent[free-1])
+		}
+		return withCode(codeQuotaExceeded, &createQuotaError{limit: limit, used: used, requested: n, retryAfter: retryAfter})
+	}
+	for i := 0; i < n; i++ {
+		recent = append(recent, now)
+	}
+	createQuotas.byToken[key] = recent
+	return nil
+}
+
+// Hand back n reserved creations of key that did not happen
+func releaseCreatesLimited(key string, limit, n int) {
+	if n <= 0 || limit <= 0 {
+		return
+	}
+
+	createQuotas.mu.Lock()
+	defer createQuotas.mu.Unlock()
+	recent := createQuotas.byToken[key]
+	if n > len(recent) {
+		n = len(recent)
+	}
+	createQuotas.byToken[key] = recent[:len(recent)-n]
+}
+
+// Reserve n creations for the APIs without a gin context, GraphQL and
+// gRPC, which only take API_TOKEN under MAX_CREATES_PER_HOUR. key is the
+// token's quota key, as callerKey gives it.
+func reserveCreatesFor(key string, n int) error {
+	return reserveCreatesLimited(key, MAX_CREATES_PER_HOUR, n)
+}
+
+// Hand back n creations reserved with reserveCreatesFor
+func releaseCreatesFor(key string, n int) {
+	releaseCreatesLimited(key, MAX_CREATES_PER_HOUR, n)
+}
+
+// Reserve n creations for the request's token, answering 429 with the
+// quota details when that would exceed the limit. Reservations for creates
+// that then fail are handed back with releaseCreates.
+func reserveCreates(c *gin.Context, n int) bool {
+	err := reserveCreatesLimited(callerKey(c), createLimit(c), n)
+	if err == nil {
+		return true
+	}
+
+	var quota *createQuotaError
+	errors.As(err, &quota)
+	retryAfter := int(quota.retryAfter.Seconds()) + 1
+	c.Header("Retry-After", fmt.Sprintf("%d", retryAfter))
+	c.JSON(http.StatusTooManyRequests, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    codeQuotaExceeded,
+		Data: map[string]interface{}{
+			"limit":               quota.limit,
+			"used":                quota.used,
+			"requested":           quota.requested,
+			"window_seconds":      int(createQuotaWindow.Seconds()),
+			"retry_after_seconds": retryAfter,
+		},
+	})
+	return false
+}
+
+// Hand back n reserved creations that did not happen
+func releaseCreates(c *gin.Context, n int) {
+	releaseCreatesLimited(callerKey(c), createLimit(c), n)
+}
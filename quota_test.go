@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminCreateQuota(t *testing.T) {
+	env := setupTestEnv(t)
+	oldLimit := MAX_CREATES_PER_HOUR
+	MAX_CREATES_PER_HOUR = 3
+	t.Cleanup(func() { MAX_CREATES_PER_HOUR = oldLimit })
+
+	for _, name := range []string{"alice", "bob"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("%s: got status %d", name, code)
+		}
+	}
+
+	// A failed create doesn't use up the quota
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"}).Code; code != http.StatusConflict {
+		t.Fatalf("duplicate: got status %d, want 409", code)
+	}
+
+	recorder := env.authedRequest(t, http.MethodPost, "/api/v1/users/add-bulk", AddUsersBulkRequest{Names: []string{"carol", "dave"}})
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("bulk over quota: got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+	var resp struct {
+		Data struct {
+			Limit     int `json:"limit"`
+			Used      int `json:"used"`
+			Requested int `json:"requested"`
+		} `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &resp)
+	if resp.Data.Limit != 3 || resp.Data.Used != 2 || resp.Data.Requested != 2 {
+		t.Errorf("unexpected quota details %+v", resp.Data)
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "carol"}).Code; code != http.StatusOK {
+		t.Errorf("last creation within quota: got status %d", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "dave"}).Code; code != http.StatusTooManyRequests {
+		t.Errorf("over quota: got status %d, want 429", code)
+	}
+}
+
+func TestTenantCreateQuotaIsPerToken(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+	tenantsByToken["globex-token"].MaxCreatesPerHour = 1
+
+	if code := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "a"}, "globex-token").Code; code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if code := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "b"}, "globex-token").Code; code != http.StatusTooManyRequests {
+		t.Errorf("same token: got status %d, want 429", code)
+	}
+	if code := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "b"}, "globex-token-2").Code; code != http.StatusOK {
+		t.Errorf("other token: got status %d, want 200", code)
+	}
+}
+
+func TestCreateQuotaCoversEveryAPI(t *testing.T) {
+	env := setupTestEnv(t)
+	oldLimit := MAX_CREATES_PER_HOUR
+	MAX_CREATES_PER_HOUR = 3
+	t.Cleanup(func() { MAX_CREATES_PER_HOUR = oldLimit })
+	server := newGRPCTestServer(t)
+
+	// Only the rows imported count against the quota
+	if rec := env.importCSV(t, "/api/v1/users/import", "name\nalice\nalice\n"); rec.Code != http.StatusOK {
+		t.Fatalf("import: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if resp := env.graphQL(t, `mutation { addClient(name: "bob") { name } }`, nil); len(resp.Errors) > 0 {
+		t.Fatalf("graphql add: %+v", resp.Errors)
+	}
+	if _, status := grpcCall(t, server, "AddClient", "test-token", appendProtoString(nil, 1, "carol")); status != "0" {
+		t.Fatalf("grpc add: got grpc-status %q", status)
+	}
+
+	resp := env.graphQL(t, `mutation { addClient(name: "dave") { name } }`, nil)
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, "quota") {
+		t.Errorf("graphql over quota: got %+v", resp.Errors)
+	}
+	if _, status := grpcCall(t, server, "AddClient", "test-token", appendProtoString(nil, 1, "dave")); status != "8" {
+		t.Errorf("grpc over quota: got grpc-status %q, want 8 (RESOURCE_EXHAUSTED)", status)
+	}
+	if code := env.importCSV(t, "/api/v1/users/import", "name\ndave\n").Code; code != http.StatusTooManyRequests {
+		t.Errorf("import over quota: got status %d, want 429", code)
+	}
+	if code := env.adoptConfig(t, "dave", "[Interface]\nPublicKey = "+strings.Repeat("A", 43)+"=\n").Code; code != http.StatusTooManyRequests {
+		t.Errorf("adopt over quota: got status %d, want 429", code)
+	}
+	if clientConfigFile("dave") != "" {
+		t.Error("dave was created over the quota")
+	}
+}
+
+func TestImportCountsTowardCreateQuota(t *testing.T) {
+	env := setupTestEnv(t)
+	oldLimit := MAX_CREATES_PER_HOUR
+	MAX_CREATES_PER_HOUR = 1
+	t.Cleanup(func() { MAX_CREATES_PER_HOUR = oldLimit })
+
+	stateFile := filepath.Join(env.dir, "wg0.json")
+	state := `{"clients": {
+  "id-1": {"id": "id-1", "name": "alice", "address": "10.8.0.2", "privateKey": "alice-priv", "publicKey": "alice-pub", "enabled": true},
+  "id-2": {"id": "id-2", "name": "bob", "address": "10.8.0.3", "privateKey": "bob-priv", "publicKey": "bob-pub", "enabled": true}
+}}`
+	if err := os.WriteFile(stateFile, []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldStateFile := WG_EASY_CONFIG
+	WG_EASY_CONFIG = stateFile
+	t.Cleanup(func() { WG_EASY_CONFIG = oldStateFile })
+	appendToFile(t, env.configFile, "\n# Client: alice (id-1)\n[Peer]\nPublicKey = alice-pub\nAllowedIPs = 10.8.0.2/32\n\n# Client: bob (id-2)\n[Peer]\nPublicKey = bob-pub\nAllowedIPs = 10.8.0.3/32\n")
+
+	// Both clients or none
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/import", ImportRequest{Source: "wg-easy"}).Code; code != http.StatusTooManyRequests {
+		t.Errorf("import over quota: got status %d, want 429", code)
+	}
+	if !strings.Contains(env.configContent(t), "# Client: alice") {
+		t.Error("alice was imported over the quota")
+	}
+	// Dry runs create nothing, so they don't count
+	if resp := env.importClients(t, ImportRequest{Source: "wg-easy", DryRun: true}); resp.Data.Imported != 2 {
+		t.Errorf("dry run: %+v", resp.Data)
+	}
+
+	MAX_CREATES_PER_HOUR = 3
+	if resp := env.importClients(t, ImportRequest{Source: "wg-easy"}); resp.Data.Imported != 2 {
+		t.Fatalf("import: %+v", resp.Data)
+	}
+	// Running again imports nothing and reserves nothing
+	env.importClients(t, ImportRequest{Source: "wg-easy"})
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "carol"}).Code; code != http.StatusOK {
+		t.Errorf("last creation within quota: got status %d", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "dave"}).Code; code != http.StatusTooManyRequests {
+		t.Errorf("over quota: got status %d, want 429", code)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Token-bucket rate limiting, so a misbehaving integration polling the
+// status in a loop or adding clients one by one can't keep the box busy
+// with wg and syncconf runs. RATE_LIMIT applies to every API route, and
+// RATE_LIMIT_ROUTES overrides it for single routes, each with its own
+// bucket. Buckets are per API token, or per source IP with
+// RATE_LIMIT_BY=ip, and live in memory. Responses carry the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers of the IETF draft, and a
+// Retry-After once the bucket is empty.
+
+const (
+	rateLimitByToken = "token"
+	rateLimitByIP    = "ip"
+
+	// How often buckets that filled up again are dropped
+	rateLimitPruneInterval = time.Minute
+)
+
+// Up to limit requests per period, refilled evenly over the period
+type rateLimit struct {
+	limit  int
+	period time.Duration
+}
+
+var (
+	globalRateLimit rateLimit
+	routeRateLimits = map[string]rateLimit{}
+)
+
+var rateLimitPeriods = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// Parse "N/s", "N/m" or "N/h"; "off" is no limit
+func parseRateLimit(value string) (rateLimit, error) {
+	if value == "off" {
+		return rateLimit{}, nil
+	}
+	count, unit, ok := strings.Cut(value, "/")
+	limit, err := strconv.Atoi(count)
+	period, known := rateLimitPeriods[unit]
+	if !ok || err != nil || limit <= 0 || !known {
+		return rateLimit{}, fmt.Errorf("rate %q must be requests per s, m or h, e.g. 10/s, or off", value)
+	}
+	return rateLimit{limit: limit, period: period}, nil
+}
+
+// Parse RATE_LIMIT, RATE_LIMIT_ROUTES and RATE_LIMIT_BY
+func loadRateLimits() error {
+	if RATE_LIMIT_BY != rateLimitByToken && RATE_LIMIT_BY != rateLimitByIP {
+		return fmt.Errorf("RATE_LIMIT_BY must be %s or %s", rateLimitByToken, rateLimitByIP)
+	}
+
+	global := rateLimit{}
+	if RATE_LIMIT != "" {
+		var err error
+		if global, err = parseRateLimit(RATE_LIMIT); err != nil {
+			return fmt.Errorf("RATE_LIMIT: %v", err)
+		}
+	}
+
+	routes := map[string]rateLimit{}
+	for _, entry := range splitList(RATE_LIMIT_ROUTES) {
+		route, value, ok := strings.Cut(entry, "=")
+		method, path, hasPath := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || !hasPath || method != strings.ToUpper(method) || !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("RATE_LIMIT_ROUTES: %q must be METHOD /route=rate, e.g. GET /status=1/s", entry)
+		}
+		limit, err := parseRateLimit(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("RATE_LIMIT_ROUTES: %v", err)
+		}
+		routes[method+" "+path] = limit
+	}
+
+	globalRateLimit, routeRateLimits = global, routes
+	return nil
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   rateLimit
+}
+
+// Tokens in the bucket at now, refilled since it was last used
+func (b *rateBucket) level(now time.Time) float64 {
+	capacity := float64(b.limit.limit)
+	refill := now.Sub(b.updated).Seconds() * capacity / b.limit.period.Seconds()
+	return math.Min(capacity, b.tokens+refill)
+}
+
+// How long until the bucket holds tokens again
+func (b *rateBucket) timeUntil(tokens float64) time.Duration {
+	missing := tokens - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / float64(b.limit.limit) * float64(b.limit.period))
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	pruned  time.Time
+}
+
+var rateLimiters = &rateLimiter{buckets: map[string]*rateBucket{}}
+
+// Take a token from the bucket for key, returning the tokens left, when
+// it is full again, and when one can be taken if there was none
+func (l *rateLimiter) take(key string, limit rateLimit, now time.Time) (int, time.Duration, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) > rateLimitPruneInterval {
+		for key, bucket := range l.buckets {
+			if bucket.level(now) >= float64(bucket.limit.limit) {
+				delete(l.buckets, key)
+			}
+		}
+		l.pruned = now
+	}
+
+	bucket := l.buckets[key]
+	if bucket == nil || bucket.limit != limit {
+		bucket = &rateBucket{tokens: float64(limit.limit), limit: limit}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = bucket.level(now)
+	}
+	bucket.updated = now
+
+	var retryAfter time.Duration
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+	} else {
+		retryAfter = bucket.timeUntil(1)
+	}
+	return int(bucket.tokens), bucket.timeUntil(float64(limit.limit)), retryAfter
+}
+
+// Whether the router is running a request itself, for a job or approval,
+// which was already counted when it came in
+func replayedRequest(c *gin.Context) bool {
+	ctx := c.Request.Context()
+	return ctx.Value(jobKey{}) != nil || ctx.Value(confirmedRequestKey{}) != nil || ctx.Value(approvedClientRequestKey{}) != nil
+}
+
+// Whole seconds, rounded up, as the headers want them
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Answer 429 once the request's bucket is empty
+func rateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := apiRoute(c)
+		limit, scope := globalRateLimit, ""
+		if override, ok := routeRateLimits[route]; ok {
+			limit, scope = override, route
+		}
+		if limit.limit <= 0 || replayedRequest(c) {
+			c.Next()
+			return
+		}
+
+		key := "token " + callerKey(c)
+		if RATE_LIMIT_BY == rateLimitByIP {
+			key = "ip " + c.ClientIP()
+		}
+		remaining, reset, retryAfter := rateLimiters.take(scope+" "+key, limit, time.Now())
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("RateLimit-Reset", ceilSeconds(reset))
+		if retryAfter > 0 {
+			c.Header("Retry-After", ceilSeconds(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, APIResponse{
+				Success: false,
+				Message: "Rate limit exceeded",
+				Data: map[string]interface{}{
+					"limit":               limit.limit,
+					"window_seconds":      int(limit.period.Seconds()),
+					"retry_after_seconds": int(math.Ceil(retryAfter.Seconds())),
+				},
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Set the rate limit config for the test and load it
+func setRateLimits(t *testing.T, global, routes, by string) {
+	t.Helper()
+	RATE_LIMIT, RATE_LIMIT_ROUTES, RATE_LIMIT_BY = global, routes, by
+	t.Cleanup(func() {
+		RATE_LIMIT, RATE_LIMIT_ROUTES, RATE_LIMIT_BY = "", "", rateLimitByToken
+		loadRateLimits()
+	})
+	if err := loadRateLimits(); err != nil {
+		t.Fatalf("loading rate limits: %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+	setRateLimits(t, "2/m", "POST /users/add=1/h, GET /tags=off", rateLimitByToken)
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/users", nil)
+	if rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "1" || rec.Header().Get("RateLimit-Reset") != "30" {
+		t.Errorf("unexpected headers: %v", rec.Header())
+	}
+	env.authedRequest(t, http.MethodGet, "/api/v1/users", nil)
+	rec = env.authedRequest(t, http.MethodGet, "/api/users", nil)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" {
+		t.Fatalf("third request: got status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Other tokens and overridden routes have their own buckets
+	if code := env.request(t, http.MethodGet, "/api/v1/users", nil, "acme-token").Code; code != http.StatusOK {
+		t.Errorf("acme: got status %d, want 200", code)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Errorf("first add: got status %d, want 200", code)
+	}
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("second add: got status %d, limit %q", rec.Code, rec.Header().Get("RateLimit-Limit"))
+	}
+	for i := 0; i < 3; i++ {
+		if rec := env.authedRequest(t, http.MethodGet, "/api/v1/tags", nil); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("exempt route: got status %d", rec.Code)
+		}
+	}
+}
+
+func TestRateLimitByIP(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+	setRateLimits(t, "1/s", "", rateLimitByIP)
+
+	// Every test request comes from the same address
+	env.authedRequest(t, http.MethodGet, "/api/v1/users", nil)
+	if code := env.request(t, http.MethodGet, "/api/v1/users", nil, "acme-token").Code; code != http.StatusTooManyRequests {
+		t.Errorf("second token from the same address: got status %d, want 429", code)
+	}
+}
+
+func TestRateLimitBucket(t *testing.T) {
+	limiter := &rateLimiter{buckets: map[string]*rateBucket{}}
+	limit := rateLimit{limit: 2, period: time.Second}
+	now := time.Now()
+
+	limiter.take("k", limit, now)
+	limiter.take("k", limit, now)
+	if _, _, retryAfter := limiter.take("k", limit, now); retryAfter != 500*time.Millisecond {
+		t.Errorf("empty bucket: retry after %s, want 500ms", retryAfter)
+	}
+	// Half a second refills one token
+	if remaining, reset, retryAfter := limiter.take("k", limit, now.Add(500*time.Millisecond)); retryAfter != 0 || remaining != 0 || reset != time.Second {
+		t.Errorf("refilled bucket: remaining %d, reset %s, retry after %s", remaining, reset, retryAfter)
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	for _, config := range [][3]string{
+		{"10", "", rateLimitByToken},
+		{"0/s", "", rateLimitByToken},
+		{"5/d", "", rateLimitByToken},
+		{"", "/status=1/s", rateLimitByToken},
+		{"", "GET /status", rateLimitByToken},
+		{"", "", "tenant"},
+	} {
+		RATE_LIMIT, RATE_LIMIT_ROUTES, RATE_LIMIT_BY = config[0], config[1], config[2]
+		if err := loadRateLimits(); err == nil {
+			t.Errorf("config %q must be rejected", config)
+		}
+	}
+	RATE_LIMIT, RATE_LIMIT_ROUTES, RATE_LIMIT_BY = "", "", rateLimitByToken
+	loadRateLimits()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Read-only mode runs this process as a status and reporting replica
+// against the files another instance manages. Requests that would change
+// the config or control the service answer 503 READ_ONLY, and the
+// scheduled work that writes (purges, key rotation, LDAP sync, group
+// enforcement, public IP updates) is skipped. It starts from READ_ONLY and
+// can be switched at runtime. Unlike maintenance mode it belongs to this
+// process alone; other instances sharing the files keep writing.
+//
+// A process started read-only neither applies NAT and firewall rules nor
+// takes part in leader election, so it can't take the HA lock from the
+// instance that writes.
+
+var readOnlyMode atomic.Bool
+
+const readOnlyModeMessage = "This instance is read-only; changes must go to the instance that manages the config"
+
+// Whether this process may change the config: it isn't read-only and it
+// leads. Scheduled work checks this before writing.
+func writesAllowed() bool {
+	return !readOnlyMode.Load() && isLeader()
+}
+
+// Routes read-only mode doesn't refuse, relative to the API version prefix
+var readOnlyExemptRoutes = map[string]bool{
+	"POST /read-only/enable":  true,
+	"POST /read-only/disable": true,
+}
+
+// Why a change to route would be refused right now, as a message and an
+// error code, both empty when it wouldn't. Followers refuse everything,
+// read-only mode and maintenance all but their exempt routes.
+func changeRefusal(route string) (string, string) {
+	if !isLeader() {
+		return followerMessage, codeNotLeader
+	}
+	if readOnlyMode.Load() && !readOnlyExemptRoutes[route] {
+		return readOnlyModeMessage, codeReadOnly
+	}
+	if !maintenanceExemptRoutes[route] {
+		if window := currentMaintenance(); window != nil {
+			return maintenanceMessage(window), codeMaintenance
+		}
+	}
+	return "", ""
+}
+
+// Why any change would be refused right now, empty when it wouldn't. For
+// the APIs outside the REST middleware: GraphQL mutations and gRPC.
+func changesRefusedMessage() string {
+	message, _ := changeRefusal("")
+	return message
+}
+
+// Refuse changes on an HA follower, in read-only mode and during
+// maintenance, answering 503 with the reason's code. POSTs that only
+// read are let through, GraphQL included; executeGraphQL refuses
+// mutations itself.
+func changesAllowedMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if HA_LOCK_FILE != "" {
+			c.Header("X-HA-Role", haRole())
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if postOnlyReads(c) {
+			c.Next()
+			return
+		}
+		message, code := changeRefusal(apiRoute(c))
+		if message == "" {
+			c.Next()
+			return
+		}
+
+		// A follower may lead after the next poll
+		if code == codeNotLeader {
+			c.Header("Retry-After", fmt.Sprintf("%d", int(HA_POLL_INTERVAL.Seconds()+0.5)))
+		}
+		c.JSON(http.StatusServiceUnavailable, APIResponse{
+			Success: false,
+			Message: message,
+			Code:    code,
+		})
+		c.Abort()
+	}
+}
+
+// Handler reporting whether this process is read-only
+func readOnlyModeHandlerGin(c *gin.Context) {
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"read_only": readOnlyMode.Load(),
+		},
+	})
+}
+
+// Handler switching read-only mode on or off
+func setReadOnlyModeHandler(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		readOnlyMode.Store(enabled)
+
+		message := "Read-only mode disabled"
+		if enabled {
+			message = "Read-only mode enabled; changes are refused until it is disabled"
+		}
+		log.Print(message)
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: message,
+			Data: map[string]interface{}{
+				"read_only": enabled,
+			},
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	env := setupTestEnv(t)
+	addedClient(t, env, "alice")
+	t.Cleanup(func() { readOnlyMode.Store(false) })
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/read-only/enable", nil); rec.Code != http.StatusOK {
+		t.Fatalf("enable: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if writesAllowed() {
+		t.Error("scheduled work may still write")
+	}
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodPost, "/api/v1/users/add"},
+		{http.MethodPost, "/api/v1/users/delete"},
+		{http.MethodPost, "/api/v1/restart"},
+		{http.MethodPost, "/api/v1/maintenance/enable"},
+	} {
+		rec := env.authedRequest(t, req.method, req.path, AddUserRequest{Name: "bob"})
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusServiceUnavailable || resp.Code != codeReadOnly {
+			t.Errorf("%s %s: status %d, %s", req.method, req.path, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/users", nil); rec.Code != http.StatusOK {
+		t.Errorf("read: status %d", rec.Code)
+	}
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/graphql", map[string]string{"query": `mutation { deleteClient(name: "alice") }`})
+	if !strings.Contains(rec.Body.String(), "read-only") {
+		t.Errorf("graphql mutation: %s", rec.Body.String())
+	}
+	server := newGRPCTestServer(t)
+	if _, status := grpcCall(t, server, "AddClient", "test-token", appendProtoString(nil, 1, "bob")); status != "14" {
+		t.Errorf("grpc AddClient: got grpc-status %q, want 14 (UNAVAILABLE)", status)
+	}
+	if !strings.Contains(env.configContent(t), "### Client alice") || strings.Contains(env.configContent(t), "bob") {
+		t.Error("the config changed in read-only mode")
+	}
+
+	var status struct {
+		Data struct {
+			ReadOnly bool `json:"read_only"`
+		} `json:"data"`
+	}
+	json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/read-only", nil).Body.Bytes(), &status)
+	if !status.Data.ReadOnly {
+		t.Error("status: read_only is false")
+	}
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/read-only/disable", nil); rec.Code != http.StatusOK {
+		t.Fatalf("disable: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"}); rec.Code != http.StatusOK {
+		t.Errorf("add after read-only: status %d, %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadOnlyModeRefusesSCIMAndPortal(t *testing.T) {
+	env := setupTestEnv(t)
+	SCIM_TOKEN = "scim-token"
+	t.Cleanup(func() { SCIM_TOKEN = "" })
+	token := setupPortalUser(t, env)
+	before := env.configContent(t)
+
+	readOnlyMode.Store(true)
+	t.Cleanup(func() { readOnlyMode.Store(false) })
+
+	rec := scimRequest(t, env, http.MethodPost, "/scim/v2/Users", `{"userName":"carol@example.com"}`)
+	var resp APIResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusServiceUnavailable || resp.Code != codeReadOnly {
+		t.Errorf("SCIM create: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := portalRequest(t, env, http.MethodPost, "/portal/v1/devices/alice/rotate-keys", token); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("portal rotate-keys: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := scimRequest(t, env, http.MethodGet, "/scim/v2/Users", ""); rec.Code != http.StatusOK {
+		t.Errorf("SCIM list: status %d", rec.Code)
+	}
+	if env.configContent(t) != before {
+		t.Error("the config changed in read-only mode")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Private keys, preshared keys and tokens must never end up in logs, error
+// messages or the debug status. Log output goes through redactSecrets, and
+// so do the messages of API responses and the output of failed commands,
+// which is where configs and wg dumps tend to leak into. Configs handed to
+// clients on purpose travel in the response data and are left alone.
+
+const redactedSecret = "[REDACTED]"
+
+// Values shorter than this are too likely to occur by chance to replace
+const minRedactedLength = 8
+
+var (
+	// Key lines of WireGuard configs and the params file, commented out or not
+	secretLineRegex = regexp.MustCompile(`(?mi)^([ \t]*#?[ \t]*(?:PrivateKey|PresharedKey|SERVER_PRIV_KEY)[ \t]*=[ \t]*)[^\s"']+`)
+	// Secret fields in JSON, YAML and key=value text
+	secretFieldRegex = regexp.MustCompile(`(?i)("?\b(?:private_?key|preshared_?key|psk|password|client_secret|secret_access_key)"?[ \t]*[:=][ \t]*"?)([^\s"',&}]+)`)
+	// The interface line of wg show dump starts with the private key, and
+	// peer lines carry the preshared key second
+	wgKeyRegex = regexp.MustCompile(`^[A-Za-z0-9+/]{43}=$`)
+)
+
+// The secrets currently in use, longest first so a token containing
+// another is replaced whole
+func knownSecrets() []string {
+	secrets := []string{secretValue(&API_TOKEN), secretValue(&API_TOKEN_SECONDARY), secretValue(&SCIM_TOKEN), wgParams.ServerPrivKey,
+		os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), os.Getenv("AZURE_CLIENT_SECRET")}
+	secrets = append(secrets, splitList(secretValue(&APPROVER_TOKENS))...)
+	secrets = append(secrets, splitList(secretValue(&READONLY_TOKENS))...)
+	for token := range tenantsByToken {
+		secrets = append(secrets, token)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	return secrets
+}
+
+// Replace every secret in s by [REDACTED]
+func redactSecrets(s string) string {
+	for _, secret := range knownSecrets() {
+		if len(secret) >= minRedactedLength {
+			s = strings.ReplaceAll(s, secret, redactedSecret)
+		}
+	}
+	s = secretLineRegex.ReplaceAllString(s, "${1}"+redactedSecret)
+	s = secretFieldRegex.ReplaceAllString(s, "${1}"+redactedSecret)
+
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		switch {
+		case len(fields) == 4 && wgKeyRegex.MatchString(fields[0]):
+			fields[0] = redactedSecret
+		case len(fields) == 8 && wgKeyRegex.MatchString(fields[1]):
+			fields[1] = redactedSecret
+		// wg show all dump prefixes the lines with the interface
+		case len(fields) == 5 && wgKeyRegex.MatchString(fields[1]):
+			fields[1] = redactedSecret
+		case len(fields) == 9 && wgKeyRegex.MatchString(fields[2]):
+			fields[2] = redactedSecret
+		default:
+			continue
+		}
+		lines[i] = strings.Join(fields, "\t")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Copy of the params without the server's private key
+func (p WGParams) redacted() WGParams {
+	if p.ServerPrivKey != "" {
+		p.ServerPrivKey = redactedSecret
+	}
+	return p
+}
+
+// Response messages are redacted; data, which carries configs on purpose,
+// is not
+func (r APIResponse) MarshalJSON() ([]byte, error) {
+	type plain APIResponse
+	r.Message = redactSecrets(r.Message)
+	return json.Marshal(plain(r))
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, redactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Send the standard logger and gin's request log through redactSecrets
+func redactLogs() {
+	log.SetOutput(redactingWriter{os.Stderr})
+	gin.DefaultWriter = redactingWriter{gin.DefaultWriter}
+	gin.DefaultErrorWriter = redactingWriter{gin.DefaultErrorWriter}
+}
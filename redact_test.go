@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	setupTestEnv(t)
+	const key = "a2tra2tra2tra2tra2tra2tra2tra2tra2tra2tra2s="
+	const pub = "cHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHA="
+	for input, want := range map[string]string{
+		"PrivateKey = " + key + "\nAddress = 10.8.0.2/32":   "PrivateKey = [REDACTED]\nAddress = 10.8.0.2/32",
+		"#PresharedKey = " + key:                            "#PresharedKey = [REDACTED]",
+		"SERVER_PRIV_KEY=" + key:                            "SERVER_PRIV_KEY=[REDACTED]",
+		`{"private_key": "` + key + `", "public_key": "x"}`: `{"private_key": "[REDACTED]", "public_key": "x"}`,
+		"Line unrecognized: `PresharedKey=" + key + "'":     "Line unrecognized: `PresharedKey=[REDACTED]'",
+		"bad token test-token given":                        "bad token [REDACTED] given",
+		"server-private-key leaked":                         "[REDACTED] leaked",
+		// wg show dump: the interface's private key and the peers' preshared keys
+		key + "\t" + pub + "\t51820\toff":                                  "[REDACTED]\t" + pub + "\t51820\toff",
+		pub + "\t" + key + "\t1.2.3.4:5\t10.8.0.2/32\t0\t0\t0\toff":        pub + "\t[REDACTED]\t1.2.3.4:5\t10.8.0.2/32\t0\t0\t0\toff",
+		"wg0\t" + pub + "\t" + key + "\t(none)\t10.8.0.2/32\t0\t0\t0\toff": "wg0\t" + pub + "\t[REDACTED]\t(none)\t10.8.0.2/32\t0\t0\t0\toff",
+		pub + "\t(none)\t(none)\t10.8.0.2/32\t0\t0\t0\toff":                pub + "\t(none)\t(none)\t10.8.0.2/32\t0\t0\t0\toff",
+		"peer: " + pub + "\n  preshared key: (hidden)":                     "peer: " + pub + "\n  preshared key: (hidden)",
+		"Client alice added with 10.8.0.2":                                 "Client alice added with 10.8.0.2",
+	} {
+		if got := redactSecrets(input); got != want {
+			t.Errorf("redactSecrets(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestRedactedLogs(t *testing.T) {
+	setupTestEnv(t)
+	var buf bytes.Buffer
+	log.SetOutput(redactingWriter{&buf})
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	log.Printf("auth failed for key test-token")
+	if strings.Contains(buf.String(), "test-token") || !strings.Contains(buf.String(), redactedSecret) {
+		t.Errorf("unexpected log line %q", buf.String())
+	}
+}
+
+func TestDebugStatusHidesServerKey(t *testing.T) {
+	env := setupTestEnv(t)
+	DEBUG_MODE = true
+	t.Cleanup(func() { DEBUG_MODE = false })
+
+	body := env.authedRequest(t, http.MethodGet, "/api/status?refresh=true", nil).Body.String()
+	if strings.Contains(body, "server-private-key") || !strings.Contains(body, `"ServerPrivKey":"[REDACTED]"`) {
+		t.Errorf("the debug status must hide the server's private key:\n%s", body)
+	}
+	if !strings.Contains(body, wgParams.ServerPubKey) {
+		t.Error("the public key is no secret")
+	}
+}
+
+func TestResponseMessagesAreRedacted(t *testing.T) {
+	env := setupTestEnv(t)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding failed with status %d", code)
+	}
+
+	// A config in a message is redacted, the same config as data is not
+	body, err := APIResponse{Message: readFile(t, clientConfigFile("alice")), Data: readFile(t, clientConfigFile("alice"))}.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(body), "PrivateKey = [REDACTED]") != 1 || strings.Count(string(body), "PrivateKey = ") != 2 {
+		t.Errorf("unexpected response %s", body)
+	}
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/users/alice", nil); !strings.Contains(rec.Body.String(), "PrivateKey = ") ||
+		strings.Contains(rec.Body.String(), redactedSecret) {
+		t.Errorf("configs handed out on purpose must stay whole: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Client configs are rendered once, when the client is added, so a new
+// endpoint hostname or port, DNS servers or default AllowedIPs in the params
+// file only reach new clients. POST /server/regenerate-clients reads the
+// params file again and renders every stored client config anew, keeping
+// its keys, addresses and kill switch, with group members getting their
+// group's defaults. Per-client DNS overrides aren't stored, so keep_dns keeps
+// each config's DNS lines instead of the server's. Lines the API doesn't
+// write, like an MTU in an imported config, are dropped; dry_run shows what
+// would change.
+
+var (
+	configPrivateKeyRegex   = regexp.MustCompile(`(?m)^PrivateKey = (.*)$`)
+	configPresharedKeyRegex = regexp.MustCompile(`(?m)^PresharedKey = (.*)$`)
+	configAddressRegex      = regexp.MustCompile(`(?m)^Address = (.*)$`)
+
+	errParamsInterfaceChanged = errors.New("the params file names another interface; restart the API to switch interfaces")
+)
+
+// Regenerate client configs request; the body is optional
+type RegenerateClientsRequest struct {
+	// Keep each client's DNS lines rather than render the server's
+	KeepDNS bool `json:"keep_dns"`
+	// Report what would change without writing anything
+	DryRun bool `json:"dry_run"`
+}
+
+// A client config that was, or would be, rewritten
+type RegeneratedClient struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+}
+
+// A client whose config couldn't be regenerated
+type SkippedClient struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// What regenerating the client configs did
+type RegenerateResult struct {
+	Changed   []RegeneratedClient `json:"changed"`
+	Unchanged int                 `json:"unchanged"`
+	Skipped   []SkippedClient     `json:"skipped"`
+	DryRun    bool                `json:"dry_run,omitempty"`
+}
+
+// Read the params file again. A missing file keeps the loaded params.
+func reloadWGParams() error {
+	content, err := os.ReadFile(WG_PARAMS_FILE)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open params file: %v", err)
+	}
+	params := parseWGParams(content)
+	if err := validateWGParams(params); err != nil {
+		return err
+	}
+	if params.ServerWGNIC != "" && params.ServerWGNIC != wgParams.ServerWGNIC {
+		return errParamsInterfaceChanged
+	}
+	wgParams = params
+	return nil
+}
+
+// The kill switch a rendered config has
+func configKillSwitch(config string) string {
+	switch {
+	case strings.Contains(config, "killswitch_"):
+		return killSwitchNft
+	case killSwitchLineRegex.MatchString(config):
+		return killSwitchIPTables
+	}
+	return killSwitchOff
+}
+
+// Render a stored client config from the current params, keeping what is
+// the client's own. group is nil for clients in none.
+func regenerateClientConfig(config string, group *ClientGroup, keepDNS bool) (string, error) {
+	privateKey := configPrivateKeyRegex.FindStringSubmatch(config)
+	address := configAddressRegex.FindStringSubmatch(config)
+	if privateKey == nil || address == nil {
+		return "", errors.New("config has no PrivateKey or Address")
+	}
+	keys := clientKeys{privateKey: strings.TrimSpace(privateKey[1])}
+	if psk := configPresharedKeyRegex.FindStringSubmatch(config); psk != nil {
+		keys.preSharedKey = strings.TrimSpace(psk[1])
+	}
+	var ipv4, ipv6 string
+	for _, entry := range splitList(address[1]) {
+		if strings.Contains(entry, ":") {
+			ipv6 = strings.TrimSuffix(entry, "/128")
+		} else {
+			ipv4 = strings.TrimSuffix(entry, "/32")
+		}
+	}
+
+	rendered := renderClientConfig(wgParams, backendType, ipv4, ipv6, keys, nil, configKillSwitch(config))
+	// A profile that is gone, or an endpoint set by hand, falls back to the default
+	profile := configEndpointProfile(config)
+	if _, ok := findEndpointProfile(profile); !ok {
+		profile = defaultEndpointProfile
+	}
+	rendered, err := withEndpointProfile(rendered, profile)
+	if err != nil {
+		return "", err
+	}
+	if group != nil {
+		rendered = group.renderInto(rendered, !keepDNS)
+	}
+	if keepDNS {
+		lines := strings.Join(clientDNSLineRegex.FindAllString(config, -1), "")
+		rendered = clientDNSLineRegex.ReplaceAllLiteralString(rendered, "")
+		if loc := clientAddressRegex.FindStringIndex(rendered); loc != nil {
+			rendered = rendered[:loc[1]] + lines + rendered[loc[1]:]
+		}
+	}
+	return rendered, nil
+}
+
+// Regenerate every client config. Caller holds wgConfigMutex.
+func regenerateClientsLocked(c *gin.Context, req RegenerateClientsRequest) (RegenerateResult, error) {
+	result := RegenerateResult{Changed: []RegeneratedClient{}, Skipped: []SkippedClient{}, DryRun: req.DryRun}
+	if err := reloadWGParams(); err != nil {
+		return result, err
+	}
+
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return result, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	groupsMutex.Lock()
+	groups, err := loadGroupsLocked()
+	groupsMutex.Unlock()
+	if err != nil {
+		return result, err
+	}
+	groupOf := make(map[string]*ClientGroup)
+	for _, group := range groups {
+		for name := range group.Members {
+			groupOf[name] = group
+		}
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, section := range scanClientSections(content) {
+		if !seen[section.name] {
+			seen[section.name] = true
+			names = append(names, section.name)
+		}
+	}
+
+	for i, name := range names {
+		reportJobProgress(c, i, len(names))
+		path := clientConfigFile(name)
+		if path == "" {
+			result.Skipped = append(result.Skipped, SkippedClient{Name: name, Reason: "no config file"})
+			continue
+		}
+		config, err := os.ReadFile(path)
+		if err != nil {
+			return result, fmt.Errorf("failed to read client config: %v", err)
+		}
+		rendered, err := regenerateClientConfig(string(config), groupOf[name], req.KeepDNS)
+		if err != nil {
+			result.Skipped = append(result.Skipped, SkippedClient{Name: name, Reason: err.Error()})
+			continue
+		}
+		if rendered == string(config) {
+			result.Unchanged++
+			continue
+		}
+		if !req.DryRun {
+			if err := os.WriteFile(path, []byte(rendered), 0600); err != nil {
+				return result, fmt.Errorf("failed to write client config: %v", err)
+			}
+		}
+		result.Changed = append(result.Changed, RegeneratedClient{Name: name, File: filepath.Base(path)})
+	}
+	reportJobProgress(c, len(names), len(names))
+	return result, nil
+}
+
+// Handler re-rendering every client config from the current params
+func regenerateClientsHandlerGin(c *gin.Context) {
+	var req RegenerateClientsRequest
+	if c.Request.ContentLength > 0 {
+		if !bindJSON(c, &req) {
+			return
+		}
+	}
+
+	wgConfigMutex.Lock()
+	result, err := regenerateClientsLocked(c, req)
+	wgConfigMutex.Unlock()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	message := fmt.Sprintf("Re-rendered %d client configs", len(result.Changed))
+	if req.DryRun {
+		message = fmt.Sprintf("%d client configs would change", len(result.Changed))
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    result,
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRegenerateClients(t *testing.T) {
+	env := setupTestEnv(t)
+	alice := addedClient(t, env, "alice")
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{
+		Name:       "bob",
+		DNS:        &ClientDNS{Servers: []string{"10.0.0.53"}},
+		KillSwitch: killSwitchNft,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("adding bob: status %d, %s", rec.Code, rec.Body.String())
+	}
+
+	wgParams.ServerPubIP = "vpn.example.com"
+	wgParams.ClientDNS1, wgParams.ClientDNS2 = "9.9.9.9", ""
+
+	regenerate := func(req RegenerateClientsRequest) RegenerateResult {
+		t.Helper()
+		rec := env.authedRequest(t, http.MethodPost, "/api/v1/server/regenerate-clients", req)
+		var resp struct {
+			Data RegenerateResult `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("regenerate: status %d, %s", rec.Code, rec.Body.String())
+		}
+		return resp.Data
+	}
+	config := func(name string) string {
+		t.Helper()
+		return readFile(t, clientConfigFile(name))
+	}
+
+	if result := regenerate(RegenerateClientsRequest{DryRun: true}); len(result.Changed) != 2 {
+		t.Errorf("dry run: got %+v, want both clients changed", result)
+	}
+	if config("alice") != alice.Config {
+		t.Error("dry run rewrote alice's config")
+	}
+
+	result := regenerate(RegenerateClientsRequest{KeepDNS: true})
+	if len(result.Changed) != 2 || result.Changed[0].File != "wg0-client-alice.conf" {
+		t.Errorf("got %+v, want both clients changed", result)
+	}
+	bob := config("bob")
+	if !strings.Contains(bob, "Endpoint = vpn.example.com:51820") || !strings.Contains(bob, "DNS = 10.0.0.53\n") || configKillSwitch(bob) != killSwitchNft {
+		t.Errorf("bob's config:\n%s", bob)
+	}
+
+	regenerate(RegenerateClientsRequest{})
+	regenerated := config("alice")
+	if !strings.Contains(regenerated, "Endpoint = vpn.example.com:51820") || !strings.Contains(regenerated, "DNS = 9.9.9.9\n") {
+		t.Errorf("alice's config:\n%s", regenerated)
+	}
+	// Keys and addresses stay
+	for _, re := range []*regexp.Regexp{configPrivateKeyRegex, configPresharedKeyRegex, configAddressRegex} {
+		if re.FindString(regenerated) != re.FindString(alice.Config) {
+			t.Errorf("%s changed: %q, was %q", re, re.FindString(regenerated), re.FindString(alice.Config))
+		}
+	}
+	if !strings.Contains(config("bob"), "DNS = 9.9.9.9\n") {
+		t.Errorf("bob's config without keep_dns:\n%s", config("bob"))
+	}
+
+	if result := regenerate(RegenerateClientsRequest{}); len(result.Changed) != 0 || result.Unchanged != 2 {
+		t.Errorf("second run: got %+v, want nothing changed", result)
+	}
+}
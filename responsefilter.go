@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Client configs and keys are only sent to callers entitled to them.
+// READONLY_TOKENS can call GET routes and GraphQL queries but never see
+// them, and with RESPONSE_SECRETS=opt-in the API and tenant tokens only get
+// them when asking with ?include=secrets. The fields are taken out of JSON
+// responses as they leave, so every route is covered, and the client list
+// doesn't read the configs in the first place.
+
+const (
+	responseSecretsAlways = "always"
+	responseSecretsOptIn  = "opt-in"
+)
+
+// JSON fields holding configs or keys
+var secretResponseFields = map[string]bool{
+	"config":        true,
+	"private_key":   true,
+	"preshared_key": true,
+}
+
+func checkResponseSecretsConfig() error {
+	if RESPONSE_SECRETS != responseSecretsAlways && RESPONSE_SECRETS != responseSecretsOptIn {
+		return fmt.Errorf("RESPONSE_SECRETS must be %s or %s", responseSecretsAlways, responseSecretsOptIn)
+	}
+	return nil
+}
+
+func readOnlyTokens() map[string]bool {
+	tokens := map[string]bool{}
+	for _, token := range splitList(secretValue(&READONLY_TOKENS)) {
+		if !isAPIToken(token) {
+			tokens[token] = true
+		}
+	}
+	return tokens
+}
+
+// POSTs that only read, relative to the API version prefix. GraphQL
+// refuses its mutations itself.
+var readingPostRoutes = map[string]bool{
+	"POST /graphql":      true,
+	"POST /users/status": true,
+	"POST /lint":         true,
+}
+
+// Whether a POST only reads: one of readingPostRoutes or a dry run of a
+// service action
+func postOnlyReads(c *gin.Context) bool {
+	return readingPostRoutes[apiRoute(c)] || serviceDryRun(c)
+}
+
+// Read-only tokens can read, and query through GraphQL
+func readOnlyAllowed(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	}
+	return postOnlyReads(c)
+}
+
+func includesSecrets(c *gin.Context) bool {
+	for _, include := range splitList(c.Query("include")) {
+		if include == "secrets" {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the response may carry configs and keys
+func includeSecrets(c *gin.Context) bool {
+	if c.GetBool("readonly") {
+		return false
+	}
+	if RESPONSE_SECRETS == responseSecretsOptIn {
+		return includesSecrets(c)
+	}
+	return true
+}
+
+// Holds back the body so the secret fields can be taken out
+type secretFilterWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *secretFilterWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *secretFilterWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// Nothing reaches the client before the whole body is filtered
+func (w *secretFilterWriter) Flush() {}
+
+// Leave configs and keys out of the responses of callers not entitled to them
+func responseFilterMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Replays record the full response; it is filtered when served
+		if replayedRequest(c) || includeSecrets(c) {
+			c.Next()
+			return
+		}
+
+		writer := &secretFilterWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		body := writer.body.Bytes()
+		mediaType, _, _ := mime.ParseMediaType(c.Writer.Header().Get("Content-Type"))
+		if mediaType == gin.MIMEJSON && len(body) > 0 {
+			if filtered, err := stripJSONFields(body, secretResponseFields); err == nil {
+				body = filtered
+			}
+		}
+		c.Writer.Write(body)
+	}
+}
+
+// Drop the fields from every object in the JSON document, keeping the
+// order of everything else
+func stripJSONFields(data []byte, fields map[string]bool) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out bytes.Buffer
+
+	var value func() error
+	value = func() error {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := token.(json.Delim)
+		if !ok {
+			encoded, err := json.Marshal(token)
+			out.Write(encoded)
+			return err
+		}
+
+		out.WriteRune(rune(delim))
+		first := true
+		for dec.More() {
+			if delim == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if fields[key.(string)] {
+					var skipped json.RawMessage
+					if err := dec.Decode(&skipped); err != nil {
+						return err
+					}
+					continue
+				}
+				if !first {
+					out.WriteByte(',')
+				}
+				encoded, _ := json.Marshal(key)
+				out.Write(encoded)
+				out.WriteByte(':')
+			} else if !first {
+				out.WriteByte(',')
+			}
+			first = false
+			if err := value(); err != nil {
+				return err
+			}
+		}
+		end, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		out.WriteRune(rune(end.(json.Delim)))
+		return nil
+	}
+
+	if err := value(); err != nil {
+		return nil, err
+	}
+	// c.JSON ends without a newline, json.Encoder with one
+	if bytes.HasSuffix(data, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), nil
+}
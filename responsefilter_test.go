@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func setReadOnlyTokens(t *testing.T, tokens string) {
+	t.Helper()
+	old := READONLY_TOKENS
+	t.Cleanup(func() { READONLY_TOKENS = old })
+	READONLY_TOKENS = tokens
+}
+
+func TestReadOnlyTokens(t *testing.T) {
+	env := setupTestEnv(t)
+	setReadOnlyTokens(t, "reader-token")
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding failed with status %d", code)
+	}
+
+	for _, path := range []string{"/api/v1/users?include=config", "/api/v1/users/alice"} {
+		rec := env.request(t, http.MethodGet, path, nil, "reader-token")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"name":"alice"`) || strings.Contains(rec.Body.String(), "PrivateKey") ||
+			strings.Contains(rec.Body.String(), `"config"`) {
+			t.Errorf("%s: got status %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+	if body := env.authedRequest(t, http.MethodGet, "/api/v1/users/alice", nil).Body.String(); !strings.Contains(body, `"config"`) {
+		t.Errorf("the API token still gets configs: %s", body)
+	}
+	for _, req := range []struct {
+		method, path string
+	}{
+		{http.MethodPost, "/api/v1/users/add"},
+		{http.MethodPost, "/api/v1/users/delete"},
+		{http.MethodPost, "/api/v1/escrow/export"},
+		{http.MethodGet, "/api/v1/users?include=secrets"},
+	} {
+		if code := env.request(t, req.method, req.path, AddUserRequest{Name: "bob"}, "reader-token").Code; code != http.StatusForbidden {
+			t.Errorf("%s %s: got status %d, want 403", req.method, req.path, code)
+		}
+	}
+
+	// GraphQL queries work without configs, mutations don't
+	rec := env.request(t, http.MethodPost, "/api/v1/graphql", graphQLRequest{Query: `{ clients { name config } }`}, "reader-token")
+	if !strings.Contains(rec.Body.String(), `"name":"alice"`) || strings.Contains(rec.Body.String(), "PrivateKey") {
+		t.Errorf("graphql query: %s", rec.Body.String())
+	}
+	rec = env.request(t, http.MethodPost, "/api/v1/graphql", graphQLRequest{Query: `mutation { addClient(name: "bob") { name } }`}, "reader-token")
+	if !strings.Contains(rec.Body.String(), "Read-only tokens can only run queries") {
+		t.Errorf("graphql mutation: %s", rec.Body.String())
+	}
+}
+
+func TestResponseSecretsOptIn(t *testing.T) {
+	env := setupTestEnv(t)
+	RESPONSE_SECRETS = responseSecretsOptIn
+	t.Cleanup(func() { RESPONSE_SECRETS = responseSecretsAlways })
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "PrivateKey") || !strings.Contains(rec.Body.String(), `"ipv4"`) {
+		t.Errorf("add without include=secrets: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := env.authedRequest(t, http.MethodGet, "/api/v1/users/alice", nil).Body.String(); strings.Contains(body, "PrivateKey") {
+		t.Errorf("configs need include=secrets: %s", body)
+	}
+	for _, path := range []string{"/api/v1/users/alice?include=secrets", "/api/v1/users?include=config,secrets"} {
+		if body := env.authedRequest(t, http.MethodGet, path, nil).Body.String(); !strings.Contains(body, "PrivateKey") {
+			t.Errorf("%s must carry the config: %s", path, body)
+		}
+	}
+}
+
+func TestStripJSONFields(t *testing.T) {
+	input := `{"success":true,"data":[{"name":"a","config":"x","n":12345678901234567890,"nested":{"private_key":"k","z":null}},{"config":{"a":[1]},"name":"b"}],"message":"ok"}`
+	want := `{"success":true,"data":[{"name":"a","n":12345678901234567890,"nested":{"z":null}},{"name":"b"}],"message":"ok"}`
+	got, err := stripJSONFields([]byte(input), secretResponseFields)
+	if err != nil || string(got) != want {
+		t.Errorf("got %s, %v\nwant %s", got, err, want)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /users/roaming sums up the session tracker's history for every client
+// at once: how often it connected and from how many IPs and countries, for
+// roaming-usage reports. A config used on two devices at the same time
+// makes the peer's endpoint flip back and forth between their IPs, as each
+// handshake moves it; a returning IP within onlineHandshakeWindow marks the
+// client as a likely shared config. One device roaming between networks
+// rarely comes back that fast. ?since=24h limits the report to recent
+// history, which is kept in memory only.
+
+// One client's connections over the tracked history
+type RoamingSummary struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+	Sessions  int    `json:"sessions"`
+	// Times the endpoint moved to another IP
+	EndpointChanges   int        `json:"endpoint_changes"`
+	DistinctIPs       int        `json:"distinct_ips"`
+	DistinctCountries int        `json:"distinct_countries"`
+	FirstSeen         *time.Time `json:"first_seen,omitempty"`
+	LastSeen          *time.Time `json:"last_seen,omitempty"`
+	// The endpoint came back to an earlier IP within onlineHandshakeWindow
+	SharedSuspected bool `json:"shared_suspected"`
+}
+
+// Summarize the history of one peer from since on; the zero time takes
+// all of it
+func (t *sessionTracker) roamingSummary(publicKey string, since time.Time) RoamingSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	summary := RoamingSummary{PublicKey: publicKey}
+	history := t.peers[publicKey]
+	if history == nil {
+		return summary
+	}
+
+	for _, session := range history.sessions {
+		if !session.LastHandshake.Before(since) {
+			summary.Sessions++
+		}
+	}
+
+	ips := make(map[string]bool)
+	countries := make(map[string]bool)
+	lastSeen := make(map[string]time.Time) // IP to when the log last left it
+	var entries []EndpointChange
+	for _, entry := range history.endpoints {
+		if !entry.LastSeen.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			summary.EndpointChanges++
+		}
+		if left, ok := lastSeen[entry.IP]; ok && entry.FirstSeen.Sub(left) < onlineHandshakeWindow {
+			summary.SharedSuspected = true
+		}
+		lastSeen[entry.IP] = entry.LastSeen
+		ips[entry.IP] = true
+		if entry.Geo != nil && entry.Geo.CountryCode != "" {
+			countries[entry.Geo.CountryCode] = true
+		}
+	}
+	if n := len(entries); n > 0 {
+		first, last := entries[0].FirstSeen, entries[n-1].LastSeen
+		summary.FirstSeen, summary.LastSeen = &first, &last
+	}
+	summary.DistinctIPs, summary.DistinctCountries = len(ips), len(countries)
+	return summary
+}
+
+// Handler for the roaming report of every client
+func roamingReportHandlerGin(c *gin.Context) {
+	var since time.Time
+	if value := c.Query("since"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Message: "since must be a positive duration such as 24h",
+			})
+			return
+		}
+		since = time.Now().Add(-window)
+	}
+
+	inv, err := currentInventory()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	clients := make([]Client, 0, len(inv.keys))
+	for name, publicKey := range inv.keys {
+		clients = append(clients, Client{Name: name, PublicKey: publicKey})
+	}
+	clients = tenantFrom(c).ownClients(clients)
+
+	report := make([]RoamingSummary, 0, len(clients))
+	shared := 0
+	for _, client := range clients {
+		summary := sessions.roamingSummary(client.PublicKey, since)
+		summary.Name = client.Name
+		if summary.SharedSuspected {
+			shared++
+		}
+		report = append(report, summary)
+	}
+	// Most roaming first
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].DistinctIPs != report[j].DistinctIPs {
+			return report[i].DistinctIPs > report[j].DistinctIPs
+		}
+		return report[i].Name < report[j].Name
+	})
+
+	respondNegotiated(c, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"tracking":         SESSION_POLL_INTERVAL > 0,
+			"shared_suspected": shared,
+			"clients":          report,
+		},
+	}, func() [][]string {
+		rows := [][]string{{"name", "public_key", "sessions", "endpoint_changes", "distinct_ips",
+			"distinct_countries", "first_seen", "last_seen", "shared_suspected"}}
+		for _, summary := range report {
+			var firstSeen, lastSeen string
+			if summary.FirstSeen != nil {
+				firstSeen = summary.FirstSeen.UTC().Format(time.RFC3339)
+				lastSeen = summary.LastSeen.UTC().Format(time.RFC3339)
+			}
+			rows = append(rows, []string{
+				summary.Name,
+				summary.PublicKey,
+				strconv.Itoa(summary.Sessions),
+				strconv.Itoa(summary.EndpointChanges),
+				strconv.Itoa(summary.DistinctIPs),
+				strconv.Itoa(summary.DistinctCountries),
+				firstSeen,
+				lastSeen,
+				strconv.FormatBool(summary.SharedSuspected),
+			})
+		}
+		return rows
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRoamingSummary(t *testing.T) {
+	tracker := newSessionTracker()
+	start := time.Unix(1700000000, 0)
+
+	observe := func(key string, at time.Time, endpoint string) {
+		tracker.observe([]peerDump{
+			{PublicKey: key, Endpoint: endpoint, LatestHandshake: at.Unix()},
+		}, at)
+	}
+
+	// Roaming from home to the office and back in the evening
+	observe("pubA", start, "198.51.100.1:4000")
+	observe("pubA", start.Add(4*time.Hour), "203.0.113.7:4000")
+	observe("pubA", start.Add(10*time.Hour), "198.51.100.1:4001")
+
+	got := tracker.roamingSummary("pubA", time.Time{})
+	if got.Sessions != 3 || got.EndpointChanges != 2 || got.DistinctIPs != 2 || got.SharedSuspected {
+		t.Errorf("roaming: got %+v", got)
+	}
+	if !got.FirstSeen.Equal(start) || !got.LastSeen.Equal(start.Add(10*time.Hour)) {
+		t.Errorf("roaming: seen from %v to %v", got.FirstSeen, got.LastSeen)
+	}
+	if got := tracker.roamingSummary("pubA", start.Add(5*time.Hour)); got.Sessions != 1 || got.DistinctIPs != 1 || got.EndpointChanges != 0 {
+		t.Errorf("since: got %+v", got)
+	}
+
+	// Two devices on one config take turns within a minute
+	tracker = newSessionTracker()
+	observe("pubB", start, "198.51.100.1:4000")
+	observe("pubB", start.Add(30*time.Second), "203.0.113.7:4000")
+	observe("pubB", start.Add(time.Minute), "198.51.100.1:4000")
+	if got := tracker.roamingSummary("pubB", time.Time{}); !got.SharedSuspected || got.DistinctIPs != 2 {
+		t.Errorf("shared: got %+v", got)
+	}
+
+	if got := tracker.roamingSummary("unknown", time.Time{}); got.Sessions != 0 || got.FirstSeen != nil {
+		t.Errorf("unknown peer: got %+v", got)
+	}
+}
+
+func TestRoamingReportHandler(t *testing.T) {
+	env := setupTestEnv(t)
+
+	oldTracker := sessions
+	sessions = newSessionTracker()
+	t.Cleanup(func() { sessions = oldTracker })
+
+	alice := addedClient(t, env, "alice")
+	addedClient(t, env, "bob")
+
+	now := time.Now()
+	sessions.observe([]peerDump{{PublicKey: alice.PublicKey, Endpoint: "198.51.100.1:4000", LatestHandshake: now.Unix()}}, now)
+	sessions.observe([]peerDump{{PublicKey: alice.PublicKey, Endpoint: "203.0.113.9:4000", LatestHandshake: now.Unix() + 10}}, now.Add(10*time.Second))
+
+	recorder := env.authedRequest(t, http.MethodGet, "/api/v1/users/roaming?since=1h", nil)
+	var resp struct {
+		Data struct {
+			Clients []RoamingSummary `json:"clients"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+	if len(resp.Data.Clients) != 2 || resp.Data.Clients[0].Name != "alice" || resp.Data.Clients[0].DistinctIPs != 2 ||
+		resp.Data.Clients[1].Name != "bob" || resp.Data.Clients[1].Sessions != 0 {
+		t.Errorf("unexpected report %s", recorder.Body.String())
+	}
+
+	if code := env.authedRequest(t, http.MethodGet, "/api/v1/users/roaming?since=soon", nil).Code; code != http.StatusBadRequest {
+		t.Errorf("bad since: got status %d, want 400", code)
+	}
+}
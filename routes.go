@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A client can carry routed subnets, e.g. the LAN behind a site-to-site
+// peer. They are listed in the peer's AllowedIPs after its tunnel
+// addresses, so WireGuard sends their traffic to that peer, and the server
+// routes them into the interface. wg-quick only adds routes when the
+// interface comes up, so after every apply the kernel routes are brought in
+// line with the config. Routes added here are tagged with their own
+// protocol number so routes added by hand are never touched.
+
+// Route protocol of the routes managed here (see /etc/iproute2/rt_protos)
+const routeProto = "77"
+
+// ip binary, overridden in tests
+var ipCmd = "ip"
+
+// Whether this process installed routes, so peers can be applied without
+// running ip as long as no client ever had a routed subnet
+var routesManaged bool
+
+var (
+	allowedIPsLineRegex = regexp.MustCompile(`(?m)^(#?AllowedIPs = )(.*)$`)
+	errRouteOverlap     = errors.New("subnet overlaps")
+)
+
+type RoutesRequest struct {
+	Subnets []string `json:"subnets"`
+}
+
+// A routed subnet and whether the kernel route is in place
+type RoutedSubnet struct {
+	Client    string `json:"client"`
+	Subnet    string `json:"subnet"`
+	Installed bool   `json:"installed"`
+}
+
+// Split a peer's AllowedIPs into its tunnel addresses (the first IPv4 /32
+// and IPv6 /128) and its routed subnets
+func splitAllowedIPs(value string) ([]string, []string) {
+	var tunnel, routed []string
+	var haveIPv4, haveIPv6 bool
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case !haveIPv4 && strings.HasSuffix(entry, "/32") && !strings.Contains(entry, ":"):
+			haveIPv4 = true
+			tunnel = append(tunnel, entry)
+		case !haveIPv6 && strings.HasSuffix(entry, "/128"):
+			haveIPv6 = true
+			tunnel = append(tunnel, entry)
+		default:
+			routed = append(routed, entry)
+		}
+	}
+	return tunnel, routed
+}
+
+// Routed subnets of every client in the server config content, including
+// disabled ones when withDisabled is set
+func routedSubnetsByClient(content []byte, withDisabled bool) map[string][]string {
+	routes := make(map[string][]string)
+	blockRegex := regexp.MustCompile(`(?ms)^### Client (.+?)\n(.*?)(?:^$|\z)`)
+	for _, match := range blockRegex.FindAllSubmatch(content, -1) {
+		line := allowedIPsLineRegex.FindSubmatch(match[2])
+		if line == nil || (!withDisabled && strings.HasPrefix(string(line[1]), "#")) {
+			continue
+		}
+		if _, routed := splitAllowedIPs(string(line[2])); len(routed) > 0 {
+			routes[string(match[1])] = routed
+		}
+	}
+	return routes
+}
+
+// Tunnel IPv4 and IPv6 address, without prefix length, of every client in
+// the server config content, disabled ones included
+func tunnelAddressesByClient(content []byte) map[string][2]string {
+	addresses := make(map[string][2]string)
+	blockRegex := regexp.MustCompile(`(?ms)^### Client (.+?)\n(.*?)(?:^$|\z)`)
+	for _, match := range blockRegex.FindAllSubmatch(content, -1) {
+		line := allowedIPsLineRegex.FindSubmatch(match[2])
+		if line == nil {
+			continue
+		}
+		tunnel, _ := splitAllowedIPs(string(line[2]))
+		var pair [2]string
+		for _, address := range tunnel {
+			if strings.Contains(address, ":") {
+				pair[1] = strings.TrimSuffix(address, "/128")
+			} else {
+				pair[0] = strings.TrimSuffix(address, "/32")
+			}
+		}
+		addresses[string(match[1])] = pair
+	}
+	return addresses
+}
+
+// Check that subnets can be routed to name: valid, outside the VPN's own
+// address space and not routed to another client
+func validateRoutedSubnets(content []byte, name string, subnets []string) ([]string, error) {
+	vpnNets := vpnSubnets()
+
+	taken := make(map[string][]*net.IPNet)
+	for client, routed := range routedSubnetsByClient(content, true) {
+		if client == name {
+			continue
+		}
+		for _, subnet := range routed {
+			if _, ipNet, err := net.ParseCIDR(subnet); err == nil {
+				taken[client] = append(taken[client], ipNet)
+			}
+		}
+	}
+
+	normalized := make([]string, 0, len(subnets))
+	for _, subnet := range subnets {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR", subnet)
+		}
+		for _, vpnNet := range vpnNets {
+			if netsOverlap(ipNet, vpnNet) {
+				return nil, fmt.Errorf("%s overlaps the VPN subnet %s", ipNet, vpnNet)
+			}
+		}
+		for client, others := range taken {
+			for _, other := range others {
+				if netsOverlap(ipNet, other) {
+					return nil, fmt.Errorf("%w %s, routed to %s", errRouteOverlap, other, client)
+				}
+			}
+		}
+		normalized = append(normalized, ipNet.String())
+	}
+	return normalized, nil
+}
+
+// The address space clients are allocated from: the server's IPv4 /16 and
+// IPv6 /64
+func vpnSubnets() []*net.IPNet {
+	var vpnNets []*net.IPNet
+	if base := ipv4Base(wgParams.ServerWGIPv4); base != "" {
+		_, vpnNet, _ := net.ParseCIDR(base + ".0.0/16")
+		vpnNets = append(vpnNets, vpnNet)
+	}
+	if wgParams.ServerWGIPv6 != "" {
+		if _, vpnNet, err := net.ParseCIDR(strings.Split(wgParams.ServerWGIPv6, "/")[0] + "/64"); err == nil {
+			vpnNets = append(vpnNets, vpnNet)
+		}
+	}
+	return vpnNets
+}
+
+func netsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// First two octets of an IPv4 address, as used by the /16 allocator
+func ipv4Base(ip string) string {
+	parts := strings.Split(ip, ".")
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// Replace the routed subnets in a client's AllowedIPs. Caller holds
+// wgConfigMutex and syncs afterwards.
+func setRoutedSubnetsLocked(name string, subnets []string) error {
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+
+	blockRegex := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(name) + `\n.*?(?:^$|\z)`)
+	loc := blockRegex.FindIndex(content)
+	if loc == nil {
+		return errClientNotFound
+	}
+	block := content[loc[0]:loc[1]]
+	line := allowedIPsLineRegex.FindSubmatchIndex(block)
+	if line == nil {
+		return fmt.Errorf("client %s has no AllowedIPs", name)
+	}
+
+	tunnel, _ := splitAllowedIPs(string(block[line[4]:line[5]]))
+	updatedBlock := append([]byte{}, block[:line[4]]...)
+	updatedBlock = append(updatedBlock, strings.Join(append(tunnel, subnets...), ",")...)
+	updatedBlock = append(updatedBlock, block[line[5]:]...)
+
+	updated := append([]byte{}, content[:loc[0]]...)
+	updated = append(updated, updatedBlock...)
+	updated = append(updated, content[loc[1]:]...)
+	if err := os.WriteFile(WG_CONFIG_FILE, updated, 0600); err != nil {
+		return fmt.Errorf("failed to update server config: %v", err)
+	}
+	return nil
+}
+
+// Managed routes currently in the kernel for the interface
+func installedRoutes() (map[string]bool, error) {
+	routes := make(map[string]bool)
+	for _, family := range []string{"-4", "-6"} {
+		success, output := executeCommand(ipCmd, family, "route", "show", "dev", wgParams.ServerWGNIC, "proto", routeProto)
+		if success != "success" {
+			return nil, fmt.Errorf("failed to list routes: %s", output)
+		}
+		for _, line := range strings.Split(output, "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				routes[fields[0]] = true
+			}
+		}
+	}
+	return routes, nil
+}
+
+// Add missing routes for the enabled clients' subnets and remove routes of
+// subnets no longer in the config. Caller holds wgConfigMutex.
+func reconcileRoutesLocked() error {
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	desired := make(map[string]bool)
+	for _, routed := range routedSubnetsByClient(content, false) {
+		for _, subnet := range routed {
+			desired[subnet] = true
+		}
+	}
+	if len(desired) == 0 && !routesManaged {
+		return nil
+	}
+
+	installed, err := installedRoutes()
+	if err != nil {
+		return err
+	}
+	for _, subnet := range sortedKeys(desired) {
+		if installed[subnet] {
+			continue
+		}
+		if success, output := executeCommand(ipCmd, "route", "replace", subnet, "dev", wgParams.ServerWGNIC, "proto", routeProto); success != "success" {
+			return fmt.Errorf("failed to add route %s: %s", subnet, output)
+		}
+	}
+	for _, subnet := range sortedKeys(installed) {
+		if desired[subnet] {
+			continue
+		}
+		if success, output := executeCommand(ipCmd, "route", "del", subnet, "dev", wgParams.ServerWGNIC, "proto", routeProto); success != "success" {
+			return fmt.Errorf("failed to remove route %s: %s", subnet, output)
+		}
+	}
+	routesManaged = len(desired) > 0
+	return nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Routed subnets of every client with their kernel route state, for status
+func routedSubnetStatus() []RoutedSubnet {
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return nil
+	}
+	byClient := routedSubnetsByClient(content, true)
+	if len(byClient) == 0 {
+		return []RoutedSubnet{}
+	}
+
+	installed, err := installedRoutes()
+	if err != nil && DEBUG_MODE {
+		log.Printf("Failed to list routes: %v", err)
+	}
+	status := []RoutedSubnet{}
+	for client, routed := range byClient {
+		for _, subnet := range routed {
+			status = append(status, RoutedSubnet{Client: client, Subnet: subnet, Installed: installed[subnet]})
+		}
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Subnet < status[j].Subnet })
+	return status
+}
+
+// Handler listing a client's routed subnets
+func clientRoutesHandlerGin(c *gin.Context) {
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+	name := c.Param("name")
+	if exists, _ := clientExists(name); !exists {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: errClientNotFound.Error(),
+		})
+		return
+	}
+
+	subnets := routedSubnetsByClient(content, true)[name]
+	if subnets == nil {
+		subnets = []string{}
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    map[string]interface{}{"name": name, "subnets": subnets},
+	})
+}
+
+// Handler replacing a client's routed subnets; an empty list removes them
+func setClientRoutesHandlerGin(c *gin.Context) {
+	var req RoutesRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Subnets == nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "subnets must be a list of CIDRs",
+		})
+		return
+	}
+
+	name := c.Param("name")
+	status, subnets, err := func() (int, []string, error) {
+		wgConfigMutex.Lock()
+		defer wgConfigMutex.Unlock()
+
+		content, err := os.ReadFile(WG_CONFIG_FILE)
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		subnets, err := validateRoutedSubnets(content, name, req.Subnets)
+		if errors.Is(err, errRouteOverlap) {
+			return http.StatusConflict, nil, err
+		}
+		if err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		if err := setRoutedSubnetsLocked(name, subnets); errors.Is(err, errClientNotFound) {
+			return http.StatusNotFound, nil, err
+		} else if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		if err := syncWireGuardConf(); err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		return http.StatusOK, subnets, nil
+	}()
+	if err != nil {
+		c.JSON(status, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Routed subnets updated",
+		Data:    map[string]interface{}{"name": name, "subnets": subnets},
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeIPScript keeps the routes of the VPN interface in ip.routes, one
+// destination per line, and ip rules in ip.rules, prefixed by their family.
+// Every call is logged to ip.log.
+const fakeIPScript = `#!/bin/bash
+dir="$(dirname "$0")"
+routes="$dir/ip.routes"
+rules="$dir/ip.rules"
+touch "$routes" "$rules"
+echo "$*" >> "$dir/ip.log"
+family=-4
+case "$1" in -4|-6) family="$1"; shift ;; esac
+case "$1 $2" in
+  "route show") if [ "$family" = -6 ]; then grep : "$routes"; else grep -v : "$routes"; fi ;;
+  "route replace") [ "$3" = default ] || grep -qxF "$3" "$routes" || echo "$3" >> "$routes" ;;
+  "route del") grep -vxF "$3" "$routes" > "$routes.new"; mv "$routes.new" "$routes" ;;
+  "rule show") grep -- "^$family " "$rules" | cut -d' ' -f2- ;;
+  "rule add") echo "$family 10000:	from all fwmark $4 lookup $6 proto 77" >> "$rules" ;;
+  "rule del") grep -vF -- "$family 10000:	from all fwmark $4 lookup $6 " "$rules" > "$rules.new"; mv "$rules.new" "$rules" ;;
+esac
+exit 0
+`
+
+// Point ipCmd at fakeIPScript; returns the path of the route list
+func setupFakeIP(t *testing.T, env *testEnv) string {
+	t.Helper()
+	script := filepath.Join(env.dir, "ip")
+	if err := os.WriteFile(script, []byte(fakeIPScript), 0755); err != nil {
+		t.Fatalf("writing fake ip script: %v", err)
+	}
+	oldIPCmd := ipCmd
+	ipCmd = script
+	t.Cleanup(func() { ipCmd = oldIPCmd })
+	return filepath.Join(env.dir, "ip.routes")
+}
+
+func TestRoutedSubnetsFollowClient(t *testing.T) {
+	env := setupTestEnv(t)
+	routesFile := setupFakeIP(t, env)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "site"})
+
+	req := RoutesRequest{Subnets: []string{"192.168.10.1/24", "fd00:10::/64"}}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/site/routes", req).Code; code != http.StatusOK {
+		t.Fatalf("set routes: got status %d", code)
+	}
+	if config := env.configContent(t); !strings.Contains(config, "AllowedIPs = 10.66.0.2/32,192.168.10.0/24,fd00:10::/64\n") {
+		t.Errorf("AllowedIPs must carry the normalized subnets:\n%s", config)
+	}
+	if routes := readFile(t, routesFile); routes != "192.168.10.0/24\nfd00:10::/64\n" {
+		t.Errorf("routes = %q", routes)
+	}
+
+	body := env.authedRequest(t, http.MethodGet, "/api/v1/users/site/routes", nil).Body.String()
+	if !strings.Contains(body, `"subnets":["192.168.10.0/24","fd00:10::/64"]`) {
+		t.Errorf("unexpected routes: %s", body)
+	}
+	routed := routedSubnetStatus()
+	if len(routed) != 2 || !routed[0].Installed || routed[0].Client != "site" {
+		t.Errorf("status = %+v", routed)
+	}
+
+	// A disabled client's routes are withdrawn and come back when enabled
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/add", ProjectRequest{Name: "sites"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/sites/clients/add", ProjectClientsRequest{Names: []string{"site"}})
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/sites/disable", nil)
+	if routes := readFile(t, routesFile); routes != "" {
+		t.Errorf("disabled client must have no routes: %q", routes)
+	}
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/sites/enable", nil)
+	if routes := readFile(t, routesFile); !strings.Contains(routes, "192.168.10.0/24") {
+		t.Errorf("enabled client must get its routes back: %q", routes)
+	}
+
+	// Deleting the client removes its routes
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "site"})
+	if routes := readFile(t, routesFile); routes != "" {
+		t.Errorf("deleted client must have no routes: %q", routes)
+	}
+}
+
+func TestRoutedSubnetsValidation(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeIP(t, env)
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/routes", RoutesRequest{Subnets: []string{"192.168.10.0/24"}})
+
+	for _, tc := range []struct {
+		name string
+		body any
+		want int
+	}{
+		{"bob", map[string]any{}, http.StatusBadRequest},
+		{"bob", RoutesRequest{Subnets: []string{"not-a-cidr"}}, http.StatusBadRequest},
+		{"bob", RoutesRequest{Subnets: []string{"10.66.5.0/24"}}, http.StatusBadRequest},
+		{"bob", RoutesRequest{Subnets: []string{"192.168.0.0/16"}}, http.StatusConflict},
+		{"ghost", RoutesRequest{Subnets: []string{"192.168.20.0/24"}}, http.StatusNotFound},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/"+tc.name+"/routes", tc.body).Code; code != tc.want {
+			t.Errorf("%s %+v: got status %d, want %d", tc.name, tc.body, code, tc.want)
+		}
+	}
+
+	// An empty list clears the subnets, leaving the tunnel address
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/routes", RoutesRequest{Subnets: []string{}}).Code; code != http.StatusOK {
+		t.Fatalf("clear routes: got status %d", code)
+	}
+	if config := env.configContent(t); !strings.Contains(config, "AllowedIPs = 10.66.0.2/32\n") {
+		t.Errorf("subnets must be removed:\n%s", config)
+	}
+}
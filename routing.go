@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Routing profiles send a project's traffic out of a specific uplink on
+// servers with several. A profile names a routing table, the uplink's
+// device and gateway, and a firewall mark (the table number by default).
+// Packets from the tunnel IPs of clients in projects using the profile are
+// marked in the firewall table (see firewall.go), unless they go to another
+// peer; an ip rule looks marked packets up in the profile's table, whose
+// default route leads out of the uplink, where they are masqueraded.
+//
+// The marks follow the clients like the rest of the table. The ip rules and
+// table routes are applied with it and tagged with routeProto, like the
+// routes of routed subnets, so rules added by hand are left alone.
+
+// Priority of the managed ip rules, ahead of the main table (32766)
+const routingRulePriority = "10000"
+
+type RoutingProfile struct {
+	Name string `json:"name"`
+	// Routing table number; 253-255 are the kernel's own tables
+	Table int `json:"table"`
+	// Firewall mark, the table number when 0
+	Fwmark int `json:"fwmark,omitempty"`
+	// Uplink interface and, unless it is point-to-point, its gateway
+	Device  string `json:"device"`
+	Gateway string `json:"gateway,omitempty"`
+}
+
+type ProjectRoutingRequest struct {
+	// Empty routes the project through the main table again
+	Profile string `json:"profile"`
+}
+
+type DeleteRoutingProfileRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// A profile with the clients whose traffic it marks, for rendering
+type routingMark struct {
+	mark    int
+	device  string
+	clients map[string]bool
+}
+
+// A managed ip rule as listed by ip rule show
+type routingRule struct {
+	mark, table int
+}
+
+var (
+	routingProfileNameRegex   = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+	routingRuleRegex          = regexp.MustCompile(`fwmark (0x[0-9a-f]+|\d+) lookup (\d+)`)
+	errRoutingProfileNotFound = errors.New("Routing profile not found")
+	errRoutingProfileConflict = errors.New("table or fwmark already used by profile")
+	errRoutingProfileInUse    = errors.New("Routing profile is used by project")
+)
+
+// Whether this process installed ip rules, so peers can be applied without
+// running ip as long as no profile was ever set
+var routingManaged bool
+
+// ROUTING_PROFILES_FILE, or routing-profiles.json next to the server config
+func routingProfilesFile() string {
+	if ROUTING_PROFILES_FILE != "" {
+		return ROUTING_PROFILES_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "routing-profiles.json")
+}
+
+// Caller holds firewallMutex
+func loadRoutingProfilesLocked() (map[string]*RoutingProfile, error) {
+	profiles := make(map[string]*RoutingProfile)
+	content, err := os.ReadFile(routingProfilesFile())
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing profiles file: %v", err)
+	}
+	if err := json.Unmarshal(content, &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse routing profiles file: %v", err)
+	}
+	return profiles, nil
+}
+
+// Caller holds firewallMutex
+func saveRoutingProfilesLocked(profiles map[string]*RoutingProfile) error {
+	content, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(routingProfilesFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write routing profiles file: %v", err)
+	}
+	return nil
+}
+
+func (p *RoutingProfile) mark() int {
+	if p.Fwmark != 0 {
+		return p.Fwmark
+	}
+	return p.Table
+}
+
+func validateRoutingProfile(profile *RoutingProfile) error {
+	if !routingProfileNameRegex.MatchString(profile.Name) {
+		return fmt.Errorf("name must be 1-32 letters, digits, '-' or '_'")
+	}
+	if profile.Table < 1 || profile.Table > 252 && profile.Table < 256 {
+		return fmt.Errorf("table must be a positive number other than 253-255")
+	}
+	if profile.Fwmark < 0 {
+		return fmt.Errorf("fwmark must be positive")
+	}
+	if profile.Device == "" {
+		return fmt.Errorf("device is required")
+	}
+	if profile.Gateway != "" && net.ParseIP(profile.Gateway) == nil {
+		return fmt.Errorf("gateway %q is not an IP", profile.Gateway)
+	}
+	return nil
+}
+
+// Marks of the profiles in use, with the members of the projects using
+// them. Caller holds firewallMutex.
+func loadRoutingMarksLocked(profiles map[string]*RoutingProfile) ([]routingMark, error) {
+	projectsMutex.Lock()
+	projects, err := loadProjectsLocked()
+	projectsMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	byProfile := make(map[string]map[string]bool)
+	for _, project := range projects {
+		if profiles[project.RoutingProfile] == nil {
+			continue
+		}
+		if byProfile[project.RoutingProfile] == nil {
+			byProfile[project.RoutingProfile] = make(map[string]bool)
+		}
+		for _, name := range project.Clients {
+			byProfile[project.RoutingProfile][name] = true
+		}
+	}
+
+	var marks []routingMark
+	for name, clients := range byProfile {
+		profile := profiles[name]
+		marks = append(marks, routingMark{mark: profile.mark(), device: profile.Device, clients: clients})
+	}
+	sort.Slice(marks, func(i, j int) bool { return marks[i].mark < marks[j].mark })
+	return marks, nil
+}
+
+// Uplinks of the profiles in use, which need the same forwarding and
+// masquerading as the NAT egress interface
+func routingDevices(marks []routingMark) []string {
+	devices := make([]string, 0, len(marks))
+	for _, mark := range marks {
+		devices = append(devices, mark.device)
+	}
+	return devices
+}
+
+// Rules of the prerouting chain marking the members' traffic, except to
+// the VPN's own address space
+func renderRoutingMarks(nic string, clients []Client, marks []routingMark) []string {
+	exclude := map[string]string{}
+	for _, vpnNet := range vpnSubnets() {
+		family := "ip"
+		if vpnNet.IP.To4() == nil {
+			family = "ip6"
+		}
+		exclude[family] = vpnNet.String()
+	}
+
+	var rules []string
+	for _, mark := range marks {
+		var ipv4, ipv6 []string
+		for _, client := range clients {
+			if !mark.clients[client.Name] || client.Disabled {
+				continue
+			}
+			if client.IPV4 != "" {
+				ipv4 = append(ipv4, client.IPV4)
+			}
+			if client.IPV6 != "" {
+				ipv6 = append(ipv6, client.IPV6)
+			}
+		}
+		for _, family := range []struct {
+			name      string
+			addresses []string
+		}{{"ip", ipv4}, {"ip6", ipv6}} {
+			if len(family.addresses) == 0 {
+				continue
+			}
+			rule := fmt.Sprintf("iifname %q %s saddr { %s }", nic, family.name, strings.Join(family.addresses, ", "))
+			if vpnNet := exclude[family.name]; vpnNet != "" {
+				rule += fmt.Sprintf(" %s daddr != %s", family.name, vpnNet)
+			}
+			rules = append(rules, fmt.Sprintf("%s meta mark set 0x%x", rule, mark.mark))
+		}
+	}
+	return rules
+}
+
+// Managed ip rules of a family ("-4" or "-6")
+func installedRoutingRules(family string) (map[routingRule]bool, error) {
+	success, output := executeCommand(ipCmd, family, "rule", "show")
+	if success != "success" {
+		return nil, fmt.Errorf("failed to list ip rules: %s", output)
+	}
+	rules := make(map[routingRule]bool)
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(line, "proto "+routeProto) {
+			continue
+		}
+		match := routingRuleRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		mark, _ := strconv.ParseInt(match[1], 0, 64)
+		table, _ := strconv.Atoi(match[2])
+		rules[routingRule{mark: int(mark), table: table}] = true
+	}
+	return rules, nil
+}
+
+// Bring the ip rules and the profiles' default routes in line with the
+// profiles. Rules of deleted profiles are removed and their tables flushed.
+// Caller holds firewallMutex.
+func applyPolicyRoutingLocked(profiles map[string]*RoutingProfile) error {
+	if len(profiles) == 0 && !routingManaged {
+		return nil
+	}
+
+	desired := make(map[routingRule]bool, len(profiles))
+	for _, profile := range profiles {
+		desired[routingRule{mark: profile.mark(), table: profile.Table}] = true
+	}
+
+	for _, family := range []string{"-4", "-6"} {
+		installed, err := installedRoutingRules(family)
+		if err != nil {
+			return err
+		}
+		for rule := range installed {
+			if desired[rule] {
+				continue
+			}
+			mark, table := fmt.Sprintf("0x%x", rule.mark), strconv.Itoa(rule.table)
+			if success, output := executeCommand(ipCmd, family, "rule", "del", "fwmark", mark, "lookup", table, "priority", routingRulePriority); success != "success" {
+				return fmt.Errorf("failed to remove ip rule: %s", output)
+			}
+			if success, output := executeCommand(ipCmd, family, "route", "flush", "table", table, "proto", routeProto); success != "success" {
+				return fmt.Errorf("failed to flush table %s: %s", table, output)
+			}
+		}
+		for rule := range desired {
+			if installed[rule] {
+				continue
+			}
+			mark, table := fmt.Sprintf("0x%x", rule.mark), strconv.Itoa(rule.table)
+			if success, output := executeCommand(ipCmd, family, "rule", "add", "fwmark", mark, "lookup", table, "priority", routingRulePriority, "proto", routeProto); success != "success" {
+				return fmt.Errorf("failed to add ip rule: %s", output)
+			}
+		}
+	}
+
+	for _, profile := range profiles {
+		families := []string{"-4", "-6"}
+		args := []string{"route", "replace", "default"}
+		if profile.Gateway != "" {
+			families = []string{"-4"}
+			if strings.Contains(profile.Gateway, ":") {
+				families = []string{"-6"}
+			}
+			args = append(args, "via", profile.Gateway)
+		}
+		args = append(args, "dev", profile.Device, "table", strconv.Itoa(profile.Table), "proto", routeProto)
+		for _, family := range families {
+			if success, output := executeCommand(ipCmd, append([]string{family}, args...)...); success != "success" {
+				return fmt.Errorf("failed to set the default route of %s: %s", profile.Name, output)
+			}
+		}
+	}
+	routingManaged = len(profiles) > 0
+	return nil
+}
+
+// Change the profiles with fn and apply the table and rules
+func updateRoutingProfiles(fn func(profiles map[string]*RoutingProfile) error) error {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	err := func() error {
+		firewallMutex.Lock()
+		defer firewallMutex.Unlock()
+
+		profiles, err := loadRoutingProfilesLocked()
+		if err != nil {
+			return err
+		}
+		if err := fn(profiles); err != nil {
+			return err
+		}
+		return saveRoutingProfilesLocked(profiles)
+	}()
+	if err != nil {
+		return err
+	}
+	return applyFirewallLocked()
+}
+
+func respondRoutingError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errRoutingProfileNotFound), errors.Is(err, errProjectNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errRoutingProfileConflict), errors.Is(err, errRoutingProfileInUse):
+		status = http.StatusConflict
+	}
+	c.JSON(status, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    errorCode(err),
+	})
+}
+
+// Handler listing the profiles with the projects using them
+func listRoutingProfilesHandlerGin(c *gin.Context) {
+	firewallMutex.Lock()
+	profiles, err := loadRoutingProfilesLocked()
+	firewallMutex.Unlock()
+	if err != nil {
+		respondRoutingError(c, err)
+		return
+	}
+	projectsMutex.Lock()
+	projects, err := loadProjectsLocked()
+	projectsMutex.Unlock()
+	if err != nil {
+		respondRoutingError(c, err)
+		return
+	}
+
+	usedBy := make(map[string][]string)
+	for _, project := range projects {
+		if project.RoutingProfile != "" {
+			usedBy[project.RoutingProfile] = append(usedBy[project.RoutingProfile], project.Name)
+		}
+	}
+	list := []map[string]interface{}{}
+	for _, profile := range profiles {
+		sort.Strings(usedBy[profile.Name])
+		projectNames := usedBy[profile.Name]
+		if projectNames == nil {
+			projectNames = []string{}
+		}
+		list = append(list, map[string]interface{}{
+			"name":     profile.Name,
+			"table":    profile.Table,
+			"fwmark":   profile.mark(),
+			"device":   profile.Device,
+			"gateway":  profile.Gateway,
+			"projects": projectNames,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["name"].(string) < list[j]["name"].(string) })
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    list,
+	})
+}
+
+// Handler creating or replacing a profile
+func setRoutingProfileHandlerGin(c *gin.Context) {
+	var profile RoutingProfile
+	if !bindJSON(c, &profile) {
+		return
+	}
+	if err := validateRoutingProfile(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	err := updateRoutingProfiles(func(profiles map[string]*RoutingProfile) error {
+		for _, other := range profiles {
+			if other.Name != profile.Name && (other.Table == profile.Table || other.mark() == profile.mark()) {
+				return fmt.Errorf("%w %s", errRoutingProfileConflict, other.Name)
+			}
+		}
+		profiles[profile.Name] = &profile
+		return nil
+	})
+	if err != nil {
+		respondRoutingError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Routing profile applied",
+		Data:    profile,
+	})
+}
+
+// Handler removing a profile no project uses
+func deleteRoutingProfileHandlerGin(c *gin.Context) {
+	var req DeleteRoutingProfileRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	err := updateRoutingProfiles(func(profiles map[string]*RoutingProfile) error {
+		if profiles[req.Name] == nil {
+			return errRoutingProfileNotFound
+		}
+		projectsMutex.Lock()
+		projects, err := loadProjectsLocked()
+		projectsMutex.Unlock()
+		if err != nil {
+			return err
+		}
+		for _, project := range projects {
+			if project.RoutingProfile == req.Name {
+				return fmt.Errorf("%w: %s", errRoutingProfileInUse, project.Name)
+			}
+		}
+		delete(profiles, req.Name)
+		return nil
+	})
+	if err != nil {
+		respondRoutingError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Routing profile removed",
+	})
+}
+
+// Handler routing a project's clients through a profile, or back through
+// the main table
+func setProjectRoutingHandlerGin(c *gin.Context) {
+	var req ProjectRoutingRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+	err := func() error {
+		firewallMutex.Lock()
+		defer firewallMutex.Unlock()
+
+		if req.Profile != "" {
+			profiles, err := loadRoutingProfilesLocked()
+			if err != nil {
+				return err
+			}
+			if profiles[req.Profile] == nil {
+				return errRoutingProfileNotFound
+			}
+		}
+		return updateProjects(func(projects map[string]*Project) error {
+			project := projects[c.Param("project")]
+			if project == nil {
+				return errProjectNotFound
+			}
+			project.RoutingProfile = req.Profile
+			return nil
+		})
+	}()
+	if err == nil {
+		err = applyFirewallLocked()
+	}
+	if err != nil {
+		respondRoutingError(c, err)
+		return
+	}
+
+	message := "Project routed through " + req.Profile
+	if req.Profile == "" {
+		message = "Project routed through the main table"
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+	})
+}
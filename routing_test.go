@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRoutingProfileRoutesProjectOutOfUplink(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+	setupFakeIP(t, env)
+	ipRules, ipLog := filepath.Join(env.dir, "ip.rules"), filepath.Join(env.dir, "ip.log")
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/add", ProjectRequest{Name: "de"})
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/de/clients/add", ProjectClientsRequest{Names: []string{"alice"}})
+
+	profile := RoutingProfile{Name: "egress-de", Table: 100, Device: "eth1", Gateway: "192.0.2.1"}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/routing-profiles", profile).Code; code != http.StatusOK {
+		t.Fatalf("set profile: got status %d", code)
+	}
+	if rules := readFile(t, ipRules); strings.Count(rules, "fwmark 0x64 lookup 100 proto 77") != 2 {
+		t.Errorf("want an IPv4 and an IPv6 rule:\n%s", rules)
+	}
+	if log := readFile(t, ipLog); !strings.Contains(log, "-4 route replace default via 192.0.2.1 dev eth1 table 100 proto 77") {
+		t.Errorf("default route of the table not set:\n%s", log)
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/de/routing", ProjectRoutingRequest{Profile: "egress-de"}).Code; code != http.StatusOK {
+		t.Fatalf("route project: got status %d", code)
+	}
+	rules := readRules(t, rulesFile)
+	for _, want := range []string{
+		`iifname "wg0" ip saddr { 10.66.0.2 } ip daddr != 10.66.0.0/16 meta mark set 0x64`,
+		`iifname "wg0" oifname "eth1" masquerade`,
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules missing %q:\n%s", want, rules)
+		}
+	}
+
+	// Profiles in use can't be deleted, nor can two share a table
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/routing-profiles/delete", DeleteRoutingProfileRequest{Name: "egress-de"}).Code; code != http.StatusConflict {
+		t.Errorf("delete profile in use: got status %d, want 409", code)
+	}
+	other := RoutingProfile{Name: "egress-nl", Table: 100, Device: "eth2"}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/routing-profiles", other).Code; code != http.StatusConflict {
+		t.Errorf("shared table: got status %d, want 409", code)
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/de/routing", ProjectRoutingRequest{})
+	if rules := readRules(t, rulesFile); strings.Contains(rules, "meta mark set") {
+		t.Errorf("project without profile must not be marked:\n%s", rules)
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/routing-profiles/delete", DeleteRoutingProfileRequest{Name: "egress-de"}).Code; code != http.StatusOK {
+		t.Fatalf("delete profile: got status %d", code)
+	}
+	if rules := readFile(t, ipRules); rules != "" {
+		t.Errorf("rules of a deleted profile must be removed:\n%s", rules)
+	}
+	if log := readFile(t, ipLog); !strings.Contains(log, "-4 route flush table 100 proto 77") {
+		t.Errorf("table of a deleted profile not flushed:\n%s", log)
+	}
+}
+
+func TestRoutingProfileValidation(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeNft(t, env)
+	setupFakeIP(t, env)
+	env.authedRequest(t, http.MethodPost, "/api/v1/projects/add", ProjectRequest{Name: "de"})
+
+	for _, profile := range []RoutingProfile{
+		{Name: "bad name", Table: 100, Device: "eth1"},
+		{Name: "main", Table: 254, Device: "eth1"},
+		{Name: "nodev", Table: 100},
+		{Name: "badgw", Table: 100, Device: "eth1", Gateway: "gateway"},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/routing-profiles", profile).Code; code != http.StatusBadRequest {
+			t.Errorf("%+v: got status %d, want 400", profile, code)
+		}
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/projects/de/routing", ProjectRoutingRequest{Profile: "ghost"}).Code; code != http.StatusNotFound {
+		t.Errorf("unknown profile: got status %d, want 404", code)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Background work the API does on its own runs as scheduled jobs: each has
+// a name, runs on an interval from its own setting, e.g.
+// GROUP_POLICY_INTERVAL, or on a cron expression from SCHEDULES, and can be
+// inspected at GET /schedules and run at once with POST
+// /schedules/:job/run. Jobs that change something only run on a schedule
+// while writesAllowed; run by hand, the API's maintenance, read-only and HA
+// checks apply as to any other change.
+//
+// Schedules are either five cron fields (minute, hour, day of month, month,
+// day of week) in the server's local time, with *, lists, ranges, steps and
+// month and day names, or one of @hourly, @daily, @weekly, @monthly,
+// @yearly and @every <duration>. An @every job also runs at startup, as the
+// interval settings always did; a cron job first runs at its next time.
+
+const (
+	jobPurgeDeletedClients = "purge-deleted-clients"
+	jobGroupPolicies       = "group-policies"
+	jobKeyRotation         = "key-rotation"
+	jobLDAPSync            = "ldap-sync"
+	jobPublicIPCheck       = "public-ip-check"
+)
+
+// The jobs SCHEDULES may name
+var jobDescriptions = map[string]string{
+	jobPurgeDeletedClients: "Drop deleted clients past DELETED_CLIENT_RETENTION",
+	jobGroupPolicies:       "Disable group members over their quota or past their expiry",
+	jobKeyRotation:         "Rotate keys older than KEY_ROTATION_INTERVAL",
+	jobLDAPSync:            "Sync clients with the LDAP group",
+	jobPublicIPCheck:       "Compare the detected public IP to SERVER_PUB_IP",
+}
+
+// When a job runs next after a time; zero when never
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+type everySchedule struct {
+	every time.Duration
+}
+
+func (s everySchedule) next(after time.Time) time.Time {
+	return after.Add(s.every)
+}
+
+// The fields of a cron expression as bit sets of the values they match
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// A * day of month or week leaves the other alone to choose the day;
+	// with both restricted, a day matching either is run on
+	domAny, dowAny bool
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	// 7 is Sunday too
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("%q: @every needs a duration of at least 1s", spec)
+		}
+		return everySchedule{interval}, nil
+	}
+	if expr, ok := cronDescriptors[spec]; ok {
+		spec = expr
+	} else if strings.HasPrefix(spec, "@") {
+		return nil, fmt.Errorf("%q: unknown descriptor", spec)
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%q: want 5 fields (minute hour day-of-month month day-of-week)", spec)
+	}
+	var bits [5]uint64
+	for i, field := range cronFields {
+		var err error
+		if bits[i], err = field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("%q: %v", spec, err)
+		}
+	}
+	// Sunday is 0
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+	return &cronSchedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func (f cronField) value(expr string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(expr, name) {
+			return f.min + i, nil
+		}
+	}
+	value, err := strconv.Atoi(expr)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("%s %q must be between %d and %d", f.name, expr, f.min, f.max)
+	}
+	return value, nil
+}
+
+func (f cronField) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepExpr); err != nil || step < 1 {
+				return 0, fmt.Errorf("%s step %q must be a positive number", f.name, stepExpr)
+			}
+		}
+
+		low, high := f.min, f.max
+		if rangeExpr != "*" {
+			lowExpr, highExpr, isRange := strings.Cut(rangeExpr, "-")
+			var err error
+			if low, err = f.value(lowExpr); err != nil {
+				return 0, err
+			}
+			switch {
+			case isRange:
+				if high, err = f.value(highExpr); err != nil {
+					return 0, err
+				}
+			case !hasStep:
+				high = low
+			}
+			if low > high {
+				return 0, fmt.Errorf("%s range %q runs backwards", f.name, rangeExpr)
+			}
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// The first matching minute after after, skipping whole months, days and
+// hours that don't match. Zero when none comes within five years, e.g. for
+// February 30.
+func (s *cronSchedule) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		switch {
+		case s.month&(1<<uint(month)) == 0:
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Schedules from SCHEDULES by job, replacing the jobs' interval settings
+var scheduleOverrides = map[string]string{}
+
+// SCHEDULES is semicolon-separated, as cron expressions use commas, e.g.
+// "key-rotation=0 3 * * *;ldap-sync=*/15 * * * *"
+func loadSchedules() error {
+	overrides := map[string]string{}
+	for _, entry := range strings.Split(SCHEDULES, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, spec, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return fmt.Errorf("%q must be job=schedule", entry)
+		}
+		if _, known := jobDescriptions[name]; !known {
+			return fmt.Errorf("unknown job %q", name)
+		}
+		if _, err := parseSchedule(spec); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		overrides[name] = strings.TrimSpace(spec)
+	}
+	scheduleOverrides = overrides
+	return nil
+}
+
+// A job and its latest run
+type scheduledJob struct {
+	name     string
+	spec     string
+	schedule schedule
+	// Skipped on its schedule while writes aren't allowed
+	writes bool
+	run    func() error
+
+	// One run at a time, by schedule or by hand
+	runMutex sync.Mutex
+
+	mutex   sync.Mutex
+	nextRun time.Time
+	last    *JobRun
+	running bool
+}
+
+// A finished run of a job
+type JobRun struct {
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+	// "schedule" or "manual"
+	Trigger string `json:"trigger"`
+	Error   string `json:"error,omitempty"`
+}
+
+// A job in GET /schedules
+type ScheduleStatus struct {
+	Job         string     `json:"job"`
+	Description string     `json:"description"`
+	Schedule    string     `json:"schedule"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+	Running     bool       `json:"running"`
+	LastRun     *JobRun    `json:"last_run,omitempty"`
+}
+
+var (
+	scheduledJobsMutex sync.Mutex
+	scheduledJobs      = map[string]*scheduledJob{}
+)
+
+// Run a job every interval, or on its schedule from SCHEDULES. Without
+// either, i.e. a zero interval and no schedule, it doesn't run.
+func scheduleJob(name string, interval time.Duration, writes bool, run func() error) {
+	var sched schedule = everySchedule{interval}
+	spec := "@every " + interval.String()
+	if override, ok := scheduleOverrides[name]; ok {
+		// Checked by loadSchedules
+		spec = override
+		sched, _ = parseSchedule(override)
+	} else if interval <= 0 {
+		return
+	}
+
+	job := &scheduledJob{name: name, spec: spec, schedule: sched, writes: writes, run: run, nextRun: sched.next(time.Now())}
+	scheduledJobsMutex.Lock()
+	scheduledJobs[name] = job
+	scheduledJobsMutex.Unlock()
+	go job.loop()
+}
+
+func (j *scheduledJob) loop() {
+	if _, interval := j.schedule.(everySchedule); interval {
+		j.runScheduled()
+	}
+	for {
+		next := j.schedule.next(time.Now())
+		j.mutex.Lock()
+		j.nextRun = next
+		j.mutex.Unlock()
+		if next.IsZero() {
+			return
+		}
+		time.Sleep(time.Until(next))
+		j.runScheduled()
+	}
+}
+
+func (j *scheduledJob) runScheduled() {
+	if j.writes && !writesAllowed() {
+		return
+	}
+	j.runNow("schedule")
+}
+
+// Run the job once it isn't running anymore
+func (j *scheduledJob) runNow(trigger string) *JobRun {
+	j.runMutex.Lock()
+	defer j.runMutex.Unlock()
+
+	j.mutex.Lock()
+	j.running = true
+	j.mutex.Unlock()
+
+	run := &JobRun{StartedAt: time.Now().UTC(), Trigger: trigger}
+	err := j.run()
+	run.DurationMS = time.Since(run.StartedAt).Milliseconds()
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	j.mutex.Lock()
+	j.running, j.last = false, run
+	j.mutex.Unlock()
+	return run
+}
+
+func (j *scheduledJob) status() ScheduleStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	status := ScheduleStatus{
+		Job:         j.name,
+		Description: jobDescriptions[j.name],
+		Schedule:    j.spec,
+		Running:     j.running,
+		LastRun:     j.last,
+	}
+	if !j.nextRun.IsZero() {
+		next := j.nextRun.UTC()
+		status.NextRun = &next
+	}
+	return status
+}
+
+// Handler for GET /schedules: the jobs that run on this instance, by name
+func schedulesHandlerGin(c *gin.Context) {
+	scheduledJobsMutex.Lock()
+	jobs := make([]ScheduleStatus, 0, len(scheduledJobs))
+	for _, job := range scheduledJobs {
+		jobs = append(jobs, job.status())
+	}
+	scheduledJobsMutex.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Job < jobs[j].Job })
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    jobs,
+	})
+}
+
+// Handler for POST /schedules/:job/run: run a job now, after its current
+// run when one is going on. The next scheduled run stays as it was.
+func runScheduledJobHandlerGin(c *gin.Context) {
+	scheduledJobsMutex.Lock()
+	job := scheduledJobs[c.Param("job")]
+	scheduledJobsMutex.Unlock()
+	if job == nil {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("No job %s runs on this instance", c.Param("job")),
+		})
+		return
+	}
+
+	run := job.runNow("manual")
+	if run.Error != "" {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Job %s failed: %s", job.name, run.Error),
+			Data:    job.status(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Job %s ran", job.name),
+		Data:    job.status(),
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	// 2026-10-16 is a Friday
+	for _, tt := range []struct {
+		spec, after, want string
+	}{
+		{"*/15 * * * *", "2026-10-16 10:07", "2026-10-16 10:15"},
+		{"0 3 * * *", "2026-10-16 03:00", "2026-10-17 03:00"},
+		{"30 9 * * mon-fri", "2026-10-17 08:00", "2026-10-19 09:30"},
+		{"0 12 * * 7", "2026-10-16 12:00", "2026-10-18 12:00"},
+		{"0 0 1,15 * mon", "2026-10-16 10:00", "2026-10-19 00:00"},
+		{"0 0 1,15 * *", "2026-10-16 10:00", "2026-11-01 00:00"},
+		{"5/20 8-9 * * *", "2026-10-16 08:30", "2026-10-16 08:45"},
+		{"@monthly", "2026-12-15 00:00", "2027-01-01 00:00"},
+		{"0 0 29 feb *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 30 feb *", "2026-03-01 00:00", ""},
+		{"@every 90m", "2026-10-16 10:00", "2026-10-16 11:30"},
+	} {
+		sched, err := parseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		got := sched.next(at(tt.after))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s: got %s, want never", tt.spec, tt.after, got)
+			}
+		} else if !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %s: got %s, want %s", tt.spec, tt.after, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *", "* * * * xyz", "@every 10ms", "@fortnightly"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+}
+
+func TestLoadSchedules(t *testing.T) {
+	old := SCHEDULES
+	t.Cleanup(func() {
+		SCHEDULES = old
+		scheduleOverrides = map[string]string{}
+	})
+
+	SCHEDULES = "key-rotation=0 3 * * *; ldap-sync=*/15 * * * 1,3,5"
+	if err := loadSchedules(); err != nil || scheduleOverrides[jobLDAPSync] != "*/15 * * * 1,3,5" {
+		t.Errorf("got %v, %v", scheduleOverrides, err)
+	}
+	for _, schedules := range []string{"backups=@daily", "key-rotation", "key-rotation=0 25 * * *"} {
+		SCHEDULES = schedules
+		if err := loadSchedules(); err == nil {
+			t.Errorf("%q: want an error", schedules)
+		}
+	}
+}
+
+// Schedule a job named name for the test
+func testJob(t *testing.T, name, spec string, run func() error) {
+	t.Helper()
+	old := scheduleOverrides
+	scheduleOverrides = map[string]string{name: spec}
+	t.Cleanup(func() {
+		scheduleOverrides = old
+		scheduledJobsMutex.Lock()
+		delete(scheduledJobs, name)
+		scheduledJobsMutex.Unlock()
+	})
+	scheduleJob(name, 0, true, run)
+	scheduleOverrides = old
+}
+
+func TestSchedulesAndRunningJobs(t *testing.T) {
+	env := setupTestEnv(t)
+	var runs atomic.Int32
+	testJob(t, "test-report", "0 0 1 1 *", func() error {
+		runs.Add(1)
+		return nil
+	})
+	testJob(t, "test-failing", "@yearly", func() error { return errors.New("upstream down") })
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/schedules", nil)
+	var resp struct {
+		Data []ScheduleStatus `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("schedules: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if len(resp.Data) != 2 || resp.Data[1].Job != "test-report" || resp.Data[1].Schedule != "0 0 1 1 *" || resp.Data[1].LastRun != nil {
+		t.Fatalf("got %+v", resp.Data)
+	}
+	if next := resp.Data[1].NextRun; next == nil || next.Month() != time.January || next.Before(time.Now()) {
+		t.Errorf("next run: %v", next)
+	}
+
+	var run struct {
+		Message string         `json:"message"`
+		Data    ScheduleStatus `json:"data"`
+	}
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/schedules/test-report/run", nil)
+	json.Unmarshal(rec.Body.Bytes(), &run)
+	if rec.Code != http.StatusOK || runs.Load() != 1 || run.Data.LastRun == nil || run.Data.LastRun.Trigger != "manual" {
+		t.Errorf("run: status %d, %s", rec.Code, rec.Body.String())
+	}
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/schedules/test-failing/run", nil)
+	json.Unmarshal(rec.Body.Bytes(), &run)
+	if rec.Code != http.StatusInternalServerError || run.Data.LastRun == nil || run.Data.LastRun.Error != "upstream down" {
+		t.Errorf("failing run: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/schedules/backups/run", nil).Code; code != http.StatusNotFound {
+		t.Errorf("unknown job: status %d", code)
+	}
+
+	// Running a job by hand is a change like any other
+	env.authedRequest(t, http.MethodPost, "/api/v1/maintenance/enable", nil)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/schedules/test-report/run", nil).Code; code != http.StatusServiceUnavailable || runs.Load() != 1 {
+		t.Errorf("during maintenance: status %d, %d runs", code, runs.Load())
+	}
+}
+
+func TestIntervalJobsRunAtStart(t *testing.T) {
+	ran := make(chan struct{}, 1)
+	t.Cleanup(func() {
+		scheduledJobsMutex.Lock()
+		delete(scheduledJobs, "test-interval")
+		scheduledJobsMutex.Unlock()
+	})
+	scheduleJob("test-interval", time.Hour, false, func() error {
+		ran <- struct{}{}
+		return nil
+	})
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job didn't run at start")
+	}
+
+	scheduleJob("test-off", 0, false, func() error { return nil })
+	scheduledJobsMutex.Lock()
+	defer scheduledJobsMutex.Unlock()
+	if scheduledJobs["test-off"] != nil {
+		t.Error("a job without interval or schedule was scheduled")
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SCIM 2.0 (RFC 7643/7644) Users endpoint for identity providers such as
+// Okta and Azure AD. Each provisioned user gets a client named after the
+// local part of their userName; active=false disables the client and
+// DELETE deletes it. Only the User resource with userName, externalId and
+// active is supported, which is all the providers need to provision and
+// deprovision. The endpoint lives under /scim/v2, outside the API token,
+// and authenticates the provider with "Authorization: Bearer SCIM_TOKEN".
+
+const (
+	scimUserSchema      = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema      = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema     = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema     = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimWireGuardSchema = "urn:ietf:params:scim:schemas:extension:wireguard:2.0:User"
+	scimContentType     = "application/scim+json"
+)
+
+// A provisioned user and the client it owns
+type scimUser struct {
+	ID           string    `json:"id"`
+	ExternalID   string    `json:"external_id,omitempty"`
+	UserName     string    `json:"user_name"`
+	Active       bool      `json:"active"`
+	Client       string    `json:"client"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// The writable attributes of a User resource
+type scimUserRequest struct {
+	UserName   string `json:"userName"`
+	ExternalID string `json:"externalId"`
+	Active     *bool  `json:"active"`
+}
+
+type scimPatchRequest struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+var (
+	scimMutex sync.Mutex
+
+	scimFilterRegex     = regexp.MustCompile(`^(?i)(userName|externalId) eq "((?:[^"\\]|\\.)*)"$`)
+	scimNameInvalidChar = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+)
+
+// SCIM_USERS_FILE, or scim-users.json next to the server config
+func scimUsersFile() string {
+	if SCIM_USERS_FILE != "" {
+		return SCIM_USERS_FILE
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "scim-users.json")
+}
+
+// Provisioned users by id. Caller holds scimMutex.
+func loadSCIMUsersLocked() (map[string]*scimUser, error) {
+	users := make(map[string]*scimUser)
+	content, err := os.ReadFile(scimUsersFile())
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SCIM users file: %v", err)
+	}
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, fmt.Errorf("failed to parse SCIM users file: %v", err)
+	}
+	return users, nil
+}
+
+// Caller holds scimMutex
+func saveSCIMUsersLocked(users map[string]*scimUser) error {
+	content, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(scimUsersFile(), content, 0600); err != nil {
+		return fmt.Errorf("failed to write SCIM users file: %v", err)
+	}
+	return nil
+}
+
+// n random bytes, hex encoded; for ids and tokens
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// A free client name from the local part of userName: invalid characters
+// become dashes, and a number is appended when the name is taken
+func scimClientName(userName string, users map[string]*scimUser) (string, error) {
+	base, _, _ := strings.Cut(userName, "@")
+	base = strings.Trim(scimNameInvalidChar.ReplaceAllString(base, "-"), "-")
+	if base == "" {
+		base = "user"
+	}
+
+	taken := make(map[string]bool, len(users))
+	for _, user := range users {
+		taken[user.Client] = true
+	}
+	for i := 1; ; i++ {
+		suffix := ""
+		if i > 1 {
+			suffix = "-" + strconv.Itoa(i)
+		}
+		name := base
+		if len(name)+len(suffix) > CLIENT_NAME_MAX_LENGTH {
+			name = name[:CLIENT_NAME_MAX_LENGTH-len(suffix)]
+		}
+		name += suffix
+		if taken[name] {
+			continue
+		}
+		exists, err := clientExists(name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+	}
+}
+
+// The User resource of a provisioned user
+func (u *scimUser) resource() map[string]interface{} {
+	resource := map[string]interface{}{
+		"schemas":  []string{scimUserSchema, scimWireGuardSchema},
+		"id":       u.ID,
+		"userName": u.UserName,
+		"active":   u.Active,
+		"meta": map[string]interface{}{
+			"resourceType": "User",
+			"created":      u.Created.UTC().Format(time.RFC3339),
+			"lastModified": u.LastModified.UTC().Format(time.RFC3339),
+			"location":     "/scim/v2/Users/" + u.ID,
+		},
+		scimWireGuardSchema: map[string]interface{}{"client": u.Client},
+	}
+	if u.ExternalID != "" {
+		resource["externalId"] = u.ExternalID
+	}
+	return resource
+}
+
+func scimJSON(c *gin.Context, status int, body interface{}) {
+	content, _ := json.Marshal(body)
+	c.Data(status, scimContentType, content)
+}
+
+func scimError(c *gin.Context, status int, scimType, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	scimJSON(c, status, body)
+}
+
+// Bearer token check for the identity provider. Without SCIM_TOKEN the
+// endpoint doesn't exist.
+func scimAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scimToken := secretValue(&SCIM_TOKEN)
+		if scimToken == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(scimToken)) != 1 {
+			scimError(c, http.StatusUnauthorized, "", "Invalid bearer token")
+			c.Abort()
+			return
+		}
+		setActedBy(c, tokenIdentity(token))
+		c.Next()
+	}
+}
+
+func registerSCIMRoutes(router *gin.Engine) {
+	scim := router.Group("/scim/v2", scimAuthMiddleware(), auditMiddleware(), changesAllowedMiddleware())
+	scim.GET("/Users", scimListUsersHandlerGin)
+	scim.POST("/Users", scimCreateUserHandlerGin)
+	scim.GET("/Users/:id", scimGetUserHandlerGin)
+	scim.PUT("/Users/:id", scimReplaceUserHandlerGin)
+	scim.PATCH("/Users/:id", scimPatchUserHandlerGin)
+	scim.DELETE("/Users/:id", scimDeleteUserHandlerGin)
+}
+
+// Disable or enable a client and apply the peers when that changed it
+func setClientActive(name string, active bool) error {
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	changed, err := setClientEnabledLocked(name, active)
+	if err != nil || !changed {
+		return err
+	}
+	return syncWireGuardConf()
+}
+
+// Handler listing users, optionally filtered by `userName eq "..."` or
+// `externalId eq "..."`, which is how providers look a user up before
+// creating it
+func scimListUsersHandlerGin(c *gin.Context) {
+	var attribute, value string
+	if filter := c.Query("filter"); filter != "" {
+		match := scimFilterRegex.FindStringSubmatch(filter)
+		if match == nil {
+			scimError(c, http.StatusBadRequest, "invalidFilter", `Only userName eq "..." and externalId eq "..." are supported`)
+			return
+		}
+		attribute, value = strings.ToLower(match[1]), strings.ReplaceAll(match[2], `\"`, `"`)
+	}
+
+	scimMutex.Lock()
+	users, err := loadSCIMUsersLocked()
+	scimMutex.Unlock()
+	if err != nil {
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	matched := []*scimUser{}
+	for _, user := range users {
+		switch {
+		case attribute == "username" && !strings.EqualFold(user.UserName, value):
+		case attribute == "externalid" && user.ExternalID != value:
+		default:
+			matched = append(matched, user)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Created.Before(matched[j].Created) })
+
+	// startIndex is 1-based
+	startIndex, _ := strconv.Atoi(c.DefaultQuery("startIndex", "1"))
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", "100"))
+	if err != nil || count < 0 {
+		count = 100
+	}
+	page := []map[string]interface{}{}
+	for i := startIndex - 1; i < len(matched) && len(page) < count; i++ {
+		page = append(page, matched[i].resource())
+	}
+
+	scimJSON(c, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(matched),
+		"startIndex":   startIndex,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+func scimGetUserHandlerGin(c *gin.Context) {
+	scimMutex.Lock()
+	users, err := loadSCIMUsersLocked()
+	scimMutex.Unlock()
+	if err != nil {
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	user := users[c.Param("id")]
+	if user == nil {
+		scimError(c, http.StatusNotFound, "", "User not found")
+		return
+	}
+	scimJSON(c, http.StatusOK, user.resource())
+}
+
+// Handler provisioning a user: creates their client, disabled when the
+// user arrives inactive
+func scimCreateUserHandlerGin(c *gin.Context) {
+	var req scimUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.UserName == "" {
+		scimError(c, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+	active := req.Active == nil || *req.Active
+
+	scimMutex.Lock()
+	defer scimMutex.Unlock()
+
+	users, err := loadSCIMUsersLocked()
+	if err != nil {
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	for _, user := range users {
+		if strings.EqualFold(user.UserName, req.UserName) {
+			scimError(c, http.StatusConflict, "uniqueness", "A user with this userName already exists")
+			return
+		}
+	}
+
+	id, err := randomHex(16)
+	if err == nil {
+		var name string
+		if name, err = scimClientName(req.UserName, users); err == nil {
+			now := time.Now().UTC()
+			users[id] = &scimUser{ID: id, ExternalID: req.ExternalID, UserName: req.UserName, Active: active, Client: name, Created: now, LastModified: now}
+			if _, _, _, err = addWireGuardClient(name, "", ""); err == nil && !active {
+				err = setClientActive(name, false)
+			}
+		}
+	}
+	if err == nil {
+		err = saveSCIMUsersLocked(users)
+	}
+	if err != nil {
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	c.Header("Location", "/scim/v2/Users/"+id)
+	scimJSON(c, http.StatusCreated, users[id].resource())
+}
+
+// Apply changed attributes to a user and its client. Caller holds
+// scimMutex and saves the users afterwards.
+func updateSCIMUserLocked(users map[string]*scimUser, user *scimUser, req scimUserRequest) (int, string, error) {
+	if req.UserName != "" && !strings.EqualFold(req.UserName, user.UserName) {
+		for _, other := range users {
+			if other != user && strings.EqualFold(other.UserName, req.UserName) {
+				return http.StatusConflict, "uniqueness", errors.New("A user with this userName already exists")
+			}
+		}
+	}
+	if req.UserName != "" {
+		user.UserName = req.UserName
+	}
+	if req.ExternalID != "" {
+		user.ExternalID = req.ExternalID
+	}
+	if req.Active != nil && *req.Active != user.Active {
+		// A client deleted by an admin stays deleted
+		if err := setClientActive(user.Client, *req.Active); err != nil && !errors.Is(err, errClientNotFound) {
+			return http.StatusInternalServerError, "", err
+		}
+		user.Active = *req.Active
+	}
+	user.LastModified = time.Now().UTC()
+	return http.StatusOK, "", nil
+}
+
+// Run fn on the user named by the id parameter and respond with the result
+func modifySCIMUser(c *gin.Context, fn func(users map[string]*scimUser, user *scimUser) (int, string, error)) {
+	scimMutex.Lock()
+	defer scimMutex.Unlock()
+
+	users, err := loadSCIMUsersLocked()
+	if err != nil {
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	user := users[c.Param("id")]
+	if user == nil {
+		scimError(c, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	if status, scimType, err := fn(users, user); err != nil {
+		scimError(c, status, scimType, err.Error())
+		return
+	}
+	if err := saveSCIMUsersLocked(users); err != nil {
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	scimJSON(c, http.StatusOK, user.resource())
+}
+
+// Handler replacing a user's attributes
+func scimReplaceUserHandlerGin(c *gin.Context) {
+	var req scimUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.UserName == "" {
+		scimError(c, http.StatusBadRequest, "invalidValue", "userName is required")
+		return
+	}
+	if req.Active == nil {
+		active := true
+		req.Active = &active
+	}
+	modifySCIMUser(c, func(users map[string]*scimUser, user *scimUser) (int, string, error) {
+		return updateSCIMUserLocked(users, user, req)
+	})
+}
+
+// Booleans arrive as true or, from Azure AD, as "True"
+func parseSCIMBool(raw json.RawMessage) (bool, error) {
+	var value bool
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		return false, fmt.Errorf("active must be a boolean")
+	}
+	return strconv.ParseBool(strings.ToLower(text))
+}
+
+// The attribute changes of a PatchOp: replace/add operations with a path
+// (Azure AD) or with an object of attributes (Okta)
+func parseSCIMPatch(patch scimPatchRequest) (scimUserRequest, error) {
+	var req scimUserRequest
+	for _, op := range patch.Operations {
+		switch strings.ToLower(op.Op) {
+		case "replace", "add":
+		default:
+			return req, fmt.Errorf("unsupported op %q", op.Op)
+		}
+
+		values := map[string]json.RawMessage{}
+		if op.Path == "" {
+			if err := json.Unmarshal(op.Value, &values); err != nil {
+				return req, fmt.Errorf("value must be an object without a path")
+			}
+		} else {
+			values[op.Path] = op.Value
+		}
+
+		for path, value := range values {
+			switch strings.ToLower(path) {
+			case "active":
+				active, err := parseSCIMBool(value)
+				if err != nil {
+					return req, fmt.Errorf("active must be a boolean")
+				}
+				req.Active = &active
+			case "username":
+				if err := json.Unmarshal(value, &req.UserName); err != nil {
+					return req, fmt.Errorf("userName must be a string")
+				}
+			case "externalid":
+				if err := json.Unmarshal(value, &req.ExternalID); err != nil {
+					return req, fmt.Errorf("externalId must be a string")
+				}
+			}
+			// Other attributes, e.g. name or emails, aren't stored
+		}
+	}
+	return req, nil
+}
+
+// Handler for partial updates; deprovisioning sends active=false here
+func scimPatchUserHandlerGin(c *gin.Context) {
+	var patch scimPatchRequest
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		scimError(c, http.StatusBadRequest, "invalidSyntax", "Invalid PatchOp")
+		return
+	}
+	req, err := parseSCIMPatch(patch)
+	if err != nil {
+		scimError(c, http.StatusBadRequest, "invalidValue", err.Error())
+		return
+	}
+	modifySCIMUser(c, func(users map[string]*scimUser, user *scimUser) (int, string, error) {
+		return updateSCIMUserLocked(users, user, req)
+	})
+}
+
+// Handler deleting a user and its client
+func scimDeleteUserHandlerGin(c *gin.Context) {
+	scimMutex.Lock()
+	defer scimMutex.Unlock()
+
+	users, err := loadSCIMUsersLocked()
+	if err != nil {
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	user := users[c.Param("id")]
+	if user == nil {
+		scimError(c, http.StatusNotFound, "", "User not found")
+		return
+	}
+
+	exists, err := clientExists(user.Client)
+	if err == nil && exists {
+		err = deleteWireGuardClient(user.Client)
+	}
+	if err == nil {
+		delete(users, user.ID)
+		err = saveSCIMUsersLocked(users)
+	}
+	if err != nil {
+		scimError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
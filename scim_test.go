@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scimRequest(t *testing.T, env *testEnv, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", scimContentType)
+	req.Header.Set("Authorization", "Bearer scim-token")
+	recorder := httptest.NewRecorder()
+	env.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestSCIMProvisioningLifecycle(t *testing.T) {
+	env := setupTestEnv(t)
+	SCIM_TOKEN = "scim-token"
+	t.Cleanup(func() { SCIM_TOKEN = "" })
+
+	rec := scimRequest(t, env, http.MethodPost, "/scim/v2/Users", `{"schemas":["`+scimUserSchema+`"],"userName":"alice@example.com","externalId":"00u1"}`)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Type") != scimContentType {
+		t.Fatalf("create: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var user struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &user)
+	if !strings.Contains(rec.Body.String(), `"client":"alice"`) || !strings.Contains(env.configContent(t), "### Client alice\n[Peer]") {
+		t.Fatalf("alice's client must be created: %s", rec.Body.String())
+	}
+
+	if code := scimRequest(t, env, http.MethodPost, "/scim/v2/Users", `{"userName":"ALICE@example.com"}`).Code; code != http.StatusConflict {
+		t.Errorf("duplicate userName: got status %d, want 409", code)
+	}
+	// Another alice gets a free client name
+	rec = scimRequest(t, env, http.MethodPost, "/scim/v2/Users", `{"userName":"alice@other.example.com","active":false}`)
+	if !strings.Contains(rec.Body.String(), `"client":"alice-2"`) || !strings.Contains(env.configContent(t), "### Client alice-2\n#[Peer]") {
+		t.Errorf("second alice must get a disabled alice-2: %s", rec.Body.String())
+	}
+
+	rec = scimRequest(t, env, http.MethodGet, `/scim/v2/Users?filter=userName+eq+%22alice%40example.com%22`, "")
+	if !strings.Contains(rec.Body.String(), `"totalResults":1`) || !strings.Contains(rec.Body.String(), user.ID) {
+		t.Errorf("filter by userName: %s", rec.Body.String())
+	}
+
+	// Okta deactivates with an object value, Azure AD with a path and a string
+	scimRequest(t, env, http.MethodPatch, "/scim/v2/Users/"+user.ID, `{"schemas":["`+scimPatchSchema+`"],"Operations":[{"op":"replace","value":{"active":false}}]}`)
+	if !strings.Contains(env.configContent(t), "### Client alice\n#[Peer]") {
+		t.Errorf("alice must be disabled:\n%s", env.configContent(t))
+	}
+	rec = scimRequest(t, env, http.MethodPatch, "/scim/v2/Users/"+user.ID, `{"Operations":[{"op":"Replace","path":"active","value":"True"}]}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"active":true`) || !strings.Contains(env.configContent(t), "### Client alice\n[Peer]") {
+		t.Errorf("alice must be enabled again: %s", rec.Body.String())
+	}
+
+	if code := scimRequest(t, env, http.MethodDelete, "/scim/v2/Users/"+user.ID, "").Code; code != http.StatusNoContent {
+		t.Errorf("delete: got status %d, want 204", code)
+	}
+	if strings.Contains(env.configContent(t), "### Client alice\n") {
+		t.Error("alice's client must be deleted")
+	}
+	if code := scimRequest(t, env, http.MethodGet, "/scim/v2/Users/"+user.ID, "").Code; code != http.StatusNotFound {
+		t.Errorf("deleted user: got status %d, want 404", code)
+	}
+}
+
+func TestSCIMAuthentication(t *testing.T) {
+	env := setupTestEnv(t)
+
+	if code := scimRequest(t, env, http.MethodGet, "/scim/v2/Users", "").Code; code != http.StatusNotFound {
+		t.Errorf("without SCIM_TOKEN: got status %d, want 404", code)
+	}
+
+	SCIM_TOKEN = "other-token"
+	t.Cleanup(func() { SCIM_TOKEN = "" })
+	if code := scimRequest(t, env, http.MethodGet, "/scim/v2/Users", "").Code; code != http.StatusUnauthorized {
+		t.Errorf("wrong bearer token: got status %d, want 401", code)
+	}
+	// The API token doesn't open the SCIM endpoint
+	if code := env.authedRequest(t, http.MethodGet, "/scim/v2/Users", nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("API token: got status %d, want 401", code)
+	}
+}
+
+func TestSCIMClientName(t *testing.T) {
+	setupTestEnv(t)
+	users := map[string]*scimUser{"x": {Client: "jean-luc-picard"}}
+	for userName, want := range map[string]string{
+		"jean.luc.picard@example.com": "jean-luc-pica-2",
+		"o'brien":                     "o-brien",
+		"@example.com":                "user",
+	} {
+		if got, err := scimClientName(userName, users); err != nil || got != want {
+			t.Errorf("scimClientName(%q) = %q, %v; want %q", userName, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tokens don't have to sit in a plaintext .env: API_TOKEN,
+// API_TOKEN_SECONDARY, APPROVER_TOKENS, READONLY_TOKENS and SCIM_TOKEN may
+// name a secret in a cloud secret manager instead,
+//
+//	aws-sm://<secret name or ARN>
+//	gcp-sm://projects/<project>/secrets/<secret>[/versions/<version>]
+//	azure-kv://<vault>/<secret>[/<version>]
+//
+// with an optional #<key> to pick one field of a JSON secret. The secrets
+// are read at startup, which fails if one can't be, and every
+// SECRETS_REFRESH_INTERVAL afterwards, keeping the old value when a read
+// fails, so a rotated token takes effect without a restart. Credentials
+// come from the environment or the instance's identity, as the providers'
+// SDKs look for them; the requests are made with the standard library.
+
+// The settings that may be secret references
+var secretSettings = map[string]*string{
+	"API_TOKEN":           &API_TOKEN,
+	"API_TOKEN_SECONDARY": &API_TOKEN_SECONDARY,
+	"APPROVER_TOKENS":     &APPROVER_TOKENS,
+	"READONLY_TOKENS":     &READONLY_TOKENS,
+	"SCIM_TOKEN":          &SCIM_TOKEN,
+}
+
+var (
+	// Guards the settings against a refresh while requests read them
+	secretsMutex sync.RWMutex
+	// The reference of each setting given as one
+	secretSources = map[string]secretRef{}
+)
+
+// Provider endpoints, variables for the tests
+var (
+	awsSecretsURL    = "https://secretsmanager.%s.amazonaws.com"
+	awsMetadataURL   = "http://169.254.169.254"
+	gcpSecretsURL    = "https://secretmanager.googleapis.com"
+	gcpMetadataURL   = "http://metadata.google.internal"
+	azureVaultURL    = "https://%s.vault.azure.net"
+	azureMetadataURL = "http://169.254.169.254"
+	azureLoginURL    = "https://login.microsoftonline.com"
+)
+
+var secretsHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type secretRef struct {
+	provider string // "aws-sm", "gcp-sm" or "azure-kv"
+	name     string
+	key      string // JSON field, the whole secret when empty
+}
+
+// Parse a secret reference; ok is false for a plain value
+func parseSecretRef(value string) (ref secretRef, ok bool, err error) {
+	provider, rest, found := strings.Cut(value, "://")
+	switch {
+	case !found:
+		return secretRef{}, false, nil
+	case provider != "aws-sm" && provider != "gcp-sm" && provider != "azure-kv":
+		return secretRef{}, false, nil
+	}
+
+	ref = secretRef{provider: provider}
+	ref.name, ref.key, _ = strings.Cut(rest, "#")
+	switch {
+	case ref.name == "":
+		return ref, true, fmt.Errorf("%s reference has no secret name", provider)
+	case provider == "gcp-sm" && !strings.HasPrefix(ref.name, "projects/"):
+		return ref, true, fmt.Errorf("gcp-sm reference must be projects/<project>/secrets/<secret>")
+	case provider == "azure-kv" && !strings.Contains(ref.name, "/"):
+		return ref, true, fmt.Errorf("azure-kv reference must be <vault>/<secret>")
+	}
+	return ref, true, nil
+}
+
+// Read the secret, and its JSON field when the reference names one
+func resolveSecret(ref secretRef) (string, error) {
+	var value string
+	var err error
+	switch ref.provider {
+	case "aws-sm":
+		value, err = fetchAWSSecret(ref.name)
+	case "gcp-sm":
+		value, err = fetchGCPSecret(ref.name)
+	case "azure-kv":
+		value, err = fetchAzureSecret(ref.name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if ref.key != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &fields); err != nil {
+			return "", fmt.Errorf("secret %s is not a JSON object", ref.name)
+		}
+		field, ok := fields[ref.key]
+		if !ok {
+			return "", fmt.Errorf("secret %s has no field %s", ref.name, ref.key)
+		}
+		value = fmt.Sprint(field)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// Replace the settings given as secret references by the secrets
+func loadSecrets() error {
+	sources := map[string]secretRef{}
+	for name, setting := range secretSettings {
+		ref, ok, err := parseSecretRef(*setting)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if !ok {
+			continue
+		}
+		value, err := resolveSecret(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		sources[name] = ref
+		*setting = value
+	}
+	secretSources = sources
+	return nil
+}
+
+// Read the secrets again, keeping the old value of those that fail
+func refreshSecrets() {
+	for name, ref := range secretSources {
+		value, err := resolveSecret(ref)
+		if err != nil {
+			log.Printf("Refreshing %s from %s: %v", name, ref.provider, err)
+			continue
+		}
+		secretsMutex.Lock()
+		changed := *secretSettings[name] != value
+		*secretSettings[name] = value
+		secretsMutex.Unlock()
+		// Logging reads the secrets to redact them, so not under the lock
+		if changed {
+			log.Printf("%s changed in %s", name, ref.provider)
+		}
+	}
+}
+
+// Refresh the secrets every SECRETS_REFRESH_INTERVAL, 0 disables
+func startSecretsRefresher() {
+	if len(secretSources) == 0 || SECRETS_REFRESH_INTERVAL <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(SECRETS_REFRESH_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			refreshSecrets()
+		}
+	}()
+}
+
+// A setting a refresh may replace, read while requests are served
+func secretValue(setting *string) string {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	return *setting
+}
+
+// Send the request and decode the JSON response, which must be a 200
+func doSecretsRequest(req *http.Request, out interface{}) error {
+	resp, err := secretsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(body) > 200 {
+			body = body[:200]
+		}
+		return fmt.Errorf("%s %s answered %d: %s", req.Method, req.URL.Host, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// AWS Secrets Manager
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"Token"`
+}
+
+func fetchAWSSecret(id string) (string, error) {
+	region, err := awsRegion(id)
+	if err != nil {
+		return "", err
+	}
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf(awsSecretsURL, region)
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": id})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, creds, region, "secretsmanager", time.Now())
+
+	var resp struct {
+		SecretString string
+		SecretBinary []byte
+	}
+	if err := doSecretsRequest(req, &resp); err != nil {
+		return "", err
+	}
+	if resp.SecretString != "" {
+		return resp.SecretString, nil
+	}
+	return string(resp.SecretBinary), nil
+}
+
+// The region of an ARN, else from the environment or the instance
+func awsRegion(id string) (string, error) {
+	if parts := strings.Split(id, ":"); strings.HasPrefix(id, "arn:") && len(parts) > 3 {
+		return parts[3], nil
+	}
+	for _, key := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(key); region != "" {
+			return region, nil
+		}
+	}
+	region, err := awsMetadata("/latest/meta-data/placement/region")
+	if err != nil {
+		return "", fmt.Errorf("no AWS_REGION and no instance metadata: %v", err)
+	}
+	return region, nil
+}
+
+// Keys from the environment, else the instance role's
+func loadAWSCredentials() (awsCredentials, error) {
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		return awsCredentials{
+			AccessKeyID:     key,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	role, err := awsMetadata("/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS_ACCESS_KEY_ID and no instance role: %v", err)
+	}
+	role, _, _ = strings.Cut(strings.TrimSpace(role), "\n")
+	raw, err := awsMetadata("/latest/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal([]byte(raw), &creds); err != nil || creds.AccessKeyID == "" {
+		return awsCredentials{}, fmt.Errorf("invalid instance role credentials")
+	}
+	return creds, nil
+}
+
+// Read instance metadata with an IMDSv2 session token
+func awsMetadata(path string) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, awsMetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := readMetadata(req)
+	if err != nil {
+		return "", err
+	}
+
+	req, err = http.NewRequest(http.MethodGet, awsMetadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	return readMetadata(req)
+}
+
+func readMetadata(req *http.Request) (string, error) {
+	resp, err := secretsHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %d", req.URL.Path, resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+// Sign the request with AWS Signature Version 4, covering every header set
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, query, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// GCP Secret Manager
+
+func fetchGCPSecret(name string) (string, error) {
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	token, err := gcpAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, gcpSecretsURL+"/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var resp struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+	}
+	if err := doSecretsRequest(req, &resp); err != nil {
+		return "", err
+	}
+	return string(resp.Payload.Data), nil
+}
+
+// A token of the GOOGLE_APPLICATION_CREDENTIALS service account, else of
+// the instance's
+func gcpAccessToken() (string, error) {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return gcpServiceAccountToken(path)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataURL+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doSecretsRequest(req, &resp); err != nil {
+		return "", fmt.Errorf("no GOOGLE_APPLICATION_CREDENTIALS and no instance service account: %v", err)
+	}
+	return resp.AccessToken, nil
+}
+
+// Exchange a JWT signed with the service account's key for a token
+func gcpServiceAccountToken(path string) (string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var account struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(raw, &account); err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("%s: no private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("%s: private key is not RSA", path)
+	}
+
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/cloud-platform",
+		"aud":   account.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	return requestOAuthToken(account.TokenURI, form)
+}
+
+// POST a token request form and return the access token
+func requestOAuthToken(tokenURL string, form url.Values) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doSecretsRequest(req, &resp); err != nil {
+		return "", err
+	}
+	if resp.AccessToken == "" {
+		return "", errors.New("token response has no access_token")
+	}
+	return resp.AccessToken, nil
+}
+
+// Azure Key Vault
+
+func fetchAzureSecret(name string) (string, error) {
+	vault, secret, _ := strings.Cut(name, "/")
+	token, err := azureAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(azureVaultURL, vault)+"/secrets/"+secret+"?api-version=7.4", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err := doSecretsRequest(req, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// A token of the AZURE_CLIENT_ID app with AZURE_CLIENT_SECRET, else of the
+// VM's managed identity (the AZURE_CLIENT_ID one when several are assigned)
+func azureAccessToken() (string, error) {
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {secret},
+			"scope":         {"https://vault.azure.net/.default"},
+		}
+		return requestOAuthToken(azureLoginURL+"/"+os.Getenv("AZURE_TENANT_ID")+"/oauth2/v2.0/token", form)
+	}
+
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://vault.azure.net"}}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, azureMetadataURL+"/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doSecretsRequest(req, &resp); err != nil {
+		return "", fmt.Errorf("no AZURE_CLIENT_SECRET and no managed identity: %v", err)
+	}
+	return resp.AccessToken, nil
+}
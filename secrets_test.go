@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// The example of the AWS Signature Version 4 documentation
+	req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSRequest(req, nil, creds, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseSecretRef(t *testing.T) {
+	for value, want := range map[string]secretRef{
+		"aws-sm://prod/wireguard-api#api_token":                           {provider: "aws-sm", name: "prod/wireguard-api", key: "api_token"},
+		"aws-sm://arn:aws:secretsmanager:eu-west-1:123456789012:secret:x": {provider: "aws-sm", name: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:x"},
+		"gcp-sm://projects/vpn/secrets/api-token/versions/3":              {provider: "gcp-sm", name: "projects/vpn/secrets/api-token/versions/3"},
+		"azure-kv://vpn-vault/api-token":                                  {provider: "azure-kv", name: "vpn-vault/api-token"},
+	} {
+		ref, ok, err := parseSecretRef(value)
+		if err != nil || !ok || ref != want {
+			t.Errorf("parseSecretRef(%q) = %+v, %v, %v", value, ref, ok, err)
+		}
+	}
+	for _, value := range []string{"plain-token", "https://example.com/token", ""} {
+		if _, ok, err := parseSecretRef(value); ok || err != nil {
+			t.Errorf("%q must be a plain value", value)
+		}
+	}
+	for _, value := range []string{"aws-sm://", "gcp-sm://vpn/api-token", "azure-kv://api-token"} {
+		if _, _, err := parseSecretRef(value); err == nil {
+			t.Errorf("%q must be rejected", value)
+		}
+	}
+}
+
+// Point API_TOKEN at ref and restore the secret settings afterwards
+func useSecretRef(t *testing.T, ref string) {
+	t.Helper()
+	oldToken, oldSources := API_TOKEN, secretSources
+	t.Cleanup(func() { API_TOKEN, secretSources = oldToken, oldSources })
+	API_TOKEN = ref
+}
+
+func TestLoadSecretsFromAWS(t *testing.T) {
+	var secret atomic.Value
+	secret.Store(`{"api_token": "aws-token"}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"Name": "vpn", "SecretString": %q}`, secret.Load())
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_SECRETS_MANAGER", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	env := setupTestEnv(t)
+	useSecretRef(t, "aws-sm://vpn#api_token")
+	if err := loadSecrets(); err != nil {
+		t.Fatalf("loading secrets: %v", err)
+	}
+	if API_TOKEN != "aws-token" {
+		t.Fatalf("API_TOKEN = %q, want the secret", API_TOKEN)
+	}
+
+	// A rotated secret replaces the token; a failed read keeps it
+	secret.Store(`{"api_token": "rotated"}`)
+	refreshSecrets()
+	if code := env.request(t, http.MethodGet, "/api/v1/users", nil, "rotated").Code; code != http.StatusOK {
+		t.Errorf("rotated token: got status %d, want 200", code)
+	}
+	if code := env.request(t, http.MethodGet, "/api/v1/users", nil, "aws-token").Code; code == http.StatusOK {
+		t.Error("the old token must stop working")
+	}
+	secret.Store(`not json`)
+	refreshSecrets()
+	if API_TOKEN != "rotated" {
+		t.Errorf("API_TOKEN = %q after a failed refresh, want it kept", API_TOKEN)
+	}
+}
+
+func TestLoadSecretsFromGCP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" && r.Header.Get("Metadata-Flavor") == "Google":
+			fmt.Fprint(w, `{"access_token": "gcp-access", "expires_in": 3599}`)
+		case r.URL.Path == "/v1/projects/vpn/secrets/api-token/versions/latest:access" && r.Header.Get("Authorization") == "Bearer gcp-access":
+			fmt.Fprintf(w, `{"payload": {"data": %q}}`, base64.StdEncoding.EncodeToString([]byte("gcp-token\n")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	oldMetadata, oldSecrets := gcpMetadataURL, gcpSecretsURL
+	gcpMetadataURL, gcpSecretsURL = server.URL, server.URL
+	t.Cleanup(func() { gcpMetadataURL, gcpSecretsURL = oldMetadata, oldSecrets })
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+
+	useSecretRef(t, "gcp-sm://projects/vpn/secrets/api-token")
+	if err := loadSecrets(); err != nil {
+		t.Fatalf("loading secrets: %v", err)
+	}
+	if API_TOKEN != "gcp-token" {
+		t.Errorf("API_TOKEN = %q, want the secret", API_TOKEN)
+	}
+}
+
+func TestLoadSecretsFromAzure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/metadata/identity/oauth2/token" && r.Header.Get("Metadata") == "true" && r.URL.Query().Get("resource") == "https://vault.azure.net":
+			fmt.Fprint(w, `{"access_token": "azure-access"}`)
+		case r.URL.Path == "/secrets/api-token" && r.Header.Get("Authorization") == "Bearer azure-access":
+			fmt.Fprint(w, `{"value": "azure-token", "id": "https://vpn-vault.vault.azure.net/secrets/api-token/1"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	oldMetadata, oldVault := azureMetadataURL, azureVaultURL
+	azureMetadataURL, azureVaultURL = server.URL, server.URL+"%.0s"
+	t.Cleanup(func() { azureMetadataURL, azureVaultURL = oldMetadata, oldVault })
+	t.Setenv("AZURE_CLIENT_SECRET", "")
+	t.Setenv("AZURE_CLIENT_ID", "")
+
+	useSecretRef(t, "azure-kv://vpn-vault/api-token")
+	if err := loadSecrets(); err != nil {
+		t.Fatalf("loading secrets: %v", err)
+	}
+	if API_TOKEN != "azure-token" {
+		t.Errorf("API_TOKEN = %q, want the secret", API_TOKEN)
+	}
+
+	// Unreadable secrets stop the startup
+	useSecretRef(t, "azure-kv://vpn-vault/missing")
+	if err := loadSecrets(); err == nil {
+		t.Error("a missing secret must fail loading")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A host missing wg-quick, the kernel module or write access to the config
+// used to start fine and fail on the first add or restart. The self-test
+// checks what the API relies on: the wg tools, a kernel module or userspace
+// implementation, the params and server config, the clients directory and
+// the systemd unit. It runs at startup, where SELFTEST_ON_START=fail (the
+// default) exits on a failed check, and on demand at GET /selftest.
+// Checks report "pass", "warn" or "fail" like a client diagnosis.
+
+// Where loaded kernel modules show up; a var so tests can point it elsewhere
+var sysModuleDir = "/sys/module"
+
+// Userspace implementations, for hosts without the kernel module
+var userspaceImplementations = map[string][]string{
+	"wireguard": {"wireguard-go", "boringtun-cli", "boringtun"},
+	"amneziawg": {"amneziawg-go"},
+}
+
+// Whether the host can run the VPN as configured
+type SelfTestReport struct {
+	// "pass" when every check passed, else "warn" or "fail"
+	Status    string            `json:"status"`
+	Backend   string            `json:"backend"`
+	Checks    []DiagnosticCheck `json:"checks"`
+	CheckedAt time.Time         `json:"checked_at"`
+}
+
+func (r *SelfTestReport) check(name, status, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, DiagnosticCheck{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+	if status == checkFail || (status == checkWarn && r.Status != checkFail) {
+		r.Status = status
+	}
+}
+
+// Whether the API can write path, without changing it
+func fileWritable(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Whether the API can create files in dir
+func dirWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".selftest-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Check a file the API reads and, unless read-only, writes
+func (r *SelfTestReport) checkFile(name, path string) ([]byte, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		r.check(name, checkFail, "%s can't be read: %v", path, err)
+		return nil, false
+	}
+	if readOnlyMode.Load() {
+		r.check(name, checkPass, "%s is readable", path)
+		return content, true
+	}
+	if err := fileWritable(path); err != nil {
+		r.check(name, checkFail, "%s can't be written: %v", path, err)
+		return content, false
+	}
+	r.check(name, checkPass, "%s is readable and writable", path)
+	return content, true
+}
+
+// Run every check
+func runSelfTest() *SelfTestReport {
+	r := &SelfTestReport{Status: checkPass, Backend: backendType, Checks: []DiagnosticCheck{}}
+	timeout := STATUS_COMMAND_TIMEOUT
+
+	for _, tool := range []struct{ name, cmd, purpose string }{
+		{"wg", wgCmd, "reading and changing peers"},
+		{"wg-quick", wgQuickCmd, "starting and stopping the interface"},
+	} {
+		if path, err := exec.LookPath(tool.cmd); err != nil {
+			r.check(tool.name, checkFail, "%s isn't installed; it is needed for %s", tool.cmd, tool.purpose)
+		} else {
+			r.check(tool.name, checkPass, "%s is at %s", tool.cmd, path)
+		}
+	}
+
+	// The kernel module, or a userspace implementation wg-quick or the API
+	// falls back to
+	if available, message := kernelModuleAvailable(); available {
+		r.check("implementation", checkPass, "%s", message)
+	} else if found := findUserspaceImplementation(); found != "" {
+		r.check("implementation", checkPass, "No %s kernel module; the userspace %s is installed", backendType, found)
+	} else {
+		r.check("implementation", checkFail, "Neither the %s kernel module nor a userspace implementation is available", backendType)
+	}
+
+	nic := wgParams.ServerWGNIC
+	if content, ok := r.checkFile("params", WG_PARAMS_FILE); content != nil {
+		params := parseWGParams(content)
+		if err := validateWGParams(params); err != nil {
+			r.check("params_valid", checkFail, "%s: %v", WG_PARAMS_FILE, err)
+		} else if ok {
+			nic = params.ServerWGNIC
+		}
+	}
+	r.checkFile("config", WG_CONFIG_FILE)
+
+	// Client configs hold private keys
+	if info, err := os.Stat(WIREGUARD_CLIENTS); err != nil {
+		r.check("clients_dir", checkFail, "%s: %v", WIREGUARD_CLIENTS, err)
+	} else if !info.IsDir() {
+		r.check("clients_dir", checkFail, "%s isn't a directory", WIREGUARD_CLIENTS)
+	} else if err := dirWritable(WIREGUARD_CLIENTS); err != nil && !readOnlyMode.Load() {
+		r.check("clients_dir", checkFail, "No new client configs can be written to %s: %v", WIREGUARD_CLIENTS, err)
+	} else if perm := info.Mode().Perm(); perm&0077 != 0 {
+		r.check("clients_dir", checkWarn, "%s is %04o; other users can read the client keys, chmod 700 it", WIREGUARD_CLIENTS, perm)
+	} else {
+		r.check("clients_dir", checkPass, "%s is private", WIREGUARD_CLIENTS)
+	}
+
+	unit := wgServicePrefix + nic
+	if userspaceImpl != "" {
+		r.check("systemd_unit", checkPass, "No unit needed; the API runs %s for %s", userspaceImpl, nic)
+	} else if _, err := exec.LookPath(systemctlCmd); err != nil {
+		r.check("systemd_unit", checkWarn, "No systemctl; /start, /stop and /restart won't work")
+	} else if status, _ := executeCommandTimeout(timeout, systemctlCmd, "cat", unit); status != "success" {
+		r.check("systemd_unit", checkFail, "The unit %s doesn't exist", unit)
+	} else {
+		r.check("systemd_unit", checkPass, "The unit %s exists", unit)
+	}
+
+	r.CheckedAt = time.Now().UTC()
+	return r
+}
+
+// Run the self-test at startup as SELFTEST_ON_START says
+func startupSelfTest() {
+	if SELFTEST_ON_START == "off" {
+		return
+	}
+	report := runSelfTest()
+	var failed []string
+	for _, check := range report.Checks {
+		switch check.Status {
+		case checkFail:
+			failed = append(failed, check.Name)
+			log.Printf("Self-test %s: FAIL: %s", check.Name, check.Message)
+		case checkWarn:
+			log.Printf("Self-test %s: warning: %s", check.Name, check.Message)
+		}
+	}
+	if len(failed) == 0 {
+		log.Printf("Self-test passed")
+		return
+	}
+	if SELFTEST_ON_START == "fail" {
+		log.Fatalf("Self-test failed: %s; fix the host or set SELFTEST_ON_START=warn", strings.Join(failed, ", "))
+	}
+	log.Printf("Self-test failed: %s", strings.Join(failed, ", "))
+}
+
+// Handler for GET /selftest. Answers 503 when a check fails, so it can
+// serve as a readiness probe.
+func selfTestHandlerGin(c *gin.Context) {
+	report := runSelfTest()
+	status := http.StatusOK
+	if report.Status == checkFail {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, APIResponse{
+		Success: report.Status != checkFail,
+		Message: "Self-test: " + report.Status,
+		Data:    report,
+	})
+}
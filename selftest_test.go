@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	env := setupTestEnv(t)
+
+	paramsFile := filepath.Join(env.dir, "params")
+	params := "SERVER_PUB_IP=203.0.113.10\nSERVER_WG_NIC=wg0\nSERVER_WG_IPV4=10.66.0.1\nSERVER_PORT=51820\nSERVER_PUB_KEY=server-public-key\n"
+	os.WriteFile(paramsFile, []byte(params), 0600)
+	modules := t.TempDir()
+	os.Mkdir(filepath.Join(modules, "wireguard"), 0755)
+	// The unit exists when systemctl cat is asked for wg-quick@wg0
+	systemctl := filepath.Join(env.dir, "systemctl")
+	os.WriteFile(systemctl, []byte("#!/bin/bash\n[ \"$1 $2\" = \"cat wg-quick@wg0\" ]\n"), 0755)
+
+	oldParamsFile, oldModules, oldSystemctl, oldPrefix := WG_PARAMS_FILE, sysModuleDir, systemctlCmd, wgServicePrefix
+	WG_PARAMS_FILE, sysModuleDir, systemctlCmd, wgServicePrefix = paramsFile, modules, systemctl, "wg-quick@"
+	t.Cleanup(func() {
+		WG_PARAMS_FILE, sysModuleDir, systemctlCmd, wgServicePrefix = oldParamsFile, oldModules, oldSystemctl, oldPrefix
+	})
+
+	selfTest := func(want int) (SelfTestReport, map[string]string) {
+		t.Helper()
+		rec := env.authedRequest(t, http.MethodGet, "/api/v1/selftest", nil)
+		var resp struct {
+			Data SelfTestReport `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != want {
+			t.Fatalf("selftest: status %d, want %d, %s", rec.Code, want, rec.Body.String())
+		}
+		checks := map[string]string{}
+		for _, check := range resp.Data.Checks {
+			checks[check.Name] = check.Status
+		}
+		return resp.Data, checks
+	}
+
+	report, checks := selfTest(http.StatusOK)
+	if report.Status != checkPass || len(checks) != 7 {
+		t.Errorf("healthy host: got %+v", report)
+	}
+
+	// Keys readable by others only warn; incomplete params fail
+	os.Chmod(env.clientsDir, 0755)
+	os.WriteFile(paramsFile, []byte("SERVER_WG_NIC=wg1\n"), 0600)
+	report, checks = selfTest(http.StatusServiceUnavailable)
+	if report.Status != checkFail || checks["clients_dir"] != checkWarn || checks["params_valid"] != checkFail {
+		t.Errorf("misconfigured host: got %+v", report)
+	}
+
+	os.Remove(paramsFile)
+	if _, checks := selfTest(http.StatusServiceUnavailable); checks["params"] != checkFail {
+		t.Errorf("missing params: got %v", checks)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import "bytes"
+
+// Every client's peer block in the server config follows a "### Client"
+// marker line and ends at an empty line. Looking clients up used to compile
+// multiline regexes and run them over the whole file for every lookup,
+// which with thousands of peers made adds, deletes and status requests
+// slow; scanning the lines once is several times faster, see the benchmarks.
+
+const clientMarker = "### Client "
+
+// A client's block in the server config
+type clientSection struct {
+	name string
+	// Byte offsets of the marker line and of the line ending the block: an
+	// empty line, the next marker or the end of the config
+	start, end int
+	// Disabled clients have their peer lines commented out and no key
+	disabled  bool
+	publicKey string
+	// Raw AllowedIPs value, also of disabled clients
+	allowedIPs string
+}
+
+// The client blocks of the server config content, in order
+func scanClientSections(content []byte) []clientSection {
+	var sections []clientSection
+	open := -1 // index of the block being scanned
+	lines := 0 // lines of it after the marker
+	for offset := 0; offset < len(content); {
+		line, next := content[offset:], len(content)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, next = line[:i], offset+i+1
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		switch {
+		case bytes.HasPrefix(line, []byte(clientMarker)) && len(line) > len(clientMarker):
+			if open >= 0 {
+				sections[open].end = offset
+			}
+			sections = append(sections, clientSection{
+				name:  string(line[len(clientMarker):]),
+				start: offset,
+				end:   len(content),
+			})
+			open, lines = len(sections)-1, 0
+		case open < 0:
+		case len(line) == 0:
+			sections[open].end = offset
+			open = -1
+		default:
+			lines++
+			section := &sections[open]
+			if lines == 1 && line[0] == '#' {
+				section.disabled = true
+			}
+			if section.disabled {
+				line = bytes.TrimPrefix(line, []byte("#"))
+			}
+			key, value, ok := bytes.Cut(line, []byte("="))
+			if !ok {
+				break
+			}
+			switch string(bytes.TrimSpace(key)) {
+			case "PublicKey":
+				if !section.disabled && section.publicKey == "" {
+					section.publicKey = string(bytes.TrimSpace(value))
+				}
+			case "AllowedIPs":
+				if section.allowedIPs == "" {
+					section.allowedIPs = string(bytes.TrimSpace(value))
+				}
+			}
+		}
+		offset = next
+	}
+	return sections
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The regex scans the parser replaced, kept to check it against and as the
+// benchmarks' baseline
+
+func regexClientExists(content []byte, name string) bool {
+	for _, section := range clientSectionNames(name) {
+		if regexp.MustCompile(`(?m)^### Client ` + regexp.QuoteMeta(section) + `$`).Match(content) {
+			return true
+		}
+	}
+	return false
+}
+
+func regexFindClientNameByPublicKey(content []byte, publicKey string) string {
+	clientSectionRegex := regexp.MustCompile(`(?m)^### Client (.+)$\s*\[Peer\]\s*PublicKey = (.+)$`)
+	for _, match := range clientSectionRegex.FindAllSubmatch(content, -1) {
+		if string(match[2]) == publicKey {
+			return string(match[1])
+		}
+	}
+	return ""
+}
+
+func regexRemoveClientFromConfig(content []byte, name string) ([]byte, bool) {
+	for _, section := range clientSectionNames(name) {
+		clientRegex := regexp.MustCompile(`(?ms)^### Client ` + regexp.QuoteMeta(section) + `$.*?^$`)
+		if clientRegex.Match(content) {
+			return clientRegex.ReplaceAll(content, nil), true
+		}
+	}
+	return content, false
+}
+
+// A server config with n peers, as the API writes it
+func serverConfigWithPeers(n int) []byte {
+	var config strings.Builder
+	config.WriteString("[Interface]\nAddress = 10.66.0.1/16\nListenPort = 51820\nPrivateKey = server\n")
+	for i := 0; i < n; i++ {
+		config.WriteString(renderServerPeer(fmt.Sprintf("client%d", i), fmt.Sprintf("10.66.%d.%d", i/250, i%250+2), "", clientKeys{
+			publicKey:    fmt.Sprintf("pub%d=", i),
+			preSharedKey: fmt.Sprintf("psk%d=", i),
+		}))
+	}
+	return []byte(config.String())
+}
+
+func TestScanClientSectionsMatchesRegexScans(t *testing.T) {
+	content := serverConfigWithPeers(20)
+	content = append(content, "\n### Client wg0-client-old\n#[Peer]\n#PublicKey = gone=\n#AllowedIPs = 10.66.9.9/32\n"...)
+
+	sections := scanClientSections(content)
+	if len(sections) != 21 || sections[5].name != "client5" || sections[5].publicKey != "pub5=" || !sections[20].disabled || sections[20].publicKey != "" {
+		t.Fatalf("unexpected sections: %d, %+v, %+v", len(sections), sections[5], sections[len(sections)-1])
+	}
+	for _, key := range []string{"pub0=", "pub19=", "gone=", "missing="} {
+		want := regexFindClientNameByPublicKey(content, key)
+		got := ""
+		for _, section := range sections {
+			if section.publicKey == key {
+				got = section.name
+				break
+			}
+		}
+		if got != want {
+			t.Errorf("key %s: got %q, want %q", key, got, want)
+		}
+	}
+	for _, name := range []string{"client0", "client7", "client19", "old", "missing"} {
+		want, wantRemoved := regexRemoveClientFromConfig(content, name)
+		got, removed := removeClientFromConfig(content, name)
+		if string(got) != string(want) || removed != wantRemoved {
+			t.Errorf("removing %s differs from the regex:\n%s\nwant:\n%s", name, got, want)
+		}
+	}
+}
+
+func TestScanClientSectionsEdgeCases(t *testing.T) {
+	// CRLF line endings and a last block without a trailing newline
+	content := []byte("### Client alice\r\n[Peer]\r\nPublicKey = a=\r\n\r\n### Client bob\n[Peer]\nPublicKey = b=")
+	sections := scanClientSections(content)
+	if len(sections) != 2 || sections[0].name != "alice" || sections[0].publicKey != "a=" || sections[1].publicKey != "b=" {
+		t.Fatalf("unexpected sections: %+v", sections)
+	}
+	if updated, removed := removeClientFromConfig(content, "bob"); !removed || strings.Contains(string(updated), "bob") {
+		t.Errorf("bob must be removed:\n%s", updated)
+	}
+
+	// A marker without a name isn't a client
+	if sections := scanClientSections([]byte("### Client \n[Peer]\n")); len(sections) != 0 {
+		t.Errorf("unexpected sections: %+v", sections)
+	}
+}
+
+func BenchmarkClientExists(b *testing.B) {
+	content := serverConfigWithPeers(5000)
+	b.Run("regex", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			regexClientExists(content, "client4999")
+		}
+	})
+	b.Run("parser", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, section := range scanClientSections(content) {
+				if section.name == "client4999" {
+					break
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkFindClientNameByPublicKey(b *testing.B) {
+	content := serverConfigWithPeers(5000)
+	b.Run("regex", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			regexFindClientNameByPublicKey(content, "pub4999=")
+		}
+	})
+	b.Run("parser", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, section := range scanClientSections(content) {
+				if section.publicKey == "pub4999=" {
+					break
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkRemoveClientFromConfig(b *testing.B) {
+	content := serverConfigWithPeers(5000)
+	b.Run("regex", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			regexRemoveClientFromConfig(content, "client2500")
+		}
+	})
+	b.Run("parser", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			removeClientFromConfig(content, "client2500")
+		}
+	})
+}
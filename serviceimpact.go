@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Service actions that answer ?dry_run=true with their impact instead of
+// running, relative to the API version prefix
+var dryRunRoutes = map[string]bool{
+	"POST /stop":    true,
+	"POST /restart": true,
+}
+
+// Whether the request is a dry run of a service action, which only reads
+func serviceDryRun(c *gin.Context) bool {
+	return c.Query("dry_run") == "true" && dryRunRoutes[apiRoute(c)]
+}
+
+// A connected peer a stop or restart would cut off
+type ImpactedPeer struct {
+	Name            string    `json:"name,omitempty"` // empty for peers added outside the API
+	PublicKey       string    `json:"public_key"`
+	Endpoint        string    `json:"endpoint,omitempty"`
+	LatestHandshake time.Time `json:"latest_handshake"`
+}
+
+// What stopping or restarting the interface would disrupt
+type ServiceImpact struct {
+	Action  string `json:"action"`
+	Running bool   `json:"running"`
+	// When the interface last started or restarted, as systemctl reports
+	// it; empty when it is down or unknown
+	LastRestart    string         `json:"last_restart"`
+	ConnectedPeers int            `json:"connected_peers"`
+	Peers          []ImpactedPeer `json:"peers"`
+}
+
+// Gather the peers that handshaked recently from a fresh dump, so the
+// report isn't as old as the status cache
+func collectServiceImpact(action string) ServiceImpact {
+	impact := ServiceImpact{Action: action, Peers: []ImpactedPeer{}}
+	success, output := wireGuardDump()
+	if success != "success" {
+		return impact
+	}
+	impact.Running = true
+	impact.LastRestart = serviceActiveSince()
+
+	names := clientNamesByPublicKey()
+	now := time.Now()
+	for _, peer := range parseWGDump(output) {
+		if !peer.online(now) {
+			continue
+		}
+		impacted := ImpactedPeer{
+			Name:            names[peer.PublicKey],
+			PublicKey:       peer.PublicKey,
+			LatestHandshake: time.Unix(peer.LatestHandshake, 0).UTC(),
+		}
+		if peer.Endpoint != "(none)" {
+			impacted.Endpoint = peer.Endpoint
+		}
+		impact.Peers = append(impact.Peers, impacted)
+	}
+	sort.Slice(impact.Peers, func(i, j int) bool {
+		return impact.Peers[i].LatestHandshake.After(impact.Peers[j].LatestHandshake)
+	})
+	impact.ConnectedPeers = len(impact.Peers)
+	return impact
+}
+
+// Answer a dry run of POST /stop or /restart
+func serviceImpactHandler(c *gin.Context, action string) {
+	impact := collectServiceImpact(action)
+	message := fmt.Sprintf("Dry run: %s would disconnect %d connected peer(s)", action, impact.ConnectedPeers)
+	if !impact.Running {
+		message = fmt.Sprintf("Dry run: the %s interface is down, %s disconnects nobody", backendType, action)
+	}
+	respondNegotiated(c, http.StatusOK, APIResponse{
+		Success: true,
+		Message: message,
+		Data:    impact,
+	}, func() [][]string {
+		rows := [][]string{{"name", "public_key", "endpoint", "latest_handshake"}}
+		for _, peer := range impact.Peers {
+			rows = append(rows, []string{peer.Name, peer.PublicKey, peer.Endpoint, peer.LatestHandshake.Format(time.RFC3339)})
+		}
+		return rows
+	})
+}
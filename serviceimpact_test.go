@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServiceDryRunReportsImpact(t *testing.T) {
+	env := setupTestEnv(t)
+	setReadOnlyTokens(t, "reader-token")
+	alice := addedClient(t, env, "alice")
+	addedClient(t, env, "bob")
+
+	logFile := filepath.Join(env.dir, "systemctl.log")
+	oldSystemctl := systemctlCmd
+	systemctlCmd = hookScript(t, env, "systemctl", `echo "$*" >> `+logFile+`
+[ "$1" = show ] && echo "Fri 2026-10-16 03:00:12 UTC"`)
+	t.Cleanup(func() { systemctlCmd = oldSystemctl })
+	CONFIRM_DESTRUCTIVE = confirmToken
+	t.Cleanup(func() { CONFIRM_DESTRUCTIVE = confirmOff })
+
+	now := time.Now().Unix()
+	env.writeDump(t,
+		fmt.Sprintf("%s\tpsk\t198.51.100.1:4000\t%s/32\t%d\t1000\t2000\t25", alice.PublicKey, alice.IPV4, now-30),
+		fmt.Sprintf("unmanaged-key\tpsk\t(none)\t10.66.9.9/32\t%d\t0\t0\t25", now-10),
+		fmt.Sprintf("stale-key\tpsk\t198.51.100.2:4000\t10.66.0.3/32\t%d\t500\t500\t25", now-3600),
+	)
+
+	// A dry run only reads, so it needs no confirmation and a read-only
+	// token will do
+	rec := env.request(t, http.MethodPost, "/api/v1/restart?dry_run=true", nil, "reader-token")
+	var resp struct {
+		Data ServiceImpact `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("dry run: status %d, %s", rec.Code, rec.Body.String())
+	}
+	impact := resp.Data
+	if impact.Action != "restart" || !impact.Running || impact.LastRestart != "Fri 2026-10-16 03:00:12 UTC" || impact.ConnectedPeers != 2 {
+		t.Fatalf("got %+v", impact)
+	}
+	if impact.Peers[0].PublicKey != "unmanaged-key" || impact.Peers[0].Name != "" || impact.Peers[0].Endpoint != "" {
+		t.Errorf("first peer: %+v", impact.Peers[0])
+	}
+	if impact.Peers[1].Name != "alice" || impact.Peers[1].Endpoint != "198.51.100.1:4000" || impact.Peers[1].LatestHandshake.Unix() != now-30 {
+		t.Errorf("second peer: %+v", impact.Peers[1])
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/maintenance/enable", nil)
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/stop?dry_run=true", nil); rec.Code != http.StatusOK {
+		t.Errorf("dry run during maintenance: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/start?dry_run=true", nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("start: status %d, %s", rec.Code, rec.Body.String())
+	}
+	show := fmt.Sprintf("show -p ActiveEnterTimestamp --value %swg0\n", wgServicePrefix)
+	if logged := readFile(t, logFile); logged != show+show {
+		t.Errorf("a dry run controlled the service:\n%s", logged)
+	}
+	// The adds and enabling maintenance
+	if _, resp := changesSince(t, env, "?since=0"); len(resp.Data.Changes) != 3 {
+		t.Errorf("a dry run recorded a change: %+v", resp.Data.Changes)
+	}
+
+	env.authedRequest(t, http.MethodPost, "/api/v1/maintenance/disable", nil)
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/start?dry_run=true", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("start: status %d, %s", rec.Code, rec.Body.String())
+	}
+}
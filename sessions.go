@@ -0,0 +1,370 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WireGuard keeps no session log, only the latest handshake and cumulative
+// transfer counters. The session tracker polls `wg show dump` and stitches
+// consecutive handshakes from the same endpoint into sessions, so admins get
+// an approximation of when and from where a client was connected.
+//
+// The same polls feed a per-peer log of the endpoint IPs a peer connected
+// from, for spotting shared credentials or roaming.
+//
+// History lives in memory only and starts empty after a restart.
+
+// Sessions kept per peer; the oldest is dropped when a new one starts
+const maxSessionsPerPeer = 50
+
+// Endpoint log entries kept per peer; the oldest is dropped first
+const maxEndpointsPerPeer = 100
+
+// One approximated connection session of a peer
+type PeerSession struct {
+	Endpoint       string    `json:"endpoint"`
+	FirstHandshake time.Time `json:"first_handshake"`
+	LastHandshake  time.Time `json:"last_handshake"`
+	RxBytes        int64     `json:"rx_bytes"`
+	TxBytes        int64     `json:"tx_bytes"`
+	Active         bool      `json:"active"`
+
+	// Counter values at session start; transfer is measured against them
+	baseRx int64
+	baseTx int64
+}
+
+// One stretch of time a peer was seen connecting from an IP. Ports are
+// not part of the key because NAT changes them constantly; Endpoint is the
+// last full address seen.
+type EndpointChange struct {
+	IP        string    `json:"ip"`
+	Endpoint  string    `json:"endpoint"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Geo       *GeoInfo  `json:"geo,omitempty"`
+}
+
+type peerHistory struct {
+	sessions  []PeerSession
+	endpoints []EndpointChange
+	// Counters seen at the previous poll, used as the baseline of the next
+	// session and to detect counter resets after an interface restart
+	lastRx int64
+	lastTx int64
+}
+
+type sessionTracker struct {
+	mu    sync.Mutex
+	peers map[string]*peerHistory // keyed by public key
+}
+
+var sessions = newSessionTracker()
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{peers: make(map[string]*peerHistory)}
+}
+
+// Start polling the interface every SESSION_POLL_INTERVAL. A zero interval
+// disables tracking.
+func startSessionTracker() {
+	if SESSION_POLL_INTERVAL <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(SESSION_POLL_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			pollSessions()
+			<-ticker.C
+		}
+	}()
+}
+
+func pollSessions() {
+	success, output := wireGuardDump()
+	if success != "success" {
+		// Interface down: keep history as is, nothing new to learn
+		if DEBUG_MODE {
+			log.Printf("Session tracker: wg show dump failed: %s", output)
+		}
+		return
+	}
+	peers, now := parseWGDump(output), time.Now()
+	sessions.observe(peers, now)
+	if peerEventQueue != nil {
+		emitPeerEvents(peerStates.observe(peers, now))
+	}
+}
+
+// Fold one dump snapshot into the history. A handshake continues the
+// current session when it comes from the same endpoint within
+// onlineHandshakeWindow of the previous one; otherwise it starts a new one.
+func (t *sessionTracker) observe(peers []peerDump, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	present := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		present[peer.PublicKey] = true
+
+		history := t.peers[peer.PublicKey]
+		if history == nil {
+			history = &peerHistory{lastRx: peer.TransferRx, lastTx: peer.TransferTx}
+			t.peers[peer.PublicKey] = history
+		}
+
+		var current *PeerSession
+		if n := len(history.sessions); n > 0 {
+			current = &history.sessions[n-1]
+		}
+
+		// Counters went backwards: the interface was restarted and counts
+		// from zero again. Carry what the current session already counted.
+		if peer.TransferRx < history.lastRx || peer.TransferTx < history.lastTx {
+			history.lastRx, history.lastTx = 0, 0
+			if current != nil {
+				current.baseRx, current.baseTx = -current.RxBytes, -current.TxBytes
+			}
+		}
+
+		if peer.LatestHandshake > 0 {
+			handshake := time.Unix(peer.LatestHandshake, 0)
+
+			continues := current != nil &&
+				current.Endpoint == peer.Endpoint &&
+				handshake.Sub(current.LastHandshake) < onlineHandshakeWindow
+
+			if continues {
+				if handshake.After(current.LastHandshake) {
+					current.LastHandshake = handshake
+				}
+			} else if current == nil || handshake.After(current.LastHandshake) {
+				if current != nil {
+					current.Active = false
+				}
+				history.sessions = append(history.sessions, PeerSession{
+					Endpoint:       peer.Endpoint,
+					FirstHandshake: handshake,
+					LastHandshake:  handshake,
+					baseRx:         history.lastRx,
+					baseTx:         history.lastTx,
+				})
+				if len(history.sessions) > maxSessionsPerPeer {
+					history.sessions = history.sessions[len(history.sessions)-maxSessionsPerPeer:]
+				}
+				current = &history.sessions[len(history.sessions)-1]
+			}
+		}
+
+		history.recordEndpoint(peer.Endpoint, now)
+
+		// Counters only move while a session has live handshakes, so
+		// everything since the baseline belongs to the latest session
+		if current != nil {
+			current.Active = now.Sub(current.LastHandshake) < onlineHandshakeWindow
+			current.RxBytes = peer.TransferRx - current.baseRx
+			current.TxBytes = peer.TransferTx - current.baseTx
+		}
+
+		history.lastRx, history.lastTx = peer.TransferRx, peer.TransferTx
+	}
+
+	// Peers no longer on the interface were deleted
+	for publicKey := range t.peers {
+		if !present[publicKey] {
+			delete(t.peers, publicKey)
+		}
+	}
+}
+
+// Extend the current endpoint log entry, or start a new one when the IP
+// changed. Peers that never connected report "(none)" and are skipped.
+func (h *peerHistory) recordEndpoint(endpoint string, now time.Time) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return
+	}
+
+	if n := len(h.endpoints); n > 0 && h.endpoints[n-1].IP == host {
+		h.endpoints[n-1].Endpoint = endpoint
+		h.endpoints[n-1].LastSeen = now
+		return
+	}
+
+	h.endpoints = append(h.endpoints, EndpointChange{
+		IP:        host,
+		Endpoint:  endpoint,
+		FirstSeen: now,
+		LastSeen:  now,
+		Geo:       lookupEndpointGeo(endpoint),
+	})
+	if len(h.endpoints) > maxEndpointsPerPeer {
+		h.endpoints = h.endpoints[len(h.endpoints)-maxEndpointsPerPeer:]
+	}
+}
+
+// Endpoint log of one peer, newest first
+func (t *sessionTracker) endpointsFor(publicKey string) []EndpointChange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := t.peers[publicKey]
+	if history == nil {
+		return []EndpointChange{}
+	}
+
+	result := make([]EndpointChange, 0, len(history.endpoints))
+	for i := len(history.endpoints) - 1; i >= 0; i-- {
+		result = append(result, history.endpoints[i])
+	}
+	return result
+}
+
+// Sessions of one peer, newest first
+func (t *sessionTracker) sessionsFor(publicKey string) []PeerSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := t.peers[publicKey]
+	if history == nil {
+		return []PeerSession{}
+	}
+
+	result := make([]PeerSession, 0, len(history.sessions))
+	for i := len(history.sessions) - 1; i >= 0; i-- {
+		result = append(result, history.sessions[i])
+	}
+	return result
+}
+
+// Find the public key of a client by name, accepting the same prefixed
+// "### Client" forms as clientExists. Empty when the client has no peer.
+func findPublicKeyByClientName(name string) string {
+	inv, err := currentInventory()
+	if err != nil {
+		if DEBUG_MODE {
+			log.Printf("Failed to read WireGuard config: %v", err)
+		}
+		return ""
+	}
+
+	for _, section := range clientSectionNames(name) {
+		if key, ok := inv.keys[section]; ok {
+			return key
+		}
+	}
+
+	return ""
+}
+
+// Resolve the :name route parameter to the client's public key, answering
+// 400/404 itself. Returns false when the handler should stop.
+func publicKeyFromParam(c *gin.Context) (string, string, bool) {
+	name := c.Param("name")
+	if !validClientName(name) {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Client name " + clientNameMessage(),
+			Code:    codeInvalidName,
+		})
+		return "", "", false
+	}
+
+	publicKey := findPublicKeyByClientName(tenantFrom(c).storedName(name))
+	if publicKey == "" {
+		c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Message: "Client not found",
+			Code:    codeClientNotFound,
+		})
+		return "", "", false
+	}
+
+	return name, publicKey, true
+}
+
+// Handler for a client's connection session history
+func userSessionsHandlerGin(c *gin.Context) {
+	name, publicKey, ok := publicKeyFromParam(c)
+	if !ok {
+		return
+	}
+
+	history := sessions.sessionsFor(publicKey)
+
+	respondNegotiated(c, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"name":       name,
+			"public_key": publicKey,
+			"tracking":   SESSION_POLL_INTERVAL > 0,
+			"sessions":   history,
+		},
+	}, func() [][]string {
+		rows := [][]string{{"endpoint", "first_handshake", "last_handshake", "rx_bytes", "tx_bytes", "active"}}
+		for _, session := range history {
+			rows = append(rows, []string{
+				session.Endpoint,
+				session.FirstHandshake.UTC().Format(time.RFC3339),
+				session.LastHandshake.UTC().Format(time.RFC3339),
+				strconv.FormatInt(session.RxBytes, 10),
+				strconv.FormatInt(session.TxBytes, 10),
+				strconv.FormatBool(session.Active),
+			})
+		}
+		return rows
+	})
+}
+
+// Handler for the endpoint IPs a client connected from
+func userEndpointsHandlerGin(c *gin.Context) {
+	name, publicKey, ok := publicKeyFromParam(c)
+	if !ok {
+		return
+	}
+
+	endpoints := sessions.endpointsFor(publicKey)
+	distinct := make(map[string]bool, len(endpoints))
+	for _, entry := range endpoints {
+		distinct[entry.IP] = true
+	}
+
+	respondNegotiated(c, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"name":         name,
+			"public_key":   publicKey,
+			"tracking":     SESSION_POLL_INTERVAL > 0,
+			"distinct_ips": len(distinct),
+			"endpoints":    endpoints,
+		},
+	}, func() [][]string {
+		rows := [][]string{{"ip", "endpoint", "first_seen", "last_seen", "country_code", "country", "city"}}
+		for _, entry := range endpoints {
+			geo := entry.Geo
+			if geo == nil {
+				geo = &GeoInfo{}
+			}
+			rows = append(rows, []string{
+				entry.IP,
+				entry.Endpoint,
+				entry.FirstSeen.UTC().Format(time.RFC3339),
+				entry.LastSeen.UTC().Format(time.RFC3339),
+				geo.CountryCode,
+				geo.Country,
+				geo.City,
+			})
+		}
+		return rows
+	})
+}
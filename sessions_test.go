@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSessionTrackerStitchesHandshakes(t *testing.T) {
+	tracker := newSessionTracker()
+	start := time.Unix(1700000000, 0)
+
+	snapshot := func(handshake time.Time, endpoint string, rx, tx int64) []peerDump {
+		return []peerDump{{PublicKey: "pubA", Endpoint: endpoint, LatestHandshake: handshake.Unix(), TransferRx: rx, TransferTx: tx}}
+	}
+
+	// Two handshakes two minutes apart from one endpoint: one session
+	tracker.observe(snapshot(start, "198.51.100.1:4000", 0, 0), start)
+	tracker.observe(snapshot(start.Add(2*time.Minute), "198.51.100.1:4000", 1000, 2000), start.Add(2*time.Minute))
+
+	got := tracker.sessionsFor("pubA")
+	if len(got) != 1 {
+		t.Fatalf("got %d sessions, want 1", len(got))
+	}
+	if !got[0].Active || got[0].RxBytes != 1000 || got[0].TxBytes != 2000 {
+		t.Errorf("unexpected session %+v", got[0])
+	}
+	if !got[0].LastHandshake.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("last handshake not advanced: %v", got[0].LastHandshake)
+	}
+
+	// Silence, then a handshake from a new endpoint an hour later
+	later := start.Add(time.Hour)
+	tracker.observe(snapshot(later, "203.0.113.7:5000", 1500, 2500), later)
+
+	got = tracker.sessionsFor("pubA")
+	if len(got) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(got))
+	}
+	if got[0].Endpoint != "203.0.113.7:5000" || !got[0].Active {
+		t.Errorf("newest session should be the active one from the new endpoint, got %+v", got[0])
+	}
+	if got[1].Active {
+		t.Error("previous session must be closed")
+	}
+	if got[0].RxBytes != 500 || got[0].TxBytes != 500 {
+		t.Errorf("new session must only count bytes since it started, got rx=%d tx=%d", got[0].RxBytes, got[0].TxBytes)
+	}
+
+	// A peer missing from the dump was removed from the interface
+	tracker.observe(nil, later)
+	if got := tracker.sessionsFor("pubA"); len(got) != 0 {
+		t.Errorf("history of a removed peer must be dropped, got %d sessions", len(got))
+	}
+}
+
+func TestSessionTrackerKeepsBoundedHistory(t *testing.T) {
+	tracker := newSessionTracker()
+	start := time.Unix(1700000000, 0)
+
+	for i := 0; i < maxSessionsPerPeer+10; i++ {
+		at := start.Add(time.Duration(i) * time.Hour)
+		tracker.observe([]peerDump{{PublicKey: "pubA", Endpoint: "198.51.100.1:4000", LatestHandshake: at.Unix()}}, at)
+	}
+
+	if got := len(tracker.sessionsFor("pubA")); got != maxSessionsPerPeer {
+		t.Errorf("got %d sessions, want %d", got, maxSessionsPerPeer)
+	}
+}
+
+func TestUserSessionsHandler(t *testing.T) {
+	env := setupTestEnv(t)
+
+	oldTracker := sessions
+	sessions = newSessionTracker()
+	t.Cleanup(func() { sessions = oldTracker })
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding alice failed with status %d", code)
+	}
+	publicKey := findPublicKeyByClientName("alice")
+	if publicKey == "" {
+		t.Fatal("public key of alice not found in config")
+	}
+
+	now := time.Now()
+	sessions.observe([]peerDump{{PublicKey: publicKey, Endpoint: "198.51.100.1:4000", LatestHandshake: now.Unix()}}, now)
+
+	recorder := env.authedRequest(t, http.MethodGet, "/api/users/alice/sessions", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+
+	var resp struct {
+		Data struct {
+			PublicKey string        `json:"public_key"`
+			Sessions  []PeerSession `json:"sessions"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.Data.PublicKey != publicKey || len(resp.Data.Sessions) != 1 {
+		t.Errorf("unexpected response %s", recorder.Body.String())
+	}
+
+	if code := env.authedRequest(t, http.MethodGet, "/api/users/nobody/sessions", nil).Code; code != http.StatusNotFound {
+		t.Errorf("unknown client: got status %d, want 404", code)
+	}
+}
+
+func TestSessionTrackerLogsEndpointChanges(t *testing.T) {
+	tracker := newSessionTracker()
+	start := time.Unix(1700000000, 0)
+
+	observe := func(at time.Time, endpoint string) {
+		tracker.observe([]peerDump{{PublicKey: "pubA", Endpoint: endpoint, LatestHandshake: at.Unix()}}, at)
+	}
+
+	observe(start, "(none)")
+	observe(start.Add(time.Minute), "198.51.100.1:4000")
+	observe(start.Add(2*time.Minute), "198.51.100.1:4001") // NAT port change only
+	observe(start.Add(3*time.Minute), "[2001:db8::1]:4000")
+	observe(start.Add(4*time.Minute), "198.51.100.1:4002")
+
+	got := tracker.endpointsFor("pubA")
+	if len(got) != 3 {
+		t.Fatalf("got %d endpoint entries, want 3: %+v", len(got), got)
+	}
+	if got[0].IP != "198.51.100.1" || got[1].IP != "2001:db8::1" || got[2].IP != "198.51.100.1" {
+		t.Errorf("unexpected order (newest first): %+v", got)
+	}
+	if got[2].Endpoint != "198.51.100.1:4001" || !got[2].LastSeen.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("port change must extend the entry, got %+v", got[2])
+	}
+}
+
+func TestUserEndpointsHandler(t *testing.T) {
+	env := setupTestEnv(t)
+
+	oldTracker := sessions
+	sessions = newSessionTracker()
+	t.Cleanup(func() { sessions = oldTracker })
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/users/add", AddUserRequest{Name: "bob"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding bob failed with status %d", code)
+	}
+	publicKey := findPublicKeyByClientName("bob")
+
+	now := time.Now()
+	sessions.observe([]peerDump{{PublicKey: publicKey, Endpoint: "198.51.100.1:4000", LatestHandshake: now.Unix()}}, now)
+	sessions.observe([]peerDump{{PublicKey: publicKey, Endpoint: "203.0.113.9:4000", LatestHandshake: now.Unix() + 10}}, now.Add(10*time.Second))
+
+	recorder := env.authedRequest(t, http.MethodGet, "/api/users/bob/endpoints", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+
+	var resp struct {
+		Data struct {
+			DistinctIPs int              `json:"distinct_ips"`
+			Endpoints   []EndpointChange `json:"endpoints"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.Data.DistinctIPs != 2 || len(resp.Data.Endpoints) != 2 {
+		t.Errorf("unexpected response %s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A peer is considered online when its latest handshake is newer than this.
+// WireGuard re-handshakes every 2 minutes on an active tunnel, so 3 minutes
+// tolerates one missed rekey without flapping.
+const onlineHandshakeWindow = 3 * time.Minute
+
+// Usable IPv4 hosts in the client /16: 256 blocks of .1-.254, see
+// getNextAvailableIPv4
+const ipv4PoolSize = 256 * 254
+
+// When this process started, for the API uptime in /api/stats
+var apiStartTime = time.Now()
+
+// One peer line of `wg show <nic> dump`
+type peerDump struct {
+	PublicKey       string
+	PresharedKey    string
+	Endpoint        string
+	AllowedIPs      string
+	LatestHandshake int64 // unix seconds, 0 = never
+	TransferRx      int64
+	TransferTx      int64
+}
+
+// Parse `wg show <nic> dump` output. The first line describes the interface
+// (4 fields) and is skipped; peer lines have 8 tab-separated fields.
+func parseWGDump(output string) []peerDump {
+	var peers []peerDump
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+
+		peer := peerDump{
+			PublicKey:    fields[0],
+			PresharedKey: fields[1],
+			Endpoint:     fields[2],
+			AllowedIPs:   fields[3],
+		}
+		peer.LatestHandshake, _ = strconv.ParseInt(fields[4], 10, 64)
+		if len(fields) >= 7 {
+			peer.TransferRx, _ = strconv.ParseInt(fields[5], 10, 64)
+			peer.TransferTx, _ = strconv.ParseInt(fields[6], 10, 64)
+		}
+
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Whether the peer handshaked within onlineHandshakeWindow of now
+func (p peerDump) online(now time.Time) bool {
+	return p.LatestHandshake > 0 && now.Sub(time.Unix(p.LatestHandshake, 0)) < onlineHandshakeWindow
+}
+
+// Transfer field formats selectable with ?format=
+const (
+	transferFormatRaw   = "raw"   // exact byte counts only (*_bytes)
+	transferFormatHuman = "human" // formatted strings only (*_human)
+	transferFormatBoth  = "both"  // both, the default
+)
+
+// Read ?format= for transfer fields, answering 400 itself on an unknown
+// value. Returns false when the handler should stop.
+func parseTransferFormat(c *gin.Context) (string, bool) {
+	format := c.DefaultQuery("format", transferFormatBoth)
+	switch format {
+	case transferFormatRaw, transferFormatHuman, transferFormatBoth:
+		return format, true
+	}
+
+	c.JSON(http.StatusBadRequest, APIResponse{
+		Success: false,
+		Message: fmt.Sprintf("format must be one of %s, %s or %s", transferFormatRaw, transferFormatHuman, transferFormatBoth),
+	})
+	return "", false
+}
+
+// Format a byte count with binary units, e.g. 3650722201 -> "3.4 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Set <key>_bytes and/or <key>_human on m according to format
+func setTransferField(m map[string]interface{}, key string, n int64, format string) {
+	if format != transferFormatHuman {
+		m[key+"_bytes"] = n
+	}
+	if format != transferFormatRaw {
+		m[key+"_human"] = formatBytes(n)
+	}
+}
+
+// Copy of a status peer with its transfer fields rendered in format. The
+// collected peer holds exact counts in transfer_rx_bytes/transfer_tx_bytes.
+func formatPeerTransfer(peer map[string]interface{}, format string) map[string]interface{} {
+	formatted := make(map[string]interface{}, len(peer)+2)
+	for k, v := range peer {
+		formatted[k] = v
+	}
+
+	for _, key := range []string{"transfer_rx", "transfer_tx"} {
+		n, ok := peer[key+"_bytes"].(int64)
+		if !ok {
+			continue
+		}
+		delete(formatted, key+"_bytes")
+		setTransferField(formatted, key, n, format)
+	}
+	return formatted
+}
+
+// CSV rows for the collected status peers, with raw transfer counts
+func peerStatusTable(peers []map[string]interface{}) [][]string {
+	rows := [][]string{{"client_name", "public_key", "endpoint", "allowed_ips", "latest_handshake",
+		"transfer_rx_bytes", "transfer_tx_bytes", "country_code"}}
+
+	for _, peer := range peers {
+		row := make([]string, 0, len(rows[0]))
+		for _, key := range rows[0][:len(rows[0])-1] {
+			if v, ok := peer[key]; ok {
+				row = append(row, fmt.Sprint(v))
+			} else {
+				row = append(row, "")
+			}
+		}
+
+		countryCode := ""
+		if geo, ok := peer["geo"].(*GeoInfo); ok {
+			countryCode = geo.CountryCode
+		}
+		rows = append(rows, append(row, countryCode))
+	}
+	return rows
+}
+
+// Numbers behind /api/stats, shared with the GraphQL stats query
+type summaryStats struct {
+	TotalClients  int
+	OnlineClients int
+	TransferRx    int64
+	TransferTx    int64
+	UsedIPv4      int
+	// `wg show dump` worked, i.e. the interface is up
+	InterfaceUp bool
+}
+
+// Gather the summary from the server config and a single `wg show dump`
+func collectSummaryStats() (summaryStats, error) {
+	var stats summaryStats
+
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+
+	stats.TotalClients = len(regexp.MustCompile(`(?m)^### Client (.+)$`).FindAll(content, -1))
+	stats.UsedIPv4 = countUsedIPv4(wgParams, content)
+
+	// A stopped interface isn't an error here; it just means nobody is online
+	var peers []peerDump
+	if success, output := wireGuardDump(); success == "success" {
+		peers = parseWGDump(output)
+		stats.InterfaceUp = true
+	}
+
+	now := time.Now()
+	for _, peer := range peers {
+		if peer.online(now) {
+			stats.OnlineClients++
+		}
+		stats.TransferRx += peer.TransferRx
+		stats.TransferTx += peer.TransferTx
+	}
+
+	return stats, nil
+}
+
+// Summary statistics handler - a cheap alternative to /api/status for
+// dashboards. Runs a single `wg show dump` plus one systemctl query.
+// Accepts ?format= like the status handler.
+func statsHandlerGin(c *gin.Context) {
+	format, ok := parseTransferFormat(c)
+	if !ok {
+		return
+	}
+
+	stats, err := collectSummaryStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	rx, tx := stats.TransferRx, stats.TransferTx
+	transfer := make(map[string]interface{}, 6)
+	setTransferField(transfer, "rx", rx, format)
+	setTransferField(transfer, "tx", tx, format)
+	setTransferField(transfer, "total", rx+tx, format)
+
+	activeSince := serviceActiveSince()
+	uptime := int64(time.Since(apiStartTime).Seconds())
+	utilization := float64(stats.UsedIPv4) / float64(ipv4PoolSize) * 100
+
+	respondNegotiated(c, http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"total_clients":  stats.TotalClients,
+			"online_clients": stats.OnlineClients,
+			"transfer":       transfer,
+			"ip_pool": map[string]interface{}{
+				"used":        stats.UsedIPv4,
+				"size":        ipv4PoolSize,
+				"utilization": utilization,
+			},
+			"service_active_since": activeSince,
+			"api_uptime_seconds":   uptime,
+		},
+	}, func() [][]string {
+		// One row with raw numbers, regardless of format
+		return [][]string{
+			{"total_clients", "online_clients", "rx_bytes", "tx_bytes", "ip_pool_used", "ip_pool_size",
+				"ip_pool_utilization", "service_active_since", "api_uptime_seconds"},
+			{strconv.Itoa(stats.TotalClients), strconv.Itoa(stats.OnlineClients),
+				strconv.FormatInt(rx, 10), strconv.FormatInt(tx, 10),
+				strconv.Itoa(stats.UsedIPv4), strconv.Itoa(ipv4PoolSize),
+				strconv.FormatFloat(utilization, 'f', 2, 64), activeSince, strconv.FormatInt(uptime, 10)},
+		}
+	})
+}
+
+// Count the distinct client IPv4 addresses in the server /16, excluding the
+// server's own address. Mirrors the used-set built by getNextAvailableIPv4.
+func countUsedIPv4(params WGParams, content []byte) int {
+	parts := strings.Split(params.ServerWGIPv4, ".")
+	if len(parts) != 4 {
+		return 0
+	}
+
+	base := fmt.Sprintf("%s.%s", parts[0], parts[1])
+	used := make(map[string]bool)
+	for _, ip := range regexp.MustCompile(regexp.QuoteMeta(base)+`\.\d{1,3}\.\d{1,3}`).FindAllString(string(content), -1) {
+		used[ip] = true
+	}
+	delete(used, params.ServerWGIPv4)
+
+	return len(used)
+}
+
+// When the VPN systemd unit last became active, as reported by systemctl.
+// Empty when the unit is inactive or systemctl is unavailable.
+func serviceActiveSince() string {
+	if userspaceImpl != "" {
+		return userspaceStartedAt()
+	}
+	success, output := executeCommand(systemctlCmd, "show", "-p", "ActiveEnterTimestamp", "--value", wgServicePrefix+wgParams.ServerWGNIC)
+	if success != "success" {
+		return ""
+	}
+	return strings.TrimSpace(output)
+}
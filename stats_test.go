@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write the output the fake wg returns for "show <nic> dump". Each peer line
+// is public key, psk, endpoint, allowed ips, handshake, rx, tx, keepalive.
+func (e *testEnv) writeDump(t *testing.T, peerLines ...string) {
+	t.Helper()
+
+	content := "server-private-key\tserver-public-key\t51820\toff\n" + strings.Join(peerLines, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(e.dir, "dump"), []byte(content), 0600); err != nil {
+		t.Fatalf("writing dump: %v", err)
+	}
+}
+
+func TestParseWGDump(t *testing.T) {
+	output := "priv\tpub\t51820\toff\n" +
+		"pubA\tpskA\t198.51.100.1:4000\t10.66.0.2/32\t1700000000\t100\t200\t25\n" +
+		"pubB\tpskB\t(none)\t10.66.0.3/32\t0\t0\t0\toff\n"
+
+	peers := parseWGDump(output)
+	if len(peers) != 2 {
+		t.Fatalf("got %d peers, want 2 (interface line must be skipped)", len(peers))
+	}
+	if peers[0].PublicKey != "pubA" || peers[0].Endpoint != "198.51.100.1:4000" {
+		t.Errorf("unexpected first peer %+v", peers[0])
+	}
+	if peers[0].LatestHandshake != 1700000000 || peers[0].TransferRx != 100 || peers[0].TransferTx != 200 {
+		t.Errorf("numeric fields not parsed: %+v", peers[0])
+	}
+	if peers[1].LatestHandshake != 0 {
+		t.Errorf("never-handshaked peer got handshake %d", peers[1].LatestHandshake)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	env := setupTestEnv(t)
+
+	for _, name := range []string{"one", "two", "three"} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/users/add", AddUserRequest{Name: name}).Code; code != http.StatusOK {
+			t.Fatalf("seeding %s failed with status %d", name, code)
+		}
+	}
+
+	now := time.Now().Unix()
+	env.writeDump(t,
+		fmt.Sprintf("pub1\tpsk\t198.51.100.1:4000\t10.66.0.2/32\t%d\t1000\t2000\t25", now-30),
+		fmt.Sprintf("pub2\tpsk\t198.51.100.2:4000\t10.66.0.3/32\t%d\t500\t500\t25", now-3600),
+		"pub3\tpsk\t(none)\t10.66.0.4/32\t0\t0\t0\t25",
+	)
+
+	recorder := env.authedRequest(t, http.MethodGet, "/api/stats", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d, body %s", recorder.Code, recorder.Body.String())
+	}
+
+	var resp struct {
+		Data struct {
+			TotalClients  int `json:"total_clients"`
+			OnlineClients int `json:"online_clients"`
+			Transfer      struct {
+				Total int64 `json:"total_bytes"`
+			} `json:"transfer"`
+			IPPool struct {
+				Used int `json:"used"`
+			} `json:"ip_pool"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	if resp.Data.TotalClients != 3 {
+		t.Errorf("got total_clients %d, want 3", resp.Data.TotalClients)
+	}
+	if resp.Data.OnlineClients != 1 {
+		t.Errorf("got online_clients %d, want 1 (only the recent handshake)", resp.Data.OnlineClients)
+	}
+	if resp.Data.Transfer.Total != 4000 {
+		t.Errorf("got total_bytes %d, want 4000", resp.Data.Transfer.Total)
+	}
+	if resp.Data.IPPool.Used != 3 {
+		t.Errorf("got ip_pool.used %d, want 3 (server address excluded)", resp.Data.IPPool.Used)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:          "0 B",
+		1023:       "1023 B",
+		1024:       "1.0 KiB",
+		1536:       "1.5 KiB",
+		3650722201: "3.4 GiB",
+		5 << 40:    "5.0 TiB",
+	}
+	for n, want := range cases {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestTransferFormatSelection(t *testing.T) {
+	env := setupTestEnv(t)
+	env.writeDump(t, "pub1\tpsk\t198.51.100.1:4000\t10.66.0.2/32\t0\t1536\t2048\t25")
+
+	peerFields := func(path string) map[string]interface{} {
+		t.Helper()
+		recorder := env.authedRequest(t, http.MethodGet, path, nil)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", path, recorder.Code)
+		}
+		var resp struct {
+			Data struct {
+				Peers []map[string]interface{} `json:"peers"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		if len(resp.Data.Peers) != 1 {
+			t.Fatalf("%s: got %d peers, want 1", path, len(resp.Data.Peers))
+		}
+		return resp.Data.Peers[0]
+	}
+
+	both := peerFields("/api/status")
+	if both["transfer_rx_bytes"] != float64(1536) || both["transfer_rx_human"] != "1.5 KiB" {
+		t.Errorf("default format must include both fields, got %v", both)
+	}
+
+	raw := peerFields("/api/status?format=raw")
+	if _, ok := raw["transfer_tx_human"]; ok || raw["transfer_tx_bytes"] != float64(2048) {
+		t.Errorf("raw format must only have byte counts, got %v", raw)
+	}
+
+	human := peerFields("/api/status?format=human")
+	if _, ok := human["transfer_tx_bytes"]; ok || human["transfer_tx_human"] != "2.0 KiB" {
+		t.Errorf("human format must only have strings, got %v", human)
+	}
+
+	if code := env.authedRequest(t, http.MethodGet, "/api/stats?format=bogus", nil).Code; code != http.StatusBadRequest {
+		t.Errorf("unknown format: got status %d, want 400", code)
+	}
+}
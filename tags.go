@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tags are lightweight labels such as "contractor" or "laptop". Unlike
+// projects a client can carry several, and they come with no isolation or
+// routing of their own: they only select clients for listing, disabling,
+// enabling and deleting. They are stored with the client's metadata.
+
+const maxTags = 16
+
+var tagRegex = regexp.MustCompile(`^[a-z0-9_.-]{1,32}$`)
+
+// Lowercased, deduplicated and sorted tags
+func normalizeTags(tags []string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(tag)
+		if !tagRegex.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q must be 1-32 letters, digits, '.', '_' or '-'", tag)
+		}
+		set[tag] = true
+	}
+	if len(set) > maxTags {
+		return nil, fmt.Errorf("a client can have at most %d tags", maxTags)
+	}
+	return sortedKeys(set), nil
+}
+
+func (client Client) hasTag(tag string) bool {
+	for _, have := range client.Tags {
+		if strings.EqualFold(have, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clients carrying a tag
+func taggedClients(tag string) ([]Client, error) {
+	clients, err := listWireGuardClients()
+	if err != nil {
+		return nil, err
+	}
+	tagged := []Client{}
+	for _, client := range clients {
+		if client.hasTag(tag) {
+			tagged = append(tagged, client)
+		}
+	}
+	sort.Slice(tagged, func(i, j int) bool { return tagged[i].Name < tagged[j].Name })
+	return tagged, nil
+}
+
+// Handler listing the tags in use with their clients
+func listTagsHandlerGin(c *gin.Context) {
+	clients, err := listWireGuardClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	tags := make(map[string][]string)
+	for _, client := range clients {
+		for _, tag := range client.Tags {
+			tags[tag] = append(tags[tag], client.Name)
+		}
+	}
+	for _, names := range tags {
+		sort.Strings(names)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data:    tags,
+	})
+}
+
+// Handler disabling or enabling every client with a tag with one apply
+func setTagEnabledHandler(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tagged, err := taggedClients(c.Param("tag"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+
+		changed := []string{}
+		err = func() error {
+			wgConfigMutex.Lock()
+			defer wgConfigMutex.Unlock()
+
+			for _, client := range tagged {
+				ok, err := setClientEnabledLocked(client.Name, enabled)
+				if errors.Is(err, errClientNotFound) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if ok {
+					changed = append(changed, client.Name)
+				}
+			}
+			if len(changed) == 0 {
+				return nil
+			}
+			return syncWireGuardConf()
+		}()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: err.Error(),
+				Code:    errorCode(err),
+			})
+			return
+		}
+
+		verb := "Disabled"
+		if enabled {
+			verb = "Enabled"
+		}
+		c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: fmt.Sprintf("%s %d clients", verb, len(changed)),
+			Data:    map[string]interface{}{"clients": changed},
+		})
+	}
+}
+
+// Handler deleting every client with a tag
+func deleteTaggedClientsHandlerGin(c *gin.Context) {
+	tag := c.Param("tag")
+	tagged, err := taggedClients(tag)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+		return
+	}
+
+	deleted := []string{}
+	for _, client := range tagged {
+		if err := deleteWireGuardClient(client.Name); err != nil {
+			log.Printf("Tag %s: failed to delete %s: %v", tag, client.Name, err)
+			c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Message: fmt.Sprintf("deleted %d clients, then failed on %s: %v", len(deleted), client.Name, err),
+				Data:    map[string]interface{}{"clients": deleted},
+			})
+			return
+		}
+		deleted = append(deleted, client.Name)
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: fmt.Sprintf("Deleted %d clients", len(deleted)),
+		Data:    map[string]interface{}{"clients": deleted},
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	env := setupTestEnv(t)
+
+	for name, tags := range map[string][]string{
+		"alice": {"Contractor", "laptop", "laptop"},
+		"bob":   {"contractor"},
+		"carol": {"laptop"},
+	} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: name, Tags: tags}).Code; code != http.StatusOK {
+			t.Fatalf("adding %s: got status %d", name, code)
+		}
+	}
+	if alice := listedClients(t, env, "?search=alice")[0]; strings.Join(alice.Tags, ",") != "contractor,laptop" {
+		t.Errorf("tags must be normalized: %v", alice.Tags)
+	}
+
+	for query, want := range map[string]string{
+		"?tag=contractor":            "alice,bob",
+		"?tag=LAPTOP":                "alice,carol",
+		"?tag=contractor&tag=laptop": "alice",
+		"?tag=phone":                 "",
+	} {
+		if got := clientNames(listedClients(t, env, query)); got != want {
+			t.Errorf("listing %q: got %q, want %q", query, got, want)
+		}
+	}
+	if body := env.authedRequest(t, http.MethodGet, "/api/v1/tags", nil).Body.String(); !strings.Contains(body, `"contractor":["alice","bob"]`) {
+		t.Errorf("unexpected tags: %s", body)
+	}
+
+	// Disabling by tag applies once for all of them
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/tags/contractor/disable", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"clients":["alice","bob"]`) {
+		t.Fatalf("disabling contractors: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	disabled := disabledClientNames([]byte(env.configContent(t)))
+	if !disabled["alice"] || !disabled["bob"] || disabled["carol"] {
+		t.Errorf("only contractors must be disabled: %v", disabled)
+	}
+	env.authedRequest(t, http.MethodPost, "/api/v1/tags/contractor/enable", nil)
+	if disabled := disabledClientNames([]byte(env.configContent(t))); len(disabled) != 0 {
+		t.Errorf("contractors must be enabled again: %v", disabled)
+	}
+
+	// Replacing the tags moves bob out of the group
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/bob/metadata", ClientMetadataRequest{Tags: []string{}}).Code; code != http.StatusOK {
+		t.Fatalf("clearing bob's tags: got status %d", code)
+	}
+	rec = env.authedRequest(t, http.MethodPost, "/api/v1/tags/contractor/delete-all", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"clients":["alice"]`) {
+		t.Fatalf("deleting contractors: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if config := env.configContent(t); strings.Contains(config, "### Client alice") || !strings.Contains(config, "### Client bob") {
+		t.Errorf("only alice must be deleted:\n%s", config)
+	}
+}
+
+func TestTagValidation(t *testing.T) {
+	env := setupTestEnv(t)
+
+	for _, tags := range [][]string{{"two words"}, {strings.Repeat("a", 33)}, {""}} {
+		if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice", Tags: tags}).Code; code != http.StatusBadRequest {
+			t.Errorf("tags %q: got status %d, want 400", tags, code)
+		}
+	}
+	many := []string{}
+	for i := 0; i <= maxTags; i++ {
+		many = append(many, strings.Repeat("a", i+1))
+	}
+	if _, err := normalizeTags(many); err == nil {
+		t.Errorf("%d tags must be rejected", len(many))
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /server/teardown decommissions a node through the API that set it
+// up. It archives the server config, the params file, the client configs
+// and the state files next to the config into TEARDOWN_BACKUP_DIR, then
+// stops and disables the VPN unit and removes the nftables table and ip
+// rules the service manages. The backup comes first, so nothing is torn
+// down when it can't be written. The files stay in place; the archive is
+// what is kept once the host is wiped. Afterwards the process is read-only
+// and maintenance mode is on, so nothing puts the rules back until the
+// service is stopped.
+
+// Teardown request. Interface has to name the VPN interface, so a call
+// meant for another node does nothing here.
+type TeardownRequest struct {
+	Interface string `json:"interface" binding:"required"`
+}
+
+// What the teardown did
+type TeardownResult struct {
+	// "pass" when every step succeeded, else "fail"
+	Status    string `json:"status"`
+	Interface string `json:"interface"`
+	// Path of the archive; empty when it couldn't be written
+	Backup     string            `json:"backup,omitempty"`
+	Steps      []DiagnosticCheck `json:"steps"`
+	TornDownAt time.Time         `json:"torn_down_at"`
+}
+
+func (r *TeardownResult) step(name, status, format string, args ...interface{}) {
+	r.Steps = append(r.Steps, DiagnosticCheck{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+	if status == checkFail {
+		r.Status = checkFail
+	}
+}
+
+// TEARDOWN_BACKUP_DIR, or backups next to the server config
+func teardownBackupDir() string {
+	if TEARDOWN_BACKUP_DIR != "" {
+		return TEARDOWN_BACKUP_DIR
+	}
+	return filepath.Join(filepath.Dir(WG_CONFIG_FILE), "backups")
+}
+
+// Whether path is dir or inside it
+func pathWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Write paths, files or directories, to a gzipped tar at dest. Entries are
+// named by their absolute path, and nothing under skip is included.
+func writeTeardownArchive(dest string, paths []string, skip string) error {
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(file)
+	archive := tar.NewWriter(gz)
+
+	err = func() error {
+		for _, root := range paths {
+			walkErr := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if pathWithin(path, skip) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !info.IsDir() && !info.Mode().IsRegular() {
+					return nil
+				}
+				header, err := tar.FileInfoHeader(info, "")
+				if err != nil {
+					return err
+				}
+				header.Name = strings.TrimPrefix(filepath.ToSlash(path), "/")
+				if err := archive.WriteHeader(header); err != nil {
+					return err
+				}
+				if info.IsDir() {
+					return nil
+				}
+				content, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer content.Close()
+				_, err = io.Copy(archive, content)
+				return err
+			})
+			if walkErr != nil && !os.IsNotExist(walkErr) {
+				return walkErr
+			}
+		}
+		if err := archive.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	}()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+// Archive the server's files into the backup directory
+func backupServerFiles(now time.Time) (string, error) {
+	dir := teardownBackupDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	configDir, err := filepath.Abs(filepath.Dir(WG_CONFIG_FILE))
+	if err != nil {
+		return "", err
+	}
+	skip, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	// The config directory holds the state files; the params file and the
+	// client configs only count when they live elsewhere
+	paths := []string{configDir}
+	for _, path := range []string{WG_PARAMS_FILE, WIREGUARD_CLIENTS} {
+		if abs, err := filepath.Abs(path); err == nil && !pathWithin(abs, configDir) {
+			paths = append(paths, abs)
+		}
+	}
+
+	dest := filepath.Join(dir, fmt.Sprintf("teardown-%s-%s.tar.gz", wgParams.ServerWGNIC, now.UTC().Format("20060102T150405Z")))
+	return dest, writeTeardownArchive(dest, paths, skip)
+}
+
+// Drop the managed nftables table and ip rules. Caller holds wgConfigMutex.
+func removeManagedRulesLocked(result *TeardownResult) {
+	firewallMutex.Lock()
+	defer firewallMutex.Unlock()
+
+	success, output := executeCommand(nftCmd, "list", "table", "inet", firewallTable)
+	switch {
+	case success != "success" && strings.Contains(output, "No such file or directory"):
+		result.step("firewall", checkSkip, "No %s table is loaded", firewallTable)
+	case success != "success" && !firewallInstalled:
+		// No nft at all, and this process never loaded rules
+		result.step("firewall", checkSkip, "No firewall rules to remove: %s", strings.TrimSpace(output))
+	case success != "success":
+		result.step("firewall", checkFail, "Failed to list the %s table: %s", firewallTable, strings.TrimSpace(output))
+	default:
+		if success, output := executeCommand(nftCmd, "delete", "table", "inet", firewallTable); success != "success" {
+			result.step("firewall", checkFail, "Failed to remove the %s table: %s", firewallTable, strings.TrimSpace(output))
+		} else {
+			firewallInstalled = false
+			result.step("firewall", checkPass, "Removed the %s table", firewallTable)
+		}
+	}
+
+	profiles, err := loadRoutingProfilesLocked()
+	if err != nil {
+		result.step("routing", checkFail, "%v", err)
+		return
+	}
+	if len(profiles) == 0 && !routingManaged {
+		result.step("routing", checkSkip, "No routing profiles")
+		return
+	}
+	// With no profiles wanted every managed rule is removed
+	routingManaged = true
+	if err := applyPolicyRoutingLocked(nil); err != nil {
+		result.step("routing", checkFail, "%v", err)
+		return
+	}
+	result.step("routing", checkPass, "Removed the ip rules of %d routing profiles", len(profiles))
+}
+
+// Handler for POST /server/teardown. Answers 500 when a step failed;
+// the steps say which.
+func teardownHandlerGin(c *gin.Context) {
+	var req TeardownRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.Interface != wgParams.ServerWGNIC {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("interface %q isn't this server's %s", req.Interface, wgParams.ServerWGNIC),
+		})
+		return
+	}
+
+	wgConfigMutex.Lock()
+	defer wgConfigMutex.Unlock()
+
+	now := time.Now()
+	result := &TeardownResult{Status: checkPass, Interface: wgParams.ServerWGNIC, Steps: []DiagnosticCheck{}, TornDownAt: now.UTC()}
+	const total = 5
+
+	backup, err := backupServerFiles(now)
+	if err != nil {
+		result.step("backup", checkFail, "Failed to archive the server files, nothing was torn down: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Message: "Teardown failed: the backup couldn't be written",
+			Data:    result,
+		})
+		return
+	}
+	result.Backup = backup
+	result.step("backup", checkPass, "Archived the server files to %s", backup)
+	reportJobProgress(c, 1, total)
+
+	unit := wgServicePrefix + wgParams.ServerWGNIC
+	if output, err := controlWireGuardService("stop"); err != nil {
+		result.step("stop", checkFail, "%v: %s", err, strings.TrimSpace(output))
+	} else {
+		result.step("stop", checkPass, "Stopped %s", unit)
+	}
+	reportJobProgress(c, 2, total)
+	if success, output := executeCommand(systemctlCmd, "disable", unit); success != "success" {
+		result.step("disable", checkFail, "Failed to disable %s: %s", unit, strings.TrimSpace(output))
+	} else {
+		result.step("disable", checkPass, "Disabled %s; it won't start at boot", unit)
+	}
+	reportJobProgress(c, 3, total)
+
+	removeManagedRulesLocked(result)
+	reportJobProgress(c, 5, total)
+
+	// Nothing may put the rules back or change the archived files
+	readOnlyMode.Store(true)
+	if _, err := enterMaintenance("The node was torn down at " + now.UTC().Format(time.RFC3339)); err != nil {
+		result.step("maintenance", checkFail, "%v", err)
+	}
+	log.Printf("Teardown of %s: %s, backup at %s", unit, result.Status, backup)
+
+	status := http.StatusOK
+	message := fmt.Sprintf("%s torn down; the backup is at %s", unit, backup)
+	if result.Status == checkFail {
+		status = http.StatusInternalServerError
+		message = fmt.Sprintf("Teardown of %s incomplete; see the failed steps", unit)
+	}
+	c.JSON(status, APIResponse{
+		Success: status == http.StatusOK,
+		Message: message,
+		Data:    result,
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTeardown(t *testing.T) {
+	env := setupTestEnv(t)
+	rulesFile := setupFakeNft(t, env)
+	addedClient(t, env, "alice")
+	policy := FirewallPolicy{Allow: []FirewallRule{{Destination: "10.0.5.0/24"}}}
+	env.authedRequest(t, http.MethodPost, "/api/v1/users/alice/firewall", policy)
+	t.Cleanup(func() { readOnlyMode.Store(false) })
+
+	logFile := filepath.Join(env.dir, "systemctl.log")
+	systemctl := filepath.Join(env.dir, "systemctl")
+	os.WriteFile(systemctl, []byte("#!/bin/bash\necho \"$*\" >> "+logFile+"\n"), 0755)
+	oldSystemctl, oldPrefix := systemctlCmd, wgServicePrefix
+	systemctlCmd, wgServicePrefix = systemctl, "wg-quick@"
+	t.Cleanup(func() { systemctlCmd, wgServicePrefix = oldSystemctl, oldPrefix })
+
+	// Naming another interface does nothing
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/server/teardown", TeardownRequest{Interface: "wg9"}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("wrong interface: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(logFile); err == nil {
+		t.Fatal("a teardown of another interface ran systemctl")
+	}
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/server/teardown", TeardownRequest{Interface: "wg0"})
+	var resp struct {
+		Data TeardownResult `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("teardown: status %d, %s", rec.Code, rec.Body.String())
+	}
+	steps := map[string]string{}
+	for _, step := range resp.Data.Steps {
+		steps[step.Name] = step.Status
+	}
+	if steps["backup"] != checkPass || steps["stop"] != checkPass || steps["disable"] != checkPass || steps["firewall"] != checkPass {
+		t.Errorf("steps: %+v", resp.Data.Steps)
+	}
+
+	commands := readFile(t, logFile)
+	if !strings.Contains(commands, "stop wg-quick@wg0") || !strings.Contains(commands, "disable wg-quick@wg0") {
+		t.Errorf("systemctl: %s", commands)
+	}
+	if rules := readRules(t, rulesFile); rules != "" {
+		t.Errorf("the firewall table is still loaded:\n%s", rules)
+	}
+
+	// The archive holds the server config and the client's config
+	file, err := os.Open(resp.Data.Backup)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	names := map[string]bool{}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			break
+		}
+		names["/"+header.Name] = true
+	}
+	if !names[env.configFile] || !names[filepath.Join(env.clientsDir, "wg0-client-alice.conf")] {
+		t.Errorf("backup lacks the configs: %v", names)
+	}
+
+	// Nothing changes afterwards
+	if currentMaintenance() == nil || writesAllowed() {
+		t.Error("the node can still be changed after the teardown")
+	}
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "bob"}); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("add after teardown: status %d", rec.Code)
+	}
+}
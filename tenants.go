@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// A customer sharing this server. Its clients are stored as
+// "<tenant>.<name>" in the server config, so two tenants can both have an
+// "alice"; the tenant only ever sees and passes the bare name.
+type Tenant struct {
+	Name   string   `yaml:"name"`
+	Tokens []string `yaml:"tokens"`
+	// IPv4 CIDR inside the server subnet the tenant's clients get addresses
+	// from; the whole server subnet when empty
+	IPPool string `yaml:"ip_pool"`
+	// 0 means no limit
+	MaxClients int `yaml:"max_clients"`
+	// Client creations per hour for each of the tenant's tokens, 0 means no
+	// limit
+	MaxCreatesPerHour int `yaml:"max_creates_per_hour"`
+	// Adds become client requests the admin approves, see clientrequests.go
+	RequireApproval bool `yaml:"require_approval"`
+
+	pool *net.IPNet
+}
+
+// Routes a tenant token may call, relative to the API version prefix.
+// Everything else (server control, status of all peers, bulk deletes,
+// imports, nodes, GraphQL) stays with the admin API_TOKEN.
+var tenantRoutes = map[string]bool{
+	"GET /users":                         true,
+	"GET /users/export":                  true,
+	"GET /users/roaming":                 true,
+	"POST /users/add":                    true,
+	"POST /users":                        true,
+	"POST /users/preview":                true,
+	"POST /users/add-bulk":               true,
+	"POST /users/delete":                 true,
+	"DELETE /users/:name":                true,
+	"GET /users/:name":                   true,
+	"GET /users/:name/config":            true,
+	"POST /users/:name/metadata":         true,
+	"POST /users/:name/restore":          true,
+	"GET /users/:name/sessions":          true,
+	"GET /users/:name/endpoints":         true,
+	"POST /users/:name/diagnose":         true,
+	"POST /users/:name/mtu-probe":        true,
+	"GET /users/:name/endpoint-profile":  true,
+	"POST /users/:name/endpoint-profile": true,
+	"GET /requests":                      true,
+}
+
+var (
+	errTenantLimit     = errors.New("client limit for this tenant reached")
+	errOutsideTenantIP = errors.New("address is outside this tenant's IP pool")
+)
+
+// Tenants by API token, loaded from TENANTS_CONFIG
+var tenantsByToken = map[string]*Tenant{}
+
+func loadTenants() error {
+	if TENANTS_CONFIG == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(TENANTS_CONFIG)
+	if err != nil {
+		return fmt.Errorf("failed to read tenants config: %v", err)
+	}
+
+	var file struct {
+		Tenants []*Tenant `yaml:"tenants"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("failed to parse tenants config: %v", err)
+	}
+
+	byToken := make(map[string]*Tenant)
+	names := make(map[string]bool)
+	for _, tenant := range file.Tenants {
+		if !clientNameRegex.MatchString(tenant.Name) {
+			return fmt.Errorf("tenants config: tenant name %q %s", tenant.Name, invalidClientNameMessage)
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("tenants config: duplicate tenant %s", tenant.Name)
+		}
+		names[tenant.Name] = true
+
+		if tenant.IPPool != "" {
+			ip, pool, err := net.ParseCIDR(tenant.IPPool)
+			if err != nil || ip.To4() == nil {
+				return fmt.Errorf("tenants config: tenant %s has invalid ip_pool %q", tenant.Name, tenant.IPPool)
+			}
+			tenant.pool = pool
+		}
+
+		if len(tenant.Tokens) == 0 {
+			return fmt.Errorf("tenants config: tenant %s has no tokens", tenant.Name)
+		}
+		for _, token := range tenant.Tokens {
+			if token == "" || isAPIToken(token) || byToken[token] != nil {
+				return fmt.Errorf("tenants config: tenant %s has an empty or reused token", tenant.Name)
+			}
+			byToken[token] = tenant
+		}
+	}
+
+	tenantsByToken = byToken
+	log.Printf("Loaded %d tenants from %s", len(names), TENANTS_CONFIG)
+	return nil
+}
+
+// The tenant of the authenticated token, nil for the admin token
+func tenantFrom(c *gin.Context) *Tenant {
+	if tenant, ok := c.Get("tenant"); ok {
+		return tenant.(*Tenant)
+	}
+	return nil
+}
+
+// Keep tenant tokens to the client routes
+func tenantAllowed(c *gin.Context) bool {
+	return tenantRoutes[apiRoute(c)]
+}
+
+// Name of a tenant's client in the server config. The nil tenant is the
+// admin, whose names are used as given.
+func (t *Tenant) storedName(name string) string {
+	if t == nil {
+		return name
+	}
+	return t.Name + "." + name
+}
+
+// Keep only the tenant's clients, with bare names
+func (t *Tenant) ownClients(clients []Client) []Client {
+	if t == nil {
+		return clients
+	}
+	own := []Client{}
+	for _, client := range clients {
+		if name := strings.TrimPrefix(client.Name, t.Name+"."); name != client.Name {
+			client.Name = name
+			own = append(own, client)
+		}
+	}
+	return own
+}
+
+// Fail with errTenantLimit when adding one more client would exceed the
+// tenant's limit. Caller holds wgConfigMutex.
+func (t *Tenant) checkLimitLocked() error {
+	if t == nil || t.MaxClients <= 0 {
+		return nil
+	}
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	count := len(regexp.MustCompile(`(?m)^### Client `+regexp.QuoteMeta(t.Name)+`\.`).FindAll(content, -1))
+	if count >= t.MaxClients {
+		return errTenantLimit
+	}
+	return nil
+}
+
+// Fill in missing client IPs like allocateClientIPsLocked, but take IPv4
+// from the tenant's pool and refuse requested addresses outside it. Caller
+// holds wgConfigMutex.
+func (t *Tenant) allocateIPsLocked(ipv4, ipv6 string) (string, string, error) {
+	if t == nil || t.pool == nil {
+		return allocateClientIPsLocked(ipv4, ipv6)
+	}
+
+	if ipv4 != "" {
+		if ip := net.ParseIP(ipv4); ip == nil || !t.pool.Contains(ip) {
+			return "", "", errOutsideTenantIP
+		}
+		return allocateClientIPsLocked(ipv4, ipv6)
+	}
+
+	content, err := readAllocationContent()
+	if err != nil {
+		return "", "", err
+	}
+	used := map[string]bool{wgParams.ServerWGIPv4: true}
+	for _, ip := range regexp.MustCompile(`\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}`).FindAllString(string(content), -1) {
+		used[ip] = true
+	}
+
+	// Walk the pool lowest first, skipping the network and broadcast addresses
+	start := t.pool.IP.To4()
+	ones, bits := t.pool.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	base := uint32(start[0])<<24 | uint32(start[1])<<16 | uint32(start[2])<<8 | uint32(start[3])
+	for offset := uint32(1); offset+1 < size; offset++ {
+		n := base + offset
+		ip := fmt.Sprintf("%d.%d.%d.%d", n>>24, n>>16&0xff, n>>8&0xff, n&0xff)
+		if !used[ip] {
+			return allocateClientIPsLocked(ip, ipv6)
+		}
+	}
+	return "", "", withCode(codeSubnetExhausted, fmt.Errorf("no available IPv4 addresses in the tenant's pool"))
+}
+
+// Answer a tenant-specific add failure, returning false for other errors
+func respondTenantError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, errTenantLimit):
+		limit := tenantFrom(c).MaxClients
+		c.JSON(http.StatusForbidden, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("Client limit of %d reached", limit),
+			Code:    codeTenantLimit,
+			Data: map[string]interface{}{
+				"limit": limit,
+				"used":  limit,
+			},
+		})
+	case errors.Is(err, errOutsideTenantIP):
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: err.Error(),
+			Code:    errorCode(err),
+		})
+	default:
+		return false
+	}
+	return true
+}
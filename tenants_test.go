@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupTenants(t *testing.T, env *testEnv) {
+	t.Helper()
+
+	config := `tenants:
+  - name: acme
+    tokens: [acme-token]
+    ip_pool: 10.66.10.0/30
+    max_clients: 3
+  - name: globex
+    tokens: [globex-token, globex-token-2]
+`
+	path := filepath.Join(env.dir, "tenants.yml")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatalf("writing tenants config: %v", err)
+	}
+	oldConfig := TENANTS_CONFIG
+	TENANTS_CONFIG = path
+	t.Cleanup(func() {
+		TENANTS_CONFIG = oldConfig
+		tenantsByToken = map[string]*Tenant{}
+	})
+	if err := loadTenants(); err != nil {
+		t.Fatalf("loadTenants: %v", err)
+	}
+}
+
+func TestTenantsHaveSeparateNamespaces(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+
+	for _, token := range []string{"acme-token", "globex-token"} {
+		if recorder := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}, token); recorder.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, body %s", token, recorder.Code, recorder.Body.String())
+		}
+	}
+	config := env.configContent(t)
+	if !strings.Contains(config, "### Client acme.alice") || !strings.Contains(config, "### Client globex.alice") {
+		t.Fatalf("tenant clients must be stored under their namespace:\n%s", config)
+	}
+
+	var list struct {
+		Data []Client `json:"data"`
+	}
+	json.Unmarshal(env.request(t, http.MethodGet, "/api/v1/users", nil, "globex-token-2").Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].Name != "alice" {
+		t.Errorf("tenant must see only its own clients by bare name, got %+v", list.Data)
+	}
+
+	// The admin sees everything
+	admin := env.authedRequest(t, http.MethodGet, "/api/v1/users", nil).Body.String()
+	if !strings.Contains(admin, `"name":"acme.alice"`) || !strings.Contains(admin, `"name":"globex.alice"`) {
+		t.Errorf("admin list: %s", admin)
+	}
+
+	if code := env.request(t, http.MethodPost, "/api/v1/users/delete", DeleteUserRequest{Name: "alice"}, "acme-token").Code; code != http.StatusOK {
+		t.Fatalf("delete: got status %d", code)
+	}
+	if config := env.configContent(t); strings.Contains(config, "acme.alice") || !strings.Contains(config, "globex.alice") {
+		t.Errorf("delete must only touch the tenant's own client:\n%s", config)
+	}
+}
+
+func TestTenantPoolAndLimit(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+
+	// The /30 pool has two usable addresses
+	var added struct {
+		Data Client `json:"data"`
+	}
+	json.Unmarshal(env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "a"}, "acme-token").Body.Bytes(), &added)
+	if added.Data.IPV4 != "10.66.10.1" {
+		t.Errorf("got IPv4 %s, want the first pool address", added.Data.IPV4)
+	}
+
+	if code := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "b", IPV4: "10.66.0.9"}, "acme-token").Code; code != http.StatusBadRequest {
+		t.Errorf("address outside the pool: got status %d, want 400", code)
+	}
+
+	recorder := env.request(t, http.MethodPost, "/api/v1/users/add-bulk", AddUsersBulkRequest{Names: []string{"b", "c"}}, "acme-token")
+	var bulk struct {
+		Data struct {
+			Results []BulkUserResult `json:"results"`
+		} `json:"data"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &bulk)
+	if len(bulk.Data.Results) != 2 || bulk.Data.Results[0].IPV4 != "10.66.10.2" || bulk.Data.Results[1].Success {
+		t.Errorf("pool must be exhausted after two clients, got %+v", bulk.Data.Results)
+	}
+
+	// Widen the pool so the limit of 3 is what stops the fourth client
+	tenantsByToken["acme-token"].pool = nil
+	env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "c"}, "acme-token")
+	if code := env.request(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "d"}, "acme-token").Code; code != http.StatusForbidden {
+		t.Errorf("over the limit: got status %d, want 403", code)
+	}
+}
+
+func TestTenantTokensAreLimitedToClientRoutes(t *testing.T) {
+	env := setupTestEnv(t)
+	setupTenants(t, env)
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/api/v1/status"},
+		{http.MethodPost, "/api/v1/users/delete-all"},
+		{http.MethodPost, "/api/v1/restart"},
+		{http.MethodPost, "/api/graphql"},
+	} {
+		if code := env.request(t, route.method, route.path, nil, "acme-token").Code; code != http.StatusForbidden {
+			t.Errorf("%s %s: got status %d, want 403", route.method, route.path, code)
+		}
+	}
+
+	// Deprecated unversioned routes work too
+	if code := env.request(t, http.MethodGet, "/api/users", nil, "acme-token").Code; code != http.StatusOK {
+		t.Errorf("got status %d, want 200", code)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dashboards want bandwidth graphs without running a TSDB. The interface's
+// rx/tx counters are sampled every THROUGHPUT_SAMPLE_INTERVAL into a ring
+// buffer holding THROUGHPUT_RETENTION worth of samples, and
+// GET /server/throughput?window=1h returns the series with the rate since
+// the previous sample. The counters come from the kernel's interface
+// statistics, so they cover the userspace implementations' tun devices too.
+// Like the session history, the series lives in memory only and starts
+// empty after a restart; while the interface is down nothing is sampled,
+// which leaves a gap.
+
+// Where the kernel exposes interface statistics; a var so tests can stub it
+var netClassDir = "/sys/class/net"
+
+// One sample of the interface counters
+type ThroughputSample struct {
+	Time    time.Time `json:"time"`
+	RxBytes int64     `json:"rx_bytes"`
+	TxBytes int64     `json:"tx_bytes"`
+	// Bytes per second since the previous sample; 0 for the first sample
+	// and after the counters were reset by an interface restart
+	RxRate float64 `json:"rx_bytes_per_sec"`
+	TxRate float64 `json:"tx_bytes_per_sec"`
+}
+
+// Fixed-size ring of samples, the oldest overwritten first
+type throughputRing struct {
+	mu      sync.Mutex
+	samples []ThroughputSample
+	next    int
+	full    bool
+}
+
+var throughput = newThroughputRing(1)
+
+func newThroughputRing(size int) *throughputRing {
+	if size < 1 {
+		size = 1
+	}
+	return &throughputRing{samples: make([]ThroughputSample, size)}
+}
+
+// Samples kept at the configured interval and retention
+func throughputRingSize() int {
+	if THROUGHPUT_SAMPLE_INTERVAL <= 0 {
+		return 1
+	}
+	return int(THROUGHPUT_RETENTION / THROUGHPUT_SAMPLE_INTERVAL)
+}
+
+// Add a reading, working out the rates against the previous one
+func (r *throughputRing) add(now time.Time, rx, tx int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sample := ThroughputSample{Time: now.UTC(), RxBytes: rx, TxBytes: tx}
+	if r.next > 0 || r.full {
+		prev := r.samples[(r.next+len(r.samples)-1)%len(r.samples)]
+		elapsed := now.Sub(prev.Time).Seconds()
+		if elapsed > 0 && rx >= prev.RxBytes && tx >= prev.TxBytes {
+			sample.RxRate = float64(rx-prev.RxBytes) / elapsed
+			sample.TxRate = float64(tx-prev.TxBytes) / elapsed
+		}
+	}
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// The samples taken after since, oldest first
+func (r *throughputRing) since(since time.Time) []ThroughputSample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	start, count := 0, r.next
+	if r.full {
+		start, count = r.next, len(r.samples)
+	}
+	samples := make([]ThroughputSample, 0, count)
+	for i := 0; i < count; i++ {
+		sample := r.samples[(start+i)%len(r.samples)]
+		if sample.Time.After(since) {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// Read a counter of the interface's statistics
+func readInterfaceCounter(nic, name string) (int64, error) {
+	content, err := os.ReadFile(filepath.Join(netClassDir, nic, "statistics", name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+}
+
+func sampleThroughput() {
+	rx, err := readInterfaceCounter(wgParams.ServerWGNIC, "rx_bytes")
+	var tx int64
+	if err == nil {
+		tx, err = readInterfaceCounter(wgParams.ServerWGNIC, "tx_bytes")
+	}
+	if err != nil {
+		// Interface down: no sample, the series has a gap
+		if DEBUG_MODE {
+			log.Printf("Throughput sampler: %v", err)
+		}
+		return
+	}
+	throughput.add(time.Now(), rx, tx)
+}
+
+// Start sampling every THROUGHPUT_SAMPLE_INTERVAL. A zero interval
+// disables sampling.
+func startThroughputSampler() {
+	if THROUGHPUT_SAMPLE_INTERVAL <= 0 {
+		return
+	}
+	throughput = newThroughputRing(throughputRingSize())
+
+	go func() {
+		ticker := time.NewTicker(THROUGHPUT_SAMPLE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			sampleThroughput()
+			<-ticker.C
+		}
+	}()
+}
+
+// Handler for GET /server/throughput. ?window= is how far back to go,
+// 1h by default and at most THROUGHPUT_RETENTION.
+func throughputHandlerGin(c *gin.Context) {
+	if THROUGHPUT_SAMPLE_INTERVAL <= 0 {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: "Throughput sampling is off; set THROUGHPUT_SAMPLE_INTERVAL",
+		})
+		return
+	}
+	window, err := time.ParseDuration(c.DefaultQuery("window", "1h"))
+	if err != nil || window <= 0 || window > THROUGHPUT_RETENTION {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("window must be a positive duration such as 1h, at most THROUGHPUT_RETENTION (%s)", THROUGHPUT_RETENTION),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"interface": wgParams.ServerWGNIC,
+			"interval":  THROUGHPUT_SAMPLE_INTERVAL.String(),
+			"window":    window.String(),
+			"samples":   throughput.since(time.Now().Add(-window)),
+		},
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThroughputRing(t *testing.T) {
+	ring := newThroughputRing(3)
+	start := time.Unix(1700000000, 0)
+	for i, counters := range [][2]int64{{0, 0}, {1000, 500}, {3000, 1500}, {100, 50}} {
+		ring.add(start.Add(time.Duration(i)*10*time.Second), counters[0], counters[1])
+	}
+
+	samples := ring.since(time.Time{})
+	if len(samples) != 3 {
+		t.Fatalf("got %d samples, want the 3 newest", len(samples))
+	}
+	if samples[0].RxBytes != 1000 || samples[2].RxBytes != 100 {
+		t.Errorf("samples out of order: %+v", samples)
+	}
+	if samples[1].RxRate != 200 || samples[1].TxRate != 100 {
+		t.Errorf("rates: got %v/%v, want 200/100", samples[1].RxRate, samples[1].TxRate)
+	}
+	// The counters went backwards, as after an interface restart
+	if samples[2].RxRate != 0 || samples[2].TxRate != 0 {
+		t.Errorf("rates after a reset: %+v", samples[2])
+	}
+
+	if recent := ring.since(start.Add(15 * time.Second)); len(recent) != 2 {
+		t.Errorf("got %d samples after 15s, want 2", len(recent))
+	}
+}
+
+func TestThroughputHandler(t *testing.T) {
+	env := setupTestEnv(t)
+	oldDir, oldInterval, oldRetention, oldRing := netClassDir, THROUGHPUT_SAMPLE_INTERVAL, THROUGHPUT_RETENTION, throughput
+	t.Cleanup(func() {
+		netClassDir, THROUGHPUT_SAMPLE_INTERVAL, THROUGHPUT_RETENTION, throughput = oldDir, oldInterval, oldRetention, oldRing
+	})
+	netClassDir = filepath.Join(env.dir, "net")
+	THROUGHPUT_SAMPLE_INTERVAL, THROUGHPUT_RETENTION = time.Second, time.Hour
+	throughput = newThroughputRing(throughputRingSize())
+
+	// No interface yet: nothing is sampled
+	sampleThroughput()
+	stats := filepath.Join(netClassDir, "wg0", "statistics")
+	if err := os.MkdirAll(stats, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(stats, "rx_bytes"), []byte("4096\n"), 0644)
+	os.WriteFile(filepath.Join(stats, "tx_bytes"), []byte("2048\n"), 0644)
+	sampleThroughput()
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/server/throughput?window=10m", nil)
+	var resp struct {
+		Data struct {
+			Interface string             `json:"interface"`
+			Samples   []ThroughputSample `json:"samples"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, %s", rec.Code, rec.Body.String())
+	}
+	if resp.Data.Interface != "wg0" || len(resp.Data.Samples) != 1 || resp.Data.Samples[0].RxBytes != 4096 || resp.Data.Samples[0].TxBytes != 2048 {
+		t.Errorf("got %+v", resp.Data)
+	}
+
+	for _, window := range []string{"2h", "-1h", "soon"} {
+		if rec := env.authedRequest(t, http.MethodGet, "/api/v1/server/throughput?window="+window, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("window %s: status %d, want 400", window, rec.Code)
+		}
+	}
+
+	THROUGHPUT_SAMPLE_INTERVAL = 0
+	if rec := env.authedRequest(t, http.MethodGet, "/api/v1/server/throughput", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("sampling off: status %d, want 400", rec.Code)
+	}
+}
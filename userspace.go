@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Containers and old kernels have no WireGuard module, and often no systemd
+// to run wg-quick@ either. With WG_USERSPACE=auto (the default) the API then
+// runs a userspace implementation itself: /start launches wireguard-go,
+// boringtun or amneziawg-go in the foreground, sets the keys and peers over
+// the UAPI socket, and adds the addresses and MTU and runs PostUp like
+// wg-quick would; /stop runs PostDown and ends the process. Peer changes
+// keep going through wg syncconf, which talks to the same socket.
+// WG_USERSPACE=off always uses the unit; any other value is the command to
+// run, used whether or not the module is there.
+
+// Where userspace implementations put their UAPI sockets; a var so tests
+// can point it elsewhere
+var userspaceSocketDir = map[string]string{
+	"wireguard": "/var/run/wireguard",
+	"amneziawg": "/var/run/amneziawg",
+}
+
+// How long the process gets to open its socket, and to exit when stopped
+const userspaceStartTimeout = 5 * time.Second
+
+// Implementation the API runs, empty when the kernel module and the unit
+// are used
+var userspaceImpl string
+
+// A launched userspace process
+type userspaceProcess struct {
+	cmd       *exec.Cmd
+	startedAt time.Time
+	stopping  atomic.Bool
+	// Closed once the process ended; exitErr is set before
+	exited  chan struct{}
+	exitErr string
+}
+
+func (p *userspaceProcess) running() bool {
+	select {
+	case <-p.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// The latest process, and why it or its start failed
+var userspace struct {
+	mu      sync.Mutex
+	process *userspaceProcess
+	failure string
+}
+
+// Whether the backend's kernel module is loaded or can be, with a
+// description of which
+func kernelModuleAvailable() (bool, string) {
+	module := backendType
+	if _, err := os.Stat(filepath.Join(sysModuleDir, module)); err == nil {
+		return true, fmt.Sprintf("The %s kernel module is loaded", module)
+	}
+	if status, _ := executeCommandTimeout(STATUS_COMMAND_TIMEOUT, "modinfo", module); status == "success" {
+		return true, fmt.Sprintf("The %s kernel module is available and loads when the interface starts", module)
+	}
+	return false, fmt.Sprintf("No %s kernel module", module)
+}
+
+// The first installed userspace implementation of the backend
+func findUserspaceImplementation() string {
+	for _, cmd := range userspaceImplementations[backendType] {
+		if _, err := exec.LookPath(cmd); err == nil {
+			return cmd
+		}
+	}
+	return ""
+}
+
+// Pick the implementation as WG_USERSPACE says
+func setupUserspace() error {
+	switch WG_USERSPACE {
+	case "off", "":
+		return nil
+	case "auto":
+		if available, _ := kernelModuleAvailable(); available {
+			return nil
+		}
+		userspaceImpl = findUserspaceImplementation()
+		if userspaceImpl == "" {
+			log.Printf("No %s kernel module and no userspace implementation; the interface can't start", backendType)
+			return nil
+		}
+	default:
+		if _, err := exec.LookPath(WG_USERSPACE); err != nil {
+			return fmt.Errorf("WG_USERSPACE %s isn't installed", WG_USERSPACE)
+		}
+		userspaceImpl = WG_USERSPACE
+	}
+	log.Printf("Running %s for %s instead of %s", userspaceImpl, wgParams.ServerWGNIC, wgServicePrefix+wgParams.ServerWGNIC)
+	return nil
+}
+
+// Path of the interface's UAPI socket
+func userspaceSocket(nic string) string {
+	return filepath.Join(userspaceSocketDir[backendType], nic+".sock")
+}
+
+// A server config split into what the device takes over UAPI and what
+// wg-quick handles itself
+type userspaceConfig struct {
+	uapi      []string
+	addresses []string
+	mtu       string
+	postUp    []string
+	postDown  []string
+}
+
+// Keys are base64 in configs and hex over UAPI
+func uapiKey(value string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return "", errors.New("not a WireGuard key")
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// Turn a server config into UAPI set lines. Disabled peers are comments,
+// so they are left out like wg leaves them out.
+func parseUserspaceConfig(content []byte) (userspaceConfig, error) {
+	config := userspaceConfig{uapi: []string{"replace_peers=true"}}
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(line)
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+
+		switch section + key {
+		case "[interface]address":
+			config.addresses = append(config.addresses, splitList(value)...)
+		case "[interface]mtu":
+			config.mtu = value
+		case "[interface]postup":
+			config.postUp = append(config.postUp, value)
+		case "[interface]postdown":
+			config.postDown = append(config.postDown, value)
+		case "[interface]privatekey", "[peer]presharedkey":
+			hexKey, err := uapiKey(value)
+			if err != nil {
+				return config, fmt.Errorf("%s: %v", key, err)
+			}
+			name := map[string]string{"privatekey": "private_key", "presharedkey": "preshared_key"}[key]
+			config.uapi = append(config.uapi, name+"="+hexKey)
+		case "[interface]listenport":
+			config.uapi = append(config.uapi, "listen_port="+value)
+		case "[interface]fwmark":
+			if value == "off" {
+				value = "0"
+			}
+			config.uapi = append(config.uapi, "fwmark="+value)
+		case "[interface]jc", "[interface]jmin", "[interface]jmax", "[interface]s1", "[interface]s2",
+			"[interface]h1", "[interface]h2", "[interface]h3", "[interface]h4":
+			// AmneziaWG obfuscation settings keep their names
+			config.uapi = append(config.uapi, key+"="+value)
+		case "[peer]publickey":
+			hexKey, err := uapiKey(value)
+			if err != nil {
+				return config, fmt.Errorf("publickey %s: %v", value, err)
+			}
+			config.uapi = append(config.uapi, "public_key="+hexKey, "replace_allowed_ips=true")
+		case "[peer]allowedips":
+			for _, prefix := range splitList(value) {
+				config.uapi = append(config.uapi, "allowed_ip="+prefix)
+			}
+		case "[peer]endpoint":
+			addr, err := net.ResolveUDPAddr("udp", value)
+			if err != nil {
+				return config, fmt.Errorf("endpoint %s: %v", value, err)
+			}
+			config.uapi = append(config.uapi, "endpoint="+addr.String())
+		case "[peer]persistentkeepalive":
+			if value == "off" {
+				value = "0"
+			}
+			config.uapi = append(config.uapi, "persistent_keepalive_interval="+value)
+		}
+	}
+	return config, scanner.Err()
+}
+
+// Send a set operation to the socket and check its errno
+func uapiSet(socket string, lines []string) error {
+	conn, err := net.DialTimeout("unix", socket, userspaceStartTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(userspaceStartTimeout))
+
+	if _, err := conn.Write([]byte("set=1\n" + strings.Join(lines, "\n") + "\n\n")); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "errno=") && line != "errno=0" {
+			return fmt.Errorf("the device refused the config, %s", line)
+		}
+	}
+	return scanner.Err()
+}
+
+// Run wg-quick style hooks with %i as the interface
+func runUserspaceHooks(hooks []string, nic string) error {
+	for _, hook := range hooks {
+		if status, output := executeCommand("bash", "-c", strings.ReplaceAll(hook, "%i", nic)); status != "success" {
+			return fmt.Errorf("%s: %s", hook, output)
+		}
+	}
+	return nil
+}
+
+// Whether the userspace process is running. Caller holds userspace.mu.
+func userspaceRunningLocked() bool {
+	return userspace.process != nil && userspace.process.running()
+}
+
+// Launch the implementation and configure the interface like wg-quick up
+func startUserspaceInterface() error {
+	userspace.mu.Lock()
+	defer userspace.mu.Unlock()
+
+	if userspaceRunningLocked() {
+		return nil
+	}
+	nic := wgParams.ServerWGNIC
+	content, err := os.ReadFile(WG_CONFIG_FILE)
+	if err != nil {
+		return fmt.Errorf("failed to read WireGuard config: %v", err)
+	}
+	config, err := parseUserspaceConfig(content)
+	if err != nil {
+		return fmt.Errorf("invalid WireGuard config: %v", err)
+	}
+
+	socket := userspaceSocket(nic)
+	// A socket left by a crashed process would take the connection
+	os.Remove(socket)
+	cmd := exec.Command(userspaceImpl, "-f", nic)
+	cmd.Env = append(os.Environ(), "WG_PROCESS_FOREGROUND=1")
+	output := &strings.Builder{}
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", userspaceImpl, err)
+	}
+	process := &userspaceProcess{cmd: cmd, startedAt: time.Now().UTC(), exited: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		process.exitErr = fmt.Sprintf("%v: %s", err, strings.TrimSpace(output.String()))
+		close(process.exited)
+		if !process.stopping.Load() {
+			log.Printf("%s for %s exited: %s", userspaceImpl, nic, process.exitErr)
+		}
+		invalidateStatusCache()
+	}()
+	userspace.process, userspace.failure = process, ""
+
+	fail := func(err error) error {
+		process.stopping.Store(true)
+		cmd.Process.Kill()
+		<-process.exited
+		userspace.failure = err.Error()
+		return err
+	}
+	deadline := time.Now().Add(userspaceStartTimeout)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		select {
+		case <-process.exited:
+			return fail(fmt.Errorf("%s exited before opening %s: %s", userspaceImpl, socket, process.exitErr))
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return fail(fmt.Errorf("%s didn't open %s", userspaceImpl, socket))
+		}
+	}
+	if err := uapiSet(socket, config.uapi); err != nil {
+		return fail(fmt.Errorf("failed to configure %s: %v", nic, err))
+	}
+
+	for _, address := range config.addresses {
+		if status, output := executeCommand(ipCmd, "address", "add", address, "dev", nic); status != "success" {
+			return fail(fmt.Errorf("failed to add %s to %s: %s", address, nic, output))
+		}
+	}
+	link := []string{"link", "set", "up", "dev", nic}
+	if config.mtu != "" {
+		link = []string{"link", "set", "mtu", config.mtu, "up", "dev", nic}
+	}
+	if status, output := executeCommand(ipCmd, link...); status != "success" {
+		return fail(fmt.Errorf("failed to bring %s up: %s", nic, output))
+	}
+	if err := runUserspaceHooks(config.postUp, nic); err != nil {
+		return fail(fmt.Errorf("PostUp failed: %v", err))
+	}
+	invalidateStatusCache()
+	log.Printf("Started %s for %s (pid %d)", userspaceImpl, nic, cmd.Process.Pid)
+	return nil
+}
+
+// Run PostDown and end the process, which takes the interface with it
+func stopUserspaceInterface() error {
+	userspace.mu.Lock()
+	defer userspace.mu.Unlock()
+
+	if !userspaceRunningLocked() {
+		return nil
+	}
+	nic := wgParams.ServerWGNIC
+	if content, err := os.ReadFile(WG_CONFIG_FILE); err == nil {
+		if config, err := parseUserspaceConfig(content); err == nil {
+			if err := runUserspaceHooks(config.postDown, nic); err != nil {
+				log.Printf("PostDown of %s failed: %v", nic, err)
+			}
+		}
+	}
+
+	process := userspace.process
+	// Stopped on purpose, so the exit isn't reported as a crash
+	process.stopping.Store(true)
+	process.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-process.exited:
+	case <-time.After(userspaceStartTimeout):
+		process.cmd.Process.Kill()
+		<-process.exited
+	}
+	invalidateStatusCache()
+	return nil
+}
+
+// systemctl-like control of the userspace interface for
+// controlWireGuardService
+func controlUserspaceInterface(action string) (string, error) {
+	var err error
+	switch action {
+	case "start":
+		err = startUserspaceInterface()
+	case "stop":
+		err = stopUserspaceInterface()
+	case "restart":
+		if err = stopUserspaceInterface(); err == nil {
+			err = startUserspaceInterface()
+		}
+	}
+	if err != nil {
+		return err.Error(), fmt.Errorf("Failed to %s %s: %v", action, userspaceImpl, err)
+	}
+	return "", nil
+}
+
+// The userspace process for /status, nil when the kernel module is used
+func userspaceStatus() map[string]interface{} {
+	if userspaceImpl == "" {
+		return nil
+	}
+	userspace.mu.Lock()
+	defer userspace.mu.Unlock()
+
+	status := map[string]interface{}{
+		"implementation": userspaceImpl,
+		"socket":         userspaceSocket(wgParams.ServerWGNIC),
+		"running":        userspaceRunningLocked(),
+	}
+	switch process := userspace.process; {
+	case userspace.failure != "":
+		status["error"] = userspace.failure
+	case process == nil:
+	case process.running():
+		status["pid"] = process.cmd.Process.Pid
+		status["started_at"] = process.startedAt
+	case !process.stopping.Load():
+		status["error"] = "exited: " + process.exitErr
+	}
+	return status
+}
+
+// When the running process started, formatted like systemd's
+// ActiveEnterTimestamp; empty when it isn't running
+func userspaceStartedAt() string {
+	userspace.mu.Lock()
+	defer userspace.mu.Unlock()
+
+	if !userspaceRunningLocked() {
+		return ""
+	}
+	return userspace.process.startedAt.Format("Mon 2006-01-02 15:04:05 MST")
+}
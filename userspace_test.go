@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserspaceInterface(t *testing.T) {
+	env := setupTestEnv(t)
+	setupFakeIP(t, env)
+
+	key := func(b byte) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)) }
+	hexKey := func(b byte) string { return hex.EncodeToString(bytes.Repeat([]byte{b}, 32)) }
+	config := "[Interface]\nAddress = 10.66.0.1/16\nListenPort = 51820\nPrivateKey = " + key(1) + "\n\n" +
+		"### Client alice\n[Peer]\nPublicKey = " + key(2) + "\nAllowedIPs = 10.66.0.2/32\n\n" +
+		"### Client bob\n#[Peer]\n#PublicKey = " + key(3) + "\n#AllowedIPs = 10.66.0.3/32\n"
+	os.WriteFile(env.configFile, []byte(config), 0600)
+
+	// The fake implementation notes its arguments and waits to be stopped
+	argsFile := filepath.Join(env.dir, "userspace.args")
+	impl := filepath.Join(env.dir, "wireguard-go")
+	os.WriteFile(impl, []byte("#!/bin/bash\necho \"$*\" > "+argsFile+"\nexec sleep 60\n"), 0755)
+	socketDir := t.TempDir()
+	oldImpl, oldSocketDir := userspaceImpl, userspaceSocketDir
+	userspaceImpl, userspaceSocketDir = impl, map[string]string{"wireguard": socketDir}
+	t.Cleanup(func() {
+		stopUserspaceInterface()
+		userspaceImpl, userspaceSocketDir = oldImpl, oldSocketDir
+		userspace.process, userspace.failure = nil, ""
+	})
+
+	// Plays the device once the process is up: takes one set operation
+	uapi := make(chan string, 1)
+	go func() {
+		for {
+			if _, err := os.Stat(argsFile); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		listener, err := net.Listen("unix", filepath.Join(socketDir, "wg0.sock"))
+		if err != nil {
+			uapi <- err.Error()
+			return
+		}
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			uapi <- err.Error()
+			return
+		}
+		defer conn.Close()
+		var request strings.Builder
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() && scanner.Text() != "" {
+			request.WriteString(scanner.Text() + "\n")
+		}
+		conn.Write([]byte("errno=0\n\n"))
+		uapi <- request.String()
+	}()
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/start", nil); rec.Code != http.StatusOK {
+		t.Fatalf("start: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if args := readFile(t, argsFile); args != "-f wg0\n" {
+		t.Errorf("implementation args: %q", args)
+	}
+	request := <-uapi
+	for _, want := range []string{"set=1\n", "private_key=" + hexKey(1) + "\n", "listen_port=51820\n",
+		"public_key=" + hexKey(2) + "\n", "allowed_ip=10.66.0.2/32\n"} {
+		if !strings.Contains(request, want) {
+			t.Errorf("UAPI request lacks %q:\n%s", want, request)
+		}
+	}
+	if strings.Contains(request, hexKey(3)) {
+		t.Error("the disabled peer was configured")
+	}
+	ipLog := readFile(t, filepath.Join(env.dir, "ip.log"))
+	if !strings.Contains(ipLog, "address add 10.66.0.1/16 dev wg0") || !strings.Contains(ipLog, "link set up dev wg0") {
+		t.Errorf("ip calls: %s", ipLog)
+	}
+
+	status := func() map[string]interface{} {
+		t.Helper()
+		var resp struct {
+			Data struct {
+				Userspace map[string]interface{} `json:"userspace"`
+			} `json:"data"`
+		}
+		json.Unmarshal(env.authedRequest(t, http.MethodGet, "/api/v1/status", nil).Body.Bytes(), &resp)
+		return resp.Data.Userspace
+	}
+	if got := status(); got["running"] != true || got["pid"] == nil {
+		t.Errorf("status while running: %v", got)
+	}
+
+	if rec := env.authedRequest(t, http.MethodPost, "/api/v1/stop", nil); rec.Code != http.StatusOK {
+		t.Fatalf("stop: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if got := status(); got["running"] != false || got["error"] != nil {
+		t.Errorf("status after stop: %v", got)
+	}
+}
+
+func TestParseUserspaceConfigRejectsBadKeys(t *testing.T) {
+	if _, err := parseUserspaceConfig([]byte("[Interface]\nPrivateKey = not-a-key\n")); err == nil {
+		t.Error("an invalid private key was accepted")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Most names one POST /users/status may ask for
+const maxStatusNames = 1000
+
+// Body of POST /users/status
+type UsersStatusRequest struct {
+	Names []string `json:"names" binding:"required"`
+}
+
+// Handler for POST /users/status: the live status of only the named
+// clients, for dashboards tracking a few of many peers. Served from the
+// same cache as GET /status and takes its ?refresh= and ?format=.
+func usersStatusHandlerGin(c *gin.Context) {
+	format, ok := parseTransferFormat(c)
+	if !ok {
+		return
+	}
+	var req UsersStatusRequest
+	if !bindJSON(c, &req) {
+		return
+	}
+	if len(req.Names) == 0 || len(req.Names) > maxStatusNames {
+		c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Message: fmt.Sprintf("names must list between 1 and %d client names", maxStatusNames),
+		})
+		return
+	}
+
+	data, collectedAt, cached := getWireGuardStatus(c.Query("refresh") == "true")
+	all, _ := data["peers"].([]map[string]interface{})
+	byName := make(map[string]map[string]interface{}, len(all))
+	for _, peer := range all {
+		if name, ok := peer["client_name"].(string); ok {
+			byName[name] = peer
+		}
+	}
+
+	// In the order asked, each name once. Names that aren't clients or have
+	// no peer on the interface, e.g. while it is down, are missing.
+	peers := make([]map[string]interface{}, 0, len(req.Names))
+	missing := []string{}
+	seen := make(map[string]bool, len(req.Names))
+	for _, name := range req.Names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if peer, ok := byName[name]; ok {
+			peers = append(peers, formatPeerTransfer(peer, format))
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	respondNegotiated(c, http.StatusOK, APIResponse{
+		Success: true,
+		Data: gin.H{
+			"peers":        peers,
+			"missing":      missing,
+			"running":      data["running"],
+			"cached":       cached,
+			"collected_at": collectedAt.UTC().Format(time.RFC3339),
+		},
+	}, func() [][]string {
+		selected := make([]map[string]interface{}, 0, len(peers))
+		for _, peer := range peers {
+			selected = append(selected, byName[peer["client_name"].(string)])
+		}
+		return peerStatusTable(selected)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUsersStatus(t *testing.T) {
+	env := setupTestEnv(t)
+	alice := addedClient(t, env, "alice")
+	bob := addedClient(t, env, "bob")
+	addedClient(t, env, "carol")
+	now := time.Now().Unix()
+	env.writeDump(t,
+		fmt.Sprintf("%s\t(none)\t198.51.100.1:4000\t10.66.0.2/32\t%d\t1024\t2048\t25", alice.PublicKey, now-30),
+		fmt.Sprintf("%s\t(none)\t(none)\t10.66.0.3/32\t0\t0\t0\toff", bob.PublicKey),
+	)
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/status?format=raw", UsersStatusRequest{Names: []string{"bob", "alice", "ghost", "bob"}})
+	var resp struct {
+		Data struct {
+			Peers   []map[string]interface{} `json:"peers"`
+			Missing []string                 `json:"missing"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d, %s", rec.Code, rec.Body.String())
+	}
+	var names []interface{}
+	for _, peer := range resp.Data.Peers {
+		names = append(names, peer["client_name"])
+	}
+	if !reflect.DeepEqual(names, []interface{}{"bob", "alice"}) || !reflect.DeepEqual(resp.Data.Missing, []string{"ghost"}) {
+		t.Errorf("got peers %v, missing %v", names, resp.Data.Missing)
+	}
+	if resp.Data.Peers[1]["transfer_rx_bytes"] != float64(1024) || resp.Data.Peers[1]["endpoint"] != "198.51.100.1:4000" {
+		t.Errorf("alice: %+v", resp.Data.Peers[1])
+	}
+
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/status", UsersStatusRequest{Names: []string{}}).Code; code != http.StatusBadRequest {
+		t.Errorf("no names: got status %d, want 400", code)
+	}
+}
+
+func TestUsersStatusOnlyReads(t *testing.T) {
+	env := setupTestEnv(t)
+	setReadOnlyTokens(t, "reader-token")
+	addedClient(t, env, "alice")
+	readOnlyMode.Store(true)
+	t.Cleanup(func() { readOnlyMode.Store(false) })
+
+	body := UsersStatusRequest{Names: []string{"alice"}}
+	if rec := env.request(t, http.MethodPost, "/api/v1/users/status", body, "reader-token"); rec.Code != http.StatusOK {
+		t.Errorf("read-only token in read-only mode: status %d, %s", rec.Code, rec.Body.String())
+	}
+	if code, _ := changesSince(t, env, "?since=1"); code != http.StatusOK {
+		t.Errorf("changes: status %d", code)
+	}
+}
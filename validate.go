@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Addresses, DNS servers and networks from requests end up verbatim in
+// wg0.conf and the client configs, where one malformed value makes
+// syncconf fail for every client. They are checked strictly before
+// anything is written, and each bad field is answered with a 422 naming it.
+
+// One invalid request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// The invalid fields of a request, as an error
+type fieldErrors []FieldError
+
+func (e *fieldErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// nil when there are none, so the result can be returned as an error
+func (e fieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e fieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fe := range e {
+		messages[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// A host address of the given family, no zone, prefix or special address
+func parseHostAddr(value string, ipv6 bool) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(value)
+	switch {
+	case err != nil || addr.Zone() != "":
+		return addr, fmt.Errorf("%q is not an IP address", value)
+	case ipv6 && !(addr.Is6() && !addr.Is4In6()):
+		return addr, fmt.Errorf("%q is not an IPv6 address", value)
+	case !ipv6 && !addr.Is4():
+		return addr, fmt.Errorf("%q is not an IPv4 address", value)
+	case addr.IsUnspecified() || addr.IsLoopback() || addr.IsMulticast():
+		return addr, fmt.Errorf("%s can't be a client address", value)
+	}
+	return addr, nil
+}
+
+// The caller-supplied addresses of a new client; empty ones are allocated
+func validateClientAddresses(ipv4, ipv6 string) fieldErrors {
+	var errs fieldErrors
+	if ipv4 != "" {
+		if _, err := parseHostAddr(ipv4, false); err != nil {
+			errs.add("ipv4", "%v", err)
+		}
+	}
+	if ipv6 != "" {
+		if _, err := parseHostAddr(ipv6, true); err != nil {
+			errs.add("ipv6", "%v", err)
+		}
+	}
+	return errs
+}
+
+// Comma-separated networks as written to AllowedIPs, each with its host
+// bits cleared
+func validateAllowedIPs(field, value string) fieldErrors {
+	var errs fieldErrors
+	for i, network := range strings.Split(value, ",") {
+		network = strings.TrimSpace(network)
+		prefix, err := netip.ParsePrefix(network)
+		switch {
+		case err != nil:
+			errs.add(fmt.Sprintf("%s[%d]", field, i), "%q is not a CIDR", network)
+		case prefix.Masked() != prefix:
+			errs.add(fmt.Sprintf("%s[%d]", field, i), "%q has host bits set; did you mean %s?", network, prefix.Masked())
+		}
+	}
+	return errs
+}
+
+func (r AddUserRequest) validateFields() error {
+	errs := validateClientAddresses(r.IPV4, r.IPV6)
+	if r.DNS != nil {
+		errs = append(errs, r.DNS.fieldErrors("dns")...)
+	}
+	return errs.err()
+}
+
+// Answer err with 422 and the invalid fields when it has them, 400 otherwise
+func respondValidationError(c *gin.Context, err error) {
+	var errs fieldErrors
+	if errors.As(err, &errs) {
+		c.JSON(http.StatusUnprocessableEntity, APIResponse{
+			Success: false,
+			Message: "Invalid fields: " + errs.Error(),
+			Code:    codeInvalidFields,
+			Errors:  errs,
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, APIResponse{
+		Success: false,
+		Message: err.Error(),
+		Code:    errorCode(err),
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAddUserRejectsMalformedAddresses(t *testing.T) {
+	env := setupTestEnv(t)
+	before := env.configContent(t)
+
+	for _, tc := range []struct {
+		req    AddUserRequest
+		fields []string
+	}{
+		{AddUserRequest{Name: "alice", IPV4: "10.66.0.5\nPostUp = id"}, []string{"ipv4"}},
+		{AddUserRequest{Name: "alice", IPV4: "10.66.0.300"}, []string{"ipv4"}},
+		{AddUserRequest{Name: "alice", IPV4: "10.66.0.5/32"}, []string{"ipv4"}},
+		{AddUserRequest{Name: "alice", IPV4: "fd42::5"}, []string{"ipv4"}},
+		{AddUserRequest{Name: "alice", IPV4: "0.0.0.0"}, []string{"ipv4"}},
+		{AddUserRequest{Name: "alice", IPV6: "10.66.0.5"}, []string{"ipv6"}},
+		{AddUserRequest{Name: "alice", IPV6: "::ffff:10.66.0.5"}, []string{"ipv6"}},
+		{AddUserRequest{Name: "alice", IPV6: "fe80::1%wg0"}, []string{"ipv6"}},
+		{AddUserRequest{Name: "alice", IPV4: "x", DNS: &ClientDNS{Servers: []string{"1.1.1.1", "dns"}, SearchDomains: []string{"a b"}}},
+			[]string{"ipv4", "dns.servers[1]", "dns.search_domains[0]"}},
+	} {
+		rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", tc.req)
+		var resp APIResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		var fields []string
+		for _, fe := range resp.Errors {
+			fields = append(fields, fe.Field)
+		}
+		if rec.Code != http.StatusUnprocessableEntity || resp.Code != codeInvalidFields || !reflect.DeepEqual(fields, tc.fields) {
+			t.Errorf("%+v: got status %d, fields %v: %s", tc.req, rec.Code, fields, rec.Body.String())
+		}
+	}
+
+	if after := env.configContent(t); after != before {
+		t.Errorf("nothing may be written for invalid requests:\n%s", after)
+	}
+
+	rec := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice", IPV4: "10.66.0.5"})
+	if rec.Code != http.StatusOK || !strings.Contains(env.configContent(t), "AllowedIPs = 10.66.0.5/32") {
+		t.Errorf("valid address: got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestValidateAllowedIPs(t *testing.T) {
+	if errs := validateAllowedIPs("allowed_ips", "0.0.0.0/0, ::/0,10.0.0.0/8"); len(errs) != 0 {
+		t.Errorf("valid networks: %v", errs)
+	}
+	errs := validateAllowedIPs("allowed_ips", "10.0.0.0/8,10.0.0.1/8,,bogus")
+	want := []string{"allowed_ips[1]", "allowed_ips[2]", "allowed_ips[3]"}
+	var fields []string
+	for _, fe := range errs {
+		fields = append(fields, fe.Field)
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("got %v, want %v", errs, want)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// After a restart the first lookup rebuilds the client inventory and the
+// first status request collects from scratch, each many times slower than
+// the cached steady state. Both are built in the background at startup
+// instead, and again every CACHE_REFRESH_INTERVAL, so the first request
+// after a restart or a quiet spell finds them ready. A request arriving
+// during the first collection waits for it rather than starting another.
+
+// Rebuild the inventory if the config changed, and collect the status
+func warmCaches() {
+	start := time.Now()
+	if _, err := currentInventory(); err != nil {
+		log.Printf("Warming the client inventory: %v", err)
+	}
+	if STATUS_CACHE_TTL > 0 {
+		getWireGuardStatus(true)
+	}
+	if DEBUG_MODE {
+		log.Printf("Caches warmed in %s", time.Since(start))
+	}
+}
+
+// Warm the caches now, then every CACHE_REFRESH_INTERVAL. A zero interval
+// only warms them at startup.
+func startCacheWarmer() {
+	go func() {
+		warmCaches()
+		if CACHE_REFRESH_INTERVAL <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(CACHE_REFRESH_INTERVAL)
+		defer ticker.Stop()
+		for range ticker.C {
+			warmCaches()
+		}
+	}()
+}
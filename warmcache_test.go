@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestWarmCaches(t *testing.T) {
+	env := setupTestEnv(t)
+	if code := env.authedRequest(t, http.MethodPost, "/api/v1/users/add", AddUserRequest{Name: "alice"}).Code; code != http.StatusOK {
+		t.Fatalf("seeding failed with status %d", code)
+	}
+	inventoryMutex.Lock()
+	inventoryData = nil
+	inventoryMutex.Unlock()
+	invalidateStatusCache()
+
+	warmCaches()
+
+	inventoryMutex.Lock()
+	warmed := inventoryData
+	inventoryMutex.Unlock()
+	if warmed == nil || !warmed.names["alice"] {
+		t.Fatalf("inventory not built: %+v", warmed)
+	}
+
+	rec := env.authedRequest(t, http.MethodGet, "/api/v1/status", nil)
+	var resp struct {
+		Data struct {
+			Cached bool `json:"cached"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding status: %v", err)
+	}
+	if !resp.Data.Cached {
+		t.Errorf("the first status after warming must come from the cache: %s", rec.Body.String())
+	}
+}
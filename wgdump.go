@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Status, stats, sessions and the pollers all read the peers as the output
+// of `wg show <interface> dump`. Spawning wg for every read adds up when
+// monitoring polls every few seconds, so with the kernel module the dump is
+// read over a netlink socket kept open for the process's lifetime and
+// rendered in wg's format, which every parser already understands. wg is
+// still run for AmneziaWG, userspace implementations, with WG_NETLINK=false
+// and whenever netlink fails. Peer changes keep going through `wg syncconf`,
+// which applies the whole config at once for both backends.
+
+// An interface as the kernel reports it
+type wgDevice struct {
+	privateKey [32]byte
+	publicKey  [32]byte
+	listenPort uint16
+	fwmark     uint32
+	peers      []wgPeer
+}
+
+type wgPeer struct {
+	publicKey     [32]byte
+	presharedKey  [32]byte
+	endpoint      string // host:port, empty when unknown
+	allowedIPs    []string
+	lastHandshake int64 // Unix seconds, 0 when never
+	rxBytes       uint64
+	txBytes       uint64
+	keepalive     uint16 // seconds, 0 when off
+}
+
+// The dump of the server interface, like executeCommand's result
+func wireGuardDump() (string, string) {
+	return interfaceDump(wgParams.ServerWGNIC)
+}
+
+// The dump of any WireGuard interface on the host
+func interfaceDump(nic string) (string, string) {
+	if WG_NETLINK && backendType == "wireguard" {
+		device, err := netlinkDevice(nic)
+		if err == nil {
+			return "success", device.dump()
+		}
+		if DEBUG_MODE {
+			log.Printf("Reading %s over netlink failed, running %s: %v", nic, wgCmd, err)
+		}
+	}
+	return executeCommandTimeout(STATUS_COMMAND_TIMEOUT, wgCmd, "show", nic, "dump")
+}
+
+// Render the device like `wg show <interface> dump`: the interface, then a
+// line per peer, with tab-separated fields
+func (d *wgDevice) dump() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\t%s\t%d\t%s\n", dumpKey(d.privateKey), dumpKey(d.publicKey), d.listenPort, dumpOff(uint64(d.fwmark)))
+	for _, peer := range d.peers {
+		endpoint, allowedIPs := peer.endpoint, strings.Join(peer.allowedIPs, ",")
+		if endpoint == "" {
+			endpoint = "(none)"
+		}
+		if allowedIPs == "" {
+			allowedIPs = "(none)"
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			dumpKey(peer.publicKey), dumpKey(peer.presharedKey), endpoint, allowedIPs,
+			peer.lastHandshake, peer.rxBytes, peer.txBytes, dumpOff(uint64(peer.keepalive)))
+	}
+	return b.String()
+}
+
+// Base64 as wg prints keys, "(none)" for an unset one
+func dumpKey(key [32]byte) string {
+	if key == [32]byte{} {
+		return "(none)"
+	}
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+func dumpOff(value uint64) string {
+	if value == 0 {
+		return "off"
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// How long to wait before opening the socket again when the kernel had
+	// no wireguard family, e.g. before wg-quick loaded the module
+	netlinkRetryInterval = time.Minute
+	// Longest a read may take
+	netlinkTimeout = 5 * time.Second
+	// Large enough for any message of a dump, which the kernel keeps to 32k
+	netlinkBufferSize = 64 * 1024
+)
+
+var (
+	errNetlinkUnavailable = errors.New("wireguard netlink family unavailable")
+	errNetlinkMalformed   = errors.New("malformed netlink message")
+)
+
+// Netlink fields are in host byte order
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// An error the kernel answered a request with; the socket stays usable
+type netlinkReplyError struct {
+	errno unix.Errno
+}
+
+func (e netlinkReplyError) Error() string {
+	return "netlink: " + e.errno.Error()
+}
+
+// A generic netlink socket to the wireguard family, opened on first use and
+// reopened after a failure leaves it in an unknown state
+type wgNetlink struct {
+	mu       sync.Mutex
+	fd       int // -1 when closed
+	family   uint16
+	seq      uint32
+	failedAt time.Time
+}
+
+var wgNetlinkHandle = &wgNetlink{fd: -1}
+
+// Read an interface over the shared netlink socket
+func netlinkDevice(name string) (*wgDevice, error) {
+	return wgNetlinkHandle.device(name)
+}
+
+func (h *wgNetlink) device(name string) (*wgDevice, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.fd < 0 {
+		if time.Since(h.failedAt) < netlinkRetryInterval {
+			return nil, errNetlinkUnavailable
+		}
+		if err := h.open(); err != nil {
+			h.failedAt = time.Now()
+			return nil, err
+		}
+	}
+
+	payloads, err := h.request(h.family, unix.WG_CMD_GET_DEVICE, unix.NLM_F_DUMP, nlAttr(unix.WGDEVICE_A_IFNAME, append([]byte(name), 0)))
+	if err != nil {
+		var reply netlinkReplyError
+		if !errors.As(err, &reply) {
+			h.close()
+		}
+		return nil, err
+	}
+	return parseWGDevice(payloads)
+}
+
+// Open the socket and look up the wireguard family. Caller holds mu.
+func (h *wgNetlink) open() error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+	timeout := unix.NsecToTimeval(netlinkTimeout.Nanoseconds())
+	err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout)
+	if err == nil {
+		err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK})
+	}
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to set up netlink socket: %v", err)
+	}
+	h.fd = fd
+
+	payloads, err := h.request(unix.GENL_ID_CTRL, unix.CTRL_CMD_GETFAMILY, 0, nlAttr(unix.CTRL_ATTR_FAMILY_NAME, append([]byte(unix.WG_GENL_NAME), 0)))
+	if err == nil {
+		err = errNetlinkUnavailable
+		for _, payload := range payloads {
+			attrs, _ := parseNlAttrs(payload)
+			for _, attr := range attrs {
+				if attr.typ == unix.CTRL_ATTR_FAMILY_ID && len(attr.data) >= 2 {
+					h.family, err = nativeEndian.Uint16(attr.data), nil
+				}
+			}
+		}
+	}
+	if err != nil {
+		h.close()
+		return fmt.Errorf("failed to find the wireguard netlink family: %v", err)
+	}
+	return nil
+}
+
+// Caller holds mu
+func (h *wgNetlink) close() {
+	if h.fd >= 0 {
+		unix.Close(h.fd)
+		h.fd = -1
+	}
+}
+
+// Send a generic netlink request and collect the payloads, after the genl
+// header, of its replies. Caller holds mu.
+func (h *wgNetlink) request(family uint16, cmd uint8, flags uint16, attrs []byte) ([][]byte, error) {
+	h.seq++
+	msg := make([]byte, unix.SizeofNlMsghdr+4, unix.SizeofNlMsghdr+4+len(attrs))
+	msg = append(msg, attrs...)
+	nativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:6], family)
+	nativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|flags)
+	nativeEndian.PutUint32(msg[8:12], h.seq)
+	msg[unix.SizeofNlMsghdr] = cmd
+	msg[unix.SizeofNlMsghdr+1] = unix.WG_GENL_VERSION
+	if err := unix.Sendto(h.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var payloads [][]byte
+	buf := make([]byte, netlinkBufferSize)
+	for {
+		n, _, recvflags, _, err := unix.Recvmsg(h.fd, buf, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if recvflags&unix.MSG_TRUNC != 0 {
+			return nil, errNetlinkMalformed
+		}
+		for data := buf[:n]; len(data) >= unix.SizeofNlMsghdr; {
+			length := int(nativeEndian.Uint32(data[0:4]))
+			if length < unix.SizeofNlMsghdr || length > len(data) {
+				return nil, errNetlinkMalformed
+			}
+			typ, msgFlags, seq := nativeEndian.Uint16(data[4:6]), nativeEndian.Uint16(data[6:8]), nativeEndian.Uint32(data[8:12])
+			body := data[unix.SizeofNlMsghdr:length]
+			data = data[nlAlign(length, len(data)):]
+			if seq != h.seq {
+				continue
+			}
+
+			switch typ {
+			case unix.NLMSG_DONE, unix.NLMSG_ERROR:
+				// An error code, 0 for an acknowledgement
+				if len(body) >= 4 {
+					if code := int32(nativeEndian.Uint32(body)); code < 0 {
+						return nil, netlinkReplyError{errno: unix.Errno(-code)}
+					}
+				}
+				return payloads, nil
+			}
+			if len(body) < 4 {
+				return nil, errNetlinkMalformed
+			}
+			payloads = append(payloads, append([]byte(nil), body[4:]...))
+			if msgFlags&unix.NLM_F_MULTI == 0 {
+				return payloads, nil
+			}
+		}
+	}
+}
+
+type nlAttribute struct {
+	typ  uint16
+	data []byte
+}
+
+// Length padded to the 4-byte alignment, capped at max
+func nlAlign(length, max int) int {
+	aligned := (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+	if aligned > max {
+		return max
+	}
+	return aligned
+}
+
+// Encode an attribute with its padding
+func nlAttr(typ uint16, data []byte) []byte {
+	attr := make([]byte, nlAlign(unix.SizeofNlAttr+len(data), 1<<16))
+	nativeEndian.PutUint16(attr[0:2], uint16(unix.SizeofNlAttr+len(data)))
+	nativeEndian.PutUint16(attr[2:4], typ)
+	copy(attr[unix.SizeofNlAttr:], data)
+	return attr
+}
+
+// Decode consecutive attributes; nested ones are decoded from their data
+func parseNlAttrs(b []byte) ([]nlAttribute, error) {
+	var attrs []nlAttribute
+	for len(b) >= unix.SizeofNlAttr {
+		length := int(nativeEndian.Uint16(b[0:2]))
+		if length < unix.SizeofNlAttr || length > len(b) {
+			return nil, errNetlinkMalformed
+		}
+		attrs = append(attrs, nlAttribute{
+			typ:  nativeEndian.Uint16(b[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER),
+			data: b[unix.SizeofNlAttr:length],
+		})
+		b = b[nlAlign(length, len(b)):]
+	}
+	return attrs, nil
+}
+
+// Assemble a device from the messages of a WG_CMD_GET_DEVICE dump. Peers
+// are spread over the messages, and a peer with more allowed IPs than fit
+// in one continues in the next under the same public key.
+func parseWGDevice(payloads [][]byte) (*wgDevice, error) {
+	device := &wgDevice{}
+	for _, payload := range payloads {
+		attrs, err := parseNlAttrs(payload)
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			switch {
+			case attr.typ == unix.WGDEVICE_A_PRIVATE_KEY:
+				copy(device.privateKey[:], attr.data)
+			case attr.typ == unix.WGDEVICE_A_PUBLIC_KEY:
+				copy(device.publicKey[:], attr.data)
+			case attr.typ == unix.WGDEVICE_A_LISTEN_PORT && len(attr.data) >= 2:
+				device.listenPort = nativeEndian.Uint16(attr.data)
+			case attr.typ == unix.WGDEVICE_A_FWMARK && len(attr.data) >= 4:
+				device.fwmark = nativeEndian.Uint32(attr.data)
+			case attr.typ == unix.WGDEVICE_A_PEERS:
+				peers, err := parseNlAttrs(attr.data)
+				if err != nil {
+					return nil, err
+				}
+				for _, nested := range peers {
+					peer, err := parseWGPeer(nested.data)
+					if err != nil {
+						return nil, err
+					}
+					if last := len(device.peers) - 1; last >= 0 && device.peers[last].publicKey == peer.publicKey {
+						device.peers[last].allowedIPs = append(device.peers[last].allowedIPs, peer.allowedIPs...)
+						continue
+					}
+					device.peers = append(device.peers, peer)
+				}
+			}
+		}
+	}
+	return device, nil
+}
+
+func parseWGPeer(b []byte) (wgPeer, error) {
+	var peer wgPeer
+	attrs, err := parseNlAttrs(b)
+	if err != nil {
+		return peer, err
+	}
+	for _, attr := range attrs {
+		switch {
+		case attr.typ == unix.WGPEER_A_PUBLIC_KEY:
+			copy(peer.publicKey[:], attr.data)
+		case attr.typ == unix.WGPEER_A_PRESHARED_KEY:
+			copy(peer.presharedKey[:], attr.data)
+		case attr.typ == unix.WGPEER_A_ENDPOINT:
+			peer.endpoint = parseSockaddr(attr.data)
+		case attr.typ == unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL && len(attr.data) >= 2:
+			peer.keepalive = nativeEndian.Uint16(attr.data)
+		case attr.typ == unix.WGPEER_A_LAST_HANDSHAKE_TIME && len(attr.data) >= 8:
+			// struct __kernel_timespec; wg shows whole seconds
+			peer.lastHandshake = int64(nativeEndian.Uint64(attr.data))
+		case attr.typ == unix.WGPEER_A_RX_BYTES && len(attr.data) >= 8:
+			peer.rxBytes = nativeEndian.Uint64(attr.data)
+		case attr.typ == unix.WGPEER_A_TX_BYTES && len(attr.data) >= 8:
+			peer.txBytes = nativeEndian.Uint64(attr.data)
+		case attr.typ == unix.WGPEER_A_ALLOWEDIPS:
+			ips, err := parseNlAttrs(attr.data)
+			if err != nil {
+				return peer, err
+			}
+			for _, nested := range ips {
+				if ip := parseAllowedIP(nested.data); ip != "" {
+					peer.allowedIPs = append(peer.allowedIPs, ip)
+				}
+			}
+		}
+	}
+	return peer, nil
+}
+
+// An allowed IP as address/prefix length
+func parseAllowedIP(b []byte) string {
+	attrs, err := parseNlAttrs(b)
+	if err != nil {
+		return ""
+	}
+	var ip net.IP
+	mask := -1
+	for _, attr := range attrs {
+		switch {
+		case attr.typ == unix.WGALLOWEDIP_A_IPADDR && (len(attr.data) == net.IPv4len || len(attr.data) == net.IPv6len):
+			ip = net.IP(attr.data)
+		case attr.typ == unix.WGALLOWEDIP_A_CIDR_MASK && len(attr.data) >= 1:
+			mask = int(attr.data[0])
+		}
+	}
+	if ip == nil || mask < 0 {
+		return ""
+	}
+	return ip.String() + "/" + strconv.Itoa(mask)
+}
+
+// A sockaddr_in or sockaddr_in6 as host:port, as wg shows endpoints. The
+// family is in host and the port in network byte order.
+func parseSockaddr(b []byte) string {
+	if len(b) < 4 {
+		return ""
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b[2:4])))
+	switch family := nativeEndian.Uint16(b[0:2]); {
+	case family == unix.AF_INET && len(b) >= 8:
+		return net.JoinHostPort(net.IP(b[4:8]).String(), port)
+	case family == unix.AF_INET6 && len(b) >= 24:
+		return net.JoinHostPort(net.IP(b[8:24]).String(), port)
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func nlU16(v uint16) []byte {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, v)
+	return b
+}
+
+func nlU64(v uint64) []byte {
+	b := make([]byte, 8)
+	nativeEndian.PutUint64(b, v)
+	return b
+}
+
+func nlNested(typ uint16, attrs ...[]byte) []byte {
+	return nlAttr(typ|unix.NLA_F_NESTED, bytes.Join(attrs, nil))
+}
+
+func testKey(fill byte) []byte {
+	return []byte(strings.Repeat(string(fill), 32))
+}
+
+func allowedIP(addr []byte, mask byte) []byte {
+	family := uint16(unix.AF_INET)
+	if len(addr) == 16 {
+		family = unix.AF_INET6
+	}
+	return nlNested(0, nlAttr(unix.WGALLOWEDIP_A_FAMILY, nlU16(family)), nlAttr(unix.WGALLOWEDIP_A_IPADDR, addr), nlAttr(unix.WGALLOWEDIP_A_CIDR_MASK, []byte{mask}))
+}
+
+func TestParseWGDeviceDump(t *testing.T) {
+	endpoint4 := make([]byte, 16)
+	nativeEndian.PutUint16(endpoint4, unix.AF_INET)
+	binary.BigEndian.PutUint16(endpoint4[2:], 51820)
+	copy(endpoint4[4:], []byte{198, 51, 100, 7})
+	endpoint6 := make([]byte, 28)
+	nativeEndian.PutUint16(endpoint6, unix.AF_INET6)
+	binary.BigEndian.PutUint16(endpoint6[2:], 4500)
+	endpoint6[8], endpoint6[9], endpoint6[23] = 0x20, 0x01, 0x01
+
+	handshake := append(nlU64(1700000000), nlU64(500)...)
+	first := string(nlAttr(unix.WGDEVICE_A_IFNAME, []byte("wg0\x00"))) +
+		string(nlAttr(unix.WGDEVICE_A_PRIVATE_KEY, testKey('a'))) +
+		string(nlAttr(unix.WGDEVICE_A_PUBLIC_KEY, testKey('b'))) +
+		string(nlAttr(unix.WGDEVICE_A_LISTEN_PORT, nlU16(51820))) +
+		string(nlNested(unix.WGDEVICE_A_PEERS,
+			nlNested(0,
+				nlAttr(unix.WGPEER_A_PUBLIC_KEY, testKey('c')),
+				nlAttr(unix.WGPEER_A_PRESHARED_KEY, testKey('d')),
+				nlAttr(unix.WGPEER_A_ENDPOINT, endpoint4),
+				nlAttr(unix.WGPEER_A_LAST_HANDSHAKE_TIME, handshake),
+				nlAttr(unix.WGPEER_A_RX_BYTES, nlU64(1024)),
+				nlAttr(unix.WGPEER_A_TX_BYTES, nlU64(2048)),
+				nlAttr(unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL, nlU16(25)),
+				nlNested(unix.WGPEER_A_ALLOWEDIPS, allowedIP([]byte{10, 66, 0, 2}, 32)),
+			),
+		))
+	// The second message continues the peer's allowed IPs, then another peer
+	second := string(nlAttr(unix.WGDEVICE_A_IFNAME, []byte("wg0\x00"))) +
+		string(nlNested(unix.WGDEVICE_A_PEERS,
+			nlNested(0,
+				nlAttr(unix.WGPEER_A_PUBLIC_KEY, testKey('c')),
+				nlNested(unix.WGPEER_A_ALLOWEDIPS, allowedIP(append([]byte{0xfd, 0x42}, make([]byte, 14)...), 64)),
+			),
+			nlNested(1,
+				nlAttr(unix.WGPEER_A_PUBLIC_KEY, testKey('e')),
+				nlAttr(unix.WGPEER_A_ENDPOINT, endpoint6),
+			),
+		))
+
+	device, err := parseWGDevice([][]byte{[]byte(first), []byte(second)})
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	key := func(fill byte) string { return base64.StdEncoding.EncodeToString(testKey(fill)) }
+	want := strings.Join([]string{
+		key('a') + "\t" + key('b') + "\t51820\toff",
+		key('c') + "\t" + key('d') + "\t198.51.100.7:51820\t10.66.0.2/32,fd42::/64\t1700000000\t1024\t2048\t25",
+		key('e') + "\t(none)\t[2001::1]:4500\t(none)\t0\t0\t0\toff",
+	}, "\n") + "\n"
+	if got := device.dump(); got != want {
+		t.Errorf("unexpected dump:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The dump parses like wg's
+	peers := parseWGDump(device.dump())
+	if len(peers) != 2 || peers[0].TransferTx != 2048 || peers[0].LatestHandshake != 1700000000 {
+		t.Errorf("unexpected peers: %+v", peers)
+	}
+
+	if _, err := parseWGDevice([][]byte{{0xff, 0x00, 0x01, 0x00}}); err == nil {
+		t.Error("a truncated attribute must be rejected")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Only Linux has the WireGuard netlink API; elsewhere wg is always run
+func netlinkDevice(name string) (*wgDevice, error) {
+	return nil, errors.New("netlink is only available on Linux")
+}